@@ -0,0 +1,126 @@
+package kite
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AccessLogFormat is the format of the entries written by AccessLog.
+type AccessLogFormat int
+
+const (
+	// AccessLogJSON writes every entry as a JSON encoded AccessLogEntry
+	// on a separate line.
+	AccessLogJSON AccessLogFormat = iota
+
+	// AccessLogCombined writes entries in the style of the Apache combined
+	// log format, with the called method in place of the request line,
+	// the status being "ok" or the type of the returned error, the ID
+	// and the name of the calling kite in place of the referer and the
+	// user agent, and the duration of the call appended:
+	//
+	//	127.0.0.1 - alice [17/Oct/2026:10:00:00 +0000] "square" ok 1 "4f7e1c2d-..." "exp/0.0.1" 0.123
+	//
+	// The duration is given in milliseconds. Missing values are written as "-".
+	AccessLogCombined
+)
+
+// AccessLogEntry describes a method call served by the kite.
+type AccessLogEntry struct {
+	Time       time.Time     `json:"time"`
+	RequestID  string        `json:"requestID,omitempty"`
+	Method     string        `json:"method"`
+	KiteID     string        `json:"kiteID,omitempty"`
+	Kite       string        `json:"kite,omitempty"` // name/version of the caller
+	Username   string        `json:"username,omitempty"`
+	RemoteAddr string        `json:"remoteAddr,omitempty"`
+	Duration   time.Duration `json:"duration"` // in nanoseconds
+	Size       int           `json:"size"`     // of the JSON encoded result
+	Error      *Error        `json:"error,omitempty"`
+}
+
+// AccessLog writes an entry for every method call served by the kite to w,
+// in the given format. Calls rejected before executing the method, e.g. due
+// to failed authentication or throttling, are logged as well.
+//
+// Size of the result is computed by encoding it with JSON, it is zero
+// for errors and streamed responses.
+func (k *Kite) AccessLog(w io.Writer, format AccessLogFormat) {
+	var mu sync.Mutex
+
+	k.OnResponse(func(r *Request, elapsed time.Duration, err *Error) {
+		e := newAccessLogEntry(r, elapsed, err)
+
+		var line []byte
+		switch format {
+		case AccessLogCombined:
+			line = e.combined()
+		default:
+			line, _ = json.Marshal(e)
+			line = append(line, '\n')
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		if _, err := w.Write(line); err != nil {
+			k.Log.Warning("Unable to write access log: %s", err)
+		}
+	})
+}
+
+func newAccessLogEntry(r *Request, elapsed time.Duration, err *Error) *AccessLogEntry {
+	e := &AccessLogEntry{
+		Time:       time.Now().Add(-elapsed),
+		RequestID:  r.ID,
+		Method:     r.Method,
+		KiteID:     r.Client.Kite.ID,
+		Username:   r.Username,
+		RemoteAddr: ThrottleByRemoteIP(r),
+		Duration:   elapsed,
+		Error:      err,
+	}
+
+	if r.Client.Kite.Name != "" {
+		e.Kite = r.Client.Kite.Name + "/" + r.Client.Kite.Version
+	}
+
+	if _, ok := r.result.(io.Reader); !ok && r.result != nil && err == nil {
+		if p, err := json.Marshal(r.result); err == nil {
+			e.Size = len(p)
+		}
+	}
+
+	return e
+}
+
+func (e *AccessLogEntry) combined() []byte {
+	status := "ok"
+	if e.Error != nil {
+		status = e.Error.Type
+	}
+
+	return []byte(fmt.Sprintf("%s - %s [%s] %q %s %d %q %q %s\n",
+		orDash(e.RemoteAddr),
+		orDash(e.Username),
+		e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		e.Method,
+		orDash(status),
+		e.Size,
+		orDash(e.KiteID),
+		orDash(e.Kite),
+		strconv.FormatFloat(float64(e.Duration)/float64(time.Millisecond), 'f', 3, 64),
+	))
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+
+	return s
+}
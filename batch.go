@@ -0,0 +1,207 @@
+package kite
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/koding/cache"
+	"github.com/koding/kite/dnode"
+)
+
+// maxBatchCalls is the max number of calls of a batch,
+// larger batches are rejected.
+const maxBatchCalls = 100
+
+// maxBatchGoroutines is the max number of calls of a concurrent batch
+// executed at once, when Config.MaxHandlerGoroutines is not set.
+const maxBatchGoroutines = 10
+
+// BatchCall is a method call made with TellBatch.
+type BatchCall struct {
+	Method string        `json:"method"`
+	Args   []interface{} `json:"args"`
+}
+
+// BatchResult is the result of a method call made with TellBatch.
+type BatchResult struct {
+	Result *dnode.Partial `json:"result"`
+	Error  *Error         `json:"error"`
+}
+
+// batchArgs are the arguments of the "kite.batch" method.
+type batchArgs struct {
+	Calls      []BatchCall `json:"calls"`
+	Concurrent bool        `json:"concurrent,omitempty"`
+}
+
+// batchRequest are the arguments of the "kite.batch" method,
+// as received by the remote kite.
+type batchRequest struct {
+	Calls []struct {
+		Method string         `json:"method"`
+		Args   *dnode.Partial `json:"args"`
+	} `json:"calls"`
+	Concurrent bool `json:"concurrent,omitempty"`
+}
+
+// TellBatch makes the method calls with a single message. The remote
+// kite executes them one after another and the results are returned
+// once all of them are done, in the order of the calls.
+//
+// Each of the calls is authenticated and handled like the ones made
+// with Tell, a failure of one of them does not stop the others.
+// The calls share the request ID of the batch. A batch may have up
+// to 100 calls, which may not call kite.batch.
+// The returned error is non-nil only if the batch could not be made.
+func (c *Client) TellBatch(calls []BatchCall) ([]BatchResult, error) {
+	return c.tellBatch(calls, false)
+}
+
+// TellBatchConcurrent is like TellBatch, but the remote kite executes
+// the calls concurrently.
+//
+// The calls are executed by the goroutines limited with
+// Config.MaxHandlerGoroutines of the remote kite. If none of them is
+// free, the calls fail with ErrOverloaded or are executed one after
+// another, depending on Config.HandlerOverflow. If the goroutines are
+// not limited, up to 10 calls of the batch are executed at once.
+func (c *Client) TellBatchConcurrent(calls []BatchCall) ([]BatchResult, error) {
+	return c.tellBatch(calls, true)
+}
+
+func (c *Client) tellBatch(calls []BatchCall, concurrent bool) ([]BatchResult, error) {
+	args := &batchArgs{
+		Calls:      make([]BatchCall, len(calls)),
+		Concurrent: concurrent,
+	}
+
+	for i, call := range calls {
+		if call.Args == nil {
+			call.Args = []interface{}{}
+		}
+
+		args.Calls[i] = call
+	}
+
+	result, err := c.Tell("kite.batch", args)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []BatchResult
+	if err := result.Unmarshal(&results); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// handleBatch executes the method calls of a batch.
+func handleBatch(r *Request) (interface{}, error) {
+	var args batchRequest
+	if err := r.Args.One().Unmarshal(&args); err != nil {
+		return nil, err
+	}
+
+	if len(args.Calls) > maxBatchCalls {
+		return nil, fmt.Errorf("batch of %d calls exceeds the limit of %d calls", len(args.Calls), maxBatchCalls)
+	}
+
+	results := make([]Response, len(args.Calls))
+
+	// The calls carry the nonce of the batch message.
+	replay := &replayCheck{}
+
+	serve := func(i int) {
+		call := args.Calls[i]
+
+		// Nested batches would multiply the calls of a single message.
+		if call.Method == "kite.batch" {
+			results[i].Error = createError(r, errors.New("kite.batch cannot be called within a batch"))
+			return
+		}
+
+		method, ok := r.LocalKite.method(call.Method)
+		if !ok {
+			results[i].Error = methodNotFound(call.Method)
+			return
+		}
+
+		if call.Args == nil {
+			call.Args = &dnode.Partial{Raw: []byte("[]")}
+		}
+
+		request := &Request{
+			ID:        r.ID,
+			Method:    call.Method,
+			Args:      call.Args,
+			LocalKite: r.LocalKite,
+			Client:    r.Client,
+			Auth:      r.Auth,
+			Context:   cache.NewMemory(),
+			ctx:       r.Ctx(),
+			method:    method,
+			replay:    replay,
+		}
+
+		results[i].Result, results[i].Error = r.Client.serveRequest(method, request)
+	}
+
+	if !args.Concurrent {
+		for i := range args.Calls {
+			serve(i)
+		}
+
+		return results, nil
+	}
+
+	p := r.LocalKite.workerPool()
+
+	// Without the handler goroutines limited, the calls of the
+	// batch are still limited to maxBatchGoroutines at a time.
+	var sem chan struct{}
+	if p == nil {
+		sem = make(chan struct{}, maxBatchGoroutines)
+	}
+
+	var wg sync.WaitGroup
+
+	for i := range args.Calls {
+		wg.Add(1)
+
+		fn := func(i int) func() {
+			return func() {
+				defer wg.Done()
+				serve(i)
+			}
+		}(i)
+
+		switch {
+		case p == nil:
+			sem <- struct{}{}
+
+			go func() {
+				defer func() { <-sem }()
+				fn()
+			}()
+		case p.tryRun(fn):
+		case p.reject:
+			atomic.AddInt64(&p.rejected, 1)
+			wg.Done()
+
+			err := *ErrOverloaded
+			results[i].Error = createError(r, &err)
+		default:
+			// The call is not queued, as the goroutines may be held by
+			// batches waiting for their calls, it is executed by the
+			// goroutine of the batch instead.
+			fn()
+		}
+	}
+
+	wg.Wait()
+
+	return results, nil
+}
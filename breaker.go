@@ -0,0 +1,235 @@
+package kite
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned to the caller when a call is not made,
+// because the circuit breaker of the client is open.
+var ErrCircuitOpen = &Error{
+	Type:      "circuitOpen",
+	Message:   "Circuit breaker is open",
+	Retryable: true,
+}
+
+// CircuitState is a state of the CircuitBreaker.
+type CircuitState int
+
+const (
+	// CircuitClosed lets all calls through, this is the initial state.
+	CircuitClosed CircuitState = iota
+
+	// CircuitOpen fails all calls with ErrCircuitOpen.
+	CircuitOpen
+
+	// CircuitHalfOpen lets probe calls through, in order to check
+	// whether the remote kite has recovered.
+	CircuitHalfOpen
+)
+
+var circuitStates = map[CircuitState]string{
+	CircuitClosed:   "closed",
+	CircuitOpen:     "open",
+	CircuitHalfOpen: "half-open",
+}
+
+func (s CircuitState) String() string {
+	if name, ok := circuitStates[s]; ok {
+		return name
+	}
+
+	return "unknown"
+}
+
+// CircuitBreaker makes calls of a client fail fast with ErrCircuitOpen,
+// after a number of consecutive calls failed, instead of waiting for
+// each of them to time out. After OpenTimeout passes, probe calls are
+// let through and the circuit closes when they succeed.
+//
+// A CircuitBreaker keeps the state of the circuit, it may be shared by
+// clients connected to the same remote kite.
+type CircuitBreaker struct {
+	// Threshold is the number of consecutive failed calls, after which
+	// the circuit opens. If zero, DefaultCircuitBreaker.Threshold is used.
+	Threshold int
+
+	// OpenTimeout is the time the circuit stays open for, before probe
+	// calls are let through. If zero, DefaultCircuitBreaker.OpenTimeout
+	// is used.
+	OpenTimeout time.Duration
+
+	// Probes is the number of probe calls let through at once when
+	// the circuit is half-open; the circuit closes when all of them
+	// succeed. If zero, DefaultCircuitBreaker.Probes is used.
+	Probes int
+
+	// IsFailure tells whether the error of a call counts as a failure.
+	// If nil, IsCircuitFailure is used.
+	IsFailure func(error) bool
+
+	mu         sync.Mutex
+	state      CircuitState
+	generation uint64 // incremented on each state change
+	failures   int
+	successes  int
+	probes     int // probe calls in flight
+	openedAt   time.Time
+}
+
+// DefaultCircuitBreaker holds the default values for zero fields
+// of a CircuitBreaker.
+var DefaultCircuitBreaker = &CircuitBreaker{
+	Threshold:   5,
+	OpenTimeout: 30 * time.Second,
+	Probes:      1,
+}
+
+// IsCircuitFailure tells whether the error means the remote kite is failing,
+// which is when the call has timed out, the remote kite was unreachable,
+// disconnected or refused the call because of being overloaded or shutting
+// down. Errors returned by method handlers are not failures.
+func IsCircuitFailure(err error) bool {
+	e, ok := err.(*Error)
+	if !ok {
+		return false
+	}
+
+	switch e.Type {
+	case "timeout", "sendError", "disconnect", "overloaded", "shutdownError":
+		return true
+	default:
+		return false
+	}
+}
+
+// State gives the current state of the circuit.
+func (cb *CircuitBreaker) State() CircuitState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state == CircuitOpen && time.Since(cb.openedAt) >= cb.openTimeout() {
+		return CircuitHalfOpen
+	}
+
+	return cb.state
+}
+
+// allow tells whether a call can be made. If it can, the returned
+// func must be called with the error of the call once it's done.
+func (cb *CircuitBreaker) allow() (done func(error), ok bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state == CircuitOpen {
+		if time.Since(cb.openedAt) < cb.openTimeout() {
+			return nil, false
+		}
+
+		cb.setState(CircuitHalfOpen)
+	}
+
+	if cb.state == CircuitHalfOpen {
+		if cb.probes >= cb.maxProbes() {
+			return nil, false
+		}
+
+		cb.probes++
+	}
+
+	generation := cb.generation
+
+	return func(err error) {
+		cb.done(generation, err)
+	}, true
+}
+
+func (cb *CircuitBreaker) done(generation uint64, err error) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	// Ignore calls made before the state has changed.
+	if generation != cb.generation {
+		return
+	}
+
+	// Calls canceled by the caller tell nothing about the remote kite.
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		if cb.state == CircuitHalfOpen {
+			cb.probes--
+		}
+		return
+	}
+
+	failed := cb.isFailure(err)
+
+	switch cb.state {
+	case CircuitClosed:
+		if !failed {
+			cb.failures = 0
+			return
+		}
+
+		if cb.failures++; cb.failures >= cb.threshold() {
+			cb.setState(CircuitOpen)
+		}
+	case CircuitHalfOpen:
+		cb.probes--
+
+		if failed {
+			cb.setState(CircuitOpen)
+			return
+		}
+
+		if cb.successes++; cb.successes >= cb.maxProbes() {
+			cb.setState(CircuitClosed)
+		}
+	}
+}
+
+// setState changes the state of the circuit. It must be called
+// with cb.mu held.
+func (cb *CircuitBreaker) setState(state CircuitState) {
+	cb.state = state
+	cb.generation++
+	cb.failures = 0
+	cb.successes = 0
+	cb.probes = 0
+
+	if state == CircuitOpen {
+		cb.openedAt = time.Now()
+	}
+}
+
+func (cb *CircuitBreaker) isFailure(err error) bool {
+	if cb.IsFailure != nil {
+		return cb.IsFailure(err)
+	}
+
+	return IsCircuitFailure(err)
+}
+
+func (cb *CircuitBreaker) threshold() int {
+	if cb.Threshold > 0 {
+		return cb.Threshold
+	}
+
+	return DefaultCircuitBreaker.Threshold
+}
+
+func (cb *CircuitBreaker) openTimeout() time.Duration {
+	if cb.OpenTimeout > 0 {
+		return cb.OpenTimeout
+	}
+
+	return DefaultCircuitBreaker.OpenTimeout
+}
+
+func (cb *CircuitBreaker) maxProbes() int {
+	if cb.Probes > 0 {
+		return cb.Probes
+	}
+
+	return DefaultCircuitBreaker.Probes
+}
@@ -0,0 +1,115 @@
+package kite
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	cb := &CircuitBreaker{
+		Threshold:   3,
+		OpenTimeout: 50 * time.Millisecond,
+	}
+
+	failure := &Error{Type: "timeout"}
+	handlerErr := &Error{Type: "genericError"}
+
+	call := func(err error) bool {
+		done, ok := cb.allow()
+		if ok {
+			done(err)
+		}
+		return ok
+	}
+
+	// Errors returned by handlers and canceled calls do not open the circuit.
+	for _, err := range []error{failure, failure, handlerErr, failure, failure, context.Canceled, nil} {
+		if !call(err) {
+			t.Fatalf("call with %v was not allowed", err)
+		}
+	}
+
+	if state := cb.State(); state != CircuitClosed {
+		t.Fatalf("got %s, want %s", state, CircuitClosed)
+	}
+
+	for i := 0; i < 3; i++ {
+		call(failure)
+	}
+
+	if state := cb.State(); state != CircuitOpen {
+		t.Fatalf("got %s, want %s", state, CircuitOpen)
+	}
+
+	if call(nil) {
+		t.Fatal("call was allowed with the circuit open")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	// A single probe is let through when the circuit is half-open.
+	done, ok := cb.allow()
+	if !ok {
+		t.Fatal("probe call was not allowed")
+	}
+
+	if call(nil) {
+		t.Fatal("second probe call was allowed")
+	}
+
+	done(failure)
+
+	if state := cb.State(); state != CircuitOpen {
+		t.Fatalf("got %s, want %s", state, CircuitOpen)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	if !call(nil) {
+		t.Fatal("probe call was not allowed")
+	}
+
+	if state := cb.State(); state != CircuitClosed {
+		t.Fatalf("got %s, want %s", state, CircuitClosed)
+	}
+}
+
+func TestClient_CircuitBreaker(t *testing.T) {
+	k := New("testkite", "0.0.1")
+	k.Config.DisableAuthentication = true
+
+	k.HandleFunc("slow", func(r *Request) (interface{}, error) {
+		<-r.Ctx().Done()
+		return nil, nil
+	})
+
+	go k.Run()
+	defer k.Close()
+	<-k.ServerReadyNotify()
+
+	c := New("exp", "0.0.1").NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", k.Port()))
+	c.CircuitBreaker = &CircuitBreaker{Threshold: 2, OpenTimeout: time.Minute}
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for i := 0; i < 2; i++ {
+		if _, err := c.TellWithTimeout("slow", 50*time.Millisecond); err == nil {
+			t.Fatal("expected call to time out")
+		}
+	}
+
+	start := time.Now()
+
+	_, err := c.TellWithTimeout("kite.ping", 4*time.Second)
+	if e, ok := err.(*Error); !ok || e.Type != "circuitOpen" {
+		t.Fatalf("got %v, want circuitOpen error", err)
+	}
+
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("call failed after %s, want it to fail fast", d)
+	}
+}
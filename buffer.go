@@ -0,0 +1,30 @@
+package kite
+
+import (
+	"bytes"
+	"sync"
+)
+
+// maxPooledBufferSize is the capacity above which buffers are not
+// returned to the pool, so occasional big messages do not make it
+// hold on to lots of memory.
+const maxPooledBufferSize = 64 * 1024
+
+// bufferPool reuses the buffers messages are encoded and framed in,
+// which are no longer needed once the message is sent.
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+func getBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	if buf == nil || buf.Cap() > maxPooledBufferSize {
+		return
+	}
+
+	buf.Reset()
+	bufferPool.Put(buf)
+}
@@ -0,0 +1,140 @@
+package kite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/igm/sockjs-go/sockjs"
+	"github.com/koding/cache"
+	"github.com/koding/kite/dnode"
+	"github.com/koding/kite/protocol"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// Call is a method call made to the kite over a transport other than
+// a kite connection, e.g. by the gateway package.
+type Call struct {
+	// Method is the name of the called method.
+	Method string
+
+	// Args are the arguments of the call, as a dnode array.
+	// No arguments are passed if Args is nil.
+	Args *dnode.Partial
+
+	// Auth is the authentication information of the call.
+	Auth *Auth
+
+	// Kite identifies the caller, if known.
+	Kite protocol.Kite
+
+	// Request is the HTTP request the call was made with, if any.
+	// Its TLS connection state is used for authenticating with client
+	// certificates, its remote address for throttling and its headers
+	// for propagating traces, the request ID (X-Request-Id) and the
+	// idempotency key (Idempotency-Key).
+	Request *http.Request
+}
+
+// ServeCall calls the method the same way as it is called by remote kites,
+// going through authentication, scope checks, throttling and the
+// pre-, post- and final handlers. The given ctx is the context
+// of the request passed to the handlers.
+//
+// If the method is not found, the returned error is of "methodNotFound"
+// type.
+func (k *Kite) ServeCall(ctx context.Context, call *Call) (interface{}, *Error) {
+	method, ok := k.method(call.Method)
+	if !ok {
+		return nil, methodNotFound(call.Method)
+	}
+
+	args := call.Args
+	if args == nil {
+		args = &dnode.Partial{Raw: []byte("[]")}
+	}
+
+	var id string
+	idempotencyKey, _ := IdempotencyKeyFromContext(ctx)
+
+	if call.Request != nil {
+		ctx = k.propagator().Extract(ctx, propagation.HeaderCarrier(call.Request.Header))
+		id = call.Request.Header.Get("X-Request-Id")
+
+		if key := call.Request.Header.Get("Idempotency-Key"); key != "" {
+			idempotencyKey = key
+		}
+	}
+
+	ctx, id = withRequestID(ctx, id)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	c := &Client{
+		LocalKite: k,
+		Kite:      call.Kite,
+		session:   &callSession{req: call.Request},
+	}
+
+	request := &Request{
+		ID:             id,
+		Method:         call.Method,
+		IdempotencyKey: idempotencyKey,
+		Args:           args,
+		LocalKite:      k,
+		Client:         c,
+		Auth:           call.Auth,
+		Context:        cache.NewMemory(),
+		ctx:            ctx,
+		method:         method,
+	}
+
+	return c.serveRequest(method, request)
+}
+
+// serveRequest serves the request made outside of the dnode protocol,
+// like a Call or a call of a batch, and gives its result.
+func (c *Client) serveRequest(method *Method, request *Request) (result interface{}, err *Error) {
+	start := time.Now()
+
+	defer func() {
+		if r := recover(); r != nil {
+			debug.PrintStack()
+			err = createError(request, r)
+			c.LocalKite.Log.Error("%s", err)
+		}
+
+		c.LocalKite.callOnResponseHandlers(request, time.Since(start), err)
+	}()
+
+	c.serveMethod(method, request, func(res interface{}, e *Error) {
+		result, err = res, e
+	})
+
+	return result, err
+}
+
+func methodNotFound(method string) *Error {
+	return &Error{
+		Type:    "methodNotFound",
+		Message: fmt.Sprintf("method %q is not found", method),
+	}
+}
+
+// callSession is a session of a pseudo client making a Call.
+type callSession struct {
+	req *http.Request
+}
+
+var _ sockjs.Session = (*callSession)(nil)
+
+func (s *callSession) ID() string                           { return "" }
+func (s *callSession) Request() *http.Request               { return s.req }
+func (s *callSession) Recv() (string, error)                { return "", io.EOF }
+func (s *callSession) Send(string) error                    { return errors.New("call session does not send messages") }
+func (s *callSession) Close(uint32, string) error           { return nil }
+func (s *callSession) GetSessionState() sockjs.SessionState { return sockjs.SessionActive }
@@ -0,0 +1,53 @@
+package kite
+
+import "context"
+
+// sendCancel notifies the remote kite that the call with the given
+// cancel ID was canceled by the caller.
+func (c *Client) sendCancel(id string) {
+	args := c.wrapMethodArgs([]interface{}{id}, callOptions{})
+
+	_, errC, err := c.marshalAndSend("kite.cancel", args)
+	if err == nil {
+		err = <-errC
+	}
+
+	if err != nil {
+		c.LocalKite.Log.Debug("Unable to cancel call %q: %s", id, err)
+	}
+}
+
+func (c *Client) addCancel(id string, cancel context.CancelFunc) {
+	c.cancelsMu.Lock()
+	if c.cancels == nil {
+		c.cancels = make(map[string]context.CancelFunc)
+	}
+	c.cancels[id] = cancel
+	c.cancelsMu.Unlock()
+}
+
+func (c *Client) removeCancel(id string) {
+	c.cancelsMu.Lock()
+	delete(c.cancels, id)
+	c.cancelsMu.Unlock()
+}
+
+// handleCancel cancels the context of a request that is being handled
+// over the current session.
+func handleCancel(r *Request) (interface{}, error) {
+	id, err := r.Args.One().String()
+	if err != nil {
+		return nil, err
+	}
+
+	r.Client.cancelsMu.Lock()
+	cancel, ok := r.Client.cancels[id]
+	r.Client.cancelsMu.Unlock()
+
+	// The call may have finished in the meantime.
+	if ok {
+		cancel()
+	}
+
+	return nil, nil
+}
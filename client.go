@@ -1,10 +1,12 @@
 package kite
 
 import (
-	"encoding/json"
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"sync"
@@ -13,12 +15,15 @@ import (
 
 	"github.com/koding/kite/config"
 	"github.com/koding/kite/dnode"
+	"github.com/koding/kite/grpcsession"
 	"github.com/koding/kite/protocol"
 	"github.com/koding/kite/sockjsclient"
+	"github.com/koding/kite/utils"
 
 	"github.com/cenkalti/backoff"
 	"github.com/gorilla/websocket"
 	"github.com/igm/sockjs-go/sockjs"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var forever = backoff.NewExponentialBackOff()
@@ -27,6 +32,72 @@ func init() {
 	forever.MaxElapsedTime = 365 * 24 * time.Hour // 1 year
 }
 
+// ReconnectPolicy configures delays between consecutive redials
+// of a disconnected client. The delay grows exponentially with each
+// failed attempt, starting at InitialInterval until it reaches
+// MaxInterval.
+type ReconnectPolicy struct {
+	// InitialInterval is the delay after the first failed attempt.
+	InitialInterval time.Duration
+
+	// MaxInterval caps the delay between attempts.
+	MaxInterval time.Duration
+
+	// Multiplier is the factor the delay grows by after each attempt.
+	Multiplier float64
+
+	// Jitter randomizes each delay by the given factor, e.g. 0.5
+	// gives a delay in [0.5*d, 1.5*d] range. Zero disables jitter.
+	Jitter float64
+
+	// MaxRetries limits the number of redials after the first failed
+	// one, after which the client gives up. Zero means the client never
+	// gives up.
+	MaxRetries int
+}
+
+// DefaultReconnectPolicy is used by clients that have no ReconnectPolicy
+// set. Zero InitialInterval, MaxInterval and Multiplier fields of a custom
+// policy are also taken from the DefaultReconnectPolicy.
+var DefaultReconnectPolicy = &ReconnectPolicy{
+	InitialInterval: backoff.DefaultInitialInterval,
+	MaxInterval:     backoff.DefaultMaxInterval,
+	Multiplier:      backoff.DefaultMultiplier,
+	Jitter:          backoff.DefaultRandomizationFactor,
+}
+
+func (p *ReconnectPolicy) backOff() backoff.BackOff {
+	if p == nil {
+		p = DefaultReconnectPolicy
+	}
+
+	b := *forever
+	b.InitialInterval = p.InitialInterval
+	b.MaxInterval = p.MaxInterval
+	b.Multiplier = p.Multiplier
+	b.RandomizationFactor = p.Jitter
+
+	if b.InitialInterval <= 0 {
+		b.InitialInterval = DefaultReconnectPolicy.InitialInterval
+	}
+
+	if b.MaxInterval <= 0 {
+		b.MaxInterval = DefaultReconnectPolicy.MaxInterval
+	}
+
+	if b.Multiplier <= 0 {
+		b.Multiplier = DefaultReconnectPolicy.Multiplier
+	}
+
+	b.Reset()
+
+	if p.MaxRetries > 0 {
+		return backoff.WithMaxRetries(&b, uint64(p.MaxRetries))
+	}
+
+	return &b
+}
+
 func nopSetSession(sockjs.Session) {}
 
 // Client is the client for communicating with another Kite.
@@ -48,9 +119,41 @@ type Client struct {
 	// broke.
 	Reconnect bool
 
+	// ReconnectPolicy configures delays between redials, when
+	// Reconnect is true. If nil, DefaultReconnectPolicy is used.
+	ReconnectPolicy *ReconnectPolicy
+
+	// CircuitBreaker, when non-nil, makes calls fail fast with
+	// ErrCircuitOpen while the remote kite is consistently failing.
+	CircuitBreaker *CircuitBreaker
+
+	// CancelRemote makes calls done with TellWithContext notify
+	// the remote kite when their context is done, so the context
+	// of the remote request gets canceled as well.
+	CancelRemote bool
+
 	// URL specifies the SockJS URL of the remote kite.
 	URL string
 
+	// URLs are alternative URLs of the remote kite, e.g. ones it
+	// registered to Kontrol with. They are dialed in order when
+	// the remote kite is not reachable at URL.
+	URLs []string
+
+	// DialSession, when non-nil, is used for establishing sessions
+	// with the remote kite instead of the transport given by the config,
+	// e.g. for connecting over the in-memory transport of the kitetest
+	// package.
+	DialSession func(timeout time.Duration) (sockjs.Session, error)
+
+	// Labels are the labels the remote kite registered to Kontrol with,
+	// set for clients returned by GetKites.
+	Labels map[string]string
+
+	// Weight is the weight the remote kite registered to Kontrol with,
+	// set for clients returned by GetKites, see config.Config.Weight.
+	Weight int
+
 	// Config is used when setting up client connection to
 	// the remote kite.
 	//
@@ -121,7 +224,54 @@ type Client struct {
 	// TODO: replace this with a proper interface to support multiple
 	// transport/protocols
 	session sockjs.Session
-	send    chan *message
+
+	// queue holds the messages waiting to be sent by the send hub,
+	// it is created on first use with sendQueue.
+	queue     *sendQueue
+	queueOnce sync.Once
+
+	// sessionCtx is canceled when the current session ends; it's
+	// the parent context of every request received over the session.
+	sessionCtx    context.Context
+	sessionCancel context.CancelFunc
+
+	// recorder records the frames of the current session,
+	// if Config.RecordDir is set.
+	recorder *recorder
+
+	// streams holds responses that are being streamed
+	// to the remote kite, keyed by stream ID.
+	streams   map[string]*stream
+	streamsMu sync.Mutex
+
+	// codec is used for encoding messages sent over the current
+	// session, JSON if nil. Received messages are decoded with
+	// the codec they were encoded with.
+	codec   dnode.Codec
+	codecMu sync.Mutex
+
+	// attachments is true if the remote kite receives
+	// attachments as frames over the current session.
+	attachments bool
+
+	// compressor compresses messages sent over the current
+	// session, they are not compressed if nil.
+	compressor compressor
+
+	// decompression is the compression algorithm of the messages
+	// accepted over the current session, once it was offered or
+	// negotiated. Compressed messages are rejected if empty.
+	decompression string
+
+	// cancels holds cancel funcs of requests received over
+	// the current session, keyed by cancel ID.
+	cancels   map[string]context.CancelFunc
+	cancelsMu sync.Mutex
+
+	// sequences order the responses to the calls of
+	// the ordered methods, keyed by Method.Ordered keys.
+	sequences   map[string]*sequence
+	sequencesMu sync.Mutex
 
 	// muReconnect protects Reconnect
 	muReconnect sync.Mutex
@@ -129,18 +279,43 @@ type Client struct {
 	// closed is to ensure Close is idempotent
 	closed int32
 
+	// lastActivity is the time in nanoseconds of the last message
+	// received over the session, accessed atomically.
+	lastActivity int64
+
+	// pendingCalls is the number of calls waiting for a response,
+	// accessed atomically.
+	pendingCalls int64
+
+	// proxy is the URL of the proxy the remote kite is dialed
+	// through, overrides Config.ProxyURL if set, see Proxy.
+	proxy *url.URL
+
+	// retry is the policy the calls are retried with, see WithRetry.
+	retry   *RetryPolicy
+	retryMu sync.Mutex
+
+	// goingAway is 1 if the remote kite notified it is shutting
+	// down over the current session, accessed atomically.
+	goingAway int32
+
 	// dnode scrubber for saving callbacks sent to remote.
 	scrubber *dnode.Scrubber
 
-	// Time to wait before redial connection.
-	redialBackOff backoff.ExponentialBackOff
-
 	// on connect/disconnect handlers are invoked after every
 	// connect/disconnect.
-	onConnectHandlers     []func()
-	onDisconnectHandlers  []func()
-	onTokenExpireHandlers []func()
-	onTokenRenewHandlers  []func(string)
+	onConnectHandlers           []func()
+	onDisconnectHandlers        []func()
+	onReconnectAttemptHandlers  []func(int, error)
+	onTokenExpireHandlers       []func()
+	onTokenRenewHandlers        []func(string)
+	onTokenRenewedHandlers      []func(string, time.Time)
+	onTokenRenewFailureHandlers []func(int, error)
+	onStateChangeHandlers       []func(*ConnectionEvent)
+
+	// conn is the state of the connection, see State
+	conn   connState
+	connMu sync.Mutex
 
 	testHookSetSession func(sockjs.Session)
 
@@ -152,8 +327,21 @@ type Client struct {
 
 // message carries an encoded payload sent over connected session.
 type message struct {
-	p    []byte
-	errC chan<- error
+	p      []byte
+	buf    *bytes.Buffer // pooled buffer holding p, if any
+	frames [][]byte      // attachments sent after the message
+	errC   chan<- error
+}
+
+// size gives the number of bytes of the message and its attachments.
+func (msg *message) size() int64 {
+	n := int64(len(msg.p))
+
+	for _, frame := range msg.frames {
+		n += int64(len(frame))
+	}
+
+	return n
 }
 
 // callOptions is the type of first argument in the dnode message.
@@ -164,22 +352,93 @@ type callOptions struct {
 	Auth             *Auth          `json:"authentication"`
 	WithArgs         *dnode.Partial `json:"withArgs" dnode:"-"`
 	ResponseCallback dnode.Function `json:"responseCallback"`
+	StreamCallback   dnode.Function `json:"streamCallback"`
+	ProgressCallback dnode.Function `json:"progressCallback"`
+
+	// Trace carries the trace context of the caller.
+	Trace map[string]string `json:"trace,omitempty" dnode:"-"`
+
+	// CancelID identifies the call when the caller cancels it,
+	// see Client.CancelRemote.
+	CancelID string `json:"cancelID,omitempty" dnode:"-"`
+
+	// RequestID is the ID of the request the call is made within,
+	// see ContextWithRequestID.
+	RequestID string `json:"requestID,omitempty" dnode:"-"`
+
+	// Timeout is the time left till the caller stops waiting for
+	// the response. It is relative, so it does not depend on clocks
+	// of both kites being in sync.
+	Timeout time.Duration `json:"timeout,omitempty" dnode:"-"`
+
+	// IdempotencyKey identifies the call and its retries,
+	// see ContextWithIdempotencyKey.
+	IdempotencyKey string `json:"idempotencyKey,omitempty" dnode:"-"`
 }
 
 // callOptionsOut is the same structure with callOptions.
 // It is used when marshalling a dnode message.
 type callOptionsOut struct {
-	callOptions
-
 	// Override this when sending because args will not be a *dnode.Partial.
+	// It precedes the inlined callOptions, so MessagePack skips the
+	// shadowed field instead of encoding both.
 	WithArgs []interface{} `json:"withArgs"`
+
+	callOptions `msgpack:",inline"`
 }
 
 // Authentication is used when connecting a Client.
 type Auth struct {
-	// Type can be "kiteKey", "token" or "sessionID" for now.
+	// Type can be "kiteKey", "token", "tls" or "sessionID" for now.
 	Type string `json:"type"`
 	Key  string `json:"key"`
+
+	// Nonce and Timestamp, in Unix milliseconds, are sent along with
+	// tokens, so the remote kite can reject replayed requests, see
+	// config.Config.ReplayWindow. Signature signs them with the proof
+	// key of the kite the token was issued to, see Kite.ProofKey.
+	Nonce     string `json:"nonce,omitempty"`
+	Timestamp int64  `json:"timestamp,omitempty"`
+	Signature string `json:"signature,omitempty"`
+}
+
+// AuthFromHeader parses the value of the HTTP Authorization header, e.g.
+// "token <key>" or "kiteKey <key>"; "Bearer" is an alias of the "token"
+// authentication type. It returns nil if the header is malformed.
+func AuthFromHeader(header string) *Auth {
+	i := strings.IndexByte(header, ' ')
+	if i == -1 {
+		return nil
+	}
+
+	typ, key := header[:i], strings.TrimSpace(header[i+1:])
+
+	if strings.EqualFold(typ, "bearer") {
+		typ = "token"
+	}
+
+	return &Auth{
+		Type: typ,
+		Key:  key,
+	}
+}
+
+// AuthFromRequest parses the Authorization header of the HTTP request,
+// see AuthFromHeader, along with the nonce, the timestamp and the
+// signature of the token sent in the Kite-Nonce, Kite-Timestamp and
+// Kite-Signature headers, see Kite.SetAuthHeader. It returns nil if
+// the Authorization header is malformed.
+func AuthFromRequest(req *http.Request) *Auth {
+	auth := AuthFromHeader(req.Header.Get("Authorization"))
+	if auth == nil {
+		return nil
+	}
+
+	auth.Nonce = req.Header.Get("Kite-Nonce")
+	auth.Signature = req.Header.Get("Kite-Signature")
+	auth.Timestamp, _ = strconv.ParseInt(req.Header.Get("Kite-Timestamp"), 10, 64)
+
+	return auth
 }
 
 // response is the type of the return value of Tell() and Go() methods.
@@ -197,11 +456,9 @@ func (k *Kite) NewClient(remoteURL string) *Client {
 		URL:                remoteURL,
 		disconnect:         make(chan struct{}),
 		closeChan:          make(chan struct{}),
-		redialBackOff:      *forever,
 		scrubber:           dnode.NewScrubber(),
 		testHookSetSession: nopSetSession,
 		Concurrent:         true,
-		send:               make(chan *message),
 		interrupt:          make(chan error, 1),
 	}
 
@@ -272,28 +529,16 @@ func (c *Client) authCopy() *Auth {
 }
 
 func (c *Client) dial(timeout time.Duration) (err error) {
-	transport := c.config().Transport
-
-	c.LocalKite.Log.Debug("Client transport is set to '%s'", transport)
-
-	var session sockjs.Session
-
-	switch transport {
-	case config.WebSocket:
-		session, err = sockjsclient.DialWebsocket(c.URL, c.config())
-	case config.XHRPolling:
-		session, err = sockjsclient.DialXHR(c.URL, c.config())
-	case config.Auto:
-		session, err = sockjsclient.DialWebsocket(c.URL, c.config())
-		if err == websocket.ErrBadHandshake {
-			// In cases when kite server is behind a proxy that do
-			// not support websocket connections, fall back to XHR.
-			session, err = sockjsclient.DialXHR(c.URL, c.config())
+	dialSession := c.dialTransport
+	if c.DialSession != nil {
+		dialSession = c.DialSession
+	} else if dial := c.LocalKite.DialSession; dial != nil {
+		dialSession = func(timeout time.Duration) (sockjs.Session, error) {
+			return dial(c, timeout)
 		}
-	default:
-		return fmt.Errorf("Connection transport is not known '%v'", transport)
 	}
 
+	session, err := dialSession(timeout)
 	if err != nil {
 		return err
 	}
@@ -302,39 +547,129 @@ func (c *Client) dial(timeout time.Duration) (err error) {
 	c.wg.Add(1)
 	go c.sendHub()
 
-	// Reset the wait time.
-	c.redialBackOff.Reset()
+	c.setState(&ConnectionEvent{State: StateConnected})
 
 	// Must be run in a goroutine because a handler may wait a response from
 	// server.
-	go c.callOnConnectHandlers()
+	go func() {
+		c.negotiateCodec()
+		c.callOnConnectHandlers()
+	}()
 
 	return nil
 }
 
+// dialTransport establishes a session with the remote kite
+// using the transport given by the config. The alternative URLs
+// are dialed if the kite is not reachable at c.URL.
+func (c *Client) dialTransport(timeout time.Duration) (session sockjs.Session, err error) {
+	session, err = c.dialURL(c.URL, timeout)
+
+	for _, u := range c.URLs {
+		if err == nil {
+			break
+		}
+
+		if u == c.URL {
+			continue
+		}
+
+		c.LocalKite.Log.Debug("Dialing '%s' kite with alternative URL %s, as %s failed: %s", c.Kite.Name, u, c.URL, err)
+
+		session, err = c.dialURL(u, timeout)
+	}
+
+	return session, err
+}
+
+// dialURL establishes a session with the remote kite at the given URL.
+func (c *Client) dialURL(remoteURL string, timeout time.Duration) (session sockjs.Session, err error) {
+	transport := c.config().Transport
+
+	c.LocalKite.Log.Debug("Client transport is set to '%s'", transport)
+
+	proxy, err := c.proxyURL()
+	if err != nil {
+		return nil, err
+	}
+
+	uri, cfg := remoteURL, proxyConfig(clientCertConfig(c.config()), proxy)
+
+	// Kites listening on a Unix domain socket are dialed with unix:// URLs,
+	// gRPC supports them natively.
+	if u, err := url.Parse(remoteURL); err == nil && u.Scheme == "unix" && transport != config.GRPC {
+		uri, cfg = unixConfig(u, cfg)
+	}
+
+	// Kites behind an SSH jump host are dialed with kite+ssh:// URLs.
+	if u, err := url.Parse(remoteURL); err == nil && u.Scheme == sshScheme {
+		if transport == config.GRPC {
+			return nil, errors.New("kite: " + sshScheme + " URLs are not supported by the gRPC transport")
+		}
+
+		if uri, cfg, err = sshConfig(u, cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	switch transport {
+	case config.WebSocket:
+		session, err = sockjsclient.DialWebsocket(uri, cfg)
+	case config.XHRPolling:
+		session, err = sockjsclient.DialXHR(uri, cfg)
+	case config.Auto:
+		session, err = sockjsclient.DialWebsocket(uri, cfg)
+		if err == websocket.ErrBadHandshake {
+			// In cases when kite server is behind a proxy that do
+			// not support websocket connections, fall back to XHR.
+			session, err = sockjsclient.DialXHR(uri, cfg)
+		}
+	case config.GRPC:
+		session, err = grpcsession.Dial(remoteURL, cfg)
+	default:
+		return nil, fmt.Errorf("Connection transport is not known '%v'", transport)
+	}
+
+	return session, err
+}
+
 func (c *Client) dialForever(connectNotifyChan chan bool) {
+	var attempt int
+	var lastErr error
+
 	dial := func() error {
 		if !c.reconnect() {
 			return nil
 		}
 
+		attempt++
+		c.setState(&ConnectionEvent{State: StateConnecting, Attempt: attempt, Err: lastErr})
+		c.callOnReconnectAttemptHandlers(attempt, lastErr)
+
 		c.LocalKite.Log.Info("Dialing '%s' kite: %s", c.Kite.Name, c.URL)
 
-		if err := c.dial(0); err != nil {
-			c.LocalKite.Log.Warning("Dialing '%s' kite error: %s: %v", c.Kite.Name, c.URL, err)
+		if lastErr = c.dial(0); lastErr != nil {
+			c.LocalKite.Log.Warning("Dialing '%s' kite error: %s: %v", c.Kite.Name, c.URL, lastErr)
 
-			return err
+			return lastErr
 		}
 
 		return nil
 	}
 
-	backoff.Retry(dial, &c.redialBackOff) // this will retry dial forever
+	// Retries dial forever, unless the policy limits the retries.
+	err := backoff.Retry(dial, c.ReconnectPolicy.backOff())
 
 	if connectNotifyChan != nil {
 		close(connectNotifyChan)
 	}
 
+	if err != nil {
+		c.LocalKite.Log.Error("Giving up dialing '%s' kite after %d attempts: %s: %v", c.Kite.Name, attempt, c.URL, err)
+		c.setState(&ConnectionEvent{State: StateClosed, Reason: ReasonError, Err: err, Attempt: attempt})
+		return
+	}
+
 	go c.run()
 }
 
@@ -344,12 +679,43 @@ func (c *Client) RemoteAddr() string {
 		return ""
 	}
 
-	websocketsession, ok := session.(*sockjsclient.WebsocketSession)
-	if !ok {
+	switch session := session.(type) {
+	case *sockjsclient.WebsocketSession:
+		return session.RemoteAddr()
+	case *grpcsession.Session:
+		return session.RemoteAddr()
+	default:
 		return ""
 	}
+}
+
+// initiated tells whether the session was opened by the client.
+func (c *Client) initiated() bool {
+	return sessionInitiated(c.session)
+}
 
-	return websocketsession.RemoteAddr()
+// sessionInitiated tells whether the session was opened by the client.
+func sessionInitiated(session sockjs.Session) bool {
+	switch session := session.(type) {
+	case *sockjsclient.WebsocketSession, *sockjsclient.XHRSession:
+		return true
+	case interface {
+		Initiated() bool
+	}:
+		return session.Initiated()
+	default:
+		return false
+	}
+}
+
+// maxMessageSize gives the size limit of messages received over
+// the current session, 0 if the size is not limited.
+func (c *Client) maxMessageSize() int64 {
+	if c.initiated() {
+		return c.config().MaxResponseSize
+	}
+
+	return c.config().MaxRequestSize
 }
 
 // run consumes incoming dnode messages. Reconnects if necessary.
@@ -360,6 +726,13 @@ func (c *Client) run() {
 	}
 
 	// falls here when connection disconnects
+	c.cancelSession()
+
+	// The remote kite forgets the callbacks it got with the session,
+	// so they are never going to be called.
+	c.scrubber.RemoveAll()
+
+	c.setDisconnected(err)
 	c.callOnDisconnectHandlers()
 
 	// let others know that the client has disconnected
@@ -400,19 +773,42 @@ func (c *Client) readLoop() error {
 			return err
 		}
 
-		msg, fn, err := c.processMessage(p)
+		c.touch()
+
+		var msg *dnode.Message
+		var fn interface{}
+
+		if limit := c.maxMessageSize(); limit > 0 && int64(len(p)) > limit {
+			err = &MessageTooLargeError{Limit: limit}
+		} else {
+			msg, fn, err = c.processMessage(p)
+		}
+
 		if err != nil {
-			if _, ok := err.(dnode.CallbackNotFoundError); !ok {
+			switch err.(type) {
+			case *MessageTooLargeError:
+				c.LocalKite.Log.Warning("Closing session with %s: %s", c.RemoteAddr(), err)
+				return err
+			case dnode.CallbackNotFoundError:
+			default:
 				c.LocalKite.Log.Warning("error processing message err: %s message: %s", err, msg)
 			}
 		}
 
 		switch v := fn.(type) {
 		case *Method: // invoke method
+			// The method may be registered with a pattern,
+			// pass the name it was called with.
+			name, _ := msg.Method.(string)
+
+			// The ticket is taken before the call is executed,
+			// so it is in the order the calls were received.
+			t := c.ticket(v)
+
 			if c.Concurrent {
-				go c.runMethod(v, msg.Arguments)
+				c.goMethod(v, name, msg.Arguments, t)
 			} else {
-				c.runMethod(v, msg.Arguments)
+				c.runMethod(v, name, msg.Arguments, t)
 			}
 		case func(*dnode.Partial): // invoke callback
 			if c.Concurrent && c.ConcurrentCallbacks {
@@ -431,7 +827,10 @@ func (c *Client) receiveData() ([]byte, error) {
 		err error
 	}
 
-	session := c.getSession()
+	c.m.RLock()
+	session, rec := c.session, c.recorder
+	c.m.RUnlock()
+
 	if session == nil {
 		return nil, errors.New("not connected")
 	}
@@ -440,6 +839,9 @@ func (c *Client) receiveData() ([]byte, error) {
 
 	go func() {
 		msg, err := session.Recv()
+		if err == nil {
+			rec.Record(true, msg)
+		}
 		done <- recv{[]byte(msg), err}
 	}()
 
@@ -462,10 +864,31 @@ func (c *Client) processMessage(data []byte) (msg *dnode.Message, fn interface{}
 
 	msg = &dnode.Message{}
 
-	if err = json.Unmarshal(data, &msg); err != nil {
+	codec, data, err := decodeFrame(data, c.getDecompression(), c.maxMessageSize())
+	if err != nil {
 		return nil, nil, err
 	}
 
+	if codec.Name() == dnode.JSON.Name() {
+		codec = c.jsonCodec()
+	}
+
+	if err = codec.Unmarshal(data, &msg); err != nil {
+		return nil, nil, err
+	}
+
+	// Arguments are decoded with the same codec.
+	if msg.Arguments != nil && msg.Arguments.Codec == nil {
+		msg.Arguments.Codec = codec
+	}
+
+	// Attachments follow the message.
+	if len(msg.Attachments) != 0 {
+		if err := c.receiveAttachments(msg); err != nil {
+			return nil, nil, err
+		}
+	}
+
 	sender := func(id uint64, args []interface{}) error {
 		// do not name the error variable to "err" here, it's a trap for
 		// shadowing variables
@@ -479,9 +902,7 @@ func (c *Client) processMessage(data []byte) (msg *dnode.Message, fn interface{}
 	}
 
 	// Find the handler function. Method may be string or integer.
-	switch method := msg.Method.(type) {
-	case float64:
-		id := uint64(method)
+	if id, ok := callbackMethodID(msg.Method); ok {
 		callback := c.scrubber.GetCallback(id)
 		if callback == nil {
 			err = dnode.CallbackNotFoundError{
@@ -492,8 +913,11 @@ func (c *Client) processMessage(data []byte) (msg *dnode.Message, fn interface{}
 		}
 
 		return msg, callback, nil
+	}
+
+	switch method := msg.Method.(type) {
 	case string:
-		m, ok := c.LocalKite.handlers[method]
+		m, ok := c.LocalKite.method(method)
 		if !ok {
 			err = dnode.MethodNotFoundError{
 				Method: method,
@@ -531,49 +955,103 @@ func (c *Client) Close() {
 	// wait for consumers to finish buffered messages
 	c.wg.Wait()
 
+	c.cancelSession()
+
 	if session := c.getSession(); session != nil {
 		session.Close(3000, "Go away!")
 	}
+
+	c.setState(&ConnectionEvent{State: StateClosed, Reason: ReasonClosed})
 }
 
 // sendhub sends the msg received from the send channel to the remote client
 func (c *Client) sendHub() {
 	defer c.wg.Done()
 
+	q := c.sendQueue()
+
 	for {
 		select {
-		case msg := <-c.send:
-			c.LocalKite.Log.Debug("sending: %s", msg)
-			session := c.getSession()
-			if session == nil {
-				c.LocalKite.Log.Error("not connected")
-				continue
-			}
+		case <-q.ready:
+		case <-c.closeChan:
+			c.LocalKite.Log.Debug("Send hub is closed")
+			return
+		}
 
-			err := session.Send(string(msg.p))
-			if err != nil {
-				if msg.errC != nil {
-					msg.errC <- err
+		for msg := q.pop(); msg != nil; msg = q.pop() {
+			if err := c.sendMessage(msg); sockjsclient.IsSessionClosed(err) {
+				// The readloop may already be interrupted, thus the non-blocking send.
+				select {
+				case c.interrupt <- err:
+				default:
 				}
 
-				if sockjsclient.IsSessionClosed(err) {
-					// The readloop may already be interrupted, thus the non-blocking send.
-					select {
-					case c.interrupt <- err:
-					default:
-					}
-
-					c.LocalKite.Log.Error("error sending to %s: %s", session.ID(), err)
-					return
+				// Let the next send hub send the remaining messages.
+				select {
+				case q.ready <- struct{}{}:
+				default:
 				}
+
+				return
 			}
-		case <-c.closeChan:
-			c.LocalKite.Log.Debug("Send hub is closed")
-			return
 		}
 	}
 }
 
+// sendQueue gives the queue of the messages waiting to be sent.
+func (c *Client) sendQueue() *sendQueue {
+	c.queueOnce.Do(func() {
+		c.queue = newSendQueue(c.config())
+	})
+
+	return c.queue
+}
+
+// sendMessage sends the message over the current session.
+func (c *Client) sendMessage(msg *message) error {
+	q := c.sendQueue()
+	defer q.done(msg)
+
+	c.LocalKite.Log.Debug("sending: %s", msg.p)
+	c.m.RLock()
+	session, rec := c.session, c.recorder
+	c.m.RUnlock()
+
+	if session == nil {
+		c.LocalKite.Log.Error("not connected")
+		putBuffer(msg.buf)
+		return nil
+	}
+
+	err := session.Send(string(msg.p))
+	if err == nil {
+		rec.Record(false, string(msg.p))
+	}
+
+	for _, frame := range msg.frames {
+		if err != nil {
+			break
+		}
+
+		if err = session.Send(string(frame)); err == nil {
+			rec.Record(false, string(frame))
+		}
+	}
+
+	// Send copies the message, so its buffer can be reused.
+	putBuffer(msg.buf)
+
+	if err != nil && msg.errC != nil {
+		msg.errC <- err
+	}
+
+	if sockjsclient.IsSessionClosed(err) {
+		c.LocalKite.Log.Error("error sending to %s: %s", session.ID(), err)
+	}
+
+	return err
+}
+
 // OnConnect adds a callback which is called when client connects
 // to a remote kite.
 func (c *Client) OnConnect(handler func()) {
@@ -583,13 +1061,24 @@ func (c *Client) OnConnect(handler func()) {
 }
 
 // OnDisconnect adds a callback which is called when client disconnects
-// from a remote kite.
+// from a remote kite. Use OnConnectionStateChange to learn the reason
+// of the disconnect.
 func (c *Client) OnDisconnect(handler func()) {
 	c.m.Lock()
 	c.onDisconnectHandlers = append(c.onDisconnectHandlers, handler)
 	c.m.Unlock()
 }
 
+// OnReconnectAttempt adds a callback which is called before each redial
+// attempt of a client with Reconnect enabled. The attempt is counted
+// from 1 for each reconnection, err is the error of the previous attempt
+// or nil for the first one.
+func (c *Client) OnReconnectAttempt(handler func(attempt int, err error)) {
+	c.m.Lock()
+	c.onReconnectAttemptHandlers = append(c.onReconnectAttemptHandlers, handler)
+	c.m.Unlock()
+}
+
 // OnTokenExpire adds a callback which is called when client receives
 // token-is-expired error from a remote kite.
 func (c *Client) OnTokenExpire(handler func()) {
@@ -606,6 +1095,23 @@ func (c *Client) OnTokenRenew(handler func(token string)) {
 	c.m.Unlock()
 }
 
+// OnTokenRenewed adds a callback which is called when client successfully
+// renews its token, with the time the renewed token expires at.
+func (c *Client) OnTokenRenewed(handler func(token string, expiresAt time.Time)) {
+	c.m.Lock()
+	c.onTokenRenewedHandlers = append(c.onTokenRenewedHandlers, handler)
+	c.m.Unlock()
+}
+
+// OnTokenRenewFailure adds a callback which is called when client fails
+// to renew its token. The attempt is counted from 1 until the token is
+// renewed, the renewal is retried with backoff meanwhile.
+func (c *Client) OnTokenRenewFailure(handler func(attempt int, err error)) {
+	c.m.Lock()
+	c.onTokenRenewFailureHandlers = append(c.onTokenRenewFailureHandlers, handler)
+	c.m.Unlock()
+}
+
 // callOnConnectHandlers runs the registered connect handlers.
 func (c *Client) callOnConnectHandlers() {
 	c.m.RLock()
@@ -632,6 +1138,20 @@ func (c *Client) callOnDisconnectHandlers() {
 	}
 }
 
+// callOnReconnectAttemptHandlers runs the registered reconnect attempt
+// handlers.
+func (c *Client) callOnReconnectAttemptHandlers(attempt int, err error) {
+	c.m.RLock()
+	defer c.m.RUnlock()
+
+	for _, handler := range c.onReconnectAttemptHandlers {
+		func() {
+			defer nopRecover()
+			handler(attempt, err)
+		}()
+	}
+}
+
 // callOnTokenExpireHandlers calls registered functions when an error
 // from remote kite is received that token used is expired.
 func (c *Client) callOnTokenExpireHandlers() {
@@ -660,21 +1180,54 @@ func (c *Client) callOnTokenRenewHandlers(token string) {
 	}
 }
 
-func (c *Client) wrapMethodArgs(args []interface{}, responseCallback dnode.Function) []interface{} {
-	options := callOptionsOut{
-		WithArgs: args,
-		callOptions: callOptions{
-			Kite:             *c.LocalKite.Kite(),
-			Auth:             c.authCopy(),
-			ResponseCallback: responseCallback,
-		},
+// callOnTokenRenewedHandlers calls all registered functions when
+// we successfully obtain new token from kontrol.
+func (c *Client) callOnTokenRenewedHandlers(token string, expiresAt time.Time) {
+	c.m.RLock()
+	defer c.m.RUnlock()
+
+	for _, handler := range c.onTokenRenewedHandlers {
+		func() {
+			defer nopRecover()
+			handler(token, expiresAt)
+		}()
+	}
+}
+
+// callOnTokenRenewFailureHandlers calls all registered functions when
+// we fail to obtain new token from kontrol.
+func (c *Client) callOnTokenRenewFailureHandlers(attempt int, err error) {
+	c.m.RLock()
+	defer c.m.RUnlock()
+
+	for _, handler := range c.onTokenRenewFailureHandlers {
+		func() {
+			defer nopRecover()
+			handler(attempt, err)
+		}()
 	}
-	return []interface{}{options}
+}
+
+// wrapMethodArgs wraps the arguments with the given options, filling
+// the kite and authentication fields.
+func (c *Client) wrapMethodArgs(args []interface{}, options callOptions) []interface{} {
+	options.Kite = *c.LocalKite.Kite()
+	options.Auth = c.authCopy()
+
+	if options.Auth != nil && options.Auth.Type == "token" {
+		c.LocalKite.newNonce(options.Auth)
+	}
+
+	return []interface{}{callOptionsOut{
+		WithArgs:    args,
+		callOptions: options,
+	}}
 }
 
 // Tell makes a blocking method call to the server.
 // Waits until the callback function is called by the other side and
-// returns the result and the error.
+// returns the result and the error. Failed calls are retried
+// if a retry policy is set with WithRetry.
 func (c *Client) Tell(method string, args ...interface{}) (result *dnode.Partial, err error) {
 	return c.TellWithTimeout(method, 0, args...)
 }
@@ -682,11 +1235,35 @@ func (c *Client) Tell(method string, args ...interface{}) (result *dnode.Partial
 // TellWithTimeout does the same thing with Tell() method except it takes an
 // extra argument that is the timeout for waiting reply from the remote Kite.
 // If timeout is given 0, the behavior is same as Tell().
+//
+// The timeout is sent to the remote kite, which sets it as the deadline
+// of the request context and does not run the method if the call
+// has expired before reaching the handler.
 func (c *Client) TellWithTimeout(method string, timeout time.Duration, args ...interface{}) (result *dnode.Partial, err error) {
+	if p := c.retryPolicy(); p.retries(method) {
+		return c.tellWithRetry(context.Background(), p, method, timeout, args)
+	}
+
 	response := <-c.GoWithTimeout(method, timeout, args...)
 	return response.Result, response.Err
 }
 
+// TellWithContext does the same thing with Tell() method except it
+// stops waiting for the reply when the ctx is done, in which case the
+// error of the context is returned.
+//
+// If CancelRemote is true, the remote kite is notified about
+// the cancellation. The deadline of the ctx, if any, is sent
+// to the remote kite like the timeout of TellWithTimeout.
+func (c *Client) TellWithContext(ctx context.Context, method string, args ...interface{}) (result *dnode.Partial, err error) {
+	if p := c.retryPolicy(); p.retries(method) || (p != nil && hasIdempotencyKey(ctx)) {
+		return c.tellWithRetry(ctx, p, method, 0, args)
+	}
+
+	response := <-c.GoWithContext(ctx, method, args...)
+	return response.Result, response.Err
+}
+
 // Go makes an unblocking method call to the server.
 // It returns a channel that the caller can wait on it to get the response.
 func (c *Client) Go(method string, args ...interface{}) chan *response {
@@ -701,14 +1278,56 @@ func (c *Client) GoWithTimeout(method string, timeout time.Duration, args ...int
 	// It can wait on this channel to get the response.
 	responseChan := make(chan *response, 1)
 
-	c.sendMethod(method, args, timeout, responseChan)
+	c.sendMethod(context.Background(), method, args, timeout, callOptions{}, responseChan)
+
+	return responseChan
+}
+
+// GoWithContext does the same thing with Go() method except it takes
+// a context, see TellWithContext for details.
+func (c *Client) GoWithContext(ctx context.Context, method string, args ...interface{}) chan *response {
+	responseChan := make(chan *response, 1)
+
+	c.sendMethod(ctx, method, args, 0, callOptions{}, responseChan)
 
 	return responseChan
 }
 
 // sendMethod wraps the arguments, adds a response callback,
 // marshals the message and send it over the wire.
-func (c *Client) sendMethod(method string, args []interface{}, timeout time.Duration, responseChan chan *response) {
+//
+// Stream and progress callbacks of the options, if valid, are sent
+// alongside the response callback and removed after the response
+// is received.
+//
+// The call is traced with a client span, which is a child of
+// the span in ctx, if any.
+func (c *Client) sendMethod(ctx context.Context, method string, args []interface{}, timeout time.Duration, options callOptions, responseChan chan *response) {
+	var breakerDone func(error)
+
+	if cb := c.CircuitBreaker; cb != nil {
+		done, ok := cb.allow()
+		if !ok {
+			err := *ErrCircuitOpen
+			responseChan <- &response{Err: &err}
+			return
+		}
+
+		breakerDone = done
+	}
+
+	ctx, span := c.LocalKite.startSpan(ctx, method, trace.SpanKindClient)
+
+	// send ends the span and passes the response to the caller.
+	send := func(resp *response) {
+		if breakerDone != nil {
+			breakerDone(resp.Err)
+		}
+
+		endSpan(span, resp.Err)
+		responseChan <- resp
+	}
+
 	// To clean the sent callback after response is received.
 	// Send/Receive in a channel to prevent race condition because
 	// the callback is run in a separate goroutine.
@@ -717,18 +1336,50 @@ func (c *Client) sendMethod(method string, args []interface{}, timeout time.Dura
 	// When a callback is called it will send the response to this channel.
 	doneChan := make(chan *response, 1)
 
+	// Calls that can be canceled get an ID, which the remote
+	// kite uses to find the canceled request.
+	var cancelID string
+	if ctx.Done() != nil && c.CancelRemote {
+		cancelID = utils.RandomString(16)
+	}
+
+	requestID, _ := RequestIDFromContext(ctx)
+	idempotencyKey, _ := IdempotencyKeyFromContext(ctx)
+
+	// Let the remote kite know when the caller stops waiting,
+	// so it does not process calls nobody waits for.
+	var callTimeout time.Duration
+	if timeout > 0 {
+		callTimeout = timeout
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		if d := time.Until(deadline); callTimeout == 0 || d < callTimeout {
+			callTimeout = d
+		}
+	}
+
 	cb := c.makeResponseCallback(doneChan, removeCallback, method, args)
-	args = c.wrapMethodArgs(args, cb)
+	args = c.wrapMethodArgs(args, callOptions{
+		ResponseCallback: cb,
+		StreamCallback:   options.StreamCallback,
+		ProgressCallback: options.ProgressCallback,
+		Trace:            c.LocalKite.injectTrace(ctx),
+		CancelID:         cancelID,
+		RequestID:        requestID,
+		Timeout:          callTimeout,
+		IdempotencyKey:   idempotencyKey,
+	})
 
 	callbacks, errC, err := c.marshalAndSend(method, args)
 	if err != nil {
-		responseChan <- &response{
+		send(&response{
 			Result: nil,
 			Err: &Error{
-				Type:    "sendError",
-				Message: err.Error(),
+				Type:      "sendError",
+				Message:   err.Error(),
+				Retryable: true,
 			},
-		}
+		})
 		return
 	}
 
@@ -739,52 +1390,74 @@ func (c *Client) sendMethod(method string, args []interface{}, timeout time.Dura
 		afterTimeout = time.After(timeout)
 	}
 
+	atomic.AddInt64(&c.pendingCalls, 1)
+
 	// Waits until the response has came or the connection has disconnected.
 	go func() {
+		defer atomic.AddInt64(&c.pendingCalls, -1)
+
+		// Do not hold the lock while waiting, otherwise the disconnect
+		// is not signaled until all pending calls are done.
 		c.disconnectMu.Lock()
-		defer c.disconnectMu.Unlock()
+		disconnect := c.disconnect
+		c.disconnectMu.Unlock()
+
+		for _, name := range []string{"streamCallback", "progressCallback"} {
+			if id, ok := callbackID(callbacks, name); ok {
+				defer c.scrubber.RemoveCallback(id)
+			}
+		}
 
 		select {
 		case resp := <-doneChan:
-			if e, ok := resp.Err.(*Error); ok {
-				if e.Type == "authenticationError" && strings.Contains(e.Message, "token is expired") {
-					c.callOnTokenExpireHandlers()
-				}
+			if isTokenExpired(resp.Err) {
+				c.callOnTokenExpireHandlers()
 			}
 
-			responseChan <- resp
-		case <-c.disconnect:
-			responseChan <- &response{
+			send(resp)
+		case <-disconnect:
+			send(&response{
 				nil,
 				&Error{
 					Type:    "disconnect",
 					Message: "Remote kite has disconnected",
 				},
-			}
+			})
 		case err := <-errC:
 			if err != nil {
-				responseChan <- &response{
+				send(&response{
 					nil,
 					&Error{
-						Type:    "sendError",
-						Message: err.Error(),
+						Type:      "sendError",
+						Message:   err.Error(),
+						Retryable: true,
 					},
-				}
+				})
 			}
 		case <-afterTimeout:
-			responseChan <- &response{
+			send(&response{
 				nil,
 				&Error{
 					Type:    "timeout",
 					Message: fmt.Sprintf("No response to %q method in %s", method, timeout),
 				},
-			}
+			})
 
 			// Remove the callback function from the map so we do not
 			// consume memory for unused callbacks.
 			if id, ok := <-removeCallback; ok {
 				c.scrubber.RemoveCallback(id)
 			}
+		case <-ctx.Done():
+			send(&response{nil, ctx.Err()})
+
+			if id, ok := <-removeCallback; ok {
+				c.scrubber.RemoveCallback(id)
+			}
+
+			if cancelID != "" {
+				go c.sendCancel(cancelID)
+			}
 		}
 	}()
 
@@ -796,6 +1469,7 @@ func (c *Client) sendMethod(method string, args []interface{}, timeout time.Dura
 func (c *Client) marshalAndSend(method interface{}, arguments []interface{}) (callbacks map[string]dnode.Path, errC <-chan error, err error) {
 	// scrub trough the arguments and save any callbacks.
 	callbacks = c.scrubber.Scrub(arguments)
+	attachments := dnode.CollectAttachments(arguments)
 
 	defer func() {
 		if err != nil {
@@ -808,35 +1482,78 @@ func (c *Client) marshalAndSend(method interface{}, arguments []interface{}) (ca
 		arguments = make([]interface{}, 0)
 	}
 
-	rawArgs, err := json.Marshal(arguments)
-	if err != nil {
+	codec := c.getCodec()
+
+	// The arguments are copied into the message, so their buffer
+	// can be reused right after the message is encoded.
+	argsBuf := getBuffer()
+	defer putBuffer(argsBuf)
+
+	if err := dnode.MarshalTo(codec, argsBuf, arguments); err != nil {
 		return nil, nil, err
 	}
 
+	rawArgs := argsBuf.Bytes()
+
+	var frames [][]byte
+
+	if len(attachments) != 0 && !c.sendsAttachments() {
+		if rawArgs, err = dnode.InlineAttachments(codec, rawArgs, attachments); err != nil {
+			return nil, nil, err
+		}
+
+		attachments = nil
+	}
+
 	msg := dnode.Message{
 		Method:    method,
-		Arguments: &dnode.Partial{Raw: rawArgs},
+		Arguments: &dnode.Partial{Raw: rawArgs, Codec: codec},
 		Callbacks: callbacks,
 	}
 
-	p, err := json.Marshal(msg)
+	for _, spec := range attachments {
+		msg.Attachments = append(msg.Attachments, spec.Path)
+		frames = append(frames, c.encodeAttachment(spec.Data))
+	}
+
+	msgBuf := getBuffer()
+	defer putBuffer(msgBuf)
+
+	if err := dnode.MarshalTo(codec, msgBuf, msg); err != nil {
+		return nil, nil, err
+	}
+
+	p, z, err := c.compress(msgBuf.Bytes())
 	if err != nil {
 		return nil, nil, err
 	}
 
+	// The frame buffer is released by the send hub.
+	frame := getBuffer()
+	encodeFrame(frame, codec, z, p)
+
 	select {
 	case <-c.closeChan:
+		putBuffer(frame)
 		return nil, nil, errors.New("can't send, client is closed")
 	default:
 		if c.getSession() == nil {
+			putBuffer(frame)
 			return nil, nil, errors.New("can't send, session is not established yet")
 		}
 
 		errC := make(chan error, 1)
 
-		c.send <- &message{
-			p:    p,
-			errC: errC,
+		msg := &message{
+			p:      frame.Bytes(),
+			buf:    frame,
+			frames: frames,
+			errC:   errC,
+		}
+
+		if err := c.sendQueue().push(msg, c.closeChan); err != nil {
+			putBuffer(frame)
+			return nil, nil, err
 		}
 
 		return callbacks, errC, nil
@@ -855,7 +1572,49 @@ func (c *Client) setSession(session sockjs.Session) {
 
 	c.m.Lock()
 	c.session = session
+	if c.sessionCancel != nil {
+		c.sessionCancel()
+	}
+	c.sessionCtx, c.sessionCancel = context.WithCancel(context.Background())
+	ctx := c.sessionCtx
+	if c.recorder != nil {
+		c.recorder.Close()
+	}
+	c.recorder = c.newRecorder(session)
 	c.m.Unlock()
+
+	atomic.StoreInt32(&c.goingAway, 0)
+
+	c.touch()
+	go c.keepAlive(ctx, session)
+}
+
+// sessionContext gives a context of the current session. The context
+// is canceled when the session ends.
+func (c *Client) sessionContext() context.Context {
+	c.m.RLock()
+	defer c.m.RUnlock()
+
+	if c.sessionCtx == nil {
+		return context.Background()
+	}
+
+	return c.sessionCtx
+}
+
+// cancelSession cancels the context of the current session, signalling
+// running method handlers the remote kite has gone away.
+func (c *Client) cancelSession() {
+	c.m.RLock()
+	defer c.m.RUnlock()
+
+	if c.sessionCancel != nil {
+		c.sessionCancel()
+	}
+
+	if c.recorder != nil {
+		c.recorder.Close()
+	}
 }
 
 // Used to remove callbacks after error occurs in send().
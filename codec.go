@@ -0,0 +1,365 @@
+package kite
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/koding/kite/config"
+	"github.com/koding/kite/dnode"
+)
+
+// handshakeArgs is the argument of kite.handshake method, which
+// the client calls after connecting in order to negotiate the codec
+// used for the session.
+type handshakeArgs struct {
+	// Codecs the client supports, in order of preference.
+	Codecs []string `json:"codecs"`
+
+	// Attachments is true if the client receives attachments
+	// as frames following the messages.
+	Attachments bool `json:"attachments,omitempty"`
+
+	// Compression algorithms the client supports, in order of preference.
+	Compression []string `json:"compression,omitempty"`
+}
+
+// handshakeResult is the result of kite.handshake method.
+type handshakeResult struct {
+	// Codec chosen by the server.
+	Codec string `json:"codec"`
+
+	// Attachments is true if the server receives attachments
+	// as frames following the messages.
+	Attachments bool `json:"attachments,omitempty"`
+
+	// Compression algorithm chosen by the server, empty if messages
+	// are not compressed.
+	Compression string `json:"compression,omitempty"`
+}
+
+// encodeFrame appends to buf the message encoded with the given codec and
+// optionally compressed, wrapping it so it can be sent over text-based
+// transports and told apart from JSON messages.
+//
+// Uncompressed JSON messages are sent as is, other messages are sent
+// as "<codec name>:<base64 encoded message>" or, when compressed, as
+// "<codec name>+<compression>:<base64 encoded message>".
+func encodeFrame(buf *bytes.Buffer, c dnode.Codec, z compressor, p []byte) {
+	if c.Name() == dnode.JSON.Name() && z == nil {
+		buf.Write(p)
+		return
+	}
+
+	buf.WriteString(c.Name())
+	if z != nil {
+		buf.WriteByte('+')
+		buf.WriteString(z.Name())
+	}
+	buf.WriteByte(':')
+
+	enc := base64.NewEncoder(base64.StdEncoding, buf)
+	enc.Write(p)
+	enc.Close()
+}
+
+// decodeFrame gives the message and the codec it was encoded with.
+// Compressed messages are accepted only if they were compressed with
+// the given algorithm, and are decompressed up to maxSize bytes,
+// or config.DefaultMaxDecompressedSize bytes if maxSize is 0.
+func decodeFrame(frame []byte, compression string, maxSize int64) (dnode.Codec, []byte, error) {
+	p := bytes.TrimLeft(frame, " \t\r\n")
+
+	if len(p) == 0 || p[0] == '{' || p[0] == '[' {
+		return dnode.JSON, frame, nil
+	}
+
+	i := bytes.IndexByte(p, ':')
+	if i == -1 {
+		return nil, nil, errors.New("invalid message frame")
+	}
+
+	name, algorithm := p[:i], []byte(nil)
+	if j := bytes.IndexByte(name, '+'); j != -1 {
+		name, algorithm = name[:j], name[j+1:]
+	}
+
+	// Do not decompress messages the session did not agree on,
+	// e.g. ones sent before the handshake.
+	if algorithm != nil && string(algorithm) != compression {
+		return nil, nil, fmt.Errorf("compression %q was not negotiated", algorithm)
+	}
+
+	c := dnode.GetCodec(string(name))
+	if c == nil {
+		return nil, nil, fmt.Errorf("unknown codec %q", name)
+	}
+
+	msg := make([]byte, base64.StdEncoding.DecodedLen(len(p)-i-1))
+
+	n, err := base64.StdEncoding.Decode(msg, p[i+1:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	msg = msg[:n]
+
+	if algorithm != nil {
+		z := getCompressor(string(algorithm))
+		if z == nil {
+			return nil, nil, fmt.Errorf("unknown compression %q", algorithm)
+		}
+
+		if maxSize == 0 {
+			maxSize = config.DefaultMaxDecompressedSize
+		}
+
+		if msg, err = z.Decompress(msg, maxSize); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return c, msg, nil
+}
+
+// callbackMethodID gives the ID of the callback, when the method of
+// the message is a number.
+func callbackMethodID(method interface{}) (uint64, bool) {
+	// JSON decodes numbers as float64, other codecs may
+	// decode them as integers.
+	switch rv := reflect.ValueOf(method); rv.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return uint64(rv.Float()), true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return uint64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return rv.Uint(), true
+	default:
+		return 0, false
+	}
+}
+
+// getCodec gives the codec used for sending messages over
+// the current session.
+func (c *Client) getCodec() dnode.Codec {
+	c.codecMu.Lock()
+	codec := c.codec
+	c.codecMu.Unlock()
+
+	if codec == nil || codec.Name() == dnode.JSON.Name() {
+		return c.jsonCodec()
+	}
+
+	return codec
+}
+
+// jsonCodec gives the JSON codec, which uses the encoder
+// configured with Config.JSONEncoder.
+func (c *Client) jsonCodec() dnode.Codec {
+	return dnode.NewJSONCodec(c.config().JSONEncoder)
+}
+
+func (c *Client) setCodec(codec dnode.Codec) {
+	c.codecMu.Lock()
+	c.codec = codec
+	c.codecMu.Unlock()
+}
+
+// negotiateCodec asks the remote kite to use the codec configured
+// with Config.Codec for the current session. The session keeps using
+// JSON if the remote kite does not support the codec.
+//
+// If Config.Attachments is true, both kites agree on sending
+// attachments as frames, if the remote kite supports them. Likewise
+// for compressing messages with Config.Compression.
+func (c *Client) negotiateCodec() {
+	// Messages are always decoded with the codec they were encoded
+	// with, so the codec is reset for a new session until the
+	// negotiation is done.
+	c.setCodec(nil)
+	c.setAttachments(false)
+	c.setCompressor(nil)
+	c.setDecompression("")
+
+	args := &handshakeArgs{
+		Attachments: c.config().Attachments,
+	}
+
+	if name := c.config().Codec; name != "" && name != dnode.JSON.Name() {
+		if dnode.GetCodec(name) != nil {
+			args.Codecs = []string{name}
+		} else {
+			c.LocalKite.Log.Warning("Unknown codec %q, using %q", name, dnode.JSON.Name())
+		}
+	}
+
+	if name := c.config().Compression.Algorithm; name != "" && !c.compressedSession() {
+		if getCompressor(name) != nil {
+			args.Compression = []string{name}
+		} else {
+			c.LocalKite.Log.Warning("Unknown compression %q, messages are not compressed", name)
+		}
+	}
+
+	if len(args.Codecs) == 0 && !args.Attachments && len(args.Compression) == 0 {
+		return
+	}
+
+	// The remote kite may compress the messages it sends once it
+	// got the handshake, even before the result reaches us.
+	if len(args.Compression) != 0 {
+		c.setDecompression(args.Compression[0])
+	}
+
+	resp, err := c.TellWithTimeout("kite.handshake", c.config().Timeout, args)
+	if err != nil {
+		c.LocalKite.Log.Debug("Unable to negotiate session with %s: %s", c.URL, err)
+		return
+	}
+
+	var res handshakeResult
+	if err := resp.Unmarshal(&res); err != nil {
+		c.LocalKite.Log.Debug("Unable to negotiate session with %s: %s", c.URL, err)
+		return
+	}
+
+	if codec := dnode.GetCodec(res.Codec); codec != nil {
+		c.setCodec(codec)
+	}
+
+	c.setAttachments(res.Attachments)
+
+	if z := getCompressor(res.Compression); z != nil {
+		c.setCompressor(z)
+	} else {
+		c.setDecompression("")
+	}
+}
+
+// handleHandshake chooses the first codec and compression supported
+// by both sides and uses them for sending messages over the current
+// session.
+func handleHandshake(r *Request) (interface{}, error) {
+	var args handshakeArgs
+
+	if err := r.Args.One().Unmarshal(&args); err != nil {
+		return nil, err
+	}
+
+	res := &handshakeResult{
+		Codec:       dnode.JSON.Name(),
+		Attachments: args.Attachments,
+	}
+
+	for _, name := range args.Codecs {
+		if codec := dnode.GetCodec(name); codec != nil {
+			r.Client.setCodec(codec)
+			res.Codec = name
+			break
+		}
+	}
+
+	r.Client.setAttachments(args.Attachments)
+
+	for _, name := range args.Compression {
+		if z := getCompressor(name); z != nil {
+			r.Client.setCompressor(z)
+			r.Client.setDecompression(name)
+			res.Compression = name
+			break
+		}
+	}
+
+	return res, nil
+}
+
+// sendsAttachments tells whether attachments are sent as frames
+// over the current session.
+func (c *Client) sendsAttachments() bool {
+	c.codecMu.Lock()
+	defer c.codecMu.Unlock()
+
+	return c.attachments
+}
+
+func (c *Client) setAttachments(ok bool) {
+	c.codecMu.Lock()
+	c.attachments = ok
+	c.codecMu.Unlock()
+}
+
+// binary tells whether the current session passes the frames as they
+// are, e.g. gRPC does. Frames sent over SockJS must be valid UTF-8.
+func (c *Client) binary() bool {
+	session, ok := c.getSession().(interface {
+		Binary() bool
+	})
+
+	return ok && session.Binary()
+}
+
+// compressedSession tells whether the current session is already
+// compressed by the transport, e.g. WebSocket connections with
+// the permessage-deflate extension are.
+func (c *Client) compressedSession() bool {
+	session, ok := c.getSession().(interface {
+		Compressed() bool
+	})
+
+	return ok && session.Compressed()
+}
+
+// encodeAttachment gives the frame the attachment is sent with,
+// the attachment is base64 encoded unless the session is binary.
+func (c *Client) encodeAttachment(p []byte) []byte {
+	if c.binary() {
+		return p
+	}
+
+	frame := make([]byte, base64.StdEncoding.EncodedLen(len(p)))
+	base64.StdEncoding.Encode(frame, p)
+
+	return frame
+}
+
+// receiveAttachments reads the attachments following the message
+// and sets them to its arguments.
+func (c *Client) receiveAttachments(msg *dnode.Message) error {
+	frames := make([][]byte, len(msg.Attachments))
+
+	var decodeErr error
+
+	for i := range frames {
+		frame, err := c.receiveData()
+		if err != nil {
+			return err
+		}
+
+		if limit := c.maxMessageSize(); limit > 0 && int64(len(frame)) > limit {
+			return &MessageTooLargeError{Limit: limit}
+		}
+
+		// Read all the frames even if some are invalid, so they
+		// are not taken for messages.
+		if !c.binary() {
+			p := make([]byte, base64.StdEncoding.DecodedLen(len(frame)))
+
+			n, err := base64.StdEncoding.Decode(p, frame)
+			if err != nil && decodeErr == nil {
+				decodeErr = err
+			}
+
+			frame = p[:n]
+		}
+
+		frames[i] = frame
+	}
+
+	if decodeErr != nil {
+		return decodeErr
+	}
+
+	return dnode.ParseAttachments(msg, frames)
+}
@@ -0,0 +1,242 @@
+package kite
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	"github.com/koding/kite/config"
+
+	"github.com/gorilla/websocket"
+	"github.com/igm/sockjs-go/sockjs"
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressor compresses messages sent over a session.
+type compressor interface {
+	// Name of the compression algorithm, it is used for
+	// negotiating the compression and in message frames.
+	Name() string
+
+	// Compress compresses p with the given level, 0 is the default one.
+	Compress(p []byte, level int) ([]byte, error)
+
+	// Decompress decompresses p, failing with *MessageTooLargeError
+	// if it gets larger than maxSize bytes, unless maxSize is 0.
+	Decompress(p []byte, maxSize int64) ([]byte, error)
+}
+
+var compressors = map[string]compressor{
+	"deflate": deflateCompressor{},
+	"zstd":    zstdCompressor{},
+}
+
+// getCompressor gives the compressor of the given algorithm,
+// or nil if the algorithm is not supported.
+func getCompressor(name string) compressor {
+	return compressors[name]
+}
+
+type deflateCompressor struct{}
+
+func (deflateCompressor) Name() string { return "deflate" }
+
+func (deflateCompressor) Compress(p []byte, level int) ([]byte, error) {
+	// For flate 0 means no compression.
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+
+	var buf bytes.Buffer
+
+	w, err := flate.NewWriter(&buf, level)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(p); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (deflateCompressor) Decompress(p []byte, maxSize int64) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(p))
+	defer r.Close()
+
+	if maxSize == 0 {
+		return ioutil.ReadAll(r)
+	}
+
+	msg, err := ioutil.ReadAll(io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(msg)) > maxSize {
+		return nil, &MessageTooLargeError{Limit: maxSize}
+	}
+
+	return msg, nil
+}
+
+type zstdCompressor struct{}
+
+var (
+	// zstd encoders and decoders are expensive to create, while safe
+	// for concurrent use, so they are shared by all the sessions.
+	zstdMu       sync.Mutex
+	zstdEncoders = make(map[int]*zstd.Encoder)
+	zstdDecoders = make(map[int64]*zstd.Decoder)
+)
+
+func (zstdCompressor) Name() string { return "zstd" }
+
+func (zstdCompressor) Compress(p []byte, level int) ([]byte, error) {
+	zstdMu.Lock()
+	enc, ok := zstdEncoders[level]
+	if !ok {
+		var opts []zstd.EOption
+		if level != 0 {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		}
+
+		var err error
+		if enc, err = zstd.NewWriter(nil, opts...); err != nil {
+			zstdMu.Unlock()
+			return nil, err
+		}
+
+		zstdEncoders[level] = enc
+	}
+	zstdMu.Unlock()
+
+	return enc.EncodeAll(p, nil), nil
+}
+
+func (zstdCompressor) Decompress(p []byte, maxSize int64) ([]byte, error) {
+	zstdMu.Lock()
+	dec, ok := zstdDecoders[maxSize]
+	if !ok {
+		var opts []zstd.DOption
+		if maxSize != 0 {
+			opts = append(opts, zstd.WithDecoderMaxMemory(uint64(maxSize)))
+		}
+
+		var err error
+		if dec, err = zstd.NewReader(nil, opts...); err != nil {
+			zstdMu.Unlock()
+			return nil, err
+		}
+
+		zstdDecoders[maxSize] = dec
+	}
+	zstdMu.Unlock()
+
+	msg, err := dec.DecodeAll(p, nil)
+	if err == zstd.ErrDecoderSizeExceeded {
+		return nil, &MessageTooLargeError{Limit: maxSize}
+	}
+
+	return msg, err
+}
+
+// getCompressor gives the compressor used for sending messages over
+// the current session, nil if messages are not compressed.
+func (c *Client) getCompressor() compressor {
+	c.codecMu.Lock()
+	defer c.codecMu.Unlock()
+
+	return c.compressor
+}
+
+func (c *Client) setCompressor(z compressor) {
+	c.codecMu.Lock()
+	c.compressor = z
+	c.codecMu.Unlock()
+}
+
+// getDecompression gives the compression algorithm of the messages
+// accepted over the current session, empty if none is.
+func (c *Client) getDecompression() string {
+	c.codecMu.Lock()
+	defer c.codecMu.Unlock()
+
+	return c.decompression
+}
+
+func (c *Client) setDecompression(name string) {
+	c.codecMu.Lock()
+	c.decompression = name
+	c.codecMu.Unlock()
+}
+
+// compress compresses the encoded message, if compression was negotiated
+// for the current session and the message is big enough. It gives the
+// compressor used, nil if the message was not compressed.
+func (c *Client) compress(p []byte) ([]byte, compressor, error) {
+	z := c.getCompressor()
+	if z == nil {
+		return p, nil, nil
+	}
+
+	cfg := c.config().Compression
+
+	minSize := cfg.MinSize
+	if minSize == 0 {
+		minSize = config.DefaultCompressionMinSize
+	}
+
+	if len(p) < minSize {
+		return p, nil, nil
+	}
+
+	compressed, err := z.Compress(p, cfg.Level)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to compress message with %s: %s", z.Name(), err)
+	}
+
+	// Do not send the compressed message if it did not get smaller.
+	if len(compressed) >= len(p) {
+		return p, nil, nil
+	}
+
+	return compressed, z, nil
+}
+
+// sockjsOptions gives the options of the SockJS handler, which enable
+// the permessage-deflate extension for WebSocket connections if
+// compression is configured.
+func sockjsOptions(cfg *config.Config) sockjs.Options {
+	opts := *cfg.SockJS
+
+	if cfg.Compression.Algorithm == "" {
+		return opts
+	}
+
+	if opts.WebsocketUpgrader != nil {
+		upgrader := *opts.WebsocketUpgrader
+		opts.WebsocketUpgrader = &upgrader
+	} else {
+		// Mimic the upgrader SockJS uses by default.
+		opts.WebsocketUpgrader = &websocket.Upgrader{
+			ReadBufferSize:  sockjs.WebSocketReadBufSize,
+			WriteBufferSize: sockjs.WebSocketWriteBufSize,
+			CheckOrigin:     func(*http.Request) bool { return true },
+			Error:           func(http.ResponseWriter, *http.Request, int, error) {},
+		}
+	}
+
+	opts.WebsocketUpgrader.EnableCompression = true
+
+	return opts
+}
@@ -2,21 +2,26 @@
 package config
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"net/http/cookiejar"
 	"os"
-	"strconv"
 	"time"
 
+	"github.com/koding/kite/dnode"
 	"github.com/koding/kite/kitekey"
 	"github.com/koding/kite/protocol"
 
 	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/gorilla/websocket"
 	"github.com/igm/sockjs-go/sockjs"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/crypto/ssh"
 )
 
 // the implementation of New() doesn't have any error to be returned yet it
@@ -35,9 +40,112 @@ type Config struct {
 	DisableConcurrency    bool      // Do not process messages concurrently.
 	Transport             Transport // SockJS transport to use.
 
+	// Codec is the name of the codec used for encoding messages,
+	// e.g. "msgpack". It is negotiated with the remote kite after
+	// connecting, JSON is used if the remote kite does not
+	// support it. If empty, JSON is used.
+	Codec string
+
+	// JSONEncoder replaces encoding/json for encoding and decoding
+	// JSON messages, e.g. with jsoniter.ConfigCompatibleWithStandardLibrary.
+	// If nil, encoding/json is used.
+	JSONEncoder dnode.JSONEncoder
+
+	// Attachments makes the client negotiate sending dnode.Attachment
+	// values as separate frames following the messages, instead of
+	// encoding them into the messages. They are encoded if the remote
+	// kite does not support attachments.
+	Attachments bool
+
+	// Compression configures compressing messages sent over sessions
+	// with the remote kites. By default messages are not compressed.
+	Compression Compression
+
+	// MaxRequestSize is the size in bytes of the largest message the kite
+	// server accepts from the kites connected to it, MaxResponseSize of
+	// the largest message a client accepts from the kite it connected to.
+	// The limits apply to the frames read from the transport as well as
+	// to the decoded messages. Sessions receiving larger messages are
+	// closed. If 0, the size is not limited, except for compressed
+	// messages, which decompress up to DefaultMaxDecompressedSize bytes.
+	//
+	// The kite server limits the size of frames read from the transport
+	// to MaxRequestSize set when the kite is created: the bodies of XHR
+	// requests, the messages of WebSocket connections, whose frame
+	// headers are checked before the payload is read, and gRPC messages.
+	MaxRequestSize  int64
+	MaxResponseSize int64
+
+	// MaxHandlerGoroutines limits the number of goroutines executing
+	// method calls received by the kite, shared by all the sessions.
+	// If 0, a goroutine is started for every call.
+	MaxHandlerGoroutines int
+
+	// HandlerOverflow is the policy for method calls received while
+	// all the MaxHandlerGoroutines goroutines are busy.
+	HandlerOverflow Overflow
+
+	// SendQueueHigh and SendQueueLow are the high and low watermarks,
+	// in bytes, of the queue of messages waiting to be sent over each
+	// session. Once the queued messages exceed SendQueueHigh, sending
+	// further messages waits, or fails as set with SendQueueOverflow,
+	// until the queue drains to SendQueueLow. This way a remote kite,
+	// which does not read its messages, does not make the kite hold
+	// on to more and more of them.
+	//
+	// If SendQueueHigh is 0, messages are sent one at a time. If
+	// SendQueueLow is 0 or above SendQueueHigh, half of SendQueueHigh
+	// is used.
+	SendQueueHigh int64
+	SendQueueLow  int64
+
+	// SendQueueOverflow is the policy for messages sent while the queue
+	// is full, see SendQueueHigh. With OverflowQueue the senders wait,
+	// with OverflowReject sending fails with kite.ErrSendQueueFull.
+	SendQueueOverflow Overflow
+
+	// ErrorReporter, if non-nil, receives the panics of the method handlers
+	// and the errors the handler chains fail with, e.g. to send them to
+	// an error tracker, see the kitesentry package.
+	ErrorReporter ErrorReporter
+
+	// SecretsProvider, if non-nil, gives the kite key and the TLS
+	// certificate of the kite, and the key pairs of Kontrol, instead of
+	// reading them from disk, e.g. from a secrets manager, see the kitevault
+	// package. The kite gets them when it starts serving or connects to
+	// Kontrol, and again before they expire.
+	SecretsProvider SecretsProvider
+
+	// SlowCallThreshold makes the kite log method calls, which handlers
+	// run longer than the threshold, with the summary of their arguments
+	// and the stack of the handler sampled once the threshold is exceeded.
+	// If zero, slow calls are not logged.
+	SlowCallThreshold time.Duration
+
+	// RecordDir makes the kite record the frames sent and received over
+	// each session, served and dialed, to a file in the directory, so
+	// the session can be replayed, see kite.ReadRecording. If empty,
+	// sessions are not recorded.
+	RecordDir string
+
 	IP   string // IP of the kite server.
 	Port int    // Port number of the kite server.
 
+	// UnixSocket makes the kite server listen on a Unix domain socket
+	// instead of IP and Port. Clients connect to such kite with
+	// a "unix:///path/to/socket" URL.
+	UnixSocket *UnixSocket
+
+	// AutoTLS makes the kite server obtain and renew its certificate
+	// automatically from Let's Encrypt, or other ACME certificate
+	// authority, instead of using one set with kite.UseTLS.
+	AutoTLS *AutoTLS
+
+	// Listeners are additional addresses the kite server listens on,
+	// e.g. an internal interface of a dual-homed host, besides IP and
+	// Port or UnixSocket.
+	Listeners []Listener
+
 	// VerifyFunc is used to verify the public key of the signed token.
 	//
 	// If the pub key is not to be trusted, the function must return
@@ -58,6 +166,21 @@ type Config struct {
 	// When 0, the default value of 300s is used.
 	VerifyTTL time.Duration
 
+	// ReplayWindow makes the kite reject replayed requests authenticated
+	// with tokens. Such requests need to carry a nonce and a timestamp,
+	// signed with the proof key the token is bound to, which kite clients
+	// send along with tokens issued by Kontrol. Requests are rejected if
+	// their timestamp is off from the time of the kite by more than the
+	// window, or their nonce was already used with the token. Tokens
+	// without an ID (jti) or a proof key are rejected.
+	//
+	// Calls made without a session, e.g. over HTTP with the gateway,
+	// are checked the same way, with the nonce, the timestamp and the
+	// signature sent in the Kite-Nonce, Kite-Timestamp and Kite-Signature
+	// headers, see kite.AuthFromRequest. If zero, requests are not
+	// checked.
+	ReplayWindow time.Duration
+
 	// VerifyAudienceFunc is used to verify the audience of JWT token.
 	//
 	// If nil, the default audience verify function is used which
@@ -80,10 +203,29 @@ type Config struct {
 	//
 	// NOTE: Ensure the Timeout is higher than SockJS.HeartbeatDelay, otherwise
 	// XHR connections may get randomly closed.
-	//
-	// TODO(rjeczalik): Make kite heartbeats configurable as well.
 	Timeout time.Duration
 
+	// PingInterval makes clients ping the remote kite with "kite.ping"
+	// when nothing was received over the connection for the interval,
+	// so half-open connections, e.g. left by a host that went down,
+	// are detected. If zero, connections are not pinged.
+	PingInterval time.Duration
+
+	// PongTimeout is the time the remote kite is given to respond
+	// to a ping, after which the connection is considered dead and
+	// closed. If zero, Timeout is used.
+	PongTimeout time.Duration
+
+	// ShutdownGracePeriod makes Close shut down the kite gracefully,
+	// waiting at most for the period for in-flight method calls
+	// to complete. If zero, Close does not wait.
+	ShutdownGracePeriod time.Duration
+
+	// HeartbeatInterval caps the interval of heartbeats sent to Kontrol,
+	// which is otherwise given by Kontrol when the kite registers.
+	// If zero, the interval of Kontrol is used.
+	HeartbeatInterval time.Duration
+
 	// Client is a HTTP client used for issuing HTTP register request and
 	// HTTP heartbeats.
 	Client *http.Client
@@ -96,6 +238,29 @@ type Config struct {
 	// Required.
 	Websocket *websocket.Dialer
 
+	// ClientCertificates are presented to remote kites when connecting
+	// to them over TLS. Kites that require client certificates
+	// authenticate the connection with them instead of kite keys
+	// or tokens.
+	ClientCertificates []tls.Certificate
+
+	// SSH is used for connecting to the jump hosts of kites dialed
+	// with kite+ssh://user@bastion/host:port/kite URLs.
+	//
+	// If nil, the keys of the SSH agent given by SSH_AUTH_SOCK are
+	// used for authentication and host keys are verified against
+	// ~/.ssh/known_hosts.
+	SSH *ssh.ClientConfig
+
+	// ProxyURL is the URL of the proxy Kontrol and remote kites are
+	// dialed through, either an HTTP proxy, e.g. "http://proxy:3128",
+	// or a SOCKS5 one, e.g. "socks5://proxy:1080". Credentials for
+	// authenticated proxies are given by the user info of the URL.
+	//
+	// If empty, the proxy is given by the HTTPS_PROXY, HTTP_PROXY
+	// and NO_PROXY environment variables.
+	ProxyURL string
+
 	// SockJS are used to configure SockJS handler.
 	//
 	// Required.
@@ -107,9 +272,259 @@ type Config struct {
 	// If Serve is nil, http.Serve is used by default.
 	Serve func(net.Listener, http.Handler) error
 
+	// TracerProvider is used for tracing incoming and outgoing method
+	// calls. The exporter is configured by the provider, e.g.:
+	//
+	//   exporter, _ := otlptracegrpc.New(ctx)
+	//   cfg.TracerProvider = sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter))
+	//
+	// If nil, the global provider is used (see otel.SetTracerProvider).
+	TracerProvider trace.TracerProvider
+
+	// Propagator is used for sending the trace context along
+	// with method calls.
+	//
+	// If nil, W3C Trace Context and Baggage propagators are used.
+	Propagator propagation.TextMapPropagator
+
 	KontrolURL  string
 	KontrolKey  string
 	KontrolUser string
+
+	// Labels are arbitrary key/value pairs, e.g. zone, shard or capacity,
+	// the kite registers to Kontrol with. Other kites can select kites
+	// by their labels with KontrolQuery.Labels.
+	Labels map[string]string
+
+	// Weight is the capacity of the kite relative to other kites, e.g.
+	// the number of CPU cores, the kite registers to Kontrol with. Pools
+	// of kites send calls to the kites proportionally to their weights.
+	// Zero means the default weight of 1.
+	Weight int
+
+	// KontrolURLs are URLs of other Kontrol instances, which are used
+	// when the one under KontrolURL is unreachable. The kite fails over
+	// to the next one when connecting, registering or sending
+	// heartbeats fails.
+	KontrolURLs []string
+
+	// KontrolKeys are additional PEM encoded public keys of Kontrol that are
+	// trusted besides KontrolKey, e.g. the old keys while Kontrol is migrated
+	// to new key pairs or a different signing algorithm.
+	//
+	// Tokens are verified with the key selected by their "kid" header,
+	// or with KontrolKey if the header is missing.
+	KontrolKeys []string
+
+	// The following fields are applied by kite.ReloadConfig, so they can
+	// be changed while the kite is running.
+
+	// LogLevel is the level of the kite logger, one of "DEBUG", "INFO",
+	// "WARNING", "ERROR" or "FATAL". If empty, the level is not changed.
+	LogLevel string
+
+	// TLSCertFile and TLSKeyFile are the PEM encoded certificate and key
+	// files of the kite server. If empty, the certificate is not changed.
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// AllowedIPs are the IP ranges in CIDR notation, e.g. "10.0.0.0/8",
+	// the kite server accepts requests from. If empty, requests from
+	// all addresses are accepted.
+	AllowedIPs []string
+
+	// DeniedIPs are the IP ranges in CIDR notation the kite server refuses
+	// connections from. They take precedence over AllowedIPs.
+	DeniedIPs []string
+
+	// MaxConnsPerIP limits the number of concurrent connections the kite
+	// server accepts from a single IP address. Connections over the limit
+	// are closed right after accepting them. If zero, the number is not
+	// limited.
+	MaxConnsPerIP int
+
+	// Throttles are rates of methods throttled with Throttle, keyed by
+	// method names. A method with zero capacity is no longer throttled.
+	Throttles map[string]Throttle
+}
+
+// Throttle is a rate of a throttled method, see kite.Method.Throttle.
+type Throttle struct {
+	FillInterval time.Duration
+	Capacity     int64
+}
+
+// ErrorReporter receives the panics and errors of method handlers of a kite,
+// see Config.ErrorReporter. Report is called by the goroutine serving the
+// call, before the response is sent, so it is expected not to block.
+type ErrorReporter interface {
+	Report(*ErrorReport)
+}
+
+// ErrorReport describes a panic or an error of a method handler.
+type ErrorReport struct {
+	// Err is the error returned to the caller.
+	Err error
+
+	// Panic is the value recovered from the panicking handler,
+	// nil for errors returned by handlers.
+	Panic interface{}
+
+	// Stack is the stack of the panicking goroutine, nil for errors
+	// returned by handlers.
+	Stack []byte
+
+	// Method is the name of the called method.
+	Method string
+
+	// RequestID is the ID of the request, see kite.Request.ID.
+	RequestID string
+
+	// Username is the username of the caller.
+	Username string
+
+	// Kite identifies the kite serving the call, Caller
+	// the kite which made it.
+	Kite   protocol.Kite
+	Caller protocol.Kite
+
+	// Context is the context of the request, e.g. for getting the trace
+	// of the call from.
+	Context context.Context
+
+	// Time is the time the report was created.
+	Time time.Time
+}
+
+// SecretsProvider gives the secrets of a kite, see Config.SecretsProvider.
+type SecretsProvider interface {
+	Secrets(ctx context.Context) (*Secrets, error)
+}
+
+// Secrets are the credentials of a kite given by a SecretsProvider.
+// Empty fields are not used.
+type Secrets struct {
+	// KiteKey is the kite key, the content of the kite.key file.
+	KiteKey string
+
+	// TLSCertificate and TLSKey are the PEM encoded certificate
+	// and key of the kite server.
+	TLSCertificate string
+	TLSKey         string
+
+	// KontrolKeys are the key pairs Kontrol signs kite keys
+	// and tokens with.
+	KontrolKeys []KeyPair
+
+	// TTL is the time the secrets are valid for. The kite gets new
+	// secrets after two thirds of the TTL. If zero, the secrets are
+	// got only once.
+	TTL time.Duration
+}
+
+// KeyPair is a PEM encoded key pair of Kontrol.
+type KeyPair struct {
+	ID      string
+	Public  string
+	Private string
+}
+
+// Overflow is the policy for method calls received while all the
+// handler goroutines are busy, see Config.MaxHandlerGoroutines, and
+// for messages sent while the send queue is full, see Config.SendQueueHigh.
+type Overflow int
+
+const (
+	// OverflowQueue makes the calls wait for a free goroutine, while
+	// messages of the session are still read. Up to 1024 calls wait,
+	// the ones above fail with kite.ErrOverloaded.
+	OverflowQueue Overflow = iota
+
+	// OverflowReject makes the calls fail with kite.ErrOverloaded.
+	OverflowReject
+)
+
+// Compression describes compression of messages sent over sessions.
+type Compression struct {
+	// Algorithm is the name of the compression algorithm, "deflate"
+	// or "zstd". It is negotiated with the remote kite after connecting,
+	// messages are not compressed if the remote kite does not support it.
+	//
+	// WebSocket connections are compressed with the permessage-deflate
+	// extension instead, if both kites enable it. The kite server enables
+	// it if Algorithm is set when the kite is created.
+	Algorithm string
+
+	// Level is the compression level of the algorithm, e.g. 1-9 for
+	// deflate or 1-22 for zstd. If 0, the default level is used.
+	Level int
+
+	// MinSize is the size in bytes of the smallest message that
+	// is compressed. If 0, DefaultCompressionMinSize is used.
+	MinSize int
+}
+
+// DefaultCompressionMinSize is the default size of the smallest
+// compressed message, smaller ones do not gain much.
+const DefaultCompressionMinSize = 1024
+
+// DefaultMaxDecompressedSize is the size in bytes of the largest
+// compressed message accepted when the message size is not limited,
+// so a small message can't decompress into an arbitrarily large one.
+const DefaultMaxDecompressedSize = 64 << 20
+
+// UnixSocket describes a Unix domain socket the kite listens on.
+type UnixSocket struct {
+	// Path of the socket file. The file is removed when the kite
+	// is closed.
+	Path string
+
+	// Mode sets permissions of the socket file, allowing to control
+	// which users can connect to the kite. If zero, permissions
+	// are set according to the process umask.
+	Mode os.FileMode
+}
+
+// Listener describes an additional address the kite server listens on.
+type Listener struct {
+	// Addr is the "host:port" TCP address or the path of the Unix
+	// domain socket given as unix:///path/to/socket.
+	Addr string
+
+	// TLS makes the listener serve TLS connections, using the TLS
+	// configuration of the kite.
+	TLS bool
+
+	// URL is the URL the kite is reachable at with the listener, which
+	// is advertised to Kontrol as an alternative URL of the kite. If empty,
+	// the listener is not advertised.
+	URL string
+}
+
+// AutoTLS describes obtaining the certificate of the kite server from
+// an ACME certificate authority.
+//
+// The certificate authority verifies the domains with the TLS-ALPN-01
+// challenge, so the kite must be reachable on port 443 of the domains.
+type AutoTLS struct {
+	// Domains the certificates are obtained for, certificates are not
+	// requested for other server names. Required.
+	Domains []string
+
+	// CacheDir is the directory the certificates and the account key
+	// are stored in, so they are reused after the kite restarts.
+	// If empty, they are kept in memory only, which may quickly hit
+	// the rate limits of the certificate authority.
+	CacheDir string
+
+	// Email is the contact address of the ACME account, used by the
+	// certificate authority to notify about problems with certificates.
+	// Optional.
+	Email string
+
+	// DirectoryURL is the ACME directory endpoint of the certificate
+	// authority. If empty, Let's Encrypt production endpoint is used.
+	DirectoryURL string
 }
 
 // DefaultConfig contains the default settings.
@@ -182,61 +597,6 @@ func MustGet() *Config {
 	return c
 }
 
-func (c *Config) ReadEnvironmentVariables() error {
-	var err error
-
-	if username := os.Getenv("KITE_USERNAME"); username != "" {
-		c.Username = username
-	}
-
-	if environment := os.Getenv("KITE_ENVIRONMENT"); environment != "" {
-		c.Environment = environment
-	}
-
-	if region := os.Getenv("KITE_REGION"); region != "" {
-		c.Region = region
-	}
-
-	if ip := os.Getenv("KITE_IP"); ip != "" {
-		c.IP = ip
-	}
-
-	if port := os.Getenv("KITE_PORT"); port != "" {
-		c.Port, err = strconv.Atoi(port)
-		if err != nil {
-			return err
-		}
-	}
-
-	if kontrolURL := os.Getenv("KITE_KONTROL_URL"); kontrolURL != "" {
-		c.KontrolURL = kontrolURL
-	}
-
-	if transportName := os.Getenv("KITE_TRANSPORT"); transportName != "" {
-		transport, ok := Transports[transportName]
-		if !ok {
-			return fmt.Errorf("transport '%s' doesn't exists", transportName)
-		}
-
-		c.Transport = transport
-	}
-
-	if ttl, err := time.ParseDuration(os.Getenv("KITE_VERIFY_TTL")); err == nil {
-		c.VerifyTTL = ttl
-	}
-
-	if timeout, err := time.ParseDuration(os.Getenv("KITE_TIMEOUT")); err == nil {
-		c.Timeout = timeout
-		c.Client.Timeout = timeout
-	}
-
-	if timeout, err := time.ParseDuration(os.Getenv("KITE_HANDSHAKE_TIMEOUT")); err == nil {
-		c.Websocket.HandshakeTimeout = timeout
-	}
-
-	return nil
-}
-
 // ReadKiteKey parsed the user's kite key and returns a new Config.
 func (c *Config) ReadKiteKey() error {
 	key, err := kitekey.Parse()
@@ -284,5 +644,59 @@ func (c *Config) Copy() *Config {
 		copy.Websocket = &ws
 	}
 
+	if c.UnixSocket != nil {
+		us := *copy.UnixSocket
+		copy.UnixSocket = &us
+	}
+
+	if c.Listeners != nil {
+		copy.Listeners = append([]Listener(nil), c.Listeners...)
+	}
+
+	if c.AutoTLS != nil {
+		autoTLS := *copy.AutoTLS
+		autoTLS.Domains = append([]string(nil), c.AutoTLS.Domains...)
+		copy.AutoTLS = &autoTLS
+	}
+
+	if c.ClientCertificates != nil {
+		copy.ClientCertificates = append([]tls.Certificate(nil), c.ClientCertificates...)
+	}
+
+	if c.SSH != nil {
+		sshConfig := *c.SSH
+		copy.SSH = &sshConfig
+	}
+
+	if c.Labels != nil {
+		copy.Labels = make(map[string]string, len(c.Labels))
+		for k, v := range c.Labels {
+			copy.Labels[k] = v
+		}
+	}
+
+	if c.KontrolURLs != nil {
+		copy.KontrolURLs = append([]string(nil), c.KontrolURLs...)
+	}
+
+	if c.KontrolKeys != nil {
+		copy.KontrolKeys = append([]string(nil), c.KontrolKeys...)
+	}
+
+	if c.AllowedIPs != nil {
+		copy.AllowedIPs = append([]string(nil), c.AllowedIPs...)
+	}
+
+	if c.DeniedIPs != nil {
+		copy.DeniedIPs = append([]string(nil), c.DeniedIPs...)
+	}
+
+	if c.Throttles != nil {
+		copy.Throttles = make(map[string]Throttle, len(c.Throttles))
+		for k, v := range c.Throttles {
+			copy.Throttles[k] = v
+		}
+	}
+
 	return &copy
 }
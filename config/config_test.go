@@ -2,8 +2,12 @@ package config_test
 
 import (
 	"net/http"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/koding/kite/config"
 
@@ -13,12 +17,24 @@ import (
 func TestConfigCopy(t *testing.T) {
 	cases := []*config.Config{
 		config.DefaultConfig, {
-			KontrolURL: "https://koding.com/kontrol/kite",
-			Username:   "john",
+			KontrolURL:  "https://koding.com/kontrol/kite",
+			KontrolURLs: []string{"https://koding.com/kontrol2/kite"},
+			Labels:      map[string]string{"zone": "eu-1a"},
+			Weight:      4,
+			Username:    "john",
 		}, {
 			Environment: "aws",
 			XHR:         http.DefaultClient,
 			SockJS:      &sockjs.DefaultOptions,
+			AutoTLS:     &config.AutoTLS{Domains: []string{"kite.koding.com"}, CacheDir: "/var/cache/kite"},
+			Listeners:   []config.Listener{{Addr: "10.0.0.1:3636", URL: "http://10.0.0.1:3636/kite"}},
+		}, {
+			LogLevel:      "DEBUG",
+			AllowedIPs:    []string{"10.0.0.0/8"},
+			DeniedIPs:     []string{"10.1.0.0/16"},
+			MaxConnsPerIP: 16,
+			ProxyURL:      "socks5://proxy.koding.com:1080",
+			Throttles:     map[string]config.Throttle{"square": {FillInterval: time.Second, Capacity: 10}},
 		},
 	}
 
@@ -30,3 +46,149 @@ func TestConfigCopy(t *testing.T) {
 		}
 	}
 }
+
+func TestFromFile(t *testing.T) {
+	files := map[string]string{
+		"kite.yaml": `
+username: john
+port: 6000
+kontrol_url: https://koding.com/kontrol/kite, https://koding.com/kontrol2/kite
+log_level: debug
+timeout: 30s
+allowed_ips: [10.0.0.0/8]
+proxy_url: socks5://proxy.koding.com:1080
+labels:
+  zone: eu-1a
+throttles:
+  square: 10/1s
+compression:
+  level: 3
+`,
+		"kite.toml": `
+username = "john"
+port = 6000
+kontrol_url = ["https://koding.com/kontrol/kite", "https://koding.com/kontrol2/kite"]
+log_level = "debug"
+timeout = "30s"
+allowed_ips = "10.0.0.0/8"
+egress_proxy_url = "socks5://proxy.koding.com:1080"
+
+[labels]
+zone = "eu-1a"
+
+[throttles]
+square = "10/1s"
+
+[compression]
+level = 3
+`,
+	}
+
+	want := config.New()
+	want.Username = "john"
+	want.Port = 6000
+	want.KontrolURL = "https://koding.com/kontrol/kite"
+	want.KontrolURLs = []string{"https://koding.com/kontrol2/kite"}
+	want.LogLevel = "DEBUG"
+	want.Timeout = 30 * time.Second
+	want.Client.Timeout = 30 * time.Second
+	want.AllowedIPs = []string{"10.0.0.0/8"}
+	want.ProxyURL = "socks5://proxy.koding.com:1080"
+	want.Labels = map[string]string{"zone": "eu-1a"}
+	want.Throttles = map[string]config.Throttle{"square": {FillInterval: time.Second, Capacity: 10}}
+	want.Compression.Level = 3
+
+	dir := t.TempDir()
+
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		c, err := config.FromFile(path)
+		if err != nil {
+			t.Fatalf("%s: FromFile()=%s", name, err)
+		}
+
+		if !reflect.DeepEqual(c, want) {
+			t.Errorf("%s: got %#v, want %#v", name, c, want)
+		}
+	}
+}
+
+func TestFromFile_Invalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kite.yaml")
+
+	content := `
+port: 70000
+log_level: verbose
+kontrl_url: https://koding.com/kontrol/kite
+`
+
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := config.FromFile(path)
+	if err == nil {
+		t.Fatal("expected FromFile() to fail")
+	}
+
+	for _, want := range []string{`invalid port "70000"`, `invalid log_level "VERBOSE"`} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("got %q, want it to contain %q", err, want)
+		}
+	}
+
+	// The misspelled setting is reported once the valid ones are fixed.
+	content = "kontrl_url: https://koding.com/kontrol/kite\n"
+
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := config.FromFile(path); err == nil || !strings.Contains(err.Error(), "unknown settings: kontrl_url") {
+		t.Errorf("got %v, want unknown setting error", err)
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	t.Setenv("TEST_PORT", "6000")
+	t.Setenv("TEST_TRANSPORT", "XHRPolling")
+	t.Setenv("TEST_THROTTLES", "square=10/1s, cube=5/100ms")
+	t.Setenv("TEST_HANDSHAKE_TIMEOUT", "5s")
+
+	c, err := config.FromEnv("TEST")
+	if err != nil {
+		t.Fatalf("FromEnv()=%s", err)
+	}
+
+	if c.Port != 6000 || c.Transport != config.XHRPolling || c.Websocket.HandshakeTimeout != 5*time.Second {
+		t.Errorf("got port %d, transport %s, handshake timeout %s", c.Port, c.Transport, c.Websocket.HandshakeTimeout)
+	}
+
+	throttles := map[string]config.Throttle{
+		"square": {FillInterval: time.Second, Capacity: 10},
+		"cube":   {FillInterval: 100 * time.Millisecond, Capacity: 5},
+	}
+
+	if !reflect.DeepEqual(c.Throttles, throttles) {
+		t.Errorf("got %v, want %v", c.Throttles, throttles)
+	}
+
+	t.Setenv("TEST_TRANSPORT", "carrier-pigeon")
+	t.Setenv("TEST_TIMEOUT", "forever")
+
+	_, err = config.FromEnv("TEST")
+	if err == nil {
+		t.Fatal("expected FromEnv() to fail")
+	}
+
+	for _, want := range []string{"TEST_TRANSPORT", "TEST_TIMEOUT"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("got %q, want it to contain %q", err, want)
+		}
+	}
+}
@@ -0,0 +1,521 @@
+package config
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// FromFile gives a new Config initialized with defaults and the settings
+// read from the YAML, TOML or JSON file, as told by its extension.
+//
+// The settings are named as the environment variables read by FromEnv,
+// in lower case and without the prefix, e.g.:
+//
+//	username: koding
+//	port: 6000
+//	kontrol_url: https://kontrol.example.com/kite
+//	log_level: debug
+//	timeout: 30s
+//	tls:
+//	  cert: /etc/kite/tls.crt
+//	  key: /etc/kite/tls.key
+//	allowed_ips: [10.0.0.0/8]
+//	labels:
+//	  zone: us-east-1a
+//	throttles:
+//	  square: 10/1s
+//
+// Nested tables are joined with underscores, so "tls.cert" is the same
+// as "tls_cert". Lists may be given as comma separated strings as well.
+// Unknown settings are an error, so misspelled ones are not ignored.
+func FromFile(path string) (*Config, error) {
+	p, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var v map[string]interface{}
+
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(p, &v)
+	case ".toml":
+		err = toml.Unmarshal(p, &v)
+	case ".json":
+		err = json.Unmarshal(p, &v)
+	default:
+		return nil, fmt.Errorf("%s: unsupported config format %q, expected .yaml, .toml or .json", path, ext)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	f := &fileSource{
+		values: make(map[string]string),
+		used:   make(map[string]bool),
+	}
+
+	if err := f.flatten("", v); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	c := New()
+
+	if err := c.read(f); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	if err := f.unused(); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	return c, nil
+}
+
+// FromEnv gives a new Config initialized with defaults and the settings
+// read from the environment variables with the prefix, e.g. "KITE" for
+// KITE_PORT or KITE_KONTROL_URL.
+//
+// Lists are given as comma separated values, labels and throttles
+// as comma separated key=value pairs, e.g.:
+//
+//	KITE_ALLOWED_IPS=10.0.0.0/8,192.168.0.0/16
+//	KITE_LABELS=zone=us-east-1a,shard=2
+//	KITE_THROTTLES=square=10/1s,cube=5/100ms
+func FromEnv(prefix string) (*Config, error) {
+	c := New()
+
+	if err := c.read(envSource(prefix)); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// ReadEnvironmentVariables reads the settings from the environment variables
+// prefixed with KITE, see FromEnv.
+func (c *Config) ReadEnvironmentVariables() error {
+	return c.read(envSource("KITE"))
+}
+
+// source gives the settings read by FromFile and FromEnv.
+type source interface {
+	// get gives the value of the setting, e.g. "kontrol_url",
+	// or an empty string if it is not set.
+	get(key string) string
+
+	// name gives the name of the setting for error messages,
+	// e.g. "KITE_KONTROL_URL".
+	name(key string) string
+}
+
+// envSource reads the settings from the environment variables
+// with the prefix.
+type envSource string
+
+func (prefix envSource) get(key string) string {
+	return os.Getenv(prefix.name(key))
+}
+
+func (prefix envSource) name(key string) string {
+	if prefix == "" {
+		return strings.ToUpper(key)
+	}
+
+	return strings.TrimSuffix(string(prefix), "_") + "_" + strings.ToUpper(key)
+}
+
+// fileSource reads the settings from the values decoded from a file.
+type fileSource struct {
+	values map[string]string
+	used   map[string]bool
+}
+
+// pairs are the settings given as key=value pairs.
+var pairs = map[string]bool{
+	"labels":    true,
+	"throttles": true,
+}
+
+// flatten adds the decoded values to the settings, joining the keys
+// of nested tables with underscores.
+func (f *fileSource) flatten(prefix string, v map[string]interface{}) error {
+	for k, v := range v {
+		key := strings.ToLower(prefix + k)
+
+		switch v := v.(type) {
+		case map[string]interface{}:
+			if !pairs[key] {
+				if err := f.flatten(key+"_", v); err != nil {
+					return err
+				}
+				continue
+			}
+
+			var kv []string
+			for k, v := range v {
+				s, err := scalar(v)
+				if err != nil {
+					return fmt.Errorf("invalid %s.%s: %s", key, k, err)
+				}
+
+				kv = append(kv, k+"="+s)
+			}
+
+			sort.Strings(kv)
+			f.values[key] = strings.Join(kv, ",")
+		case []interface{}:
+			var list []string
+			for _, v := range v {
+				s, err := scalar(v)
+				if err != nil {
+					return fmt.Errorf("invalid %s: %s", key, err)
+				}
+
+				list = append(list, s)
+			}
+
+			f.values[key] = strings.Join(list, ",")
+		default:
+			s, err := scalar(v)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %s", key, err)
+			}
+
+			f.values[key] = s
+		}
+	}
+
+	return nil
+}
+
+func scalar(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case int, int64, uint64, float64, bool:
+		return fmt.Sprint(v), nil
+	case nil:
+		return "", nil
+	default:
+		return "", fmt.Errorf("expected a string or a number, got %T", v)
+	}
+}
+
+func (f *fileSource) get(key string) string {
+	f.used[key] = true
+	return f.values[key]
+}
+
+func (f *fileSource) name(key string) string {
+	return key
+}
+
+// unused fails if the file has settings, which were not read.
+func (f *fileSource) unused() error {
+	var keys []string
+
+	for key := range f.values {
+		if !f.used[key] {
+			keys = append(keys, key)
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil
+	}
+
+	sort.Strings(keys)
+
+	return fmt.Errorf("unknown settings: %s", strings.Join(keys, ", "))
+}
+
+// read reads the settings from the source. The settings, which are not
+// set, are left unchanged.
+func (c *Config) read(s source) error {
+	var errs []error
+
+	invalid := func(key, value string, err error) {
+		errs = append(errs, fmt.Errorf("invalid %s %q: %s", s.name(key), value, err))
+	}
+
+	str := func(key string, v *string) {
+		if value := s.get(key); value != "" {
+			*v = value
+		}
+	}
+
+	list := func(key string) (values []string) {
+		for _, value := range strings.Split(s.get(key), ",") {
+			if value = strings.TrimSpace(value); value != "" {
+				values = append(values, value)
+			}
+		}
+		return values
+	}
+
+	number := func(key string, v *int) {
+		if value := s.get(key); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				invalid(key, value, errors.New("expected a non-negative integer"))
+				return
+			}
+
+			*v = n
+		}
+	}
+
+	size := func(key string, v *int64) {
+		if value := s.get(key); value != "" {
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n < 0 {
+				invalid(key, value, errors.New("expected a size in bytes"))
+				return
+			}
+
+			*v = n
+		}
+	}
+
+	duration := func(key string, v *time.Duration) bool {
+		value := s.get(key)
+		if value == "" {
+			return false
+		}
+
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			invalid(key, value, errors.New(`expected a duration, e.g. "10s"`))
+			return false
+		}
+
+		*v = d
+		return true
+	}
+
+	cidrs := func(key string, v *[]string) {
+		ips := list(key)
+		if len(ips) == 0 {
+			return
+		}
+
+		*v = nil
+
+		for _, ip := range ips {
+			if _, _, err := net.ParseCIDR(ip); err != nil {
+				invalid(key, ip, errors.New(`expected an IP range, e.g. "10.0.0.0/8"`))
+				continue
+			}
+
+			*v = append(*v, ip)
+		}
+	}
+
+	str("username", &c.Username)
+	str("environment", &c.Environment)
+	str("region", &c.Region)
+	str("ip", &c.IP)
+
+	if port := s.get("port"); port != "" {
+		n, err := strconv.Atoi(port)
+		if err != nil || n < 0 || n > 65535 {
+			invalid("port", port, errors.New("expected a port number"))
+		} else {
+			c.Port = n
+		}
+	}
+
+	// Multiple Kontrol URLs are separated with commas, the first one
+	// is used unless it is unreachable.
+	if urls := list("kontrol_url"); len(urls) != 0 {
+		c.KontrolURL = urls[0]
+		c.KontrolURLs = urls[1:]
+
+		for _, rawurl := range urls {
+			if u, err := url.Parse(rawurl); err != nil || u.Scheme == "" || u.Host == "" {
+				invalid("kontrol_url", rawurl, errors.New(`expected an absolute URL, e.g. "https://kontrol.example.com/kite"`))
+			}
+		}
+	}
+
+	if name := s.get("transport"); name != "" {
+		if transport, ok := Transports[name]; ok {
+			c.Transport = transport
+		} else {
+			var names []string
+			for name := range Transports {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+
+			invalid("transport", name, fmt.Errorf("expected one of: %s", strings.Join(names, ", ")))
+		}
+	}
+
+	if path := s.get("unix_socket"); path != "" {
+		c.UnixSocket = &UnixSocket{Path: path}
+	}
+
+	domains, cacheDir, email := list("autotls_domains"), s.get("autotls_cache_dir"), s.get("autotls_email")
+
+	if len(domains) != 0 {
+		c.AutoTLS = &AutoTLS{
+			Domains:  domains,
+			CacheDir: cacheDir,
+			Email:    email,
+		}
+	} else if cacheDir != "" || email != "" {
+		errs = append(errs, fmt.Errorf("%s is required by %s and %s", s.name("autotls_domains"),
+			s.name("autotls_cache_dir"), s.name("autotls_email")))
+	}
+
+	clientCert, clientKey := s.get("tls_client_cert"), s.get("tls_client_key")
+
+	if clientCert != "" || clientKey != "" {
+		cert, err := tls.LoadX509KeyPair(clientCert, clientKey)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s and %s: %s", s.name("tls_client_cert"), s.name("tls_client_key"), err))
+		} else {
+			c.ClientCertificates = []tls.Certificate{cert}
+		}
+	}
+
+	// Labels are given as comma separated key=value pairs.
+	if labels := list("labels"); len(labels) != 0 {
+		c.Labels = make(map[string]string)
+
+		for _, label := range labels {
+			kv := strings.SplitN(label, "=", 2)
+			if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+				invalid("labels", label, errors.New("expected a key=value pair"))
+				continue
+			}
+
+			c.Labels[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+	}
+
+	// Throttles are given as comma separated method=capacity/interval pairs.
+	if throttles := list("throttles"); len(throttles) != 0 {
+		c.Throttles = make(map[string]Throttle)
+
+		for _, throttle := range throttles {
+			method, t, err := parseThrottle(throttle)
+			if err != nil {
+				invalid("throttles", throttle, err)
+				continue
+			}
+
+			c.Throttles[method] = t
+		}
+	}
+
+	number("weight", &c.Weight)
+	str("egress_proxy_url", &c.ProxyURL) // older name of proxy_url
+	str("proxy_url", &c.ProxyURL)
+
+	if level := s.get("log_level"); level != "" {
+		switch level = strings.ToUpper(level); level {
+		case "DEBUG", "INFO", "WARNING", "ERROR", "FATAL":
+			c.LogLevel = level
+		default:
+			invalid("log_level", level, errors.New("expected one of: DEBUG, INFO, WARNING, ERROR, FATAL"))
+		}
+	}
+
+	if certFile, keyFile := s.get("tls_cert"), s.get("tls_key"); certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			errs = append(errs, fmt.Errorf("%s and %s are required together", s.name("tls_cert"), s.name("tls_key")))
+		} else {
+			c.TLSCertFile = certFile
+			c.TLSKeyFile = keyFile
+		}
+	}
+
+	cidrs("allowed_ips", &c.AllowedIPs)
+	cidrs("denied_ips", &c.DeniedIPs)
+	number("max_conns_per_ip", &c.MaxConnsPerIP)
+	number("max_handler_goroutines", &c.MaxHandlerGoroutines)
+	size("max_request_size", &c.MaxRequestSize)
+	size("max_response_size", &c.MaxResponseSize)
+	str("codec", &c.Codec)
+
+	if algorithm := s.get("compression"); algorithm != "" {
+		switch algorithm {
+		case "deflate", "zstd":
+			c.Compression.Algorithm = algorithm
+		default:
+			invalid("compression", algorithm, errors.New("expected deflate or zstd"))
+		}
+	}
+
+	if level := s.get("compression_level"); level != "" {
+		n, err := strconv.Atoi(level)
+		if err != nil {
+			invalid("compression_level", level, errors.New("expected an integer"))
+		} else {
+			c.Compression.Level = n
+		}
+	}
+
+	duration("verify_ttl", &c.VerifyTTL)
+	duration("replay_window", &c.ReplayWindow)
+	str("record_dir", &c.RecordDir)
+
+	if duration("timeout", &c.Timeout) && c.Client != nil {
+		c.Client.Timeout = c.Timeout
+	}
+
+	duration("slow_call_threshold", &c.SlowCallThreshold)
+	duration("ping_interval", &c.PingInterval)
+	duration("pong_timeout", &c.PongTimeout)
+	duration("shutdown_grace_period", &c.ShutdownGracePeriod)
+	duration("heartbeat_interval", &c.HeartbeatInterval)
+
+	var handshakeTimeout time.Duration
+	if duration("handshake_timeout", &handshakeTimeout) && c.Websocket != nil {
+		c.Websocket.HandshakeTimeout = handshakeTimeout
+	}
+
+	// All the invalid settings are reported at once,
+	// so they can be fixed in one go.
+	return errors.Join(errs...)
+}
+
+// parseThrottle parses a method=capacity/interval pair, e.g. "square=10/1s".
+func parseThrottle(s string) (method string, t Throttle, err error) {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+		return "", t, errors.New(`expected a method=capacity/interval pair, e.g. "square=10/1s"`)
+	}
+
+	rate := strings.SplitN(strings.TrimSpace(kv[1]), "/", 2)
+	if len(rate) != 2 {
+		return "", t, errors.New(`expected a capacity/interval rate, e.g. "10/1s"`)
+	}
+
+	if t.Capacity, err = strconv.ParseInt(rate[0], 10, 64); err != nil || t.Capacity < 0 {
+		return "", t, fmt.Errorf("invalid capacity %q", rate[0])
+	}
+
+	if t.FillInterval, err = time.ParseDuration(rate[1]); err != nil || t.FillInterval <= 0 {
+		return "", t, fmt.Errorf("invalid interval %q", rate[1])
+	}
+
+	return strings.TrimSpace(kv[0]), t, nil
+}
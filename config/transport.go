@@ -7,6 +7,7 @@ const (
 	WebSocket = iota
 	XHRPolling
 	Auto
+	GRPC
 )
 
 func (t Transport) String() string {
@@ -17,6 +18,8 @@ func (t Transport) String() string {
 		return "XHRPolling"
 	case Auto:
 		return "auto"
+	case GRPC:
+		return "gRPC"
 	default:
 		return "UnkownKiteTransport"
 	}
@@ -26,4 +29,5 @@ var Transports = map[string]Transport{
 	"WebSocket":  WebSocket,
 	"XHRPolling": XHRPolling,
 	"auto":       Auto,
+	"gRPC":       GRPC,
 }
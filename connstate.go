@@ -0,0 +1,219 @@
+package kite
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/koding/kite/sockjsclient"
+)
+
+// ConnectionState is a state of the connection of a Client.
+type ConnectionState int
+
+const (
+	// StateDisconnected is the initial state, the client is also
+	// disconnected after losing the connection, before it redials.
+	StateDisconnected ConnectionState = iota
+
+	// StateConnecting is set before each redial attempt.
+	StateConnecting
+
+	// StateConnected is set when a session with the remote kite
+	// is established.
+	StateConnected
+
+	// StateClosed is set when the client is closed or it gave up
+	// redialing, it's the final state.
+	StateClosed
+)
+
+var connectionStates = map[ConnectionState]string{
+	StateDisconnected: "disconnected",
+	StateConnecting:   "connecting",
+	StateConnected:    "connected",
+	StateClosed:       "closed",
+}
+
+func (s ConnectionState) String() string {
+	if name, ok := connectionStates[s]; ok {
+		return name
+	}
+
+	return "unknown"
+}
+
+// DisconnectReason tells why the client has disconnected.
+type DisconnectReason int
+
+const (
+	// ReasonNone is the reason of events, which are not disconnects.
+	ReasonNone DisconnectReason = iota
+
+	// ReasonClosed means the client was closed with Close.
+	ReasonClosed
+
+	// ReasonRemoteClosed means the session was closed cleanly
+	// by the remote kite.
+	ReasonRemoteClosed
+
+	// ReasonError means the connection failed, e.g. due to a network
+	// error, or the client gave up redialing.
+	ReasonError
+
+	// ReasonGoingAway means the session was closed, because the remote
+	// kite notified it is shutting down, see (*Client).GoingAway.
+	ReasonGoingAway
+)
+
+var disconnectReasons = map[DisconnectReason]string{
+	ReasonNone:         "none",
+	ReasonClosed:       "closed",
+	ReasonRemoteClosed: "remote closed",
+	ReasonError:        "error",
+	ReasonGoingAway:    "going away",
+}
+
+func (r DisconnectReason) String() string {
+	if name, ok := disconnectReasons[r]; ok {
+		return name
+	}
+
+	return "unknown"
+}
+
+// ConnectionEvent describes a change of the connection state of a client.
+type ConnectionEvent struct {
+	// State is the new state of the connection, Previous is the old one.
+	State    ConnectionState
+	Previous ConnectionState
+
+	// Reason tells why the client has disconnected, it is set
+	// for StateDisconnected and StateClosed events.
+	Reason DisconnectReason
+
+	// Err is the error the connection failed with for disconnect events
+	// and the error of the previous attempt for StateConnecting events.
+	Err error
+
+	// Attempt is the number of the redial attempt for StateConnecting
+	// events and the number of attempts it took to reconnect for
+	// StateConnected ones.
+	Attempt int
+
+	// Downtime is the time the client was disconnected for,
+	// set for StateConnected events after reconnecting.
+	Downtime time.Duration
+}
+
+// connState tracks the connection state of a client.
+type connState struct {
+	state          ConnectionState
+	attempt        int       // last redial attempt
+	disconnectedAt time.Time // zero if never connected
+}
+
+// State gives the current state of the connection.
+func (c *Client) State() ConnectionState {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+
+	return c.conn.state
+}
+
+// OnConnectionStateChange adds a callback which is called with every
+// change of the connection state.
+func (c *Client) OnConnectionStateChange(handler func(*ConnectionEvent)) {
+	c.m.Lock()
+	c.onStateChangeHandlers = append(c.onStateChangeHandlers, handler)
+	c.m.Unlock()
+}
+
+// OnReconnect adds a callback which is called when the client reconnects
+// after it got disconnected. The event tells how many attempts it took
+// and for how long the client was disconnected.
+func (c *Client) OnReconnect(handler func(*ConnectionEvent)) {
+	c.OnConnectionStateChange(func(ev *ConnectionEvent) {
+		if ev.State == StateConnected && ev.Downtime != 0 {
+			handler(ev)
+		}
+	})
+}
+
+// setState changes the state of the connection and calls the state
+// change handlers. Nothing is changed once the client is closed.
+func (c *Client) setState(ev *ConnectionEvent) {
+	c.connMu.Lock()
+
+	if c.conn.state == StateClosed {
+		c.connMu.Unlock()
+		return
+	}
+
+	ev.Previous = c.conn.state
+	c.conn.state = ev.State
+
+	switch ev.State {
+	case StateConnecting:
+		c.conn.attempt = ev.Attempt
+	case StateConnected:
+		ev.Attempt = c.conn.attempt
+		if !c.conn.disconnectedAt.IsZero() {
+			ev.Downtime = time.Since(c.conn.disconnectedAt)
+		}
+		c.conn.attempt = 0
+		c.conn.disconnectedAt = time.Time{}
+	case StateDisconnected:
+		if ev.Previous == StateConnected {
+			c.conn.disconnectedAt = time.Now()
+		}
+	}
+
+	c.connMu.Unlock()
+
+	c.callOnStateChangeHandlers(ev)
+}
+
+// setDisconnected changes the state after the session ended
+// with the given error.
+func (c *Client) setDisconnected(err error) {
+	ev := &ConnectionEvent{
+		State:  StateDisconnected,
+		Reason: ReasonError,
+		Err:    err,
+	}
+
+	switch {
+	case atomic.LoadInt32(&c.closed) == 1:
+		ev.State = StateClosed
+		ev.Reason = ReasonClosed
+		ev.Err = nil
+	case c.GoingAway():
+		ev.Reason = ReasonGoingAway
+	case isCleanClose(err):
+		ev.Reason = ReasonRemoteClosed
+	}
+
+	c.setState(ev)
+}
+
+// isCleanClose tells whether the session ended, because it was closed.
+func isCleanClose(err error) bool {
+	if e, ok := err.(*websocket.CloseError); ok {
+		return e.Code != websocket.CloseAbnormalClosure
+	}
+
+	return sockjsclient.IsSessionClosed(err)
+}
+
+func (c *Client) callOnStateChangeHandlers(ev *ConnectionEvent) {
+	c.m.RLock()
+	defer c.m.RUnlock()
+
+	for _, handler := range c.onStateChangeHandlers {
+		func() {
+			defer nopRecover()
+			handler(ev)
+		}()
+	}
+}
@@ -0,0 +1,127 @@
+package kite
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestClient_OnConnectionStateChange(t *testing.T) {
+	k := New("testkite", "0.0.1")
+	k.Config.DisableAuthentication = true
+
+	remote := make(chan *Client, 2)
+	k.OnConnect(func(c *Client) { remote <- c })
+
+	go k.Run()
+	defer k.Close()
+	<-k.ServerReadyNotify()
+
+	c := New("exp", "0.0.1").NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", k.Port()))
+	c.ReconnectPolicy = &ReconnectPolicy{
+		InitialInterval: 10 * time.Millisecond,
+		MaxInterval:     50 * time.Millisecond,
+	}
+
+	events := make(chan *ConnectionEvent, 16)
+	c.OnConnectionStateChange(func(ev *ConnectionEvent) { events <- ev })
+
+	reconnected := make(chan *ConnectionEvent, 1)
+	c.OnReconnect(func(ev *ConnectionEvent) { reconnected <- ev })
+
+	next := func() *ConnectionEvent {
+		select {
+		case ev := <-events:
+			return ev
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for connection event")
+			return nil
+		}
+	}
+
+	if _, err := c.DialForever(); err != nil {
+		t.Fatalf("DialForever()=%s", err)
+	}
+
+	if ev := next(); ev.State != StateConnecting || ev.Attempt != 1 || ev.Err != nil {
+		t.Fatalf("got %+v, want first connecting event", ev)
+	}
+
+	if ev := next(); ev.State != StateConnected || ev.Previous != StateConnecting || ev.Downtime != 0 {
+		t.Fatalf("got %+v, want connected event", ev)
+	}
+
+	if c.State() != StateConnected {
+		t.Fatalf("got %s, want %s", c.State(), StateConnected)
+	}
+
+	// The remote kite closes the session, the client reconnects.
+	(<-remote).Close()
+
+	if ev := next(); ev.State != StateDisconnected || ev.Reason != ReasonRemoteClosed {
+		t.Fatalf("got %+v (%s), want disconnect closed by remote", ev, ev.Reason)
+	}
+
+	if ev := next(); ev.State != StateConnecting || ev.Attempt != 1 {
+		t.Fatalf("got %+v, want connecting event", ev)
+	}
+
+	if ev := next(); ev.State != StateConnected || ev.Attempt != 1 || ev.Downtime <= 0 {
+		t.Fatalf("got %+v, want reconnected event", ev)
+	}
+
+	select {
+	case ev := <-reconnected:
+		if ev.Downtime <= 0 {
+			t.Fatalf("got %+v, want non-zero downtime", ev)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for OnReconnect")
+	}
+
+	c.Close()
+
+	if ev := next(); ev.State != StateClosed || ev.Reason != ReasonClosed || ev.Err != nil {
+		t.Fatalf("got %+v (%s), want closed event", ev, ev.Reason)
+	}
+
+	select {
+	case ev := <-events:
+		t.Fatalf("unexpected event after close: %+v", ev)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestClient_GiveUpState(t *testing.T) {
+	c := New("exp", "0.0.1").NewClient("http://127.0.0.1:1/kite")
+	c.ReconnectPolicy = &ReconnectPolicy{
+		InitialInterval: 10 * time.Millisecond,
+		MaxRetries:      1,
+	}
+
+	closed := make(chan *ConnectionEvent, 1)
+	c.OnConnectionStateChange(func(ev *ConnectionEvent) {
+		if ev.State == StateClosed {
+			closed <- ev
+		}
+	})
+
+	connected, err := c.DialForever()
+	if err != nil {
+		t.Fatalf("DialForever()=%s", err)
+	}
+	<-connected
+
+	select {
+	case ev := <-closed:
+		if ev.Reason != ReasonError || ev.Err == nil || ev.Attempt != 2 {
+			t.Fatalf("got %+v, want gave up event", ev)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for closed event")
+	}
+
+	if c.State() != StateClosed {
+		t.Fatalf("got %s, want %s", c.State(), StateClosed)
+	}
+}
@@ -0,0 +1,231 @@
+package kite
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	rpprof "runtime/pprof"
+	"runtime/trace"
+	"time"
+
+	"github.com/koding/cache"
+)
+
+// ScopeDebug is the scope required for calling the debug methods of the
+// kite, like "kite.debug.pprof", and for the net/http/pprof endpoints
+// mounted with HandlePprof.
+const ScopeDebug = "kite.debug"
+
+// defaultProfileDuration is the duration of CPU profiles and execution
+// traces, when not given by the caller.
+const defaultProfileDuration = 30 * time.Second
+
+// maxProfileDuration is the max duration of CPU profiles and execution
+// traces, which hold the profiler of the process until they are done.
+const maxProfileDuration = 5 * time.Minute
+
+// debugArgs are the optional arguments of the debug methods.
+type debugArgs struct {
+	// Debug is the debug parameter of pprof.Profile.WriteTo, 0 writes
+	// profiles in the protobuf format read by "go tool pprof".
+	Debug int `json:"debug"`
+
+	// GC runs the garbage collection before reading heap statistics.
+	GC bool `json:"gc"`
+
+	// Profile is the name of the profile streamed by "kite.debug.pprof",
+	// "cpu", "trace" or one of the pprof.Profiles, e.g. "heap".
+	Profile string `json:"profile"`
+
+	// Seconds is the duration of CPU profiles and execution traces.
+	Seconds int `json:"seconds"`
+}
+
+func (k *Kite) addDebugHandlers() {
+	k.HandleFunc("kite.debug.goroutines", handleDebugGoroutines).RequireScope(ScopeDebug)
+	k.HandleFunc("kite.debug.heap", handleDebugHeap).RequireScope(ScopeDebug)
+	k.HandleFunc("kite.debug.pprof", handleDebugPprof).RequireScope(ScopeDebug)
+}
+
+// readDebugArgs reads the optional arguments of a debug method.
+func readDebugArgs(r *Request) (*debugArgs, error) {
+	var args debugArgs
+
+	if r.Args == nil {
+		return &args, nil
+	}
+
+	a, err := r.Args.Slice()
+	if err != nil || len(a) == 0 {
+		return &args, err
+	}
+
+	if err := a[0].Unmarshal(&args); err != nil {
+		return nil, err
+	}
+
+	return &args, nil
+}
+
+// handleDebugGoroutines gives the stack traces of all goroutines, formatted
+// as for an unrecovered panic, unless a different debug level is given.
+func handleDebugGoroutines(r *Request) (interface{}, error) {
+	args, err := readDebugArgs(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if args.Debug == 0 {
+		args.Debug = 2
+	}
+
+	var buf bytes.Buffer
+
+	if err := rpprof.Lookup("goroutine").WriteTo(&buf, args.Debug); err != nil {
+		return nil, err
+	}
+
+	return buf.String(), nil
+}
+
+// handleDebugHeap gives the memory allocator statistics.
+func handleDebugHeap(r *Request) (interface{}, error) {
+	args, err := readDebugArgs(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if args.GC {
+		runtime.GC()
+	}
+
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+
+	return &stats, nil
+}
+
+// handleDebugPprof streams the requested profile. CPU profiles and execution
+// traces are collected for the requested number of seconds, up to 5 minutes,
+// or until the stream is closed, e.g. the caller went away, or the kite is
+// closed. They are not bound to the context of the call, which for calls
+// made over HTTP ends once the handler returns the stream.
+func handleDebugPprof(r *Request) (interface{}, error) {
+	args, err := readDebugArgs(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if args.Seconds > int(maxProfileDuration/time.Second) {
+		return nil, fmt.Errorf("profile duration of %ds exceeds the limit of %s", args.Seconds, maxProfileDuration)
+	}
+
+	d := time.Duration(args.Seconds) * time.Second
+	if d <= 0 {
+		d = defaultProfileDuration
+	}
+
+	s := NewStream()
+
+	switch args.Profile {
+	case "cpu":
+		if err := rpprof.StartCPUProfile(s); err != nil {
+			return nil, err
+		}
+
+		go func() {
+			waitProfile(r.LocalKite, s, d)
+			rpprof.StopCPUProfile()
+			s.Close()
+		}()
+	case "trace":
+		if err := trace.Start(s); err != nil {
+			return nil, err
+		}
+
+		go func() {
+			waitProfile(r.LocalKite, s, d)
+			trace.Stop()
+			s.Close()
+		}()
+	default:
+		p := rpprof.Lookup(args.Profile)
+		if p == nil {
+			return nil, fmt.Errorf("unknown profile: %q", args.Profile)
+		}
+
+		go func() {
+			s.CloseWithError(p.WriteTo(s, args.Debug))
+		}()
+	}
+
+	return s, nil
+}
+
+// waitProfile waits for the duration d of a profile, or until the stream
+// or the kite is closed.
+func waitProfile(k *Kite, s *Stream, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+	case <-s.done:
+	case <-k.closeC:
+	}
+}
+
+// HandlePprof mounts the net/http/pprof handlers under the /debug/pprof/
+// path of the kite's HTTP server. Requests are authenticated like method
+// calls, with the Authorization header holding "<auth type> <auth key>",
+// and require the ScopeDebug scope.
+func (k *Kite) HandlePprof() {
+	k.HandleHTTP("/debug/pprof/cmdline", k.debugHandler(http.HandlerFunc(pprof.Cmdline)))
+	k.HandleHTTP("/debug/pprof/profile", k.debugHandler(http.HandlerFunc(pprof.Profile)))
+	k.HandleHTTP("/debug/pprof/symbol", k.debugHandler(http.HandlerFunc(pprof.Symbol)))
+	k.HandleHTTP("/debug/pprof/trace", k.debugHandler(http.HandlerFunc(pprof.Trace)))
+	k.muxer.PathPrefix("/debug/pprof/").Handler(k.debugHandler(http.HandlerFunc(pprof.Index)))
+}
+
+// debugHandler serves requests with h, once they are authorized.
+func (k *Kite) debugHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if err := k.authorizeHTTP(req, ScopeDebug); err != nil {
+			code := http.StatusForbidden
+			if err.Type == "authenticationError" {
+				code = http.StatusUnauthorized
+			}
+
+			http.Error(w, err.Error(), code)
+			return
+		}
+
+		h.ServeHTTP(w, req)
+	})
+}
+
+// authorizeHTTP authenticates the HTTP request like a method call
+// and checks whether the caller was granted the scopes.
+func (k *Kite) authorizeHTTP(req *http.Request, scopes ...string) *Error {
+	m := k.newMethod(req.URL.Path, nil)
+	m.scopes = scopes
+
+	r := &Request{
+		Method:    req.URL.Path,
+		LocalKite: k,
+		Client:    &Client{LocalKite: k, session: &callSession{req: req}},
+		Auth:      AuthFromRequest(req),
+		Context:   cache.NewMemory(),
+		ctx:       req.Context(),
+	}
+
+	if m.authenticate {
+		if err := r.authenticate(); err != nil {
+			return err
+		}
+	}
+
+	return m.checkScopes(r)
+}
@@ -0,0 +1,263 @@
+// Package discover resolves kites from DNS SRV records, for deployments
+// where Kontrol is not available.
+//
+// Kites of a service are published as _kite._tcp.<service> records:
+//
+//	_kite._tcp.math.example.com. 60 IN SRV 10 50 3636 math-1.example.com.
+//	_kite._tcp.math.example.com. 60 IN SRV 10 50 3636 math-2.example.com.
+//
+// and resolved with:
+//
+//	d := discover.New(k, "math.example.com")
+//	d.Start()
+//	defer d.Close()
+//
+//	clients := d.Clients()
+package discover
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/koding/kite"
+	"github.com/koding/kite/protocol"
+)
+
+// DefaultInterval is the default interval of re-resolving the records.
+const DefaultInterval = 30 * time.Second
+
+// Resolver looks up SRV records, *net.Resolver is used by default.
+type Resolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// Discovery gives clients of the kites of a service. The clients
+// are ordered by the priority and the weight of the records.
+type Discovery struct {
+	// Kite is the local kite the clients are created with.
+	Kite *kite.Kite
+
+	// Service is the domain name of the service, the records
+	// are looked up under _kite._tcp.<Service>.
+	Service string
+
+	// Resolver looks up the records. If nil, net.DefaultResolver is used.
+	Resolver Resolver
+
+	// Interval is the interval of re-resolving the records after Start.
+	// If zero, DefaultInterval is used.
+	Interval time.Duration
+
+	// Scheme is the scheme of the kite URLs, "http" by default.
+	Scheme string
+
+	// Path is the path of the kite URLs, "/kite" by default.
+	Path string
+
+	// Auth gives authentication of the client of the remote kite.
+	// If nil, the clients authenticate with the kite key
+	// of the local kite.
+	Auth func(remote *protocol.Kite) (*kite.Auth, error)
+
+	// OnChange, if non-nil, is called with the clients after the set
+	// of the resolved kites changes.
+	OnChange func(clients []*kite.Client)
+
+	mu      sync.Mutex
+	clients []*kite.Client
+	close   chan struct{}
+	done    chan struct{}
+}
+
+// New gives a discovery of the kites of the service.
+func New(k *kite.Kite, service string) *Discovery {
+	return &Discovery{
+		Kite:    k,
+		Service: service,
+	}
+}
+
+// Resolve looks up the records and gives clients of the kites. Clients
+// of kites resolved before are reused, the new ones are not connected yet.
+//
+// If no records are found, kite.ErrNoKitesAvailable is returned.
+func (d *Discovery) Resolve(ctx context.Context) ([]*kite.Client, error) {
+	_, records, err := d.resolver().LookupSRV(ctx, "kite", "tcp", d.Service)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+
+	old := make(map[string]*kite.Client, len(d.clients))
+	for _, c := range d.clients {
+		old[c.URL] = c
+	}
+
+	var (
+		clients []*kite.Client
+		changed bool
+	)
+
+	for _, srv := range records {
+		host := strings.TrimSuffix(srv.Target, ".")
+
+		u := &url.URL{
+			Scheme: d.scheme(),
+			Host:   net.JoinHostPort(host, strconv.Itoa(int(srv.Port))),
+			Path:   d.path(),
+		}
+
+		if c, ok := old[u.String()]; ok {
+			delete(old, u.String())
+			clients = append(clients, c)
+			continue
+		}
+
+		remote := &protocol.Kite{
+			Hostname: host,
+		}
+
+		c := d.Kite.NewClient(u.String())
+		c.Kite = *remote
+
+		if c.Auth, err = d.auth(remote); err != nil {
+			d.mu.Unlock()
+			return nil, err
+		}
+
+		clients = append(clients, c)
+		changed = true
+	}
+
+	if len(old) != 0 {
+		changed = true
+	}
+
+	d.clients = clients
+	d.mu.Unlock()
+
+	if changed && d.OnChange != nil {
+		d.OnChange(clients)
+	}
+
+	if len(clients) == 0 {
+		return nil, kite.ErrNoKitesAvailable
+	}
+
+	return clients, nil
+}
+
+// Clients gives the clients of the kites resolved most recently.
+func (d *Discovery) Clients() []*kite.Client {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return append([]*kite.Client(nil), d.clients...)
+}
+
+// Start resolves the records and keeps re-resolving them every Interval,
+// until Close is called. Errors of the first resolution are returned,
+// the ones of the following resolutions are logged.
+func (d *Discovery) Start() error {
+	d.mu.Lock()
+	if d.close != nil {
+		d.mu.Unlock()
+		return errors.New("discover: already started")
+	}
+	closeC, done := make(chan struct{}), make(chan struct{})
+	d.close, d.done = closeC, done
+	d.mu.Unlock()
+
+	_, err := d.Resolve(context.Background())
+
+	go d.loop(closeC, done)
+
+	return err
+}
+
+// Close stops re-resolving the records.
+func (d *Discovery) Close() error {
+	d.mu.Lock()
+	closeC, done := d.close, d.done
+	d.close, d.done = nil, nil
+	d.mu.Unlock()
+
+	if closeC == nil {
+		return nil
+	}
+
+	close(closeC)
+	<-done
+
+	return nil
+}
+
+func (d *Discovery) loop(closeC, done chan struct{}) {
+	defer close(done)
+
+	t := time.NewTicker(d.interval())
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			ctx, cancel := context.WithTimeout(context.Background(), d.interval())
+			if _, err := d.Resolve(ctx); err != nil {
+				d.Kite.Log.Warning("discover: resolving %q failed: %s", d.Service, err)
+			}
+			cancel()
+		case <-closeC:
+			return
+		}
+	}
+}
+
+func (d *Discovery) auth(remote *protocol.Kite) (*kite.Auth, error) {
+	if d.Auth != nil {
+		return d.Auth(remote)
+	}
+
+	return &kite.Auth{
+		Type: "kiteKey",
+		Key:  d.Kite.KiteKey(),
+	}, nil
+}
+
+func (d *Discovery) resolver() Resolver {
+	if d.Resolver != nil {
+		return d.Resolver
+	}
+
+	return net.DefaultResolver
+}
+
+func (d *Discovery) interval() time.Duration {
+	if d.Interval > 0 {
+		return d.Interval
+	}
+
+	return DefaultInterval
+}
+
+func (d *Discovery) scheme() string {
+	if d.Scheme != "" {
+		return d.Scheme
+	}
+
+	return "http"
+}
+
+func (d *Discovery) path() string {
+	if d.Path != "" {
+		return d.Path
+	}
+
+	return "/kite"
+}
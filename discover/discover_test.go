@@ -0,0 +1,124 @@
+package discover
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/koding/kite"
+)
+
+// fakeResolver serves the records set with set.
+type fakeResolver struct {
+	mu      sync.Mutex
+	name    string
+	records []*net.SRV
+}
+
+func (r *fakeResolver) set(records ...*net.SRV) {
+	r.mu.Lock()
+	r.records = records
+	r.mu.Unlock()
+}
+
+func (r *fakeResolver) LookupSRV(_ context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.name = "_" + service + "._" + proto + "." + name
+
+	return r.name, r.records, nil
+}
+
+func urls(clients []*kite.Client) []string {
+	var u []string
+	for _, c := range clients {
+		u = append(u, c.URL)
+	}
+	return u
+}
+
+func TestDiscovery(t *testing.T) {
+	r := &fakeResolver{}
+	r.set(
+		&net.SRV{Target: "math-1.example.com.", Port: 3636, Priority: 10},
+		&net.SRV{Target: "math-2.example.com.", Port: 3637, Priority: 20},
+	)
+
+	k := kite.New("exp", "0.0.1")
+	k.Config.KiteKey = "kitekey"
+
+	changes := make(chan []string, 2)
+
+	d := New(k, "math.example.com")
+	d.Resolver = r
+	d.Interval = 10 * time.Millisecond
+	d.OnChange = func(clients []*kite.Client) {
+		changes <- urls(clients)
+	}
+
+	if err := d.Start(); err != nil {
+		t.Fatalf("Start()=%s", err)
+	}
+	defer d.Close()
+
+	want := []string{
+		"http://math-1.example.com:3636/kite",
+		"http://math-2.example.com:3637/kite",
+	}
+
+	if got := <-changes; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	r.mu.Lock()
+	name := r.name
+	r.mu.Unlock()
+
+	if name != "_kite._tcp.math.example.com" {
+		t.Fatalf("got %q, want _kite._tcp.math.example.com", name)
+	}
+
+	first := d.Clients()[0]
+
+	if first.Kite.Hostname != "math-1.example.com" {
+		t.Errorf("got %q hostname", first.Kite.Hostname)
+	}
+
+	if first.Auth == nil || first.Auth.Type != "kiteKey" || first.Auth.Key != "kitekey" {
+		t.Errorf("got %+v auth, want kite key", first.Auth)
+	}
+
+	r.set(
+		&net.SRV{Target: "math-1.example.com.", Port: 3636, Priority: 10},
+		&net.SRV{Target: "math-3.example.com.", Port: 3636, Priority: 20},
+	)
+
+	select {
+	case got := <-changes:
+		want := []string{
+			"http://math-1.example.com:3636/kite",
+			"http://math-3.example.com:3636/kite",
+		}
+
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the records to be re-resolved")
+	}
+
+	// Clients of kites, which were resolved before, are reused.
+	if c := d.Clients()[0]; c != first {
+		t.Fatal("expected the client to be reused")
+	}
+
+	r.set()
+
+	if _, err := d.Resolve(context.Background()); err != kite.ErrNoKitesAvailable {
+		t.Fatalf("got %v, want %v", err, kite.ErrNoKitesAvailable)
+	}
+}
@@ -0,0 +1,383 @@
+package dnode
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Attachment is a binary payload, which is sent as a separate frame
+// following the dnode message, instead of being encoded into the message.
+// It saves encoding the bytes, e.g. with base64 for JSON messages.
+//
+// In the message the attachment is null, its data is set from the frame
+// when the arguments are unmarshaled. Attachments can be unmarshaled
+// into Attachment, []byte and interface{} values.
+//
+// If the remote side does not support attachments, they are encoded
+// into the message like []byte values, see InlineAttachments.
+type Attachment []byte
+
+var attachmentType = reflect.TypeOf(Attachment(nil))
+
+// MarshalJSON encodes the attachment placeholder.
+func (Attachment) MarshalJSON() ([]byte, error) {
+	return []byte(`null`), nil
+}
+
+// UnmarshalJSON decodes attachments, which were encoded into
+// the message. The placeholder is ignored.
+func (a *Attachment) UnmarshalJSON(data []byte) error {
+	if bytes.Equal(data, []byte(`null`)) {
+		return nil
+	}
+
+	return json.Unmarshal(data, (*[]byte)(a))
+}
+
+// MarshalMsgpack encodes the attachment placeholder.
+func (Attachment) MarshalMsgpack() ([]byte, error) {
+	return msgpack.Marshal(nil)
+}
+
+// UnmarshalMsgpack decodes attachments, which were encoded into
+// the message. The placeholder is ignored.
+func (a *Attachment) UnmarshalMsgpack(data []byte) error {
+	var p []byte
+
+	if err := msgpack.Unmarshal(data, &p); err != nil {
+		return err
+	}
+
+	if p != nil {
+		*a = p
+	}
+
+	return nil
+}
+
+// AttachmentSpec is a structure encapsulating an attachment
+// and its path in the arguments.
+type AttachmentSpec struct {
+	Path Path
+	Data Attachment
+}
+
+// CollectAttachments gives the attachments found in obj along with their
+// paths, in the order they are sent. Attachments of Partial values, which
+// are part of obj, are collected as well.
+func CollectAttachments(obj interface{}) []AttachmentSpec {
+	var specs []AttachmentSpec
+	collectAttachments(reflect.ValueOf(obj), make(Path, 0), &specs)
+	return specs
+}
+
+func collectAttachments(rv reflect.Value, path Path, specs *[]AttachmentSpec) {
+	if !rv.IsValid() {
+		return
+	}
+
+	if rv.Type() == attachmentType {
+		// Empty attachments are not worth a frame.
+		if rv.Len() != 0 {
+			*specs = append(*specs, AttachmentSpec{
+				Path: copyPath(path),
+				Data: rv.Bytes(),
+			})
+		}
+		return
+	}
+
+	switch rv.Kind() {
+	case reflect.Interface:
+		if !rv.IsNil() {
+			collectAttachments(rv.Elem(), path, specs)
+		}
+	case reflect.Ptr:
+		if rv.IsNil() {
+			return
+		}
+
+		if rv.Type() == partialType && rv.CanInterface() {
+			for _, spec := range rv.Interface().(*Partial).AttachmentSpecs {
+				*specs = append(*specs, AttachmentSpec{
+					Path: copyPath(append(path, spec.Path...)),
+					Data: spec.Data,
+				})
+			}
+			return
+		}
+
+		collectAttachments(rv.Elem(), path, specs)
+	case reflect.Array, reflect.Slice:
+		// Do not walk over plain bytes.
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			return
+		}
+
+		for i := 0; i < rv.Len(); i++ {
+			collectAttachments(rv.Index(i), append(path, i), specs)
+		}
+	case reflect.Map:
+		for _, key := range rv.MapKeys() {
+			collectAttachments(rv.MapIndex(key), append(path, key.String()), specs)
+		}
+	case reflect.Struct:
+		if rv.Type() == dnodeFunctionType {
+			return
+		}
+
+		for i := 0; i < rv.NumField(); i++ {
+			sf := rv.Type().Field(i)
+
+			name, ok := fieldName(sf)
+			if !ok {
+				continue
+			}
+
+			if sf.Anonymous {
+				collectAttachments(rv.Field(i), path, specs)
+			} else {
+				collectAttachments(rv.Field(i), append(path, name), specs)
+			}
+		}
+	}
+}
+
+// ParseAttachments sets the attachments of the message, which were
+// received as frames following the message, to its arguments.
+func ParseAttachments(msg *Message, frames [][]byte) error {
+	if len(frames) != len(msg.Attachments) {
+		return fmt.Errorf("got %d attachments, want %d", len(frames), len(msg.Attachments))
+	}
+
+	if msg.Arguments == nil {
+		return nil
+	}
+
+	for i, path := range msg.Attachments {
+		msg.Arguments.AttachmentSpecs = append(msg.Arguments.AttachmentSpecs, AttachmentSpec{
+			Path: path,
+			Data: frames[i],
+		})
+	}
+
+	return nil
+}
+
+// InlineAttachments encodes the attachments into the raw arguments
+// encoded with the given codec, replacing their placeholders.
+//
+// It is used when the remote side does not support receiving
+// attachments as separate frames.
+func InlineAttachments(c Codec, raw []byte, specs []AttachmentSpec) ([]byte, error) {
+	var v interface{}
+
+	if isJSON(c) {
+		// Do not lose precision of big numbers.
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		dec.UseNumber()
+
+		if err := dec.Decode(&v); err != nil {
+			return nil, err
+		}
+	} else if err := c.Unmarshal(raw, &v); err != nil {
+		return nil, err
+	}
+
+	for _, spec := range specs {
+		var err error
+		if v, err = inlineAttachment(v, spec.Path, spec.Data); err != nil {
+			return nil, err
+		}
+	}
+
+	return c.Marshal(v)
+}
+
+func inlineAttachment(node interface{}, path Path, data []byte) (interface{}, error) {
+	if len(path) == 0 {
+		return data, nil
+	}
+
+	var err error
+
+	switch n := node.(type) {
+	case []interface{}:
+		i, e := pathIndex(path[0])
+		if e != nil || i < 0 || i >= len(n) {
+			return nil, fmt.Errorf("invalid attachment path: %v", path)
+		}
+
+		n[i], err = inlineAttachment(n[i], path[1:], data)
+		return n, err
+	case map[string]interface{}:
+		key := fmt.Sprint(path[0])
+
+		n[key], err = inlineAttachment(n[key], path[1:], data)
+		return n, err
+	default:
+		return nil, fmt.Errorf("invalid attachment path: %v", path)
+	}
+}
+
+// setAttachment sets the attachment data at the path of the unmarshaled
+// value, like setCallback does for callbacks.
+func setAttachment(value reflect.Value, path Path, data Attachment) error {
+	i := 0
+	for {
+		switch value.Kind() {
+		case reflect.Ptr:
+			// The placeholder of the attachment is null, so the pointer
+			// to it is nil, e.g. for a result being the attachment.
+			if value.IsNil() && value.CanSet() {
+				if value.Type() == partialType {
+					value.Set(reflect.ValueOf(&Partial{Raw: []byte(`null`)}))
+				} else {
+					value.Set(reflect.New(value.Type().Elem()))
+				}
+			}
+
+			if value.Type() == partialType && !value.IsNil() {
+				p := value.Interface().(*Partial)
+				p.AttachmentSpecs = append(p.AttachmentSpecs, AttachmentSpec{path[i:], data})
+				return nil
+			}
+
+			value = value.Elem()
+		case reflect.Interface:
+			if i == len(path) {
+				if !value.CanSet() {
+					return fmt.Errorf("cannot set attachment at path: %v", path)
+				}
+
+				value.Set(reflect.ValueOf(data))
+				return nil
+			}
+
+			value = value.Elem()
+		case reflect.Slice:
+			if i == len(path) {
+				if value.Type().Elem().Kind() != reflect.Uint8 || !value.CanSet() {
+					return fmt.Errorf("cannot set attachment to %s value", value.Type())
+				}
+
+				value.SetBytes(data)
+				return nil
+			}
+
+			index, err := pathIndex(path[i])
+			if err != nil {
+				return err
+			}
+
+			if index < 0 || index >= value.Len() {
+				return fmt.Errorf("attachment path out of range: %v", path)
+			}
+
+			value = value.Index(index)
+			i++
+		case reflect.Map:
+			if i == len(path) {
+				return fmt.Errorf("attachment path too short: %v", path)
+			}
+
+			key, err := mapKey(value, path[i])
+			if err != nil {
+				return err
+			}
+
+			if i == len(path)-1 && !value.IsNil() {
+				switch elem := value.Type().Elem(); {
+				case elem.Kind() == reflect.Interface:
+					value.SetMapIndex(key, reflect.ValueOf(data))
+					return nil
+				case elem.Kind() == reflect.Slice && elem.Elem().Kind() == reflect.Uint8:
+					value.SetMapIndex(key, reflect.ValueOf(data).Convert(elem))
+					return nil
+				}
+			}
+
+			value = value.MapIndex(key)
+			i++
+		case reflect.Struct:
+			if value.CanAddr() {
+				if p, ok := value.Addr().Interface().(*Partial); ok {
+					p.AttachmentSpecs = append(p.AttachmentSpecs, AttachmentSpec{path[i:], data})
+					return nil
+				}
+			}
+
+			if i == len(path) {
+				return fmt.Errorf("cannot set attachment to %s value", value.Type())
+			}
+
+			name, ok := path[i].(string)
+			if !ok {
+				return fmt.Errorf("Invalid path: %#v", path[i])
+			}
+
+			value = fieldByName(value, name)
+			if value.IsValid() && !value.CanInterface() {
+				return fmt.Errorf("Invalid path: %#v", name)
+			}
+			i++
+		case reflect.Invalid:
+			// attachment path does not exist, skip
+			return nil
+		default:
+			return fmt.Errorf("Unhandled value of kind '%v' in attachment path: %v", value.Kind(), path)
+		}
+	}
+}
+
+// fieldByName gives the field of the struct value, which is named
+// in the dnode arguments with the given name.
+func fieldByName(value reflect.Value, name string) reflect.Value {
+	for i := 0; i < value.NumField(); i++ {
+		sf := value.Type().Field(i)
+
+		// Fields skipped when collecting callbacks, e.g. dnode:"-"
+		// tagged ones, may still hold arguments.
+		if sf.PkgPath != "" && !sf.Anonymous {
+			continue
+		}
+
+		fname := sf.Name
+		if tag := strings.Split(sf.Tag.Get("json"), ",")[0]; tag == "-" {
+			continue
+		} else if tag != "" {
+			fname = tag
+		}
+
+		if !sf.Anonymous {
+			if fname == name {
+				return value.Field(i)
+			}
+			continue
+		}
+
+		field := value.Field(i)
+		if field.Kind() == reflect.Ptr {
+			field = field.Elem()
+		}
+
+		if field.Kind() == reflect.Struct {
+			if v := fieldByName(field, name); v.IsValid() {
+				return v
+			}
+		}
+	}
+
+	return reflect.Value{}
+}
+
+func copyPath(path Path) Path {
+	pathCopy := make(Path, len(path))
+	copy(pathCopy, path)
+	return pathCopy
+}
@@ -0,0 +1,118 @@
+package dnode
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestAttachments(t *testing.T) {
+	type Args struct {
+		Name  string            `json:"name"`
+		Blob  Attachment        `json:"blob"`
+		Files map[string][]byte `json:"files"`
+		Any   interface{}       `json:"any"`
+	}
+
+	args := []interface{}{&Args{
+		Name:  "kite",
+		Blob:  Attachment("blob data"),
+		Files: map[string][]byte{"a": []byte("not attached")},
+		Any:   Attachment("any"),
+	}}
+
+	specs := CollectAttachments(args)
+
+	want := []AttachmentSpec{
+		{Path{0, "blob"}, Attachment("blob data")},
+		{Path{0, "any"}, Attachment("any")},
+	}
+
+	if !reflect.DeepEqual(specs, want) {
+		t.Fatalf("got %+v, want %+v", specs, want)
+	}
+
+	for _, codec := range []Codec{JSON, MsgPack} {
+		raw, err := codec.Marshal(args)
+		if err != nil {
+			t.Fatalf("%s: Marshal()=%s", codec.Name(), err)
+		}
+
+		if bytes.Contains(raw, []byte("blob data")) {
+			t.Fatalf("%s: attachment was encoded into the message", codec.Name())
+		}
+
+		// Attachments sent as frames.
+		msg := &Message{
+			Arguments:   &Partial{Raw: raw, Codec: codec},
+			Attachments: []Path{want[0].Path, want[1].Path},
+		}
+
+		if err := ParseAttachments(msg, [][]byte{[]byte("blob data"), []byte("any")}); err != nil {
+			t.Fatalf("%s: ParseAttachments()=%s", codec.Name(), err)
+		}
+
+		var got Args
+		if err := msg.Arguments.One().Unmarshal(&got); err != nil {
+			t.Fatalf("%s: Unmarshal()=%s", codec.Name(), err)
+		}
+
+		if string(got.Blob) != "blob data" || string(got.Files["a"]) != "not attached" {
+			t.Fatalf("%s: got %+v", codec.Name(), &got)
+		}
+
+		if a, ok := got.Any.(Attachment); !ok || string(a) != "any" {
+			t.Fatalf("%s: got %#v, want %q attachment", codec.Name(), got.Any, "any")
+		}
+
+		// Attachments encoded into the message.
+		inlined, err := InlineAttachments(codec, raw, specs)
+		if err != nil {
+			t.Fatalf("%s: InlineAttachments()=%s", codec.Name(), err)
+		}
+
+		var blob struct {
+			Blob []byte `json:"blob"`
+		}
+
+		p := &Partial{Raw: inlined, Codec: codec}
+		if err := p.One().Unmarshal(&blob); err != nil {
+			t.Fatalf("%s: Unmarshal()=%s", codec.Name(), err)
+		}
+
+		if string(blob.Blob) != "blob data" {
+			t.Fatalf("%s: got %q, want %q", codec.Name(), blob.Blob, "blob data")
+		}
+	}
+
+	// The placeholder of a value being the attachment is null.
+	var blob []byte
+
+	p := &Partial{Raw: []byte(`null`), AttachmentSpecs: []AttachmentSpec{{Path{}, Attachment("blob data")}}}
+	if err := p.Unmarshal(&blob); err != nil {
+		t.Fatalf("Unmarshal()=%s", err)
+	}
+
+	if string(blob) != "blob data" {
+		t.Fatalf("got %q, want %q", blob, "blob data")
+	}
+
+	// Attachments are kept in partials.
+	p, err := NewPartial(args[0])
+	if err != nil {
+		t.Fatalf("NewPartial()=%s", err)
+	}
+
+	if specs := CollectAttachments([]interface{}{p}); len(specs) != 2 || !reflect.DeepEqual(specs[0].Path, Path{0, "blob"}) {
+		t.Fatalf("got %+v attachments of the partial", specs)
+	}
+
+	var got Args
+	if err := p.Unmarshal(&got); err != nil {
+		t.Fatalf("Unmarshal()=%s", err)
+	}
+
+	if string(got.Blob) != "blob data" {
+		t.Fatalf("got %q, want %q", got.Blob, "blob data")
+	}
+}
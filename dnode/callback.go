@@ -1,8 +1,10 @@
 package dnode
 
 import (
+	"context"
 	"errors"
 	"strconv"
+	"time"
 )
 
 // Function is the type for sending and receiving functions in dnode messages.
@@ -29,10 +31,12 @@ func (f Function) IsValid() bool {
 }
 
 func (f Function) MarshalJSON() ([]byte, error) {
-	if _, ok := f.Caller.(callback); !ok {
+	switch f.Caller.(type) {
+	case callback, scopedCallback:
+		return []byte(`"[Function]"`), nil
+	default:
 		return []byte(`null`), nil
 	}
-	return []byte(`"[Function]"`), nil
 }
 
 func (*Function) UnmarshalJSON(data []byte) error {
@@ -46,6 +50,25 @@ func Callback(f func(*Partial)) Function {
 	}
 }
 
+// CallbackWithTTL is like Callback, but the scrubber forgets the callback
+// after the ttl elapses, whether the remote side called it or not.
+//
+// Use it for callbacks which are not expected to be called after some
+// time, otherwise the scrubber keeps them as long as the connection lasts.
+func CallbackWithTTL(f func(*Partial), ttl time.Duration) Function {
+	return Function{
+		Caller: scopedCallback{fn: f, ttl: ttl},
+	}
+}
+
+// CallbackWithContext is like Callback, but the scrubber forgets the
+// callback when the ctx is done.
+func CallbackWithContext(ctx context.Context, f func(*Partial)) Function {
+	return Function{
+		Caller: scopedCallback{fn: f, ctx: ctx},
+	}
+}
+
 type callback func(*Partial)
 
 func (f callback) Call(args ...interface{}) error {
@@ -53,6 +76,17 @@ func (f callback) Call(args ...interface{}) error {
 	panic("you cannot call your own callback method")
 }
 
+// scopedCallback is a callback with a limited lifetime.
+type scopedCallback struct {
+	fn  callback
+	ttl time.Duration
+	ctx context.Context
+}
+
+func (f scopedCallback) Call(args ...interface{}) error {
+	return f.fn.Call(args...)
+}
+
 // functionReceived is a type implementing caller interface.
 // It is used to set the Function when a callback function is received.
 type functionReceived func(...interface{}) error
@@ -61,6 +95,12 @@ func (f functionReceived) Call(args ...interface{}) error {
 	return f(args...)
 }
 
+// MarshalJSON makes received functions, which were unmarshaled
+// into interface{} values, encode like Function does.
+func (f functionReceived) MarshalJSON() ([]byte, error) {
+	return []byte(`null`), nil
+}
+
 // CallbackSpec is a structure encapsulating a Function and it's Path.
 // It is the type of the values in callbacks map.
 type CallbackSpec struct {
@@ -76,6 +116,10 @@ type Path []interface{}
 // parseCallbacks parses the message's "callbacks" field and prepares
 // callback functions in "arguments" field.
 func ParseCallbacks(msg *Message, sender func(id uint64, args []interface{}) error) error {
+	if len(msg.Callbacks) != 0 && msg.Arguments == nil {
+		return errors.New("callbacks of a message without arguments")
+	}
+
 	// Parse callbacks field and create callback functions.
 	for methodID, path := range msg.Callbacks {
 		id, err := strconv.ParseUint(methodID, 10, 64)
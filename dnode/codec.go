@@ -0,0 +1,261 @@
+package dnode
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Codec encodes and decodes dnode messages.
+//
+// A Codec must decode *Partial values by storing the raw, encoded value
+// in Partial.Raw and setting Partial.Codec to itself, so the arguments
+// can be decoded lazily. Struct fields are named after their JSON tags,
+// regardless of the codec used.
+type Codec interface {
+	// Name is used to identify the codec when negotiating it
+	// with the remote kite.
+	Name() string
+
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	// JSON is the default codec.
+	JSON Codec = jsonCodec{}
+
+	// MsgPack encodes messages with MessagePack, which is more
+	// compact and faster to encode than JSON.
+	//
+	// Numbers decoded into interface{} values are integers or floats,
+	// depending on how they were encoded, unlike JSON where all
+	// numbers are float64.
+	MsgPack Codec = msgpackCodec{}
+)
+
+// bufferMarshaler is implemented by codecs, which are able to encode
+// values directly into a buffer.
+type bufferMarshaler interface {
+	marshalTo(buf *bytes.Buffer, v interface{}) error
+}
+
+// MarshalTo encodes v with the codec and appends the result to buf.
+// Unlike Codec.Marshal, it does not allocate the result for the builtin
+// codecs, which allows for reusing buffers, e.g. with sync.Pool.
+func MarshalTo(c Codec, buf *bytes.Buffer, v interface{}) error {
+	if m, ok := c.(bufferMarshaler); ok {
+		n := buf.Len()
+
+		if err := m.marshalTo(buf, v); err != nil {
+			buf.Truncate(n) // drop partially encoded value
+			return err
+		}
+
+		return nil
+	}
+
+	p, err := c.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	buf.Write(p)
+	return nil
+}
+
+var (
+	codecs   = map[string]Codec{JSON.Name(): JSON, MsgPack.Name(): MsgPack}
+	codecsMu sync.RWMutex
+)
+
+// RegisterCodec makes the codec available for negotiation. Codecs
+// are registered under their names, registering a codec with the same
+// name replaces the previous one.
+func RegisterCodec(c Codec) {
+	codecsMu.Lock()
+	codecs[c.Name()] = c
+	codecsMu.Unlock()
+}
+
+// GetCodec gives a codec registered under the given name. It returns
+// nil if there is no such codec.
+func GetCodec(name string) Codec {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+
+	return codecs[name]
+}
+
+// JSONEncoder marshals and unmarshals values to and from JSON, like
+// encoding/json does. It allows for replacing encoding/json with faster
+// implementations, e.g. jsoniter.ConfigCompatibleWithStandardLibrary
+// of github.com/json-iterator/go satisfies the interface.
+type JSONEncoder interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// NewJSONCodec gives a JSON codec, which uses the given encoder
+// instead of encoding/json. The encoder must be compatible with
+// encoding/json, e.g. it must respect Marshaler and Unmarshaler
+// implementations.
+//
+// The codec is interchangeable with JSON, messages encoded with
+// one can be decoded with the other. If enc is nil, JSON is returned.
+func NewJSONCodec(enc JSONEncoder) Codec {
+	if enc == nil {
+		return JSON
+	}
+
+	return jsonCodec{enc: enc}
+}
+
+type jsonCodec struct {
+	enc JSONEncoder // nil for encoding/json
+}
+
+func (jsonCodec) Name() string { return "json" }
+
+func (c jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	if c.enc != nil {
+		return c.enc.Marshal(v)
+	}
+
+	return json.Marshal(v)
+}
+
+func (c jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	if c.enc != nil {
+		return c.enc.Unmarshal(data, v)
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+func (c jsonCodec) marshalTo(buf *bytes.Buffer, v interface{}) error {
+	if c.enc != nil {
+		p, err := c.enc.Marshal(v)
+		if err != nil {
+			return err
+		}
+
+		buf.Write(p)
+		return nil
+	}
+
+	if err := json.NewEncoder(buf).Encode(v); err != nil {
+		return err
+	}
+
+	// Strip the newline Encode terminates the value with.
+	buf.Truncate(buf.Len() - 1)
+
+	return nil
+}
+
+// isJSON tells whether the codec encodes JSON, either with
+// encoding/json or a custom encoder, see NewJSONCodec.
+func isJSON(c Codec) bool {
+	_, ok := c.(jsonCodec)
+	return ok
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string { return "msgpack" }
+
+func (c msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+
+	if err := c.marshalTo(&buf, v); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) marshalTo(buf *bytes.Buffer, v interface{}) error {
+	enc := msgpack.GetEncoder()
+	defer msgpack.PutEncoder(enc)
+
+	enc.Reset(buf)
+	enc.SetCustomStructTag("json")
+	enc.UseCompactInts(true)
+
+	return enc.Encode(v)
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	// Decode into the value pointed by the interface, like
+	// encoding/json does.
+	if pv, ok := v.(*interface{}); ok && *pv != nil && reflect.ValueOf(*pv).Kind() == reflect.Ptr {
+		v = *pv
+	}
+
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+
+	return dec.Decode(v)
+}
+
+// MarshalMsgpack returns the raw bytes of the Partial, converting them
+// to MessagePack if they were encoded with other codec.
+func (p *Partial) MarshalMsgpack() ([]byte, error) {
+	if p.Codec == MsgPack {
+		return p.Raw, nil
+	}
+
+	return p.transcode(MsgPack)
+}
+
+// UnmarshalMsgpack puts the data into Partial.Raw.
+func (p *Partial) UnmarshalMsgpack(data []byte) error {
+	if p == nil {
+		return fmt.Errorf("dnode.Partial: UnmarshalMsgpack on nil pointer")
+	}
+
+	p.Raw = make([]byte, len(data))
+	p.Codec = MsgPack
+	copy(p.Raw, data)
+	return nil
+}
+
+// transcode gives the raw bytes of the Partial encoded with the given codec.
+func (p *Partial) transcode(c Codec) ([]byte, error) {
+	var v interface{}
+
+	if err := p.codec().Unmarshal(p.Raw, &v); err != nil {
+		return nil, err
+	}
+
+	return c.Marshal(v)
+}
+
+func (p *Partial) codec() Codec {
+	if p.Codec == nil {
+		return JSON
+	}
+
+	return p.Codec
+}
+
+// MarshalMsgpack encodes the function placeholder.
+func (f Function) MarshalMsgpack() ([]byte, error) {
+	switch f.Caller.(type) {
+	case callback, scopedCallback:
+		return msgpack.Marshal("[Function]")
+	default:
+		return msgpack.Marshal(nil)
+	}
+}
+
+// UnmarshalMsgpack ignores the function placeholder, the functions are
+// set from the callbacks field of the message.
+func (*Function) UnmarshalMsgpack(data []byte) error {
+	return nil
+}
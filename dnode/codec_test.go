@@ -0,0 +1,183 @@
+package dnode
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestMsgPack(t *testing.T) {
+	type args struct {
+		Name   string   `json:"name"`
+		Values []int    `json:"values"`
+		Nested *Partial `json:"nested"`
+		Cb     Function `json:"cb"`
+	}
+
+	p, err := MsgPack.Marshal([]interface{}{args{
+		Name:   "kite",
+		Values: []int{1, 2, 3},
+		Nested: &Partial{Raw: []byte(`{"foo":"bar"}`)},
+		Cb:     Callback(func(*Partial) {}),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := &Message{
+		Method:    "method",
+		Arguments: &Partial{Raw: p, Codec: MsgPack},
+		Callbacks: map[string]Path{"0": {0, "cb"}},
+	}
+
+	raw, err := MsgPack.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got Message
+	if err := MsgPack.Unmarshal(raw, &got); err != nil {
+		t.Fatal(err)
+	}
+
+	called := false
+	err = ParseCallbacks(&got, func(id uint64, args []interface{}) error {
+		called = true
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.Method != "method" {
+		t.Fatalf("got %v method, want %q", got.Method, "method")
+	}
+
+	var a args
+	if err := got.Arguments.One().Unmarshal(&a); err != nil {
+		t.Fatal(err)
+	}
+
+	if a.Name != "kite" || !reflect.DeepEqual(a.Values, []int{1, 2, 3}) {
+		t.Fatalf("got %+v", a)
+	}
+
+	if a.Nested.Codec != MsgPack {
+		t.Fatalf("got %v codec of nested partial, want %v", a.Nested.Codec, MsgPack)
+	}
+
+	if s := a.Nested.MustMap()["foo"].MustString(); s != "bar" {
+		t.Fatalf("got %q, want %q", s, "bar")
+	}
+
+	// Nested partial is converted back to JSON.
+	j, err := a.Nested.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(j) != `{"foo":"bar"}` {
+		t.Fatalf("got %s, want %s", j, `{"foo":"bar"}`)
+	}
+
+	// Integers decode into floats too.
+	if f := got.Arguments.One().MustMap()["values"].MustSlice()[2].MustFloat64(); f != 3 {
+		t.Fatalf("got %f, want 3", f)
+	}
+
+	if err := a.Cb.Call(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !called {
+		t.Fatal("callback was not called")
+	}
+}
+
+type countingEncoder struct {
+	marshal, unmarshal int
+}
+
+func (e *countingEncoder) Marshal(v interface{}) ([]byte, error) {
+	e.marshal++
+	return json.Marshal(v)
+}
+
+func (e *countingEncoder) Unmarshal(data []byte, v interface{}) error {
+	e.unmarshal++
+	return json.Unmarshal(data, v)
+}
+
+func TestNewJSONCodec(t *testing.T) {
+	if c := NewJSONCodec(nil); c != JSON {
+		t.Fatalf("got %v codec, want %v", c, JSON)
+	}
+
+	enc := &countingEncoder{}
+	c := NewJSONCodec(enc)
+
+	if c.Name() != JSON.Name() {
+		t.Fatalf("got %q name, want %q", c.Name(), JSON.Name())
+	}
+
+	raw, err := c.Marshal([]interface{}{map[string]int{"foo": 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if enc.marshal != 1 {
+		t.Fatalf("got %d Marshal calls, want 1", enc.marshal)
+	}
+
+	p := &Partial{Raw: raw, Codec: c}
+
+	// Partials decoded out of p use the custom encoder too.
+	if n := p.One().MustMap()["foo"].MustFloat64(); n != 1 {
+		t.Fatalf("got %f, want 1", n)
+	}
+
+	if enc.unmarshal != 3 {
+		t.Fatalf("got %d Unmarshal calls, want 3", enc.unmarshal)
+	}
+
+	// The partial is JSON already and it is not re-encoded.
+	j, err := p.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(j) != string(raw) {
+		t.Fatalf("got %s, want %s", j, raw)
+	}
+}
+
+func TestMarshalTo(t *testing.T) {
+	v := []interface{}{"kite", 1, map[string]interface{}{"foo": []int{1, 2}}}
+
+	for _, c := range []Codec{JSON, MsgPack, NewJSONCodec(&countingEncoder{})} {
+		want, err := c.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buf := bytes.NewBufferString("prefix")
+
+		if err := MarshalTo(c, buf, v); err != nil {
+			t.Fatalf("%s: %s", c.Name(), err)
+		}
+
+		if got := buf.Bytes(); !bytes.Equal(got, append([]byte("prefix"), want...)) {
+			t.Fatalf("%s: got %q, want %q", c.Name(), got, want)
+		}
+
+		// Values which fail to encode leave the buffer intact.
+		if err := MarshalTo(c, buf, []interface{}{"kite", func() {}}); err == nil {
+			t.Fatalf("%s: expected error", c.Name())
+		}
+
+		if got := buf.Bytes(); !bytes.Equal(got, append([]byte("prefix"), want...)) {
+			t.Fatalf("%s: got %q after error, want %q", c.Name(), got, want)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package dnode
+
+import (
+	"testing"
+)
+
+// fuzzArgs is a typed argument the fuzzed messages are unmarshaled to,
+// so callbacks and attachments are set to struct fields, slices and maps.
+type fuzzArgs struct {
+	A string                 `json:"a"`
+	B Function               `json:"b"`
+	C []Function             `json:"c"`
+	D map[string]interface{} `json:"d"`
+	E map[string]Function    `json:"e"`
+	F []byte                 `json:"f"`
+	G *Partial               `json:"g"`
+	H map[int]string         `json:"h"`
+	I []interface{}          `json:"i"`
+	J *fuzzArgs              `json:"j"`
+}
+
+func addMessageSeeds(f *testing.F) {
+	for _, s := range []string{
+		`{"method":"square","arguments":[4],"callbacks":{}}`,
+		`{"method":0,"arguments":[{"a":"x","b":"[Function]"}],"callbacks":{"1":["0","b"]}}`,
+		`{"method":"m","arguments":[{"c":["[Function]"],"d":{"x":"[Function]"}}],"callbacks":{"2":["0","c","0"],"3":["0","d","x"]}}`,
+		`{"method":"m","arguments":[{"f":null}],"callbacks":{},"attachments":[["0","f"]]}`,
+		`{"method":"m","arguments":[{"g":{"x":1}}],"callbacks":{"4":["0","g","x"]}}`,
+		`{"method":"m","callbacks":{"5":[0]}}`,
+		`{"method":"m","arguments":[["[Function]"]],"callbacks":{"6":[0,"9"]}}`,
+		`{"method":"m","arguments":[{"h":{"1":"x"}}],"callbacks":{"7":["0","h","1"]}}`,
+	} {
+		f.Add([]byte(s), false)
+	}
+
+	p, err := MsgPack.Marshal(map[string]interface{}{
+		"method":    "square",
+		"arguments": []interface{}{4},
+		"callbacks": map[string]Path{"0": {0, "b"}},
+	})
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	f.Add(p, true)
+}
+
+// FuzzMessage fuzzes unmarshaling of messages and their arguments
+// with the callbacks and attachments of the messages.
+func FuzzMessage(f *testing.F) {
+	addMessageSeeds(f)
+
+	f.Fuzz(func(t *testing.T, data []byte, msgpack bool) {
+		codec := JSON
+		if msgpack {
+			codec = MsgPack
+		}
+
+		var msg Message
+		if err := codec.Unmarshal(data, &msg); err != nil {
+			return
+		}
+
+		if msg.Arguments != nil {
+			msg.Arguments.Codec = codec
+		}
+
+		sender := func(uint64, []interface{}) error { return nil }
+
+		if err := ParseCallbacks(&msg, sender); err != nil {
+			return
+		}
+
+		frames := make([][]byte, len(msg.Attachments))
+		for i := range frames {
+			frames[i] = []byte("attachment")
+		}
+
+		if err := ParseAttachments(&msg, frames); err != nil {
+			return
+		}
+
+		if msg.Arguments == nil {
+			return
+		}
+
+		var v interface{}
+		msg.Arguments.Unmarshal(&v)
+
+		var args []fuzzArgs
+		msg.Arguments.Unmarshal(&args)
+
+		var partials []*Partial
+		if msg.Arguments.Unmarshal(&partials) == nil {
+			for _, p := range partials {
+				if p == nil {
+					continue
+				}
+
+				var m map[string]interface{}
+				p.Unmarshal(&m)
+
+				var a fuzzArgs
+				p.Unmarshal(&a)
+			}
+		}
+	})
+}
+
+// FuzzUnscrub fuzzes setting the callbacks of the paths
+// received from the remote side.
+func FuzzUnscrub(f *testing.F) {
+	for _, s := range [][2]string{
+		{`{"a":"x","b":"[Function]"}`, `{"1":["b"]}`},
+		{`{"c":["[Function]"]}`, `{"1":["c","0"]}`},
+		{`{"c":[]}`, `{"1":["c","5"]}`},
+		{`{"d":{"x":{"y":1}}}`, `{"1":["d","x","y"]}`},
+		{`{"h":{"1":"x"}}`, `{"1":["h",1]}`},
+		{`{"j":{"a":""}}`, `{"1":["j",""]}`},
+		{`{}`, `{"x":[]}`},
+	} {
+		f.Add([]byte(s[0]), []byte(s[1]))
+	}
+
+	f.Fuzz(func(t *testing.T, args, callbacks []byte) {
+		var a fuzzArgs
+		if err := JSON.Unmarshal(args, &a); err != nil {
+			return
+		}
+
+		var paths map[string]Path
+		if err := JSON.Unmarshal(callbacks, &paths); err != nil {
+			return
+		}
+
+		cb := func(uint64) functionReceived {
+			return func(...interface{}) error { return nil }
+		}
+
+		NewScrubber().Unscrub(&a, paths, cb)
+
+		var v interface{}
+		if err := JSON.Unmarshal(args, &v); err != nil {
+			return
+		}
+
+		NewScrubber().Unscrub(&v, paths, cb)
+	})
+}
@@ -13,4 +13,8 @@ type Message struct {
 
 	// Integer map of callback paths in arguments
 	Callbacks map[string]Path `json:"callbacks"`
+
+	// Paths of attachments in arguments, which are sent
+	// as separate frames following the message.
+	Attachments []Path `json:"attachments,omitempty"`
 }
@@ -9,13 +9,119 @@ import (
 
 // Partial is the type of "arguments" field in dnode.Message.
 type Partial struct {
-	Raw           []byte
-	CallbackSpecs []CallbackSpec
+	Raw             []byte
+	CallbackSpecs   []CallbackSpec
+	AttachmentSpecs []AttachmentSpec
+
+	// Codec the Raw bytes are encoded with. If nil, JSON is used.
+	Codec Codec
+}
+
+// NewPartial gives a Partial holding v encoded with JSON.
+//
+// Callbacks received from the remote side and attachments, that are part
+// of v, are kept in the Partial, so they can be unmarshaled as usual. This
+// includes the ones of Partial values, which are part of v.
+func NewPartial(v interface{}) (*Partial, error) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Partial{
+		Raw:             raw,
+		AttachmentSpecs: CollectAttachments(v),
+	}
+	p.collectCallbacks(reflect.ValueOf(v), make(Path, 0))
+
+	return p, nil
 }
 
-// MarshalJSON returns the raw bytes of the Partial.
+var partialType = reflect.TypeOf((*Partial)(nil))
+
+// collectCallbacks adds callback specs for functions received from the
+// remote side, which are found in rv.
+func (p *Partial) collectCallbacks(rv reflect.Value, path Path) {
+	if !rv.IsValid() || !rv.CanInterface() {
+		return
+	}
+
+	switch rv.Kind() {
+	case reflect.Interface:
+		if !rv.IsNil() {
+			p.collectCallbacks(rv.Elem(), path)
+		}
+	case reflect.Ptr:
+		if rv.IsNil() {
+			return
+		}
+
+		if rv.Type() == partialType {
+			for _, spec := range rv.Interface().(*Partial).CallbackSpecs {
+				p.addCallback(append(path, spec.Path...), spec.Function)
+			}
+			return
+		}
+
+		p.collectCallbacks(rv.Elem(), path)
+	case reflect.Array, reflect.Slice:
+		for i := 0; i < rv.Len(); i++ {
+			p.collectCallbacks(rv.Index(i), append(path, i))
+		}
+	case reflect.Map:
+		for _, key := range rv.MapKeys() {
+			p.collectCallbacks(rv.MapIndex(key), append(path, key.String()))
+		}
+	case reflect.Struct:
+		if rv.Type() == dnodeFunctionType {
+			if fn := rv.Interface().(Function); fn.IsValid() {
+				if _, ok := fn.Caller.(functionReceived); ok {
+					p.addCallback(path, fn)
+				}
+			}
+			return
+		}
+
+		for i := 0; i < rv.NumField(); i++ {
+			sf := rv.Type().Field(i)
+
+			name, ok := fieldName(sf)
+			if !ok {
+				continue
+			}
+
+			if sf.Anonymous {
+				p.collectCallbacks(rv.Field(i), path)
+			} else {
+				p.collectCallbacks(rv.Field(i), append(path, name))
+			}
+		}
+	case reflect.Func:
+		if fn, ok := rv.Interface().(functionReceived); ok && fn != nil {
+			p.addCallback(path, Function{Caller: fn})
+		}
+	}
+}
+
+func (p *Partial) addCallback(path Path, fn Function) {
+	// Make a copy of path because it is reused by the caller.
+	pathCopy := make(Path, len(path))
+	copy(pathCopy, path)
+
+	p.CallbackSpecs = append(p.CallbackSpecs, CallbackSpec{
+		Path:     pathCopy,
+		Function: fn,
+	})
+}
+
+// MarshalJSON returns the raw bytes of the Partial, converting them
+// to JSON if they were encoded with other codec.
 func (p *Partial) MarshalJSON() ([]byte, error) {
-	return p.Raw, nil
+	if isJSON(p.codec()) {
+		return p.Raw, nil
+	}
+
+	return p.transcode(JSON)
 }
 
 // UnmarshalJSON puts the data into Partial.Raw.
@@ -29,25 +135,34 @@ func (p *Partial) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
-// Unmarshal unmarshals the raw data (p.Raw) into v and prepares callbacks.
+// Unmarshal unmarshals the raw data (p.Raw) into v and prepares callbacks
+// and attachments.
 // v must be a struct that is the type of expected arguments.
 func (p *Partial) Unmarshal(v interface{}) error {
 	if p == nil {
 		return fmt.Errorf("Cannot unmarshal nil argument")
 	}
 
-	if err := json.Unmarshal(p.Raw, &v); err != nil {
+	// Decoding null resets v, while attachments are
+	// still set to the value v points to.
+	value := reflect.ValueOf(v)
+
+	if err := p.codec().Unmarshal(p.Raw, &v); err != nil {
 		return fmt.Errorf("%s. Data: %s", err.Error(), string(p.Raw))
 	}
 
-	value := reflect.ValueOf(v)
-
 	for _, spec := range p.CallbackSpecs {
 		if err := setCallback(value, spec.Path, spec.Function.Caller.(functionReceived)); err != nil {
 			return err
 		}
 	}
 
+	for _, spec := range p.AttachmentSpecs {
+		if err := setAttachment(value, spec.Path, spec.Data); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -63,12 +178,15 @@ func (p *Partial) MustUnmarshal(v interface{}) {
 // Slice is a helper method to unmarshal a JSON Array.
 func (p *Partial) Slice() (a []*Partial, err error) {
 	err = p.Unmarshal(&a)
+	for _, elem := range a {
+		p.inheritCodec(elem)
+	}
 	return
 }
 
 // SliceOfLength is a helper method to unmarshal a JSON Array with specified length.
 func (p *Partial) SliceOfLength(length int) (a []*Partial, err error) {
-	err = p.Unmarshal(&a)
+	a, err = p.Slice()
 	if err != nil {
 		return
 	}
@@ -83,9 +201,21 @@ func (p *Partial) SliceOfLength(length int) (a []*Partial, err error) {
 // Map is a helper method to unmarshal to a JSON Object.
 func (p *Partial) Map() (m map[string]*Partial, err error) {
 	err = p.Unmarshal(&m)
+	for _, elem := range m {
+		p.inheritCodec(elem)
+	}
 	return
 }
 
+// inheritCodec makes the partial decoded out of p use the JSON codec
+// of p, e.g. one with a custom encoder. Codecs other than JSON set
+// themselves when decoding partials.
+func (p *Partial) inheritCodec(elem *Partial) {
+	if elem != nil && elem.Codec == nil && p.Codec != nil && isJSON(p.Codec) {
+		elem.Codec = p.Codec
+	}
+}
+
 // String is a helper to unmarshal a JSON String.
 func (p *Partial) String() (s string, err error) {
 	err = p.Unmarshal(&s)
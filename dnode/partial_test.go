@@ -19,3 +19,56 @@ func TestUnmarshalArguments(t *testing.T) {
 		return
 	}
 }
+
+func TestNewPartial(t *testing.T) {
+	var called []interface{}
+
+	received := Function{functionReceived(func(args ...interface{}) error {
+		called = args
+		return nil
+	})}
+
+	type options struct {
+		Name     string   `json:"name"`
+		Callback Function `json:"callback"`
+	}
+
+	p, err := NewPartial([]interface{}{&options{Name: "test", Callback: received}, "extra"})
+	if err != nil {
+		t.Fatalf("NewPartial()=%s", err)
+	}
+
+	args := p.MustSliceOfLength(2)
+
+	var opts options
+	args[0].MustUnmarshal(&opts)
+
+	if opts.Name != "test" {
+		t.Fatalf("got %q, want %q", opts.Name, "test")
+	}
+
+	if err := opts.Callback.Call("ok"); err != nil {
+		t.Fatalf("Call()=%s", err)
+	}
+
+	if len(called) != 1 || called[0] != "ok" {
+		t.Fatalf("got %v, want [ok]", called)
+	}
+
+	if s := args[1].MustString(); s != "extra" {
+		t.Fatalf("got %q, want %q", s, "extra")
+	}
+
+	// Callbacks of partials are kept when they are rewrapped.
+	p, err = NewPartial([]interface{}{args[0]})
+	if err != nil {
+		t.Fatalf("NewPartial()=%s", err)
+	}
+
+	opts = options{}
+	p.One().MustUnmarshal(&opts)
+
+	if !opts.Callback.IsValid() {
+		t.Fatal("callback of rewrapped partial is lost")
+	}
+}
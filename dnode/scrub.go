@@ -4,6 +4,7 @@ import (
 	"reflect"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 )
 
@@ -21,10 +22,22 @@ func (s *Scrubber) Scrub(obj interface{}) (callbacks map[string]Path) {
 		return nil
 	}
 
-	s.collect(rv, make(Path, 0), callbacks)
+	path := pathPool.Get().(*Path)
+	s.collect(rv, (*path)[:0], callbacks)
+	pathPool.Put(path)
+
 	return callbacks
 }
 
+// pathPool reuses the paths used while walking over the scrubbed
+// objects, they are copied when a callback is found.
+var pathPool = sync.Pool{
+	New: func() interface{} {
+		path := make(Path, 0, 8)
+		return &path
+	},
+}
+
 var dnodeFunctionType = reflect.TypeOf(new(Function)).Elem()
 
 func (s *Scrubber) collect(rv reflect.Value, path Path, callbacks map[string]Path) {
@@ -56,7 +69,13 @@ func (s *Scrubber) collect(rv reflect.Value, path Path, callbacks map[string]Pat
 		// register callback functions wrapper.
 		if rv.Type() == dnodeFunctionType {
 			if cb := rv.Interface().(Function); cb.Caller != nil {
-				s.register(cb.Caller.(callback), path, callbacks)
+				if scoped, ok := cb.Caller.(scopedCallback); ok {
+					if id, ok := s.register(scoped.fn, path, callbacks); ok {
+						s.expire(id, scoped)
+					}
+				} else {
+					s.register(cb.Caller.(callback), path, callbacks)
+				}
 			}
 			return
 		}
@@ -71,29 +90,12 @@ func (s *Scrubber) collect(rv reflect.Value, path Path, callbacks map[string]Pat
 func (s *Scrubber) fields(rv reflect.Value, path Path, callbacks map[string]Path) {
 	for i := 0; i < rv.NumField(); i++ {
 		sf := rv.Type().Field(i)
-		if sf.PkgPath != "" && !sf.Anonymous { // unexported.
-			continue
-		}
 
-		// dnode uses JSON package tags for field naming so we need to
-		// discard their comma-separated options.
-		tag := sf.Tag.Get("json")
-		if idx := strings.Index(tag, ","); idx != -1 {
-			tag = tag[:idx]
-		}
-		if tag == "-" {
-			continue
-		}
-		// do not collect callbacks for "-" tagged fields.
-		if skip := sf.Tag.Get("dnode"); skip == "-" {
+		name, ok := fieldName(sf)
+		if !ok {
 			continue
 		}
 
-		var name = tag
-		if name == "" {
-			name = sf.Name
-		}
-
 		if sf.Anonymous {
 			s.collect(rv.Field(i), path, callbacks)
 		} else {
@@ -102,6 +104,34 @@ func (s *Scrubber) fields(rv reflect.Value, path Path, callbacks map[string]Path
 	}
 }
 
+// fieldName gives the name of the struct field in dnode arguments.
+// It returns false for fields which do not hold callbacks.
+func fieldName(sf reflect.StructField) (string, bool) {
+	if sf.PkgPath != "" && !sf.Anonymous { // unexported.
+		return "", false
+	}
+
+	// dnode uses JSON package tags for field naming so we need to
+	// discard their comma-separated options.
+	tag := sf.Tag.Get("json")
+	if idx := strings.Index(tag, ","); idx != -1 {
+		tag = tag[:idx]
+	}
+	if tag == "-" {
+		return "", false
+	}
+	// do not collect callbacks for "-" tagged fields.
+	if skip := sf.Tag.Get("dnode"); skip == "-" {
+		return "", false
+	}
+
+	if tag == "" {
+		return sf.Name, true
+	}
+
+	return tag, true
+}
+
 // methods walks over a structure and scrubs its exported methods.
 func (s *Scrubber) methods(rv reflect.Value, path Path, callbacks map[string]Path) {
 	for i := 0; i < rv.NumMethod(); i++ {
@@ -120,10 +150,10 @@ func (s *Scrubber) methods(rv reflect.Value, path Path, callbacks map[string]Pat
 
 // register is called when a function/method is found in arguments array. It
 // assigns an unique ID to the passed callback and stores it internally.
-func (s *Scrubber) register(cb func(*Partial), path Path, callbacks map[string]Path) {
+func (s *Scrubber) register(cb func(*Partial), path Path, callbacks map[string]Path) (uint64, bool) {
 	// do not register nil callbacks.
 	if cb == nil {
-		return
+		return 0, false
 	}
 	// subtract one to start counting from zero. This is not absolutely
 	// necessary, just cosmetics.
@@ -140,4 +170,6 @@ func (s *Scrubber) register(cb func(*Partial), path Path, callbacks map[string]P
 	pathCopy := make(Path, len(path))
 	copy(pathCopy, path)
 	callbacks[seq] = pathCopy
+
+	return next, true
 }
@@ -1,6 +1,9 @@
 package dnode
 
-import "sync"
+import (
+	"sync"
+	"time"
+)
 
 type Scrubber struct {
 	// Next callback number.
@@ -10,12 +13,17 @@ type Scrubber struct {
 	// Reference to sent callbacks are saved in this map.
 	sync.Mutex // protects
 	callbacks  map[uint64]func(*Partial)
+
+	// Callbacks with limited lifetime have their expiry
+	// stopped when they are removed.
+	stops map[uint64]func()
 }
 
 // New returns a pointer to a new Scrubber.
 func NewScrubber() *Scrubber {
 	return &Scrubber{
 		callbacks: make(map[uint64]func(*Partial)),
+		stops:     make(map[uint64]func()),
 	}
 }
 
@@ -23,8 +31,72 @@ func NewScrubber() *Scrubber {
 // Can be used to remove unused callbacks to free memory.
 func (s *Scrubber) RemoveCallback(id uint64) {
 	s.Lock()
+	stop := s.stops[id]
 	delete(s.callbacks, id)
+	delete(s.stops, id)
+	s.Unlock()
+
+	if stop != nil {
+		stop()
+	}
+}
+
+// RemoveAll removes all the callbacks. It is used when the remote side
+// goes away, as it is not able to call any of the callbacks anymore.
+func (s *Scrubber) RemoveAll() {
+	s.Lock()
+	stops := s.stops
+	s.callbacks = make(map[uint64]func(*Partial))
+	s.stops = make(map[uint64]func())
+	s.Unlock()
+
+	for _, stop := range stops {
+		stop()
+	}
+}
+
+// Len gives the number of callbacks saved in the scrubber.
+func (s *Scrubber) Len() int {
+	s.Lock()
+	defer s.Unlock()
+
+	return len(s.callbacks)
+}
+
+// expire removes the callback with id when its lifetime ends.
+func (s *Scrubber) expire(id uint64, cb scopedCallback) {
+	var stop func()
+
+	switch {
+	case cb.ctx != nil:
+		done := make(chan struct{})
+		stop = func() { close(done) }
+
+		go func() {
+			select {
+			case <-cb.ctx.Done():
+				s.RemoveCallback(id)
+			case <-done:
+			}
+		}()
+	case cb.ttl > 0:
+		t := time.AfterFunc(cb.ttl, func() { s.RemoveCallback(id) })
+		stop = func() { t.Stop() }
+	default:
+		return
+	}
+
+	s.Lock()
+	_, ok := s.callbacks[id]
+	if ok {
+		s.stops[id] = stop
+	}
 	s.Unlock()
+
+	// The callback was removed in the meantime.
+	if !ok {
+		stop()
+	}
 }
 
 func (s *Scrubber) GetCallback(id uint64) func(*Partial) {
@@ -1,6 +1,10 @@
 package dnode
 
-import "testing"
+import (
+	"context"
+	"testing"
+	"time"
+)
 
 func TestScrubUnscrub(t *testing.T) {
 	scrubber := NewScrubber()
@@ -48,3 +52,57 @@ func TestScrubUnscrub(t *testing.T) {
 		t.Error("callback is not called")
 	}
 }
+
+func TestScrubberCallbackLifetime(t *testing.T) {
+	scrubber := NewScrubber()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fn := func(*Partial) {}
+
+	args := []interface{}{
+		Callback(fn),
+		CallbackWithTTL(fn, 50*time.Millisecond),
+		CallbackWithContext(ctx, fn),
+	}
+
+	if callbacks := scrubber.Scrub(args); len(callbacks) != 3 {
+		t.Fatalf("got %d callbacks, want 3", len(callbacks))
+	}
+
+	wait := func(n int) {
+		t.Helper()
+
+		timeout := time.After(4 * time.Second)
+		for scrubber.Len() != n {
+			select {
+			case <-timeout:
+				t.Fatalf("got %d callbacks, want %d", scrubber.Len(), n)
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}
+
+	// The callback with ttl expires.
+	wait(2)
+
+	if scrubber.GetCallback(1) != nil {
+		t.Fatal("callback with ttl was not removed")
+	}
+
+	// The callback tied to the context is removed when it is canceled.
+	cancel()
+	wait(1)
+
+	if scrubber.GetCallback(0) == nil {
+		t.Fatal("callback without lifetime was removed")
+	}
+
+	scrubber.Scrub([]interface{}{CallbackWithTTL(fn, time.Hour)})
+	scrubber.RemoveAll()
+
+	if n := scrubber.Len(); n != 0 {
+		t.Fatalf("got %d callbacks, want 0", n)
+	}
+}
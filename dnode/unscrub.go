@@ -37,19 +37,13 @@ func setCallback(value reflect.Value, path Path, cb functionReceived) error {
 				return fmt.Errorf("callback path too short: %v", path)
 			}
 
-			// Path component may be a string or an integer.
-			var index int
-			var err error
-			switch v := path[i].(type) {
-			case string:
-				index, err = strconv.Atoi(v)
-				if err != nil {
-					return fmt.Errorf("integer expected in callback path, got '%v'.", path[i])
-				}
-			case float64:
-				index = int(v)
-			default:
-				panic(fmt.Errorf("unknown type: %#v", path[i]))
+			index, err := pathIndex(path[i])
+			if err != nil {
+				return err
+			}
+
+			if index < 0 || index >= value.Len() {
+				return fmt.Errorf("callback path out of range: %v", path)
 			}
 
 			value = value.Index(index)
@@ -58,40 +52,70 @@ func setCallback(value reflect.Value, path Path, cb functionReceived) error {
 			if i == len(path) {
 				return fmt.Errorf("callback path too short: %v", path)
 			}
-			if i == len(path)-1 && value.Type().Elem().Kind() == reflect.Interface {
-				value.SetMapIndex(reflect.ValueOf(path[i]), reflect.ValueOf(cb))
-				return nil
+
+			key, err := mapKey(value, path[i])
+			if err != nil {
+				return err
+			}
+
+			if i == len(path)-1 && !value.IsNil() {
+				switch elem := value.Type().Elem(); {
+				case elem.Kind() == reflect.Interface:
+					value.SetMapIndex(key, reflect.ValueOf(cb))
+					return nil
+				case elem == dnodeFunctionType:
+					value.SetMapIndex(key, reflect.ValueOf(Function{cb}))
+					return nil
+				}
 			}
-			value = value.MapIndex(reflect.ValueOf(path[i]))
+
+			value = value.MapIndex(key)
 			i++
 		case reflect.Ptr:
 			value = value.Elem()
 		case reflect.Interface:
 			if i == len(path) {
+				if !value.CanSet() {
+					return fmt.Errorf("cannot set callback at path: %v", path)
+				}
+
 				value.Set(reflect.ValueOf(cb))
 				return nil
 			}
 			value = value.Elem()
 		case reflect.Struct:
-			if value.Type() == reflect.TypeOf(Function{}) {
+			if value.Type() == dnodeFunctionType {
 				caller := value.FieldByName("Caller")
+				if !caller.CanSet() {
+					return fmt.Errorf("cannot set callback at path: %v", path)
+				}
+
 				caller.Set(reflect.ValueOf(cb))
 				return nil
 			}
 
-			if innerPartial, ok := value.Addr().Interface().(*Partial); ok {
-				spec := CallbackSpec{path[i:], Function{cb}}
-				innerPartial.CallbackSpecs = append(innerPartial.CallbackSpecs, spec)
-				return nil
+			if value.CanAddr() {
+				if innerPartial, ok := value.Addr().Interface().(*Partial); ok {
+					spec := CallbackSpec{path[i:], Function{cb}}
+					innerPartial.CallbackSpecs = append(innerPartial.CallbackSpecs, spec)
+					return nil
+				}
+			}
+
+			if i == len(path) {
+				return fmt.Errorf("callback path too short: %v", path)
 			}
 
 			// Path component may be a string or an integer.
 			name, ok := path[i].(string)
-			if !ok {
+			if !ok || name == "" {
 				return fmt.Errorf("Invalid path: %#v", path[i])
 			}
 
 			value = value.FieldByName(strings.ToUpper(name[0:1]) + name[1:])
+			if value.IsValid() && !value.CanInterface() {
+				return fmt.Errorf("Invalid path: %#v", name)
+			}
 			i++
 		case reflect.Func:
 			// plain func is not supported, use Function type
@@ -104,3 +128,40 @@ func setCallback(value reflect.Value, path Path, cb functionReceived) error {
 		}
 	}
 }
+
+// pathIndex gives the index of a slice element in a callback path.
+func pathIndex(v interface{}) (int, error) {
+	// Path component may be a string or an integer.
+	switch v := v.(type) {
+	case string:
+		index, err := strconv.Atoi(v)
+		if err != nil {
+			return 0, fmt.Errorf("integer expected in callback path, got '%v'.", v)
+		}
+		return index, nil
+	case float64:
+		return int(v), nil
+	}
+
+	// Codecs other than JSON decode numbers as integers.
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return int(rv.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int(rv.Uint()), nil
+	default:
+		return 0, fmt.Errorf("integer expected in callback path, got '%v'.", v)
+	}
+}
+
+// mapKey gives the key of the map value given by the path component.
+func mapKey(m reflect.Value, v interface{}) (reflect.Value, error) {
+	key := reflect.ValueOf(v)
+
+	if !key.IsValid() || !key.Type().AssignableTo(m.Type().Key()) {
+		return reflect.Value{}, fmt.Errorf("invalid map key in path: %#v", v)
+	}
+
+	return key, nil
+}
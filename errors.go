@@ -1,6 +1,7 @@
 package kite
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 
@@ -11,12 +12,127 @@ import (
 // should not be trusted.
 var ErrKeyNotTrusted = errors.New("kontrol key is not trusted")
 
+// ErrTimeout is returned to the caller when a method did not finish
+// within the limit set with (*Method).Timeout. The handler may still
+// be running, see Timeout.
+var ErrTimeout = &Error{
+	Type:    "timeout",
+	Message: "Method execution has timed out",
+	CodeVal: "kite.methodTimeout",
+}
+
+// ErrDeadlineExceeded is returned to the caller when a method call is
+// received after the deadline set by the caller with TellWithTimeout
+// or TellWithContext, in which case the method is not executed.
+//
+// It has the same type as ErrTimeout, but a different code, so both
+// match &Error{Type: "timeout"} with errors.Is, but not each other.
+var ErrDeadlineExceeded = &Error{
+	Type:    "timeout",
+	Message: "Deadline of the call has been exceeded",
+	CodeVal: "kite.deadlineExceeded",
+}
+
+// ErrShuttingDown is returned to the caller when a method call is
+// received while the kite is being shut down with (*Kite).Shutdown.
+var ErrShuttingDown = &Error{
+	Type:      "shutdownError",
+	Message:   "Kite is shutting down",
+	Retryable: true,
+}
+
+// ErrOverloaded is returned to the caller when a method call exceeds
+// the limit set with (*Method).MaxConcurrent.
+var ErrOverloaded = &Error{
+	Type:      "overloaded",
+	Message:   "The maximum number of concurrent calls is exceeded.",
+	Retryable: true,
+}
+
+// The errors below are returned to the callers of methods. They are meant
+// to be matched with errors.Is, as the returned errors differ in messages
+// and request IDs, e.g.:
+//
+//	if errors.Is(err, kite.ErrMethodNotFound) {
+//		...
+//	}
+var (
+	// ErrMethodNotFound is returned when the called method is not handled.
+	ErrMethodNotFound = &Error{Type: "methodNotFound", Message: "Method is not found"}
+
+	// ErrAuthentication is returned when the caller failed to authenticate.
+	ErrAuthentication = &Error{Type: "authenticationError", Message: "Authentication failed"}
+
+	// ErrForbidden is returned when the caller was not granted a scope
+	// required by the method, see (*Method).RequireScope.
+	ErrForbidden = &Error{Type: "forbidden", Message: "Method is forbidden"}
+
+	// ErrArgument is returned when the arguments of a method call
+	// cannot be unmarshaled.
+	ErrArgument = &Error{Type: "argumentError", Message: "Invalid arguments"}
+
+	// ErrValidation is returned when the arguments of a method call
+	// failed validation, see Validate.
+	ErrValidation = &Error{Type: "validationError", Message: "Invalid arguments"}
+
+	// ErrRequestLimit is returned when a method call exceeds the rate
+	// limit of the method, see (*Method).Throttle.
+	ErrRequestLimit = &Error{Type: "requestLimitError", Message: "The maximum request rate is exceeded.", Retryable: true}
+
+	// ErrPanic is returned when the method handler panicked.
+	ErrPanic = &Error{Type: "panicError", Message: "Method panicked"}
+
+	// ErrDisconnect is returned when the remote kite disconnected
+	// before responding to the call.
+	ErrDisconnect = &Error{Type: "disconnect", Message: "Remote kite has disconnected"}
+
+	// ErrSend is returned when the call could not be sent
+	// to the remote kite.
+	ErrSend = &Error{Type: "sendError", Message: "Sending the call failed", Retryable: true}
+)
+
+// MessageTooLargeError is returned when a message received from the remote
+// kite exceeds Config.MaxRequestSize or Config.MaxResponseSize, in which
+// case the session is closed.
+type MessageTooLargeError struct {
+	Limit int64
+}
+
+func (e *MessageTooLargeError) Error() string {
+	return fmt.Sprintf("message exceeds the size limit of %d bytes", e.Limit)
+}
+
 // Error is the type of the kite related errors returned from kite package.
+//
+// An error matches another *Error with errors.Is when both have the same
+// type and, if the other one has a code, the same code. Thanks to that
+// errors.Is(err, kite.ErrOverloaded) holds also for the errors received
+// from remote kites, which are decoded into new values.
+//
+// The causes of the errors are sent to the remote kites along with them,
+// so errors.Is and errors.As see the whole chain on both sides.
 type Error struct {
 	Type      string `json:"type"`
 	Message   string `json:"message"`
-	CodeVal   string `json:"code"`
+	CodeVal   string `json:"code"` // application defined, e.g. "user.notFound"
 	RequestID string `json:"id"`
+
+	// Fields are the invalid fields of the arguments
+	// of a "validationError", see Validate.
+	Fields []FieldError `json:"fields,omitempty"`
+
+	// Retryable is true if the call failed without being executed,
+	// so it can be made again, see IsRetryable.
+	Retryable bool `json:"retryable,omitempty"`
+
+	// Details are arbitrary values describing the error, they are sent
+	// to the remote kite with the error, see UnmarshalDetails.
+	Details interface{} `json:"details,omitempty"`
+
+	// Cause is the error, which caused this one, see Wrap.
+	Cause *Error `json:"cause,omitempty"`
+
+	err error // wrapped local error, not sent to the remote kite
 }
 
 func (e Error) Code() string {
@@ -37,6 +153,109 @@ func (e Error) Error() string {
 	return s
 }
 
+// Unwrap gives the wrapped error, the local one for errors created by
+// the kite, Cause for the errors received from the remote kite.
+func (e Error) Unwrap() error {
+	if e.err != nil {
+		return e.err
+	}
+
+	if e.Cause != nil {
+		return e.Cause
+	}
+
+	return nil
+}
+
+// Is tells whether the error matches the target, see Error.
+func (e Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	if !ok || t == nil {
+		return false
+	}
+
+	if t.Type != "" && t.Type != e.Type {
+		return false
+	}
+
+	if t.CodeVal != "" && t.CodeVal != e.CodeVal {
+		return false
+	}
+
+	return t.Type != "" || t.CodeVal != ""
+}
+
+// Wrap gives a copy of the error, which wraps the cause. The message
+// of the cause is appended to the message of the copy, e.g.:
+//
+//	if err := db.Ping(); err != nil {
+//		return nil, kite.ErrOverloaded.Wrap(err)
+//	}
+func (e *Error) Wrap(cause error) *Error {
+	err := *e
+
+	if cause != nil {
+		if err.Message != "" {
+			err.Message += ": " + cause.Error()
+		} else {
+			err.Message = cause.Error()
+		}
+
+		err.Cause = toError(cause)
+		err.err = cause
+	}
+
+	return &err
+}
+
+// WithDetails gives a copy of the error with the details.
+func (e *Error) WithDetails(details interface{}) *Error {
+	err := *e
+	err.Details = details
+	return &err
+}
+
+// UnmarshalDetails unmarshals the details of the error into v. It is
+// meant for errors received from the remote kite, which details are
+// decoded as generic maps and slices.
+func (e *Error) UnmarshalDetails(v interface{}) error {
+	if e.Details == nil {
+		return errors.New("kite: error has no details")
+	}
+
+	p, err := json.Marshal(e.Details)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(p, v)
+}
+
+// IsRetryable tells whether the err, or an error it wraps, is an *Error,
+// which is retryable.
+func IsRetryable(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Retryable
+}
+
+// toError converts the error, and the errors it wraps, to *Error
+// so that they can be sent to the remote kite.
+func toError(err error) *Error {
+	switch e := err.(type) {
+	case nil:
+		return nil
+	case *Error:
+		return e
+	default:
+		return &Error{
+			Type:    "genericError",
+			Message: err.Error(),
+			Cause:   toError(errors.Unwrap(err)),
+			err:     err,
+		}
+	}
+}
+
 // createError creates a new kite.Error for the given r variable
 func createError(req *Request, r interface{}) *Error {
 	if r == nil {
@@ -52,6 +271,8 @@ func createError(req *Request, r interface{}) *Error {
 			Type:    "argumentError",
 			Message: err.Error(),
 		}
+	case error:
+		kiteErr = toError(err)
 	default:
 		kiteErr = &Error{
 			Type:    "genericError",
@@ -59,8 +280,12 @@ func createError(req *Request, r interface{}) *Error {
 		}
 	}
 
+	// The error may be a shared one, e.g. ErrValidation,
+	// so the request ID is set on its copy.
 	if kiteErr.RequestID == "" && req != nil {
-		kiteErr.RequestID = req.ID
+		err := *kiteErr
+		err.RequestID = req.ID
+		kiteErr = &err
 	}
 
 	return kiteErr
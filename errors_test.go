@@ -0,0 +1,115 @@
+package kite
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestError_Is(t *testing.T) {
+	notFound := &Error{Type: "notFound", CodeVal: "user.notFound"}
+
+	cases := []struct {
+		name   string
+		err    error
+		target error
+		want   bool
+	}{
+		{"same type", &Error{Type: "overloaded", Message: "busy", RequestID: "1"}, ErrOverloaded, true},
+		{"other type", &Error{Type: "timeout"}, ErrOverloaded, false},
+		{"same code", &Error{Type: "notFound", CodeVal: "user.notFound"}, notFound, true},
+		{"other code", &Error{Type: "notFound", CodeVal: "group.notFound"}, notFound, false},
+		{"code only", &Error{Type: "notFound", CodeVal: "user.notFound"}, &Error{CodeVal: "user.notFound"}, true},
+		{"empty target", &Error{Type: "notFound"}, &Error{}, false},
+		{"wrapped", fmt.Errorf("loading: %w", &Error{Type: "notFound"}), &Error{Type: "notFound"}, true},
+		{"cause", &Error{Type: "genericError", Cause: &Error{Type: "overloaded"}}, ErrOverloaded, true},
+		{"local cause", ErrShuttingDown.Wrap(io.EOF), io.EOF, true},
+		{"not kite error", errors.New("overloaded"), ErrOverloaded, false},
+		{"timeout code", &Error{Type: "timeout", CodeVal: "kite.deadlineExceeded"}, ErrTimeout, false},
+		{"timeout type", ErrDeadlineExceeded, &Error{Type: "timeout"}, true},
+	}
+
+	for _, cas := range cases {
+		t.Run(cas.name, func(t *testing.T) {
+			if got := errors.Is(cas.err, cas.target); got != cas.want {
+				t.Fatalf("got %t, want %t", got, cas.want)
+			}
+		})
+	}
+}
+
+func TestError_Wrap(t *testing.T) {
+	cause := fmt.Errorf("reading config: %w", io.ErrUnexpectedEOF)
+
+	err := ErrOverloaded.Wrap(cause).WithDetails(map[string]int{"queued": 10})
+
+	if err == ErrOverloaded || ErrOverloaded.Cause != nil || ErrOverloaded.Details != nil {
+		t.Fatal("Wrap modified the original error")
+	}
+
+	if want := ErrOverloaded.Message + ": reading config: unexpected EOF"; err.Message != want {
+		t.Fatalf("got %q, want %q", err.Message, want)
+	}
+
+	p, e := json.Marshal(err)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	var got Error
+	if e := json.Unmarshal(p, &got); e != nil {
+		t.Fatal(e)
+	}
+
+	if !got.Retryable || !IsRetryable(fmt.Errorf("calling: %w", &got)) {
+		t.Error("want error to be retryable")
+	}
+
+	if !errors.Is(&got, ErrOverloaded) {
+		t.Error("want error to be ErrOverloaded")
+	}
+
+	if !errors.Is(&got, &Error{Type: "genericError"}) {
+		t.Error("want error to wrap the cause")
+	}
+
+	var causes []string
+	for c := got.Cause; c != nil; c = c.Cause {
+		causes = append(causes, c.Message)
+	}
+
+	if want := []string{"reading config: unexpected EOF", "unexpected EOF"}; !reflect.DeepEqual(causes, want) {
+		t.Errorf("got %q, want %q", causes, want)
+	}
+
+	var details struct {
+		Queued int `json:"queued"`
+	}
+
+	if e := got.UnmarshalDetails(&details); e != nil {
+		t.Fatal(e)
+	}
+
+	if details.Queued != 10 {
+		t.Errorf("got %d, want 10", details.Queued)
+	}
+
+	if IsRetryable(ErrTimeout) || IsRetryable(io.EOF) {
+		t.Error("want error not to be retryable")
+	}
+}
+
+func TestCreateError_RequestID(t *testing.T) {
+	err := createError(&Request{ID: "1"}, ErrValidation)
+
+	if err == ErrValidation || ErrValidation.RequestID != "" {
+		t.Fatal("createError modified the shared error")
+	}
+
+	if err.RequestID != "1" || !errors.Is(err, ErrValidation) {
+		t.Fatalf("got %+v", err)
+	}
+}
@@ -1,7 +1,3 @@
-// TODO: Watcher was disabled by e8ad10d.
-
-// +build ignore
-
 package main
 
 import (
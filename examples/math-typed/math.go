@@ -0,0 +1,11 @@
+// Package mathtyped is an example of a kite with a typed client
+// and server interface generated by kitegen from math.json.
+package mathtyped
+
+//go:generate kitegen -o math_kite.go math.json
+
+// DivideArgs are the arguments of the divide method.
+type DivideArgs struct {
+	Dividend float64 `json:"dividend"`
+	Divisor  float64 `json:"divisor"`
+}
@@ -0,0 +1,93 @@
+// Code generated by kitegen. DO NOT EDIT.
+
+package mathtyped
+
+import (
+	"context"
+
+	"github.com/koding/kite"
+)
+
+// MathServer is the interface of the server of the math kite.
+type MathServer interface {
+	Square(ctx context.Context, args float64) (float64, error)
+	// Divide divides the dividend by the divisor.
+	Divide(ctx context.Context, args DivideArgs) (float64, error)
+	MathVersion(ctx context.Context) (string, error)
+}
+
+// RegisterMathServer registers the methods of srv with the kite.
+// The returned methods are keyed by name, so they can be configured
+// further, e.g. throttled.
+func RegisterMathServer(k *kite.Kite, srv MathServer) map[string]*kite.Method {
+	return map[string]*kite.Method{
+		"square":       k.HandleTyped("square", srv.Square),
+		"divide":       k.HandleTyped("divide", srv.Divide),
+		"math.version": k.HandleTyped("math.version", srv.MathVersion),
+	}
+}
+
+// MathClient calls the methods of the math kite with the client.
+type MathClient struct {
+	Client *kite.Client
+}
+
+// NewMathClient gives a client of the math kite, which calls
+// its methods with c.
+func NewMathClient(c *kite.Client) *MathClient {
+	return &MathClient{Client: c}
+}
+
+// Square calls the square method.
+func (c *MathClient) Square(ctx context.Context, args float64) (float64, error) {
+	var result float64
+
+	res, err := c.Client.TellWithContext(ctx, "square", args)
+	if err != nil {
+		return result, err
+	}
+
+	if res != nil {
+		if err := res.Unmarshal(&result); err != nil {
+			return result, err
+		}
+	}
+
+	return result, nil
+}
+
+// Divide divides the dividend by the divisor.
+func (c *MathClient) Divide(ctx context.Context, args DivideArgs) (float64, error) {
+	var result float64
+
+	res, err := c.Client.TellWithContext(ctx, "divide", args)
+	if err != nil {
+		return result, err
+	}
+
+	if res != nil {
+		if err := res.Unmarshal(&result); err != nil {
+			return result, err
+		}
+	}
+
+	return result, nil
+}
+
+// MathVersion calls the math.version method.
+func (c *MathClient) MathVersion(ctx context.Context) (string, error) {
+	var result string
+
+	res, err := c.Client.TellWithContext(ctx, "math.version")
+	if err != nil {
+		return result, err
+	}
+
+	if res != nil {
+		if err := res.Unmarshal(&result); err != nil {
+			return result, err
+		}
+	}
+
+	return result, nil
+}
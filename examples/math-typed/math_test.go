@@ -0,0 +1,74 @@
+package mathtyped
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/koding/kite"
+	"github.com/koding/kite/config"
+	"github.com/koding/kite/testkeys"
+	"github.com/koding/kite/testutil"
+)
+
+type mathServer struct{}
+
+func (mathServer) Square(ctx context.Context, args float64) (float64, error) {
+	return args * args, nil
+}
+
+func (mathServer) Divide(ctx context.Context, args DivideArgs) (float64, error) {
+	if args.Divisor == 0 {
+		return 0, errors.New("division by zero")
+	}
+
+	return args.Dividend / args.Divisor, nil
+}
+
+func (mathServer) MathVersion(ctx context.Context) (string, error) {
+	return "1.0.0", nil
+}
+
+func TestMathClient(t *testing.T) {
+	conf := config.New()
+	conf.KiteKey = testutil.NewKiteKey().Raw
+	conf.KontrolUser = "testuser"
+	conf.KontrolKey = testkeys.Public
+
+	k := kite.NewWithConfig("math", "1.0.0", conf)
+	RegisterMathServer(k, mathServer{})
+
+	go k.Run()
+	<-k.ServerReadyNotify()
+	defer k.Close()
+
+	c := kite.New("exp", "1.0.0").NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", k.Port()))
+	c.Auth = &kite.Auth{Type: "kiteKey", Key: conf.KiteKey}
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	math := NewMathClient(c)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 4*time.Second)
+	defer cancel()
+
+	if n, err := math.Square(ctx, 4); err != nil || n != 16 {
+		t.Fatalf("Square(4)=%v, %v", n, err)
+	}
+
+	if n, err := math.Divide(ctx, DivideArgs{Dividend: 10, Divisor: 4}); err != nil || n != 2.5 {
+		t.Fatalf("Divide(10, 4)=%v, %v", n, err)
+	}
+
+	if _, err := math.Divide(ctx, DivideArgs{Dividend: 10}); err == nil {
+		t.Fatal("expected division by zero to fail")
+	}
+
+	if v, err := math.MathVersion(ctx); err != nil || v != "1.0.0" {
+		t.Fatalf("MathVersion()=%q, %v", v, err)
+	}
+}
@@ -0,0 +1,66 @@
+package kite
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/koding/kite/dnode"
+)
+
+func FuzzDecodeFrame(f *testing.F) {
+	msg := []byte(`{"method":"square","arguments":[{"kite":{},"withArgs":[4]}],"callbacks":{"1":["0","responseCallback"]}}`)
+
+	f.Add(msg)
+	f.Add([]byte("  \n[1,2]"))
+	f.Add([]byte(""))
+	f.Add([]byte("json:"))
+	f.Add([]byte("msgpack+zstd:"))
+	f.Add([]byte("unknown:AAAA"))
+
+	for _, z := range []compressor{nil, getCompressor("deflate"), getCompressor("zstd")} {
+		for _, c := range []dnode.Codec{dnode.JSON, dnode.MsgPack} {
+			var m dnode.Message
+			if err := dnode.JSON.Unmarshal(msg, &m); err != nil {
+				f.Fatal(err)
+			}
+
+			p, err := c.Marshal(&m)
+			if err != nil {
+				f.Fatal(err)
+			}
+
+			if z != nil {
+				if p, err = z.Compress(p, 0); err != nil {
+					f.Fatal(err)
+				}
+			}
+
+			var buf bytes.Buffer
+			encodeFrame(&buf, c, z, p)
+			f.Add(buf.Bytes())
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, frame []byte) {
+		const maxSize = 1 << 20
+
+		for _, compression := range []string{"deflate", "zstd"} {
+			c, msg, err := decodeFrame(frame, compression, maxSize)
+			if err != nil {
+				continue
+			}
+
+			// Only decompressed messages may be longer than the frame.
+			if int64(len(msg)) > maxSize && len(msg) > len(frame) {
+				t.Fatalf("decoded %d bytes, limit is %d", len(msg), maxSize)
+			}
+
+			var m dnode.Message
+			if err := c.Unmarshal(msg, &m); err != nil {
+				continue
+			}
+
+			dnode.ParseCallbacks(&m, nil)
+		}
+	})
+}
@@ -0,0 +1,186 @@
+// Package gateway exposes methods of a kite over plain HTTP, so they can
+// be called by clients that do not speak the kite protocol.
+//
+// A method is called with:
+//
+//	POST /methods/{name}
+//	Authorization: <auth type> <auth key>
+//
+//	<JSON encoded argument>
+//
+// The request body, if not empty, is passed to the method as its only
+// argument. Bearer authorization is passed as "token" authentication.
+// The optional X-Request-Id header sets the ID of the request.
+// The response body is a JSON encoded kite.Response, unless the method
+// returns an io.Reader, which is then copied to the response body.
+//
+// Calls go through the same authentication, scope checks, throttling
+// and handlers as the ones made by remote kites.
+//
+// The methods are described with an OpenAPI document, which is served
+// with HandleOpenAPI, so clients can be generated from it.
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+
+	"github.com/koding/kite"
+	"github.com/koding/kite/dnode"
+)
+
+// DefaultMaxBodySize is the default limit of the request body size.
+const DefaultMaxBodySize = 10 << 20
+
+var (
+	errBodyTooLarge = errors.New("request body is too large")
+	errInvalidJSON  = errors.New("request body is not valid JSON")
+)
+
+// Gateway is a http.Handler that calls methods of the kite.
+type Gateway struct {
+	Kite *kite.Kite
+
+	// MaxBodySize limits the size of the request body.
+	// If zero, DefaultMaxBodySize is used.
+	MaxBodySize int64
+}
+
+// New gives a new gateway for the methods of the kite.
+func New(k *kite.Kite) *Gateway {
+	return &Gateway{
+		Kite: k,
+	}
+}
+
+// Handle registers a new gateway for the methods of the kite
+// under the /methods/{name} path of the kite's HTTP server.
+func Handle(k *kite.Kite) {
+	k.HandleHTTP("/methods/{name}", New(k))
+}
+
+// ServeHTTP calls the method named by the last element of the request path.
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeError(w, http.StatusMethodNotAllowed, &kite.Error{
+			Type:    "methodNotAllowed",
+			Message: "only POST requests are allowed",
+		})
+		return
+	}
+
+	args, err := g.readArgs(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, &kite.Error{
+			Type:    "argumentError",
+			Message: err.Error(),
+		})
+		return
+	}
+
+	call := &kite.Call{
+		Method:  path.Base(r.URL.Path),
+		Args:    args,
+		Auth:    kite.AuthFromRequest(r),
+		Request: r,
+	}
+
+	result, kiteErr := g.Kite.ServeCall(r.Context(), call)
+	if kiteErr != nil {
+		// The retried call gets the response of the one in progress.
+		if kiteErr.Type == "callInProgress" {
+			w.Header().Set("Retry-After", "1")
+		}
+
+		writeError(w, statusCode(kiteErr), kiteErr)
+		return
+	}
+
+	if rd, ok := result.(io.Reader); ok {
+		if c, ok := rd.(io.Closer); ok {
+			defer c.Close()
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		if _, err := io.Copy(w, rd); err != nil {
+			g.Kite.Log.Warning("gateway: unable to stream %q result: %s", call.Method, err)
+		}
+		return
+	}
+
+	writeResponse(w, http.StatusOK, &kite.Response{Result: result})
+}
+
+// readArgs reads the method arguments from the request body.
+func (g *Gateway) readArgs(r *http.Request) (*dnode.Partial, error) {
+	max := g.MaxBodySize
+	if max == 0 {
+		max = DefaultMaxBodySize
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, max+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(body)) > max {
+		return nil, errBodyTooLarge
+	}
+
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return nil, nil
+	}
+
+	if !json.Valid(body) {
+		return nil, errInvalidJSON
+	}
+
+	raw := make([]byte, 0, len(body)+2)
+	raw = append(raw, '[')
+	raw = append(raw, body...)
+	raw = append(raw, ']')
+
+	return &dnode.Partial{Raw: raw}, nil
+}
+
+// statusCode gives the HTTP status code for the kite error.
+func statusCode(err *kite.Error) int {
+	switch err.Type {
+	case "authenticationError":
+		return http.StatusUnauthorized
+	case "forbidden":
+		return http.StatusForbidden
+	case "methodNotFound":
+		return http.StatusNotFound
+	case "argumentError", "validationError":
+		return http.StatusBadRequest
+	case "callInProgress":
+		return http.StatusConflict
+	case "requestLimitError":
+		return http.StatusTooManyRequests
+	case "timeout":
+		return http.StatusGatewayTimeout
+	case "shutdownError", "overloaded":
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, err *kite.Error) {
+	writeResponse(w, code, &kite.Response{Error: err})
+}
+
+func writeResponse(w http.ResponseWriter, code int, resp *kite.Response) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	json.NewEncoder(w).Encode(resp)
+}
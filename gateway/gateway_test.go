@@ -0,0 +1,334 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/koding/kite"
+	"github.com/koding/kite/config"
+)
+
+func TestGateway(t *testing.T) {
+	k := kite.New("gateway", "0.0.1")
+	k.Config = config.New()
+	k.Config.DisableAuthentication = false
+
+	k.Authenticators["test"] = func(r *kite.Request) error {
+		if r.Auth.Key != "secret" {
+			return errors.New("invalid key")
+		}
+
+		r.Username = "alice"
+		return nil
+	}
+
+	k.HandleFunc("square", func(r *kite.Request) (interface{}, error) {
+		return r.Args.One().MustFloat64() * r.Args.One().MustFloat64(), nil
+	})
+
+	k.HandleFunc("whoami", func(r *kite.Request) (interface{}, error) {
+		return r.Username, nil
+	})
+
+	k.HandleFunc("stream", func(r *kite.Request) (interface{}, error) {
+		return strings.NewReader("raw data"), nil
+	})
+
+	k.HandleFunc("requestID", func(r *kite.Request) (interface{}, error) {
+		return r.ID, nil
+	})
+
+	k.HandleTyped("greet", func(ctx context.Context, args struct {
+		Name string `json:"name" validate:"required"`
+	}) (string, error) {
+		return "hello " + args.Name, nil
+	})
+
+	k.HandleFunc("anonymous", func(r *kite.Request) (interface{}, error) {
+		return r.Args.One().MustString(), nil
+	}).DisableAuthentication()
+
+	Handle(k)
+
+	s := httptest.NewServer(k)
+	defer s.Close()
+
+	cases := map[string]struct {
+		method string
+		auth   string
+		reqID  string
+		body   string
+		code   int
+		result interface{}
+		errTyp string
+		raw    string
+	}{
+		"call with argument": {
+			method: "square",
+			auth:   "test secret",
+			body:   "3",
+			code:   200,
+			result: 9.0,
+		},
+		"call without argument": {
+			method: "whoami",
+			auth:   "test secret",
+			code:   200,
+			result: "alice",
+		},
+		"streamed result": {
+			method: "stream",
+			auth:   "test secret",
+			code:   200,
+			raw:    "raw data",
+		},
+		"authentication disabled": {
+			method: "anonymous",
+			body:   `"hello"`,
+			code:   200,
+			result: "hello",
+		},
+		"request ID": {
+			method: "requestID",
+			auth:   "test secret",
+			reqID:  "my-request",
+			code:   200,
+			result: "my-request",
+		},
+		"invalid key": {
+			method: "whoami",
+			auth:   "test invalid",
+			code:   401,
+			errTyp: "authenticationError",
+		},
+		"missing authentication": {
+			method: "whoami",
+			code:   401,
+			errTyp: "authenticationError",
+		},
+		"method not found": {
+			method: "missing",
+			auth:   "test secret",
+			code:   404,
+			errTyp: "methodNotFound",
+		},
+		"invalid JSON": {
+			method: "square",
+			auth:   "test secret",
+			body:   "{",
+			code:   400,
+			errTyp: "argumentError",
+		},
+		"valid arguments": {
+			method: "greet",
+			auth:   "test secret",
+			body:   `{"name":"alice"}`,
+			code:   200,
+			result: "hello alice",
+		},
+		"invalid arguments": {
+			method: "greet",
+			auth:   "test secret",
+			body:   `{}`,
+			code:   400,
+			errTyp: "validationError",
+		},
+	}
+
+	for name, cas := range cases {
+		t.Run(name, func(t *testing.T) {
+			req, err := http.NewRequest("POST", s.URL+"/methods/"+cas.method, strings.NewReader(cas.body))
+			if err != nil {
+				t.Fatalf("NewRequest()=%s", err)
+			}
+
+			if cas.auth != "" {
+				req.Header.Set("Authorization", cas.auth)
+			}
+
+			if cas.reqID != "" {
+				req.Header.Set("X-Request-Id", cas.reqID)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Do()=%s", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != cas.code {
+				t.Fatalf("got %d, want %d", resp.StatusCode, cas.code)
+			}
+
+			if cas.raw != "" {
+				p, err := ioutil.ReadAll(resp.Body)
+				if err != nil {
+					t.Fatalf("ReadAll()=%s", err)
+				}
+
+				if string(p) != cas.raw {
+					t.Fatalf("got %q, want %q", p, cas.raw)
+				}
+
+				return
+			}
+
+			var res kite.Response
+			if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+				t.Fatalf("Decode()=%s", err)
+			}
+
+			if cas.errTyp != "" {
+				if res.Error == nil || res.Error.Type != cas.errTyp {
+					t.Fatalf("got %+v, want %q error", res.Error, cas.errTyp)
+				}
+
+				return
+			}
+
+			if res.Error != nil {
+				t.Fatalf("got %s error", res.Error)
+			}
+
+			if res.Result != cas.result {
+				t.Fatalf("got %v, want %v", res.Result, cas.result)
+			}
+		})
+	}
+
+	resp, err := http.Get(s.URL + "/methods/whoami")
+	if err != nil {
+		t.Fatalf("Get()=%s", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("got %d, want %d", resp.StatusCode, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestGateway_Pprof(t *testing.T) {
+	k := kite.New("gateway", "0.0.1")
+	k.Config = config.New()
+	k.Config.DisableAuthentication = false
+
+	k.Authenticators["test"] = func(r *kite.Request) error {
+		r.Username = "admin"
+		r.Scopes = []string{kite.ScopeDebug}
+		return nil
+	}
+
+	Handle(k)
+
+	s := httptest.NewServer(k)
+	defer s.Close()
+
+	req, err := http.NewRequest("POST", s.URL+"/methods/kite.debug.pprof", strings.NewReader(`{"profile": "cpu", "seconds": 1}`))
+	if err != nil {
+		t.Fatalf("NewRequest()=%s", err)
+	}
+	req.Header.Set("Authorization", "test admin")
+
+	start := time.Now()
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Do()=%s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	p, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("ReadAll()=%s", err)
+	}
+
+	// The profile is collected for the requested duration, even though
+	// the call ends once the stream is returned.
+	if d := time.Since(start); d < time.Second {
+		t.Fatalf("profile was collected for %s, want 1s", d)
+	}
+
+	if len(p) == 0 {
+		t.Fatal("expected CPU profile to be streamed")
+	}
+}
+
+func TestGateway_CallInProgress(t *testing.T) {
+	k := kite.New("gateway", "0.0.1")
+	k.Config = config.New()
+	k.Config.DisableAuthentication = true
+
+	started, done := make(chan struct{}), make(chan struct{})
+
+	k.HandleFunc("create", func(r *kite.Request) (interface{}, error) {
+		close(started)
+		<-done
+		return "created", nil
+	}).Deduplicate(time.Minute)
+
+	Handle(k)
+
+	s := httptest.NewServer(k)
+	defer s.Close()
+
+	call := func() (*http.Response, error) {
+		req, err := http.NewRequest("POST", s.URL+"/methods/create", nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Idempotency-Key", "key")
+
+		return http.DefaultClient.Do(req)
+	}
+
+	first := make(chan error, 1)
+
+	go func() {
+		resp, err := call()
+		if err == nil {
+			resp.Body.Close()
+		}
+		first <- err
+	}()
+
+	<-started
+
+	resp, err := call()
+	close(done)
+	if err != nil {
+		t.Fatalf("Do()=%s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("got %d, want %d", resp.StatusCode, http.StatusConflict)
+	}
+
+	if s := resp.Header.Get("Retry-After"); s == "" {
+		t.Fatal("missing Retry-After header")
+	}
+
+	var res kite.Response
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.Fatalf("Decode()=%s", err)
+	}
+
+	if res.Error == nil || res.Error.Type != "callInProgress" {
+		t.Fatalf("got %+v, want %q error", res.Error, "callInProgress")
+	}
+
+	if err := <-first; err != nil {
+		t.Fatalf("Do()=%s", err)
+	}
+}
@@ -0,0 +1,147 @@
+package gateway
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/koding/kite"
+)
+
+// errorSchema is the JSON schema of kite.Error.
+var errorSchema = map[string]interface{}{
+	"type": "object",
+	"properties": map[string]interface{}{
+		"type":      map[string]interface{}{"type": "string"},
+		"message":   map[string]interface{}{"type": "string"},
+		"code":      map[string]interface{}{"type": "string"},
+		"id":        map[string]interface{}{"type": "string"},
+		"retryable": map[string]interface{}{"type": "boolean"},
+		"details":   map[string]interface{}{},
+	},
+}
+
+// OpenAPI gives the OpenAPI 3.0 document describing the methods as they are
+// called through the gateway, so clients can be generated from it. The
+// methods are described by MethodInfos of the kite, or by the kite.methods
+// method of a remote kite; the schemas of their arguments and results
+// are the ones set with (*kite.Method).Schema or derived from the
+// handlers registered with HandleTyped.
+//
+// Methods registered with patterns are not described, as they are
+// called by their names only.
+func OpenAPI(title, version string, methods []kite.MethodInfo) map[string]interface{} {
+	paths := make(map[string]interface{})
+
+	for _, m := range methods {
+		if strings.ContainsAny(m.Name, `*?[\`) {
+			continue
+		}
+
+		paths["/methods/"+m.Name] = map[string]interface{}{
+			"post": operation(m),
+		}
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   title,
+			"version": version,
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": map[string]interface{}{
+				"Error": errorSchema,
+			},
+			"securitySchemes": map[string]interface{}{
+				"token": map[string]interface{}{
+					"type":   "http",
+					"scheme": "bearer",
+				},
+				"kiteKey": map[string]interface{}{
+					"type":        "apiKey",
+					"in":          "header",
+					"name":        "Authorization",
+					"description": `Kite key sent as "kiteKey <key>".`,
+				},
+			},
+		},
+	}
+}
+
+// operation describes the call of the method through the gateway.
+func operation(m kite.MethodInfo) map[string]interface{} {
+	result := m.Result
+	if result == nil {
+		result = map[string]interface{}{}
+	}
+
+	op := map[string]interface{}{
+		"operationId": m.Name,
+		"responses": map[string]interface{}{
+			"200": map[string]interface{}{
+				"description": "The result of the method.",
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{
+						"schema": map[string]interface{}{
+							"type": "object",
+							"properties": map[string]interface{}{
+								"result": result,
+							},
+						},
+					},
+				},
+			},
+			"default": map[string]interface{}{
+				"description": "The error the call failed with.",
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{
+						"schema": map[string]interface{}{
+							"type": "object",
+							"properties": map[string]interface{}{
+								"error": map[string]interface{}{"$ref": "#/components/schemas/Error"},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	if m.Args != nil {
+		op["requestBody"] = map[string]interface{}{
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{
+					"schema": m.Args,
+				},
+			},
+		}
+	}
+
+	if m.Authenticated {
+		op["security"] = []interface{}{
+			map[string]interface{}{"token": []string{}},
+			map[string]interface{}{"kiteKey": []string{}},
+		}
+	} else {
+		op["security"] = []interface{}{}
+	}
+
+	if len(m.Scopes) != 0 {
+		op["description"] = "Requires the " + strings.Join(m.Scopes, ", ") + " scopes."
+	}
+
+	return op
+}
+
+// HandleOpenAPI serves the OpenAPI document of the methods of the kite,
+// see OpenAPI, under the /openapi.json path of the kite's HTTP server.
+func HandleOpenAPI(k *kite.Kite) {
+	k.HandleHTTPFunc("/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		doc := OpenAPI(k.Kite().Name, k.Kite().Version, k.MethodInfos())
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(doc)
+	})
+}
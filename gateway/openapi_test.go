@@ -0,0 +1,103 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/koding/kite"
+	"github.com/koding/kite/config"
+)
+
+func TestOpenAPI(t *testing.T) {
+	k := kite.New("gateway", "0.0.1")
+	k.Config = config.New()
+
+	k.HandleTyped("divide", func(ctx context.Context, args struct {
+		Dividend float64 `json:"dividend"`
+		Divisor  float64 `json:"divisor"`
+	}) (float64, error) {
+		return args.Dividend / args.Divisor, nil
+	}).RequireScope("write")
+
+	k.HandleFunc("echo", func(r *kite.Request) (interface{}, error) {
+		return r.Args.One().MustString(), nil
+	}).Schema("", "").DisableAuthentication()
+
+	k.HandleFunc("plugin.*", func(r *kite.Request) (interface{}, error) {
+		return nil, nil
+	})
+
+	HandleOpenAPI(k)
+
+	s := httptest.NewServer(k)
+	defer s.Close()
+
+	resp, err := http.Get(s.URL + "/openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var doc struct {
+		OpenAPI string `json:"openapi"`
+		Info    struct {
+			Title   string `json:"title"`
+			Version string `json:"version"`
+		} `json:"info"`
+		Paths map[string]struct {
+			Post struct {
+				OperationID string                 `json:"operationId"`
+				Description string                 `json:"description"`
+				RequestBody map[string]interface{} `json:"requestBody"`
+				Responses   map[string]interface{} `json:"responses"`
+				Security    []interface{}          `json:"security"`
+			} `json:"post"`
+		} `json:"paths"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		t.Fatal(err)
+	}
+
+	if doc.OpenAPI != "3.0.3" || doc.Info.Title != "gateway" || doc.Info.Version != "0.0.1" {
+		t.Fatalf("got %+v", doc)
+	}
+
+	if _, ok := doc.Paths["/methods/plugin.*"]; ok {
+		t.Error("expected pattern method not to be described")
+	}
+
+	divide, ok := doc.Paths["/methods/divide"]
+	if !ok {
+		t.Fatalf("divide not found in %v", doc.Paths)
+	}
+
+	if divide.Post.OperationID != "divide" || len(divide.Post.Security) != 2 || !strings.Contains(divide.Post.Description, "write") {
+		t.Errorf("got %+v", divide.Post)
+	}
+
+	args := divide.Post.RequestBody["content"].(map[string]interface{})["application/json"].(map[string]interface{})["schema"]
+	want := map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"dividend": map[string]interface{}{"type": "number"},
+			"divisor":  map[string]interface{}{"type": "number"},
+		},
+		"required": []interface{}{"dividend", "divisor"},
+	}
+
+	if !reflect.DeepEqual(args, want) {
+		t.Errorf("got %v, want %v", args, want)
+	}
+
+	echo := doc.Paths["/methods/echo"].Post
+
+	if echo.RequestBody == nil || len(echo.Security) != 0 {
+		t.Errorf("got %+v", echo)
+	}
+}
@@ -0,0 +1,73 @@
+package kite
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// goAwayPollInterval is the interval of checking whether the calls
+// made over a session of a kite going away are done.
+const goAwayPollInterval = 10 * time.Millisecond
+
+// GoingAway tells whether the remote kite notified the client it is
+// shutting down, see (*Kite).Shutdown. The remote kite still responds
+// to the calls in flight, but new calls are likely to be rejected with
+// ErrShuttingDown. It is reset once the client reconnects.
+func (c *Client) GoingAway() bool {
+	return atomic.LoadInt32(&c.goingAway) == 1
+}
+
+// notifyGoingAway tells the kites connected to k that it is shutting
+// down, so they can reconnect or fail over to other kites.
+func (k *Kite) notifyGoingAway() {
+	for _, c := range k.connectedClients() {
+		c.Go("kite.goingAway")
+	}
+}
+
+// handleGoingAway handles the notification of the remote kite that
+// it is shutting down. It is accepted only over sessions the local
+// kite has dialed.
+func handleGoingAway(r *Request) (interface{}, error) {
+	if !r.Client.initiated() {
+		return nil, errors.New("going away is accepted only from dialed kites")
+	}
+
+	go r.Client.goAway()
+
+	return nil, nil
+}
+
+// goAway marks the client as going away. If the client reconnects,
+// it closes the session once its calls in flight are done, so it
+// redials while the remote kite is shutting down.
+func (c *Client) goAway() {
+	if !atomic.CompareAndSwapInt32(&c.goingAway, 0, 1) {
+		return
+	}
+
+	c.LocalKite.Log.Info("Remote kite %s is going away", c.Kite.Name)
+
+	if !c.reconnect() {
+		return
+	}
+
+	session := c.getSession()
+	ctx := c.sessionContext()
+
+	t := time.NewTicker(goAwayPollInterval)
+	defer t.Stop()
+
+	for atomic.LoadInt64(&c.pendingCalls) > 0 {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+
+	if session != nil {
+		session.Close(3000, "Going away")
+	}
+}
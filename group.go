@@ -0,0 +1,176 @@
+package kite
+
+import "time"
+
+// Group registers methods under a common name prefix, applying the same
+// settings to each of them, e.g.:
+//
+//	fs := k.Group("fs")
+//	fs.PreHandleFunc(checkQuota)
+//	fs.ThrottleBy(kite.ThrottleByUsername, time.Second, 10)
+//
+//	fs.HandleFunc("list", list)   // registers "fs.list"
+//	fs.HandleFunc("remove", rm)   // registers "fs.remove"
+//
+// Settings of the group are applied to methods, when they are registered,
+// so they must be set before the methods are registered. Pre- and post
+// handlers of the group are executed before the ones registered with
+// the returned *Method.
+type Group struct {
+	kite   *Kite
+	prefix string
+
+	// opts are applied to every method registered with the group
+	opts []func(*Method)
+}
+
+// Group gives a group of methods, which names start with the given prefix
+// followed by a dot.
+func (k *Kite) Group(prefix string) *Group {
+	return &Group{
+		kite:   k,
+		prefix: prefix,
+	}
+}
+
+// Group gives a subgroup, which inherits settings of g. Names of its methods
+// start with the prefix of g and the given prefix, separated with dots.
+func (g *Group) Group(prefix string) *Group {
+	return &Group{
+		kite:   g.kite,
+		prefix: g.name(prefix),
+		opts:   append([]func(*Method){}, g.opts...),
+	}
+}
+
+// Handle registers the handler for the method of the group,
+// see Kite.Handle.
+func (g *Group) Handle(method string, handler Handler) *Method {
+	return g.apply(g.kite.Handle(g.name(method), handler))
+}
+
+// HandleFunc registers the handler for the method of the group,
+// see Kite.HandleFunc.
+func (g *Group) HandleFunc(method string, handler HandlerFunc) *Method {
+	return g.apply(g.kite.HandleFunc(g.name(method), handler))
+}
+
+// HandleTyped registers fn as a handler for the method of the group,
+// see Kite.HandleTyped.
+func (g *Group) HandleTyped(method string, fn interface{}) *Method {
+	return g.apply(g.kite.HandleTyped(g.name(method), fn))
+}
+
+// DisableAuthentication disables authentication check for methods
+// of the group.
+func (g *Group) DisableAuthentication() *Group {
+	return g.add(func(m *Method) { m.DisableAuthentication() })
+}
+
+// RequireScope allows calling methods of the group only by callers,
+// which were granted all of the given scopes, see Method.RequireScope.
+func (g *Group) RequireScope(scopes ...string) *Group {
+	return g.add(func(m *Method) { m.RequireScope(scopes...) })
+}
+
+// Throttle throttles each method of the group, see Method.Throttle.
+// Every method has its own token bucket.
+func (g *Group) Throttle(fillInterval time.Duration, capacity int64) *Group {
+	return g.add(func(m *Method) { m.Throttle(fillInterval, capacity) })
+}
+
+// ThrottleBy throttles each method of the group per key returned by the
+// key func, see Method.ThrottleBy. Every method has its own token buckets.
+func (g *Group) ThrottleBy(key func(*Request) string, fillInterval time.Duration, capacity int64) *Group {
+	return g.add(func(m *Method) { m.ThrottleBy(key, fillInterval, capacity) })
+}
+
+// MaxConcurrent limits the number of calls of each method of the group,
+// which are executed at once, see Method.MaxConcurrent.
+func (g *Group) MaxConcurrent(n int) *Group {
+	return g.add(func(m *Method) { m.MaxConcurrent(n) })
+}
+
+// MaxQueued makes calls of each method of the group, exceeding the limit
+// set with MaxConcurrent, wait, see Method.MaxQueued.
+func (g *Group) MaxQueued(n int) *Group {
+	return g.add(func(m *Method) { m.MaxQueued(n) })
+}
+
+// Handling sets the handling of methods of the group, see Method.Handling.
+func (g *Group) Handling(mode MethodHandling) *Group {
+	return g.add(func(m *Method) { m.Handling(mode) })
+}
+
+// Timeout limits the execution time of methods of the group,
+// see Method.Timeout.
+func (g *Group) Timeout(d time.Duration) *Group {
+	return g.add(func(m *Method) { m.Timeout(d) })
+}
+
+// Deduplicate makes the calls of each method of the group, which carry
+// the same idempotency key, be executed only once, see Method.Deduplicate.
+func (g *Group) Deduplicate(ttl time.Duration) *Group {
+	return g.add(func(m *Method) { m.Deduplicate(ttl) })
+}
+
+// Ordered makes the responses to the calls of the methods of the group
+// be sent in the order the calls were received, see Method.Ordered.
+func (g *Group) Ordered(key string) *Group {
+	return g.add(func(m *Method) { m.Ordered(key) })
+}
+
+// OnError registers a function called when the handler chain of a method
+// of the group fails, see Method.OnError.
+func (g *Group) OnError(f ErrorFunc) *Group {
+	return g.add(func(m *Method) { m.OnError(f) })
+}
+
+// PreHandle adds a new kite handler which is executed before methods
+// of the group.
+func (g *Group) PreHandle(handler Handler) *Group {
+	return g.add(func(m *Method) { m.PreHandle(handler) })
+}
+
+// PreHandleFunc adds a new kite handlerfunc which is executed before methods
+// of the group.
+func (g *Group) PreHandleFunc(handler HandlerFunc) *Group {
+	return g.PreHandle(handler)
+}
+
+// PostHandle adds a new kite handler which is executed after methods
+// of the group.
+func (g *Group) PostHandle(handler Handler) *Group {
+	return g.add(func(m *Method) { m.PostHandle(handler) })
+}
+
+// PostHandleFunc adds a new kite handlerfunc which is executed after methods
+// of the group.
+func (g *Group) PostHandleFunc(handler HandlerFunc) *Group {
+	return g.PostHandle(handler)
+}
+
+// FinalFunc registers a function that is always called as a last one
+// after pre-, handler and post- functions of methods of the group,
+// see Method.FinalFunc.
+func (g *Group) FinalFunc(f FinalFunc) *Group {
+	return g.add(func(m *Method) { m.FinalFunc(f) })
+}
+
+func (g *Group) add(opt func(*Method)) *Group {
+	g.opts = append(g.opts, opt)
+	return g
+}
+
+func (g *Group) apply(m *Method) *Method {
+	for _, opt := range g.opts {
+		opt(m)
+	}
+
+	return m
+}
+
+// name gives the full name of the method of the group.
+func (g *Group) name(method string) string {
+	return g.prefix + "." + method
+}
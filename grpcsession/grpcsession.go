@@ -0,0 +1,325 @@
+// Package grpcsession implements a sockjs.Session over a gRPC bidirectional
+// stream, which allows kites to talk to each other over HTTP/2 instead of
+// SockJS.
+//
+// Each dnode message is sent as a single gRPC message, the stream is
+// served by the kite's HTTP handler under the /kite.Kite/Session path.
+package grpcsession
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/koding/kite/config"
+	"github.com/koding/kite/sockjsclient"
+	"github.com/koding/kite/utils"
+
+	"github.com/igm/sockjs-go/sockjs"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+const (
+	serviceName = "kite.Kite"
+	streamName  = "Session"
+
+	// Path is the HTTP path of the session stream.
+	Path = "/" + serviceName + "/" + streamName
+)
+
+// codec passes the messages as they are, so no protobuf
+// definitions are needed.
+type codec struct{}
+
+func (codec) Name() string { return "kite" }
+
+func (codec) Marshal(v interface{}) ([]byte, error) {
+	p, ok := v.(*[]byte)
+	if !ok {
+		return nil, errors.New("grpcsession: unexpected message type")
+	}
+	return *p, nil
+}
+
+func (codec) Unmarshal(data []byte, v interface{}) error {
+	p, ok := v.(*[]byte)
+	if !ok {
+		return errors.New("grpcsession: unexpected message type")
+	}
+	*p = append((*p)[:0], data...)
+	return nil
+}
+
+var streamDesc = grpc.StreamDesc{
+	StreamName:    streamName,
+	ServerStreams: true,
+	ClientStreams: true,
+}
+
+// stream is implemented by both grpc.ClientStream and grpc.ServerStream.
+type stream interface {
+	SendMsg(m interface{}) error
+	RecvMsg(m interface{}) error
+}
+
+// Session represents a sockjs.Session over a gRPC stream.
+type Session struct {
+	id         string
+	req        *http.Request
+	remoteAddr string
+	stream     stream
+	initiated  bool
+
+	sendMu sync.Mutex // protects stream.SendMsg
+
+	mu      sync.Mutex
+	state   sockjs.SessionState
+	closeC  chan struct{}
+	onClose func()
+}
+
+var _ sockjs.Session = (*Session)(nil)
+
+func newSession(stream stream, req *http.Request) *Session {
+	return &Session{
+		id:     utils.RandomString(20),
+		req:    req,
+		stream: stream,
+		state:  sockjs.SessionActive,
+		closeC: make(chan struct{}),
+	}
+}
+
+// Dial establishes a session with the kite under the given URL, e.g.
+// http://localhost:3000/kite or unix:///path/to/socket. For https URLs the connection is secured
+// with cfg.Websocket.TLSClientConfig, the remote kite is expected to
+// support HTTP/2 over TLS then.
+func Dial(uri string, cfg *config.Config) (*Session, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	creds := insecure.NewCredentials()
+
+	if u.Scheme == "https" {
+		var tlsConfig *tls.Config
+		if cfg.Websocket != nil && cfg.Websocket.TLSClientConfig != nil {
+			tlsConfig = cfg.Websocket.TLSClientConfig.Clone()
+		}
+		creds = credentials.NewTLS(tlsConfig)
+	}
+
+	target := u.Host
+	if u.Scheme == "unix" {
+		target = "unix://" + u.Path
+	}
+
+	opts := []grpc.DialOption{grpc.WithTransportCredentials(creds)}
+
+	if cfg.MaxResponseSize > 0 {
+		opts = append(opts, grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(int(cfg.MaxResponseSize))))
+	}
+
+	conn, err := grpc.NewClient(target, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	stream, err := conn.NewStream(ctx, &streamDesc, Path, grpc.ForceCodec(codec{}))
+	if err != nil {
+		cancel()
+		conn.Close()
+		return nil, err
+	}
+
+	s := newSession(stream, &http.Request{
+		URL:    u,
+		Header: make(http.Header),
+	})
+	s.remoteAddr = target
+	s.initiated = true
+	s.onClose = func() {
+		cancel()
+		conn.Close()
+	}
+
+	return s, nil
+}
+
+// NewServer gives a gRPC server, which calls the handler for every
+// new session. The session is closed once the handler returns.
+//
+// The server is expected to be served with (*grpc.Server).ServeHTTP.
+// The opts configure the server, e.g. grpc.MaxRecvMsgSize.
+func NewServer(handler func(sockjs.Session), opts ...grpc.ServerOption) *grpc.Server {
+	srv := grpc.NewServer(append([]grpc.ServerOption{grpc.ForceServerCodec(codec{})}, opts...)...)
+
+	srv.RegisterService(&grpc.ServiceDesc{
+		ServiceName: serviceName,
+		HandlerType: (*interface{})(nil),
+		Streams: []grpc.StreamDesc{{
+			StreamName:    streamName,
+			ServerStreams: true,
+			ClientStreams: true,
+			Handler: func(_ interface{}, stream grpc.ServerStream) error {
+				return serve(handler, stream)
+			},
+		}},
+	}, nil)
+
+	return srv
+}
+
+func serve(handler func(sockjs.Session), stream grpc.ServerStream) error {
+	ctx := stream.Context()
+
+	req := &http.Request{
+		URL:    &url.URL{Path: Path},
+		Header: make(http.Header),
+	}
+
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		for key, values := range md {
+			req.Header[http.CanonicalHeaderKey(key)] = values
+		}
+	}
+
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		req.RemoteAddr = p.Addr.String()
+	}
+
+	s := newSession(stream, req)
+	s.remoteAddr = req.RemoteAddr
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		handler(s)
+	}()
+
+	// Returning from the stream handler ends the stream and
+	// unblocks pending Recv calls.
+	select {
+	case <-done:
+	case <-s.closeC:
+	case <-ctx.Done():
+	}
+
+	s.setState(sockjs.SessionClosed)
+
+	return nil
+}
+
+// ID returns a session id.
+func (s *Session) ID() string {
+	return s.id
+}
+
+// Request returns the request the session was created with.
+func (s *Session) Request() *http.Request {
+	return s.req
+}
+
+// RemoteAddr gives network address of the remote kite.
+func (s *Session) RemoteAddr() string {
+	return s.remoteAddr
+}
+
+// Initiated tells whether the session was created with Dial.
+func (s *Session) Initiated() bool {
+	return s.initiated
+}
+
+// Binary tells the messages are passed as they are, so they may
+// carry binary data.
+func (s *Session) Binary() bool {
+	return true
+}
+
+// Recv reads one message from the session.
+func (s *Session) Recv() (string, error) {
+	var p []byte
+
+	if err := s.stream.RecvMsg(&p); err != nil {
+		s.Close(0, "")
+
+		if err == io.EOF {
+			err = nil
+		}
+
+		return "", &sockjsclient.ErrSession{
+			Type:  config.GRPC,
+			State: sockjs.SessionClosed,
+			Err:   err,
+		}
+	}
+
+	return string(p), nil
+}
+
+// Send sends one message to the session.
+func (s *Session) Send(msg string) error {
+	if s.GetSessionState() != sockjs.SessionActive {
+		return &sockjsclient.ErrSession{
+			Type:  config.GRPC,
+			State: s.GetSessionState(),
+		}
+	}
+
+	p := []byte(msg)
+
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+
+	return s.stream.SendMsg(&p)
+}
+
+// Close closes the session.
+func (s *Session) Close(uint32, string) error {
+	s.mu.Lock()
+	if s.state == sockjs.SessionClosed {
+		s.mu.Unlock()
+		return sockjsclient.ErrSessionClosed
+	}
+	s.state = sockjs.SessionClosed
+	close(s.closeC)
+	s.mu.Unlock()
+
+	if cs, ok := s.stream.(grpc.ClientStream); ok {
+		s.sendMu.Lock()
+		cs.CloseSend()
+		s.sendMu.Unlock()
+	}
+
+	if s.onClose != nil {
+		s.onClose()
+	}
+
+	return nil
+}
+
+func (s *Session) setState(state sockjs.SessionState) {
+	s.mu.Lock()
+	s.state = state
+	s.mu.Unlock()
+}
+
+// GetSessionState gives state of the session.
+func (s *Session) GetSessionState() sockjs.SessionState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.state
+}
@@ -19,14 +19,26 @@ func (k *Kite) addDefaultHandlers() {
 	k.HandleFunc("kite.systemInfo", handleSystemInfo)
 	k.HandleFunc("kite.heartbeat", k.handleHeartbeat)
 	k.HandleFunc("kite.ping", handlePing).DisableAuthentication()
+	k.HandleFunc("kite.health", k.handleHealth)
+	k.HandleFunc("kite.methods", handleMethods)
 	k.HandleFunc("kite.tunnel", handleTunnel)
+	k.HandleFunc("kite.reverse", handleReverse)
+	k.HandleFunc("kite.reverseTunnel", handleReverseTunnel)
 	k.HandleFunc("kite.log", k.handleLog)
 	k.HandleFunc("kite.print", handlePrint)
 	k.HandleFunc("kite.prompt", handlePrompt)
 	k.HandleFunc("kite.getPass", handleGetPass)
+	k.HandleFunc("kite.streamAck", handleStreamAck).DisableAuthentication().controlMethod()
+	k.HandleFunc("kite.cancel", handleCancel).DisableAuthentication().controlMethod()
+	k.HandleFunc("kite.goingAway", handleGoingAway).DisableAuthentication().controlMethod()
+	k.HandleFunc("kite.handshake", handleHandshake).DisableAuthentication().controlMethod()
+	k.HandleFunc("kite.batch", handleBatch).DisableAuthentication()
+	k.HandleFunc("kite.reloadConfig", k.handleReloadConfig).RequireScope(ScopeAdmin)
 	if runtime.GOOS == "darwin" {
 		k.HandleFunc("kite.notify", handleNotifyDarwin)
 	}
+
+	k.addDebugHandlers()
 }
 
 // handleSystemInfo returns info about the system (CPU, memory, disk...).
@@ -34,6 +46,11 @@ func handleSystemInfo(r *Request) (interface{}, error) {
 	return systeminfo.New()
 }
 
+// handleMethods returns the descriptions of the methods of the kite.
+func handleMethods(r *Request) (interface{}, error) {
+	return r.LocalKite.MethodInfos(), nil
+}
+
 // handleLog prints a log message to stderr.
 func (k *Kite) handleLog(r *Request) (interface{}, error) {
 	msg, err := r.Args.One().String()
@@ -46,6 +63,11 @@ func (k *Kite) handleLog(r *Request) (interface{}, error) {
 	return nil, nil
 }
 
+// handleReloadConfig reloads the configuration of the kite.
+func (k *Kite) handleReloadConfig(r *Request) (interface{}, error) {
+	return nil, k.reload()
+}
+
 //handlePing returns a simple "pong" string
 func handlePing(r *Request) (interface{}, error) {
 	return "pong", nil
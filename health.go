@@ -0,0 +1,167 @@
+package kite
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HealthCheckTimeout limits the time health checks are run for
+// by the /healthz and /readyz endpoints and the kite.health method.
+var HealthCheckTimeout = 5 * time.Second
+
+// HealthStatus is the result of running the health checks.
+type HealthStatus struct {
+	// Healthy is true if all the checks passed.
+	Healthy bool `json:"healthy"`
+
+	// Checks maps names of the checks to their errors, passed checks
+	// are mapped to "ok".
+	Checks map[string]string `json:"checks"`
+}
+
+var (
+	errShuttingDown     = errors.New("kite is shutting down")
+	errNotRegistered    = errors.New("kite is not registered to kontrol")
+	errHealthCheckPanic = errors.New("health check panicked")
+)
+
+// healthCheck is a check added with AddHealthCheck.
+type healthCheck struct {
+	name string
+	fn   func(context.Context) error
+}
+
+// AddHealthCheck adds the check, which is run by the /healthz and /readyz
+// endpoints and the kite.health method. The check reports the dependency
+// it checks unhealthy by returning a non-nil error, it should return
+// once the ctx is done. A check added with the same name replaces
+// the previous one.
+func (k *Kite) AddHealthCheck(name string, fn func(ctx context.Context) error) {
+	k.healthMu.Lock()
+	defer k.healthMu.Unlock()
+
+	for i, check := range k.healthChecks {
+		if check.name == name {
+			k.healthChecks[i].fn = fn
+			return
+		}
+	}
+
+	k.healthChecks = append(k.healthChecks, healthCheck{name: name, fn: fn})
+}
+
+// Health runs the health checks added with AddHealthCheck.
+func (k *Kite) Health(ctx context.Context) *HealthStatus {
+	k.healthMu.Lock()
+	checks := append([]healthCheck(nil), k.healthChecks...)
+	k.healthMu.Unlock()
+
+	return runHealthChecks(ctx, checks)
+}
+
+// Ready runs the health checks along with checking whether the kite
+// is ready to serve requests: it is not shutting down and, if the kite
+// was registered to Kontrol, it is still registered.
+func (k *Kite) Ready(ctx context.Context) *HealthStatus {
+	k.healthMu.Lock()
+	checks := append([]healthCheck(nil), k.healthChecks...)
+	k.healthMu.Unlock()
+
+	checks = append(checks,
+		healthCheck{name: "server", fn: k.checkServer},
+		healthCheck{name: "kontrol", fn: k.checkKontrol},
+	)
+
+	return runHealthChecks(ctx, checks)
+}
+
+func (k *Kite) checkServer(context.Context) error {
+	k.callsMu.Lock()
+	defer k.callsMu.Unlock()
+
+	if k.draining {
+		return errShuttingDown
+	}
+
+	return nil
+}
+
+func (k *Kite) checkKontrol(context.Context) error {
+	if atomic.LoadInt32(&k.kontrol.registering) == 1 && atomic.LoadInt32(&k.kontrol.registered) == 0 {
+		return errNotRegistered
+	}
+
+	return nil
+}
+
+// runHealthChecks runs the checks concurrently and collects their results.
+func runHealthChecks(ctx context.Context, checks []healthCheck) *HealthStatus {
+	ctx, cancel := context.WithTimeout(ctx, HealthCheckTimeout)
+	defer cancel()
+
+	errs := make([]error, len(checks))
+
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func(i int, check healthCheck) {
+			defer wg.Done()
+			defer func() {
+				if v := recover(); v != nil {
+					errs[i] = errHealthCheckPanic
+				}
+			}()
+
+			errs[i] = check.fn(ctx)
+		}(i, check)
+	}
+	wg.Wait()
+
+	status := &HealthStatus{
+		Healthy: true,
+		Checks:  make(map[string]string, len(checks)),
+	}
+
+	for i, check := range checks {
+		if errs[i] != nil {
+			status.Healthy = false
+			status.Checks[check.name] = errs[i].Error()
+		} else {
+			status.Checks[check.name] = "ok"
+		}
+	}
+
+	return status
+}
+
+// serveHealth writes the status as a JSON, with the 503 status code
+// if the kite is unhealthy.
+func serveHealth(w http.ResponseWriter, status *HealthStatus) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if !status.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	json.NewEncoder(w).Encode(status)
+}
+
+// handleHealthz serves the /healthz endpoint.
+func (k *Kite) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	serveHealth(w, k.Health(r.Context()))
+}
+
+// handleReadyz serves the /readyz endpoint.
+func (k *Kite) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	serveHealth(w, k.Ready(r.Context()))
+}
+
+// handleHealth gives the readiness status of the kite, see Kite.Ready.
+func (k *Kite) handleHealth(r *Request) (interface{}, error) {
+	return k.Ready(r.Ctx()), nil
+}
@@ -0,0 +1,115 @@
+package kite
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestKite_Health(t *testing.T) {
+	k := New("testkite", "0.0.1")
+
+	var failing atomic.Value
+	failing.Store(false)
+
+	k.AddHealthCheck("db", func(ctx context.Context) error {
+		if failing.Load().(bool) {
+			return errors.New("connection refused")
+		}
+		return nil
+	})
+
+	// Default methods are registered by New with authentication enabled.
+	k.HandleFunc("kite.health", k.handleHealth).DisableAuthentication()
+
+	go k.Run()
+	defer k.Close()
+	<-k.ServerReadyNotify()
+
+	get := func(path string) (int, *HealthStatus) {
+		resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d%s", k.Port(), path))
+		if err != nil {
+			t.Fatalf("Get(%q)=%s", path, err)
+		}
+		defer resp.Body.Close()
+
+		var status HealthStatus
+		if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+			t.Fatalf("Decode()=%s", err)
+		}
+
+		return resp.StatusCode, &status
+	}
+
+	cases := []struct {
+		path    string
+		failing bool
+		code    int
+		checks  map[string]string
+	}{{
+		"/healthz", false, http.StatusOK,
+		map[string]string{"db": "ok"},
+	}, {
+		"/readyz", false, http.StatusOK,
+		map[string]string{"db": "ok", "server": "ok", "kontrol": "ok"},
+	}, {
+		"/healthz", true, http.StatusServiceUnavailable,
+		map[string]string{"db": "connection refused"},
+	}, {
+		"/readyz", true, http.StatusServiceUnavailable,
+		map[string]string{"db": "connection refused", "server": "ok", "kontrol": "ok"},
+	}}
+
+	for _, cas := range cases {
+		failing.Store(cas.failing)
+
+		code, status := get(cas.path)
+
+		if code != cas.code {
+			t.Errorf("%s: got %d, want %d", cas.path, code, cas.code)
+		}
+
+		if status.Healthy != (cas.code == http.StatusOK) {
+			t.Errorf("%s: got healthy=%t", cas.path, status.Healthy)
+		}
+
+		if fmt.Sprint(status.Checks) != fmt.Sprint(cas.checks) {
+			t.Errorf("%s: got %v, want %v", cas.path, status.Checks, cas.checks)
+		}
+	}
+
+	// Readiness reflects registration to Kontrol.
+	failing.Store(false)
+	atomic.StoreInt32(&k.kontrol.registering, 1)
+
+	c := New("exp", "0.0.1").NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", k.Port()))
+	if err := c.Dial(); err != nil {
+		t.Fatalf("Dial()=%s", err)
+	}
+	defer c.Close()
+
+	res, err := c.TellWithTimeout("kite.health", 4*time.Second)
+	if err != nil {
+		t.Fatalf("TellWithTimeout()=%s", err)
+	}
+
+	var status HealthStatus
+	if err := res.Unmarshal(&status); err != nil {
+		t.Fatalf("Unmarshal()=%s", err)
+	}
+
+	if status.Healthy || status.Checks["kontrol"] != errNotRegistered.Error() {
+		t.Fatalf("got %+v, want the kite not registered to kontrol", &status)
+	}
+
+	atomic.StoreInt32(&k.kontrol.registered, 1)
+
+	if code, _ := get("/readyz"); code != http.StatusOK {
+		t.Fatalf("got %d, want %d", code, http.StatusOK)
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/cenkalti/backoff"
@@ -115,20 +116,64 @@ func (k *Kite) RegisterHTTPForever(kiteURL *url.URL) {
 	}
 }
 
-func (k *Kite) getKontrolPath(path string) string {
-	heartbeatURL := k.Config.KontrolURL + "/" + path
-	if strings.HasSuffix(k.Config.KontrolURL, "/kite") {
-		heartbeatURL = strings.TrimSuffix(k.Config.KontrolURL, "/kite") + "/" + path
+func (k *Kite) getKontrolPath(kontrolURL, path string) string {
+	heartbeatURL := kontrolURL + "/" + path
+	if strings.HasSuffix(kontrolURL, "/kite") {
+		heartbeatURL = strings.TrimSuffix(kontrolURL, "/kite") + "/" + path
 	}
 
 	return heartbeatURL
 }
 
+// kontrolHTTPURL gives the URL of Kontrol the kite registered to with
+// RegisterHTTP, or Config.KontrolURL if it has not registered yet.
+func (k *Kite) kontrolHTTPURL() string {
+	k.kontrol.Lock()
+	defer k.kontrol.Unlock()
+
+	if k.kontrol.httpURL != "" {
+		return k.kontrol.httpURL
+	}
+
+	return k.Config.KontrolURL
+}
+
 // RegisterHTTP registers current Kite to Kontrol. After registration other Kites
 // can find it via GetKites() or WatchKites() method. It registers again if
 // connection to kontrol is lost.
+//
+// If Config.KontrolURLs are set, the kite registers to the first Kontrol
+// that is available, starting with the one it registered to last time.
 func (k *Kite) RegisterHTTP(kiteURL *url.URL) (*registerResult, error) {
-	registerURL := k.getKontrolPath("register")
+	atomic.StoreInt32(&k.kontrol.registering, 1)
+
+	urls := k.kontrolURLs()
+	current := k.kontrolHTTPURL()
+
+	for i, u := range urls {
+		if u == current {
+			urls = append(append([]string(nil), urls[i:]...), urls[:i]...)
+			break
+		}
+	}
+
+	var err error
+	for _, u := range urls {
+		var res *registerResult
+		if res, err = k.registerHTTP(u, kiteURL); err == nil {
+			return res, nil
+		}
+
+		if len(urls) > 1 {
+			k.Log.Warning("Cannot register to Kontrol %s: %s", u, err)
+		}
+	}
+
+	return nil, err
+}
+
+func (k *Kite) registerHTTP(kontrolURL string, kiteURL *url.URL) (*registerResult, error) {
+	registerURL := k.getKontrolPath(kontrolURL, "register")
 
 	args := protocol.RegisterArgs{
 		URL:  kiteURL.String(),
@@ -137,6 +182,9 @@ func (k *Kite) RegisterHTTP(kiteURL *url.URL) (*registerResult, error) {
 			Type: "kiteKey",
 			Key:  k.KiteKey(),
 		},
+		Labels: k.Config.Labels,
+		URLs:   k.advertisedURLs(),
+		Weight: k.Config.Weight,
 	}
 
 	data, err := json.Marshal(&args)
@@ -144,7 +192,12 @@ func (k *Kite) RegisterHTTP(kiteURL *url.URL) (*registerResult, error) {
 		return nil, err
 	}
 
-	resp, err := k.Config.Client.Post(registerURL, "application/json", bytes.NewReader(data))
+	client, err := k.httpClient()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Post(registerURL, "application/json", bytes.NewReader(data))
 	if err != nil {
 		return nil, err
 	}
@@ -168,7 +221,11 @@ func (k *Kite) RegisterHTTP(kiteURL *url.URL) (*registerResult, error) {
 		k.Log.Error("Cannot parse registered URL: %s", err.Error())
 	}
 
-	heartbeat := time.Duration(rr.HeartbeatInterval) * time.Second
+	heartbeat := k.heartbeatInterval(time.Duration(rr.HeartbeatInterval) * time.Second)
+
+	k.kontrol.Lock()
+	k.kontrol.httpURL = kontrolURL
+	k.kontrol.Unlock()
 
 	k.Log.Info("Registered (via HTTP) with URL: '%s' and HeartBeat interval: '%s'",
 		rr.URL, heartbeat)
@@ -182,8 +239,18 @@ func (k *Kite) RegisterHTTP(kiteURL *url.URL) (*registerResult, error) {
 
 var errRegisterAgain = errors.New("register again")
 
+// heartbeatInterval gives the interval of heartbeats, which is the one
+// requested by Kontrol, unless Config.HeartbeatInterval is shorter.
+func (k *Kite) heartbeatInterval(kontrol time.Duration) time.Duration {
+	if d := k.Config.HeartbeatInterval; d > 0 && (d < kontrol || kontrol <= 0) {
+		return d
+	}
+
+	return kontrol
+}
+
 func (k *Kite) sendHeartbeats(interval time.Duration, kiteURL *url.URL) {
-	heartbeatURL := k.getKontrolPath("heartbeat")
+	heartbeatURL := k.getKontrolPath(k.kontrolHTTPURL(), "heartbeat")
 
 	k.Log.Debug("Starting to send heartbeat to: %s", heartbeatURL)
 
@@ -192,6 +259,11 @@ func (k *Kite) sendHeartbeats(interval time.Duration, kiteURL *url.URL) {
 		k.Log.Fatal("HeartbeatURL is malformed: %s", err)
 	}
 
+	client, err := k.httpClient()
+	if err != nil {
+		k.Log.Fatal("Cannot create heartbeat client: %s", err)
+	}
+
 	q := u.Query()
 	q.Set("id", k.Id)
 	u.RawQuery = q.Encode()
@@ -199,8 +271,18 @@ func (k *Kite) sendHeartbeats(interval time.Duration, kiteURL *url.URL) {
 	heartbeatFunc := func() error {
 		k.Log.Debug("Sending heartbeat to %s", u)
 
-		resp, err := k.Config.Client.Get(u.String())
+		resp, err := client.Get(u.String())
 		if err != nil {
+			// Register to other Kontrol if the current one is unreachable.
+			if len(k.kontrolURLs()) > 1 {
+				k.Log.Warning("Cannot send heartbeat to Kontrol, going to register again: %s", err)
+
+				atomic.StoreInt32(&k.kontrol.registered, 0)
+				go k.RegisterHTTPForever(kiteURL)
+
+				return errRegisterAgain
+			}
+
 			return err
 		}
 		defer resp.Body.Close()
@@ -225,6 +307,7 @@ func (k *Kite) sendHeartbeats(interval time.Duration, kiteURL *url.URL) {
 			return nil
 		case "registeragain":
 			k.Log.Info("Disconnected from Kontrol, going to register again")
+			atomic.StoreInt32(&k.kontrol.registered, 0)
 
 			go func() {
 				k.RegisterHTTPForever(kiteURL)
@@ -249,6 +332,8 @@ func (k *Kite) handleHeartbeat(r *Request) (interface{}, error) {
 		return nil, err
 	}
 
+	req.interval = k.heartbeatInterval(req.interval)
+
 	k.heartbeatC <- req
 
 	return nil, req.ping()
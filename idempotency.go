@@ -0,0 +1,306 @@
+package kite
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/koding/kite/dnode"
+)
+
+// ErrCallInProgress is returned to the caller of a method deduplicated
+// with (*Method).Deduplicate, when a call with the same idempotency key
+// has not finished yet. It is retryable, the retried call gets
+// the response of the first one once it finishes.
+var ErrCallInProgress = &Error{
+	Type:      "callInProgress",
+	Message:   "A call with the same idempotency key is in progress",
+	Retryable: true,
+}
+
+// idempotencyKeyKey is the context key of the idempotency key.
+type idempotencyKeyKey struct{}
+
+// ContextWithIdempotencyKey gives a copy of ctx carrying the idempotency key.
+//
+// Calls made with TellWithContext and a context carrying an idempotency key
+// send it to the remote kite. Calls of the methods deduplicated with
+// (*Method).Deduplicate, which carry the same key, are executed only
+// once, so such calls can be safely retried, e.g. after they timed out:
+//
+//	ctx := kite.ContextWithIdempotencyKey(ctx, uuid)
+//	result, err := c.TellWithContext(ctx, "machines.create", args)
+//
+// The calls carrying a key are retried if the client has a retry
+// policy set, see (*Client).WithRetry.
+func ContextWithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKeyKey{}, key)
+}
+
+// IdempotencyKeyFromContext gives the idempotency key carried by ctx, if any.
+func IdempotencyKeyFromContext(ctx context.Context) (string, bool) {
+	key, ok := ctx.Value(idempotencyKeyKey{}).(string)
+	return key, ok && key != ""
+}
+
+func hasIdempotencyKey(ctx context.Context) bool {
+	_, ok := IdempotencyKeyFromContext(ctx)
+	return ok
+}
+
+// IdempotencyStore keeps the responses of the calls of the methods
+// deduplicated with (*Method).Deduplicate, see Kite.IdempotencyStore.
+type IdempotencyStore interface {
+	// Begin stores a pending record under the key, unless the key is
+	// already stored. It returns nil if the record was stored, the
+	// stored record otherwise.
+	//
+	// The pending record does not expire after ttl, it is kept until
+	// it is replaced with Finish or removed with Cancel, so the calls
+	// running longer than ttl are not executed again by their duplicates.
+	Begin(ctx context.Context, key string, ttl time.Duration) (*IdempotencyRecord, error)
+
+	// Finish replaces the pending record under the key with the
+	// one holding the response of the call, kept for ttl.
+	Finish(ctx context.Context, key string, rec *IdempotencyRecord, ttl time.Duration) error
+
+	// Cancel removes the record under the key, when the call failed
+	// without being executed, so it can be made again.
+	Cancel(ctx context.Context, key string) error
+}
+
+// IdempotencyRecord is a record of a call kept by an IdempotencyStore.
+type IdempotencyRecord struct {
+	// Pending is true if the call has not finished yet.
+	Pending bool `json:"pending,omitempty"`
+
+	// Result is the JSON encoded result of the call.
+	Result json.RawMessage `json:"result,omitempty"`
+
+	// Error is the error the call failed with.
+	Error *Error `json:"error,omitempty"`
+}
+
+// Deduplicate makes the calls of the method, which carry the same
+// idempotency key and are made by the same user, be executed only once.
+// Duplicates received within ttl after the first call finished get its
+// response, without executing the method. Duplicates received while the
+// first call is executed fail with ErrCallInProgress, however long it takes.
+//
+// Responses are kept by the kite's IdempotencyStore. Calls, which failed
+// before the method handler was invoked, e.g. with ErrOverloaded or
+// ErrDeadlineExceeded, are not kept, neither are streamed responses.
+// Calls, which returned while the handler was still running, e.g. they
+// timed out or the caller went away, are kept once the handler returns.
+// Callbacks, that are part of the kept responses, cannot be called
+// by the callers of the duplicates.
+//
+// Zero or negative ttl disables deduplication, which is the default.
+func (m *Method) Deduplicate(ttl time.Duration) *Method {
+	m.mu.Lock()
+	m.dedupTTL = ttl
+	m.resetChain()
+	m.mu.Unlock()
+
+	return m
+}
+
+// idempotencyStore gives the kite's IdempotencyStore, or the one
+// keeping the records in memory if it is not set.
+func (k *Kite) idempotencyStore() IdempotencyStore {
+	if k.IdempotencyStore != nil {
+		return k.IdempotencyStore
+	}
+
+	k.idempotencyOnce.Do(func() {
+		k.idempotency = newMemoryIdempotencyStore()
+	})
+
+	return k.idempotency
+}
+
+// serveOnce runs the handler chain of the method, unless the request is
+// a duplicate of a call with the same idempotency key, see Deduplicate.
+// Calls are executed as usual if the IdempotencyStore fails.
+func (m *Method) serveOnce(r *Request) (interface{}, error) {
+	ttl := m.handlerChain(r.LocalKite).dedupTTL
+	if ttl <= 0 || r.IdempotencyKey == "" {
+		return m.ServeKite(r)
+	}
+
+	store := r.LocalKite.idempotencyStore()
+	key := m.rateLimitKey(r.LocalKite) + ":" + r.Username + ":" + r.IdempotencyKey
+
+	rec, err := store.Begin(r.Ctx(), key, ttl)
+	if err != nil {
+		r.Logger().Warning("idempotency store: %s", err)
+		return m.ServeKite(r)
+	}
+
+	if rec != nil {
+		return rec.response(r)
+	}
+
+	result, err := m.ServeKite(r)
+
+	// The call returned before the handler did, e.g. the caller went
+	// away. The record is kept pending until the handler returns.
+	if done := r.detached; done != nil {
+		go func() {
+			res := <-done
+			m.finishOnce(r, store, key, ttl, res.resp, res.err)
+		}()
+
+		return result, err
+	}
+
+	return m.finishOnce(r, store, key, ttl, result, err)
+}
+
+// finishOnce stores the response of the deduplicated call r under the key,
+// unless it failed before its handler was invoked, e.g. it was rejected
+// or received after its deadline, so its duplicates need to be executed
+// instead of getting the error.
+func (m *Method) finishOnce(r *Request, store IdempotencyStore, key string, ttl time.Duration, result interface{}, err error) (interface{}, error) {
+	// The store is updated even if the caller went away.
+	ctx := context.Background()
+
+	if _, ok := result.(io.Reader); ok || !r.invoked {
+		if e := store.Cancel(ctx, key); e != nil {
+			r.Logger().Warning("idempotency store: %s", e)
+		}
+
+		return result, err
+	}
+
+	rec := &IdempotencyRecord{
+		Error: createError(r, err),
+	}
+
+	if err == nil {
+		p, e := json.Marshal(result)
+		if e != nil {
+			r.Logger().Warning("idempotency store: unable to encode the result: %s", e)
+
+			if e := store.Cancel(ctx, key); e != nil {
+				r.Logger().Warning("idempotency store: %s", e)
+			}
+
+			return result, nil
+		}
+
+		rec.Result = p
+	}
+
+	if e := store.Finish(ctx, key, rec, ttl); e != nil {
+		r.Logger().Warning("idempotency store: %s", e)
+	}
+
+	return result, rec.errorOrNil()
+}
+
+// response gives the response of the recorded call to the duplicate r.
+func (rec *IdempotencyRecord) response(r *Request) (interface{}, error) {
+	if rec.Pending {
+		err := *ErrCallInProgress
+		return nil, &err
+	}
+
+	if rec.Error != nil {
+		err := *rec.Error
+		err.RequestID = r.ID
+		return nil, &err
+	}
+
+	if len(rec.Result) == 0 {
+		return nil, nil
+	}
+
+	return &dnode.Partial{Raw: rec.Result}, nil
+}
+
+func (rec *IdempotencyRecord) errorOrNil() error {
+	if rec.Error == nil {
+		return nil
+	}
+
+	return rec.Error
+}
+
+// memoryIdempotencyStore is an IdempotencyStore keeping the records
+// in memory. Expired records are swept at most once per minute.
+type memoryIdempotencyStore struct {
+	mu        sync.Mutex
+	records   map[string]*memoryIdempotencyRecord
+	lastSweep time.Time
+}
+
+type memoryIdempotencyRecord struct {
+	rec     *IdempotencyRecord
+	expires time.Time
+}
+
+var _ IdempotencyStore = (*memoryIdempotencyStore)(nil)
+
+// expired tells whether the record has expired, pending
+// records are kept until the call finishes.
+func (r *memoryIdempotencyRecord) expired(now time.Time) bool {
+	return !r.rec.Pending && now.After(r.expires)
+}
+
+func newMemoryIdempotencyStore() *memoryIdempotencyStore {
+	return &memoryIdempotencyStore{
+		records:   make(map[string]*memoryIdempotencyRecord),
+		lastSweep: time.Now(),
+	}
+}
+
+func (s *memoryIdempotencyStore) Begin(_ context.Context, key string, ttl time.Duration) (*IdempotencyRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	if now.Sub(s.lastSweep) > time.Minute {
+		for k, r := range s.records {
+			if r.expired(now) {
+				delete(s.records, k)
+			}
+		}
+
+		s.lastSweep = now
+	}
+
+	if r, ok := s.records[key]; ok && !r.expired(now) {
+		return r.rec, nil
+	}
+
+	s.records[key] = &memoryIdempotencyRecord{
+		rec: &IdempotencyRecord{Pending: true},
+	}
+
+	return nil, nil
+}
+
+func (s *memoryIdempotencyStore) Finish(_ context.Context, key string, rec *IdempotencyRecord, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.records[key] = &memoryIdempotencyRecord{
+		rec:     rec,
+		expires: time.Now().Add(ttl),
+	}
+
+	return nil
+}
+
+func (s *memoryIdempotencyStore) Cancel(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.records, key)
+
+	return nil
+}
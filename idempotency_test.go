@@ -0,0 +1,373 @@
+package kite
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMethod_Deduplicate(t *testing.T) {
+	k := New("testkite", "0.0.1")
+	k.Config.DisableAuthentication = true
+
+	var created, failed, slow int32
+	release := make(chan struct{})
+
+	k.HandleFunc("create", func(r *Request) (interface{}, error) {
+		return atomic.AddInt32(&created, 1), nil
+	}).Deduplicate(time.Minute)
+	k.HandleFunc("fail", func(r *Request) (interface{}, error) {
+		atomic.AddInt32(&failed, 1)
+		return nil, &Error{Type: "conflict", Message: "already exists"}
+	}).Deduplicate(time.Minute)
+	k.HandleFunc("slow", func(r *Request) (interface{}, error) {
+		atomic.AddInt32(&slow, 1)
+		<-release
+		return "slow", nil
+	}).Deduplicate(time.Minute)
+
+	go k.Run()
+	defer k.Close()
+	<-k.ServerReadyNotify()
+
+	c := New("exp", "0.0.1").NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", k.Port()))
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	call := func(method, key string) (int, error) {
+		ctx := context.Background()
+		if key != "" {
+			ctx = ContextWithIdempotencyKey(ctx, key)
+		}
+
+		res, err := c.TellWithContext(ctx, method)
+		if err != nil {
+			return 0, err
+		}
+
+		return int(res.MustFloat64()), nil
+	}
+
+	cases := []struct {
+		key  string
+		want int
+	}{
+		{"a", 1},
+		{"a", 1}, // duplicate
+		{"b", 2},
+		{"a", 1}, // duplicate
+		{"", 3},  // no key
+		{"", 4},  // no key
+		{"b", 2}, // duplicate
+	}
+
+	for i, cas := range cases {
+		got, err := call("create", cas.key)
+		if err != nil {
+			t.Fatalf("%d: TellWithContext()=%s", i, err)
+		}
+
+		if got != cas.want {
+			t.Errorf("%d: got %d, want %d", i, got, cas.want)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		_, err := call("fail", "a")
+		if !errors.Is(err, &Error{Type: "conflict"}) {
+			t.Fatalf("%d: got %v, want conflict error", i, err)
+		}
+	}
+
+	if n := atomic.LoadInt32(&failed); n != 1 {
+		t.Errorf("got %d calls of fail, want 1", n)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.TellWithContext(ContextWithIdempotencyKey(context.Background(), "a"), "slow")
+		done <- err
+	}()
+
+	for atomic.LoadInt32(&slow) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	_, err := c.TellWithContext(ContextWithIdempotencyKey(context.Background(), "a"), "slow")
+	if !errors.Is(err, ErrCallInProgress) {
+		t.Fatalf("got %v, want %v", err, ErrCallInProgress)
+	}
+
+	close(release)
+
+	if err := <-done; err != nil {
+		t.Fatalf("TellWithContext()=%s", err)
+	}
+
+	res, err := c.TellWithContext(ContextWithIdempotencyKey(context.Background(), "a"), "slow")
+	if err != nil {
+		t.Fatalf("TellWithContext()=%s", err)
+	}
+
+	if s := res.MustString(); s != "slow" {
+		t.Errorf("got %q, want %q", s, "slow")
+	}
+
+	if n := atomic.LoadInt32(&slow); n != 1 {
+		t.Errorf("got %d calls of slow, want 1", n)
+	}
+}
+
+func TestMethod_DeduplicateRetry(t *testing.T) {
+	k := New("testkite", "0.0.1")
+	k.Config.DisableAuthentication = true
+
+	var calls int32
+
+	// The first call takes longer than an attempt may take.
+	k.HandleFunc("create", func(r *Request) (interface{}, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			time.Sleep(300 * time.Millisecond)
+		}
+		return "created", nil
+	}).Deduplicate(time.Minute)
+
+	go k.Run()
+	defer k.Close()
+	<-k.ServerReadyNotify()
+
+	c := New("exp", "0.0.1").NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", k.Port())).WithRetry(&RetryPolicy{
+		MaxAttempts:     10,
+		InitialInterval: 50 * time.Millisecond,
+		MaxInterval:     50 * time.Millisecond,
+		AttemptTimeout:  100 * time.Millisecond,
+	})
+
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Not retried without a key, as create is not idempotent.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if _, err := c.TellWithContext(ctx, "create"); err == nil {
+		t.Fatal("expected the call to time out")
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	atomic.StoreInt32(&calls, 0)
+
+	res, err := c.TellWithContext(ContextWithIdempotencyKey(context.Background(), "key"), "create")
+	if err != nil {
+		t.Fatalf("TellWithContext()=%s", err)
+	}
+
+	if s := res.MustString(); s != "created" {
+		t.Errorf("got %q, want %q", s, "created")
+	}
+
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("got %d calls, want 1", n)
+	}
+}
+
+func TestKite_ServeCallIdempotencyKey(t *testing.T) {
+	k := New("testkite", "0.0.1")
+	k.Config.DisableAuthentication = true
+
+	var calls int32
+
+	k.HandleFunc("create", func(r *Request) (interface{}, error) {
+		return atomic.AddInt32(&calls, 1), nil
+	}).Deduplicate(time.Minute)
+
+	for i := 0; i < 3; i++ {
+		req, err := http.NewRequest("POST", "/create", strings.NewReader("[]"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Idempotency-Key", "key")
+
+		res, kerr := k.ServeCall(context.Background(), &Call{
+			Method:  "create",
+			Request: req,
+		})
+		if kerr != nil {
+			t.Fatalf("%d: ServeCall()=%s", i, kerr)
+		}
+
+		p, e := json.Marshal(res)
+		if e != nil {
+			t.Fatalf("%d: Marshal()=%s", i, e)
+		}
+
+		if string(p) != "1" {
+			t.Errorf("%d: got %s, want 1", i, p)
+		}
+	}
+}
+
+func TestMethod_DeduplicateExpired(t *testing.T) {
+	k := New("testkite", "0.0.1")
+	k.Config.DisableAuthentication = true
+
+	var calls int32
+
+	k.HandleFunc("create", func(r *Request) (interface{}, error) {
+		return atomic.AddInt32(&calls, 1), nil
+	}).Deduplicate(time.Minute)
+
+	call := func(ctx context.Context) (interface{}, *Error) {
+		return k.ServeCall(ContextWithIdempotencyKey(ctx, "key"), &Call{Method: "create"})
+	}
+
+	// The first call is received after its deadline, so it is not executed.
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+
+	if _, err := call(ctx); !errors.Is(err, ErrDeadlineExceeded) {
+		t.Fatalf("got %v, want %v", err, ErrDeadlineExceeded)
+	}
+
+	if n := atomic.LoadInt32(&calls); n != 0 {
+		t.Fatalf("got %d calls, want 0", n)
+	}
+
+	res, err := call(context.Background())
+	if err != nil {
+		t.Fatalf("ServeCall()=%s", err)
+	}
+
+	if n, ok := res.(int32); !ok || n != 1 {
+		t.Errorf("got %v, want the duplicate to be executed", res)
+	}
+}
+
+func TestMethod_DeduplicateCanceled(t *testing.T) {
+	k := New("testkite", "0.0.1")
+	k.Config.DisableAuthentication = true
+
+	var calls int32
+	started, release := make(chan struct{}), make(chan struct{})
+
+	// The handler does not watch the context of the request,
+	// so it keeps running after the caller went away.
+	k.HandleFunc("create", func(r *Request) (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		close(started)
+		<-release
+		return "created", nil
+	}).Deduplicate(time.Minute).Timeout(time.Minute)
+
+	call := func(ctx context.Context) (interface{}, *Error) {
+		return k.ServeCall(ContextWithIdempotencyKey(ctx, "key"), &Call{Method: "create"})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan *Error, 1)
+	go func() {
+		_, err := call(ctx)
+		done <- err
+	}()
+
+	<-started
+	cancel()
+
+	if err := <-done; err == nil {
+		t.Fatal("expected the canceled call to fail")
+	}
+
+	// The retry is not executed while the first call is still running.
+	if _, err := call(context.Background()); err == nil || !errors.Is(err, ErrCallInProgress) {
+		t.Fatalf("got %v, want %v", err, ErrCallInProgress)
+	}
+
+	close(release)
+
+	var res interface{}
+	var err *Error
+
+	for deadline := time.Now().Add(4 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if res, err = call(context.Background()); err == nil || !errors.Is(err, ErrCallInProgress) {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the first call to finish")
+		}
+	}
+
+	if err != nil {
+		t.Fatalf("ServeCall()=%s", err)
+	}
+
+	p, e := json.Marshal(res)
+	if e != nil {
+		t.Fatalf("Marshal()=%s", e)
+	}
+
+	if string(p) != `"created"` {
+		t.Errorf("got %s, want the response of the first call", p)
+	}
+
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("got %d calls, want 1", n)
+	}
+}
+
+func TestMethod_DeduplicateLongerThanTTL(t *testing.T) {
+	k := New("testkite", "0.0.1")
+	k.Config.DisableAuthentication = true
+
+	var calls int32
+	started, release := make(chan struct{}), make(chan struct{})
+
+	k.HandleFunc("create", func(r *Request) (interface{}, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			close(started)
+			<-release
+		}
+		return "created", nil
+	}).Deduplicate(50 * time.Millisecond)
+
+	call := func() (interface{}, *Error) {
+		return k.ServeCall(ContextWithIdempotencyKey(context.Background(), "key"), &Call{Method: "create"})
+	}
+
+	done := make(chan *Error, 1)
+	go func() {
+		_, err := call()
+		done <- err
+	}()
+
+	<-started
+
+	// The call runs longer than the ttl, its duplicates are still
+	// not executed.
+	time.Sleep(200 * time.Millisecond)
+
+	if _, err := call(); err == nil || !errors.Is(err, ErrCallInProgress) {
+		t.Fatalf("got %v, want %v", err, ErrCallInProgress)
+	}
+
+	close(release)
+
+	if err := <-done; err != nil {
+		t.Fatalf("ServeCall()=%s", err)
+	}
+
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("got %d calls, want 1", n)
+	}
+}
@@ -0,0 +1,264 @@
+package kite
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// MethodInfo describes a method of a kite, see (*Kite).MethodInfos.
+type MethodInfo struct {
+	// Name is the name of the method, or the pattern
+	// it is registered with.
+	Name string `json:"name"`
+
+	// Authenticated is true if callers must be authenticated.
+	Authenticated bool `json:"authenticated"`
+
+	// Scopes the callers must be granted, see (*Method).RequireScope.
+	Scopes []string `json:"scopes,omitempty"`
+
+	// Throttle is the throttle of the method, see (*Method).Throttle.
+	Throttle *ThrottleInfo `json:"throttle,omitempty"`
+
+	// ThrottleBy is the throttle of the method per key,
+	// see (*Method).ThrottleBy.
+	ThrottleBy *ThrottleInfo `json:"throttleBy,omitempty"`
+
+	MaxConcurrent int           `json:"maxConcurrent,omitempty"`
+	MaxQueued     int           `json:"maxQueued,omitempty"`
+	Timeout       time.Duration `json:"timeout,omitempty"` // in nanoseconds
+
+	// Deduplicate is the time the responses of the calls with idempotency
+	// keys are kept for, see (*Method).Deduplicate.
+	Deduplicate time.Duration `json:"deduplicate,omitempty"` // in nanoseconds
+
+	// Ordered is the key the responses to the calls are ordered
+	// by, see (*Method).Ordered.
+	Ordered string `json:"ordered,omitempty"`
+
+	// Args and Result are the JSON schemas of the argument and the result
+	// of the method, see (*Method).Schema. They are nil if unknown.
+	Args   map[string]interface{} `json:"args,omitempty"`
+	Result map[string]interface{} `json:"result,omitempty"`
+}
+
+// ThrottleInfo describes the token bucket a method is throttled with.
+type ThrottleInfo struct {
+	FillInterval time.Duration `json:"fillInterval"` // in nanoseconds
+	Capacity     int64         `json:"capacity"`
+}
+
+// MethodInfos describes the methods registered with the kite, sorted by
+// name. They are served by the kite.methods method, so tools can discover
+// what a kite can do.
+func (k *Kite) MethodInfos() []MethodInfo {
+	t := k.methodTable()
+
+	infos := make([]MethodInfo, 0, len(t.handlers)+len(t.patterns))
+	for _, m := range t.handlers {
+		infos = append(infos, m.info())
+	}
+
+	for _, m := range t.patterns {
+		infos = append(infos, m.info())
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+
+	return infos
+}
+
+// info describes the method.
+func (m *Method) info() MethodInfo {
+	m.mu.Lock()
+	info := MethodInfo{
+		Name:          m.name,
+		Authenticated: m.authenticate,
+		Scopes:        m.scopes,
+		MaxConcurrent: m.maxConcurrent,
+		MaxQueued:     m.maxQueued,
+		Timeout:       m.timeout,
+		Deduplicate:   m.dedupTTL,
+		Ordered:       m.orderKey,
+	}
+	kb := m.keyedBucket
+	m.mu.Unlock()
+
+	if t := m.getThrottle(); t != nil {
+		info.Throttle = &ThrottleInfo{
+			FillInterval: t.fillInterval,
+			Capacity:     t.capacity,
+		}
+	}
+
+	if kb != nil {
+		info.ThrottleBy = &ThrottleInfo{
+			FillInterval: kb.fillInterval,
+			Capacity:     kb.capacity,
+		}
+	}
+
+	if h, ok := m.handler.(*typedHandler); ok {
+		if h.argType != nil {
+			info.Args = jsonSchema(h.argType, make(map[reflect.Type]bool))
+		}
+
+		if h.resultType != nil {
+			info.Result = jsonSchema(h.resultType, make(map[reflect.Type]bool))
+		}
+	}
+
+	if m.argsSchema != nil {
+		info.Args = m.argsSchema
+	}
+
+	if m.resultSchema != nil {
+		info.Result = m.resultSchema
+	}
+
+	return info
+}
+
+// Schema describes the argument and the result of the method with JSON
+// schemas, which are served by kite.methods, see MethodInfo, and used
+// to generate OpenAPI documents, see the gateway package. The schemas
+// of the methods registered with HandleTyped are derived from the types
+// of their handlers, Schema overrides them.
+//
+// The args and result are either JSON schemas of map[string]interface{}
+// type, or values of the types the schemas are derived from, e.g.:
+//
+//	k.HandleFunc("square", square).Schema(float64(0), float64(0))
+//
+// A nil args or result leaves the respective schema unchanged.
+func (m *Method) Schema(args, result interface{}) *Method {
+	if args != nil {
+		m.argsSchema = schemaOf(args)
+	}
+
+	if result != nil {
+		m.resultSchema = schemaOf(result)
+	}
+
+	return m
+}
+
+// schemaOf gives v if it is a JSON schema, or the schema of its type.
+func schemaOf(v interface{}) map[string]interface{} {
+	if schema, ok := v.(map[string]interface{}); ok {
+		return schema
+	}
+
+	return jsonSchema(reflect.TypeOf(v), make(map[reflect.Type]bool))
+}
+
+var (
+	timeType          = reflect.TypeOf(time.Time{})
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+)
+
+// jsonSchema gives the JSON schema of the values of type t encoded
+// with encoding/json. Types with custom encoding and recursive types
+// are described with an empty schema, which matches any value.
+func jsonSchema(t reflect.Type, seen map[reflect.Type]bool) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t.Implements(jsonMarshalerType) || reflect.PtrTo(t).Implements(jsonMarshalerType):
+		return map[string]interface{}{}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "contentEncoding": "base64"}
+		}
+
+		return map[string]interface{}{"type": "array", "items": jsonSchema(t.Elem(), seen)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": jsonSchema(t.Elem(), seen)}
+	case reflect.Struct:
+		if seen[t] {
+			return map[string]interface{}{}
+		}
+
+		seen[t] = true
+		defer delete(seen, t)
+
+		properties := make(map[string]interface{})
+		var required []string
+
+		structSchema(t, seen, properties, &required)
+
+		schema := map[string]interface{}{"type": "object", "properties": properties}
+		if len(required) != 0 {
+			sort.Strings(required)
+			schema["required"] = required
+		}
+
+		return schema
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+// structSchema adds the schemas of the fields of the struct to properties,
+// the fields of embedded structs are added like encoding/json encodes them.
+// Fields without the omitempty option, or with the required validate
+// rule, are required.
+func structSchema(t reflect.Type, seen map[reflect.Type]bool, properties map[string]interface{}, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+
+		name, opts, _ := strings.Cut(tag, ",")
+
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+
+			if ft.Kind() == reflect.Struct {
+				structSchema(ft, seen, properties, required)
+				continue
+			}
+		}
+
+		if !f.IsExported() {
+			continue
+		}
+
+		if name == "" {
+			name = f.Name
+		}
+
+		properties[name] = jsonSchema(f.Type, seen)
+
+		if !strings.Contains(opts, "omitempty") || hasRule(f.Tag.Get("validate"), "required") {
+			*required = append(*required, name)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package kite
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestKite_MethodInfos(t *testing.T) {
+	k := New("testkite", "0.0.1")
+	k.HandleFunc("square", func(r *Request) (interface{}, error) { return nil, nil }).
+		RequireScope("write").
+		Schema(float64(0), map[string]interface{}{"type": "number", "minimum": 0.0})
+	k.HandleTyped("divide", func(ctx context.Context, args struct {
+		Dividend float64  `json:"dividend"`
+		Divisor  float64  `json:"divisor,omitempty"`
+		Tags     []string `json:"tags,omitempty"`
+		Ignored  string   `json:"-"`
+	}) (float64, error) {
+		return 0, nil
+	})
+
+	methods := make(map[string]MethodInfo)
+	for _, info := range k.MethodInfos() {
+		methods[info.Name] = info
+	}
+
+	want := map[string]MethodInfo{
+		"square": {
+			Name:          "square",
+			Authenticated: true,
+			Scopes:        []string{"write"},
+			Args:          map[string]interface{}{"type": "number"},
+			Result:        map[string]interface{}{"type": "number", "minimum": 0.0},
+		},
+		"divide": {
+			Name:          "divide",
+			Authenticated: true,
+			Args: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"dividend": map[string]interface{}{"type": "number"},
+					"divisor":  map[string]interface{}{"type": "number"},
+					"tags": map[string]interface{}{
+						"type":  "array",
+						"items": map[string]interface{}{"type": "string"},
+					},
+				},
+				"required": []string{"dividend"},
+			},
+			Result: map[string]interface{}{"type": "number"},
+		},
+	}
+
+	for name, info := range want {
+		if got := methods[name]; !reflect.DeepEqual(got, info) {
+			t.Errorf("%s: got %+v, want %+v", name, got, info)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package kite
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// ipFilterListener filters the connections accepted by the kite server
+// by the IP addresses of their peers, before any HTTP or dnode processing
+// happens. It closes the connections from addresses that are denied with
+// Config.DeniedIPs or not allowed with Config.AllowedIPs, and the ones
+// over the Config.MaxConnsPerIP limit.
+type ipFilterListener struct {
+	net.Listener
+	k *Kite
+}
+
+func (k *Kite) newIPFilterListener(l net.Listener) net.Listener {
+	return &ipFilterListener{Listener: l, k: k}
+}
+
+func (l *ipFilterListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		// Connections that are not made over TCP,
+		// e.g. over Unix domain sockets, are accepted.
+		addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+		if !ok {
+			return conn, nil
+		}
+
+		if !l.k.allowsIP(addr.IP) {
+			l.k.Log.Debug("Refused connection from %s: address is not allowed", addr)
+			conn.Close()
+			continue
+		}
+
+		ip := addr.IP.String()
+
+		if !l.k.acquireIPConn(ip) {
+			l.k.Log.Debug("Refused connection from %s: too many connections", addr)
+			conn.Close()
+			continue
+		}
+
+		return &ipFilterConn{Conn: conn, release: func() { l.k.releaseIPConn(ip) }}, nil
+	}
+}
+
+// ipFilterConn releases its slot of the per-IP limit upon Close.
+type ipFilterConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *ipFilterConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+// acquireIPConn counts a new connection from the IP address, unless
+// it would exceed Config.MaxConnsPerIP.
+func (k *Kite) acquireIPConn(ip string) bool {
+	max := int(atomic.LoadInt32(&k.maxConnsPerIP))
+
+	k.ipConnsMu.Lock()
+	defer k.ipConnsMu.Unlock()
+
+	if max > 0 && k.ipConns[ip] >= max {
+		return false
+	}
+
+	if k.ipConns == nil {
+		k.ipConns = make(map[string]int)
+	}
+
+	k.ipConns[ip]++
+
+	return true
+}
+
+func (k *Kite) releaseIPConn(ip string) {
+	k.ipConnsMu.Lock()
+	defer k.ipConnsMu.Unlock()
+
+	if k.ipConns[ip]--; k.ipConns[ip] <= 0 {
+		delete(k.ipConns, ip)
+	}
+}
+
+// setIPFilter applies parsed Config.AllowedIPs, Config.DeniedIPs
+// and Config.MaxConnsPerIP.
+func (k *Kite) setIPFilter(allowed, denied []*net.IPNet, maxConnsPerIP int) {
+	k.allowedIPs.Store(allowed)
+	k.deniedIPs.Store(denied)
+	atomic.StoreInt32(&k.maxConnsPerIP, int32(maxConnsPerIP))
+}
@@ -0,0 +1,72 @@
+package kite
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/igm/sockjs-go/sockjs"
+)
+
+// LastActivity gives the time a message was last received from
+// the remote kite over the current session, or the session was
+// established if nothing was received yet. It gives zero time
+// if the client was never connected.
+func (c *Client) LastActivity() time.Time {
+	if n := atomic.LoadInt64(&c.lastActivity); n != 0 {
+		return time.Unix(0, n)
+	}
+
+	return time.Time{}
+}
+
+func (c *Client) touch() {
+	atomic.StoreInt64(&c.lastActivity, time.Now().UnixNano())
+}
+
+// keepAlive pings the remote kite whenever nothing was received over
+// the session for Config.PingInterval and closes the session if the
+// remote kite does not respond within Config.PongTimeout, so the client
+// can reconnect. It returns when ctx, the context of the session, is done.
+func (c *Client) keepAlive(ctx context.Context, session sockjs.Session) {
+	cfg := c.config()
+
+	if cfg.PingInterval <= 0 {
+		return
+	}
+
+	timeout := cfg.PongTimeout
+	if timeout <= 0 {
+		timeout = cfg.Timeout
+	}
+
+	t := time.NewTicker(cfg.PingInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		if time.Since(c.LastActivity()) < cfg.PingInterval {
+			continue
+		}
+
+		// Any response counts, e.g. an error of a remote kite
+		// which does not handle pings.
+		start := time.Now()
+		c.TellWithTimeout("kite.ping", timeout)
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		if c.LastActivity().Before(start) {
+			c.LocalKite.Log.Warning("Closing session with %s: no response to ping within %s", c.Kite.Name, timeout)
+			session.Close(3000, "ping timeout")
+			return
+		}
+	}
+}
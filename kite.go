@@ -5,8 +5,12 @@ package kite
 
 import (
 	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
 	"crypto/rsa"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
@@ -15,9 +19,11 @@ import (
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/koding/kite/config"
+	"github.com/koding/kite/grpcsession"
 	"github.com/koding/kite/kitekey"
 	"github.com/koding/kite/protocol"
 
@@ -27,6 +33,7 @@ import (
 	"github.com/koding/cache"
 	"github.com/koding/kite/sockjsclient"
 	uuid "github.com/satori/go.uuid"
+	"google.golang.org/grpc"
 )
 
 var hostname string
@@ -64,6 +71,17 @@ type Kite struct {
 	// Keys are the authentication types (options.auth.type).
 	Authenticators map[string]func(*Request) error
 
+	// ScopesFromClaims gives the scopes granted by the claims of a token
+	// or kite key the request was authenticated with. The scopes are
+	// checked against the ones required with (*Method).RequireScope.
+	// If nil, ScopesClaim is used.
+	ScopesFromClaims func(claims jwt.MapClaims) []string
+
+	// UsernameFromCert gives the username of the user authenticated
+	// with a TLS client certificate, see RequireClientCert.
+	// If nil, CertUsername is used.
+	UsernameFromCert func(cert *x509.Certificate) (string, error)
+
 	// ClientFunc is used as the default value for kite.Client.ClientFunc.
 	// If nil, a default ClientFunc will be used.
 	//
@@ -71,28 +89,127 @@ type Kite struct {
 	ClientFunc func(*sockjsclient.DialOptions) *http.Client
 
 	// Handlers added with Kite.HandleFunc().
-	handlers     map[string]*Method // method map for exported methods
-	preHandlers  []Handler          // a list of handlers that are executed before any handler
-	postHandlers []Handler          // a list of handlers that are executed after any handler
-	finalFuncs   []FinalFunc        // a list of funcs executed after any handler regardless of the error
+	methodsMu    sync.Mutex   // serializes updates of methods
+	methods      atomic.Value // registered methods (*methodTable), copied on write
+	chainMu      sync.RWMutex // protects the handler slices below
+	chainGen     uint64       // incremented when the handlers below change, accessed atomically
+	preHandlers  []Handler    // a list of handlers that are executed before any handler
+	postHandlers []Handler    // a list of handlers that are executed after any handler
+	finalFuncs   []FinalFunc  // a list of funcs executed after any handler regardless of the error
 
 	// MethodHandling defines how the kite is returning the response for
-	// multiple handlers
+	// multiple handlers. It is set for the methods when they are registered,
+	// Method.Handling overrides it per method.
 	MethodHandling MethodHandling
 
+	// PanicHandler, if non-nil, is called when a method handler panics.
+	// The recovered value and the stack trace of the panicking goroutine
+	// are passed along. The caller receives an error of "panicError" type
+	// regardless of the PanicHandler.
+	PanicHandler func(r *Request, recovered interface{}, stack []byte)
+
+	// RateLimiter, if non-nil, keeps the token buckets of the methods
+	// throttled with Throttle and ThrottleBy, instead of the kite's memory.
+	// It allows sharing the limits by all replicas of the kite, e.g. with
+	// the redislimit package. Calls are allowed if the RateLimiter fails.
+	RateLimiter RateLimiter
+
+	// IdempotencyStore, if non-nil, keeps the responses of the methods
+	// deduplicated with Deduplicate, instead of the kite's memory. It
+	// allows deduplicating calls received by any replica of the kite.
+	// Calls are executed as usual if the IdempotencyStore fails.
+	IdempotencyStore IdempotencyStore
+
+	// NonceStore, if non-nil, keeps the nonces of the requests authenticated
+	// with tokens, instead of the kite's memory, see Config.ReplayWindow.
+	// It allows rejecting requests replayed to any replica of the kite.
+	// Requests are rejected if the NonceStore fails.
+	NonceStore NonceStore
+
+	// ReadConfig gives the configuration applied with ReloadConfig, when
+	// the kite receives SIGHUP (see SetupReloadHandler) or its
+	// "kite.reloadConfig" method is called. If nil, config.Get is used.
+	ReadConfig func() (*config.Config, error)
+
+	// DialSession, if non-nil, is used for establishing sessions of the
+	// clients of the kite, which do not set their own Client.DialSession,
+	// including the client of Kontrol. It is used e.g. for connecting to
+	// the fakes of the kitefake package.
+	DialSession func(c *Client, timeout time.Duration) (sockjs.Session, error)
+
 	// HTTP muxer
 	muxer *mux.Router
 
+	// grpcServer serves sessions of clients that use gRPC transport
+	grpcServer *grpc.Server
+
+	// workers executes method calls, if the number of their
+	// goroutines is limited
+	workers     *workerPool
+	workersOnce sync.Once
+
 	// kontrolclient is used to register to kontrol and query third party kites
 	// from kontrol
 	kontrol *kontrolClient
 
 	// kontrolKey stores parsed Config.KontrolKey
-	kontrolKey *rsa.PublicKey
+	kontrolKey crypto.PublicKey
+
+	// kontrolKeys stores parsed Config.KontrolKey and Config.KontrolKeys
+	// by their key IDs
+	kontrolKeys map[string]crypto.PublicKey
+
+	// revocations holds revoked kite keys and tokens
+	revocations revocations
+
+	// idempotency keeps the records of deduplicated calls
+	// if IdempotencyStore is nil
+	idempotency     IdempotencyStore
+	idempotencyOnce sync.Once
+
+	// nonces keeps the nonces of token authenticated
+	// requests if NonceStore is nil
+	nonces     NonceStore
+	noncesOnce sync.Once
+
+	// proofKey signs the nonces of the requests authenticated with
+	// tokens, Kontrol binds the tokens it issues to its public part
+	proofKey     ed25519.PrivateKey
+	proofKeyOnce sync.Once
 
 	// configMu protects access to Config.{Kite,Kontrol}Key fields.
 	configMu sync.RWMutex
 
+	// reloadMu serializes configuration reloads
+	reloadMu sync.Mutex
+
+	// allowedIPs holds parsed Config.AllowedIPs ([]*net.IPNet)
+	allowedIPs atomic.Value
+
+	// deniedIPs holds parsed Config.DeniedIPs ([]*net.IPNet)
+	deniedIPs atomic.Value
+
+	// maxConnsPerIP holds Config.MaxConnsPerIP, accessed atomically
+	maxConnsPerIP int32
+
+	// ipConns counts the connections accepted from IP addresses,
+	// see ipFilterListener
+	ipConnsMu sync.Mutex
+	ipConns   map[string]int
+
+	// restart holds the state inherited from the process
+	// the kite was restarted from, see Restart
+	restart *restartState
+
+	// tlsReloaded holds the TLS configuration with the reloaded
+	// certificate (*tls.Config)
+	tlsReloaded atomic.Value
+
+	// secretsCancel stops refreshing the secrets, it is non-nil
+	// once they are loaded, see LoadSecrets
+	secretsMu     sync.Mutex
+	secretsCancel context.CancelFunc
+
 	// verifyCache is used as a cache for verify method.
 	//
 	// The field is set by verifyInit method.
@@ -132,6 +249,15 @@ type Kite struct {
 	// registers successfully to Kontrol
 	onRegisterHandlers []func(*protocol.RegisterResult)
 
+	// Handlers to call after a method call has finished.
+	onResponseHandlers []func(*Request, time.Duration, *Error)
+
+	// Handlers to call when a handler chain fails.
+	onErrorHandlers []ErrorFunc
+
+	// Handlers to call when secrets are got from Config.SecretsProvider.
+	onSecretsHandlers []func(*config.Secrets)
+
 	// handlersMu protects access to on*Handlers fields.
 	handlersMu sync.RWMutex
 
@@ -140,12 +266,40 @@ type Kite struct {
 	// new heartbeats; sending nil value stops heartbeats
 	heartbeatC chan *heartbeatReq
 
+	// calls is used to wait for in-flight method calls
+	// during Shutdown.
+	calls sync.WaitGroup
+
+	// draining is true when the kite is being shut down,
+	// no new method calls are accepted then.
+	draining bool
+	callsMu  sync.Mutex // protects draining and calls.Add
+
+	// healthChecks are checks added with AddHealthCheck
+	healthChecks []healthCheck
+	healthMu     sync.Mutex
+
+	// clients holds connected clients, so Shutdown can close
+	// their sessions.
+	clients   map[*Client]struct{}
+	clientsMu sync.Mutex
+
+	// reverse holds clients of kites connected with DialReverse,
+	// keyed by kite ID, tunnels holds the tunnels to them waiting
+	// to be joined with relayed sessions, keyed by token.
+	reverse    map[string]*Client
+	tunnels    map[string]*reverseTunnel
+	relayStats map[string]*RelayStats // keyed by kite ID
+	reverseMu  sync.Mutex
+
 	// server fields, are initialized and used when
 	// TODO: move them to their own struct, just like KontrolClient
-	listener  *gracefulListener
-	TLSConfig *tls.Config
-	readyC    chan bool // To signal when kite is ready to accept connections
-	closeC    chan bool // To signal when kite is closed with Close()
+	listener   *gracefulListener
+	extra      []*gracefulListener // listeners of Config.Listeners
+	listenerMu sync.Mutex          // protects listener and extra
+	TLSConfig  *tls.Config
+	readyC     chan bool // To signal when kite is ready to accept connections
+	closeC     chan bool // To signal when kite is closed with Close()
 
 	name    string
 	version string
@@ -186,7 +340,6 @@ func NewWithConfig(name, version string, cfg *config.Config) *Kite {
 		Log:            l,
 		SetLogLevel:    setlevel,
 		Authenticators: make(map[string]func(*Request) error),
-		handlers:       make(map[string]*Method),
 		kontrol:        kClient,
 		name:           name,
 		version:        version,
@@ -197,14 +350,37 @@ func NewWithConfig(name, version string, cfg *config.Config) *Kite {
 		muxer:          mux.NewRouter(),
 	}
 
+	// Take over the listener and the ID of the kite restarted with Restart.
+	if id, state, err := inheritRestartState(); err != nil {
+		k.Log.Error("Unable to take over the restarted kite: %s", err)
+	} else if state != nil {
+		k.Id, k.restart = id, state
+	}
+
 	// All sockjs communication is done through this endpoint..
-	k.muxer.PathPrefix("/kite").Handler(sockjs.NewHandler("/kite", *cfg.SockJS, k.sockjsHandler))
+	k.muxer.PathPrefix("/kite").Handler(limitRequestSize(sockjs.NewHandler("/kite", sockjsOptions(cfg), k.acceptSession), cfg.MaxRequestSize))
+
+	// Health checks for load balancers and orchestrators.
+	k.muxer.HandleFunc("/healthz", k.handleHealthz)
+	k.muxer.HandleFunc("/readyz", k.handleReadyz)
+
+	// Sessions of the gRPC transport are dispatched in ServeHTTP.
+	var grpcOpts []grpc.ServerOption
+	if cfg.MaxRequestSize > 0 {
+		grpcOpts = append(grpcOpts, grpc.MaxRecvMsgSize(int(cfg.MaxRequestSize)))
+	}
+
+	k.grpcServer = grpcsession.NewServer(k.acceptSession, grpcOpts...)
 
 	// Add useful debug logs
 	k.OnConnect(func(c *Client) { k.Log.Debug("New session: %s", c.session.ID()) })
 	k.OnFirstRequest(func(c *Client) { k.Log.Debug("Session %q is identified as %q", c.session.ID(), c.Kite) })
 	k.OnDisconnect(func(c *Client) { k.Log.Debug("Kite has disconnected: %q", c.Kite) })
+	k.OnResponse(func(r *Request, elapsed time.Duration, err *Error) {
+		WithFields(r.Logger(), "duration", elapsed).Debug("Method is called (error: %v)", err)
+	})
 	k.OnRegister(k.updateAuth)
+	k.OnRegister(func(*protocol.RegisterResult) { atomic.StoreInt32(&kClient.registered, 1) })
 
 	// Every kite should be able to authenticate the user from token.
 	// Tokens are granted by Kontrol Kite.
@@ -213,6 +389,10 @@ func NewWithConfig(name, version string, cfg *config.Config) *Kite {
 	// A kite accepts requests with the same username.
 	k.Authenticators["kiteKey"] = k.AuthenticateFromKiteKey
 
+	// A kite requiring client certificates accepts requests
+	// authenticated with them.
+	k.Authenticators["tls"] = k.AuthenticateFromCert
+
 	// Register default methods and handlers.
 	k.addDefaultHandlers()
 
@@ -242,10 +422,21 @@ func (k *Kite) KiteKey() string {
 	return k.Config.KiteKey
 }
 
-// KontrolKey gives a Kontrol's public key.
+// KontrolKey gives a Kontrol's public key, if it is an RSA one.
 //
 // The value is taken form kite key's kontrolKey claim.
+//
+// Deprecated: Use KontrolPublicKey instead.
 func (k *Kite) KontrolKey() *rsa.PublicKey {
+	key, _ := k.KontrolPublicKey().(*rsa.PublicKey)
+	return key
+}
+
+// KontrolPublicKey gives a Kontrol's public key, which is either
+// *rsa.PublicKey, *ecdsa.PublicKey or ed25519.PublicKey.
+//
+// The value is taken form kite key's kontrolKey claim.
+func (k *Kite) KontrolPublicKey() crypto.PublicKey {
 	k.configMu.RLock()
 	defer k.configMu.RUnlock()
 
@@ -266,10 +457,33 @@ func (k *Kite) HandleHTTPFunc(pattern string, handler func(http.ResponseWriter,
 
 // ServeHTTP helps Kite to satisfy the http.Handler interface. So kite can be
 // used as a standard http server.
+//
+// HTTP/2 requests of the gRPC transport are served as well, for
+// details see the grpcsession package.
 func (k *Kite) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !k.isAllowedIP(req.RemoteAddr) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	if req.ProtoMajor == 2 && strings.HasPrefix(req.Header.Get("Content-Type"), "application/grpc") {
+		k.grpcServer.ServeHTTP(w, req)
+		return
+	}
+
 	k.muxer.ServeHTTP(w, req)
 }
 
+// ServeSession serves the remote kite connected over the session,
+// the same way kites connected over SockJS are served. It returns
+// after the session is closed.
+//
+// It is meant for serving kites over custom transports, like
+// the in-memory one of the kitetest package.
+func (k *Kite) ServeSession(session sockjs.Session) {
+	k.sockjsHandler(session)
+}
+
 func (k *Kite) sockjsHandler(session sockjs.Session) {
 	defer session.Close(3000, "Go away!")
 
@@ -282,11 +496,18 @@ func (k *Kite) sockjsHandler(session sockjs.Session) {
 	c.wg.Add(1)
 	go c.sendHub()
 
+	k.addClient(c)
+	defer k.removeClient(c)
+
+	c.setState(&ConnectionEvent{State: StateConnected})
 	k.callOnConnectHandlers(c)
 
 	// Run after methods are registered and delegate is set
-	c.readLoop()
+	err := c.readLoop()
 
+	c.cancelSession()
+	c.scrubber.RemoveAll()
+	c.setDisconnected(err)
 	c.callOnDisconnectHandlers()
 	k.callOnDisconnectHandlers(c)
 }
@@ -322,6 +543,29 @@ func (k *Kite) OnRegister(handler func(*protocol.RegisterResult)) {
 	k.handlersMu.Unlock()
 }
 
+// OnResponse registers a callback which is called after a method call
+// has finished and the response was sent back to the caller. The callback
+// is passed the request, the time it took to handle it and the returned
+// error, if any. Rejected calls, e.g. due to failed authentication or
+// throttling, are reported as well.
+func (k *Kite) OnResponse(handler func(r *Request, elapsed time.Duration, err *Error)) {
+	k.handlersMu.Lock()
+	k.onResponseHandlers = append(k.onResponseHandlers, handler)
+	k.handlersMu.Unlock()
+}
+
+// OnError registers a callback which is called whenever the handler chain
+// of a method fails, with the request and the error returned to the caller,
+// so the errors can be reported in one place, e.g. to an error tracker.
+// Calls rejected before the handler chain is executed, e.g. due to failed
+// authentication or throttling, are not reported, see OnResponse.
+// See Method.OnError for callbacks of a single method.
+func (k *Kite) OnError(handler ErrorFunc) {
+	k.handlersMu.Lock()
+	k.onErrorHandlers = append(k.onErrorHandlers, handler)
+	k.handlersMu.Unlock()
+}
+
 func (k *Kite) callOnConnectHandlers(c *Client) {
 	k.handlersMu.RLock()
 	defer k.handlersMu.RUnlock()
@@ -370,6 +614,30 @@ func (k *Kite) callOnRegisterHandlers(r *protocol.RegisterResult) {
 	}
 }
 
+func (k *Kite) callOnResponseHandlers(r *Request, elapsed time.Duration, err *Error) {
+	k.handlersMu.RLock()
+	defer k.handlersMu.RUnlock()
+
+	for _, handler := range k.onResponseHandlers {
+		func() {
+			defer nopRecover()
+			handler(r, elapsed, err)
+		}()
+	}
+}
+
+func (k *Kite) callOnErrorHandlers(r *Request, err error) {
+	k.handlersMu.RLock()
+	defer k.handlersMu.RUnlock()
+
+	for _, handler := range k.onErrorHandlers {
+		func() {
+			defer nopRecover()
+			handler(r, err)
+		}()
+	}
+}
+
 func (k *Kite) updateAuth(reg *protocol.RegisterResult) {
 	k.configMu.Lock()
 	defer k.configMu.Unlock()
@@ -397,31 +665,52 @@ func (k *Kite) updateAuth(reg *protocol.RegisterResult) {
 	// Use it now.
 	if reg.PublicKey != "" {
 		k.Config.KontrolKey = reg.PublicKey
+	}
 
-		key, err := jwt.ParseRSAPublicKeyFromPEM([]byte(reg.PublicKey))
-		if err != nil {
+	// Trust all the keys of Kontrol, so tokens signed with
+	// rotated keys are still accepted.
+	if len(reg.Keys) != 0 {
+		k.Config.KontrolKeys = reg.Keys
+	}
+
+	if reg.PublicKey != "" || len(reg.Keys) != 0 {
+		if err := k.initKontrolKeys(); err != nil {
 			k.Log.Error("auth update: unable to update kontrol key: %s", err)
 
 			return
 		}
-
-		k.kontrolKey = key
 	}
 }
 
 // RSAKey returns the corresponding public key for the issuer of the token.
 // It is called by jwt-go package when validating the signature in the token.
+//
+// The key is selected by the "kid" header of the token out of the trusted
+// Config.KontrolKey and Config.KontrolKeys. Tokens without the header are
+// verified with Config.KontrolKey. Despite its name, the method supports
+// RSA, ECDSA and Ed25519 keys.
 func (k *Kite) RSAKey(token *jwt.Token) (interface{}, error) {
 	k.verifyOnce.Do(k.verifyInit)
 
-	kontrolKey := k.KontrolKey()
+	k.configMu.RLock()
+	kontrolKey, kontrolKeys := k.kontrolKey, k.kontrolKeys
+	k.configMu.RUnlock()
 
 	if kontrolKey == nil {
 		panic("kontrol key is not set in config")
 	}
 
-	if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
-		return nil, errors.New("invalid signing method")
+	if kid, ok := token.Header["kid"].(string); ok {
+		if kontrolKey, ok = kontrolKeys[kid]; !ok {
+			// The token was signed with a key that is no longer
+			// trusted, report it like a signature mismatch,
+			// so the token gets renewed.
+			return nil, jwt.NewValidationError("unknown key ID: "+kid, jwt.ValidationErrorSignatureInvalid)
+		}
+	}
+
+	if err := kitekey.VerifyMethod(token, kontrolKey); err != nil {
+		return nil, err
 	}
 
 	claims, ok := token.Claims.(*kitekey.KiteClaims)
@@ -1,23 +1,54 @@
 package kite
 
 import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	cryptorand "crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math"
+	"math/big"
 	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/koding/kite/config"
 	"github.com/koding/kite/dnode"
+	"github.com/koding/kite/kitekey"
 	"github.com/koding/kite/protocol"
 	"github.com/koding/kite/sockjsclient"
-	_ "github.com/koding/kite/testutil"
+	"github.com/koding/kite/testkeys"
+	"github.com/koding/kite/testutil"
 
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/websocket"
 	"github.com/igm/sockjs-go/sockjs"
+	"golang.org/x/crypto/ssh"
 )
 
 func init() {
@@ -203,7 +234,8 @@ func TestConcurrency(t *testing.T) {
 			defer wg.Done()
 			result, err := clients[i].TellWithTimeout("ping", 4*time.Second)
 			if err != nil {
-				t.Fatal(err)
+				t.Error(err)
+				return
 			}
 
 			if result.MustString() != "pong" {
@@ -482,3 +514,2467 @@ func newXhrKite(name, version string) *Kite {
 	k.Config.Transport = config.XHRPolling
 	return k
 }
+
+func TestShutdown(t *testing.T) {
+	k := New("testkite", "0.0.1")
+	k.Config.DisableAuthentication = true
+
+	started := make(chan struct{})
+
+	k.HandleFunc("slow", func(r *Request) (interface{}, error) {
+		close(started)
+		time.Sleep(500 * time.Millisecond)
+		return "done", nil
+	})
+
+	go k.Run()
+	<-k.ServerReadyNotify()
+
+	c := New("exp", "0.0.1").NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", k.Port()))
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	respC := c.GoWithTimeout("slow", 4*time.Second)
+
+	<-started
+
+	if err := k.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown()=%s", err)
+	}
+
+	select {
+	case resp := <-respC:
+		if resp.Err != nil {
+			t.Fatalf("in-flight call failed: %s", resp.Err)
+		}
+
+		if s := resp.Result.MustString(); s != "done" {
+			t.Fatalf("got %q, want %q", s, "done")
+		}
+	case <-time.After(4 * time.Second):
+		t.Fatal("timed out waiting for the in-flight call")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	k := New("testkite", "0.0.1")
+	k.Config.DisableAuthentication = true
+
+	started := make(chan struct{})
+
+	k.HandleFunc("block", func(r *Request) (interface{}, error) {
+		close(started)
+		<-r.Ctx().Done()
+		return nil, r.Ctx().Err()
+	})
+
+	go k.Run()
+	<-k.ServerReadyNotify()
+
+	c := New("exp", "0.0.1").NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", k.Port()))
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.Go("block")
+
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	if err := k.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestShutdownMethodTimeout(t *testing.T) {
+	k := New("testkite", "0.0.1")
+	k.Config.DisableAuthentication = true
+
+	unblock := make(chan struct{})
+	var returned int32
+
+	// The handler ignores the canceled context and keeps
+	// running after the call timed out.
+	k.HandleFunc("stuck", func(r *Request) (interface{}, error) {
+		<-unblock
+		atomic.StoreInt32(&returned, 1)
+		return nil, nil
+	}).Timeout(50 * time.Millisecond)
+
+	go k.Run()
+	<-k.ServerReadyNotify()
+
+	c := New("exp", "0.0.1").NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", k.Port()))
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := c.TellWithTimeout("stuck", 4*time.Second); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("got %v, want %v", err, ErrTimeout)
+	}
+
+	time.AfterFunc(200*time.Millisecond, func() { close(unblock) })
+
+	if err := k.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown()=%s", err)
+	}
+
+	if atomic.LoadInt32(&returned) != 1 {
+		t.Fatal("Shutdown returned before the handler")
+	}
+}
+
+func TestKite_GRPC(t *testing.T) {
+	mathKite := New("mathworker", "0.0.1")
+	mathKite.Config.DisableAuthentication = true
+	mathKite.HandleFunc("square", Square)
+	mathKite.HandleFunc("squareCB", SquareCB)
+	go mathKite.Run()
+	<-mathKite.ServerReadyNotify()
+	defer mathKite.Close()
+
+	exp2Kite := New("exp2", "0.0.1")
+	exp2Kite.Config.Transport = config.GRPC
+	fooChan := make(chan string, 1)
+	exp2Kite.HandleFunc("foo", func(r *Request) (interface{}, error) {
+		fooChan <- r.Args.One().MustString()
+		return nil, nil
+	})
+
+	remote := exp2Kite.NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", mathKite.Port()))
+	if err := remote.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+
+	result, err := remote.TellWithTimeout("square", 4*time.Second, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := result.MustFloat64(); n != 4 {
+		t.Fatalf("got %f, want 4", n)
+	}
+
+	// The mathworker calls foo method back over the same session.
+	select {
+	case s := <-fooChan:
+		if s != "bar" {
+			t.Fatalf("got %q, want %q", s, "bar")
+		}
+	case <-time.After(4 * time.Second):
+		t.Fatal("Did not get the message")
+	}
+
+	resultChan := make(chan float64, 1)
+	resultCallback := func(args *dnode.Partial) {
+		resultChan <- args.One().MustFloat64()
+	}
+
+	if _, err := remote.TellWithTimeout("squareCB", 4*time.Second, 3, dnode.Callback(resultCallback)); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case n := <-resultChan:
+		if n != 9 {
+			t.Fatalf("got %f, want 9", n)
+		}
+	case <-time.After(4 * time.Second):
+		t.Fatal("Did not get the message")
+	}
+}
+
+func TestReconnectPolicy(t *testing.T) {
+	k := New("client", "0.0.1")
+
+	// Nothing listens on the port after the listener is closed.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	c := k.NewClient(fmt.Sprintf("http://%s/kite", l.Addr()))
+	c.ReconnectPolicy = &ReconnectPolicy{
+		InitialInterval: 10 * time.Millisecond,
+		MaxInterval:     20 * time.Millisecond,
+		MaxRetries:      3,
+	}
+
+	var mu sync.Mutex
+	var attempts []int
+	var errs []error
+
+	c.OnReconnectAttempt(func(attempt int, err error) {
+		mu.Lock()
+		attempts = append(attempts, attempt)
+		errs = append(errs, err)
+		mu.Unlock()
+	})
+
+	connected, err := c.DialForever()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-connected:
+	case <-time.After(4 * time.Second):
+		t.Fatal("client did not give up redialing")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if want := []int{1, 2, 3, 4}; !reflect.DeepEqual(attempts, want) {
+		t.Fatalf("got %v attempts, want %v", attempts, want)
+	}
+
+	if errs[0] != nil {
+		t.Fatalf("got %v error for first attempt, want nil", errs[0])
+	}
+
+	for i, err := range errs[1:] {
+		if err == nil {
+			t.Fatalf("got nil error for attempt %d", i+2)
+		}
+	}
+}
+
+func TestKite_Codec(t *testing.T) {
+	mathKite := New("mathworker", "0.0.1")
+	mathKite.Config.DisableAuthentication = true
+	mathKite.HandleFunc("square", Square)
+	mathKite.HandleFunc("squareCB", SquareCB)
+	go mathKite.Run()
+	<-mathKite.ServerReadyNotify()
+	defer mathKite.Close()
+
+	exp2Kite := New("exp2", "0.0.1")
+	exp2Kite.Config.Codec = "msgpack"
+	fooChan := make(chan string, 1)
+	exp2Kite.HandleFunc("foo", func(r *Request) (interface{}, error) {
+		fooChan <- r.Args.One().MustString()
+		return nil, nil
+	})
+
+	remote := exp2Kite.NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", mathKite.Port()))
+
+	connected := make(chan struct{}, 1)
+	remote.OnConnect(func() { connected <- struct{}{} })
+
+	if err := remote.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+
+	select {
+	case <-connected:
+	case <-time.After(4 * time.Second):
+		t.Fatal("client did not connect")
+	}
+
+	if codec := remote.getCodec(); codec != dnode.MsgPack {
+		t.Fatalf("got %q codec, want %q", codec.Name(), dnode.MsgPack.Name())
+	}
+
+	result, err := remote.TellWithTimeout("square", 4*time.Second, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := result.MustFloat64(); n != 4 {
+		t.Fatalf("got %f, want 4", n)
+	}
+
+	// The mathworker calls foo method back with the negotiated codec.
+	select {
+	case s := <-fooChan:
+		if s != "bar" {
+			t.Fatalf("got %q, want %q", s, "bar")
+		}
+	case <-time.After(4 * time.Second):
+		t.Fatal("Did not get the message")
+	}
+
+	resultChan := make(chan float64, 1)
+	resultCallback := func(args *dnode.Partial) {
+		resultChan <- args.One().MustFloat64()
+	}
+
+	if _, err := remote.TellWithTimeout("squareCB", 4*time.Second, 3, dnode.Callback(resultCallback)); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case n := <-resultChan:
+		if n != 9 {
+			t.Fatalf("got %f, want 9", n)
+		}
+	case <-time.After(4 * time.Second):
+		t.Fatal("Did not get the callback")
+	}
+}
+
+func TestCallOptionsOut_MsgPack(t *testing.T) {
+	p, err := dnode.MsgPack.Marshal(callOptionsOut{
+		WithArgs: []interface{}{2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var opts map[string]interface{}
+	if err := dnode.MsgPack.Unmarshal(p, &opts); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := strings.Count(string(p), "withArgs"); n != 1 {
+		t.Fatalf("got withArgs encoded %d times, want 1", n)
+	}
+
+	if args, ok := opts["withArgs"].([]interface{}); !ok || len(args) != 1 {
+		t.Fatalf("got %#v, want a single argument", opts["withArgs"])
+	}
+}
+
+func TestKite_Attachments(t *testing.T) {
+	type Args struct {
+		Name string           `json:"name"`
+		Data dnode.Attachment `json:"data"`
+	}
+
+	k := New("testkite", "0.0.1")
+	k.Config.DisableAuthentication = true
+	k.HandleFunc("reverse", func(r *Request) (interface{}, error) {
+		var args Args
+		if err := r.Args.One().Unmarshal(&args); err != nil {
+			return nil, err
+		}
+
+		p := make(dnode.Attachment, len(args.Data))
+		for i, b := range args.Data {
+			p[len(p)-1-i] = b
+		}
+
+		return map[string]interface{}{"name": args.Name, "data": p}, nil
+	})
+	go k.Run()
+	<-k.ServerReadyNotify()
+	defer k.Close()
+
+	// Not valid UTF-8, so it can't be sent over SockJS as is.
+	data := make([]byte, 256)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	cases := []struct {
+		codec       string
+		attachments bool
+	}{
+		{"", true},
+		{"", false},
+		{"msgpack", true},
+		{"msgpack", false},
+	}
+
+	for _, cas := range cases {
+		c := New("exp", "0.0.1")
+		c.Config.Codec = cas.codec
+		c.Config.Attachments = cas.attachments
+
+		remote := c.NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", k.Port()))
+
+		connected := make(chan struct{}, 1)
+		remote.OnConnect(func() { connected <- struct{}{} })
+
+		if err := remote.Dial(); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case <-connected:
+		case <-time.After(4 * time.Second):
+			t.Fatal("client did not connect")
+		}
+
+		if remote.sendsAttachments() != cas.attachments {
+			t.Errorf("%+v: got %t, want %t", cas, remote.sendsAttachments(), cas.attachments)
+		}
+
+		result, err := remote.TellWithTimeout("reverse", 4*time.Second, &Args{Name: "blob", Data: data})
+		if err != nil {
+			t.Fatalf("%+v: TellWithTimeout()=%s", cas, err)
+		}
+
+		var res struct {
+			Name string `json:"name"`
+			Data []byte `json:"data"`
+		}
+
+		if err := result.Unmarshal(&res); err != nil {
+			t.Fatalf("%+v: Unmarshal()=%s", cas, err)
+		}
+
+		if res.Name != "blob" || len(res.Data) != len(data) {
+			t.Fatalf("%+v: got %q with %d bytes", cas, res.Name, len(res.Data))
+		}
+
+		for i, b := range res.Data {
+			if b != data[len(data)-1-i] {
+				t.Fatalf("%+v: got %d at %d, want %d", cas, b, i, data[len(data)-1-i])
+			}
+		}
+
+		remote.Close()
+	}
+}
+
+func TestKite_Compression(t *testing.T) {
+	// The permessage-deflate extension is configured
+	// when the kite is created.
+	cfg := config.New()
+	cfg.DisableAuthentication = true
+	cfg.Compression.Algorithm = "deflate"
+
+	k := NewWithConfig("testkite", "0.0.1", cfg)
+	k.HandleFunc("echo", func(r *Request) (interface{}, error) {
+		compression := ""
+		if z := r.Client.getCompressor(); z != nil {
+			compression = z.Name()
+		}
+
+		return map[string]interface{}{
+			"compression": compression,
+			"text":        r.Args.One().MustString(),
+		}, nil
+	})
+	go k.Run()
+	<-k.ServerReadyNotify()
+	defer k.Close()
+
+	text := strings.Repeat("kite compression ", 1000)
+
+	cases := []struct {
+		transport   config.Transport
+		codec       string
+		compression string
+		want        string
+		compressed  bool // permessage-deflate
+	}{
+		{config.XHRPolling, "", "deflate", "deflate", false},
+		{config.XHRPolling, "", "zstd", "zstd", false},
+		{config.XHRPolling, "msgpack", "zstd", "zstd", false},
+		{config.XHRPolling, "", "", "", false},
+		{config.WebSocket, "", "zstd", "", true},
+		{config.WebSocket, "", "", "", false},
+	}
+
+	for _, cas := range cases {
+		c := New("exp", "0.0.1")
+		c.Config.Transport = cas.transport
+		c.Config.Codec = cas.codec
+		c.Config.Compression.Algorithm = cas.compression
+		c.Config.Compression.Level = 3
+
+		remote := c.NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", k.Port()))
+
+		connected := make(chan struct{}, 1)
+		remote.OnConnect(func() { connected <- struct{}{} })
+
+		if err := remote.Dial(); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case <-connected:
+		case <-time.After(4 * time.Second):
+			t.Fatal("client did not connect")
+		}
+
+		if got := remote.compressedSession(); got != cas.compressed {
+			t.Errorf("%+v: got %t, want %t", cas, got, cas.compressed)
+		}
+
+		result, err := remote.TellWithTimeout("echo", 4*time.Second, text)
+		if err != nil {
+			t.Fatalf("%+v: TellWithTimeout()=%s", cas, err)
+		}
+
+		var res struct {
+			Compression string `json:"compression"`
+			Text        string `json:"text"`
+		}
+
+		if err := result.Unmarshal(&res); err != nil {
+			t.Fatalf("%+v: Unmarshal()=%s", cas, err)
+		}
+
+		if res.Compression != cas.want {
+			t.Errorf("%+v: got %q, want %q", cas, res.Compression, cas.want)
+		}
+
+		if res.Text != text {
+			t.Fatalf("%+v: got %d bytes of text, want %d", cas, len(res.Text), len(text))
+		}
+
+		remote.Close()
+	}
+}
+
+// countingEncoder is a JSONEncoder counting the encoded
+// and decoded values.
+type countingEncoder struct {
+	marshaled   int64
+	unmarshaled int64
+}
+
+func (e *countingEncoder) Marshal(v interface{}) ([]byte, error) {
+	atomic.AddInt64(&e.marshaled, 1)
+	return json.Marshal(v)
+}
+
+func (e *countingEncoder) Unmarshal(data []byte, v interface{}) error {
+	atomic.AddInt64(&e.unmarshaled, 1)
+	return json.Unmarshal(data, v)
+}
+
+func TestKite_JSONEncoder(t *testing.T) {
+	var server, client countingEncoder
+
+	k := New("testkite", "0.0.1")
+	k.Config.DisableAuthentication = true
+	k.Config.JSONEncoder = &server
+	k.HandleFunc("square", Square)
+	go k.Run()
+	<-k.ServerReadyNotify()
+	defer k.Close()
+
+	c := New("exp", "0.0.1")
+	c.Config.JSONEncoder = &client
+
+	remote := c.NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", k.Port()))
+	if err := remote.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+
+	result, err := remote.TellWithTimeout("square", 4*time.Second, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := result.MustFloat64(); n != 9 {
+		t.Fatalf("got %v, want 9", n)
+	}
+
+	for name, enc := range map[string]*countingEncoder{"server": &server, "client": &client} {
+		if atomic.LoadInt64(&enc.marshaled) == 0 || atomic.LoadInt64(&enc.unmarshaled) == 0 {
+			t.Errorf("%s: encoder was not used: %+v", name, enc)
+		}
+	}
+}
+
+func TestKite_MessageSize(t *testing.T) {
+	// The transport limits are configured when the kite is created.
+	cfg := config.New()
+	cfg.DisableAuthentication = true
+	cfg.MaxRequestSize = 4096
+
+	k := NewWithConfig("testkite", "0.0.1", cfg)
+	k.HandleFunc("echo", func(r *Request) (interface{}, error) {
+		return strings.Repeat(r.Args.One().MustString(), 2), nil
+	})
+	go k.Run()
+	<-k.ServerReadyNotify()
+	defer k.Close()
+
+	cases := []struct {
+		transport   config.Transport
+		compression string
+		size        int
+		ok          bool
+	}{
+		{config.WebSocket, "", 1000, true},
+		{config.WebSocket, "", 3000, false}, // response too large
+		{config.WebSocket, "", 8000, false}, // request too large
+		{config.WebSocket, "zstd", 3000, false},
+		{config.WebSocket, "zstd", 100000, false},
+		{config.XHRPolling, "", 1000, true},
+		{config.XHRPolling, "", 3000, false},
+		{config.XHRPolling, "", 8000, false},
+		{config.XHRPolling, "deflate", 100000, false},
+		{config.GRPC, "", 1000, true},
+		{config.GRPC, "", 3000, false},
+		{config.GRPC, "", 8000, false},
+	}
+
+	for _, cas := range cases {
+		c := New("exp", "0.0.1")
+		c.Config.Transport = cas.transport
+		c.Config.Compression.Algorithm = cas.compression
+		c.Config.MaxResponseSize = 4096
+
+		remote := c.NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", k.Port()))
+
+		connected := make(chan struct{}, 1)
+		remote.OnConnect(func() { connected <- struct{}{} })
+
+		if err := remote.Dial(); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case <-connected:
+		case <-time.After(4 * time.Second):
+			t.Fatal("client did not connect")
+		}
+
+		text := strings.Repeat("a", cas.size)
+
+		result, err := remote.TellWithTimeout("echo", 4*time.Second, text)
+		if cas.ok {
+			if err != nil {
+				t.Fatalf("%+v: TellWithTimeout()=%s", cas, err)
+			}
+
+			if s := result.MustString(); s != text+text {
+				t.Fatalf("%+v: got %d bytes, want %d", cas, len(s), 2*len(text))
+			}
+		} else if err == nil {
+			t.Fatalf("%+v: expected TellWithTimeout to fail", cas)
+		} else if e, ok := err.(*Error); ok && e.Type == "timeout" {
+			t.Fatalf("%+v: expected the session to be closed, got %s", cas, err)
+		}
+
+		remote.Close()
+	}
+}
+
+func TestKite_WebSocketFrameSize(t *testing.T) {
+	cfg := config.New()
+	cfg.DisableAuthentication = true
+	cfg.MaxRequestSize = 4096
+
+	k := NewWithConfig("testkite", "0.0.1", cfg)
+	go k.Run()
+	<-k.ServerReadyNotify()
+	defer k.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://127.0.0.1:%d/kite/000/test/websocket", k.Port()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Announce a 2GB masked text frame, but send only its header.
+	hdr := []byte{0x81, 0x80 | 127, 0, 0, 0, 0, 0x80, 0, 0, 0, 1, 2, 3, 4}
+	raw := conn.UnderlyingConn()
+
+	if _, err := raw.Write(hdr); err != nil {
+		t.Fatal(err)
+	}
+
+	raw.SetReadDeadline(time.Now().Add(4 * time.Second))
+
+	for {
+		_, err := raw.Read(make([]byte, 512))
+		if err == nil {
+			continue
+		}
+
+		if e, ok := err.(net.Error); ok && e.Timeout() {
+			t.Fatal("expected the session to be closed before the frame is read")
+		}
+
+		break
+	}
+}
+
+func TestLimitConn_Compressed(t *testing.T) {
+	// The message is far below the limit once compressed,
+	// but inflates to far above it.
+	var buf bytes.Buffer
+
+	fw, err := flate.NewWriter(&buf, flate.BestCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fw.Write(bytes.Repeat([]byte("a"), 1<<20))
+	fw.Flush()
+
+	payload := bytes.TrimSuffix(buf.Bytes(), []byte{0, 0, 0xff, 0xff})
+	if len(payload) >= 65536 {
+		t.Fatalf("got %d bytes of payload, want less than 64KiB", len(payload))
+	}
+
+	// Final compressed text frame, masked.
+	mask := [4]byte{1, 2, 3, 4}
+	frame := []byte{0x80 | 0x40 | 0x1, 0x80 | 126, byte(len(payload) >> 8), byte(len(payload))}
+	frame = append(frame, mask[:]...)
+
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+
+	for limit, want := range map[int64]error{
+		4096:    errMessageTooLarge,
+		2 << 20: nil,
+	} {
+		c := &limitConn{r: bytes.NewReader(frame), limit: limit}
+
+		if _, err := io.Copy(ioutil.Discard, c); err != want {
+			t.Errorf("%d: got %v, want %v", limit, err, want)
+		}
+	}
+}
+
+func TestDecodeFrame_Compression(t *testing.T) {
+	z := getCompressor("zstd")
+
+	p, err := z.Compress(make([]byte, config.DefaultMaxDecompressedSize+1), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	encodeFrame(&buf, dnode.JSON, z, p)
+
+	if _, _, err := decodeFrame(buf.Bytes(), "", 0); err == nil {
+		t.Fatal("expected compression which was not negotiated to fail")
+	}
+
+	if _, _, err := decodeFrame(buf.Bytes(), "deflate", 0); err == nil {
+		t.Fatal("expected compression other than the negotiated one to fail")
+	}
+
+	// The size of decompressed messages is limited even if
+	// the message size is not.
+	_, _, err = decodeFrame(buf.Bytes(), "zstd", 0)
+	if _, ok := err.(*MessageTooLargeError); !ok {
+		t.Fatalf("got %v, want *MessageTooLargeError", err)
+	}
+}
+
+func TestKite_UnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mathworker.sock")
+
+	mathKite := New("mathworker", "0.0.1")
+	mathKite.Config.DisableAuthentication = true
+	mathKite.Config.UnixSocket = &config.UnixSocket{
+		Path: path,
+		Mode: 0600,
+	}
+	mathKite.HandleFunc("square", Square)
+	go mathKite.Run()
+	<-mathKite.ServerReadyNotify()
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if mode := fi.Mode().Perm(); mode != 0600 {
+		t.Fatalf("got %o mode, want 600", mode)
+	}
+
+	if u := mathKite.RegisterURL(true); u.String() != "unix://"+path {
+		t.Fatalf("got %q, want %q", u, "unix://"+path)
+	}
+
+	for _, transport := range []config.Transport{config.WebSocket, config.XHRPolling, config.GRPC} {
+		t.Run(transport.String(), func(t *testing.T) {
+			exp2Kite := New("exp2", "0.0.1")
+			exp2Kite.Config.Transport = transport
+			exp2Kite.HandleFunc("foo", func(r *Request) (interface{}, error) {
+				return nil, nil
+			})
+
+			remote := exp2Kite.NewClient("unix://" + path)
+			if err := remote.Dial(); err != nil {
+				t.Fatal(err)
+			}
+			defer remote.Close()
+
+			result, err := remote.TellWithTimeout("square", 4*time.Second, 3)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if n := result.MustFloat64(); n != 9 {
+				t.Fatalf("got %f, want 9", n)
+			}
+		})
+	}
+
+	mathKite.Close()
+
+	// The socket file is removed when the kite is closed.
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("got %v, want the socket file to be removed", err)
+	}
+}
+
+func TestKite_SigningMethods(t *testing.T) {
+	genKey := func(alg string) (private, public string) {
+		var key crypto.Signer
+		var err error
+
+		switch alg {
+		case "RS256":
+			key, err = rsa.GenerateKey(cryptorand.Reader, 2048)
+		case "ES256":
+			key, err = ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+		case "EdDSA":
+			_, key, err = ed25519.GenerateKey(cryptorand.Reader)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		priv, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pub, err := x509.MarshalPKIXPublicKey(key.Public())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: priv})),
+			string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub}))
+	}
+
+	oldPrivate, oldPublic := genKey("RS256")
+
+	for _, alg := range []string{"RS256", "ES256", "EdDSA"} {
+		t.Run(alg, func(t *testing.T) {
+			private, public := genKey(alg)
+
+			k := New("testkite", "0.0.1")
+			k.Config.KontrolUser = "kontrol"
+			k.Config.KontrolKey = public
+			k.Config.KontrolKeys = []string{oldPublic}
+			k.Config.VerifyAudienceFunc = func(*protocol.Kite, string) error { return nil }
+			defer k.Close()
+
+			sign := func(private string) string {
+				s, err := kitekey.Sign(&kitekey.KiteClaims{
+					StandardClaims: jwt.StandardClaims{
+						Issuer:   "kontrol",
+						Subject:  "alice",
+						Audience: "/",
+					},
+					KontrolKey: public,
+				}, private)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return s
+			}
+
+			token := sign(private)
+
+			if got := jwtAlg(t, token); got != alg {
+				t.Fatalf("got %q, want %q", got, alg)
+			}
+
+			for _, key := range []string{token, sign(oldPrivate)} {
+				r := &Request{LocalKite: k, Auth: &Auth{Type: "token", Key: key}}
+
+				if err := k.AuthenticateFromToken(r); err != nil {
+					t.Fatalf("AuthenticateFromToken()=%s", err)
+				}
+
+				if r.Username != "alice" {
+					t.Fatalf("got %q, want %q", r.Username, "alice")
+				}
+			}
+
+			r := &Request{LocalKite: k, Auth: &Auth{Type: "kiteKey", Key: token}}
+
+			if err := k.AuthenticateFromKiteKey(r); err != nil {
+				t.Fatalf("AuthenticateFromKiteKey()=%s", err)
+			}
+
+			// Tokens signed with untrusted keys are reported as expired,
+			// so they are renewed by the caller.
+			untrustedPrivate, untrustedPublic := genKey(alg)
+
+			r = &Request{LocalKite: k, Auth: &Auth{Type: "token", Key: sign(untrustedPrivate)}}
+
+			if err := k.AuthenticateFromToken(r); err == nil || err.Error() != "token is expired" {
+				t.Fatalf("got %v, want token is expired", err)
+			}
+
+			// Keys received from Kontrol on register are trusted.
+			k.updateAuth(&protocol.RegisterResult{Keys: []string{public, untrustedPublic}})
+
+			if err := k.AuthenticateFromToken(r); err != nil {
+				t.Fatalf("AuthenticateFromToken()=%s", err)
+			}
+		})
+	}
+}
+
+func jwtAlg(t *testing.T, token string) string {
+	tok, _, err := new(jwt.Parser).ParseUnverified(token, jwt.MapClaims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tok.Method.Alg()
+}
+
+func TestKite_Revoke(t *testing.T) {
+	k := New("testkite", "0.0.1")
+	k.Config.KontrolUser = "kontrol"
+	k.Config.KontrolKey = testkeys.Public
+	k.Config.VerifyAudienceFunc = func(*protocol.Kite, string) error { return nil }
+	k.HandleFunc("foo", func(r *Request) (interface{}, error) {
+		return "foo", nil
+	})
+
+	go k.Run()
+	defer k.Close()
+	<-k.ServerReadyNotify()
+
+	sign := func(jti string) string {
+		s, err := kitekey.Sign(&kitekey.KiteClaims{
+			StandardClaims: jwt.StandardClaims{
+				Id:       jti,
+				Issuer:   "kontrol",
+				Subject:  "alice",
+				Audience: "/",
+			},
+			KontrolKey: testkeys.Public,
+			KiteID:     "alice-kite",
+		}, testkeys.Private)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	revoked, valid := sign("revoked"), sign("valid")
+
+	k.Revoke(&protocol.Revocation{JTI: "revoked"})
+
+	for _, typ := range []string{"token", "kiteKey"} {
+		r := &Request{LocalKite: k, Auth: &Auth{Type: typ, Key: revoked}}
+
+		if err := k.Authenticators[typ](r); err != ErrRevoked {
+			t.Fatalf("%s: got %v, want %v", typ, err, ErrRevoked)
+		}
+
+		r = &Request{LocalKite: k, Auth: &Auth{Type: typ, Key: valid}}
+
+		if err := k.Authenticators[typ](r); err != nil {
+			t.Fatalf("%s: %s", typ, err)
+		}
+	}
+
+	// Expired revocations are forgotten.
+	k.Revoke(&protocol.Revocation{JTI: "valid", Expires: time.Now().Add(-time.Minute).Unix()})
+
+	if k.IsRevoked("valid", "") {
+		t.Fatal("expired revocation is in effect")
+	}
+
+	c := New("exp", "0.0.1").NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", k.Port()))
+	c.Auth = &Auth{Type: "token", Key: sign("other")}
+
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := c.TellWithTimeout("foo", 4*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// The kite is identified by the claims of its token, not by
+	// the ID it sends about itself.
+	k.Revoke(&protocol.Revocation{KiteID: c.LocalKite.Id})
+
+	if _, err := c.TellWithTimeout("foo", 4*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	k.Revoke(&protocol.Revocation{KiteID: "alice-kite"})
+
+	_, err := c.TellWithTimeout("foo", 4*time.Second)
+	if kErr, ok := err.(*Error); !ok || kErr.Type != "authenticationError" {
+		t.Fatalf("got %v, want authenticationError", err)
+	}
+}
+
+func TestRevocations_Epoch(t *testing.T) {
+	var r revocations
+
+	r.update(&protocol.GetRevocationsResult{Version: 10, Epoch: "a"})
+	r.update(&protocol.GetRevocationsResult{Version: 5, Epoch: "a"})
+
+	if version, epoch := r.getVersion(); version != 10 || epoch != "a" {
+		t.Fatalf("got %d/%s, want 10/a", version, epoch)
+	}
+
+	// Kontrol restarted and its versions started over.
+	r.update(&protocol.GetRevocationsResult{Version: 2, Epoch: "b"})
+
+	if version, epoch := r.getVersion(); version != 2 || epoch != "b" {
+		t.Fatalf("got %d/%s, want 2/b", version, epoch)
+	}
+}
+
+func TestKite_ServeListener(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(cryptorand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(t.TempDir(), "cert.pem")
+	keyFile := filepath.Join(t.TempDir(), "key.pem")
+
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+
+	cases := map[string]struct {
+		scheme string
+		serve  func(*Kite, net.Listener) error
+	}{
+		"plain": {"http", (*Kite).ServeListener},
+		"tls": {"https", func(k *Kite, l net.Listener) error {
+			return k.ServeListenerTLS(l, certFile, keyFile)
+		}},
+	}
+
+	for name, cas := range cases {
+		t.Run(name, func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			mathKite := New("mathworker", "0.0.1")
+			mathKite.Config.DisableAuthentication = true
+			mathKite.HandleFunc("square", Square)
+
+			done := make(chan error, 1)
+			go func() { done <- cas.serve(mathKite, l) }()
+			<-mathKite.ServerReadyNotify()
+
+			if port := mathKite.Port(); port != l.Addr().(*net.TCPAddr).Port {
+				t.Fatalf("got %d port, want %d", port, l.Addr().(*net.TCPAddr).Port)
+			}
+
+			exp2Kite := New("exp2", "0.0.1")
+			exp2Kite.Config.Websocket.TLSClientConfig = &tls.Config{RootCAs: roots}
+
+			remote := exp2Kite.NewClient(cas.scheme + "://" + l.Addr().String() + "/kite")
+			if err := remote.Dial(); err != nil {
+				t.Fatal(err)
+			}
+			defer remote.Close()
+
+			result, err := remote.TellWithTimeout("square", 4*time.Second, 3)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if n := result.MustFloat64(); n != 9 {
+				t.Fatalf("got %f, want 9", n)
+			}
+
+			mathKite.Close()
+
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatalf("got %v, want nil", err)
+				}
+			case <-time.After(4 * time.Second):
+				t.Fatal("timed out waiting for the server to close")
+			}
+		})
+	}
+}
+
+func TestKite_Restart(t *testing.T) {
+	newKite := func() *Kite {
+		k := New("mathworker", "0.0.1")
+		k.Config.DisableAuthentication = true
+		k.HandleFunc("pid", func(r *Request) (interface{}, error) {
+			return []interface{}{os.Getpid(), r.LocalKite.Id}, nil
+		})
+
+		return k
+	}
+
+	// The test binary is executed again by Restart.
+	if os.Getenv("KITE_TEST_RESTARTED") != "" {
+		k := newKite()
+		go k.Run()
+		<-k.ServerReadyNotify()
+
+		time.Sleep(30 * time.Second) // killed by the parent
+		return
+	}
+
+	k := newKite()
+	go k.Run()
+	<-k.ServerReadyNotify()
+
+	url := fmt.Sprintf("http://127.0.0.1:%d/kite", k.Port())
+
+	pid := func() (int, string) {
+		c := New("exp", "0.0.1").NewClient(url)
+		if err := c.DialTimeout(4 * time.Second); err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		result, err := c.TellWithTimeout("pid", 4*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res := result.MustSliceOfLength(2)
+
+		return int(res[0].MustFloat64()), res[1].MustString()
+	}
+
+	if got, id := pid(); got != os.Getpid() || id != k.Id {
+		t.Fatalf("got %d, %q, want %d, %q", got, id, os.Getpid(), k.Id)
+	}
+
+	// The arguments and the environment of the test process are not
+	// changed, as they are read by the goroutines of the kite.
+	args := []string{os.Args[0], "-test.run=^TestKite_Restart$"}
+	environ := append(os.Environ(), "KITE_TEST_RESTARTED=1")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	p, err := k.restartProcess(ctx, args, environ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		p.Kill()
+		p.Wait()
+	}()
+
+	if err := k.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The new process serves on the same port with the same ID.
+	if got, id := pid(); got != p.Pid || id != k.Id {
+		t.Fatalf("got %d, %q, want %d, %q", got, id, p.Pid, k.Id)
+	}
+}
+
+func TestKite_AutoTLS(t *testing.T) {
+	k := New("testkite", "0.0.1")
+	k.Config.AutoTLS = &config.AutoTLS{
+		Domains:      []string{"kite.example.com"},
+		CacheDir:     t.TempDir(),
+		DirectoryURL: "http://127.0.0.1:1/directory", // not used
+	}
+
+	go k.Run()
+	defer k.Close()
+	<-k.ServerReadyNotify()
+
+	want := fmt.Sprintf("https://kite.example.com:%d/testkite-0.0.1/kite", k.Config.Port)
+	if u := k.RegisterURL(false); u.String() != want {
+		t.Fatalf("got %q, want %q", u, want)
+	}
+
+	if protos := k.TLSConfig.NextProtos; len(protos) == 0 || protos[len(protos)-1] != "acme-tls/1" {
+		t.Fatalf("got %v protocols, want acme-tls/1 to be accepted", protos)
+	}
+
+	// Certificates are not requested for other domains.
+	conn, err := tls.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", k.Port()), &tls.Config{
+		ServerName:         "other.example.com",
+		InsecureSkipVerify: true,
+	})
+	if err == nil {
+		conn.Close()
+		t.Fatal("expected handshake to fail for a domain not configured")
+	}
+}
+
+func TestKite_Listeners(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mathworker.sock")
+
+	mathKite := New("mathworker", "0.0.1")
+	mathKite.Config.DisableAuthentication = true
+	mathKite.Config.Listeners = []config.Listener{
+		{Addr: "unix://" + path, URL: "unix://" + path},
+		{Addr: "127.0.0.1:0"},
+	}
+	mathKite.HandleFunc("square", Square)
+	go mathKite.Run()
+	<-mathKite.ServerReadyNotify()
+	defer mathKite.Close()
+
+	addrs := mathKite.Addrs()
+	if len(addrs) != 3 {
+		t.Fatalf("got %v addresses, want 3", addrs)
+	}
+
+	if urls := mathKite.advertisedURLs(); !reflect.DeepEqual(urls, []string{"unix://" + path}) {
+		t.Fatalf("got %v advertised URLs, want %v", urls, []string{"unix://" + path})
+	}
+
+	exp2Kite := New("exp2", "0.0.1")
+
+	cases := map[string]*Client{
+		"unix":  exp2Kite.NewClient("unix://" + path),
+		"extra": exp2Kite.NewClient("http://" + addrs[2].String() + "/kite"),
+		"alternative": func() *Client {
+			c := exp2Kite.NewClient("http://127.0.0.1:1/kite") // unreachable
+			c.URLs = []string{fmt.Sprintf("http://127.0.0.1:%d/kite", mathKite.Port())}
+			return c
+		}(),
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			if err := c.DialTimeout(4 * time.Second); err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			result, err := c.TellWithTimeout("square", 4*time.Second, 3)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if n := result.MustFloat64(); n != 9 {
+				t.Fatalf("got %f, want 9", n)
+			}
+		})
+	}
+
+	// TLS listeners require TLS to be configured.
+	k := New("testkite", "0.0.1")
+	k.Config.Listeners = []config.Listener{{Addr: "127.0.0.1:0", TLS: true}}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := k.ServeListener(l); err == nil {
+		t.Fatal("expected serving TLS listener without TLS configured to fail")
+	}
+}
+
+func TestKite_ClientCert(t *testing.T) {
+	newCert := func(tmpl, parent *x509.Certificate, parentKey crypto.Signer) (*x509.Certificate, crypto.Signer, tls.Certificate) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tmpl.NotBefore = time.Now().Add(-time.Hour)
+		tmpl.NotAfter = time.Now().Add(time.Hour)
+
+		if parent == nil {
+			parent, parentKey = tmpl, key
+		}
+
+		der, err := x509.CreateCertificate(cryptorand.Reader, tmpl, parent, key.Public(), parentKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return cert, key, tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	}
+
+	ca, caKey, _ := newCert(&x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+
+	_, _, serverCert := newCert(&x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+
+	spiffeID, _ := url.Parse("spiffe://example.org/ns/test/sa/alice")
+
+	_, _, clientCert := newCert(&x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		URIs:         []*url.URL{spiffeID},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+
+	caPEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}))
+
+	k := New("testkite", "0.0.1")
+	k.TLSConfig = &tls.Config{Certificates: []tls.Certificate{serverCert}}
+	k.RequireClientCert(caPEM)
+	k.HandleFunc("whoami", func(r *Request) (interface{}, error) {
+		return r.Username, nil
+	})
+
+	go k.Run()
+	defer k.Close()
+	<-k.ServerReadyNotify()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	newClient := func(transport config.Transport, certs ...tls.Certificate) *Client {
+		e := New("exp", "0.0.1")
+		e.Config.Transport = transport
+		e.Config.ClientCertificates = certs
+		e.Config.Websocket.TLSClientConfig = &tls.Config{RootCAs: roots}
+		e.Config.XHR.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}
+
+		return e.NewClient(fmt.Sprintf("https://127.0.0.1:%d/kite", k.Port()))
+	}
+
+	for _, transport := range []config.Transport{config.WebSocket, config.XHRPolling} {
+		t.Run(transport.String(), func(t *testing.T) {
+			c := newClient(transport, clientCert)
+
+			if err := c.Dial(); err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			result, err := c.TellWithTimeout("whoami", 4*time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if username := result.MustString(); username != spiffeID.String() {
+				t.Fatalf("got %q, want %q", username, spiffeID)
+			}
+		})
+	}
+
+	c := newClient(config.WebSocket)
+
+	if err := c.DialTimeout(4 * time.Second); err == nil {
+		c.Close()
+		t.Fatal("expected dialing without client certificate to fail")
+	}
+}
+
+func TestKontrolFailover(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing listens under the URL of the first Kontrol.
+	deadURL := fmt.Sprintf("http://%s/kite", l.Addr())
+	l.Close()
+
+	kon := New("kontrol", "0.0.1")
+	kon.Authenticators["kiteKey"] = func(r *Request) error {
+		r.Username = "alice"
+		return nil
+	}
+	kon.HandleFunc("getToken", func(r *Request) (interface{}, error) {
+		return "token", nil
+	})
+
+	go kon.Run()
+	defer kon.Close()
+	<-kon.ServerReadyNotify()
+
+	k := New("exp", "0.0.1")
+	k.Config.KontrolURL = deadURL
+	k.Config.KontrolURLs = []string{fmt.Sprintf("http://127.0.0.1:%d/kite", kon.Port())}
+	k.Config.Timeout = 10 * time.Second
+
+	result, err := k.TellKontrolWithTimeout("getToken", 4*time.Second, &protocol.Kite{Name: "foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if token := result.MustString(); token != "token" {
+		t.Fatalf("got %q, want %q", token, "token")
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/register", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(&protocol.RegisterResult{
+			URL:               "http://127.0.0.1:1234/kite",
+			HeartbeatInterval: 60,
+		})
+	})
+
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	k = New("exp", "0.0.1")
+	k.Config.KontrolURL = deadURL
+	k.Config.KontrolURLs = []string{ts.URL + "/kite"}
+
+	if _, err := k.RegisterHTTP(&url.URL{Scheme: "http", Host: "127.0.0.1:1234", Path: "/kite"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := k.kontrolHTTPURL(), ts.URL+"/kite"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestWatchKites(t *testing.T) {
+	foo := protocol.Kite{
+		Username:    "alice",
+		Environment: "testing",
+		Name:        "foo",
+		Version:     "0.0.1",
+		Region:      "local",
+		Hostname:    "localhost",
+		ID:          "foo-id",
+	}
+
+	watches := make(chan *protocol.GetKitesArgs, 2)
+	clients := make(chan *Client, 2)
+	canceled := make(chan string, 1)
+
+	kon := New("kontrol", "0.0.1")
+	kon.Authenticators["kiteKey"] = func(r *Request) error {
+		r.Username = "alice"
+		return nil
+	}
+	kon.HandleFunc("getKites", func(r *Request) (interface{}, error) {
+		var args protocol.GetKitesArgs
+		if err := r.Args.One().Unmarshal(&args); err != nil {
+			return nil, err
+		}
+
+		watches <- &args
+		clients <- r.Client
+
+		res := &protocol.GetKitesResult{
+			Revision:  args.Since,
+			WatcherID: fmt.Sprintf("watch-%d", args.Since),
+		}
+
+		// A new watch lists the kites and gets changes made
+		// afterwards, a resumed one only gets the changes.
+		if args.Since == 0 {
+			res.Revision = 10
+			res.Kites = []*protocol.KiteWithToken{{
+				Kite:  foo,
+				URL:   "http://127.0.0.1:1234/kite",
+				Token: "token",
+			}}
+
+			go args.WatchCallback.Call(&protocol.KiteEvent{
+				Action:   protocol.Deregister,
+				Kite:     foo,
+				Revision: 11,
+			})
+		}
+
+		return res, nil
+	})
+	kon.HandleFunc("cancelWatcher", func(r *Request) (interface{}, error) {
+		canceled <- r.Args.One().MustString()
+		return nil, nil
+	})
+
+	go kon.Run()
+	defer kon.Close()
+	<-kon.ServerReadyNotify()
+
+	k := New("exp", "0.0.1")
+	k.Config.KontrolURL = fmt.Sprintf("http://127.0.0.1:%d/kite", kon.Port())
+	defer k.Close()
+
+	events := make(chan *Event, 4)
+
+	w, err := k.WatchKites(protocol.KontrolQuery{Username: "alice", Name: "foo"}, func(e *Event, err *Error) {
+		if err != nil {
+			t.Errorf("watch error: %s", err)
+			return
+		}
+		events <- e
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	next := func() *Event {
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for event")
+			return nil
+		}
+	}
+
+	if e := next(); e.Action != protocol.Register || e.Kite != foo || e.Client().Auth.Key != "token" {
+		t.Fatalf("unexpected event: %+v", e.KiteEvent)
+	}
+
+	if e := next(); e.Action != protocol.Deregister || e.Revision != 11 {
+		t.Fatalf("unexpected event: %+v", e.KiteEvent)
+	}
+
+	if args := <-watches; args.Since != 0 || args.Query.Name != "foo" {
+		t.Fatalf("unexpected watch: %+v", args)
+	}
+
+	// Reconnecting to Kontrol resumes the watch.
+	(<-clients).Close()
+
+	select {
+	case args := <-watches:
+		if args.Since != 11 {
+			t.Fatalf("got %d, want %d", args.Since, 11)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the watch to resume")
+	}
+
+	// Wait for the result of the resumed watch.
+	for i := 0; ; i++ {
+		w.mu.Lock()
+		id := w.id
+		w.mu.Unlock()
+
+		if id == "watch-11" {
+			break
+		}
+
+		if i == 100 {
+			t.Fatalf("got %q, want %q", id, "watch-11")
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if err := w.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	if id := <-canceled; id != "watch-11" {
+		t.Fatalf("got %q, want %q", id, "watch-11")
+	}
+}
+
+func TestClient_RemoveCallbacksOnDisconnect(t *testing.T) {
+	k := New("testkite", "0.0.1")
+	k.Config.DisableAuthentication = true
+	k.HandleFunc("subscribe", func(r *Request) (interface{}, error) {
+		return nil, nil
+	})
+
+	remote := make(chan *Client, 1)
+	k.OnConnect(func(c *Client) { remote <- c })
+
+	go k.Run()
+	defer k.Close()
+	<-k.ServerReadyNotify()
+
+	c := New("exp", "0.0.1").NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", k.Port()))
+	if err := c.Dial(); err != nil {
+		t.Fatalf("Dial()=%s", err)
+	}
+	defer c.Close()
+
+	disconnected := make(chan struct{})
+	c.OnDisconnect(func() { close(disconnected) })
+
+	if _, err := c.TellWithTimeout("subscribe", 4*time.Second, dnode.Callback(func(*dnode.Partial) {})); err != nil {
+		t.Fatalf("TellWithTimeout()=%s", err)
+	}
+
+	// The remote kite may still call the callback.
+	if n := c.scrubber.Len(); n == 0 {
+		t.Fatal("callback was removed")
+	}
+
+	(<-remote).Close()
+
+	select {
+	case <-disconnected:
+	case <-time.After(4 * time.Second):
+		t.Fatal("timed out waiting for disconnect")
+	}
+
+	if n := c.scrubber.Len(); n != 0 {
+		t.Fatalf("got %d callbacks, want 0", n)
+	}
+}
+
+func TestKite_IPFilter(t *testing.T) {
+	mathKite := New("mathworker", "0.0.1")
+	mathKite.Config.DisableAuthentication = true
+	mathKite.Config.MaxConnsPerIP = 1
+	mathKite.HandleFunc("square", Square)
+	go mathKite.Run()
+	<-mathKite.ServerReadyNotify()
+	defer mathKite.Close()
+
+	addr := fmt.Sprintf("127.0.0.1:%d", mathKite.Port())
+
+	// dial connects to the kite and tells whether the connection
+	// was closed by the server right after accepting it.
+	dial := func() (net.Conn, bool) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("Dial()=%s", err)
+		}
+
+		conn.SetReadDeadline(time.Now().Add(250 * time.Millisecond))
+
+		_, err = conn.Read(make([]byte, 1))
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return conn, false
+		}
+
+		conn.Close()
+		return nil, true
+	}
+
+	first, refused := dial()
+	if refused {
+		t.Fatal("expected the first connection to be accepted")
+	}
+
+	if _, refused := dial(); !refused {
+		t.Fatal("expected the connection over the limit to be refused")
+	}
+
+	first.Close()
+
+	// The slot of the closed connection is released once
+	// the server notices the connection is closed.
+	var second net.Conn
+	for i := 0; i < 20 && second == nil; i++ {
+		second, _ = dial()
+	}
+	if second == nil {
+		t.Fatal("expected the connection to be accepted after the first one was closed")
+	}
+	defer second.Close()
+
+	if err := mathKite.ReloadConfig(&config.Config{DeniedIPs: []string{"127.0.0.0/8"}}); err != nil {
+		t.Fatalf("ReloadConfig()=%s", err)
+	}
+
+	if _, refused := dial(); !refused {
+		t.Fatal("expected the connection from a denied address to be refused")
+	}
+
+	// The fields not set by the reloaded configuration are kept,
+	// so the denied range and the limit are replaced explicitly.
+	if err := mathKite.ReloadConfig(&config.Config{
+		AllowedIPs:    []string{"127.0.0.0/8"},
+		DeniedIPs:     []string{"192.0.2.0/24"},
+		MaxConnsPerIP: 2,
+	}); err != nil {
+		t.Fatalf("ReloadConfig()=%s", err)
+	}
+
+	c := New("exp", "0.0.1").NewClient("http://" + addr + "/kite")
+	if err := c.DialTimeout(4 * time.Second); err != nil {
+		t.Fatalf("Dial()=%s", err)
+	}
+	defer c.Close()
+
+	result, err := c.TellWithTimeout("square", 4*time.Second, 2)
+	if err != nil {
+		t.Fatalf("Tell()=%s", err)
+	}
+
+	if n := result.MustFloat64(); n != 4 {
+		t.Fatalf("got %v, want 4", n)
+	}
+}
+
+// lineWriter passes written lines over the channel.
+type lineWriter chan string
+
+func (w lineWriter) Write(p []byte) (int, error) {
+	w <- string(p)
+	return len(p), nil
+}
+
+func TestKite_AccessLog(t *testing.T) {
+	jsonLog, combinedLog := make(lineWriter, 4), make(lineWriter, 4)
+
+	mathKite := New("mathworker", "0.0.1")
+	mathKite.Config.DisableAuthentication = true
+	mathKite.AccessLog(jsonLog, AccessLogJSON)
+	mathKite.AccessLog(combinedLog, AccessLogCombined)
+	mathKite.HandleFunc("square", Square)
+	mathKite.HandleFunc("fail", func(*Request) (interface{}, error) {
+		return nil, errors.New("failed")
+	})
+	go mathKite.Run()
+	<-mathKite.ServerReadyNotify()
+	defer mathKite.Close()
+
+	exp2Kite := New("exp2", "0.0.1")
+	exp2Kite.Config.Username = "alice"
+	c := exp2Kite.NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", mathKite.Port()))
+	if err := c.DialTimeout(4 * time.Second); err != nil {
+		t.Fatalf("Dial()=%s", err)
+	}
+	defer c.Close()
+
+	if _, err := c.TellWithTimeout("square", 4*time.Second, 12); err != nil {
+		t.Fatalf("Tell()=%s", err)
+	}
+
+	if _, err := c.TellWithTimeout("fail", 4*time.Second); err == nil {
+		t.Fatal("expected the call to fail")
+	}
+
+	readLine := func(w lineWriter) string {
+		select {
+		case line := <-w:
+			return line
+		case <-time.After(4 * time.Second):
+			t.Fatal("timed out waiting for an access log entry")
+			return ""
+		}
+	}
+
+	var entries []AccessLogEntry
+	for i := 0; i < 2; i++ {
+		var e AccessLogEntry
+		if err := json.Unmarshal([]byte(readLine(jsonLog)), &e); err != nil {
+			t.Fatalf("Unmarshal()=%s", err)
+		}
+
+		entries = append(entries, e)
+	}
+
+	if e := entries[0]; e.Method != "square" || e.KiteID != exp2Kite.Id || e.Kite != "exp2/0.0.1" || e.Username != "alice" ||
+		e.RemoteAddr != "127.0.0.1" || e.Size != len("144") || e.Duration <= 0 || e.Error != nil {
+		t.Fatalf("got %+v entry for the square call", e)
+	}
+
+	if e := entries[1]; e.Method != "fail" || e.Size != 0 || e.Error == nil || e.Error.Message != "failed" {
+		t.Fatalf("got %+v entry for the failed call", e)
+	}
+
+	square, fail := readLine(combinedLog), readLine(combinedLog)
+
+	if want := `] "square" ok 3 "` + exp2Kite.Id + `" "exp2/0.0.1" `; !strings.HasPrefix(square, "127.0.0.1 - alice [") || !strings.Contains(square, want) {
+		t.Fatalf("got %q, want it to contain %q", square, want)
+	}
+
+	if want := `] "fail" genericError 0 "` + exp2Kite.Id + `" "exp2/0.0.1" `; !strings.Contains(fail, want) {
+		t.Fatalf("got %q, want it to contain %q", fail, want)
+	}
+}
+
+func TestKite_Debug(t *testing.T) {
+	mathKite := New("mathworker", "0.0.1")
+	mathKite.Config.DisableAuthentication = false
+	mathKite.Authenticators["test"] = func(r *Request) error {
+		r.Username = r.Auth.Key
+		if r.Username == "admin" {
+			r.Scopes = []string{ScopeDebug}
+		}
+		return nil
+	}
+	mathKite.HandlePprof()
+	go mathKite.Run()
+	<-mathKite.ServerReadyNotify()
+	defer mathKite.Close()
+
+	dial := func(username string) *Client {
+		c := New("exp", "0.0.1").NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", mathKite.Port()))
+		c.Auth = &Auth{Type: "test", Key: username}
+
+		if err := c.DialTimeout(4 * time.Second); err != nil {
+			t.Fatalf("Dial()=%s", err)
+		}
+
+		return c
+	}
+
+	alice := dial("alice")
+	defer alice.Close()
+
+	if _, err := alice.TellWithTimeout("kite.debug.goroutines", 4*time.Second); err == nil || err.(*Error).Type != "forbidden" {
+		t.Fatalf("got %v, want forbidden error", err)
+	}
+
+	admin := dial("admin")
+	defer admin.Close()
+
+	result, err := admin.TellWithTimeout("kite.debug.goroutines", 4*time.Second)
+	if err != nil {
+		t.Fatalf("Tell()=%s", err)
+	}
+
+	if s := result.MustString(); !strings.Contains(s, "goroutine ") || !strings.Contains(s, "handleDebugGoroutines") {
+		t.Fatalf("got %q, want goroutine stacks", s)
+	}
+
+	result, err = admin.TellWithTimeout("kite.debug.heap", 4*time.Second, map[string]interface{}{"gc": true})
+	if err != nil {
+		t.Fatalf("Tell()=%s", err)
+	}
+
+	var stats struct{ NumGC uint32 }
+	if err := result.Unmarshal(&stats); err != nil || stats.NumGC == 0 {
+		t.Fatalf("got %+v (%v), want garbage collection to be run", stats, err)
+	}
+
+	var buf strings.Builder
+	if _, err := admin.TellStream("kite.debug.pprof", &buf, map[string]interface{}{"profile": "heap", "debug": 1}); err != nil {
+		t.Fatalf("TellStream()=%s", err)
+	}
+
+	if !strings.HasPrefix(buf.String(), "heap profile:") {
+		t.Fatalf("got %q, want heap profile", buf.String())
+	}
+
+	buf.Reset()
+	if _, err := admin.TellStream("kite.debug.pprof", &buf, map[string]interface{}{"profile": "cpu", "seconds": 1}); err != nil {
+		t.Fatalf("TellStream()=%s", err)
+	}
+
+	if buf.Len() == 0 {
+		t.Fatal("expected CPU profile to be streamed")
+	}
+
+	if _, err := admin.TellWithTimeout("kite.debug.pprof", 4*time.Second, map[string]interface{}{"profile": "unknown"}); err == nil {
+		t.Fatal("expected streaming unknown profile to fail")
+	}
+
+	if _, err := admin.TellWithTimeout("kite.debug.pprof", 4*time.Second, map[string]interface{}{"profile": "cpu", "seconds": 1e9}); err == nil {
+		t.Fatal("expected profiling for too long to fail")
+	}
+
+	// The trace is stopped once the caller cancels the stream,
+	// so the next one can be started.
+	if _, err := admin.TellStream("kite.debug.pprof", failingWriter{}, map[string]interface{}{"profile": "trace", "seconds": 300}); err == nil {
+		t.Fatal("expected the canceled stream to fail")
+	}
+
+	for deadline := time.Now().Add(4 * time.Second); ; time.Sleep(50 * time.Millisecond) {
+		buf.Reset()
+		_, err := admin.TellStream("kite.debug.pprof", &buf, map[string]interface{}{"profile": "trace", "seconds": 1})
+		if err == nil {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("TellStream()=%s", err)
+		}
+	}
+
+	if buf.Len() == 0 {
+		t.Fatal("expected execution trace to be streamed")
+	}
+
+	for auth, code := range map[string]int{
+		"":           http.StatusUnauthorized,
+		"test alice": http.StatusForbidden,
+		"test admin": http.StatusOK,
+	} {
+		req, err := http.NewRequest("GET", fmt.Sprintf("http://127.0.0.1:%d/debug/pprof/", mathKite.Port()), nil)
+		if err != nil {
+			t.Fatalf("NewRequest()=%s", err)
+		}
+
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Do()=%s", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != code {
+			t.Errorf("%q: got %d, want %d", auth, resp.StatusCode, code)
+		}
+	}
+}
+
+// failingWriter fails every write.
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func TestClient_KeepAlive(t *testing.T) {
+	var hang int32
+	done := make(chan struct{})
+	defer close(done)
+
+	mathKite := New("mathworker", "0.0.1")
+	mathKite.Config.DisableAuthentication = true
+	mathKite.HandleFunc("kite.ping", func(*Request) (interface{}, error) {
+		if atomic.LoadInt32(&hang) == 1 {
+			<-done
+		}
+
+		return "pong", nil
+	}).DisableAuthentication()
+	go mathKite.Run()
+	<-mathKite.ServerReadyNotify()
+	defer mathKite.Close()
+
+	exp2Kite := New("exp2", "0.0.1")
+	exp2Kite.Config.PingInterval = 50 * time.Millisecond
+	exp2Kite.Config.PongTimeout = 100 * time.Millisecond
+
+	c := exp2Kite.NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", mathKite.Port()))
+
+	disconnected := make(chan struct{}, 1)
+	c.OnDisconnect(func() {
+		disconnected <- struct{}{}
+	})
+
+	if err := c.DialTimeout(4 * time.Second); err != nil {
+		t.Fatalf("Dial()=%s", err)
+	}
+	defer c.Close()
+
+	if last := c.LastActivity(); last.IsZero() || time.Since(last) > time.Second {
+		t.Fatalf("got %s last activity after dialing", last)
+	}
+
+	// Pings which are responded to keep the connection open.
+	select {
+	case <-disconnected:
+		t.Fatal("unexpected disconnect of the responding kite")
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	if time.Since(c.LastActivity()) > 200*time.Millisecond {
+		t.Fatalf("got %s last activity, want pings to be responded", c.LastActivity())
+	}
+
+	atomic.StoreInt32(&hang, 1)
+
+	select {
+	case <-disconnected:
+	case <-time.After(4 * time.Second):
+		t.Fatal("timed out waiting for the dead connection to be closed")
+	}
+}
+
+func TestKite_ShutdownGoingAway(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+
+	mathKite := New("mathworker", "0.0.1")
+	mathKite.Config.DisableAuthentication = true
+	mathKite.HandleFunc("slow", func(*Request) (interface{}, error) {
+		close(started)
+		<-release
+		return "done", nil
+	})
+	go mathKite.Run()
+	<-mathKite.ServerReadyNotify()
+	defer mathKite.Close()
+
+	exp2Kite := New("exp2", "0.0.1")
+	c := exp2Kite.NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", mathKite.Port()))
+	c.Reconnect = true
+
+	events := make(chan *ConnectionEvent, 16)
+	c.OnConnectionStateChange(func(ev *ConnectionEvent) {
+		events <- ev
+	})
+
+	if err := c.DialTimeout(4 * time.Second); err != nil {
+		t.Fatalf("Dial()=%s", err)
+	}
+	defer c.Close()
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := c.TellWithTimeout("slow", 4*time.Second)
+		result <- err
+	}()
+
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 4*time.Second)
+	defer cancel()
+
+	go mathKite.Shutdown(ctx)
+
+	for deadline := time.Now().Add(4 * time.Second); !c.GoingAway(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the kite to go away")
+		}
+	}
+
+	// The session is kept open until the call is done.
+	if state := c.State(); state != StateConnected {
+		t.Fatalf("got %s state, want %s", state, StateConnected)
+	}
+
+	close(release)
+
+	if err := <-result; err != nil {
+		t.Fatalf("Tell()=%s", err)
+	}
+
+	for {
+		select {
+		case ev := <-events:
+			if ev.State != StateDisconnected {
+				continue
+			}
+
+			if ev.Reason != ReasonGoingAway {
+				t.Fatalf("got %s disconnect reason, want %s", ev.Reason, ReasonGoingAway)
+			}
+
+			return
+		case <-time.After(4 * time.Second):
+			t.Fatal("timed out waiting for the client to disconnect")
+		}
+	}
+}
+
+func TestClient_Proxy(t *testing.T) {
+	var tunnels int32
+	auth := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:secret"))
+
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "only CONNECT is supported", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if r.Header.Get("Proxy-Authorization") != auth {
+			http.Error(w, "unauthorized", http.StatusProxyAuthRequired)
+			return
+		}
+
+		remote, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer remote.Close()
+
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		atomic.AddInt32(&tunnels, 1)
+
+		io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+
+		go io.Copy(remote, buf)
+		io.Copy(conn, remote)
+	}))
+	defer proxy.Close()
+
+	mathKite := New("mathworker", "0.0.1")
+	mathKite.Config.DisableAuthentication = true
+	mathKite.HandleFunc("square", Square)
+	go mathKite.Run()
+	<-mathKite.ServerReadyNotify()
+	defer mathKite.Close()
+
+	exp2Kite := New("exp2", "0.0.1")
+	exp2Kite.Config.Transport = config.WebSocket
+
+	proxyURL, err := url.Parse(proxy.URL)
+	if err != nil {
+		t.Fatalf("Parse()=%s", err)
+	}
+
+	kiteURL := fmt.Sprintf("http://127.0.0.1:%d/kite", mathKite.Port())
+
+	// Unauthenticated requests are rejected by the proxy.
+	c := exp2Kite.NewClient(kiteURL)
+	if err := c.Proxy(proxyURL.String()); err != nil {
+		t.Fatalf("Proxy()=%s", err)
+	}
+
+	if err := c.DialTimeout(4 * time.Second); err == nil {
+		c.Close()
+		t.Fatal("expected dialing without proxy credentials to fail")
+	}
+
+	proxyURL.User = url.UserPassword("user", "secret")
+
+	c = exp2Kite.NewClient(kiteURL)
+	if err := c.Proxy(proxyURL.String()); err != nil {
+		t.Fatalf("Proxy()=%s", err)
+	}
+
+	if err := c.DialTimeout(4 * time.Second); err != nil {
+		t.Fatalf("Dial()=%s", err)
+	}
+	defer c.Close()
+
+	result, err := c.TellWithTimeout("square", 4*time.Second, 2)
+	if err != nil {
+		t.Fatalf("Tell()=%s", err)
+	}
+
+	if n := result.MustFloat64(); n != 4 {
+		t.Fatalf("got %v, want 4", n)
+	}
+
+	if n := atomic.LoadInt32(&tunnels); n != 1 {
+		t.Fatalf("got %d tunnels, want 1", n)
+	}
+
+	if err := c.Proxy("ftp://proxy:21"); err == nil {
+		t.Fatal("expected unsupported proxy scheme to be rejected")
+	}
+}
+
+// newSSHJumpHost starts an SSH server, which accepts the given password
+// and forwards direct-tcpip channels. It returns the address of the server
+// and its host key.
+func newSSHJumpHost(t *testing.T, password string) (string, ssh.PublicKey, func()) {
+	_, key, err := ed25519.GenerateKey(cryptorand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey()=%s", err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatalf("NewSignerFromKey()=%s", err)
+	}
+
+	cfg := &ssh.ServerConfig{
+		PasswordCallback: func(_ ssh.ConnMetadata, p []byte) (*ssh.Permissions, error) {
+			if string(p) != password {
+				return nil, errors.New("invalid password")
+			}
+
+			return nil, nil
+		},
+	}
+	cfg.AddHostKey(signer)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen()=%s", err)
+	}
+
+	forward := func(ch ssh.NewChannel) {
+		var target struct {
+			Host     string
+			Port     uint32
+			OrigHost string
+			OrigPort uint32
+		}
+
+		if err := ssh.Unmarshal(ch.ExtraData(), &target); err != nil {
+			ch.Reject(ssh.ConnectionFailed, err.Error())
+			return
+		}
+
+		remote, err := net.Dial("tcp", net.JoinHostPort(target.Host, strconv.Itoa(int(target.Port))))
+		if err != nil {
+			ch.Reject(ssh.ConnectionFailed, err.Error())
+			return
+		}
+		defer remote.Close()
+
+		c, reqs, err := ch.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+
+		go ssh.DiscardRequests(reqs)
+		go func() {
+			io.Copy(remote, c)
+			remote.Close()
+		}()
+
+		io.Copy(c, remote)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				_, chans, reqs, err := ssh.NewServerConn(conn, cfg)
+				if err != nil {
+					conn.Close()
+					return
+				}
+
+				go ssh.DiscardRequests(reqs)
+
+				for ch := range chans {
+					if ch.ChannelType() != "direct-tcpip" {
+						ch.Reject(ssh.UnknownChannelType, "unsupported channel type")
+						continue
+					}
+
+					go forward(ch)
+				}
+			}()
+		}
+	}()
+
+	return l.Addr().String(), signer.PublicKey(), func() { l.Close() }
+}
+
+func TestClient_SSH(t *testing.T) {
+	addr, hostKey, stop := newSSHJumpHost(t, "secret")
+	defer stop()
+
+	mathKite := New("mathworker", "0.0.1")
+	mathKite.Config.DisableAuthentication = true
+	mathKite.HandleFunc("square", Square)
+	go mathKite.Run()
+	<-mathKite.ServerReadyNotify()
+	defer mathKite.Close()
+
+	for _, transport := range []config.Transport{config.WebSocket, config.XHRPolling} {
+		t.Run(transport.String(), func(t *testing.T) {
+			exp2Kite := New("exp2", "0.0.1")
+			exp2Kite.Config.Transport = transport
+			exp2Kite.Config.SSH = &ssh.ClientConfig{
+				HostKeyCallback: ssh.FixedHostKey(hostKey),
+			}
+
+			kiteURL := fmt.Sprintf("kite+ssh://kite:secret@%s/127.0.0.1:%d/kite", addr, mathKite.Port())
+
+			c := exp2Kite.NewClient(kiteURL)
+			if err := c.DialTimeout(4 * time.Second); err != nil {
+				t.Fatalf("Dial()=%s", err)
+			}
+			defer c.Close()
+
+			result, err := c.TellWithTimeout("square", 4*time.Second, 3)
+			if err != nil {
+				t.Fatalf("Tell()=%s", err)
+			}
+
+			if n := result.MustFloat64(); n != 9 {
+				t.Fatalf("got %v, want 9", n)
+			}
+
+			c = exp2Kite.NewClient(strings.Replace(kiteURL, ":secret@", ":invalid@", 1))
+			if err := c.DialTimeout(4 * time.Second); err == nil {
+				c.Close()
+				t.Fatal("expected dialing with invalid SSH password to fail")
+			}
+		})
+	}
+}
+
+// newReverseKite gives a kite with its own kite key,
+// identified by the ID the key was issued to.
+func newReverseKite(name string) *Kite {
+	key := testutil.NewKiteKey()
+
+	k := New(name, "0.0.1")
+	k.Config.KiteKey = key.Raw
+	k.Config.KontrolUser = "testuser"
+	k.Config.KontrolKey = testkeys.Public
+	k.Id = key.Claims.(*kitekey.KiteClaims).Id
+	return k
+}
+
+func TestKite_Reverse(t *testing.T) {
+	newKite := newReverseKite
+
+	relayKite := newKite("relay")
+	go relayKite.Run()
+	<-relayKite.ServerReadyNotify()
+	defer relayKite.Close()
+
+	// The kite does not run a server, it is reachable
+	// over the reverse connection only.
+	mathKite := newKite("mathworker")
+	mathKite.HandleFunc("square", Square)
+	defer mathKite.Close()
+
+	relayURL := fmt.Sprintf("http://127.0.0.1:%d/kite", relayKite.Port())
+
+	rc, err := mathKite.DialReverse(relayURL)
+	if err != nil {
+		t.Fatalf("DialReverse()=%s", err)
+	}
+	defer rc.Close()
+
+	c := relayKite.ReverseClient(mathKite.Id)
+	if c == nil {
+		t.Fatalf("no reverse client of %s", mathKite.Id)
+	}
+
+	result, err := c.TellWithTimeout("square", 4*time.Second, 2)
+	if err != nil {
+		t.Fatalf("Tell()=%s", err)
+	}
+
+	if n := result.MustFloat64(); n != 4 {
+		t.Fatalf("got %v, want 4", n)
+	}
+
+	// Other kites are relayed to the kite.
+	for _, transport := range []config.Transport{config.WebSocket, config.XHRPolling} {
+		t.Run(transport.String(), func(t *testing.T) {
+			exp2Kite := newKite("exp2")
+			exp2Kite.Config.Transport = transport
+
+			c := exp2Kite.NewClient(relayURL + "?reverse=" + mathKite.Id)
+			if err := c.DialTimeout(4 * time.Second); err != nil {
+				t.Fatalf("Dial()=%s", err)
+			}
+			defer c.Close()
+
+			// The calls of the relayed kites are authenticated
+			// by the kite itself.
+			_, err := c.TellWithTimeout("square", 4*time.Second, 2)
+			if e, ok := err.(*Error); !ok || e.Type != "authenticationError" {
+				t.Fatalf("got %v, want authenticationError", err)
+			}
+
+			c.Auth = &Auth{
+				Type: "kiteKey",
+				Key:  exp2Kite.KiteKey(),
+			}
+
+			for i := 1; i <= 3; i++ {
+				result, err := c.TellWithTimeout("square", 4*time.Second, i)
+				if err != nil {
+					t.Fatalf("Tell()=%s", err)
+				}
+
+				if n := result.MustFloat64(); n != float64(i*i) {
+					t.Fatalf("got %v, want %d", n, i*i)
+				}
+			}
+		})
+	}
+
+	rc.Close()
+
+	for deadline := time.Now().Add(4 * time.Second); relayKite.ReverseClient(mathKite.Id) != nil; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the reverse client to be removed")
+		}
+	}
+}
+
+func TestKite_ReverseForgedID(t *testing.T) {
+	relayKite := newReverseKite("relay")
+	go relayKite.Run()
+	<-relayKite.ServerReadyNotify()
+	defer relayKite.Close()
+
+	relayURL := fmt.Sprintf("http://127.0.0.1:%d/kite", relayKite.Port())
+
+	mathKite := newReverseKite("mathworker")
+	mathKite.HandleFunc("square", Square)
+	defer mathKite.Close()
+
+	rc, err := mathKite.DialReverse(relayURL)
+	if err != nil {
+		t.Fatalf("DialReverse()=%s", err)
+	}
+	defer rc.Close()
+
+	// The kite announces itself with the ID of the other one,
+	// but is authenticated with a kite key of its own.
+	forgedKite := newReverseKite("mathworker")
+	forgedKite.Id = mathKite.Id
+	forgedKite.HandleFunc("square", func(*Request) (interface{}, error) {
+		return -1, nil
+	})
+	defer forgedKite.Close()
+
+	if fc, err := forgedKite.DialReverse(relayURL); err == nil {
+		fc.Close()
+		t.Fatal("expected reverse connection with a forged kite ID to be rejected")
+	}
+
+	if n := len(relayKite.ReverseClients()); n != 1 {
+		t.Fatalf("got %d reverse clients, want 1", n)
+	}
+
+	c := relayKite.ReverseClient(mathKite.Id)
+	if c == nil {
+		t.Fatalf("no reverse client of %s", mathKite.Id)
+	}
+
+	result, err := c.TellWithTimeout("square", 4*time.Second, 2)
+	if err != nil {
+		t.Fatalf("Tell()=%s", err)
+	}
+
+	if n := result.MustFloat64(); n != 4 {
+		t.Fatalf("got %v, want 4", n)
+	}
+}
@@ -0,0 +1,426 @@
+// Package kitebench load tests kites. It calls methods of a kite over
+// many concurrent connections and reports the latency percentiles,
+// throughput and errors of the calls.
+//
+//	report, err := kitebench.Run(ctx, &kitebench.Options{
+//		Connections: 50,
+//		Duration:    time.Minute,
+//		Workloads: []kitebench.Workload{
+//			{Method: "square", Args: []interface{}{4}, Weight: 9},
+//			{Method: "divide", Args: []interface{}{10, 2}},
+//		},
+//		Dial: func() (*kite.Client, error) {
+//			c := k.NewClient("http://localhost:6000/kite")
+//			return c, c.Dial()
+//		},
+//	})
+package kitebench
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/koding/kite"
+)
+
+// Workload is a method call made by the benchmark.
+type Workload struct {
+	Method string        `json:"method"`
+	Args   []interface{} `json:"args,omitempty"`
+
+	// Weight is the relative frequency of the call among the workloads,
+	// 1 if zero.
+	Weight int `json:"weight,omitempty"`
+}
+
+// Options configures the benchmark.
+type Options struct {
+	// Connections is the number of connections to the kite, 1 if zero.
+	Connections int
+
+	// Concurrency is the number of concurrent calls over each
+	// connection, 1 if zero.
+	Concurrency int
+
+	// Calls is the number of calls made by the benchmark. If zero,
+	// the calls are made until Duration passes.
+	Calls int
+
+	// Duration limits the time the calls are made for.
+	// Either Calls or Duration must be set.
+	Duration time.Duration
+
+	// Rate limits the number of calls per second made over all the
+	// connections. If zero, the calls are made as fast as possible.
+	Rate float64
+
+	// Timeout is the timeout of the calls. If zero, the timeout
+	// of the clients is used.
+	Timeout time.Duration
+
+	// Workloads are the calls made by the benchmark, picked
+	// randomly according to their weights.
+	Workloads []Workload
+
+	// Dial gives a connected client of the kite. It is called
+	// for each of the connections.
+	Dial func() (*kite.Client, error)
+}
+
+// Report is the result of the benchmark.
+type Report struct {
+	Connections int           `json:"connections"`
+	Calls       int           `json:"calls"`
+	Failed      int           `json:"failed"`
+	Elapsed     time.Duration `json:"elapsed"`    // in nanoseconds
+	Throughput  float64       `json:"throughput"` // calls per second
+
+	// Latency is the latency of all the calls.
+	Latency Latency `json:"latency"`
+
+	// Errors are the numbers of the failed calls by the type of the error,
+	// e.g. "timeout" or "methodNotFound".
+	Errors map[string]int `json:"errors,omitempty"`
+
+	// Methods are the reports of the calls of each method.
+	Methods map[string]*MethodReport `json:"methods"`
+}
+
+// MethodReport is the result of the calls of a method.
+type MethodReport struct {
+	Calls   int     `json:"calls"`
+	Failed  int     `json:"failed"`
+	Latency Latency `json:"latency"`
+}
+
+// Latency describes the distribution of latencies of calls,
+// the durations are in nanoseconds when encoded to JSON.
+type Latency struct {
+	Min  time.Duration `json:"min"`
+	Mean time.Duration `json:"mean"`
+	P50  time.Duration `json:"p50"`
+	P90  time.Duration `json:"p90"`
+	P95  time.Duration `json:"p95"`
+	P99  time.Duration `json:"p99"`
+	Max  time.Duration `json:"max"`
+}
+
+// call is the result of a single call.
+type call struct {
+	method  string
+	latency time.Duration
+	err     string // type of the error, empty on success
+}
+
+// Run runs the benchmark until the calls are made, Duration passes or
+// the ctx is done. The connections are closed when it returns.
+func Run(ctx context.Context, opts *Options) (*Report, error) {
+	if opts.Dial == nil {
+		return nil, errors.New("kitebench: missing Dial")
+	}
+
+	if len(opts.Workloads) == 0 {
+		return nil, errors.New("kitebench: missing workloads")
+	}
+
+	if opts.Calls <= 0 && opts.Duration <= 0 {
+		return nil, errors.New("kitebench: either Calls or Duration must be set")
+	}
+
+	connections := atLeastOne(opts.Connections)
+	concurrency := atLeastOne(opts.Concurrency)
+
+	clients := make([]*kite.Client, 0, connections)
+	defer func() {
+		for _, c := range clients {
+			c.Close()
+		}
+	}()
+
+	for i := 0; i < connections; i++ {
+		c, err := opts.Dial()
+		if err != nil {
+			return nil, fmt.Errorf("kitebench: connection #%d failed: %s", i, err)
+		}
+
+		clients = append(clients, c)
+	}
+
+	if opts.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Duration)
+		defer cancel()
+	}
+
+	var tick <-chan time.Time
+	if opts.Rate > 0 {
+		// Rates above a call per nanosecond are not limited.
+		if interval := time.Duration(float64(time.Second) / opts.Rate); interval > 0 {
+			t := time.NewTicker(interval)
+			defer t.Stop()
+			tick = t.C
+		}
+	}
+
+	var (
+		wg      sync.WaitGroup
+		claimed int64
+		results = make([][]call, connections*concurrency)
+		start   = time.Now()
+	)
+
+	for i := range results {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			c := clients[i%connections]
+			rnd := rand.New(rand.NewSource(start.UnixNano() + int64(i)))
+
+			for {
+				if opts.Calls > 0 && atomic.AddInt64(&claimed, 1) > int64(opts.Calls) {
+					return
+				}
+
+				if tick != nil {
+					select {
+					case <-tick:
+					case <-ctx.Done():
+						return
+					}
+				}
+
+				select {
+				case <-ctx.Done():
+					return
+				default:
+				}
+
+				w := pick(opts.Workloads, rnd)
+				callStart := time.Now()
+
+				_, err := c.TellWithTimeout(w.Method, opts.Timeout, w.Args...)
+
+				results[i] = append(results[i], call{
+					method:  w.Method,
+					latency: time.Since(callStart),
+					err:     errorType(err),
+				})
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	return newReport(connections, time.Since(start), results), nil
+}
+
+// pick picks a workload randomly according to the weights.
+func pick(workloads []Workload, rnd *rand.Rand) *Workload {
+	total := 0
+	for _, w := range workloads {
+		total += atLeastOne(w.Weight)
+	}
+
+	n := rnd.Intn(total)
+
+	for i := range workloads {
+		if n -= atLeastOne(workloads[i].Weight); n < 0 {
+			return &workloads[i]
+		}
+	}
+
+	return &workloads[len(workloads)-1]
+}
+
+// errorType gives the type the error is reported with.
+func errorType(err error) string {
+	switch e := err.(type) {
+	case nil:
+		return ""
+	case *kite.Error:
+		if e.Type == "" {
+			return "genericError"
+		}
+
+		return e.Type
+	default:
+		return err.Error()
+	}
+}
+
+func newReport(connections int, elapsed time.Duration, results [][]call) *Report {
+	r := &Report{
+		Connections: connections,
+		Elapsed:     elapsed,
+		Errors:      make(map[string]int),
+		Methods:     make(map[string]*MethodReport),
+	}
+
+	var all []time.Duration
+	methods := make(map[string][]time.Duration)
+
+	for _, calls := range results {
+		for _, c := range calls {
+			m, ok := r.Methods[c.method]
+			if !ok {
+				m = &MethodReport{}
+				r.Methods[c.method] = m
+			}
+
+			r.Calls++
+			m.Calls++
+
+			if c.err != "" {
+				r.Failed++
+				m.Failed++
+				r.Errors[c.err]++
+			}
+
+			all = append(all, c.latency)
+			methods[c.method] = append(methods[c.method], c.latency)
+		}
+	}
+
+	if elapsed > 0 {
+		r.Throughput = float64(r.Calls) / elapsed.Seconds()
+	}
+
+	r.Latency = newLatency(all)
+
+	for method, latencies := range methods {
+		r.Methods[method].Latency = newLatency(latencies)
+	}
+
+	return r
+}
+
+// newLatency gives the distribution of the latencies, which are sorted.
+func newLatency(latencies []time.Duration) Latency {
+	if len(latencies) == 0 {
+		return Latency{}
+	}
+
+	sort.Slice(latencies, func(i, j int) bool {
+		return latencies[i] < latencies[j]
+	})
+
+	var sum time.Duration
+	for _, d := range latencies {
+		sum += d
+	}
+
+	return Latency{
+		Min:  latencies[0],
+		Mean: sum / time.Duration(len(latencies)),
+		P50:  percentile(latencies, 50),
+		P90:  percentile(latencies, 90),
+		P95:  percentile(latencies, 95),
+		P99:  percentile(latencies, 99),
+		Max:  latencies[len(latencies)-1],
+	}
+}
+
+// percentile gives the p-th percentile of the sorted latencies,
+// using the nearest-rank method.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	i := (p*len(sorted)+99)/100 - 1
+	if i < 0 {
+		i = 0
+	}
+
+	return sorted[i]
+}
+
+// ReadWorkloads reads the workloads from the JSON file,
+// which holds a list of them.
+func ReadWorkloads(file string) ([]Workload, error) {
+	p, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var workloads []Workload
+	if err := json.Unmarshal(p, &workloads); err != nil {
+		return nil, err
+	}
+
+	for i, w := range workloads {
+		if w.Method == "" {
+			return nil, fmt.Errorf("kitebench: missing method of workload #%d", i)
+		}
+	}
+
+	return workloads, nil
+}
+
+// WriteText writes the report in a human-readable form.
+func (r *Report) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintf(tw, "Connections:\t%d\n", r.Connections)
+	fmt.Fprintf(tw, "Calls:\t%d (%d failed)\n", r.Calls, r.Failed)
+	fmt.Fprintf(tw, "Elapsed:\t%s\n", r.Elapsed.Round(time.Millisecond))
+	fmt.Fprintf(tw, "Throughput:\t%.1f calls/s\n", r.Throughput)
+	fmt.Fprintln(tw)
+
+	fmt.Fprintln(tw, "METHOD\tCALLS\tFAILED\tMIN\tMEAN\tP50\tP90\tP95\tP99\tMAX")
+	writeLatency(tw, "(all)", r.Calls, r.Failed, r.Latency)
+
+	methods := make([]string, 0, len(r.Methods))
+	for method := range r.Methods {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+
+	for _, method := range methods {
+		m := r.Methods[method]
+		writeLatency(tw, method, m.Calls, m.Failed, m.Latency)
+	}
+
+	if len(r.Errors) != 0 {
+		fmt.Fprintln(tw)
+		fmt.Fprintln(tw, "ERROR\tCALLS")
+
+		errs := make([]string, 0, len(r.Errors))
+		for typ := range r.Errors {
+			errs = append(errs, typ)
+		}
+		sort.Strings(errs)
+
+		for _, typ := range errs {
+			fmt.Fprintf(tw, "%s\t%d\n", typ, r.Errors[typ])
+		}
+	}
+
+	return tw.Flush()
+}
+
+func writeLatency(w io.Writer, name string, calls, failed int, l Latency) {
+	fmt.Fprintf(w, "%s\t%d\t%d", name, calls, failed)
+
+	for _, d := range []time.Duration{l.Min, l.Mean, l.P50, l.P90, l.P95, l.P99, l.Max} {
+		fmt.Fprintf(w, "\t%s", d.Round(time.Microsecond))
+	}
+
+	fmt.Fprintln(w)
+}
+
+// atLeastOne gives n, or 1 if n is not positive.
+func atLeastOne(n int) int {
+	if n < 1 {
+		return 1
+	}
+	return n
+}
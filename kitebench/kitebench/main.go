@@ -0,0 +1,138 @@
+// Command kitebench load tests a kite, see the kitebench package.
+//
+//	kitebench -c 50 -d 1m http://localhost:6000/kite square 4
+//	kitebench -c 50 -n 100000 -workload workload.json http://localhost:6000/kite
+//
+// A workload file holds a JSON list of the calls made, e.g.:
+//
+//	[
+//	  {"method": "square", "args": [4], "weight": 9},
+//	  {"method": "divide", "args": [10, 2]}
+//	]
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/koding/kite"
+	"github.com/koding/kite/config"
+	"github.com/koding/kite/kitebench"
+	"github.com/koding/kite/kitekey"
+)
+
+var (
+	flagConnections = flag.Int("c", 10, "Number of connections")
+	flagConcurrency = flag.Int("concurrency", 1, "Number of concurrent calls per connection")
+	flagCalls       = flag.Int("n", 0, "Number of calls, the calls are made for the duration if 0")
+	flagDuration    = flag.Duration("d", 10*time.Second, "Duration of the benchmark, if the number of calls is not given")
+	flagRate        = flag.Float64("rate", 0, "Calls per second, unlimited if 0")
+	flagTimeout     = flag.Duration("timeout", 4*time.Second, "Timeout of the calls")
+	flagWorkload    = flag.String("workload", "", "JSON file with the workloads")
+	flagJSON        = flag.Bool("json", false, "Print the report as JSON")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: kitebench [options] <url> [<method> [JSON arguments]]")
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+
+	workloads, err := readWorkloads()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	k := kite.New("kitebench", "0.0.1")
+	k.Config = config.MustGet()
+	k.SetLogLevel(kite.WARNING)
+
+	// The kite key is optional, kites which do not
+	// require authentication can be benchmarked without it.
+	key, _ := kitekey.Read()
+
+	opts := &kitebench.Options{
+		Connections: *flagConnections,
+		Concurrency: *flagConcurrency,
+		Calls:       *flagCalls,
+		Rate:        *flagRate,
+		Timeout:     *flagTimeout,
+		Workloads:   workloads,
+		Dial: func() (*kite.Client, error) {
+			c := k.NewClient(flag.Arg(0))
+
+			if key != "" {
+				c.Auth = &kite.Auth{
+					Type: "kiteKey",
+					Key:  key,
+				}
+			}
+
+			return c, c.DialTimeout(*flagTimeout)
+		},
+	}
+
+	if opts.Calls == 0 {
+		opts.Duration = *flagDuration
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	report, err := kitebench.Run(ctx, opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *flagJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(report)
+	} else {
+		err = report.WriteText(os.Stdout)
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// readWorkloads gives the workloads from the workload file,
+// or the single one given by the arguments.
+func readWorkloads() ([]kitebench.Workload, error) {
+	switch {
+	case *flagWorkload != "" && flag.NArg() == 1:
+		return kitebench.ReadWorkloads(*flagWorkload)
+	case *flagWorkload == "" && (flag.NArg() == 2 || flag.NArg() == 3):
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	w := kitebench.Workload{Method: flag.Arg(1)}
+
+	if flag.NArg() == 3 {
+		var args interface{}
+		if err := json.Unmarshal([]byte(flag.Arg(2)), &args); err != nil {
+			return nil, fmt.Errorf("invalid JSON arguments %s: %s", flag.Arg(2), err)
+		}
+
+		// A JSON array is passed as the list of arguments,
+		// other values as the only argument, like with kitectl tell.
+		if list, ok := args.([]interface{}); ok {
+			w.Args = list
+		} else {
+			w.Args = []interface{}{args}
+		}
+	}
+
+	return []kitebench.Workload{w}, nil
+}
@@ -0,0 +1,191 @@
+package kitebench
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/koding/kite"
+	"github.com/koding/kite/config"
+	"github.com/koding/kite/kitetest"
+)
+
+func newTarget() *kite.Kite {
+	k := kite.New("target", "0.0.1")
+	k.Config = config.New()
+	k.Config.DisableAuthentication = true
+
+	k.HandleFunc("square", func(r *kite.Request) (interface{}, error) {
+		n := r.Args.One().MustFloat64()
+		return n * n, nil
+	}).DisableAuthentication()
+
+	k.HandleFunc("fail", func(r *kite.Request) (interface{}, error) {
+		return nil, errors.New("failed")
+	}).DisableAuthentication()
+
+	return k
+}
+
+func TestRun(t *testing.T) {
+	target := newTarget()
+	defer target.Close()
+
+	local := kite.New("local", "0.0.1")
+	local.Config = config.New()
+
+	dials := 0
+
+	opts := &Options{
+		Connections: 4,
+		Concurrency: 2,
+		Calls:       200,
+		Timeout:     4 * time.Second,
+		Workloads: []Workload{
+			{Method: "square", Args: []interface{}{4}, Weight: 3},
+			{Method: "fail"},
+		},
+		Dial: func() (*kite.Client, error) {
+			dials++
+			c := kitetest.Connect(local, target)
+			return c, c.Dial()
+		},
+	}
+
+	report, err := Run(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("Run()=%s", err)
+	}
+
+	if dials != 4 || report.Connections != 4 {
+		t.Fatalf("got %d dials and %d connections, want 4", dials, report.Connections)
+	}
+
+	if report.Calls != 200 {
+		t.Fatalf("got %d calls, want 200", report.Calls)
+	}
+
+	square, fail := report.Methods["square"], report.Methods["fail"]
+	if square == nil || fail == nil || square.Calls+fail.Calls != 200 {
+		t.Fatalf("got methods %+v", report.Methods)
+	}
+
+	if square.Failed != 0 || fail.Failed != fail.Calls || report.Failed != fail.Calls {
+		t.Fatalf("got %d failed calls of square, %d of %d calls of fail, %d in total",
+			square.Failed, fail.Failed, fail.Calls, report.Failed)
+	}
+
+	if n := report.Errors["genericError"]; n != fail.Calls {
+		t.Fatalf("got %d generic errors, want %d", n, fail.Calls)
+	}
+
+	l := report.Latency
+	if l.Min <= 0 || l.Min > l.P50 || l.P50 > l.P90 || l.P90 > l.P99 || l.P99 > l.Max {
+		t.Fatalf("got invalid latency %+v", l)
+	}
+
+	if report.Throughput <= 0 {
+		t.Fatalf("got throughput %v", report.Throughput)
+	}
+
+	var buf bytes.Buffer
+	if err := report.WriteText(&buf); err != nil {
+		t.Fatalf("WriteText()=%s", err)
+	}
+
+	for _, s := range []string{"Calls:", "square", "fail", "genericError"} {
+		if !strings.Contains(buf.String(), s) {
+			t.Errorf("report does not contain %q:\n%s", s, &buf)
+		}
+	}
+}
+
+func TestRunDuration(t *testing.T) {
+	target := newTarget()
+	defer target.Close()
+
+	local := kite.New("local", "0.0.1")
+	local.Config = config.New()
+
+	start := time.Now()
+
+	report, err := Run(context.Background(), &Options{
+		Duration:  200 * time.Millisecond,
+		Rate:      100,
+		Workloads: []Workload{{Method: "square", Args: []interface{}{2}}},
+		Dial: func() (*kite.Client, error) {
+			c := kitetest.Connect(local, target)
+			return c, c.Dial()
+		},
+	})
+	if err != nil {
+		t.Fatalf("Run()=%s", err)
+	}
+
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("Run() took %s", d)
+	}
+
+	// The rate limits the calls to 20 within the duration.
+	if report.Calls == 0 || report.Calls > 21 || report.Failed != 0 {
+		t.Fatalf("got %d calls, %d failed", report.Calls, report.Failed)
+	}
+}
+
+func TestRunInvalid(t *testing.T) {
+	dial := func() (*kite.Client, error) { return nil, errors.New("unreachable") }
+	workloads := []Workload{{Method: "square"}}
+
+	cases := map[string]*Options{
+		"missing dial":      {Calls: 1, Workloads: workloads},
+		"missing workloads": {Calls: 1, Dial: dial},
+		"missing limit":     {Workloads: workloads, Dial: dial},
+		"dial failure":      {Calls: 1, Workloads: workloads, Dial: dial},
+	}
+
+	for name, opts := range cases {
+		if _, err := Run(context.Background(), opts); err == nil {
+			t.Errorf("%s: expected Run to fail", name)
+		}
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	var sorted []time.Duration
+	for i := 1; i <= 100; i++ {
+		sorted = append(sorted, time.Duration(i))
+	}
+
+	for p, want := range map[int]time.Duration{50: 50, 90: 90, 99: 99, 100: 100} {
+		if got := percentile(sorted, p); got != want {
+			t.Errorf("percentile(%d)=%d, want %d", p, got, want)
+		}
+	}
+
+	if got := percentile(sorted[:1], 99); got != 1 {
+		t.Errorf("percentile of a single latency = %d, want 1", got)
+	}
+}
+
+func TestReadWorkloads(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "workload.json")
+
+	err := os.WriteFile(file, []byte(`[{"method": "square", "args": [4], "weight": 9}, {"method": "version"}]`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	workloads, err := ReadWorkloads(file)
+	if err != nil {
+		t.Fatalf("ReadWorkloads()=%s", err)
+	}
+
+	if len(workloads) != 2 || workloads[0].Weight != 9 || len(workloads[0].Args) != 1 || workloads[1].Method != "version" {
+		t.Fatalf("got %+v", workloads)
+	}
+}
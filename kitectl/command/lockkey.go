@@ -0,0 +1,145 @@
+package command
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"strings"
+
+	"github.com/koding/kite/kitekey"
+
+	"github.com/mitchellh/cli"
+)
+
+type Lockkey struct {
+	Ui cli.Ui
+}
+
+func NewLockkey() cli.CommandFactory {
+	return func() (cli.Command, error) {
+		return &Lockkey{
+			Ui: DefaultUi,
+		}, nil
+	}
+}
+
+func (c *Lockkey) Synopsis() string {
+	return "Encrypts the registration key"
+}
+
+func (c *Lockkey) Help() string {
+	helpText := `
+Usage: kitectl lockkey [options]
+
+  Encrypts the registration key stored in ~/.kite/kite.key, so it is
+  not kept in plaintext. Kites unlock it transparently when reading it.
+
+  By default the key is encrypted with a passphrase, which kites read
+  from the KITE_KEY_PASSPHRASE environment variable or prompt for.
+
+Options:
+
+  -keyring  Keep the encryption key in the keychain of the OS instead
+            of using a passphrase
+`
+	return strings.TrimSpace(helpText)
+}
+
+func (c *Lockkey) Run(args []string) int {
+	var useKeyring bool
+
+	flags := flag.NewFlagSet("lockkey", flag.ExitOnError)
+	flags.BoolVar(&useKeyring, "keyring", false, "Use the keychain of the OS")
+	flags.Parse(args)
+
+	kiteKey, err := kitekey.Read()
+	if err != nil {
+		c.Ui.Error(err.Error())
+		return 1
+	}
+
+	if useKeyring {
+		err = kitekey.WriteKeyring(kiteKey)
+	} else {
+		var passphrase string
+
+		if passphrase, err = c.passphrase(); err != nil {
+			c.Ui.Error(err.Error())
+			return 1
+		}
+
+		err = kitekey.WriteEncrypted(kiteKey, []byte(passphrase))
+	}
+
+	if err != nil {
+		c.Ui.Error(err.Error())
+		return 1
+	}
+
+	c.Ui.Info("Registration key encrypted successfully")
+
+	return 0
+}
+
+func (c *Lockkey) passphrase() (string, error) {
+	if passphrase := os.Getenv("KITE_KEY_PASSPHRASE"); passphrase != "" {
+		return passphrase, nil
+	}
+
+	passphrase, err := c.Ui.AskSecret("Passphrase:")
+	if err != nil {
+		return "", err
+	}
+
+	if passphrase == "" {
+		return "", errors.New("passphrase can not be empty")
+	}
+
+	confirm, err := c.Ui.AskSecret("Confirm passphrase:")
+	if err != nil {
+		return "", err
+	}
+
+	if confirm != passphrase {
+		return "", errors.New("passphrases do not match")
+	}
+
+	return passphrase, nil
+}
+
+type Unlockkey struct {
+	Ui cli.Ui
+}
+
+func NewUnlockkey() cli.CommandFactory {
+	return func() (cli.Command, error) {
+		return &Unlockkey{
+			Ui: DefaultUi,
+		}, nil
+	}
+}
+
+func (c *Unlockkey) Synopsis() string {
+	return "Decrypts the registration key"
+}
+
+func (c *Unlockkey) Help() string {
+	helpText := `
+Usage: kitectl unlockkey
+
+  Decrypts the registration key encrypted with lockkey, storing it
+  in ~/.kite/kite.key in plaintext again.
+`
+	return strings.TrimSpace(helpText)
+}
+
+func (c *Unlockkey) Run(_ []string) int {
+	if err := kitekey.Unlock(); err != nil {
+		c.Ui.Error(err.Error())
+		return 1
+	}
+
+	c.Ui.Info("Registration key decrypted successfully")
+
+	return 0
+}
@@ -0,0 +1,104 @@
+package command
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/cli"
+)
+
+type OpenAPI struct {
+	Ui cli.Ui
+}
+
+func NewOpenAPI() cli.CommandFactory {
+	return func() (cli.Command, error) {
+		return &OpenAPI{
+			Ui: DefaultUi,
+		}, nil
+	}
+}
+
+func (c *OpenAPI) Synopsis() string {
+	return "Prints the OpenAPI document of a kite"
+}
+
+func (c *OpenAPI) Help() string {
+	helpText := `
+Usage: kitectl openapi [options]
+
+  Prints the OpenAPI document describing the methods of a kite, as they
+  are called through its HTTP gateway, so clients can be generated
+  from it. The kite needs to serve the document with
+  gateway.HandleOpenAPI.
+
+Options:
+
+  -to=URL          URL of the remote kite
+  -timeout=4s      Timeout of the request.
+`
+	return strings.TrimSpace(helpText)
+}
+
+func (c *OpenAPI) Run(args []string) int {
+	var to string
+	var timeout time.Duration
+
+	flags := flag.NewFlagSet("openapi", flag.ExitOnError)
+	flags.StringVar(&to, "to", "", "URL of remote kite")
+	flags.DurationVar(&timeout, "timeout", 4*time.Second, "timeout of the request")
+	flags.Parse(args)
+
+	if to == "" {
+		c.Ui.Output(c.Help())
+		return 1
+	}
+
+	u, err := url.Parse(to)
+	if err != nil {
+		c.Ui.Error(err.Error())
+		return 1
+	}
+
+	// The document is served next to the kite endpoint,
+	// e.g. http://localhost:3000/openapi.json.
+	u.Path = path.Join(path.Dir(u.Path), "openapi.json")
+
+	client := &http.Client{Timeout: timeout}
+
+	resp, err := client.Get(u.String())
+	if err != nil {
+		c.Ui.Error(err.Error())
+		return 1
+	}
+	defer resp.Body.Close()
+
+	p, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		c.Ui.Error(err.Error())
+		return 1
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		c.Ui.Error(fmt.Sprintf("unable to get OpenAPI document from %s: %s", u, resp.Status))
+		return 1
+	}
+
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, p, "", "  "); err != nil {
+		c.Ui.Error(err.Error())
+		return 1
+	}
+
+	c.Ui.Output(buf.String())
+
+	return 0
+}
@@ -0,0 +1,299 @@
+package command
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/koding/kite"
+	"github.com/koding/kite/kitekey"
+	"github.com/mitchellh/cli"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// replHistoryFile is the file in the kite home directory,
+// which keeps the lines entered in the REPL.
+const replHistoryFile = "kitectl_history"
+
+type Repl struct {
+	KiteClient *kite.Kite
+	Ui         cli.Ui
+}
+
+func NewRepl() cli.CommandFactory {
+	return func() (cli.Command, error) {
+		return &Repl{
+			KiteClient: DefaultKiteClient,
+			Ui:         DefaultUi,
+		}, nil
+	}
+}
+
+func (c *Repl) Synopsis() string {
+	return "Starts an interactive shell for calling methods on a kite"
+}
+
+func (c *Repl) Help() string {
+	helpText := `
+Usage: kitectl repl [options] <query|url>
+
+  Starts an interactive shell for calling methods on a kite, which is
+  given like for kitectl tell. Lines are entered in the form of:
+
+    <method> [JSON arguments]
+
+  e.g. square 4 or divide [10, 2]. A JSON array is passed as the list
+  of arguments, other values as the only argument. Method names are
+  completed with Tab, the history is kept in ~/.kite/kitectl_history.
+
+  Commands:
+
+    methods [prefix]  List the methods of the kite.
+    help              Show this help.
+    exit              Exit the shell, like Ctrl-D.
+
+Options:
+
+  -timeout=4s  Timeout of the calls.
+`
+	return strings.TrimSpace(helpText)
+}
+
+func (c *Repl) Run(args []string) int {
+	var timeout time.Duration
+
+	flags := flag.NewFlagSet("repl", flag.ExitOnError)
+	flags.DurationVar(&timeout, "timeout", 4*time.Second, "timeout of the calls")
+
+	positional := parseInterspersed(flags, args)
+	if len(positional) != 1 {
+		c.Ui.Output(c.Help())
+		return 1
+	}
+
+	remote, err := dialKite(c.KiteClient, positional[0], timeout)
+	if err != nil {
+		c.Ui.Error(err.Error())
+		return 1
+	}
+	defer remote.Close()
+
+	r := &repl{
+		remote:  remote,
+		timeout: timeout,
+	}
+
+	if err := r.loadMethods(); err != nil {
+		c.Ui.Error("Method names are not completed: " + err.Error())
+	}
+
+	if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		// Lines are read from a pipe, e.g. a script.
+		scanner := bufio.NewScanner(os.Stdin)
+
+		r.w = os.Stdout
+		r.run(func() (string, error) {
+			if !scanner.Scan() {
+				return "", io.EOF
+			}
+
+			return scanner.Text(), nil
+		})
+
+		return 0
+	}
+
+	state, err := terminal.MakeRaw(int(os.Stdin.Fd()))
+	if err != nil {
+		c.Ui.Error(err.Error())
+		return 1
+	}
+	defer terminal.Restore(int(os.Stdin.Fd()), state)
+
+	term := terminal.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout}, remote.Kite.Name+"> ")
+	term.AutoCompleteCallback = r.complete
+
+	if width, height, err := terminal.GetSize(int(os.Stdout.Fd())); err == nil {
+		term.SetSize(width, height)
+	}
+
+	r.w = term
+	r.loadHistory(term)
+	r.run(term.ReadLine)
+
+	return 0
+}
+
+// repl is the shell of the remote kite.
+type repl struct {
+	remote  *kite.Client
+	timeout time.Duration
+	methods []string // sorted method names
+	w       io.Writer
+	history *os.File
+}
+
+// run reads lines with readLine and evaluates them until the input
+// ends, e.g. on Ctrl-D, or the shell is exited.
+func (r *repl) run(readLine func() (string, error)) {
+	if r.history != nil {
+		defer r.history.Close()
+	}
+
+	for {
+		line, err := readLine()
+		if err != nil {
+			return
+		}
+
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		if r.history != nil {
+			fmt.Fprintln(r.history, line)
+		}
+
+		if !r.eval(line) {
+			return
+		}
+	}
+}
+
+// eval evaluates the line, it returns false if the shell should exit.
+func (r *repl) eval(line string) bool {
+	fields := strings.SplitN(line, " ", 2)
+	method, rest := fields[0], ""
+	if len(fields) == 2 {
+		rest = strings.TrimSpace(fields[1])
+	}
+
+	switch method {
+	case "exit", "quit":
+		return false
+	case "help":
+		fmt.Fprintln(r.w, "<method> [JSON arguments] | methods [prefix] | help | exit")
+		return true
+	case "methods":
+		for _, m := range r.methods {
+			if strings.HasPrefix(m, rest) {
+				fmt.Fprintln(r.w, m)
+			}
+		}
+		return true
+	}
+
+	var params []interface{}
+
+	if rest != "" {
+		var err error
+		if params, err = tellParams(rest, nil); err != nil {
+			fmt.Fprintln(r.w, "error:", err)
+			return true
+		}
+	}
+
+	result, err := r.remote.TellWithTimeout(method, r.timeout, params...)
+	if err != nil {
+		fmt.Fprintln(r.w, "error:", err)
+		return true
+	}
+
+	fmt.Fprintln(r.w, formatResult(result))
+
+	return true
+}
+
+// loadMethods fetches the method names of the remote kite,
+// older kites which do not serve kite.methods fail.
+func (r *repl) loadMethods() error {
+	result, err := r.remote.TellWithTimeout("kite.methods", r.timeout)
+	if err != nil {
+		return err
+	}
+
+	var infos []kite.MethodInfo
+	if err := result.Unmarshal(&infos); err != nil {
+		return err
+	}
+
+	for _, info := range infos {
+		r.methods = append(r.methods, info.Name)
+	}
+
+	sort.Strings(r.methods)
+
+	return nil
+}
+
+// loadHistory adds the lines of the previous sessions to the history
+// of the terminal and opens the history file for appending.
+func (r *repl) loadHistory(term *terminal.Terminal) {
+	home, err := kitekey.KiteHome()
+	if err != nil {
+		return
+	}
+
+	file := filepath.Join(home, replHistoryFile)
+
+	if f, err := os.Open(file); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			term.History.Add(scanner.Text())
+		}
+		f.Close()
+	}
+
+	if f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600); err == nil {
+		r.history = f
+	}
+}
+
+// complete completes the method name before the cursor on Tab. If there
+// are many methods which match, the longest common prefix is completed
+// and the methods are listed.
+func (r *repl) complete(line string, pos int, key rune) (string, int, bool) {
+	if key != '\t' || strings.Contains(line[:pos], " ") {
+		return "", 0, false
+	}
+
+	prefix := line[:pos]
+
+	var matches []string
+	for _, m := range r.methods {
+		if strings.HasPrefix(m, prefix) {
+			matches = append(matches, m)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return "", 0, false
+	case 1:
+		completed := matches[0] + " "
+		return completed + line[pos:], len(completed), true
+	}
+
+	common := matches[0]
+	for _, m := range matches[1:] {
+		for !strings.HasPrefix(m, common) {
+			common = common[:len(common)-1]
+		}
+	}
+
+	if common == prefix {
+		fmt.Fprintln(r.w, strings.Join(matches, "  "))
+	}
+
+	return common + line[pos:], len(common), true
+}
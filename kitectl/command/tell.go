@@ -1,13 +1,23 @@
 package command
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/signal"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/koding/kite"
+	"github.com/koding/kite/config"
+	"github.com/koding/kite/dnode"
 	"github.com/koding/kite/kitekey"
+	"github.com/koding/kite/protocol"
 	"github.com/mitchellh/cli"
 )
 
@@ -31,56 +41,189 @@ func (c *Tell) Synopsis() string {
 
 func (c *Tell) Help() string {
 	helpText := `
-Usage: kitectl tell [options]
+Usage: kitectl tell [options] <query|url> <method> [args...]
 
-  Calls a method on a kite.
+  Calls a method on a kite and prints the JSON response.
+
+  The kite is given either by its URL or by a Kontrol query in
+  the form of /username/environment/name/version/region/hostname/id,
+  where trailing fields may be omitted, e.g. /koding/production/math.
+  Calls are authenticated with the local kite.key.
+
+  Arguments given after the method are passed as strings or numbers,
+  use -json for other types.
 
 Options:
 
-  -to=URL          URL of the remote kite
-  -method=divide   Method name to be invoked
-  -timeout=4       Timeout in seconds.
+  -json='[1, "a"]'  JSON arguments of the method. An array is passed
+                    as the list of arguments, other values as the
+                    only argument.
+  -timeout=4s       Timeout of the call.
+  -watch=1s         Call the method repeatedly with the given interval
+                    until interrupted.
+  -to=URL           URL of the remote kite (deprecated).
+  -method=divide    Method name to be invoked (deprecated).
 `
 	return strings.TrimSpace(helpText)
 }
 
 func (c *Tell) Run(args []string) int {
 
-	var to, method string
-	var timeout time.Duration
+	var to, method, jsonArgs string
+	var timeout, watch time.Duration
 
 	flags := flag.NewFlagSet("tell", flag.ExitOnError)
 	flags.StringVar(&to, "to", "", "URL of remote kite")
 	flags.StringVar(&method, "method", "", "method to be called")
+	flags.StringVar(&jsonArgs, "json", "", "JSON arguments of the method")
 	flags.DurationVar(&timeout, "timeout", 4*time.Second, "timeout of tell method")
-	flags.Parse(args)
+	flags.DurationVar(&watch, "watch", 0, "interval of calling the method repeatedly")
+
+	positional := parseInterspersed(flags, args)
 
-	if to == "" || method == "" {
+	if to == "" && len(positional) != 0 {
+		to, positional = positional[0], positional[1:]
+	}
+
+	if method == "" && len(positional) != 0 {
+		method, positional = positional[0], positional[1:]
+	}
+
+	if to == "" || method == "" || (jsonArgs != "" && len(positional) != 0) {
 		c.Ui.Output(c.Help())
 		return 1
 	}
 
-	key, err := kitekey.Read()
+	params, err := tellParams(jsonArgs, positional)
+	if err != nil {
+		c.Ui.Error(err.Error())
+		return 1
+	}
+
+	remote, err := dialKite(c.KiteClient, to, timeout)
+	if err != nil {
+		c.Ui.Error(err.Error())
+		return 1
+	}
+	defer remote.Close()
+
+	if watch <= 0 {
+		return c.tell(remote, method, timeout, params)
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+
+	t := time.NewTicker(watch)
+	defer t.Stop()
+
+	for {
+		c.Ui.Output(fmt.Sprintf("# %s", time.Now().Format(time.RFC3339)))
+		c.tell(remote, method, timeout, params)
+
+		select {
+		case <-interrupt:
+			return 0
+		case <-t.C:
+		}
+	}
+}
+
+// tell calls the method and prints the response.
+func (c *Tell) tell(remote *kite.Client, method string, timeout time.Duration, params []interface{}) int {
+	result, err := remote.TellWithTimeout(method, timeout, params...)
 	if err != nil {
 		c.Ui.Error(err.Error())
 		return 1
 	}
 
-	remote := c.KiteClient.NewClient(to)
+	c.Ui.Info(formatResult(result))
+
+	return 0
+}
+
+// formatResult gives the indented JSON of the result.
+func formatResult(result *dnode.Partial) string {
+	if result == nil {
+		return "null"
+	}
+
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, result.Raw, "", "  "); err != nil {
+		return string(result.Raw)
+	}
+
+	return buf.String()
+}
+
+// dialKite connects to the kite at the given URL, or to a kite which
+// matches the given query, and authenticates with the local kite.key.
+func dialKite(k *kite.Kite, to string, timeout time.Duration) (*kite.Client, error) {
+	key, err := kitekey.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	var remote *kite.Client
+
+	if strings.HasPrefix(to, "/") {
+		query, err := protocol.KiteFromString(to)
+		if err != nil {
+			return nil, err
+		}
+
+		k.Config = config.MustGet()
+		k.Config.Transport = config.XHRPolling
+
+		clients, err := k.GetKites(query.Query())
+		if err != nil {
+			return nil, err
+		}
+
+		// Kontrol returns the kites in random order, any of them is fine.
+		remote = clients[rand.Intn(len(clients))]
+	} else {
+		remote = k.NewClient(to)
+	}
+
 	remote.Auth = &kite.Auth{
 		Type: "kiteKey",
 		Key:  key,
 	}
 
-	if err = remote.Dial(); err != nil {
-		c.Ui.Error(err.Error())
-		return 1
+	if err := remote.DialTimeout(timeout); err != nil {
+		return nil, err
+	}
+
+	return remote, nil
+}
+
+// tellParams gives the arguments of the method. The arguments given
+// as a JSON value are passed as they are, the other ones are converted
+// to numbers if possible, like the arguments of older versions.
+func tellParams(jsonArgs string, args []string) ([]interface{}, error) {
+	if jsonArgs != "" {
+		if !json.Valid([]byte(jsonArgs)) {
+			return nil, errors.New("invalid JSON arguments: " + jsonArgs)
+		}
+
+		var list []json.RawMessage
+		if err := json.Unmarshal([]byte(jsonArgs), &list); err != nil {
+			return []interface{}{json.RawMessage(jsonArgs)}, nil
+		}
+
+		params := make([]interface{}, len(list))
+		for i, arg := range list {
+			params[i] = arg
+		}
+
+		return params, nil
 	}
 
 	// Convert args to []interface{} in order to pass it to Tell() method.
-	methodArgs := flags.Args()
-	params := make([]interface{}, len(methodArgs))
-	for i, arg := range methodArgs {
+	params := make([]interface{}, len(args))
+	for i, arg := range args {
 		if number, err := strconv.Atoi(arg); err != nil {
 			params[i] = arg
 		} else {
@@ -88,17 +231,45 @@ func (c *Tell) Run(args []string) int {
 		}
 	}
 
-	result, err := remote.TellWithTimeout(method, timeout, params...)
-	if err != nil {
-		c.Ui.Error(err.Error())
-		return 1
+	return params, nil
+}
+
+// parseInterspersed parses the flags, which may be given after
+// positional arguments, and returns the latter. Negative numbers
+// and arguments after "--" are positional.
+func parseInterspersed(flags *flag.FlagSet, args []string) []string {
+	var positional []string
+
+	for len(args) != 0 {
+		if args[0] == "--" {
+			return append(positional, args[1:]...)
+		}
+
+		if !isFlag(args[0]) {
+			positional = append(positional, args[0])
+			args = args[1:]
+			continue
+		}
+
+		flags.Parse(args)
+		rest := flags.Args()
+
+		// Parse stops after "--", the rest is positional then.
+		if i := len(args) - len(rest) - 1; i >= 0 && args[i] == "--" {
+			return append(positional, rest...)
+		}
+
+		args = rest
 	}
 
-	if result == nil {
-		c.Ui.Info("nil")
-	} else {
-		c.Ui.Info(string(result.Raw))
+	return positional
+}
+
+func isFlag(arg string) bool {
+	if len(arg) < 2 || arg[0] != '-' {
+		return false
 	}
 
-	return 0
+	_, err := strconv.ParseFloat(arg, 64)
+	return err != nil
 }
@@ -15,10 +15,14 @@ func main() {
 	c.Args = os.Args[1:]
 	c.Commands = map[string]cli.CommandFactory{
 		"showkey":   command.NewShowkey(),
+		"lockkey":   command.NewLockkey(),
+		"unlockkey": command.NewUnlockkey(),
 		"register":  command.NewRegister(),
 		"query":     command.NewQuery(),
 		"run":       command.NewRun(),
 		"tell":      command.NewTell(),
+		"openapi":   command.NewOpenAPI(),
+		"repl":      command.NewRepl(),
 		"uninstall": command.NewUninstall(),
 		"list":      command.NewList(),
 		"install":   command.NewInstall(),
@@ -0,0 +1,254 @@
+// Package kitefake provides fakes of kites and Kontrol for unit testing
+// consumers of kites without running servers.
+//
+// A fake kite responds to calls with scripted responses and records them:
+//
+//	math := kitefake.New("math")
+//	math.On("square").Return(16)
+//	math.On("divide").ReturnError(errors.New("division by zero"))
+//
+//	c := math.Client()
+//	if err := c.Dial(); err != nil {
+//		...
+//	}
+//
+//	res, err := c.Tell("square", 4) // 16
+//
+// Consumers, which find kites with GetKites, are attached
+// to a fake Kontrol, see Kontrol.
+package kitefake
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/koding/kite"
+	"github.com/koding/kite/config"
+	"github.com/koding/kite/dnode"
+	"github.com/koding/kite/kitetest"
+)
+
+// ErrDisconnected is the error of calls, for which the fake
+// kite closed the session of the caller, see Response.Disconnect.
+var ErrDisconnected = errors.New("kitefake: disconnected")
+
+// Kite is a fake kite, which responds to calls of the methods
+// with the responses scripted with On.
+type Kite struct {
+	// Kite is the kite, which serves the calls.
+	Kite *kite.Kite
+
+	mu      sync.Mutex
+	methods map[string]*Method
+	calls   []*Call
+}
+
+// Call is a call of a method of a fake kite.
+type Call struct {
+	Method   string
+	Args     *dnode.Partial
+	Username string // the authenticated caller, if any
+	Time     time.Time
+}
+
+// New gives a fake kite with the given name. Its methods can be called
+// without authentication.
+func New(name string) *Kite {
+	k := kite.New(name, "0.0.1")
+	k.Config = config.New()
+	k.Config.Username = "testuser"
+	k.Config.Environment = "test"
+	k.Config.DisableAuthentication = true
+
+	return &Kite{
+		Kite:    k,
+		methods: make(map[string]*Method),
+	}
+}
+
+// On gives the script of responses of the method,
+// registering the method with the fake kite.
+func (f *Kite) On(method string) *Method {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	m, ok := f.methods[method]
+	if !ok {
+		m = &Method{name: method}
+		f.methods[method] = m
+
+		f.Kite.HandleFunc(method, func(r *kite.Request) (interface{}, error) {
+			return f.serve(m, r)
+		}).DisableAuthentication()
+	}
+
+	return m
+}
+
+// Calls gives the calls of the method made so far, or calls
+// of all the methods if method is empty, in the order they
+// were made.
+func (f *Kite) Calls(method string) []*Call {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var calls []*Call
+	for _, c := range f.calls {
+		if method == "" || c.Method == method {
+			calls = append(calls, c)
+		}
+	}
+
+	return calls
+}
+
+// Client gives a client of the fake kite, which is connected to it
+// over an in-memory transport once dialed.
+func (f *Kite) Client() *kite.Client {
+	local := kite.New("kitefake-client", "0.0.1")
+	local.Config = config.New()
+
+	return kitetest.Connect(local, f.Kite)
+}
+
+// Close closes the fake kite.
+func (f *Kite) Close() {
+	f.Kite.Close()
+}
+
+func (f *Kite) serve(m *Method, r *kite.Request) (interface{}, error) {
+	f.mu.Lock()
+	f.calls = append(f.calls, &Call{
+		Method:   r.Method,
+		Args:     r.Args,
+		Username: r.Username,
+		Time:     time.Now(),
+	})
+	f.mu.Unlock()
+
+	resp := m.next()
+	if resp == nil {
+		return nil, fmt.Errorf("kitefake: no response scripted for %q", m.name)
+	}
+
+	if resp.delay > 0 {
+		select {
+		case <-time.After(resp.delay):
+		case <-r.Ctx().Done():
+			return nil, r.Ctx().Err()
+		}
+	}
+
+	if resp.disconnect {
+		r.Client.Close()
+		return nil, ErrDisconnected
+	}
+
+	if resp.fn != nil {
+		return resp.fn(r)
+	}
+
+	return resp.result, resp.err
+}
+
+// Method is the script of responses of a method of a fake kite.
+// Calls are responded with the first response, which is not used
+// up, in the order the responses were added.
+type Method struct {
+	name string
+
+	mu        sync.Mutex
+	responses []*Response
+}
+
+// Return responds to the calls with the result.
+func (m *Method) Return(result interface{}) *Response {
+	return m.add(&Response{result: result})
+}
+
+// ReturnError responds to the calls with the error.
+func (m *Method) ReturnError(err error) *Response {
+	return m.add(&Response{err: err})
+}
+
+// Do responds to the calls with the response of fn.
+func (m *Method) Do(fn kite.HandlerFunc) *Response {
+	return m.add(&Response{fn: fn})
+}
+
+// Reset removes the scripted responses.
+func (m *Method) Reset() {
+	m.mu.Lock()
+	m.responses = nil
+	m.mu.Unlock()
+}
+
+func (m *Method) add(resp *Response) *Response {
+	m.mu.Lock()
+	m.responses = append(m.responses, resp)
+	m.mu.Unlock()
+
+	return resp
+}
+
+// next gives the response of the next call, or nil if there is none.
+func (m *Method) next() *Response {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, resp := range m.responses {
+		if resp.times < 0 {
+			continue
+		}
+
+		if resp.times > 0 {
+			if resp.times--; resp.times == 0 {
+				resp.times = -1 // used up
+			}
+		}
+
+		return resp
+	}
+
+	return nil
+}
+
+// Response is a scripted response of a method of a fake kite.
+// It responds to all the calls, unless limited with Times or Once.
+type Response struct {
+	result     interface{}
+	err        error
+	fn         kite.HandlerFunc
+	delay      time.Duration
+	disconnect bool
+	times      int // 0 if unlimited, -1 if used up
+}
+
+// Times limits the response to n calls, after which
+// the next response of the method is used.
+func (r *Response) Times(n int) *Response {
+	r.times = n
+	return r
+}
+
+// Once limits the response to a single call.
+func (r *Response) Once() *Response {
+	return r.Times(1)
+}
+
+// Delay delays the response, simulating latency. Calls canceled
+// before the delay passes are responded with the error of
+// the context.
+func (r *Response) Delay(d time.Duration) *Response {
+	r.delay = d
+	return r
+}
+
+// Disconnect makes the fake kite close the session of the caller
+// instead of responding, simulating a crash or a network fault.
+func (r *Response) Disconnect() *Response {
+	r.disconnect = true
+	return r
+}
@@ -0,0 +1,144 @@
+package kitefake
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/koding/kite"
+	"github.com/koding/kite/config"
+	"github.com/koding/kite/protocol"
+)
+
+func TestKite(t *testing.T) {
+	math := New("math")
+	defer math.Close()
+
+	math.On("square").Return(16).Once()
+	math.On("square").ReturnError(errors.New("overflow"))
+	math.On("slow").Return("done").Delay(time.Second)
+	math.On("crash").Return(nil).Disconnect()
+	math.On("echo").Do(func(r *kite.Request) (interface{}, error) {
+		return r.Args.One().MustString(), nil
+	})
+
+	c := math.Client()
+	if err := c.Dial(); err != nil {
+		t.Fatalf("Dial()=%s", err)
+	}
+	defer c.Close()
+
+	res, err := c.TellWithTimeout("square", 4*time.Second, 4)
+	if err != nil || res.MustFloat64() != 16 {
+		t.Fatalf("square: got %v, %v, want 16", res, err)
+	}
+
+	// The first response is used up.
+	_, err = c.TellWithTimeout("square", 4*time.Second, 5)
+	if e, ok := err.(*kite.Error); !ok || e.Message != "overflow" {
+		t.Fatalf("square: got %v, want overflow error", err)
+	}
+
+	if res, err := c.TellWithTimeout("echo", 4*time.Second, "hello"); err != nil || res.MustString() != "hello" {
+		t.Fatalf("echo: got %v, %v", res, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	// The call fails either on the caller's side, or with the error of
+	// the canceled request, depending on which is first.
+	start := time.Now()
+	if _, err := c.TellWithContext(ctx, "slow"); err == nil || !strings.Contains(err.Error(), context.DeadlineExceeded.Error()) {
+		t.Fatalf("slow: got %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	if d := time.Since(start); d >= time.Second {
+		t.Fatalf("slow: call took %s, want it canceled", d)
+	}
+
+	if _, err := c.TellWithTimeout("unknown", 4*time.Second); err == nil {
+		t.Fatal("expected call of unknown method to fail")
+	}
+
+	calls := math.Calls("square")
+	if len(calls) != 2 {
+		t.Fatalf("got %d calls of square, want 2", len(calls))
+	}
+
+	if n := calls[1].Args.One().MustFloat64(); n != 5 {
+		t.Fatalf("got argument %v of the second call, want 5", n)
+	}
+
+	if _, err := c.TellWithTimeout("crash", 4*time.Second); err == nil {
+		t.Fatal("expected call of crash to fail")
+	}
+}
+
+func TestKontrol(t *testing.T) {
+	kon, err := NewKontrol()
+	if err != nil {
+		t.Fatalf("NewKontrol()=%s", err)
+	}
+	defer kon.Close()
+
+	math := New("math")
+	math.On("square").Do(func(r *kite.Request) (interface{}, error) {
+		n := r.Args.One().MustFloat64()
+		return n * n, nil
+	})
+	defer math.Close()
+
+	other := New("other")
+	defer other.Close()
+
+	kon.Add(math)
+	kon.Add(other)
+
+	consumer := kite.New("consumer", "0.0.1")
+	consumer.Config = config.New()
+	kon.Attach(consumer)
+	defer consumer.Close()
+
+	clients, err := consumer.GetKites(&protocol.KontrolQuery{
+		Username:    "testuser",
+		Environment: "test",
+		Name:        "math",
+	})
+	if err != nil {
+		t.Fatalf("GetKites()=%s", err)
+	}
+	defer kite.Close(clients)
+
+	if len(clients) != 1 || clients[0].Kite.ID != math.Kite.Id {
+		t.Fatalf("got %v, want the math kite", clients)
+	}
+
+	if err := clients[0].Dial(); err != nil {
+		t.Fatalf("Dial()=%s", err)
+	}
+
+	res, err := clients[0].TellWithTimeout("square", 4*time.Second, 3)
+	if err != nil || res.MustFloat64() != 9 {
+		t.Fatalf("square: got %v, %v, want 9", res, err)
+	}
+
+	u, _ := url.Parse("http://consumer.example.com/kite")
+	if _, err := consumer.Register(u); err != nil {
+		t.Fatalf("Register()=%s", err)
+	}
+
+	regs := kon.Registrations()
+	if len(regs) != 1 || regs[0].Args.URL != u.String() || regs[0].Kite.Name != "consumer" {
+		t.Fatalf("got registrations %+v", regs)
+	}
+
+	kon.Remove(math)
+
+	if _, err := consumer.GetKites(&protocol.KontrolQuery{Name: "math"}); err != kite.ErrNoKitesAvailable {
+		t.Fatalf("got %v, want %v", err, kite.ErrNoKitesAvailable)
+	}
+}
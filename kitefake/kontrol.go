@@ -0,0 +1,227 @@
+package kitefake
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/igm/sockjs-go/sockjs"
+	"github.com/koding/kite"
+	"github.com/koding/kite/config"
+	"github.com/koding/kite/kitetest"
+	"github.com/koding/kite/protocol"
+)
+
+// memoryScheme is the scheme of URLs of the fakes,
+// which are connected to over the in-memory transport.
+const memoryScheme = "memory://"
+
+// kontrolURL is the URL of the fake Kontrol.
+const kontrolURL = memoryScheme + "kontrol"
+
+// Kontrol is a fake Kontrol. The fake kites added to it are returned
+// by GetKites of the kites attached to it, which connect to them over
+// the in-memory transport, like to the fake Kontrol. Tokens of the
+// returned kites are issued by Issuer.
+type Kontrol struct {
+	// Kite is the kite, which serves the calls.
+	Kite *kite.Kite
+
+	// Issuer issues the tokens of the kites.
+	Issuer *kitetest.Issuer
+
+	mu         sync.Mutex
+	kites      []*Kite
+	registered []*Registration
+}
+
+// Registration is a registration of an attached kite, see Register.
+type Registration struct {
+	Kite protocol.Kite
+	Args protocol.RegisterArgs
+}
+
+// NewKontrol gives a fake Kontrol.
+func NewKontrol() (*Kontrol, error) {
+	issuer, err := kitetest.NewIssuer()
+	if err != nil {
+		return nil, err
+	}
+
+	k := kite.New("kontrol", "0.0.1")
+	k.Config = config.New()
+	k.Config.Username = "testuser"
+	k.Config.Environment = "test"
+
+	kon := &Kontrol{
+		Kite:   k,
+		Issuer: issuer,
+	}
+
+	k.HandleFunc("getKites", kon.handleGetKites).DisableAuthentication()
+	k.HandleFunc("getToken", kon.handleGetToken).DisableAuthentication()
+	k.HandleFunc("register", kon.handleRegister).DisableAuthentication()
+
+	return kon, nil
+}
+
+// Add adds the fake kite, so it is found by the attached kites.
+func (k *Kontrol) Add(f *Kite) {
+	k.mu.Lock()
+	k.kites = append(k.kites, f)
+	k.mu.Unlock()
+}
+
+// Remove removes the fake kite.
+func (k *Kontrol) Remove(f *Kite) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	for i, g := range k.kites {
+		if g == f {
+			k.kites = append(k.kites[:i], k.kites[i+1:]...)
+			return
+		}
+	}
+}
+
+// Attach makes the kite use the fake Kontrol. The kite must not
+// be connected to Kontrol yet. Its clients connect to the fake kites
+// over the in-memory transport and cannot connect to other kites.
+func (k *Kontrol) Attach(consumer *kite.Kite) {
+	consumer.Config.KontrolURL = kontrolURL
+	consumer.DialSession = k.dial
+
+	k.Issuer.Trust(consumer)
+}
+
+// Registrations gives the registrations of the attached kites
+// made so far with Register or RegisterForever.
+func (k *Kontrol) Registrations() []*Registration {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	return append([]*Registration(nil), k.registered...)
+}
+
+// Close closes the fake Kontrol.
+func (k *Kontrol) Close() {
+	k.Kite.Close()
+}
+
+// dial connects the client to the fake Kontrol or
+// the fake kite given by the URL of the client.
+func (k *Kontrol) dial(c *kite.Client, _ time.Duration) (sockjs.Session, error) {
+	var remote *kite.Kite
+
+	if c.URL == kontrolURL {
+		remote = k.Kite
+	} else if id := strings.TrimPrefix(c.URL, memoryScheme); id != c.URL {
+		k.mu.Lock()
+		for _, f := range k.kites {
+			if f.Kite.Id == id {
+				remote = f.Kite
+			}
+		}
+		k.mu.Unlock()
+	}
+
+	if remote == nil {
+		return nil, errors.New("kitefake: no fake kite at " + c.URL)
+	}
+
+	client, server := kitetest.Pipe()
+
+	go remote.ServeSession(server)
+
+	return client, nil
+}
+
+func (k *Kontrol) handleGetKites(r *kite.Request) (interface{}, error) {
+	var args protocol.GetKitesArgs
+	if err := r.Args.One().Unmarshal(&args); err != nil {
+		return nil, err
+	}
+
+	if args.Query == nil {
+		return nil, errors.New("kitefake: missing query")
+	}
+
+	k.mu.Lock()
+	kites := append([]*Kite(nil), k.kites...)
+	k.mu.Unlock()
+
+	result := &protocol.GetKitesResult{
+		Kites: make([]*protocol.KiteWithToken, 0, len(kites)),
+	}
+
+	for _, f := range kites {
+		if !matches(args.Query, f) {
+			continue
+		}
+
+		remote := f.Kite.Kite()
+
+		token, err := k.Issuer.Token(r.Username, f.Kite)
+		if err != nil {
+			return nil, err
+		}
+
+		result.Kites = append(result.Kites, &protocol.KiteWithToken{
+			Kite:  *remote,
+			URL:   memoryScheme + remote.ID,
+			Token: token,
+		})
+	}
+
+	return result, nil
+}
+
+func (k *Kontrol) handleGetToken(r *kite.Request) (interface{}, error) {
+	var args protocol.GetTokenArgs
+	if err := r.Args.One().Unmarshal(&args); err != nil {
+		return nil, err
+	}
+
+	k.mu.Lock()
+	kites := append([]*Kite(nil), k.kites...)
+	k.mu.Unlock()
+
+	for _, f := range kites {
+		if f.Kite.Id == args.ID {
+			return k.Issuer.Token(r.Username, f.Kite)
+		}
+	}
+
+	return nil, errors.New("kitefake: no fake kite with ID " + args.ID)
+}
+
+func (k *Kontrol) handleRegister(r *kite.Request) (interface{}, error) {
+	var args protocol.RegisterArgs
+	if err := r.Args.One().Unmarshal(&args); err != nil {
+		return nil, err
+	}
+
+	k.mu.Lock()
+	k.registered = append(k.registered, &Registration{
+		Kite: r.Client.Kite,
+		Args: args,
+	})
+	k.mu.Unlock()
+
+	return &protocol.RegisterResult{URL: args.URL}, nil
+}
+
+// matches tells whether the fake kite matches the query.
+func matches(q *protocol.KontrolQuery, f *Kite) bool {
+	values := f.Kite.Kite().Query().Fields()
+
+	for key, value := range q.Fields() {
+		if value != "" && values[key] != value {
+			return false
+		}
+	}
+
+	return q.MatchLabels(f.Kite.Config.Labels)
+}
@@ -0,0 +1,259 @@
+// Package kitegen generates typed clients and server interfaces of kites
+// from definitions of their methods.
+//
+// A definition is a JSON document like:
+//
+//	{
+//	  "package": "math",
+//	  "name": "math",
+//	  "methods": [
+//	    {"name": "square", "args": "float64", "result": "float64"},
+//	    {"name": "divide", "args": "DivideArgs", "result": "float64"},
+//	    {"name": "version", "result": "string"}
+//	  ]
+//	}
+//
+// Arguments and results are Go types, which are either built-in or
+// declared in the package of the generated code, or in the packages
+// listed in imports. The generated server interface is registered with
+// HandleTyped, so the argument is the first argument of the call.
+package kitegen
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/format"
+	"go/token"
+	"io"
+	"os"
+	"strings"
+	"text/template"
+	"unicode"
+)
+
+// Version is the version of the generator.
+const Version = "0.0.1"
+
+// Definition defines a kite for generating its client and server code.
+type Definition struct {
+	// Package is the name of the package of the generated code.
+	Package string `json:"package"`
+
+	// Name is the name of the kite, the generated types are named after
+	// it, e.g. MathClient and MathServer for the math kite.
+	Name string `json:"name"`
+
+	// Imports are the import paths of packages the types
+	// of arguments and results are declared in.
+	Imports []string `json:"imports,omitempty"`
+
+	Methods []Method `json:"methods"`
+}
+
+// Method defines a method of the kite.
+type Method struct {
+	// Name is the name the method is registered with, e.g. "square".
+	Name string `json:"name"`
+
+	// GoName is the name of the Go method, by default it is the Name in
+	// camel case, e.g. FilesRead for files.read.
+	GoName string `json:"goName,omitempty"`
+
+	// Doc is the doc comment of the method, without the comment markers.
+	Doc string `json:"doc,omitempty"`
+
+	// Args is the Go type of the argument, the method
+	// takes no argument if empty.
+	Args string `json:"args,omitempty"`
+
+	// Result is the Go type of the result, interface{} if empty.
+	Result string `json:"result,omitempty"`
+}
+
+// ReadDefinition reads the definition from the JSON file.
+func ReadDefinition(file string) (*Definition, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return DecodeDefinition(f)
+}
+
+// DecodeDefinition decodes the definition from JSON.
+func DecodeDefinition(r io.Reader) (*Definition, error) {
+	var def Definition
+
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(&def); err != nil {
+		return nil, err
+	}
+
+	return &def, nil
+}
+
+// Generate generates the client and server code of the defined kite.
+func Generate(def *Definition) ([]byte, error) {
+	d, err := prepare(def)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+
+	if err := codeTmpl.Execute(&buf, d); err != nil {
+		return nil, err
+	}
+
+	p, err := format.Source(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("kitegen: formatting generated code failed: %s\n%s", err, buf.Bytes())
+	}
+
+	return p, nil
+}
+
+// prepare validates the definition and gives a copy of it,
+// which has the default values set.
+func prepare(def *Definition) (*Definition, error) {
+	if !token.IsIdentifier(def.Package) {
+		return nil, fmt.Errorf("kitegen: invalid package name %q", def.Package)
+	}
+
+	if def.Name == "" {
+		return nil, errors.New("kitegen: missing kite name")
+	}
+
+	if !token.IsIdentifier(goName(def.Name)) {
+		return nil, fmt.Errorf("kitegen: invalid kite name %q", def.Name)
+	}
+
+	d := *def
+	d.Methods = make([]Method, len(def.Methods))
+
+	seen := make(map[string]bool)
+
+	for i, m := range def.Methods {
+		if m.Name == "" {
+			return nil, fmt.Errorf("kitegen: missing name of method #%d", i)
+		}
+
+		if m.GoName == "" {
+			m.GoName = goName(m.Name)
+		}
+
+		if !token.IsIdentifier(m.GoName) || !token.IsExported(m.GoName) {
+			return nil, fmt.Errorf("kitegen: invalid Go name %q of method %q", m.GoName, m.Name)
+		}
+
+		if seen[m.GoName] {
+			return nil, fmt.Errorf("kitegen: duplicate Go name %q of method %q", m.GoName, m.Name)
+		}
+
+		seen[m.GoName] = true
+
+		if m.Result == "" {
+			m.Result = "interface{}"
+		}
+
+		d.Methods[i] = m
+	}
+
+	return &d, nil
+}
+
+// goName gives the name in camel case, e.g. FilesRead for files.read.
+func goName(name string) string {
+	var b strings.Builder
+	upper := true
+
+	for _, r := range name {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			upper = true
+			continue
+		}
+
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
+
+var codeTmpl = template.Must(template.New("code").Funcs(template.FuncMap{
+	"goName": goName,
+	"comment": func(s string) string {
+		return "// " + strings.Replace(strings.TrimSpace(s), "\n", "\n// ", -1)
+	},
+}).Parse(`// Code generated by kitegen. DO NOT EDIT.
+{{$n := goName .Name}}
+package {{.Package}}
+
+import (
+	"context"
+
+	"github.com/koding/kite"
+{{- range .Imports}}
+	"{{.}}"
+{{- end}}
+)
+
+// {{$n}}Server is the interface of the server of the {{.Name}} kite.
+type {{$n}}Server interface {
+{{- range .Methods}}
+{{- if .Doc}}
+	{{comment .Doc}}
+{{- end}}
+	{{.GoName}}(ctx context.Context{{if .Args}}, args {{.Args}}{{end}}) ({{.Result}}, error)
+{{- end}}
+}
+
+// Register{{$n}}Server registers the methods of srv with the kite.
+// The returned methods are keyed by name, so they can be configured
+// further, e.g. throttled.
+func Register{{$n}}Server(k *kite.Kite, srv {{$n}}Server) map[string]*kite.Method {
+	return map[string]*kite.Method{
+{{- range .Methods}}
+		{{printf "%q" .Name}}: k.HandleTyped({{printf "%q" .Name}}, srv.{{.GoName}}),
+{{- end}}
+	}
+}
+
+// {{$n}}Client calls the methods of the {{.Name}} kite with the client.
+type {{$n}}Client struct {
+	Client *kite.Client
+}
+
+// New{{$n}}Client gives a client of the {{.Name}} kite, which calls
+// its methods with c.
+func New{{$n}}Client(c *kite.Client) *{{$n}}Client {
+	return &{{$n}}Client{Client: c}
+}
+{{range .Methods}}
+{{if .Doc}}{{comment .Doc}}{{else}}// {{.GoName}} calls the {{.Name}} method.{{end}}
+func (c *{{$n}}Client) {{.GoName}}(ctx context.Context{{if .Args}}, args {{.Args}}{{end}}) ({{.Result}}, error) {
+	var result {{.Result}}
+
+	res, err := c.Client.TellWithContext(ctx, {{printf "%q" .Name}}{{if .Args}}, args{{end}})
+	if err != nil {
+		return result, err
+	}
+
+	if res != nil {
+		if err := res.Unmarshal(&result); err != nil {
+			return result, err
+		}
+	}
+
+	return result, nil
+}
+{{end}}`))
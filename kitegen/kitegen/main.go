@@ -0,0 +1,58 @@
+// Command kitegen generates typed clients and server interfaces of kites,
+// see the kitegen package for the format of definitions.
+//
+//	kitegen -o math_kite.go math.json
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/koding/kite/kitegen"
+)
+
+var (
+	flagOutput  = flag.String("o", "", "Output file, standard output if empty")
+	flagVersion = flag.Bool("version", false, "Show version and exit")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: kitegen [options] <definition.json>")
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+
+	if *flagVersion {
+		fmt.Println(kitegen.Version)
+		os.Exit(0)
+	}
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	def, err := kitegen.ReadDefinition(flag.Arg(0))
+	if err != nil {
+		log.Fatalf("Reading %s: %s", flag.Arg(0), err)
+	}
+
+	code, err := kitegen.Generate(def)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *flagOutput == "" {
+		os.Stdout.Write(code)
+		return
+	}
+
+	if err := ioutil.WriteFile(*flagOutput, code, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
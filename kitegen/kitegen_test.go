@@ -0,0 +1,74 @@
+package kitegen
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestGenerate(t *testing.T) {
+	// The example is generated with go generate, it must be up to date.
+	def, err := ReadDefinition("../examples/math-typed/math.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, err := Generate(def)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want, err := ioutil.ReadFile("../examples/math-typed/math_kite.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(code, want) {
+		t.Fatalf("generated code differs from examples/math-typed/math_kite.go:\n%s", code)
+	}
+}
+
+func TestGenerate_Invalid(t *testing.T) {
+	cases := map[string]string{
+		"package":   `{"package": "math-typed", "name": "math"}`,
+		"name":      `{"package": "math", "name": ""}`,
+		"method":    `{"package": "math", "name": "math", "methods": [{"args": "int"}]}`,
+		"duplicate": `{"package": "math", "name": "math", "methods": [{"name": "a.b"}, {"name": "a_b"}]}`,
+		"goName":    `{"package": "math", "name": "math", "methods": [{"name": "a", "goName": "lower"}]}`,
+		"type":      `{"package": "math", "name": "math", "methods": [{"name": "a", "args": "[]["}]}`,
+	}
+
+	for name, s := range cases {
+		t.Run(name, func(t *testing.T) {
+			def, err := DecodeDefinition(strings.NewReader(s))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := Generate(def); err == nil {
+				t.Fatal("expected Generate to fail")
+			}
+		})
+	}
+
+	if _, err := DecodeDefinition(strings.NewReader(`{"package": "math", "unknown": 1}`)); err == nil {
+		t.Fatal("expected unknown fields to be rejected")
+	}
+}
+
+func TestGoName(t *testing.T) {
+	cases := map[string]string{
+		"square":       "Square",
+		"files.read":   "FilesRead",
+		"kite.getPass": "KiteGetPass",
+		"math-worker":  "MathWorker",
+		"vm_start2":    "VmStart2",
+	}
+
+	for name, want := range cases {
+		if got := goName(name); got != want {
+			t.Errorf("goName(%q)=%q, want %q", name, got, want)
+		}
+	}
+}
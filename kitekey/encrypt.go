@@ -0,0 +1,365 @@
+package kitekey
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/zalando/go-keyring"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/term"
+)
+
+// Backends the encrypted kite.key is unlocked with.
+const (
+	// BackendPassphrase derives the encryption key from a passphrase,
+	// which is given by the Passphrase func.
+	BackendPassphrase = "passphrase"
+
+	// BackendKeyring keeps the encryption key in the keychain of the OS,
+	// given by DefaultKeyring, so the kite.key is unlocked without
+	// user interaction by the processes of the user owning the keychain.
+	BackendKeyring = "keyring"
+)
+
+// KeyringService is the name of the service the encryption keys
+// of kite.key files are stored under in the keychain of the OS.
+const KeyringService = "kite"
+
+// pemType is the type of the PEM block of an encrypted kite.key.
+const pemType = "ENCRYPTED KITE KEY"
+
+// scrypt parameters for deriving encryption keys from passphrases.
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// ErrNoPassphrase is returned when kite.key encrypted with a passphrase
+// is read, but the passphrase is not given.
+var ErrNoPassphrase = errors.New("kite.key is encrypted, set the passphrase with KITE_KEY_PASSPHRASE")
+
+// Passphrase gives the passphrase for kite.key encrypted with
+// BackendPassphrase. By default it is read from the KITE_KEY_PASSPHRASE
+// environment variable, or prompted for, if the standard input is
+// a terminal.
+var Passphrase = func() ([]byte, error) {
+	if passphrase := os.Getenv("KITE_KEY_PASSPHRASE"); passphrase != "" {
+		return []byte(passphrase), nil
+	}
+
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return nil, ErrNoPassphrase
+	}
+
+	fmt.Fprint(os.Stderr, "kite.key passphrase: ")
+	defer fmt.Fprintln(os.Stderr)
+
+	return term.ReadPassword(int(os.Stdin.Fd()))
+}
+
+// Keyring stores secrets in a keychain, see DefaultKeyring. Get returns
+// keyring.ErrNotFound if there is no secret stored under the account.
+type Keyring interface {
+	Get(service, account string) (string, error)
+	Set(service, account, secret string) error
+	Delete(service, account string) error
+}
+
+// DefaultKeyring is the keychain of the OS, which is the Keychain on macOS,
+// the Secret Service (e.g. GNOME Keyring or KWallet) on Linux and the
+// Credential Manager on Windows.
+var DefaultKeyring Keyring = osKeyring{}
+
+type osKeyring struct{}
+
+func (osKeyring) Get(service, account string) (string, error) {
+	return keyring.Get(service, account)
+}
+
+func (osKeyring) Set(service, account, secret string) error {
+	return keyring.Set(service, account, secret)
+}
+
+func (osKeyring) Delete(service, account string) error {
+	return keyring.Delete(service, account)
+}
+
+// IsEncrypted tells whether the content of the kite.key file is encrypted.
+func IsEncrypted(data []byte) bool {
+	block, _ := pem.Decode(data)
+	return block != nil && block.Type == pemType
+}
+
+// Encrypt encrypts the kite key with the passphrase, giving the content
+// of the kite.key file, which is decrypted by Decrypt.
+func Encrypt(kiteKey string, passphrase []byte) ([]byte, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	key, err := scrypt.Key(passphrase, salt, scryptN, scryptR, scryptP, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	return seal(kiteKey, key, map[string]string{
+		"Backend": BackendPassphrase,
+		"Salt":    base64.StdEncoding.EncodeToString(salt),
+	})
+}
+
+// EncryptKeyring encrypts the kite key with the key stored in the keyring
+// under the account, e.g. the path of the kite.key file. If there is none,
+// a random key is generated and stored. It gives the content of the
+// kite.key file, which is decrypted by Decrypt.
+//
+// The stored key is reused, so the kite.key file written before can still
+// be decrypted if writing the new one fails. It is never replaced, if it
+// can not be read from the keyring or is malformed an error is returned.
+func EncryptKeyring(kiteKey string, kr Keyring, account string) ([]byte, error) {
+	key, err := keyringKey(kr, account)
+	if errors.Is(err, keyring.ErrNotFound) {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+
+		if err := kr.Set(KeyringService, account, base64.StdEncoding.EncodeToString(key)); err != nil {
+			return nil, fmt.Errorf("unable to store encryption key in keyring: %s", err)
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	return seal(kiteKey, key, map[string]string{
+		"Backend": BackendKeyring,
+		"Account": account,
+	})
+}
+
+// Decrypt gives the kite key from the content of the kite.key file, which
+// is unlocked with the backend it was encrypted with. The content
+// is given as is, if it is not encrypted.
+func Decrypt(data []byte) (string, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != pemType {
+		return strings.TrimSpace(string(data)), nil
+	}
+
+	var key []byte
+
+	switch backend := block.Headers["Backend"]; backend {
+	case BackendPassphrase:
+		salt, err := base64.StdEncoding.DecodeString(block.Headers["Salt"])
+		if err != nil {
+			return "", fmt.Errorf("invalid encrypted kite.key: %s", err)
+		}
+
+		passphrase, err := Passphrase()
+		if err != nil {
+			return "", err
+		}
+
+		if key, err = scrypt.Key(passphrase, salt, scryptN, scryptR, scryptP, 32); err != nil {
+			return "", err
+		}
+	case BackendKeyring:
+		var err error
+		key, err = keyringKey(DefaultKeyring, block.Headers["Account"])
+		if errors.Is(err, keyring.ErrNotFound) {
+			return "", errors.New("encryption key of kite.key is not found in keyring")
+		}
+
+		if err != nil {
+			return "", err
+		}
+	default:
+		return "", fmt.Errorf("unsupported kite.key encryption backend %q", backend)
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", err
+	}
+
+	if len(block.Bytes) < aead.NonceSize() {
+		return "", errors.New("invalid encrypted kite.key: too short")
+	}
+
+	nonce, ciphertext := block.Bytes[:aead.NonceSize()], block.Bytes[aead.NonceSize():]
+
+	kiteKey, err := aead.Open(nil, nonce, ciphertext, []byte(block.Headers["Backend"]))
+	if err != nil {
+		return "", errors.New("unable to decrypt kite.key: wrong passphrase or encryption key")
+	}
+
+	return string(kiteKey), nil
+}
+
+// WriteEncrypted writes over the kite.key file with the kite key
+// encrypted with the passphrase.
+func WriteEncrypted(kiteKey string, passphrase []byte) error {
+	data, err := Encrypt(kiteKey, passphrase)
+	if err != nil {
+		return err
+	}
+
+	return writeFile(data)
+}
+
+// WriteKeyring writes over the kite.key file with the kite key encrypted
+// with a key stored in the keychain of the OS, see DefaultKeyring.
+func WriteKeyring(kiteKey string) error {
+	keyPath, err := kiteKeyPath()
+	if err != nil {
+		return err
+	}
+
+	data, err := EncryptKeyring(kiteKey, DefaultKeyring, keyPath)
+	if err != nil {
+		return err
+	}
+
+	return writeFile(data)
+}
+
+// Lock encrypts the plaintext kite.key file with the backend, migrating
+// it to the encrypted storage. The passphrase of BackendPassphrase is
+// given by the Passphrase func.
+func Lock(backend string) error {
+	kiteKey, err := Read()
+	if err != nil {
+		return err
+	}
+
+	switch backend {
+	case BackendPassphrase:
+		passphrase, err := Passphrase()
+		if err != nil {
+			return err
+		}
+
+		return WriteEncrypted(kiteKey, passphrase)
+	case BackendKeyring:
+		return WriteKeyring(kiteKey)
+	default:
+		return fmt.Errorf("unsupported kite.key encryption backend %q", backend)
+	}
+}
+
+// Unlock decrypts the kite.key file, storing it as plaintext, and removes
+// its encryption key from the keychain, if it was stored there.
+func Unlock() error {
+	keyPath, err := kiteKeyPath()
+	if err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return err
+	}
+
+	kiteKey, err := Decrypt(data)
+	if err != nil {
+		return err
+	}
+
+	if err := writeFile([]byte(kiteKey)); err != nil {
+		return err
+	}
+
+	if block, _ := pem.Decode(data); block != nil && block.Headers["Backend"] == BackendKeyring {
+		// The kite key is already stored as plaintext,
+		// a stale encryption key does no harm.
+		_ = DefaultKeyring.Delete(KeyringService, block.Headers["Account"])
+	}
+
+	return nil
+}
+
+// encode encrypts the kite key the same way the kite.key file is,
+// so kite keys re-issued by Kontrol stay encrypted.
+func encode(kiteKey string, old []byte) ([]byte, error) {
+	block, _ := pem.Decode(old)
+	if block == nil || block.Type != pemType {
+		return []byte(kiteKey), nil
+	}
+
+	switch block.Headers["Backend"] {
+	case BackendPassphrase:
+		passphrase, err := Passphrase()
+		if err != nil {
+			return nil, err
+		}
+
+		return Encrypt(kiteKey, passphrase)
+	case BackendKeyring:
+		return EncryptKeyring(kiteKey, DefaultKeyring, block.Headers["Account"])
+	default:
+		return nil, fmt.Errorf("unsupported kite.key encryption backend %q", block.Headers["Backend"])
+	}
+}
+
+// keyringKey gives the encryption key stored in the keyring under the account.
+// It returns keyring.ErrNotFound if there is none.
+func keyringKey(kr Keyring, account string) ([]byte, error) {
+	secret, err := kr.Get(KeyringService, account)
+	if errors.Is(err, keyring.ErrNotFound) {
+		return nil, keyring.ErrNotFound
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("unable to get encryption key of kite.key from keyring: %s", err)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(secret)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key of kite.key in keyring: %s", err)
+	}
+
+	if len(key) != 32 {
+		return nil, fmt.Errorf("invalid encryption key of kite.key in keyring: got %d bytes, want 32", len(key))
+	}
+
+	return key, nil
+}
+
+func seal(kiteKey string, key []byte, headers map[string]string) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	block := &pem.Block{
+		Type:    pemType,
+		Headers: headers,
+		Bytes:   aead.Seal(nonce, nonce, []byte(kiteKey), []byte(headers["Backend"])),
+	}
+
+	return pem.EncodeToMemory(block), nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,164 @@
+package kitekey
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/zalando/go-keyring"
+)
+
+type fakeKeyring map[string]string
+
+func (kr fakeKeyring) Get(service, account string) (string, error) {
+	secret, ok := kr[service+"/"+account]
+	if !ok {
+		return "", keyring.ErrNotFound
+	}
+	return secret, nil
+}
+
+func (kr fakeKeyring) Set(service, account, secret string) error {
+	kr[service+"/"+account] = secret
+	return nil
+}
+
+func (kr fakeKeyring) Delete(service, account string) error {
+	delete(kr, service+"/"+account)
+	return nil
+}
+
+func TestEncrypt(t *testing.T) {
+	const kiteKey = "header.payload.signature"
+
+	home := t.TempDir()
+	t.Setenv("KITE_HOME", home)
+	t.Setenv("KITE_KEY_PASSPHRASE", "")
+
+	kr := fakeKeyring{}
+	defer func(old Keyring) { DefaultKeyring = old }(DefaultKeyring)
+	DefaultKeyring = kr
+
+	passphrase := []byte("secret")
+	defer func(old func() ([]byte, error)) { Passphrase = old }(Passphrase)
+	Passphrase = func() ([]byte, error) { return passphrase, nil }
+
+	if err := Write(kiteKey); err != nil {
+		t.Fatalf("Write()=%s", err)
+	}
+
+	for _, backend := range []string{BackendPassphrase, BackendKeyring} {
+		if err := Lock(backend); err != nil {
+			t.Fatalf("%s: Lock()=%s", backend, err)
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(home, "kite.key"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !IsEncrypted(data) {
+			t.Fatalf("%s: kite.key is not encrypted: %s", backend, data)
+		}
+
+		// Re-issued kite keys are encrypted the same way.
+		if err := Write(kiteKey + "2"); err != nil {
+			t.Fatalf("%s: Write()=%s", backend, err)
+		}
+
+		if data, _ := ioutil.ReadFile(filepath.Join(home, "kite.key")); !IsEncrypted(data) {
+			t.Fatalf("%s: kite.key was written in plaintext", backend)
+		}
+
+		if key, err := Read(); err != nil || key != kiteKey+"2" {
+			t.Fatalf("%s: got %q, %v, want %q", backend, key, err, kiteKey+"2")
+		}
+
+		// Encrypting the kite key again keeps the file written
+		// before readable, in case writing the new one fails.
+		if _, err := encode(kiteKey+"3", data); err != nil {
+			t.Fatalf("%s: encode()=%s", backend, err)
+		}
+
+		if key, err := Read(); err != nil || key != kiteKey+"2" {
+			t.Fatalf("%s: got %q, %v, want %q", backend, key, err, kiteKey+"2")
+		}
+
+		if err := Unlock(); err != nil {
+			t.Fatalf("%s: Unlock()=%s", backend, err)
+		}
+
+		if key, err := Read(); err != nil || key != kiteKey+"2" {
+			t.Fatalf("%s: got %q, %v, want %q", backend, key, err, kiteKey+"2")
+		}
+
+		if err := Write(kiteKey); err != nil {
+			t.Fatalf("%s: Write()=%s", backend, err)
+		}
+	}
+
+	if len(kr) != 0 {
+		t.Errorf("got %d keys left in keyring, want 0", len(kr))
+	}
+
+	data, err := Encrypt(kiteKey, passphrase)
+	if err != nil {
+		t.Fatalf("Encrypt()=%s", err)
+	}
+
+	passphrase = []byte("wrong")
+
+	if _, err := Decrypt(data); err == nil {
+		t.Fatal("expected Decrypt() to fail with a wrong passphrase")
+	}
+}
+
+// brokenKeyring fails to get the secrets, e.g. as it is locked.
+type brokenKeyring struct {
+	fakeKeyring
+}
+
+func (brokenKeyring) Get(service, account string) (string, error) {
+	return "", errors.New("keyring is locked")
+}
+
+func TestEncryptKeyring(t *testing.T) {
+	const kiteKey = "header.payload.signature"
+
+	kr := fakeKeyring{}
+
+	data, err := EncryptKeyring(kiteKey, kr, "kite.key")
+	if err != nil {
+		t.Fatalf("EncryptKeyring()=%s", err)
+	}
+
+	stored := kr[KeyringService+"/kite.key"]
+
+	// The stored key is neither replaced, when it can not be read,
+	// nor when it is malformed.
+	if _, err := EncryptKeyring(kiteKey, brokenKeyring{kr}, "kite.key"); err == nil {
+		t.Fatal("expected EncryptKeyring() to fail with a broken keyring")
+	}
+
+	if kr[KeyringService+"/kite.key"] != stored {
+		t.Fatal("encryption key was replaced after the keyring failed")
+	}
+
+	malformed := fakeKeyring{KeyringService + "/kite.key": "c2hvcnQ="}
+
+	if _, err := EncryptKeyring(kiteKey, malformed, "kite.key"); err == nil {
+		t.Fatal("expected EncryptKeyring() to fail with a malformed key")
+	}
+
+	if malformed[KeyringService+"/kite.key"] != "c2hvcnQ=" {
+		t.Fatal("malformed encryption key was replaced")
+	}
+
+	defer func(old Keyring) { DefaultKeyring = old }(DefaultKeyring)
+	DefaultKeyring = kr
+
+	if key, err := Decrypt(data); err != nil || key != kiteKey {
+		t.Fatalf("got %q, %v, want %q", key, err, kiteKey)
+	}
+}
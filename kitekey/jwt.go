@@ -0,0 +1,222 @@
+package kitekey
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// SigningMethodEdDSA signs tokens with Ed25519 keys, which are not
+// supported by the jwt-go package.
+var SigningMethodEdDSA jwt.SigningMethod = signingMethodEdDSA{}
+
+// ErrUnsupportedKey is returned when a key is neither an RSA, ECDSA
+// nor Ed25519 one.
+var ErrUnsupportedKey = errors.New("unsupported key type")
+
+func init() {
+	jwt.RegisterSigningMethod(SigningMethodEdDSA.Alg(), func() jwt.SigningMethod {
+		return SigningMethodEdDSA
+	})
+}
+
+type signingMethodEdDSA struct{}
+
+func (signingMethodEdDSA) Alg() string { return "EdDSA" }
+
+func (signingMethodEdDSA) Verify(signingString, signature string, key interface{}) error {
+	pub, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKeyType
+	}
+
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+
+	if !ed25519.Verify(pub, []byte(signingString), sig) {
+		return errors.New("EdDSA verification failed")
+	}
+
+	return nil
+}
+
+func (signingMethodEdDSA) Sign(signingString string, key interface{}) (string, error) {
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+
+	return jwt.EncodeSegment(ed25519.Sign(priv, []byte(signingString))), nil
+}
+
+// ParsePublicKey parses PEM encoded RSA, ECDSA or Ed25519 public key.
+func ParsePublicKey(s string) (crypto.PublicKey, error) {
+	block, _ := pem.Decode([]byte(s))
+	if block == nil {
+		return nil, jwt.ErrKeyMustBePEMEncoded
+	}
+
+	var key interface{}
+	var err error
+
+	switch block.Type {
+	case "CERTIFICATE":
+		var cert *x509.Certificate
+
+		if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+			key = cert.PublicKey
+		}
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch key.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey, ed25519.PublicKey:
+		return key, nil
+	default:
+		return nil, ErrUnsupportedKey
+	}
+}
+
+// ParsePrivateKey parses PEM encoded RSA, ECDSA or Ed25519 private key.
+func ParsePrivateKey(s string) (crypto.Signer, error) {
+	block, _ := pem.Decode([]byte(s))
+	if block == nil {
+		return nil, jwt.ErrKeyMustBePEMEncoded
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return key, nil
+	case *ecdsa.PrivateKey:
+		return key, nil
+	case ed25519.PrivateKey:
+		return key, nil
+	default:
+		return nil, ErrUnsupportedKey
+	}
+}
+
+// SigningMethod gives the signing method used with the given public
+// or private key:
+//
+//   - RS256 for RSA keys
+//   - ES256, ES384 or ES512 for ECDSA keys, depending on the curve
+//   - EdDSA for Ed25519 keys
+func SigningMethod(key interface{}) (jwt.SigningMethod, error) {
+	if signer, ok := key.(crypto.Signer); ok {
+		key = signer.Public()
+	}
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return jwt.SigningMethodRS256, nil
+	case *ecdsa.PublicKey:
+		switch key.Curve.Params().BitSize {
+		case 256:
+			return jwt.SigningMethodES256, nil
+		case 384:
+			return jwt.SigningMethodES384, nil
+		case 521:
+			return jwt.SigningMethodES512, nil
+		default:
+			return nil, fmt.Errorf("unsupported curve: %s", key.Curve.Params().Name)
+		}
+	case ed25519.PublicKey:
+		return SigningMethodEdDSA, nil
+	default:
+		return nil, ErrUnsupportedKey
+	}
+}
+
+// VerifyMethod ensures the token was signed with a method which matches
+// the type of the given public key. It must be called by key funcs
+// passed to jwt.Parse, so a token signed by a forged key of other type
+// is not accepted.
+func VerifyMethod(token *jwt.Token, key crypto.PublicKey) error {
+	var ok bool
+
+	switch key.(type) {
+	case *rsa.PublicKey:
+		_, ok = token.Method.(*jwt.SigningMethodRSA)
+	case *ecdsa.PublicKey:
+		_, ok = token.Method.(*jwt.SigningMethodECDSA)
+	case ed25519.PublicKey:
+		ok = token.Method == SigningMethodEdDSA
+	}
+
+	if !ok {
+		return errors.New("invalid signing method")
+	}
+
+	return nil
+}
+
+// KeyID gives the ID of the public key, which is the base64url encoded
+// SHA-256 hash of the key in PKIX form. Tokens signed with Sign carry
+// the ID in the "kid" header.
+func KeyID(key crypto.PublicKey) (string, error) {
+	p, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(p)
+
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// Sign signs the claims with the given PEM encoded private key.
+//
+// The signing method is chosen by the type of the key, see SigningMethod.
+// The ID of the key is set in the "kid" header of the token, see KeyID.
+func Sign(claims jwt.Claims, privateKey string) (string, error) {
+	key, err := ParsePrivateKey(privateKey)
+	if err != nil {
+		return "", err
+	}
+
+	method, err := SigningMethod(key)
+	if err != nil {
+		return "", err
+	}
+
+	kid, err := KeyID(key.Public())
+	if err != nil {
+		return "", err
+	}
+
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = kid
+
+	return token.SignedString(key)
+}
@@ -2,14 +2,11 @@
 package kitekey
 
 import (
-	"bytes"
-	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/user"
 	"path/filepath"
-	"strings"
 
 	"github.com/dgrijalva/jwt-go"
 )
@@ -19,11 +16,22 @@ const (
 	kiteKeyFileName = "kite.key"
 )
 
-// KiteClaims represents JWT token claims extended with kontrolKey claim.
+// KiteClaims represents JWT token claims extended with kontrolKey
+// and scopes claims.
 type KiteClaims struct {
 	jwt.StandardClaims
-	KontrolKey string `json:"kontrolKey,omitempty"`
-	KontrolURL string `json:"kontrolURL,omitempty"`
+	KontrolKey string   `json:"kontrolKey,omitempty"`
+	KontrolURL string   `json:"kontrolURL,omitempty"`
+	Scopes     []string `json:"scopes,omitempty"`
+
+	// ProofKey is the base64 encoded Ed25519 public key of the kite
+	// the token was issued to. The kite signs the nonces of the requests
+	// authenticated with the token with its private key.
+	ProofKey string `json:"proofKey,omitempty"`
+
+	// KiteID is the ID of the kite the token was issued to, that is
+	// the JWT ID of its kite key, so revoking the kite revokes its tokens.
+	KiteID string `json:"kiteID,omitempty"`
 }
 
 // KiteHome returns the home path of Kite directory.
@@ -48,7 +56,8 @@ func kiteKeyPath() (string, error) {
 	return filepath.Join(kiteHome, kiteKeyFileName), nil
 }
 
-// Read the contents of the kite.key file.
+// Read the contents of the kite.key file. The encrypted file
+// is unlocked with the backend it was encrypted with.
 func Read() (string, error) {
 	keyPath, err := kiteKeyPath()
 	if err != nil {
@@ -58,16 +67,33 @@ func Read() (string, error) {
 	if err != nil {
 		return "", err
 	}
-	return strings.TrimSpace(string(data)), nil
+	return Decrypt(data)
 }
 
-// Write over the kite.key file.
+// Write over the kite.key file. If the file is encrypted,
+// the kite key is encrypted with the same backend.
 func Write(kiteKey string) error {
 	keyPath, err := kiteKeyPath()
 	if err != nil {
 		return err
 	}
 
+	old, _ := ioutil.ReadFile(keyPath)
+
+	data, err := encode(kiteKey, old)
+	if err != nil {
+		return err
+	}
+
+	return writeFile(data)
+}
+
+func writeFile(data []byte) error {
+	keyPath, err := kiteKeyPath()
+	if err != nil {
+		return err
+	}
+
 	err = os.MkdirAll(filepath.Dir(keyPath), 0700)
 	if err != nil {
 		return err
@@ -77,7 +103,7 @@ func Write(kiteKey string) error {
 	// when previous file's mode is 0400.
 	os.Remove(keyPath)
 
-	return ioutil.WriteFile(keyPath, []byte(kiteKey), 0400)
+	return ioutil.WriteFile(keyPath, data, 0400)
 }
 
 // Parse the kite.key file and return it as JWT token.
@@ -91,13 +117,19 @@ func Parse() (*jwt.Token, error) {
 }
 
 // ParseFile reads the given kite key file and parses it as a JWT token.
+// The encrypted file is unlocked as with Read.
 func ParseFile(file string) (*jwt.Token, error) {
-	kiteKey, err := ioutil.ReadFile(file)
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	kiteKey, err := Decrypt(data)
 	if err != nil {
 		return nil, err
 	}
 
-	return jwt.ParseWithClaims(string(bytes.TrimSpace(kiteKey)), &KiteClaims{}, GetKontrolKey)
+	return jwt.ParseWithClaims(kiteKey, &KiteClaims{}, GetKontrolKey)
 }
 
 // Extractor is used to extract kontrol key from JWT token.
@@ -110,10 +142,6 @@ type Extractor struct {
 func (e *Extractor) Extract(token *jwt.Token) (interface{}, error) {
 	e.Token = token
 
-	if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
-		return nil, errors.New("invalid signing method")
-	}
-
 	claims, ok := token.Claims.(*KiteClaims)
 	if !ok {
 		return nil, fmt.Errorf("no kontrol key found")
@@ -121,7 +149,16 @@ func (e *Extractor) Extract(token *jwt.Token) (interface{}, error) {
 
 	e.Claims = claims
 
-	return jwt.ParseRSAPublicKeyFromPEM([]byte(claims.KontrolKey))
+	key, err := ParsePublicKey(claims.KontrolKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := VerifyMethod(token, key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
 }
 
 // GetKontrolKey is used as key getter func for jwt.Parse() function.
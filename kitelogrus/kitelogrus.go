@@ -0,0 +1,97 @@
+// Package kitelogrus provides a kite.Logger, which logs with logrus.
+//
+// Fields attached to the messages, e.g. the ones given by kite.Request's
+// Logger, are logged as logrus fields:
+//
+//	log := logrus.New()
+//	log.SetFormatter(&logrus.JSONFormatter{})
+//
+//	k := kite.New("math", "1.0.0")
+//	k.Log = kitelogrus.New(log)
+//	k.SetLogLevel = kitelogrus.SetLevel(log)
+package kitelogrus
+
+import (
+	"fmt"
+
+	"github.com/koding/kite"
+	"github.com/sirupsen/logrus"
+)
+
+// Logger is a kite.FieldLogger, which logs with a logrus logger or entry.
+type Logger struct {
+	log logrus.FieldLogger
+}
+
+var _ kite.FieldLogger = (*Logger)(nil)
+
+// New gives a logger, which logs with log.
+func New(log logrus.FieldLogger) *Logger {
+	return &Logger{
+		log: log,
+	}
+}
+
+// Level gives the logrus level corresponding to the kite level.
+func Level(level kite.Level) logrus.Level {
+	switch level {
+	case kite.DEBUG:
+		return logrus.DebugLevel
+	case kite.WARNING:
+		return logrus.WarnLevel
+	case kite.ERROR:
+		return logrus.ErrorLevel
+	case kite.FATAL:
+		return logrus.FatalLevel
+	default:
+		return logrus.InfoLevel
+	}
+}
+
+// SetLevel gives a func, which sets the level of log to the given kite level,
+// to be used as kite's SetLogLevel.
+func SetLevel(log *logrus.Logger) func(kite.Level) {
+	return func(level kite.Level) {
+		log.SetLevel(Level(level))
+	}
+}
+
+// Fatal logs the message with the fatal level, then calls os.Exit(1).
+func (l *Logger) Fatal(format string, args ...interface{}) {
+	l.log.Fatalf(format, args...)
+}
+
+func (l *Logger) Error(format string, args ...interface{}) {
+	l.log.Errorf(format, args...)
+}
+
+func (l *Logger) Warning(format string, args ...interface{}) {
+	l.log.Warnf(format, args...)
+}
+
+func (l *Logger) Info(format string, args ...interface{}) {
+	l.log.Infof(format, args...)
+}
+
+func (l *Logger) Debug(format string, args ...interface{}) {
+	l.log.Debugf(format, args...)
+}
+
+// With gives a logger, which logs the fields with every message.
+// A key with no value is given the "!MISSING" value.
+func (l *Logger) With(keyvals ...interface{}) kite.Logger {
+	fields := make(logrus.Fields, (len(keyvals)+1)/2)
+
+	for i := 0; i < len(keyvals); i += 2 {
+		var value interface{} = "!MISSING"
+		if i+1 < len(keyvals) {
+			value = keyvals[i+1]
+		}
+
+		fields[fmt.Sprint(keyvals[i])] = value
+	}
+
+	return &Logger{
+		log: l.log.WithFields(fields),
+	}
+}
@@ -0,0 +1,421 @@
+// Package kitesentry provides a config.ErrorReporter, which sends the panics
+// and errors of method handlers of a kite to Sentry:
+//
+//	r, err := kitesentry.New(os.Getenv("SENTRY_DSN"))
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	defer r.Close()
+//
+//	k := kite.New("math", "1.0.0")
+//	k.Config.ErrorReporter = r
+//
+// The events are sent in the background, so reporting does not slow down
+// the calls. Close sends the events, which are still queued.
+package kitesentry
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/koding/kite/config"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// DefaultQueueSize is the default number of events waiting to be sent,
+// events reported while the queue is full are dropped.
+const DefaultQueueSize = 100
+
+// Reporter is a config.ErrorReporter, which sends the reports as events
+// to the Sentry project of the DSN it was created with.
+//
+// The fields may be changed only before the first report.
+type Reporter struct {
+	// Environment, Release and ServerName are set on the events,
+	// e.g. "production", the version of the kite and the hostname.
+	// If ServerName is empty, the hostname of the kite is used.
+	Environment string
+	Release     string
+	ServerName  string
+
+	// Filter, if non-nil, selects the reports to be sent, e.g. to
+	// send only panics and errors of certain types. By default all
+	// the reports are sent.
+	Filter func(*config.ErrorReport) bool
+
+	// Client is the HTTP client the events are sent with,
+	// http.DefaultClient by default.
+	Client *http.Client
+
+	dsn      string
+	endpoint string
+	auth     string
+
+	queue chan *event
+	once  sync.Once
+	done  chan struct{}
+	mu    sync.RWMutex // guards sends to queue against Close
+	close bool
+}
+
+var _ config.ErrorReporter = (*Reporter)(nil)
+
+// New gives a reporter sending the events to the project of the DSN,
+// e.g. "https://public@sentry.example.com/1".
+func New(dsn string) (*Reporter, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("kitesentry: invalid DSN: %s", err)
+	}
+
+	if u.User == nil || u.User.Username() == "" {
+		return nil, errors.New("kitesentry: invalid DSN: missing public key")
+	}
+
+	i := strings.LastIndex(u.Path, "/")
+	project := u.Path[i+1:]
+
+	if _, err := strconv.ParseUint(project, 10, 64); err != nil {
+		return nil, fmt.Errorf("kitesentry: invalid DSN: invalid project ID %q", project)
+	}
+
+	endpoint := url.URL{
+		Scheme: u.Scheme,
+		Host:   u.Host,
+		Path:   u.Path[:i] + "/api/" + project + "/envelope/",
+	}
+
+	auth := "Sentry sentry_version=7, sentry_client=kitesentry/1.0, sentry_key=" + u.User.Username()
+	if secret, ok := u.User.Password(); ok {
+		auth += ", sentry_secret=" + secret
+	}
+
+	return &Reporter{
+		dsn:      dsn,
+		endpoint: endpoint.String(),
+		auth:     auth,
+		queue:    make(chan *event, DefaultQueueSize),
+		done:     make(chan struct{}),
+	}, nil
+}
+
+// Report queues the report to be sent to Sentry. The report is dropped
+// if the queue is full, or the reporter is closed.
+func (r *Reporter) Report(rep *config.ErrorReport) {
+	if r.Filter != nil && !r.Filter(rep) {
+		return
+	}
+
+	r.once.Do(func() { go r.sendLoop() })
+
+	ev := r.event(rep)
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.close {
+		return
+	}
+
+	select {
+	case r.queue <- ev:
+	default:
+	}
+}
+
+// Close sends the queued events and stops the reporter.
+func (r *Reporter) Close() error {
+	r.mu.Lock()
+	if r.close {
+		r.mu.Unlock()
+		return nil
+	}
+	r.close = true
+	close(r.queue)
+	r.mu.Unlock()
+
+	r.once.Do(func() { go r.sendLoop() })
+
+	<-r.done
+
+	return nil
+}
+
+func (r *Reporter) sendLoop() {
+	defer close(r.done)
+
+	for ev := range r.queue {
+		// Errors are not reported, as reporting them
+		// is what the reporter is failing at.
+		_ = r.send(ev)
+	}
+}
+
+func (r *Reporter) send(ev *event) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+
+	header := map[string]string{
+		"event_id": ev.EventID,
+		"sent_at":  time.Now().UTC().Format(time.RFC3339),
+		"dsn":      r.dsn,
+	}
+
+	if err := enc.Encode(header); err != nil {
+		return err
+	}
+
+	if err := enc.Encode(map[string]string{"type": "event"}); err != nil {
+		return err
+	}
+
+	if err := enc.Encode(ev); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", r.endpoint, &buf)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/x-sentry-envelope")
+	req.Header.Set("X-Sentry-Auth", r.auth)
+
+	client := r.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("kitesentry: unexpected status: %s", resp.Status)
+	}
+
+	return nil
+}
+
+// event is a Sentry event.
+type event struct {
+	EventID     string                 `json:"event_id"`
+	Timestamp   string                 `json:"timestamp"`
+	Level       string                 `json:"level"`
+	Platform    string                 `json:"platform"`
+	Logger      string                 `json:"logger"`
+	Transaction string                 `json:"transaction,omitempty"`
+	ServerName  string                 `json:"server_name,omitempty"`
+	Release     string                 `json:"release,omitempty"`
+	Environment string                 `json:"environment,omitempty"`
+	Exception   *exceptions            `json:"exception"`
+	Tags        map[string]string      `json:"tags,omitempty"`
+	User        *user                  `json:"user,omitempty"`
+	Contexts    map[string]interface{} `json:"contexts,omitempty"`
+}
+
+type exceptions struct {
+	Values []exception `json:"values"`
+}
+
+type exception struct {
+	Type       string      `json:"type"`
+	Value      string      `json:"value"`
+	Stacktrace *stacktrace `json:"stacktrace,omitempty"`
+}
+
+type stacktrace struct {
+	Frames []frame `json:"frames"`
+}
+
+type frame struct {
+	Function string `json:"function"`
+	Filename string `json:"filename"`
+	AbsPath  string `json:"abs_path"`
+	Lineno   int    `json:"lineno"`
+	InApp    bool   `json:"in_app"`
+}
+
+type user struct {
+	Username string `json:"username"`
+}
+
+// event converts the report to an event.
+func (r *Reporter) event(rep *config.ErrorReport) *event {
+	ev := &event{
+		EventID:     newEventID(),
+		Timestamp:   rep.Time.UTC().Format(time.RFC3339Nano),
+		Level:       "error",
+		Platform:    "go",
+		Logger:      "kite",
+		Transaction: rep.Method,
+		ServerName:  r.ServerName,
+		Release:     r.Release,
+		Environment: r.Environment,
+		Tags: map[string]string{
+			"kite.name":    rep.Kite.Name,
+			"kite.version": rep.Kite.Version,
+			"kite.method":  rep.Method,
+			"request_id":   rep.RequestID,
+		},
+	}
+
+	if rep.Time.IsZero() {
+		ev.Timestamp = time.Now().UTC().Format(time.RFC3339Nano)
+	}
+
+	if ev.ServerName == "" {
+		ev.ServerName = rep.Kite.Hostname
+	}
+
+	if rep.Caller.Name != "" {
+		ev.Tags["caller.name"] = rep.Caller.Name
+		ev.Tags["caller.id"] = rep.Caller.ID
+	}
+
+	if rep.Username != "" {
+		ev.User = &user{Username: rep.Username}
+	}
+
+	if rep.Context != nil {
+		if sc := trace.SpanContextFromContext(rep.Context); sc.IsValid() {
+			ev.Contexts = map[string]interface{}{
+				"trace": map[string]string{
+					"trace_id": sc.TraceID().String(),
+					"span_id":  sc.SpanID().String(),
+				},
+			}
+		}
+	}
+
+	ex := exception{
+		Type: fmt.Sprintf("%T", rep.Err),
+	}
+
+	if rep.Err != nil {
+		ex.Value = rep.Err.Error()
+	}
+
+	if rep.Panic != nil {
+		ev.Level = "fatal"
+		ex.Type = "panic"
+		ex.Value = fmt.Sprint(rep.Panic)
+		ex.Stacktrace = parseStack(rep.Stack)
+	} else if t := errorType(rep.Err); t != "" {
+		ex.Type = t
+	}
+
+	ev.Exception = &exceptions{Values: []exception{ex}}
+
+	return ev
+}
+
+// errorType gives the type of kite errors, e.g. "validationError",
+// which groups the events better than the Go type.
+func errorType(err error) string {
+	var e interface {
+		error
+		Code() string
+	}
+
+	if !errors.As(err, &e) {
+		return ""
+	}
+
+	p, jerr := json.Marshal(e)
+	if jerr != nil {
+		return ""
+	}
+
+	var v struct {
+		Type string `json:"type"`
+	}
+
+	if json.Unmarshal(p, &v) != nil {
+		return ""
+	}
+
+	return v.Type
+}
+
+// parseStack parses the stack formatted by runtime/debug.Stack into
+// frames, ordered from the outermost call, as Sentry expects.
+func parseStack(stack []byte) *stacktrace {
+	if len(stack) == 0 {
+		return nil
+	}
+
+	var frames []frame
+
+	s := bufio.NewScanner(bytes.NewReader(stack))
+
+	var function string
+
+	for s.Scan() {
+		line := s.Text()
+
+		if !strings.HasPrefix(line, "\t") {
+			function = line
+			if i := strings.LastIndex(function, "("); i > 0 {
+				function = function[:i]
+			}
+			continue
+		}
+
+		if function == "" {
+			continue
+		}
+
+		loc := strings.TrimSpace(line)
+		if i := strings.LastIndex(loc, " +0x"); i > 0 {
+			loc = loc[:i]
+		}
+
+		i := strings.LastIndex(loc, ":")
+		if i < 0 {
+			continue
+		}
+
+		lineno, _ := strconv.Atoi(loc[i+1:])
+		file := loc[:i]
+
+		frames = append(frames, frame{
+			Function: function,
+			Filename: file[strings.LastIndex(file, "/")+1:],
+			AbsPath:  file,
+			Lineno:   lineno,
+			InApp:    !strings.HasPrefix(function, "runtime.") && !strings.HasPrefix(function, "runtime/debug."),
+		})
+
+		function = ""
+	}
+
+	// Sentry expects the frames from the oldest to the newest call.
+	for i, j := 0, len(frames)-1; i < j; i, j = i+1, j-1 {
+		frames[i], frames[j] = frames[j], frames[i]
+	}
+
+	return &stacktrace{Frames: frames}
+}
+
+func newEventID() string {
+	var id [16]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
@@ -0,0 +1,143 @@
+package kitesentry
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/koding/kite"
+)
+
+func TestReporter(t *testing.T) {
+	type envelope struct {
+		auth  string
+		event map[string]interface{}
+	}
+
+	envelopes := make(chan envelope, 3)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/api/42/envelope/" {
+			t.Errorf("got path %q", req.URL.Path)
+		}
+
+		s := bufio.NewScanner(req.Body)
+		s.Buffer(nil, 1<<20)
+
+		var lines []string
+		for s.Scan() {
+			lines = append(lines, s.Text())
+		}
+
+		if len(lines) != 3 {
+			t.Errorf("got %d envelope lines, want 3", len(lines))
+			return
+		}
+
+		var ev map[string]interface{}
+		if err := json.Unmarshal([]byte(lines[2]), &ev); err != nil {
+			t.Errorf("Unmarshal()=%s", err)
+		}
+
+		envelopes <- envelope{auth: req.Header.Get("X-Sentry-Auth"), event: ev}
+	}))
+	defer srv.Close()
+
+	r, err := New(strings.Replace(srv.URL, "://", "://public@", 1) + "/42")
+	if err != nil {
+		t.Fatalf("New()=%s", err)
+	}
+
+	r.Environment = "test"
+
+	k := kite.New("reported", "0.0.1")
+	k.Config.DisableAuthentication = true
+	k.Config.ErrorReporter = r
+
+	k.HandleFunc("panic", func(*kite.Request) (interface{}, error) {
+		panic("boom")
+	})
+
+	k.HandleFunc("fail", func(*kite.Request) (interface{}, error) {
+		return nil, &kite.Error{Type: "failError", Message: "failed"}
+	})
+
+	go k.Run()
+	defer k.Close()
+	<-k.ServerReadyNotify()
+
+	c := kite.New("caller", "0.0.1").NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", k.Port()))
+	if err := c.Dial(); err != nil {
+		t.Fatalf("Dial()=%s", err)
+	}
+	defer c.Close()
+
+	if _, err := c.Tell("panic"); err == nil {
+		t.Fatal("expected panic call to fail")
+	}
+
+	if _, err := c.Tell("fail"); err == nil {
+		t.Fatal("expected fail call to fail")
+	}
+
+	r.Close()
+
+	for _, want := range []struct {
+		level, method, typ string
+		stack              bool
+	}{
+		{"fatal", "panic", "panic", true},
+		{"error", "fail", "failError", false},
+	} {
+		var env envelope
+		select {
+		case env = <-envelopes:
+		default:
+			t.Fatalf("%s: no event sent", want.method)
+		}
+
+		if !strings.Contains(env.auth, "sentry_key=public") {
+			t.Errorf("%s: got auth %q", want.method, env.auth)
+		}
+
+		ev := env.event
+
+		if ev["level"] != want.level || ev["transaction"] != want.method || ev["environment"] != "test" {
+			t.Errorf("%s: got event %v", want.method, ev)
+		}
+
+		if tags, _ := ev["tags"].(map[string]interface{}); tags["kite.name"] != "reported" || tags["caller.name"] != "caller" {
+			t.Errorf("%s: got tags %v", want.method, ev["tags"])
+		}
+
+		ex := ev["exception"].(map[string]interface{})["values"].([]interface{})[0].(map[string]interface{})
+
+		if ex["type"] != want.typ {
+			t.Errorf("%s: got exception type %v, want %s", want.method, ex["type"], want.typ)
+		}
+
+		if _, ok := ex["stacktrace"]; ok != want.stack {
+			t.Errorf("%s: got stacktrace %v, want %t", want.method, ok, want.stack)
+		}
+	}
+
+	if len(envelopes) != 0 {
+		t.Errorf("got %d unexpected events", len(envelopes))
+	}
+}
+
+func TestNew(t *testing.T) {
+	for _, dsn := range []string{
+		"https://sentry.example.com/1",
+		"https://public@sentry.example.com/",
+		"https://public@sentry.example.com/project",
+	} {
+		if _, err := New(dsn); err == nil {
+			t.Errorf("%s: expected New() to fail", dsn)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+// Package kiteslog provides a kite.Logger, which logs with log/slog.
+//
+// Fields attached to the messages, e.g. the ones given by kite.Request's
+// Logger, are logged as slog attributes:
+//
+//	k := kite.New("math", "1.0.0")
+//	k.Log = kiteslog.New(slog.New(slog.NewJSONHandler(os.Stderr, nil)))
+package kiteslog
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/koding/kite"
+)
+
+// LevelFatal is the slog level of messages logged with Fatal.
+const LevelFatal = slog.Level(12)
+
+// Logger is a kite.FieldLogger, which logs with a slog.Logger.
+type Logger struct {
+	log *slog.Logger
+}
+
+var _ kite.FieldLogger = (*Logger)(nil)
+
+// New gives a logger, which logs with log. If log is nil,
+// slog.Default() is used.
+func New(log *slog.Logger) *Logger {
+	if log == nil {
+		log = slog.Default()
+	}
+
+	return &Logger{
+		log: log,
+	}
+}
+
+// Level gives the slog level corresponding to the kite level.
+func Level(level kite.Level) slog.Level {
+	switch level {
+	case kite.DEBUG:
+		return slog.LevelDebug
+	case kite.WARNING:
+		return slog.LevelWarn
+	case kite.ERROR:
+		return slog.LevelError
+	case kite.FATAL:
+		return LevelFatal
+	default:
+		return slog.LevelInfo
+	}
+}
+
+// SetLevel gives a func, which sets the level of v to the given kite level,
+// to be used as kite's SetLogLevel for handlers created with v as their level.
+func SetLevel(v *slog.LevelVar) func(kite.Level) {
+	return func(level kite.Level) {
+		v.Set(Level(level))
+	}
+}
+
+// Fatal logs the message with LevelFatal, then calls os.Exit(1).
+func (l *Logger) Fatal(format string, args ...interface{}) {
+	l.logf(LevelFatal, format, args...)
+	os.Exit(1)
+}
+
+func (l *Logger) Error(format string, args ...interface{}) {
+	l.logf(slog.LevelError, format, args...)
+}
+
+func (l *Logger) Warning(format string, args ...interface{}) {
+	l.logf(slog.LevelWarn, format, args...)
+}
+
+func (l *Logger) Info(format string, args ...interface{}) {
+	l.logf(slog.LevelInfo, format, args...)
+}
+
+func (l *Logger) Debug(format string, args ...interface{}) {
+	l.logf(slog.LevelDebug, format, args...)
+}
+
+// With gives a logger, which logs the fields as attributes of every message.
+func (l *Logger) With(keyvals ...interface{}) kite.Logger {
+	return &Logger{
+		log: l.log.With(keyvals...),
+	}
+}
+
+func (l *Logger) logf(level slog.Level, format string, args ...interface{}) {
+	ctx := context.Background()
+
+	if !l.log.Enabled(ctx, level) {
+		return
+	}
+
+	l.log.Log(ctx, level, fmt.Sprintf(format, args...))
+}
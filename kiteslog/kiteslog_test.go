@@ -0,0 +1,55 @@
+package kiteslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	"github.com/koding/kite"
+)
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+
+	level := new(slog.LevelVar)
+	l := New(slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: level})))
+
+	kite.WithFields(l, "method", "square", "requestID", "abc").Warning("took %s", "1s")
+	l.Debug("not logged")
+
+	SetLevel(level)(kite.DEBUG)
+	l.Debug("logged")
+
+	var entries []map[string]interface{}
+
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var entry map[string]interface{}
+		if err := dec.Decode(&entry); err != nil {
+			t.Fatalf("Decode()=%s", err)
+		}
+		entries = append(entries, entry)
+	}
+
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries, want 2", len(entries))
+	}
+
+	want := map[string]interface{}{
+		"level":     "WARN",
+		"msg":       "took 1s",
+		"method":    "square",
+		"requestID": "abc",
+	}
+
+	for k, v := range want {
+		if entries[0][k] != v {
+			t.Errorf("%s: got %v, want %v", k, entries[0][k], v)
+		}
+	}
+
+	if level, msg := entries[1]["level"], entries[1]["msg"]; level != "DEBUG" || msg != "logged" {
+		t.Errorf("got %v %v, want DEBUG logged", level, msg)
+	}
+}
@@ -0,0 +1,89 @@
+package kitetest
+
+import (
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/koding/kite"
+	"github.com/koding/kite/kitekey"
+	"github.com/satori/go.uuid"
+)
+
+// Issuer issues kite tokens like Kontrol does, so methods requiring
+// authentication can be tested without running Kontrol.
+type Issuer struct {
+	// Keys are used for signing the tokens.
+	Keys *KeyPair
+
+	// Name is the issuer of the tokens, "kontrol" by default.
+	Name string
+
+	// TTL is the lifetime of the tokens, an hour by default.
+	TTL time.Duration
+}
+
+// NewIssuer gives an issuer with newly generated keys.
+func NewIssuer() (*Issuer, error) {
+	keys, err := GenerateKeyPair()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Issuer{
+		Keys: keys,
+	}, nil
+}
+
+// Trust makes the kite accept tokens issued by i. It must be called
+// before the kite authenticates any request.
+func (i *Issuer) Trust(k *kite.Kite) {
+	k.Config.KontrolKey = string(i.Keys.Public)
+	k.Config.KontrolUser = i.name()
+}
+
+// Token gives a token of the user for calling methods of the kite.
+func (i *Issuer) Token(username string, k *kite.Kite) (string, error) {
+	now := time.Now().UTC()
+	remote := k.Kite()
+
+	claims := &kitekey.KiteClaims{
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    i.name(),
+			Subject:   username,
+			Audience:  "/" + remote.Username + "/" + remote.Environment + "/" + remote.Name,
+			ExpiresAt: now.Add(i.ttl()).Unix(),
+			IssuedAt:  now.Unix(),
+			Id:        uuid.NewV4().String(),
+		},
+	}
+
+	return kitekey.Sign(claims, string(i.Keys.Private))
+}
+
+// Auth gives token authentication of the user for calling methods
+// of the kite, to be set as kite.Client's Auth.
+func (i *Issuer) Auth(username string, k *kite.Kite) (*kite.Auth, error) {
+	token, err := i.Token(username, k)
+	if err != nil {
+		return nil, err
+	}
+
+	return &kite.Auth{
+		Type: "token",
+		Key:  token,
+	}, nil
+}
+
+func (i *Issuer) name() string {
+	if i.Name != "" {
+		return i.Name
+	}
+	return "kontrol"
+}
+
+func (i *Issuer) ttl() time.Duration {
+	if i.TTL != 0 {
+		return i.TTL
+	}
+	return time.Hour
+}
@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
+	"github.com/koding/kite/kitekey"
 	"github.com/koding/kite/protocol"
 	"github.com/satori/go.uuid"
 )
@@ -108,9 +109,7 @@ func GenerateKiteKey(k *KiteKey, keys *KeyPair) (*jwt.Token, error) {
 		}
 	}
 
-	kiteKey := jwt.New(jwt.GetSigningMethod("RS256"))
-
-	kiteKey.Claims = jwt.MapClaims{
+	claims := jwt.MapClaims{
 		"iss":        k.issuer(),
 		"sub":        k.username(),
 		"iat":        k.issuedAt(),
@@ -119,19 +118,14 @@ func GenerateKiteKey(k *KiteKey, keys *KeyPair) (*jwt.Token, error) {
 		"kontrolKey": string(keys.Public),
 	}
 
-	privateKey, err := jwt.ParseRSAPrivateKeyFromPEM(keys.Private)
-	if err != nil {
-		return nil, err
-	}
-
-	kiteKey.Raw, err = kiteKey.SignedString(privateKey)
+	signed, err := kitekey.Sign(claims, string(keys.Private))
 	if err != nil {
 		return nil, err
 	}
 
-	kiteKey.Valid = true
-
-	return kiteKey, nil
+	return jwt.Parse(signed, func(*jwt.Token) (interface{}, error) {
+		return kitekey.ParsePublicKey(string(keys.Public))
+	})
 }
 
 // TokenExtractor is used to extract kite ID from the given JWT token.
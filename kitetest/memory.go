@@ -0,0 +1,135 @@
+package kitetest
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/igm/sockjs-go/sockjs"
+	"github.com/koding/kite"
+	"github.com/satori/go.uuid"
+)
+
+// Connect gives a client of the local kite, which calls methods of the
+// remote one over an in-memory transport, without binding any ports.
+//
+// The client is not connected yet, each Dial starts a new session
+// served by the remote kite.
+func Connect(local, remote *kite.Kite) *kite.Client {
+	c := local.NewClient("memory://" + remote.Id)
+	c.Kite = *remote.Kite()
+	c.DialSession = func(time.Duration) (sockjs.Session, error) {
+		client, server := Pipe()
+
+		go remote.ServeSession(server)
+
+		return client, nil
+	}
+
+	return c
+}
+
+// Pipe gives a pair of sessions connected in memory. Messages sent with
+// one of them are received by the other one. Closing either
+// of the sessions closes both of them.
+//
+// The client session is reported as initiated by the local side,
+// like the dialed ones.
+func Pipe() (client, server sockjs.Session) {
+	p := &pipe{
+		id:     uuid.NewV4().String(),
+		closed: make(chan struct{}),
+	}
+
+	toServer := make(chan string, 16)
+	toClient := make(chan string, 16)
+
+	client = &memorySession{pipe: p, initiated: true, in: toClient, out: toServer}
+	server = &memorySession{pipe: p, in: toServer, out: toClient}
+
+	return client, server
+}
+
+// pipe is the state shared by both ends of the connection.
+type pipe struct {
+	id     string
+	once   sync.Once
+	closed chan struct{}
+}
+
+// memorySession is one end of the in-memory connection.
+type memorySession struct {
+	*pipe
+
+	initiated bool
+	in        <-chan string
+	out       chan<- string
+}
+
+var _ sockjs.Session = (*memorySession)(nil)
+
+func (s *memorySession) ID() string {
+	return s.id
+}
+
+func (s *memorySession) Request() *http.Request {
+	return nil
+}
+
+// Initiated tells whether the session is the client end of the pipe.
+func (s *memorySession) Initiated() bool {
+	return s.initiated
+}
+
+// Binary tells the messages are passed as they are.
+func (s *memorySession) Binary() bool {
+	return true
+}
+
+func (s *memorySession) Recv() (string, error) {
+	// Pass the messages sent before the session was closed.
+	select {
+	case msg := <-s.in:
+		return msg, nil
+	default:
+	}
+
+	select {
+	case msg := <-s.in:
+		return msg, nil
+	case <-s.closed:
+		return "", sockjs.ErrSessionNotOpen
+	}
+}
+
+func (s *memorySession) Send(msg string) error {
+	select {
+	case <-s.closed:
+		return sockjs.ErrSessionNotOpen
+	default:
+	}
+
+	select {
+	case s.out <- msg:
+		return nil
+	case <-s.closed:
+		return sockjs.ErrSessionNotOpen
+	}
+}
+
+func (s *memorySession) Close(uint32, string) error {
+	s.once.Do(func() {
+		close(s.closed)
+	})
+
+	return nil
+}
+
+func (s *memorySession) GetSessionState() sockjs.SessionState {
+	select {
+	case <-s.closed:
+		return sockjs.SessionClosed
+	default:
+		return sockjs.SessionActive
+	}
+}
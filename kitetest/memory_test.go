@@ -0,0 +1,65 @@
+package kitetest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/koding/kite"
+	"github.com/koding/kite/config"
+)
+
+func TestConnect(t *testing.T) {
+	issuer, err := NewIssuer()
+	if err != nil {
+		t.Fatalf("NewIssuer()=%s", err)
+	}
+
+	remote := kite.New("remote", "0.0.1")
+	remote.Config = config.New()
+	remote.Config.Username = "testuser"
+	remote.Config.Environment = "test"
+	issuer.Trust(remote)
+
+	remote.HandleFunc("whoami", func(r *kite.Request) (interface{}, error) {
+		return r.Username, nil
+	})
+
+	disconnected := make(chan struct{})
+	remote.OnDisconnect(func(*kite.Client) {
+		close(disconnected)
+	})
+
+	local := kite.New("local", "0.0.1")
+	local.Config = config.New()
+
+	c := Connect(local, remote)
+
+	if err := c.Dial(); err != nil {
+		t.Fatalf("Dial()=%s", err)
+	}
+
+	if _, err := c.TellWithTimeout("whoami", 5*time.Second); err == nil {
+		t.Fatal("expected call without token to fail")
+	}
+
+	if c.Auth, err = issuer.Auth("alice", remote); err != nil {
+		t.Fatalf("Auth()=%s", err)
+	}
+
+	res, err := c.TellWithTimeout("whoami", 5*time.Second)
+	if err != nil {
+		t.Fatalf("TellWithTimeout()=%s", err)
+	}
+
+	if username := res.MustString(); username != "alice" {
+		t.Fatalf("got %q, want %q", username, "alice")
+	}
+
+	c.Close()
+
+	select {
+	case <-disconnected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the remote kite to notice disconnect")
+	}
+}
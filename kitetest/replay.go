@@ -0,0 +1,253 @@
+package kitetest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/igm/sockjs-go/sockjs"
+	"github.com/koding/kite"
+)
+
+// Replay is a session, which replays a recorded session, see
+// kite.Config.RecordDir. The frames received over the recorded session
+// are received over the replay, in the recorded order, and the frames
+// sent over the replay are compared with the recorded ones.
+//
+// A received frame is replayed once all the frames sent before it
+// in the recording were sent over the replay, so the replay is
+// deterministic as long as the kite responds the same way. The sent
+// frames are matched in any order, as responses to concurrent calls
+// may be sent in any order.
+type Replay struct {
+	// Compare tells whether the sent frame matches the recorded one.
+	// If nil, the frames match if they are equal, or if both are JSON
+	// and they encode equal values.
+	//
+	// It is meant for ignoring the parts of the frames, which differ
+	// between runs, like IDs of kites or tokens.
+	Compare func(recorded, sent string) bool
+
+	rec *kite.Recording
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	next    int    // index of the next frame to be received
+	matched []bool // matched sent frames of the recording
+	sent    []string
+	err     error // first mismatch or timeout
+	closed  bool
+}
+
+var _ sockjs.Session = (*Replay)(nil)
+
+// NewReplay gives a replay of the recording.
+func NewReplay(rec *kite.Recording) *Replay {
+	r := &Replay{
+		rec:     rec,
+		matched: make([]bool, len(rec.Frames)),
+	}
+
+	r.cond = sync.NewCond(&r.mu)
+
+	return r
+}
+
+// ReplayKite replays the recording of a session served by a kite,
+// with k serving the replay.
+func ReplayKite(k *kite.Kite, rec *kite.Recording) *Replay {
+	r := NewReplay(rec)
+
+	go k.ServeSession(r)
+
+	return r
+}
+
+// ReplayClient replays the recording of a session dialed by a client,
+// each Dial of c connects it to the replay.
+func ReplayClient(c *kite.Client, rec *kite.Recording) *Replay {
+	r := NewReplay(rec)
+
+	c.DialSession = func(time.Duration) (sockjs.Session, error) {
+		return r, nil
+	}
+
+	return r
+}
+
+// Wait waits until all the recorded frames are replayed. It fails
+// if a sent frame did not match the recording, or on timeout.
+func (r *Replay) Wait(timeout time.Duration) error {
+	timer := time.AfterFunc(timeout, func() {
+		r.mu.Lock()
+		if r.err == nil {
+			r.err = fmt.Errorf("kitetest: replay timed out after %s with %d of %d frames replayed",
+				timeout, r.replayed(), len(r.rec.Frames))
+		}
+		r.cond.Broadcast()
+		r.mu.Unlock()
+	})
+	defer timer.Stop()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for r.err == nil && r.replayed() != len(r.rec.Frames) {
+		r.cond.Wait()
+	}
+
+	return r.err
+}
+
+// Sent gives the frames sent over the replay so far.
+func (r *Replay) Sent() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]string(nil), r.sent...)
+}
+
+// replayed gives the number of frames replayed so far.
+func (r *Replay) replayed() int {
+	n := 0
+
+	for i, f := range r.rec.Frames {
+		if (f.Received && i < r.next) || r.matched[i] {
+			n++
+		}
+	}
+
+	return n
+}
+
+// ready tells whether all the frames sent before the i-th one
+// in the recording were matched.
+func (r *Replay) ready(i int) bool {
+	for j := 0; j < i; j++ {
+		if !r.rec.Frames[j].Received && !r.matched[j] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (r *Replay) compare(recorded, sent string) bool {
+	if r.Compare != nil {
+		return r.Compare(recorded, sent)
+	}
+
+	if recorded == sent {
+		return true
+	}
+
+	var v, w interface{}
+
+	if json.Unmarshal([]byte(recorded), &v) != nil || json.Unmarshal([]byte(sent), &w) != nil {
+		return false
+	}
+
+	return reflect.DeepEqual(v, w)
+}
+
+func (r *Replay) ID() string {
+	return r.rec.SessionID
+}
+
+func (r *Replay) Request() *http.Request {
+	return nil
+}
+
+// Initiated tells whether the recorded session was dialed by a client.
+func (r *Replay) Initiated() bool {
+	return r.rec.Initiated
+}
+
+// Binary tells whether the recorded session passed the frames
+// as they are.
+func (r *Replay) Binary() bool {
+	return r.rec.Binary
+}
+
+// Recv gives the next received frame of the recording, once the frames
+// sent before it were sent over the replay. It blocks until the replay
+// is closed if there are no more frames to receive.
+func (r *Replay) Recv() (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for {
+		if r.closed {
+			return "", sockjs.ErrSessionNotOpen
+		}
+
+		for r.next < len(r.rec.Frames) && !r.rec.Frames[r.next].Received {
+			r.next++
+		}
+
+		if r.next < len(r.rec.Frames) && r.err == nil && r.ready(r.next) {
+			f := r.rec.Frames[r.next]
+			r.next++
+			r.cond.Broadcast()
+
+			return f.Data, nil
+		}
+
+		r.cond.Wait()
+	}
+}
+
+// Send matches the frame with the first sent frame of the recording,
+// which was not matched yet.
+func (r *Replay) Send(msg string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return sockjs.ErrSessionNotOpen
+	}
+
+	r.sent = append(r.sent, msg)
+
+	for i, f := range r.rec.Frames {
+		if !f.Received && !r.matched[i] && r.compare(f.Data, msg) {
+			r.matched[i] = true
+			r.cond.Broadcast()
+
+			return nil
+		}
+	}
+
+	if r.err == nil {
+		r.err = fmt.Errorf("kitetest: sent frame #%d does not match the recording: %s", len(r.sent)-1, msg)
+		r.cond.Broadcast()
+	}
+
+	return nil
+}
+
+func (r *Replay) Close(uint32, string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.closed {
+		r.closed = true
+		r.cond.Broadcast()
+	}
+
+	return nil
+}
+
+func (r *Replay) GetSessionState() sockjs.SessionState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return sockjs.SessionClosed
+	}
+
+	return sockjs.SessionActive
+}
@@ -0,0 +1,110 @@
+package kitetest
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/koding/kite"
+	"github.com/koding/kite/config"
+)
+
+func newSquareKite(offset float64) *kite.Kite {
+	k := kite.New("square", "0.0.1")
+	k.Config = config.New()
+	k.Config.DisableAuthentication = true
+
+	k.HandleFunc("square", func(r *kite.Request) (interface{}, error) {
+		n := r.Args.One().MustFloat64()
+		return n*n + offset, nil
+	}).DisableAuthentication()
+
+	return k
+}
+
+func TestReplay(t *testing.T) {
+	dir := t.TempDir()
+
+	remote := newSquareKite(0)
+	remote.Config.RecordDir = dir
+	defer remote.Close()
+
+	disconnected := make(chan struct{})
+	remote.OnDisconnect(func(*kite.Client) {
+		close(disconnected)
+	})
+
+	local := kite.New("local", "0.0.1")
+	local.Config = config.New()
+
+	c := Connect(local, remote)
+
+	if err := c.Dial(); err != nil {
+		t.Fatalf("Dial()=%s", err)
+	}
+
+	for i := 1; i <= 3; i++ {
+		res, err := c.TellWithTimeout("square", 5*time.Second, i)
+		if err != nil {
+			t.Fatalf("TellWithTimeout()=%s", err)
+		}
+
+		if n := res.MustFloat64(); n != float64(i*i) {
+			t.Fatalf("got %v, want %d", n, i*i)
+		}
+	}
+
+	c.Close()
+
+	select {
+	case <-disconnected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the session to end")
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "square-*.kiterec"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("got recordings %v, %v, want one", files, err)
+	}
+
+	rec, err := kite.ReadRecording(files[0])
+	if err != nil {
+		t.Fatalf("ReadRecording()=%s", err)
+	}
+
+	if rec.Kite.Name != "square" || rec.Initiated {
+		t.Fatalf("got recording of %s (initiated=%t), want served by square", rec.Kite.Name, rec.Initiated)
+	}
+
+	var received int
+	for _, f := range rec.Frames {
+		if f.Received {
+			received++
+		}
+	}
+
+	if received < 3 || received == len(rec.Frames) {
+		t.Fatalf("got %d received of %d frames", received, len(rec.Frames))
+	}
+
+	// The same kite responds the same way.
+	k := newSquareKite(0)
+	defer k.Close()
+
+	r := ReplayKite(k, rec)
+	if err := r.Wait(5 * time.Second); err != nil {
+		t.Fatalf("Wait()=%s", err)
+	}
+	r.Close(0, "")
+
+	// A regression is caught.
+	broken := newSquareKite(1)
+	defer broken.Close()
+
+	r = ReplayKite(broken, rec)
+	if err := r.Wait(5 * time.Second); err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Fatalf("got %v, want mismatch", err)
+	}
+	r.Close(0, "")
+}
@@ -0,0 +1,445 @@
+// Package kitevault provides a config.SecretsProvider, which gets the kite
+// key, the TLS certificate of a kite and the key pairs of Kontrol from
+// HashiCorp Vault, so they are not stored on disk:
+//
+//	p := kitevault.New()
+//	p.AppRole = &kitevault.AppRole{
+//		RoleID:   os.Getenv("VAULT_ROLE_ID"),
+//		SecretID: os.Getenv("VAULT_SECRET_ID"),
+//	}
+//	p.KiteKeyPath = "secret/data/kites/math"
+//	p.TLSPath = "pki/issue/kites"
+//	p.TLSCommonName = "math.kites.example.com"
+//
+//	k := kite.New("math", "1.0.0")
+//	k.Config.SecretsProvider = p
+//
+// The Vault token is renewed, or the provider logs in again, each time
+// the kite gets the secrets, which it does before the token or any of
+// the secrets expire.
+package kitevault
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/koding/kite/config"
+)
+
+// DefaultRefreshInterval is the default interval of getting the secrets,
+// which do not expire, e.g. the ones of the KV secrets engine, so their
+// changes are picked up.
+const DefaultRefreshInterval = time.Hour
+
+// Provider is a config.SecretsProvider, which gets the secrets from Vault.
+//
+// The secrets are read from the KV secrets engine, version 1 or 2, and
+// the TLS certificate is issued by the PKI secrets engine, if
+// TLSCommonName is set.
+//
+// The fields may be changed only before the secrets are got
+// for the first time.
+type Provider struct {
+	// Address is the address of Vault, e.g. "https://vault.example.com:8200".
+	// VAULT_ADDR by default.
+	Address string
+
+	// Token authenticates to Vault, if AppRole is nil. VAULT_TOKEN by default.
+	Token string
+
+	// AppRole, if non-nil, makes the provider log in with the AppRole
+	// auth method instead of using Token.
+	AppRole *AppRole
+
+	// Namespace is the namespace of Vault Enterprise. VAULT_NAMESPACE
+	// by default.
+	Namespace string
+
+	// KiteKeyPath is the path of the KV secret with the kite key in its
+	// "kite_key" field, e.g. "secret/data/kites/math" for version 2
+	// of the KV secrets engine.
+	KiteKeyPath string
+
+	// TLSPath is the path of the KV secret with the PEM encoded certificate
+	// and key of the kite server in its "certificate" and "private_key"
+	// fields. If TLSCommonName is set, it is the path of the issue
+	// endpoint of the PKI secrets engine instead, e.g. "pki/issue/kites",
+	// and a new certificate is issued each time the secrets are got.
+	TLSPath       string
+	TLSCommonName string
+
+	// KontrolKeyPaths are the paths of the KV secrets with the key pairs
+	// of Kontrol in their "public_key" and "private_key" fields. The ID
+	// of the key pair is given by the "id" field, or the last element
+	// of the path.
+	KontrolKeyPaths []string
+
+	// RefreshInterval is the time the secrets, which do not expire, are
+	// valid for. If zero, DefaultRefreshInterval is used. If negative,
+	// such secrets are got only once.
+	RefreshInterval time.Duration
+
+	// Client is the HTTP client the requests are sent with,
+	// http.DefaultClient by default.
+	Client *http.Client
+
+	mu        sync.Mutex
+	token     string
+	expires   time.Time // zero if the token does not expire
+	renewable bool
+}
+
+// AppRole describes logging in with the AppRole auth method.
+type AppRole struct {
+	// Mount is the path the auth method is mounted at,
+	// "approle" by default.
+	Mount string
+
+	RoleID   string
+	SecretID string
+}
+
+var _ config.SecretsProvider = (*Provider)(nil)
+
+// New gives a provider configured with the VAULT_ADDR, VAULT_TOKEN
+// and VAULT_NAMESPACE environment variables.
+func New() *Provider {
+	return &Provider{
+		Address:   os.Getenv("VAULT_ADDR"),
+		Token:     os.Getenv("VAULT_TOKEN"),
+		Namespace: os.Getenv("VAULT_NAMESPACE"),
+	}
+}
+
+// Secrets gets the secrets from Vault. The TTL of the secrets is the
+// shortest of the TTLs of the token, the secrets and RefreshInterval.
+func (p *Provider) Secrets(ctx context.Context) (*config.Secrets, error) {
+	token, tokenTTL, err := p.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &config.Secrets{
+		TTL: p.RefreshInterval,
+	}
+
+	if s.TTL == 0 {
+		s.TTL = DefaultRefreshInterval
+	}
+
+	if s.TTL < 0 {
+		s.TTL = 0
+	}
+
+	shorten := func(ttl time.Duration) {
+		if ttl > 0 && (s.TTL == 0 || ttl < s.TTL) {
+			s.TTL = ttl
+		}
+	}
+
+	shorten(tokenTTL)
+
+	if p.KiteKeyPath != "" {
+		secret, err := p.read(ctx, token, p.KiteKeyPath)
+		if err != nil {
+			return nil, err
+		}
+
+		if s.KiteKey, err = secret.field("kite_key"); err != nil {
+			return nil, err
+		}
+
+		shorten(secret.ttl())
+	}
+
+	if p.TLSPath != "" {
+		var secret *secret
+		var err error
+
+		if p.TLSCommonName != "" {
+			body := map[string]string{"common_name": p.TLSCommonName}
+			secret, err = p.do(ctx, token, "POST", p.TLSPath, body)
+		} else {
+			secret, err = p.read(ctx, token, p.TLSPath)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if s.TLSCertificate, err = secret.field("certificate"); err != nil {
+			return nil, err
+		}
+
+		if s.TLSKey, err = secret.field("private_key"); err != nil {
+			return nil, err
+		}
+
+		// Certificates issued by the PKI secrets engine are
+		// served along with the certificate of the issuer.
+		if ca, ok := secret.Data["issuing_ca"].(string); ok && ca != "" {
+			s.TLSCertificate = strings.TrimSpace(s.TLSCertificate) + "\n" + ca
+		}
+
+		shorten(secret.ttl())
+	}
+
+	for _, keyPath := range p.KontrolKeyPaths {
+		secret, err := p.read(ctx, token, keyPath)
+		if err != nil {
+			return nil, err
+		}
+
+		kp := config.KeyPair{
+			ID: path.Base(keyPath),
+		}
+
+		if id, ok := secret.Data["id"].(string); ok && id != "" {
+			kp.ID = id
+		}
+
+		if kp.Public, err = secret.field("public_key"); err != nil {
+			return nil, err
+		}
+
+		if kp.Private, err = secret.field("private_key"); err != nil {
+			return nil, err
+		}
+
+		s.KontrolKeys = append(s.KontrolKeys, kp)
+
+		shorten(secret.ttl())
+	}
+
+	return s, nil
+}
+
+// authenticate gives the token the secrets are read with and its TTL,
+// zero if it does not expire. The token is renewed if it is renewable,
+// or a new one is got with AppRole once the current one is about
+// to expire.
+func (p *Provider) authenticate(ctx context.Context) (string, time.Duration, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var err error
+
+	switch {
+	case p.token == "" && p.AppRole == nil:
+		if p.Token == "" {
+			return "", 0, errors.New("kitevault: no token or AppRole given")
+		}
+
+		p.token = p.Token
+		err = p.lookupSelf(ctx)
+	case p.token == "":
+		err = p.login(ctx)
+	case p.renewable:
+		if err = p.renewSelf(ctx); err != nil && p.AppRole != nil {
+			err = p.login(ctx)
+		}
+	case p.AppRole != nil && !p.expires.IsZero() && time.Until(p.expires) < time.Minute:
+		err = p.login(ctx)
+	}
+
+	if err != nil {
+		p.token = "" // start over with the next attempt
+		return "", 0, err
+	}
+
+	var ttl time.Duration
+	if !p.expires.IsZero() {
+		ttl = time.Until(p.expires)
+	}
+
+	return p.token, ttl, nil
+}
+
+func (p *Provider) login(ctx context.Context) error {
+	mount := p.AppRole.Mount
+	if mount == "" {
+		mount = "approle"
+	}
+
+	body := map[string]string{
+		"role_id":   p.AppRole.RoleID,
+		"secret_id": p.AppRole.SecretID,
+	}
+
+	secret, err := p.do(ctx, "", "POST", "auth/"+mount+"/login", body)
+	if err != nil {
+		return err
+	}
+
+	return p.setToken(secret)
+}
+
+func (p *Provider) renewSelf(ctx context.Context) error {
+	secret, err := p.do(ctx, p.token, "POST", "auth/token/renew-self", nil)
+	if err != nil {
+		return err
+	}
+
+	return p.setToken(secret)
+}
+
+func (p *Provider) lookupSelf(ctx context.Context) error {
+	secret, err := p.do(ctx, p.token, "GET", "auth/token/lookup-self", nil)
+	if err != nil {
+		return err
+	}
+
+	ttl, _ := secret.Data["ttl"].(float64)
+	renewable, _ := secret.Data["renewable"].(bool)
+
+	p.renewable = renewable && ttl > 0
+	p.expires = time.Time{}
+
+	if ttl > 0 {
+		p.expires = time.Now().Add(time.Duration(ttl) * time.Second)
+	}
+
+	return nil
+}
+
+func (p *Provider) setToken(secret *secret) error {
+	if secret.Auth == nil || secret.Auth.ClientToken == "" {
+		return errors.New("kitevault: no token in the response")
+	}
+
+	p.token = secret.Auth.ClientToken
+	p.renewable = secret.Auth.Renewable && secret.Auth.LeaseDuration > 0
+	p.expires = time.Time{}
+
+	if secret.Auth.LeaseDuration > 0 {
+		p.expires = time.Now().Add(time.Duration(secret.Auth.LeaseDuration) * time.Second)
+	}
+
+	return nil
+}
+
+// read reads the secret, unwrapping the data of version 2
+// of the KV secrets engine.
+func (p *Provider) read(ctx context.Context, token, path string) (*secret, error) {
+	s, err := p.do(ctx, token, "GET", path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if data, ok := s.Data["data"].(map[string]interface{}); ok && s.Data["metadata"] != nil {
+		s.Data = data
+	}
+
+	return s, nil
+}
+
+// do sends the request to the Vault API.
+func (p *Provider) do(ctx context.Context, token, method, path string, body interface{}) (*secret, error) {
+	var r io.Reader
+
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+
+		r = bytes.NewReader(b)
+	}
+
+	url := strings.TrimSuffix(p.Address, "/") + "/v1/" + strings.TrimPrefix(path, "/")
+
+	req, err := http.NewRequestWithContext(ctx, method, url, r)
+	if err != nil {
+		return nil, err
+	}
+
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+
+	if p.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", p.Namespace)
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("kitevault: %s", err)
+	}
+	defer resp.Body.Close()
+
+	var s secret
+
+	if err := json.NewDecoder(resp.Body).Decode(&s); err != nil && resp.StatusCode < 300 {
+		return nil, fmt.Errorf("kitevault: %s %s: invalid response: %s", method, path, err)
+	}
+
+	if resp.StatusCode >= 300 {
+		if len(s.Errors) == 0 {
+			s.Errors = []string{resp.Status}
+		}
+
+		return nil, fmt.Errorf("kitevault: %s %s: %s", method, path, strings.Join(s.Errors, "; "))
+	}
+
+	s.path = path
+
+	return &s, nil
+}
+
+// secret is a response of the Vault API.
+type secret struct {
+	LeaseDuration int                    `json:"lease_duration"`
+	Data          map[string]interface{} `json:"data"`
+	Auth          *auth                  `json:"auth"`
+	Errors        []string               `json:"errors"`
+
+	path string
+}
+
+type auth struct {
+	ClientToken   string `json:"client_token"`
+	LeaseDuration int    `json:"lease_duration"`
+	Renewable     bool   `json:"renewable"`
+}
+
+func (s *secret) field(name string) (string, error) {
+	v, ok := s.Data[name].(string)
+	if !ok || v == "" {
+		return "", fmt.Errorf("kitevault: no %q field in %s", name, s.path)
+	}
+
+	return v, nil
+}
+
+// ttl gives the time the secret is valid for, given by its lease
+// or the expiration of the issued certificate.
+func (s *secret) ttl() time.Duration {
+	if s.LeaseDuration > 0 {
+		return time.Duration(s.LeaseDuration) * time.Second
+	}
+
+	if expiration, ok := s.Data["expiration"].(float64); ok && expiration > 0 {
+		return time.Until(time.Unix(int64(expiration), 0))
+	}
+
+	return 0
+}
@@ -0,0 +1,102 @@
+package kitevault
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestProvider(t *testing.T) {
+	expiration := time.Now().Add(10 * time.Minute).Unix()
+
+	responses := map[string]interface{}{
+		"POST /v1/auth/approle/login": map[string]interface{}{
+			"auth": map[string]interface{}{"client_token": "s.token", "lease_duration": 3600, "renewable": true},
+		},
+		"POST /v1/auth/token/renew-self": map[string]interface{}{
+			"auth": map[string]interface{}{"client_token": "s.token", "lease_duration": 3600, "renewable": true},
+		},
+		"GET /v1/secret/data/kites/math": map[string]interface{}{
+			"data": map[string]interface{}{
+				"data":     map[string]interface{}{"kite_key": "kite.key"},
+				"metadata": map[string]interface{}{"version": 1},
+			},
+		},
+		"POST /v1/pki/issue/kites": map[string]interface{}{
+			"data": map[string]interface{}{
+				"certificate": "cert",
+				"private_key": "key",
+				"issuing_ca":  "ca",
+				"expiration":  expiration,
+			},
+		},
+		"GET /v1/kv/kontrol/key1": map[string]interface{}{
+			"data": map[string]interface{}{"public_key": "public", "private_key": "private"},
+		},
+	}
+
+	var requests []string
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := r.Method + " " + r.URL.Path
+		requests = append(requests, req)
+
+		if r.URL.Path != "/v1/auth/approle/login" && r.Header.Get("X-Vault-Token") != "s.token" {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]interface{}{"errors": []string{"permission denied"}})
+			return
+		}
+
+		resp, ok := responses[req]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]interface{}{"errors": []string{}})
+			return
+		}
+
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer srv.Close()
+
+	p := &Provider{
+		Address:         srv.URL,
+		AppRole:         &AppRole{RoleID: "role", SecretID: "secret"},
+		KiteKeyPath:     "secret/data/kites/math",
+		TLSPath:         "pki/issue/kites",
+		TLSCommonName:   "math.kites.example.com",
+		KontrolKeyPaths: []string{"kv/kontrol/key1"},
+	}
+
+	for i := 0; i < 2; i++ {
+		s, err := p.Secrets(context.Background())
+		if err != nil {
+			t.Fatalf("%d: Secrets()=%s", i, err)
+		}
+
+		if s.KiteKey != "kite.key" || s.TLSCertificate != "cert\nca" || s.TLSKey != "key" {
+			t.Fatalf("%d: got %+v", i, s)
+		}
+
+		if len(s.KontrolKeys) != 1 || s.KontrolKeys[0].ID != "key1" || s.KontrolKeys[0].Private != "private" {
+			t.Fatalf("%d: got %+v kontrol keys", i, s.KontrolKeys)
+		}
+
+		// The certificate expires first.
+		if s.TTL <= 9*time.Minute || s.TTL > 10*time.Minute {
+			t.Fatalf("%d: got %s TTL, want about 10m", i, s.TTL)
+		}
+	}
+
+	if requests[0] != "POST /v1/auth/approle/login" || requests[4] != "POST /v1/auth/token/renew-self" {
+		t.Fatalf("got %v requests, want login followed by renewal", requests)
+	}
+
+	p.KiteKeyPath = "secret/data/kites/missing"
+
+	if _, err := p.Secrets(context.Background()); err == nil {
+		t.Fatal("expected Secrets() to fail for a missing secret")
+	}
+}
@@ -38,6 +38,8 @@ CREATE UNLOGGED TABLE "kite"."kite" (
     created_at timestamptz NOT NULL DEFAULT (NOW() AT TIME ZONE 'UTC'), -- you may set a global timezone
     updated_at timestamptz NOT NULL DEFAULT (NOW() AT TIME ZONE 'UTC'),
     key_id UUID NOT NULL,
+    labels TEXT, -- JSON encoded labels of the kite
+    urls TEXT, -- JSON encoded alternative URLs of the kite
 
     CONSTRAINT "kite_key_id_fkey" FOREIGN KEY ("key_id") REFERENCES kite.key (id) ON UPDATE NO ACTION ON DELETE NO ACTION NOT DEFERRABLE INITIALLY IMMEDIATE
 );
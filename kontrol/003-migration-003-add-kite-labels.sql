@@ -0,0 +1,10 @@
+-- add labels column into kite table, it stores JSON encoded labels
+DO $$
+  BEGIN
+    BEGIN
+      ALTER TABLE kite.kite ADD COLUMN "labels" TEXT;
+    EXCEPTION
+      WHEN duplicate_column THEN RAISE NOTICE 'labels column already exists';
+    END;
+  END;
+$$;
@@ -0,0 +1,10 @@
+-- add urls column into kite table, it stores JSON encoded alternative URLs
+DO $$
+  BEGIN
+    BEGIN
+      ALTER TABLE kite.kite ADD COLUMN "urls" TEXT;
+    EXCEPTION
+      WHEN duplicate_column THEN RAISE NOTICE 'urls column already exists';
+    END;
+  END;
+$$;
@@ -0,0 +1,33 @@
+-- partition kite table by updated_at, the partitions are created and dropped
+-- by kontrol, so expired kites are removed without deleting the rows; it
+-- requires PostgreSQL 11 or newer
+--
+-- the registered kites are not copied, they are stored again
+-- with the next heartbeat
+DROP TABLE IF EXISTS "kite"."kite";
+
+CREATE TABLE "kite"."kite" (
+    username TEXT NOT NULL,
+    environment TEXT NOT NULL,
+    kitename TEXT NOT NULL,
+    version TEXT NOT NULL,
+    region TEXT NOT NULL,
+    hostname TEXT NOT NULL,
+    id uuid NOT NULL,
+    url TEXT NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT (NOW() AT TIME ZONE 'UTC'),
+    updated_at timestamptz NOT NULL DEFAULT (NOW() AT TIME ZONE 'UTC'),
+    key_id UUID NOT NULL,
+    labels TEXT, -- JSON encoded labels of the kite
+    urls TEXT, -- JSON encoded alternative URLs of the kite
+
+    PRIMARY KEY (id, updated_at),
+    CONSTRAINT "kite_key_id_fkey" FOREIGN KEY ("key_id") REFERENCES kite.key (id) ON UPDATE NO ACTION ON DELETE NO ACTION NOT DEFERRABLE INITIALLY IMMEDIATE
+) PARTITION BY RANGE (updated_at);
+
+-- kontrol needs to own the table to create and drop its partitions
+ALTER TABLE "kite"."kite" OWNER TO "kontrol";
+GRANT CREATE ON SCHEMA kite TO "kontrol";
+
+CREATE INDEX kite_updated_at_btree_idx ON "kite"."kite" USING BTREE (updated_at DESC);
+CREATE INDEX kite_id_idx ON "kite"."kite" USING BTREE (id);
@@ -0,0 +1,12 @@
+-- create event table for storing changes of kites, which are sent to
+-- the watchers notified on the kite_event channel
+CREATE UNLOGGED TABLE IF NOT EXISTS "kite"."event" (
+    revision BIGSERIAL PRIMARY KEY,
+    action TEXT NOT NULL, -- either register or deregister
+    path TEXT NOT NULL, -- key of the kite, e.g. /kites/username/environment/...
+    value TEXT NOT NULL, -- JSON encoded register value of the kite
+    created_at timestamptz NOT NULL DEFAULT (NOW() AT TIME ZONE 'UTC')
+);
+
+GRANT SELECT, INSERT, DELETE ON "kite"."event" TO "kontrol";
+GRANT USAGE ON SEQUENCE "kite"."event_revision_seq" TO "kontrol";
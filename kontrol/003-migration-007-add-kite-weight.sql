@@ -0,0 +1,11 @@
+-- add weight column into kite table, it stores the capacity of the kite
+-- relative to other kites
+DO $$
+  BEGIN
+    BEGIN
+      ALTER TABLE kite.kite ADD COLUMN "weight" INTEGER NOT NULL DEFAULT 0;
+    EXCEPTION
+      WHEN duplicate_column THEN RAISE NOTICE 'weight column already exists';
+    END;
+  END;
+$$;
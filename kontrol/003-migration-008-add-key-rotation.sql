@@ -0,0 +1,17 @@
+-- add current and retire_at columns into key table, they store the state
+-- of key pairs rotated with RotateKeyPair, so it survives restarts
+DO $$
+  BEGIN
+    BEGIN
+      ALTER TABLE kite.key ADD COLUMN "current" BOOLEAN NOT NULL DEFAULT FALSE;
+    EXCEPTION
+      WHEN duplicate_column THEN RAISE NOTICE 'current column already exists';
+    END;
+
+    BEGIN
+      ALTER TABLE kite.key ADD COLUMN "retire_at" timestamp(6) WITH TIME ZONE;
+    EXCEPTION
+      WHEN duplicate_column THEN RAISE NOTICE 'retire_at column already exists';
+    END;
+  END;
+$$;
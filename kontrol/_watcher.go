@@ -3,11 +3,11 @@ package kontrol
 import (
 	"errors"
 
-	etcd "github.com/coreos/etcd/client"
 	"github.com/hashicorp/go-version"
 	"github.com/koding/kite"
 	"github.com/koding/kite/dnode"
 	"github.com/koding/kite/protocol"
+	etcd "go.etcd.io/etcd/client/v2"
 )
 
 type Event struct {
@@ -0,0 +1,437 @@
+package kontrol
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/koding/kite"
+	"github.com/koding/kite/gateway"
+	kontrolprotocol "github.com/koding/kite/kontrol/protocol"
+	"github.com/koding/kite/protocol"
+)
+
+// registration tracks heartbeats of a kite registered to the Kontrol.
+type registration struct {
+	kite       protocol.Kite
+	transport  string
+	registered time.Time
+
+	// client is the connection the kite registered over,
+	// nil if it registered over HTTP
+	client *kite.Client
+
+	mu        sync.Mutex
+	heartbeat time.Time
+
+	// stopUpdates stops updating the kite in the storage,
+	// disconnect disconnects it
+	stopUpdates func()
+	disconnect  func()
+}
+
+// stop stops updating the kite in the storage and disconnects it.
+func (reg *registration) stop() {
+	reg.stopUpdates()
+	reg.disconnect()
+}
+
+// beat records a heartbeat of the kite.
+func (reg *registration) beat() {
+	reg.mu.Lock()
+	reg.heartbeat = time.Now()
+	reg.mu.Unlock()
+}
+
+func (reg *registration) status() *protocol.HeartbeatStatus {
+	reg.mu.Lock()
+	heartbeat := reg.heartbeat
+	reg.mu.Unlock()
+
+	return &protocol.HeartbeatStatus{
+		Kite:          reg.kite,
+		Transport:     reg.transport,
+		Registered:    reg.registered,
+		LastHeartbeat: heartbeat,
+		Alive:         time.Since(heartbeat) < HeartbeatInterval+HeartbeatDelay,
+	}
+}
+
+// addRegistration starts tracking heartbeats of the kite, replacing its
+// previous registration, if any.
+func (k *Kontrol) addRegistration(kite *protocol.Kite, transport string, c *kite.Client, stopUpdates, disconnect func()) *registration {
+	now := time.Now()
+
+	reg := &registration{
+		kite:        *kite,
+		transport:   transport,
+		registered:  now,
+		client:      c,
+		heartbeat:   now,
+		stopUpdates: stopUpdates,
+		disconnect:  disconnect,
+	}
+
+	k.registrationsMu.Lock()
+	if k.registrations == nil {
+		k.registrations = make(map[string]*registration)
+	}
+	k.registrations[kite.ID] = reg
+	k.registrationsMu.Unlock()
+
+	return reg
+}
+
+// removeRegistration stops tracking heartbeats of the kite, unless
+// it has registered again in the meantime.
+func (k *Kontrol) removeRegistration(reg *registration) {
+	k.registrationsMu.Lock()
+	if k.registrations[reg.kite.ID] == reg {
+		delete(k.registrations, reg.kite.ID)
+	}
+	k.registrationsMu.Unlock()
+}
+
+func (k *Kontrol) registration(id string) *registration {
+	k.registrationsMu.Lock()
+	defer k.registrationsMu.Unlock()
+
+	return k.registrations[id]
+}
+
+// HandleAdminListKites gives the kites matching the query along with
+// their heartbeat status. Tokens are not issued for the listed kites.
+func (k *Kontrol) HandleAdminListKites(r *kite.Request) (interface{}, error) {
+	var args protocol.AdminListKitesArgs
+
+	if err := r.Args.One().Unmarshal(&args); err != nil {
+		return nil, err
+	}
+
+	if args.Query == nil {
+		return nil, errors.New("query is empty")
+	}
+
+	kites, err := k.storage.Get(args.Query)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &protocol.AdminListKitesResult{
+		Kites: make([]*protocol.AdminKite, 0, len(kites)),
+	}
+
+	for _, kite := range kites {
+		if !args.Query.MatchLabels(kite.Labels) {
+			continue
+		}
+
+		ak := &protocol.AdminKite{
+			Kite:   kite.Kite,
+			URL:    kite.URL,
+			URLs:   kite.URLs,
+			KeyID:  kite.KeyID,
+			Labels: kite.Labels,
+			Weight: kite.Weight,
+		}
+
+		if reg := k.registration(kite.Kite.ID); reg != nil {
+			ak.Heartbeat = reg.status()
+		}
+
+		res.Kites = append(res.Kites, ak)
+	}
+
+	return res, nil
+}
+
+// HandleAdminHeartbeats gives the heartbeat status of all the kites
+// registered to the Kontrol, ordered by their IDs.
+func (k *Kontrol) HandleAdminHeartbeats(r *kite.Request) (interface{}, error) {
+	k.registrationsMu.Lock()
+	regs := make([]*registration, 0, len(k.registrations))
+	for _, reg := range k.registrations {
+		regs = append(regs, reg)
+	}
+	k.registrationsMu.Unlock()
+
+	sort.Slice(regs, func(i, j int) bool { return regs[i].kite.ID < regs[j].kite.ID })
+
+	statuses := make([]*protocol.HeartbeatStatus, 0, len(regs))
+	for _, reg := range regs {
+		statuses = append(statuses, reg.status())
+	}
+
+	return statuses, nil
+}
+
+// HandleAdminDeregister removes the kite matching the query from the
+// storage and disconnects it, if it is registered to the Kontrol.
+//
+// The kite is going to register again, if it keeps running, unless
+// its kite key is revoked as well.
+func (k *Kontrol) HandleAdminDeregister(r *kite.Request) (interface{}, error) {
+	var args protocol.AdminDeregisterArgs
+
+	if err := r.Args.One().Unmarshal(&args); err != nil {
+		return nil, err
+	}
+
+	kites, err := k.storage.Get(&args.KontrolQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(kites) > 1 {
+		return nil, errors.New("query matches more than one kite")
+	}
+
+	if len(kites) == 0 {
+		return nil, errors.New("no kites found")
+	}
+
+	if args.Revoke {
+		if err := k.Revoke(&protocol.Revocation{KiteID: kites[0].Kite.ID}); err != nil {
+			return nil, err
+		}
+	}
+
+	if reg := k.registration(kites[0].Kite.ID); reg != nil {
+		reg.stop()
+		k.removeRegistration(reg)
+	}
+
+	if err := k.deregister(kites[0]); err != nil {
+		return nil, err
+	}
+
+	k.log.Info("Kite deregistered by %q: %s", r.Username, &kites[0].Kite)
+
+	return nil, nil
+}
+
+// HandleDeregister removes the calling kite from the storage, e.g. when
+// it shuts down, so it is no longer returned by getKites. The kite must
+// call it over the connection it registered over.
+func (k *Kontrol) HandleDeregister(r *kite.Request) (interface{}, error) {
+	reg := k.registration(r.Client.Kite.ID)
+	if reg == nil || reg.client != r.Client {
+		return nil, errors.New("kite is not registered over this connection")
+	}
+
+	kites, err := k.storage.Get(r.Client.Kite.Query())
+	if err != nil {
+		return nil, err
+	}
+
+	if len(kites) != 1 {
+		return nil, errors.New("no kites found")
+	}
+
+	// The kite closes the connection itself.
+	reg.stopUpdates()
+	k.removeRegistration(reg)
+
+	if err := k.deregister(kites[0]); err != nil {
+		return nil, err
+	}
+
+	k.log.Info("Kite deregistered: %s", &kites[0].Kite)
+
+	return nil, nil
+}
+
+// deregister deletes the kite from the storage and notifies the watchers.
+func (k *Kontrol) deregister(kite *protocol.KiteWithToken) error {
+	if err := k.storage.Delete(&kite.Kite); err != nil {
+		return err
+	}
+
+	k.emit(protocol.Deregister, &kite.Kite, &kontrolprotocol.RegisterValue{
+		URL:    kite.URL,
+		URLs:   kite.URLs,
+		Labels: kite.Labels,
+		Weight: kite.Weight,
+	})
+
+	return nil
+}
+
+// HandleAdminGetKeys gives the key pairs of the Kontrol, starting with
+// the current one. Private keys are never given.
+func (k *Kontrol) HandleAdminGetKeys(r *kite.Request) (interface{}, error) {
+	var current string
+
+	if kp, err := k.KeyPair(); err == nil {
+		current = kp.Public
+	}
+
+	k.keysMu.Lock()
+	defer k.keysMu.Unlock()
+
+	keys := make([]*protocol.AdminKey, 0, len(k.lastIDs))
+
+	for i := len(k.lastIDs) - 1; i >= 0; i-- {
+		_, retiring := k.retiring[k.lastIDs[i]]
+
+		key := &protocol.AdminKey{
+			ID:       k.lastIDs[i],
+			Public:   k.lastPublic[i],
+			Current:  k.lastPublic[i] == current,
+			Retiring: retiring,
+		}
+
+		if key.Current {
+			keys = append([]*protocol.AdminKey{key}, keys...)
+		} else {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, nil
+}
+
+// HandleAdmin serves the admin web UI under the /admin path and the admin
+// methods under the /admin/methods/{name} path, see the gateway package
+// for the details of calling them. The UI asks for the kite key or token
+// the admin methods are called with.
+func (k *Kontrol) HandleAdmin(rw http.ResponseWriter, req *http.Request) {
+	if !strings.HasPrefix(req.URL.Path, "/admin/methods/") {
+		rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+		rw.Write([]byte(adminPage))
+		return
+	}
+
+	// Only admin methods are exposed.
+	if !strings.HasPrefix(req.URL.Path, "/admin/methods/admin.") {
+		http.NotFound(rw, req)
+		return
+	}
+
+	gateway.New(k.Kite).ServeHTTP(rw, req)
+}
+
+const adminPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Kontrol</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin: 1em 0; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: left; }
+.dead { color: #b00; }
+#error { color: #b00; }
+</style>
+</head>
+<body>
+<h1>Kontrol</h1>
+<p>
+<select id="authType">
+<option value="kiteKey">kite key</option>
+<option value="token">token</option>
+</select>
+<input id="authKey" type="password" size="40" placeholder="kite key or token">
+<input id="username" placeholder="username">
+<button onclick="refresh()">Refresh</button>
+</p>
+<p id="error"></p>
+<h2>Kites</h2>
+<table id="kites"></table>
+<h2>Heartbeats</h2>
+<table id="heartbeats"></table>
+<h2>Keys</h2>
+<table id="keys"></table>
+<script>
+function call(method, arg) {
+	var auth = document.getElementById("authType").value + " " + document.getElementById("authKey").value;
+	return fetch("/admin/methods/admin." + method, {
+		method: "POST",
+		headers: {"Authorization": auth, "Content-Type": "application/json"},
+		body: arg === undefined ? "" : JSON.stringify(arg)
+	}).then(function(resp) { return resp.json(); }).then(function(resp) {
+		if (resp.error) {
+			throw new Error(resp.error.message);
+		}
+		return resp.result;
+	});
+}
+
+function kiteString(k) {
+	return "/" + [k.username, k.environment, k.name, k.version, k.region, k.hostname, k.id].join("/");
+}
+
+function fill(id, header, rows) {
+	var table = document.getElementById(id);
+	table.innerHTML = "";
+	[header].concat(rows).forEach(function(row, i) {
+		var tr = table.insertRow();
+		row.forEach(function(cell) {
+			var td = document.createElement(i === 0 ? "th" : "td");
+			if (cell instanceof Node) {
+				td.appendChild(cell);
+			} else {
+				td.textContent = cell;
+			}
+			tr.appendChild(td);
+		});
+	});
+}
+
+function heartbeat(h) {
+	if (!h) {
+		return "-";
+	}
+	var span = document.createElement("span");
+	span.textContent = h.lastHeartbeat + " (" + h.transport + ")";
+	span.className = h.alive ? "" : "dead";
+	return span;
+}
+
+function deregisterButton(k) {
+	var button = document.createElement("button");
+	button.textContent = "Deregister";
+	button.onclick = function() {
+		if (!confirm("Deregister " + kiteString(k) + "?")) {
+			return;
+		}
+		call("deregister", k).then(refresh, showError);
+	};
+	return button;
+}
+
+function showError(err) {
+	document.getElementById("error").textContent = err.message;
+}
+
+function refresh() {
+	document.getElementById("error").textContent = "";
+
+	var username = document.getElementById("username").value;
+	if (username) {
+		call("listKites", {query: {username: username}}).then(function(res) {
+			fill("kites", ["Kite", "URL", "Key ID", "Last heartbeat", ""], res.kites.map(function(k) {
+				return [kiteString(k.kite), k.url, k.keyId, heartbeat(k.heartbeat), deregisterButton(k.kite)];
+			}));
+		}).catch(showError);
+	}
+
+	call("heartbeats").then(function(res) {
+		fill("heartbeats", ["Kite", "Registered", "Last heartbeat"], res.map(function(h) {
+			return [kiteString(h.kite), h.registered, heartbeat(h)];
+		}));
+	}).catch(showError);
+
+	call("getKeys").then(function(res) {
+		fill("keys", ["ID", "Public key", "Current", "Retiring"], res.map(function(k) {
+			return [k.id, k.public, k.current ? "yes" : "", k.retiring ? "yes" : ""];
+		}));
+	}).catch(showError);
+}
+</script>
+</body>
+</html>
+`
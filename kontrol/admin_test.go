@@ -0,0 +1,190 @@
+package kontrol
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/koding/kite"
+	"github.com/koding/kite/config"
+	"github.com/koding/kite/kitekey"
+	"github.com/koding/kite/protocol"
+	"github.com/koding/kite/testkeys"
+	"github.com/koding/kite/testutil"
+	uuid "github.com/satori/go.uuid"
+)
+
+func TestAdmin(t *testing.T) {
+	conf := config.New()
+	conf.Username = "testuser"
+	conf.Environment = "admin"
+	conf.Port = 5512
+	conf.KontrolURL = fmt.Sprintf("http://localhost:%d/kite", conf.Port)
+	conf.KontrolKey = testkeys.Public
+	conf.KontrolUser = "testuser"
+	conf.KiteKey = testutil.NewToken("testuser", testkeys.Private, testkeys.Public).Raw
+
+	kon := New(conf.Copy(), "1.0.0")
+	kon.SetStorage(newMemStorage())
+	kon.AddKeyPair("admin", testkeys.Public, testkeys.Private)
+
+	go kon.Run()
+	<-kon.Kite.ServerReadyNotify()
+	defer kon.Close()
+
+	k := kite.New("managed", "1.0.0")
+	k.Config = conf.Copy()
+	k.Config.Port = 0
+
+	go k.Run()
+	<-k.ServerReadyNotify()
+	defer k.Close()
+
+	registered := make(chan struct{}, 1)
+	k.OnRegister(func(*protocol.RegisterResult) {
+		select {
+		case registered <- struct{}{}:
+		default:
+		}
+	})
+
+	u := &url.URL{Scheme: "http", Host: fmt.Sprintf("127.0.0.1:%d", k.Port()), Path: "/kite"}
+
+	if err := k.RegisterForever(u); err != nil {
+		t.Fatalf("RegisterForever()=%s", err)
+	}
+
+	select {
+	case <-registered:
+	case <-time.After(15 * time.Second):
+		t.Fatal("timed out waiting for the kite to register")
+	}
+
+	adminKey, err := kitekey.Sign(&kitekey.KiteClaims{
+		StandardClaims: jwt.StandardClaims{
+			Issuer:   "testuser",
+			Subject:  "admin",
+			IssuedAt: time.Now().UTC().Unix(),
+			Id:       uuid.NewV4().String(),
+		},
+		KontrolKey: testkeys.Public,
+		KontrolURL: conf.KontrolURL,
+		Scopes:     []string{kite.ScopeAdmin},
+	}, testkeys.Private)
+	if err != nil {
+		t.Fatalf("Sign()=%s", err)
+	}
+
+	c := kite.New("admin", "1.0.0")
+	c.Config = conf.Copy()
+	defer c.Close()
+
+	admin := c.NewClient(conf.KontrolURL)
+	admin.Auth = &kite.Auth{Type: "kiteKey", Key: adminKey}
+
+	if err := admin.Dial(); err != nil {
+		t.Fatalf("Dial()=%s", err)
+	}
+	defer admin.Close()
+
+	user := c.NewClient(conf.KontrolURL)
+	user.Auth = &kite.Auth{Type: "kiteKey", Key: conf.KiteKey}
+
+	if err := user.Dial(); err != nil {
+		t.Fatalf("Dial()=%s", err)
+	}
+	defer user.Close()
+
+	query := &protocol.KontrolQuery{
+		Username:    "testuser",
+		Environment: "admin",
+		Name:        "managed",
+	}
+
+	args := &protocol.AdminListKitesArgs{
+		Query: query,
+	}
+
+	if _, err := user.TellWithTimeout("admin.listKites", 4*time.Second, args); err == nil {
+		t.Fatal("expected admin.listKites to fail without the admin scope")
+	}
+
+	res, err := admin.TellWithTimeout("admin.listKites", 4*time.Second, args)
+	if err != nil {
+		t.Fatalf("admin.listKites: %s", err)
+	}
+
+	var list protocol.AdminListKitesResult
+	if err := res.Unmarshal(&list); err != nil {
+		t.Fatalf("Unmarshal()=%s", err)
+	}
+
+	if len(list.Kites) != 1 {
+		t.Fatalf("got %d kites, want 1", len(list.Kites))
+	}
+
+	if got := list.Kites[0]; got.Kite.ID != k.Id || got.Heartbeat == nil || !got.Heartbeat.Alive {
+		t.Fatalf("got %+v, want alive kite %q", got, k.Id)
+	}
+
+	res, err = admin.TellWithTimeout("admin.getKeys", 4*time.Second)
+	if err != nil {
+		t.Fatalf("admin.getKeys: %s", err)
+	}
+
+	var keys []*protocol.AdminKey
+	if err := res.Unmarshal(&keys); err != nil {
+		t.Fatalf("Unmarshal()=%s", err)
+	}
+
+	if len(keys) != 1 || keys[0].ID != "admin" || !keys[0].Current {
+		t.Fatalf("got %+v, want the current admin key pair", keys)
+	}
+
+	resp, err := http.Get(fmt.Sprintf("http://localhost:%d/admin", conf.Port))
+	if err != nil {
+		t.Fatalf("Get()=%s", err)
+	}
+	page, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("ReadAll()=%s", err)
+	}
+
+	if !strings.Contains(string(page), "admin.") {
+		t.Fatalf("unexpected admin page: %s", page)
+	}
+
+	// Other methods are not exposed over HTTP.
+	resp, err = http.Post(fmt.Sprintf("http://localhost:%d/admin/methods/getKites", conf.Port), "application/json", nil)
+	if err != nil {
+		t.Fatalf("Post()=%s", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("got %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+
+	deregister := &protocol.AdminDeregisterArgs{
+		KontrolQuery: *k.Kite().Query(),
+	}
+
+	if _, err := admin.TellWithTimeout("admin.deregister", 4*time.Second, deregister); err != nil {
+		t.Fatalf("admin.deregister: %s", err)
+	}
+
+	kites, err := kon.storage.Get(query)
+	if err != nil {
+		t.Fatalf("Get()=%s", err)
+	}
+
+	if len(kites) != 0 {
+		t.Fatalf("got %d kites, want the kite to be deregistered", len(kites))
+	}
+}
@@ -0,0 +1,408 @@
+package kontrol
+
+import (
+	"encoding/json"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-version"
+	"github.com/koding/kite"
+	kontrolprotocol "github.com/koding/kite/kontrol/protocol"
+	"github.com/koding/kite/protocol"
+)
+
+// ConsulConfig is used to configure the Consul storage.
+type ConsulConfig struct {
+	// Address of the Consul agent, "127.0.0.1:8500" by default.
+	Address string
+
+	// Scheme is either "http" (default) or "https".
+	Scheme string
+
+	// Datacenter to use, the agent's one by default.
+	Datacenter string
+
+	// Token is an ACL token used for all the requests.
+	Token string
+
+	// Tag is used to tell kite services apart from other ones
+	// in the catalog, "kite" by default.
+	Tag string
+
+	CertFile string // client certificate
+	KeyFile  string // client certificate key
+	CAFile   string // certificate authority used to verify the agent
+}
+
+// Consul implements the Storage interface with Consul.
+//
+// Each kite is registered as a service of the local Consul agent, named
+// after the kite and with the kite fields, URL and key ID kept in the service
+// meta. The service has a TTL check, which passes on each Update, so kites
+// that stopped sending heartbeats are considered unhealthy and are not
+// returned by Get, until they are eventually deregistered by Consul.
+//
+// The kite ID is additionally stored in the KV, under the KitesPrefix, bound
+// to a session with KeyTTL, which is used for looking up kites by their ID.
+type Consul struct {
+	client *api.Client
+	log    kite.Logger
+	tag    string
+}
+
+var _ Storage = (*Consul)(nil)
+
+// NewConsul gives new Consul storage. It panics if the client cannot
+// be created.
+func NewConsul(conf *ConsulConfig, log kite.Logger) *Consul {
+	if conf == nil {
+		conf = &ConsulConfig{}
+	}
+
+	cfg := api.DefaultConfig()
+
+	if conf.Address != "" {
+		cfg.Address = conf.Address
+	}
+
+	if conf.Scheme != "" {
+		cfg.Scheme = conf.Scheme
+	}
+
+	if conf.Datacenter != "" {
+		cfg.Datacenter = conf.Datacenter
+	}
+
+	if conf.Token != "" {
+		cfg.Token = conf.Token
+	}
+
+	if conf.CertFile != "" || conf.KeyFile != "" || conf.CAFile != "" {
+		cfg.TLSConfig = api.TLSConfig{
+			CertFile: conf.CertFile,
+			KeyFile:  conf.KeyFile,
+			CAFile:   conf.CAFile,
+		}
+	}
+
+	client, err := api.NewClient(cfg)
+	if err != nil {
+		panic("cannot create consul client: " + err.Error())
+	}
+
+	tag := conf.Tag
+	if tag == "" {
+		tag = "kite"
+	}
+
+	return &Consul{
+		client: client,
+		log:    log,
+		tag:    tag,
+	}
+}
+
+func (c *Consul) Delete(k *protocol.Kite) error {
+	if err := c.client.Agent().ServiceDeregister(k.ID); err != nil {
+		return err
+	}
+
+	pair, _, err := c.client.KV().Get(consulIDKey(k.ID), nil)
+	if err != nil {
+		return err
+	}
+
+	if pair == nil {
+		return nil
+	}
+
+	if pair.Session != "" {
+		// The key is deleted together with the session.
+		_, err = c.client.Session().Destroy(pair.Session, nil)
+		return err
+	}
+
+	_, err = c.client.KV().Delete(pair.Key, nil)
+	return err
+}
+
+func (c *Consul) Add(k *protocol.Kite, value *kontrolprotocol.RegisterValue) error {
+	return c.Upsert(k, value)
+}
+
+func (c *Consul) Update(k *protocol.Kite, value *kontrolprotocol.RegisterValue) error {
+	return c.Upsert(k, value)
+}
+
+func (c *Consul) Upsert(k *protocol.Kite, value *kontrolprotocol.RegisterValue) error {
+	if err := validateKiteKey(k); err != nil {
+		return err
+	}
+
+	reg := &api.AgentServiceRegistration{
+		ID:   k.ID,
+		Name: k.Name,
+		Tags: []string{c.tag},
+		Meta: map[string]string{
+			"username":    k.Username,
+			"environment": k.Environment,
+			"name":        k.Name,
+			"version":     k.Version,
+			"region":      k.Region,
+			"hostname":    k.Hostname,
+			"id":          k.ID,
+			"url":         value.URL,
+			"keyID":       value.KeyID,
+		},
+		Check: &api.AgentServiceCheck{
+			CheckID:                        consulCheckID(k.ID),
+			TTL:                            KeyTTL.String(),
+			Status:                         api.HealthPassing,
+			DeregisterCriticalServiceAfter: KeyTTL.String(),
+		},
+	}
+
+	// Meta keys are restricted, so labels are stored encoded
+	// under a single one.
+	if len(value.Labels) != 0 {
+		p, err := json.Marshal(value.Labels)
+		if err != nil {
+			return err
+		}
+
+		reg.Meta["labels"] = string(p)
+	}
+
+	if len(value.URLs) != 0 {
+		p, err := json.Marshal(value.URLs)
+		if err != nil {
+			return err
+		}
+
+		reg.Meta["urls"] = string(p)
+	}
+
+	if value.Weight != 0 {
+		reg.Meta["weight"] = strconv.Itoa(value.Weight)
+	}
+
+	// Make the kite reachable with Consul DNS too.
+	if u, err := url.Parse(value.URL); err == nil {
+		if host, port, err := net.SplitHostPort(u.Host); err == nil {
+			reg.Address = host
+			reg.Port, _ = strconv.Atoi(port)
+		}
+	}
+
+	// Registering the service again updates its meta and passes
+	// the TTL check.
+	if err := c.client.Agent().ServiceRegister(reg); err != nil {
+		return err
+	}
+
+	return c.upsertID(k)
+}
+
+// upsertID renews the session of the kite ID key, creating the key
+// with a new session when the previous one has expired.
+func (c *Consul) upsertID(k *protocol.Kite) error {
+	key := consulIDKey(k.ID)
+
+	pair, _, err := c.client.KV().Get(key, nil)
+	if err != nil {
+		return err
+	}
+
+	if pair != nil && pair.Session != "" {
+		entry, _, err := c.client.Session().Renew(pair.Session, nil)
+		if err != nil {
+			return err
+		}
+
+		if entry != nil {
+			return nil
+		}
+	}
+
+	session, _, err := c.client.Session().Create(&api.SessionEntry{
+		Name:     "kite-" + k.ID,
+		TTL:      KeyTTL.String(),
+		Behavior: api.SessionBehaviorDelete,
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	_, _, err = c.client.KV().Acquire(&api.KVPair{
+		Key:     key,
+		Value:   []byte(k.Name),
+		Session: session,
+	}, nil)
+
+	return err
+}
+
+func (c *Consul) Get(query *protocol.KontrolQuery) (Kites, error) {
+	// NewVersion returns an error if it's a constraint, like: ">= 1.0, < 1.4"
+	var versionConstraint version.Constraints
+	if _, err := version.NewVersion(query.Version); err != nil && query.Version != "" {
+		versionConstraint, err = version.NewConstraint(query.Version)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	names, err := c.serviceNames(query)
+	if err != nil {
+		return nil, err
+	}
+
+	kites := make(Kites, 0)
+
+	for _, name := range names {
+		// Only kites that have passing TTL check are returned.
+		entries, _, err := c.client.Health().Service(name, c.tag, true, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			kite, err := kiteFromService(entry.Service)
+			if err != nil {
+				c.log.Warning("Ignoring invalid %q service: %s", name, err)
+				continue
+			}
+
+			if matchQuery(&kite.Kite, query, versionConstraint) {
+				kites = append(kites, kite)
+			}
+		}
+	}
+
+	kites.Shuffle()
+
+	return kites, nil
+}
+
+// serviceNames gives names of the services that need to be looked up
+// for the given query.
+func (c *Consul) serviceNames(query *protocol.KontrolQuery) ([]string, error) {
+	if query.Name != "" {
+		return []string{query.Name}, nil
+	}
+
+	if onlyIDQuery(query) {
+		pair, _, err := c.client.KV().Get(consulIDKey(query.ID), nil)
+		if err != nil {
+			return nil, err
+		}
+
+		if pair == nil {
+			return nil, nil
+		}
+
+		return []string{string(pair.Value)}, nil
+	}
+
+	services, _, err := c.client.Catalog().Services(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+
+	for name, tags := range services {
+		for _, tag := range tags {
+			if tag == c.tag {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+
+	return names, nil
+}
+
+// consulIDKey gives the KV key for the given kite ID.
+func consulIDKey(id string) string {
+	return strings.TrimPrefix(KitesPrefix, "/") + "/" + id
+}
+
+func consulCheckID(id string) string {
+	return "kite:" + id
+}
+
+// kiteFromService builds a kite from the meta of the Consul service.
+func kiteFromService(s *api.AgentService) (*protocol.KiteWithToken, error) {
+	kite := &protocol.KiteWithToken{
+		Kite: protocol.Kite{
+			Username:    s.Meta["username"],
+			Environment: s.Meta["environment"],
+			Name:        s.Meta["name"],
+			Version:     s.Meta["version"],
+			Region:      s.Meta["region"],
+			Hostname:    s.Meta["hostname"],
+			ID:          s.Meta["id"],
+		},
+		URL:   s.Meta["url"],
+		KeyID: s.Meta["keyID"],
+	}
+
+	if err := validateKiteKey(&kite.Kite); err != nil {
+		return nil, err
+	}
+
+	if labels := s.Meta["labels"]; labels != "" {
+		if err := json.Unmarshal([]byte(labels), &kite.Labels); err != nil {
+			return nil, err
+		}
+	}
+
+	if urls := s.Meta["urls"]; urls != "" {
+		if err := json.Unmarshal([]byte(urls), &kite.URLs); err != nil {
+			return nil, err
+		}
+	}
+
+	if weight := s.Meta["weight"]; weight != "" {
+		w, err := strconv.Atoi(weight)
+		if err != nil {
+			return nil, err
+		}
+
+		kite.Weight = w
+	}
+
+	return kite, nil
+}
+
+// matchQuery tells whether the kite matches all the non-empty fields of
+// the query. If constraint is non-nil, it is used for matching the version
+// instead of the query's one.
+func matchQuery(k *protocol.Kite, query *protocol.KontrolQuery, constraint version.Constraints) bool {
+	if constraint != nil {
+		v, err := version.NewVersion(k.Version)
+		if err != nil || !constraint.Check(v) {
+			return false
+		}
+	} else if query.Version != "" && query.Version != k.Version {
+		return false
+	}
+
+	fields := k.Query().Fields()
+
+	for key, v := range query.Fields() {
+		if key == "version" || v == "" {
+			continue
+		}
+
+		if fields[key] != v {
+			return false
+		}
+	}
+
+	return true
+}
@@ -8,11 +8,11 @@ import (
 	"strings"
 	"time"
 
-	etcd "github.com/coreos/etcd/client"
 	"github.com/hashicorp/go-version"
 	"github.com/koding/kite"
 	kontrolprotocol "github.com/koding/kite/kontrol/protocol"
 	"github.com/koding/kite/protocol"
+	etcd "go.etcd.io/etcd/client/v2"
 )
 
 // keyOrder defines the order of the query parameters.
@@ -34,7 +34,7 @@ type Etcd struct {
 
 func NewEtcd(machines []string, log kite.Logger) *Etcd {
 	if machines == nil || len(machines) == 0 {
-		machines = []string{"//127.0.0.1:4001"}
+		machines = []string{"http://127.0.0.1:4001"}
 	}
 
 	cfg := etcd.Config{
@@ -0,0 +1,438 @@
+package kontrol
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-version"
+	"github.com/koding/kite"
+	kontrolprotocol "github.com/koding/kite/kontrol/protocol"
+	"github.com/koding/kite/protocol"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// EtcdV3Config is used to configure the etcd v3 storage.
+type EtcdV3Config struct {
+	// Endpoints of the etcd cluster, "127.0.0.1:2379" by default.
+	Endpoints []string
+
+	// DialTimeout is the timeout for establishing a connection,
+	// 5s by default.
+	DialTimeout time.Duration
+
+	// RequestTimeout is the timeout of a single request, 5s by default.
+	RequestTimeout time.Duration
+
+	// Username and Password are used for authenticating
+	// to the etcd cluster if non-empty.
+	Username string
+	Password string
+
+	// TLS is used for securing connections to the etcd cluster.
+	// If nil and any of the below files is set, it is built
+	// from the files.
+	TLS *tls.Config
+
+	CertFile string // client certificate
+	KeyFile  string // client certificate key
+	CAFile   string // certificate authority used to verify the cluster
+}
+
+func (conf *EtcdV3Config) tlsConfig() (*tls.Config, error) {
+	if conf.TLS != nil {
+		return conf.TLS, nil
+	}
+
+	if conf.CertFile == "" && conf.KeyFile == "" && conf.CAFile == "" {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{}
+
+	if conf.CertFile != "" || conf.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	if conf.CAFile != "" {
+		pem, err := ioutil.ReadFile(conf.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + conf.CAFile)
+		}
+
+		cfg.RootCAs = pool
+	}
+
+	return cfg, nil
+}
+
+// EtcdV3 implements the Storage interface with etcd v3 API.
+//
+// Each kite is stored under two keys: one built from all the kite fields
+// and one built from the kite ID, which points to the former. Both keys
+// are attached to a lease with KeyTTL, which is renewed on each Update,
+// so the keys of kites that stopped sending heartbeats expire on their own.
+type EtcdV3 struct {
+	client  *clientv3.Client
+	log     kite.Logger
+	timeout time.Duration
+}
+
+var _ Watcher = (*EtcdV3)(nil)
+
+// NewEtcdV3Storage gives new etcd v3 storage. It panics if the client
+// cannot be created.
+func NewEtcdV3Storage(conf *EtcdV3Config, log kite.Logger) *EtcdV3 {
+	if conf == nil {
+		conf = &EtcdV3Config{}
+	}
+
+	endpoints := conf.Endpoints
+	if len(endpoints) == 0 {
+		endpoints = []string{"127.0.0.1:2379"}
+	}
+
+	dialTimeout := conf.DialTimeout
+	if dialTimeout == 0 {
+		dialTimeout = 5 * time.Second
+	}
+
+	timeout := conf.RequestTimeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+
+	tlsConfig, err := conf.tlsConfig()
+	if err != nil {
+		panic("cannot read etcd TLS configuration: " + err.Error())
+	}
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   endpoints,
+		DialTimeout: dialTimeout,
+		Username:    conf.Username,
+		Password:    conf.Password,
+		TLS:         tlsConfig,
+	})
+	if err != nil {
+		panic("cannot connect to etcd cluster: " + strings.Join(endpoints, ","))
+	}
+
+	return &EtcdV3{
+		client:  client,
+		log:     log,
+		timeout: timeout,
+	}
+}
+
+// Close closes the etcd client.
+func (e *EtcdV3) Close() error {
+	return e.client.Close()
+}
+
+func (e *EtcdV3) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), e.timeout)
+}
+
+func (e *EtcdV3) Delete(k *protocol.Kite) error {
+	ctx, cancel := e.context()
+	defer cancel()
+
+	_, err := e.client.Txn(ctx).Then(
+		clientv3.OpDelete(KitesPrefix+k.String()),
+		clientv3.OpDelete(KitesPrefix+"/"+k.ID),
+	).Commit()
+
+	return err
+}
+
+// Clear deletes all the kites.
+func (e *EtcdV3) Clear() error {
+	ctx, cancel := e.context()
+	defer cancel()
+
+	_, err := e.client.Delete(ctx, KitesPrefix+"/", clientv3.WithPrefix())
+	return err
+}
+
+func (e *EtcdV3) Upsert(k *protocol.Kite, value *kontrolprotocol.RegisterValue) error {
+	return e.Add(k, value)
+}
+
+func (e *EtcdV3) Add(k *protocol.Kite, value *kontrolprotocol.RegisterValue) error {
+	valueBytes, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := e.context()
+	defer cancel()
+
+	lease, err := e.client.Grant(ctx, int64(KeyTTL/time.Second))
+	if err != nil {
+		return err
+	}
+
+	return e.put(ctx, k, string(valueBytes), lease.ID)
+}
+
+func (e *EtcdV3) Update(k *protocol.Kite, value *kontrolprotocol.RegisterValue) error {
+	valueBytes, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := e.context()
+	defer cancel()
+
+	resp, err := e.client.Get(ctx, KitesPrefix+k.String())
+	if err != nil {
+		return err
+	}
+
+	// The key has expired or was never added.
+	if len(resp.Kvs) == 0 || resp.Kvs[0].Lease == 0 {
+		return e.Add(k, value)
+	}
+
+	lease := clientv3.LeaseID(resp.Kvs[0].Lease)
+
+	if _, err := e.client.KeepAliveOnce(ctx, lease); err != nil {
+		if err == context.DeadlineExceeded {
+			return err
+		}
+
+		// The lease has expired in the meantime.
+		return e.Add(k, value)
+	}
+
+	return e.put(ctx, k, string(valueBytes), lease)
+}
+
+// put stores the kite keys, attaching them to the given lease.
+func (e *EtcdV3) put(ctx context.Context, k *protocol.Kite, value string, lease clientv3.LeaseID) error {
+	key := KitesPrefix + k.String()
+
+	// Example "/kites/koding/production/os/0.0.1/sj/kontainer1.sj.koding.com/1234asdf..."
+	// and "/kites/1234asdf..." for easy lookup by ID.
+	_, err := e.client.Txn(ctx).Then(
+		clientv3.OpPut(key, value, clientv3.WithLease(lease)),
+		clientv3.OpPut(KitesPrefix+"/"+k.ID, key, clientv3.WithLease(lease)),
+	).Commit()
+
+	return err
+}
+
+func (e *EtcdV3) Get(query *protocol.KontrolQuery) (Kites, error) {
+	ctx, cancel := e.context()
+	defer cancel()
+
+	key, err := e.etcdKey(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	// If version field contains a constraint we need no make a new query up to
+	// "name" field and filter the results after getting all versions.
+	var hasVersionConstraint bool // does query contains a constraint on version?
+	var keyRest string            // query key after the version field
+	var versionConstraint version.Constraints
+	_, err = version.NewVersion(query.Version)
+	if err != nil && query.Version != "" {
+		versionConstraint, err = version.NewConstraint(query.Version)
+		if err != nil {
+			return nil, err
+		}
+
+		hasVersionConstraint = true
+		nameQuery := &protocol.KontrolQuery{
+			Username:    query.Username,
+			Environment: query.Environment,
+			Name:        query.Name,
+		}
+		key, _ = GetQueryKey(nameQuery)
+
+		keyRest = "/" + strings.TrimRight(
+			query.Region+"/"+query.Hostname+"/"+query.ID, "/")
+	}
+
+	key = KitesPrefix + key
+
+	// A query with all the fields gives a single kite, other queries
+	// match a subtree. Trailing slash ensures "/kites/user/env/math"
+	// does not match "/kites/user/env/mathworker" kites.
+	resp, err := e.client.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp.Kvs) == 0 {
+		resp, err = e.client.Get(ctx, key+"/", clientv3.WithPrefix())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	kites := make(Kites, 0, len(resp.Kvs))
+
+	for _, kv := range resp.Kvs {
+		kite, err := kiteFromKV(string(kv.Key), kv.Value)
+		if err != nil {
+			return nil, err
+		}
+
+		kites = append(kites, kite)
+	}
+
+	if hasVersionConstraint {
+		kites.Filter(versionConstraint, keyRest)
+	}
+
+	kites.Shuffle()
+
+	return kites, nil
+}
+
+func (e *EtcdV3) etcdKey(ctx context.Context, query *protocol.KontrolQuery) (string, error) {
+	if onlyIDQuery(query) {
+		resp, err := e.client.Get(ctx, KitesPrefix+"/"+query.ID)
+		if err != nil {
+			return "", err
+		}
+
+		if len(resp.Kvs) == 0 {
+			return "", errors.New("kite not found")
+		}
+
+		return strings.TrimPrefix(string(resp.Kvs[0].Value), KitesPrefix), nil
+	}
+
+	return GetQueryKey(query)
+}
+
+// Revision gives the current revision of the etcd cluster.
+func (e *EtcdV3) Revision() (int64, error) {
+	ctx, cancel := e.context()
+	defer cancel()
+
+	resp, err := e.client.Get(ctx, KitesPrefix, clientv3.WithCountOnly())
+	if err != nil {
+		return 0, err
+	}
+
+	return resp.Header.Revision, nil
+}
+
+// Watch watches changes of kites that match the given query. The returned
+// channel is closed when ctx is done or the watch fails.
+//
+// Version constraints are not supported by Watch.
+func (e *EtcdV3) Watch(ctx context.Context, query *protocol.KontrolQuery) (<-chan *Event, error) {
+	return e.WatchFrom(ctx, query, 0)
+}
+
+// WatchFrom is like Watch, but it starts with the changes made after the
+// given revision. Kites are also filtered by the labels of the query.
+//
+// If the revision was already compacted, the returned channel is closed
+// and the kites need to be listed again.
+func (e *EtcdV3) WatchFrom(ctx context.Context, query *protocol.KontrolQuery, revision int64) (<-chan *Event, error) {
+	key, err := GetQueryKey(query)
+	if err != nil {
+		return nil, err
+	}
+
+	key = KitesPrefix + key
+
+	opts := []clientv3.OpOption{clientv3.WithPrefix(), clientv3.WithPrevKV()}
+	if revision > 0 {
+		opts = append(opts, clientv3.WithRev(revision+1))
+	}
+
+	events := make(chan *Event)
+	w := e.client.Watch(clientv3.WithRequireLeader(ctx), key, opts...)
+
+	go func() {
+		defer close(events)
+
+		for resp := range w {
+			if err := resp.Err(); err != nil {
+				e.log.Error("etcd watch of %q failed: %s", key, err)
+				return
+			}
+
+			for _, ev := range resp.Events {
+				kv, action := ev.Kv, "register"
+
+				if ev.Type == clientv3.EventTypeDelete {
+					if ev.PrevKv == nil {
+						continue
+					}
+
+					kv, action = ev.PrevKv, "deregister"
+				}
+
+				kite, err := kiteFromKV(string(kv.Key), kv.Value)
+				if err != nil {
+					// Ignore ID lookup keys.
+					continue
+				}
+
+				if !query.MatchLabels(kite.Labels) {
+					continue
+				}
+
+				event := &Event{
+					Action:   action,
+					Kite:     kite,
+					Revision: ev.Kv.ModRevision,
+				}
+
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return events, nil
+}
+
+// kiteFromKV builds a kite from its etcd key and value.
+func kiteFromKV(key string, value []byte) (*protocol.KiteWithToken, error) {
+	kite, err := kiteFromKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var rv kontrolprotocol.RegisterValue
+	if err := json.Unmarshal(value, &rv); err != nil {
+		return nil, err
+	}
+
+	return &protocol.KiteWithToken{
+		Kite:   *kite,
+		URL:    rv.URL,
+		URLs:   rv.URLs,
+		KeyID:  rv.KeyID,
+		Labels: rv.Labels,
+		Weight: rv.Weight,
+	}, nil
+}
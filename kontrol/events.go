@@ -0,0 +1,184 @@
+package kontrol
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/koding/kite"
+	"github.com/koding/kite/dnode"
+	kontrolprotocol "github.com/koding/kite/kontrol/protocol"
+	"github.com/koding/kite/protocol"
+	uuid "github.com/satori/go.uuid"
+)
+
+// EventQueueSize is the number of registration events that are queued
+// for publishing, events are dropped when the queue is full.
+var EventQueueSize = 1024
+
+// EventPublisher publishes registration events to external systems,
+// e.g. a message queue.
+type EventPublisher interface {
+	Publish(ev *protocol.RegistrationEvent) error
+}
+
+// EventPublisherFunc is an adapter to allow the use of ordinary functions
+// as EventPublisher.
+type EventPublisherFunc func(ev *protocol.RegistrationEvent) error
+
+// Publish calls fn(ev).
+func (fn EventPublisherFunc) Publish(ev *protocol.RegistrationEvent) error {
+	return fn(ev)
+}
+
+// NewSubjectPublisher gives a publisher, which publishes JSON encoded
+// events to subjects named after the prefix and the lowercased event
+// action, e.g. "kontrol.events.register". The signature of the publish
+// func matches the one of (*nats.Conn).Publish:
+//
+//	nc, err := nats.Connect(nats.DefaultURL)
+//	...
+//	k.Publisher = kontrol.NewSubjectPublisher("kontrol.events", nc.Publish)
+//
+// For publishing to Kafka, the publish func writes a message with the
+// subject as its topic.
+func NewSubjectPublisher(prefix string, publish func(subject string, data []byte) error) EventPublisher {
+	return EventPublisherFunc(func(ev *protocol.RegistrationEvent) error {
+		p, err := json.Marshal(ev)
+		if err != nil {
+			return err
+		}
+
+		return publish(prefix+"."+strings.ToLower(string(ev.Action)), p)
+	})
+}
+
+// subscriber is a subscription started with "subscribe".
+type subscriber struct {
+	client   *kite.Client
+	query    *protocol.KontrolQuery
+	callback dnode.Function
+}
+
+func (s *subscriber) match(ev *protocol.RegistrationEvent) bool {
+	if s.query == nil {
+		return true
+	}
+
+	return matchQuery(&ev.Kite, s.query, nil) && s.query.MatchLabels(ev.Labels)
+}
+
+// emit queues the registration event for publishing.
+func (k *Kontrol) emit(action protocol.KiteAction, kite *protocol.Kite, value *kontrolprotocol.RegisterValue) {
+	ev := &protocol.RegistrationEvent{
+		Action: action,
+		Kite:   *kite,
+		Time:   time.Now().UTC(),
+	}
+
+	if value != nil {
+		ev.URL = value.URL
+		ev.URLs = value.URLs
+		ev.Labels = value.Labels
+		ev.Weight = value.Weight
+	}
+
+	select {
+	case k.events <- ev:
+	default:
+		k.log.Warning("event queue is full, dropping %s event of %s", action, kite)
+	}
+}
+
+// publishEvents sends queued registration events to the subscribers
+// and the publisher until the Kontrol is closed.
+func (k *Kontrol) publishEvents() {
+	for {
+		select {
+		case <-k.closed:
+			return
+		case ev := <-k.events:
+			k.subscribersMu.Lock()
+			subscribers := make([]*subscriber, 0, len(k.subscribers))
+			for _, s := range k.subscribers {
+				if s.match(ev) {
+					subscribers = append(subscribers, s)
+				}
+			}
+			k.subscribersMu.Unlock()
+
+			for _, s := range subscribers {
+				if err := s.callback.Call(ev); err != nil {
+					k.log.Warning("unable to send registration event: %s", err)
+				}
+			}
+
+			if k.Publisher != nil {
+				if err := k.Publisher.Publish(ev); err != nil {
+					k.log.Error("unable to publish %s event of %s: %s", ev.Action, &ev.Kite, err)
+				}
+			}
+		}
+	}
+}
+
+// HandleSubscribe calls the callback of the caller with registration events
+// of kites matching the query, until the caller disconnects or calls
+// "unsubscribe" with the returned subscription ID.
+//
+// Only events of kites registering to this Kontrol are sent, to get
+// all the events of Kontrols sharing a storage, subscribe to all of them.
+func (k *Kontrol) HandleSubscribe(r *kite.Request) (interface{}, error) {
+	var args protocol.SubscribeArgs
+
+	if err := r.Args.One().Unmarshal(&args); err != nil {
+		return nil, err
+	}
+
+	if !args.Callback.IsValid() {
+		return nil, errors.New("callback is not a function")
+	}
+
+	id := uuid.NewV4().String()
+
+	k.subscribersMu.Lock()
+	if k.subscribers == nil {
+		k.subscribers = make(map[string]*subscriber)
+	}
+	k.subscribers[id] = &subscriber{
+		client:   r.Client,
+		query:    args.Query,
+		callback: args.Callback,
+	}
+	k.subscribersMu.Unlock()
+
+	r.Client.OnDisconnect(func() {
+		k.subscribersMu.Lock()
+		delete(k.subscribers, id)
+		k.subscribersMu.Unlock()
+	})
+
+	return id, nil
+}
+
+// HandleUnsubscribe cancels the subscription started by the caller with
+// "subscribe". It expects the subscription ID as the argument.
+func (k *Kontrol) HandleUnsubscribe(r *kite.Request) (interface{}, error) {
+	id, err := r.Args.One().String()
+	if err != nil {
+		return nil, err
+	}
+
+	k.subscribersMu.Lock()
+	defer k.subscribersMu.Unlock()
+
+	s, ok := k.subscribers[id]
+	if !ok || s.client != r.Client {
+		return nil, errors.New("subscription not found")
+	}
+
+	delete(k.subscribers, id)
+
+	return nil, nil
+}
@@ -0,0 +1,143 @@
+package kontrol
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/koding/kite"
+	"github.com/koding/kite/config"
+	"github.com/koding/kite/dnode"
+	"github.com/koding/kite/protocol"
+	"github.com/koding/kite/testkeys"
+	"github.com/koding/kite/testutil"
+)
+
+func TestSubjectPublisher(t *testing.T) {
+	var subject string
+	var ev protocol.RegistrationEvent
+
+	p := NewSubjectPublisher("kontrol.events", func(s string, data []byte) error {
+		subject = s
+		return json.Unmarshal(data, &ev)
+	})
+
+	want := &protocol.RegistrationEvent{
+		Action: protocol.Expire,
+		Kite:   protocol.Kite{Username: "testuser", Name: "mathworker", ID: "1"},
+		URL:    "http://localhost:3636/kite",
+	}
+
+	if err := p.Publish(want); err != nil {
+		t.Fatalf("Publish()=%s", err)
+	}
+
+	if subject != "kontrol.events.expire" {
+		t.Fatalf("got %q, want %q", subject, "kontrol.events.expire")
+	}
+
+	if ev.Action != want.Action || ev.Kite != want.Kite || ev.URL != want.URL {
+		t.Fatalf("got %+v, want %+v", &ev, want)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	conf := config.New()
+	conf.Username = "testuser"
+	conf.Environment = "events"
+	conf.Port = 5513
+	conf.KontrolURL = fmt.Sprintf("http://localhost:%d/kite", conf.Port)
+	conf.KontrolKey = testkeys.Public
+	conf.KontrolUser = "testuser"
+	conf.KiteKey = testutil.NewToken("testuser", testkeys.Private, testkeys.Public).Raw
+
+	published := make(chan *protocol.RegistrationEvent, 16)
+
+	kon := New(conf.Copy(), "1.0.0")
+	kon.SetStorage(newMemStorage())
+	kon.AddKeyPair("events", testkeys.Public, testkeys.Private)
+	kon.Publisher = EventPublisherFunc(func(ev *protocol.RegistrationEvent) error {
+		published <- ev
+		return nil
+	})
+
+	go kon.Run()
+	<-kon.Kite.ServerReadyNotify()
+	defer kon.Close()
+
+	c := kite.New("inventory", "1.0.0")
+	c.Config = conf.Copy()
+	defer c.Close()
+
+	sub := c.NewClient(conf.KontrolURL)
+	sub.Auth = &kite.Auth{Type: "kiteKey", Key: conf.KiteKey}
+
+	if err := sub.Dial(); err != nil {
+		t.Fatalf("Dial()=%s", err)
+	}
+	defer sub.Close()
+
+	events := make(chan *protocol.RegistrationEvent, 16)
+
+	args := &protocol.SubscribeArgs{
+		Query: &protocol.KontrolQuery{
+			Username:    "testuser",
+			Environment: "events",
+			Name:        "subscribed",
+		},
+		Callback: dnode.Callback(func(args *dnode.Partial) {
+			var ev protocol.RegistrationEvent
+			if err := args.One().Unmarshal(&ev); err != nil {
+				t.Errorf("Unmarshal()=%s", err)
+				return
+			}
+			events <- &ev
+		}),
+	}
+
+	if _, err := sub.TellWithTimeout("subscribe", 4*time.Second, args); err != nil {
+		t.Fatalf("subscribe: %s", err)
+	}
+
+	for _, name := range []string{"unsubscribed", "subscribed"} {
+		k := kite.New(name, "1.0.0")
+		k.Config = conf.Copy()
+		k.Config.Port = 0
+
+		go k.Run()
+		<-k.ServerReadyNotify()
+		defer k.Close()
+
+		u := &url.URL{Scheme: "http", Host: fmt.Sprintf("127.0.0.1:%d", k.Port()), Path: "/kite"}
+
+		if err := k.RegisterForever(u); err != nil {
+			t.Fatalf("RegisterForever()=%s", err)
+		}
+	}
+
+	select {
+	case ev := <-events:
+		if ev.Action != protocol.Register || ev.Kite.Name != "subscribed" {
+			t.Fatalf("got %+v, want register event of the subscribed kite", ev)
+		}
+	case <-time.After(15 * time.Second):
+		t.Fatal("timed out waiting for the register event")
+	}
+
+	// The publisher gets events of all kites.
+	names := make(map[string]bool)
+	timeout := time.After(15 * time.Second)
+
+	for len(names) != 2 {
+		select {
+		case ev := <-published:
+			if ev.Action == protocol.Register && ev.Kite.Environment == "events" {
+				names[ev.Kite.Name] = true
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for published events, got %v", names)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package kontrol
+
+import (
+	"sync"
+
+	"github.com/koding/kite"
+	"github.com/koding/kite/protocol"
+)
+
+// peer is a Kontrol of another region, see AddPeer.
+type peer struct {
+	region string
+	url    string
+
+	mu     sync.Mutex
+	client *kite.Client
+}
+
+// AddPeer federates the Kontrol with the one of another region running
+// under the given URL. Queries of callers asking for kites of all regions
+// (see kite.GetFederatedKites) are forwarded to the peers, unless the query
+// selects a region other than the peer's one.
+//
+// Kites registered to the Kontrol come first in the results, followed by
+// the ones of the peers in the order the peers were added. Tokens for kites
+// of the peers are issued by the Kontrol, so federated Kontrols must share
+// their key pairs, e.g. by using the same KeyPairStorage. The Kontrol
+// authenticates to the peers with its kite key.
+func (k *Kontrol) AddPeer(region, url string) {
+	k.peersMu.Lock()
+	k.peers = append(k.peers, &peer{
+		region: region,
+		url:    url,
+	})
+	k.peersMu.Unlock()
+}
+
+// peersFor gives the peers, which may have kites of the given region.
+func (k *Kontrol) peersFor(region string) []*peer {
+	k.peersMu.Lock()
+	defer k.peersMu.Unlock()
+
+	if region != "" && region == k.Kite.Config.Region {
+		return nil
+	}
+
+	var peers []*peer
+
+	for _, p := range k.peers {
+		if region == "" || p.region == region {
+			peers = append(peers, p)
+		}
+	}
+
+	return peers
+}
+
+// peerKites gives the kites matching the query, which are registered
+// to the peers. Peers that fail to respond are skipped.
+func (k *Kontrol) peerKites(query *protocol.KontrolQuery) Kites {
+	peers := k.peersFor(query.Region)
+	if len(peers) == 0 {
+		return nil
+	}
+
+	results := make([]Kites, len(peers))
+
+	var wg sync.WaitGroup
+
+	for i, p := range peers {
+		wg.Add(1)
+
+		go func(i int, p *peer) {
+			defer wg.Done()
+
+			kites, err := p.getKites(k, query)
+			if err != nil {
+				k.log.Warning("getting kites of %q region from %s failed: %s", p.region, p.url, err)
+				return
+			}
+
+			results[i] = kites
+		}(i, p)
+	}
+
+	wg.Wait()
+
+	var kites Kites
+
+	for _, res := range results {
+		kites = append(kites, res...)
+	}
+
+	return kites
+}
+
+// federatedKites gives the kites of the peers matching the query along
+// with tokens for the caller, bound to its proof key.
+func (k *Kontrol) federatedKites(r *kite.Request, query *protocol.KontrolQuery, proofKey string) Kites {
+	var kites Kites
+
+	for _, kite := range k.peerKites(query) {
+		if k.Kite.IsRevoked("", kite.Kite.ID) {
+			continue
+		}
+
+		token, err := k.kiteToken(r, query, kite.KeyID, proofKey)
+		if err != nil {
+			k.log.Warning("generating token for %q kite failed: %s", kite.Kite.ID, err)
+			continue
+		}
+
+		kite.Token = token
+		kites = append(kites, kite)
+	}
+
+	return kites
+}
+
+// getKites queries the peer for the kites.
+func (p *peer) getKites(k *Kontrol, query *protocol.KontrolQuery) (Kites, error) {
+	c, err := p.dial(k)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := c.TellWithTimeout("getKites", k.Kite.Config.Timeout, &protocol.GetKitesArgs{
+		Query: query,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var result protocol.GetKitesResult
+	if err := res.Unmarshal(&result); err != nil {
+		return nil, err
+	}
+
+	return result.Kites, nil
+}
+
+// dial gives a client connected to the peer.
+func (p *peer) dial(k *Kontrol) (*kite.Client, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.client != nil {
+		return p.client, nil
+	}
+
+	c := k.Kite.NewClient(p.url)
+	c.Kite = protocol.Kite{Name: "kontrol", Region: p.region} // for logging purposes
+	c.Auth = &kite.Auth{
+		Type: "kiteKey",
+		Key:  k.Kite.KiteKey(),
+	}
+	c.Reconnect = true
+
+	if err := c.DialTimeout(k.Kite.Config.Timeout); err != nil {
+		return nil, err
+	}
+
+	p.client = c
+
+	return c, nil
+}
+
+// closePeers closes connections to the peers.
+func (k *Kontrol) closePeers() {
+	k.peersMu.Lock()
+	defer k.peersMu.Unlock()
+
+	for _, p := range k.peers {
+		p.mu.Lock()
+		if p.client != nil {
+			p.client.Close()
+			p.client = nil
+		}
+		p.mu.Unlock()
+	}
+}
@@ -0,0 +1,200 @@
+package kontrol
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/koding/kite"
+	"github.com/koding/kite/config"
+	kontrolprotocol "github.com/koding/kite/kontrol/protocol"
+	"github.com/koding/kite/protocol"
+	"github.com/koding/kite/testkeys"
+	"github.com/koding/kite/testutil"
+)
+
+// memStorage is a Storage keeping kites in memory.
+type memStorage struct {
+	mu    sync.Mutex
+	kites map[string]*protocol.KiteWithToken
+}
+
+var _ Storage = (*memStorage)(nil)
+
+func newMemStorage() *memStorage {
+	return &memStorage{
+		kites: make(map[string]*protocol.KiteWithToken),
+	}
+}
+
+func (m *memStorage) Get(query *protocol.KontrolQuery) (Kites, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var kites Kites
+
+	for _, kite := range m.kites {
+		if matchQuery(&kite.Kite, query, nil) {
+			copy := *kite
+			kites = append(kites, &copy)
+		}
+	}
+
+	return kites, nil
+}
+
+func (m *memStorage) Add(kite *protocol.Kite, value *kontrolprotocol.RegisterValue) error {
+	return m.Upsert(kite, value)
+}
+
+func (m *memStorage) Update(kite *protocol.Kite, value *kontrolprotocol.RegisterValue) error {
+	return m.Upsert(kite, value)
+}
+
+func (m *memStorage) Delete(kite *protocol.Kite) error {
+	m.mu.Lock()
+	delete(m.kites, kite.ID)
+	m.mu.Unlock()
+
+	return nil
+}
+
+func (m *memStorage) Upsert(kite *protocol.Kite, value *kontrolprotocol.RegisterValue) error {
+	m.mu.Lock()
+	m.kites[kite.ID] = &protocol.KiteWithToken{
+		Kite:   *kite,
+		URL:    value.URL,
+		KeyID:  value.KeyID,
+		Labels: value.Labels,
+	}
+	m.mu.Unlock()
+
+	return nil
+}
+
+func TestFederation(t *testing.T) {
+	regions := []string{"eu", "us"}
+	confs := make(map[string]*config.Config)
+	kontrols := make(map[string]*Kontrol)
+
+	for i, region := range regions {
+		conf := config.New()
+		conf.Username = "testuser"
+		conf.Environment = "federation"
+		conf.Region = region
+		conf.Port = 5510 + i
+		conf.KontrolURL = fmt.Sprintf("http://localhost:%d/kite", conf.Port)
+		conf.KontrolKey = testkeys.Public
+		conf.KontrolUser = "testuser"
+		conf.KiteKey = testutil.NewToken("testuser", testkeys.Private, testkeys.Public).Raw
+
+		kon := New(conf.Copy(), "1.0.0")
+		kon.SetStorage(newMemStorage())
+		kon.AddKeyPair("federation", testkeys.Public, testkeys.Private)
+
+		go kon.Run()
+		<-kon.Kite.ServerReadyNotify()
+		defer kon.Close()
+
+		confs[region] = conf
+		kontrols[region] = kon
+	}
+
+	kontrols["eu"].AddPeer("us", confs["us"].KontrolURL)
+	kontrols["us"].AddPeer("eu", confs["eu"].KontrolURL)
+
+	for _, region := range regions {
+		k := kite.New("federated", "1.0.0")
+		k.Config = confs[region].Copy()
+		k.Config.Port = 0
+
+		k.HandleFunc("region", func(r *kite.Request) (interface{}, error) {
+			return r.LocalKite.Config.Region, nil
+		})
+
+		go k.Run()
+		<-k.ServerReadyNotify()
+		defer k.Close()
+
+		registered := make(chan struct{}, 1)
+		k.OnRegister(func(*protocol.RegisterResult) {
+			select {
+			case registered <- struct{}{}:
+			default:
+			}
+		})
+
+		u := &url.URL{Scheme: "http", Host: fmt.Sprintf("127.0.0.1:%d", k.Port()), Path: "/kite"}
+
+		if err := k.RegisterForever(u); err != nil {
+			t.Fatalf("RegisterForever()=%s", err)
+		}
+
+		select {
+		case <-registered:
+		case <-time.After(15 * time.Second):
+			t.Fatalf("timed out waiting for the kite to register in %q region", region)
+		}
+	}
+
+	c := kite.New("exp", "1.0.0")
+	c.Config = confs["eu"].Copy()
+	defer c.Close()
+
+	query := &protocol.KontrolQuery{
+		Username:    "testuser",
+		Environment: "federation",
+		Name:        "federated",
+	}
+
+	kites, err := c.GetKites(query)
+	if err != nil {
+		t.Fatalf("GetKites()=%s", err)
+	}
+	klose(kites)
+
+	if len(kites) != 1 {
+		t.Fatalf("got %d kites, want the one of the local region", len(kites))
+	}
+
+	kites, err = c.GetFederatedKites(query)
+	if err != nil {
+		t.Fatalf("GetFederatedKites()=%s", err)
+	}
+	defer klose(kites)
+
+	if len(kites) != 2 {
+		t.Fatalf("got %d kites, want 2", len(kites))
+	}
+
+	// Kites of the local region come first, tokens of the other
+	// regions' ones are accepted by them.
+	for i, region := range regions {
+		if err := kites[i].Dial(); err != nil {
+			t.Fatalf("Dial()=%s", err)
+		}
+
+		res, err := kites[i].TellWithTimeout("region", 4*time.Second)
+		if err != nil {
+			t.Fatalf("TellWithTimeout()=%s", err)
+		}
+
+		if got := res.MustString(); got != region {
+			t.Fatalf("got %q, want %q", got, region)
+		}
+	}
+
+	query.Region = "us"
+
+	kites, err = c.GetFederatedKites(query)
+	if err != nil {
+		t.Fatalf("GetFederatedKites()=%s", err)
+	}
+	defer klose(kites)
+
+	if len(kites) != 1 || kites[0].Kite.Region != "us" {
+		t.Fatalf("got %d kites, want the one of the us region", len(kites))
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"net/url"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -26,7 +27,10 @@ func (k *Kontrol) HandleRegister(r *kite.Request) (interface{}, error) {
 	}
 
 	var args struct {
-		URL string `json:"url"`
+		URL    string            `json:"url"`
+		URLs   []string          `json:"urls"`
+		Labels map[string]string `json:"labels"`
+		Weight int               `json:"weight"`
 	}
 
 	if err := r.Args.One().Unmarshal(&args); err != nil {
@@ -41,6 +45,10 @@ func (k *Kontrol) HandleRegister(r *kite.Request) (interface{}, error) {
 		return nil, fmt.Errorf("invalid register URL: %s", err)
 	}
 
+	if args.Weight < 0 {
+		return nil, errors.New("negative weight")
+	}
+
 	res := &protocol.RegisterResult{
 		URL: args.URL,
 	}
@@ -70,13 +78,18 @@ func (k *Kontrol) HandleRegister(r *kite.Request) (interface{}, error) {
 		res.PublicKey = keyPair.Public
 	}
 
+	res.Keys = k.trustedKeys()
+
 	if err := validateKiteKey(&r.Client.Kite); err != nil {
 		return nil, err
 	}
 
 	value := &kontrolprotocol.RegisterValue{
-		URL:   args.URL,
-		KeyID: keyPair.ID,
+		URL:    args.URL,
+		URLs:   args.URLs,
+		KeyID:  keyPair.ID,
+		Labels: args.Labels,
+		Weight: args.Weight,
 	}
 
 	// Register first by adding the value to the storage. Return if there is
@@ -86,6 +99,8 @@ func (k *Kontrol) HandleRegister(r *kite.Request) (interface{}, error) {
 		return nil, errors.New("internal error - register")
 	}
 
+	k.emit(protocol.Register, &r.Client.Kite, value)
+
 	every := onceevery.New(UpdateInterval)
 
 	ping := make(chan struct{}, 1)
@@ -93,11 +108,24 @@ func (k *Kontrol) HandleRegister(r *kite.Request) (interface{}, error) {
 
 	kiteCopy := r.Client.Kite
 
+	// Deregistering the kite stops the updater and disconnects the kite.
+	stopped := make(chan struct{})
+	var stopOnce sync.Once
+	c := r.Client
+
+	reg := k.addRegistration(&kiteCopy, "kite", c, func() {
+		stopOnce.Do(func() { close(stopped) })
+	}, func() {
+		c.Close()
+	})
+
 	updaterFunc := func() {
 		for {
 			select {
 			case <-k.closed:
 				return
+			case <-stopped:
+				return
 			case <-ping:
 				k.log.Debug("Kite is active, got a ping %s", &kiteCopy)
 				every.Do(func() {
@@ -108,8 +136,16 @@ func (k *Kontrol) HandleRegister(r *kite.Request) (interface{}, error) {
 					}
 				})
 			case <-time.After(HeartbeatInterval + HeartbeatDelay):
+				// The kite has registered again over a new connection,
+				// e.g. after it was restarted, so it has not expired.
+				if r := k.registration(kiteCopy.ID); r != nil && r != reg {
+					k.log.Debug("Kite registered again %s.", &kiteCopy)
+					return
+				}
+
 				k.log.Debug("Kite didn't sent any heartbeat %s.", &kiteCopy)
 				atomic.StoreInt32(&closed, 1)
+				k.emit(protocol.Expire, &kiteCopy, value)
 				return
 			}
 		}
@@ -122,6 +158,14 @@ func (k *Kontrol) HandleRegister(r *kite.Request) (interface{}, error) {
 		dnode.Callback(func(args *dnode.Partial) {
 			k.log.Debug("Kite send us an heartbeat. %s", &kiteCopy)
 
+			select {
+			case <-stopped:
+				return
+			default:
+			}
+
+			reg.beat()
+
 			k.clientLocks.Get(kiteCopy.ID).Lock()
 			defer k.clientLocks.Get(kiteCopy.ID).Unlock()
 
@@ -137,7 +181,9 @@ func (k *Kontrol) HandleRegister(r *kite.Request) (interface{}, error) {
 				// it might be removed because the ttl cleaner would come
 				// before us, so try to add it again, the updater will than
 				// continue to update it afterwards.
-				k.storage.Upsert(&kiteCopy, value)
+				if err := k.storage.Upsert(&kiteCopy, value); err == nil {
+					k.emit(protocol.Register, &kiteCopy, value)
+				}
 				go updaterFunc()
 			}
 		}),
@@ -158,6 +204,7 @@ func (k *Kontrol) HandleRegister(r *kite.Request) (interface{}, error) {
 
 	r.Client.OnDisconnect(func() {
 		k.log.Info("Kite disconnected: %s", clientKite)
+		k.removeRegistration(reg)
 	})
 
 	return res, nil
@@ -170,28 +217,79 @@ func (k *Kontrol) HandleGetKites(r *kite.Request) (interface{}, error) {
 		return nil, err
 	}
 
-	// Get kites from the storage
-	kites, err := k.storage.Get(args.Query)
-	if err != nil {
-		return nil, err
+	// The caller wants to be notified about changes of kites, see watchKites.
+	var w Watcher
+	var revision int64
+
+	if args.WatchCallback.IsValid() {
+		var ok bool
+		if w, ok = k.storage.(Watcher); !ok {
+			return nil, errors.New("storage does not support watching kites")
+		}
+
+		if revision = args.Since; revision == 0 {
+			var err error
+			if revision, err = w.Revision(); err != nil {
+				return nil, err
+			}
+		}
 	}
 
-	for _, kite := range kites {
-		keyPair, err := k.getOrUpdateKeyID(kite.KeyID, r)
+	kites := make(Kites, 0)
+
+	// Kites are not listed again when the caller resumes the watch.
+	if w == nil || args.Since == 0 {
+		var err error
+		if kites, err = k.getKites(r, args.Query, args.ProofKey); err != nil {
+			return nil, err
+		}
+
+		if args.Federated {
+			kites = append(kites, k.federatedKites(r, args.Query, args.ProofKey)...)
+		}
+	}
+
+	res := &protocol.GetKitesResult{
+		Kites:    kites,
+		Revision: revision,
+	}
+
+	if w != nil {
+		id, err := k.watchKites(r, &args, w, revision)
 		if err != nil {
 			return nil, err
 		}
 
-		tok := &token{
-			audience: getAudience(args.Query),
-			username: r.Username,
-			issuer:   k.Kite.Kite().Username,
-			keyPair:  keyPair,
+		res.WatcherID = id
+	}
+
+	return res, nil
+}
+
+// getKites gives the kites matching the query along with tokens
+// for the caller, bound to its proof key.
+func (k *Kontrol) getKites(r *kite.Request, query *protocol.KontrolQuery, proofKey string) (Kites, error) {
+	// Get kites from the storage
+	kites, err := k.storage.Get(query)
+	if err != nil {
+		return nil, err
+	}
+
+	// Skip kites with revoked kite keys and the ones
+	// not matching the label selector.
+	n := 0
+	for _, kite := range kites {
+		if !k.Kite.IsRevoked("", kite.Kite.ID) && query.MatchLabels(kite.Labels) {
+			kites[n] = kite
+			n++
 		}
+	}
+	kites = kites[:n]
 
+	for _, kite := range kites {
 		// Generate token once here because we are using the same token for every
 		// kite we return and generating many tokens is really slow.
-		token, err := k.generateToken(tok)
+		token, err := k.kiteToken(r, query, kite.KeyID, proofKey)
 		if err != nil {
 			return nil, err
 		}
@@ -199,9 +297,26 @@ func (k *Kontrol) HandleGetKites(r *kite.Request) (interface{}, error) {
 		kite.Token = token
 	}
 
-	return &protocol.GetKitesResult{
-		Kites: kites,
-	}, nil
+	return kites, nil
+}
+
+// kiteToken generates a token for the caller to authenticate to kites,
+// which registered with the key pair of the given ID. The token is bound
+// to the proof key of the caller, if it sent one.
+func (k *Kontrol) kiteToken(r *kite.Request, query *protocol.KontrolQuery, keyID, proofKey string) (string, error) {
+	keyPair, err := k.getOrUpdateKeyID(keyID, r)
+	if err != nil {
+		return "", err
+	}
+
+	return k.generateToken(&token{
+		audience: getAudience(query),
+		username: r.Username,
+		issuer:   k.Kite.Kite().Username,
+		keyPair:  keyPair,
+		proofKey: proofKey,
+		kiteID:   r.KiteID,
+	})
 }
 
 func (k *Kontrol) HandleGetToken(r *kite.Request) (interface{}, error) {
@@ -221,6 +336,15 @@ func (k *Kontrol) HandleGetToken(r *kite.Request) (interface{}, error) {
 		return nil, errors.New("query matches more than one kite")
 	}
 
+	// The kite may be registered to a peer, see AddPeer.
+	if len(kites) == 0 {
+		kites = k.peerKites(&args.KontrolQuery)
+	}
+
+	if len(kites) > 1 {
+		return nil, errors.New("query matches more than one kite")
+	}
+
 	if len(kites) == 0 {
 		return nil, errors.New("no kites found")
 	}
@@ -237,6 +361,8 @@ func (k *Kontrol) HandleGetToken(r *kite.Request) (interface{}, error) {
 		username: r.Username,
 		issuer:   k.Kite.Kite().Username,
 		keyPair:  keyPair,
+		proofKey: args.ProofKey,
+		kiteID:   r.KiteID,
 		force:    args.Force,
 	})
 }
@@ -351,14 +477,7 @@ func (k *Kontrol) updateKeyWithKeyPair(t *jwt.Token, keyPair *KeyPair) string {
 		claims.KontrolKey = keyPair.Public
 	}
 
-	rsaPrivate, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(keyPair.Private))
-	if err != nil {
-		k.log.Error("key update error for %q: %s", claims.Subject, err)
-
-		return ""
-	}
-
-	kiteKey, err := t.SignedString(rsaPrivate)
+	kiteKey, err := kitekey.Sign(claims, keyPair.Private)
 	if err != nil {
 		k.log.Error("key update error for %q: %s", claims.Subject, err)
 
@@ -372,8 +491,15 @@ func (k *Kontrol) getOrUpdateKeyPub(pub string, t *jwt.Token, r *kite.Request) (
 	var kiteKey string
 
 	kp, err := k.keyPair.GetKeyFromPublic(pub)
-	if err == ErrKeyDeleted {
+	switch {
+	case err == ErrKeyDeleted:
 		kp, kiteKey = k.updateKey(t)
+	case err == nil && k.isRetiring(kp.ID):
+		// The key pair was rotated, re-issue the kite key with
+		// the current one while the old one is still valid.
+		if cur, curKiteKey := k.updateKey(t); curKiteKey != "" {
+			kp, kiteKey = cur, curKiteKey
+		}
 	}
 
 	if kp == nil {
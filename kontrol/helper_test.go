@@ -14,6 +14,8 @@ import (
 	"github.com/koding/kite/config"
 	"github.com/koding/kite/protocol"
 	"github.com/koding/kite/testutil"
+
+	"github.com/redis/go-redis/v9"
 )
 
 var interactive = os.Getenv("TEST_INTERACTIVE") == "1"
@@ -59,10 +61,16 @@ func startKontrol(pem, pub string, port int) (*Kontrol, *Config) {
 	switch os.Getenv("KONTROL_STORAGE") {
 	case "etcd":
 		kon.SetStorage(NewEtcd(nil, kon.Kite.Log))
+	case "etcdv3":
+		kon.SetStorage(NewEtcdV3Storage(nil, kon.Kite.Log))
+	case "consul":
+		kon.SetStorage(NewConsul(nil, kon.Kite.Log))
 	case "postgres":
 		p := NewPostgres(nil, kon.Kite.Log)
 		kon.SetStorage(p)
 		kon.SetKeyPairStorage(p)
+	case "redis":
+		kon.SetStorage(NewRedis(redis.NewClient(&redis.Options{Addr: "127.0.0.1:6379"}), nil, kon.Kite.Log))
 	default:
 		kon.SetStorage(NewEtcd(nil, kon.Kite.Log))
 	}
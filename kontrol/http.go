@@ -34,6 +34,10 @@ func (k *Kontrol) HandleHeartbeat(rw http.ResponseWriter, req *http.Request) {
 		// so the key is being deleted automatically via the TTL mechanism.
 		h.timer.Reset(HeartbeatInterval + HeartbeatDelay)
 
+		if reg := k.registration(id); reg != nil {
+			reg.beat()
+		}
+
 		k.log.Debug("Sending pong '%s'", id)
 		rw.Write([]byte("pong"))
 		return
@@ -75,6 +79,12 @@ func (k *Kontrol) HandleRegisterHTTP(rw http.ResponseWriter, req *http.Request)
 		return
 	}
 
+	if args.Weight < 0 {
+		err := errors.New("negative weight")
+		http.Error(rw, jsonError(err), http.StatusBadRequest)
+		return
+	}
+
 	// decode and authenticated the token key. We'll get the authenticated
 	// username
 	username, err := k.Kite.AuthenticateSimpleKiteKey(args.Auth.Key)
@@ -122,6 +132,8 @@ func (k *Kontrol) HandleRegisterHTTP(rw http.ResponseWriter, req *http.Request)
 		resp.PublicKey = keyPair.Public
 	}
 
+	resp.Keys = k.trustedKeys()
+
 	remoteKite := args.Kite
 
 	// Be sure we have a valid Kite representation. We should not allow someone
@@ -133,8 +145,11 @@ func (k *Kontrol) HandleRegisterHTTP(rw http.ResponseWriter, req *http.Request)
 
 	// This will be stored into the final storage
 	value := &kontrolprotocol.RegisterValue{
-		URL:   args.URL,
-		KeyID: keyPair.ID,
+		URL:    args.URL,
+		URLs:   args.URLs,
+		KeyID:  keyPair.ID,
+		Labels: args.Labels,
+		Weight: args.Weight,
 	}
 
 	// Register first by adding the value to the storage. Return if there is
@@ -145,6 +160,8 @@ func (k *Kontrol) HandleRegisterHTTP(rw http.ResponseWriter, req *http.Request)
 		return
 	}
 
+	k.emit(protocol.Register, remoteKite, value)
+
 	k.heartbeatsMu.Lock()
 	defer k.heartbeatsMu.Unlock()
 
@@ -155,6 +172,10 @@ func (k *Kontrol) HandleRegisterHTTP(rw http.ResponseWriter, req *http.Request)
 
 		h.timer.Reset(HeartbeatInterval + HeartbeatDelay)
 
+		if reg := k.registration(remoteKite.ID); reg != nil {
+			reg.beat()
+		}
+
 		// update registerURL of the previously started heartbeat goroutine
 		// so it does not get overwritten back to the old value
 		h.updateC <- func() error {
@@ -197,12 +218,9 @@ func (k *Kontrol) HandleRegisterHTTP(rw http.ResponseWriter, req *http.Request)
 			}
 		}()
 
-		// we are now creating a timer that is going to call the function which
-		// stops the background updater if it's not resetted. The time is being
-		// resetted on a separate HTTP endpoint "/heartbeat"
-		h.timer = time.AfterFunc(HeartbeatInterval+HeartbeatDelay, func() {
-			k.log.Info("Kite didn't sent any heartbeat (via HTTP). Stopping the updater %s", remoteKite)
+		var reg *registration
 
+		stop := func() {
 			// stop the updater so it doesn't update it in the background
 			updater.Stop()
 
@@ -215,10 +233,30 @@ func (k *Kontrol) HandleRegisterHTTP(rw http.ResponseWriter, req *http.Request)
 				close(h.updateC)
 			}
 
-			delete(k.heartbeats, remoteKite.ID)
+			if k.heartbeats[remoteKite.ID] == h {
+				delete(k.heartbeats, remoteKite.ID)
+			}
+		}
+
+		// we are now creating a timer that is going to call the function which
+		// stops the background updater if it's not resetted. The time is being
+		// resetted on a separate HTTP endpoint "/heartbeat"
+		h.timer = time.AfterFunc(HeartbeatInterval+HeartbeatDelay, func() {
+			k.log.Info("Kite didn't sent any heartbeat (via HTTP). Stopping the updater %s", remoteKite)
+
+			stop()
+			k.removeRegistration(reg)
+			k.emit(protocol.Expire, remoteKite, value)
 		})
 
 		k.heartbeats[remoteKite.ID] = h
+
+		// Deregistering the kite stops the updater, the kite is told
+		// to register again on its next heartbeat.
+		reg = k.addRegistration(remoteKite, "http", nil, func() {
+			h.timer.Stop()
+			stop()
+		}, func() {})
 	}
 
 	k.log.Info("Kite registered (via HTTP): %s", remoteKite)
@@ -3,6 +3,7 @@ package kontrol
 import (
 	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/koding/cache"
@@ -36,6 +37,29 @@ func (k *KeyPair) Validate() error {
 	return nil
 }
 
+// KeyRotation is the state of the key pairs rotated with RotateKeyPair.
+type KeyRotation struct {
+	// Current is the ID of the key pair used to sign new kite keys.
+	Current string
+
+	// Retire maps IDs of the replaced key pairs to the time
+	// they are deleted at.
+	Retire map[string]time.Time
+}
+
+func (kr *KeyRotation) copy() *KeyRotation {
+	c := &KeyRotation{
+		Current: kr.Current,
+		Retire:  make(map[string]time.Time, len(kr.Retire)),
+	}
+
+	for id, t := range kr.Retire {
+		c.Retire[id] = t
+	}
+
+	return c
+}
+
 // KeyPairStorage is responsible of managing key pairs
 type KeyPairStorage interface {
 	// AddKey adds the given key pair to the storage
@@ -61,6 +85,14 @@ type KeyPairStorage interface {
 	// that it was deleted, the returned error is of *DeletedKeyPairError
 	// type.
 	IsValid(publicKey string) error
+
+	// SetKeyRotation stores the state of the key pair rotation,
+	// replacing the one stored before.
+	SetKeyRotation(*KeyRotation) error
+
+	// GetKeyRotation retrieves the state of the key pair rotation,
+	// which is empty if the key pairs were never rotated.
+	GetKeyRotation() (*KeyRotation, error)
 }
 
 func NewMemKeyPairStorage() *MemKeyPairStorage {
@@ -80,6 +112,9 @@ func NewMemKeyPairStorageTTL(ttl time.Duration) *MemKeyPairStorage {
 type MemKeyPairStorage struct {
 	id     cache.Cache
 	public cache.Cache
+
+	mu       sync.Mutex
+	rotation *KeyRotation
 }
 
 func (m *MemKeyPairStorage) AddKey(keyPair *KeyPair) error {
@@ -139,6 +174,25 @@ func (m *MemKeyPairStorage) IsValid(public string) error {
 	return err
 }
 
+func (m *MemKeyPairStorage) SetKeyRotation(rotation *KeyRotation) error {
+	m.mu.Lock()
+	m.rotation = rotation.copy()
+	m.mu.Unlock()
+
+	return nil
+}
+
+func (m *MemKeyPairStorage) GetKeyRotation() (*KeyRotation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.rotation == nil {
+		return &KeyRotation{}, nil
+	}
+
+	return m.rotation.copy(), nil
+}
+
 // CachedStorage caches the requests that are going to backend and tries to
 // lower the load on the backend
 type CachedStorage struct {
@@ -215,3 +269,13 @@ func (m *CachedStorage) IsValid(public string) error {
 
 	return m.backend.IsValid(public)
 }
+
+// SetKeyRotation stores the rotation state in the backend only,
+// which is shared by Kontrols using the same storage.
+func (m *CachedStorage) SetKeyRotation(rotation *KeyRotation) error {
+	return m.backend.SetKeyRotation(rotation)
+}
+
+func (m *CachedStorage) GetKeyRotation() (*KeyRotation, error) {
+	return m.backend.GetKeyRotation()
+}
@@ -13,8 +13,10 @@ import (
 	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/koding/kite"
 	"github.com/koding/kite/config"
+	"github.com/koding/kite/dnode"
 	"github.com/koding/kite/kitekey"
 	kontrolprotocol "github.com/koding/kite/kontrol/protocol"
+	"github.com/koding/kite/protocol"
 	uuid "github.com/satori/go.uuid"
 )
 
@@ -84,6 +86,10 @@ type Kontrol struct {
 	// TokenNoNBF when true does not set nbf field for generated JWT tokens.
 	TokenNoNBF bool
 
+	// Publisher, if set, publishes registration events of kites,
+	// along with sending them to subscribers of the "subscribe" method.
+	Publisher EventPublisher
+
 	clientLocks *IdLock
 
 	heartbeats   map[string]*heartbeat
@@ -110,6 +116,45 @@ type Kontrol struct {
 	// selfKeyPair is a key pair used to sign Kontrol's kite key.
 	selfKeyPair *KeyPair
 
+	// retiring holds timers that delete key pairs replaced with
+	// RotateKeyPair once their grace period is over, by key pair ID
+	retiring map[string]*time.Timer
+
+	// keysMu protects lastIDs, lastPublic, lastPrivate, selfKeyPair
+	// and retiring fields
+	keysMu sync.Mutex
+
+	// rotationMu serializes updates of the key rotation state
+	// kept in the key pair storage
+	rotationMu sync.Mutex
+
+	// revocations issued with Revoke, ordered by their versions;
+	// the versions start over with a new epoch when Kontrol restarts
+	revocations        []revocation
+	revocationsVersion int64
+	revocationsEpoch   string
+	revocationWatchers map[*kite.Client]dnode.Function
+	revocationsMu      sync.Mutex // protects revocation* fields
+
+	// watchers are watches of kites started with "getKites", by their IDs
+	watchers   map[string]*kiteWatch
+	watchersMu sync.Mutex
+
+	// peers are Kontrols of other regions, see AddPeer
+	peers   []*peer
+	peersMu sync.Mutex
+
+	// registrations are kites registered to the Kontrol, by their IDs
+	registrations   map[string]*registration
+	registrationsMu sync.Mutex
+
+	// events are registration events queued for publishing
+	events chan *protocol.RegistrationEvent
+
+	// subscribers are subscriptions started with "subscribe", by their IDs
+	subscribers   map[string]*subscriber
+	subscribersMu sync.Mutex
+
 	// RegisterURL defines the URL that is used to self register when adding
 	// itself to the storage backend
 	RegisterURL string
@@ -126,12 +171,20 @@ type heartbeat struct {
 // instance, and the default kontrol handlers. Publickey is used for
 // validating tokens and privateKey is used for signing tokens.
 //
-// Public and private keys are RSA pem blocks that can be generated with the
-// following command:
+// Public and private keys are RSA, ECDSA or Ed25519 pem blocks that can be
+// generated with the following command:
 //
 //     openssl genrsa -out testkey.pem 2048
 //     openssl rsa -in testkey.pem -pubout > testkey_pub.pem
 //
+// or, for ES256 signed tokens:
+//
+//     openssl ecparam -name prime256v1 -genkey -noout -out testkey.pem
+//     openssl ec -in testkey.pem -pubout > testkey_pub.pem
+//
+// The signing algorithm is chosen by the type of the private key,
+// see kitekey.SigningMethod.
+//
 // If you need to provide custom handlers in place of the default ones,
 // use the following command instead:
 //
@@ -141,13 +194,27 @@ func New(conf *config.Config, version string) *Kontrol {
 	kontrol := NewWithoutHandlers(conf, version)
 
 	kontrol.Kite.HandleFunc("register", kontrol.HandleRegister)
+	kontrol.Kite.HandleFunc("deregister", kontrol.HandleDeregister)
 	kontrol.Kite.HandleFunc("registerMachine", kontrol.HandleMachine).DisableAuthentication()
 	kontrol.Kite.HandleFunc("getKites", kontrol.HandleGetKites)
 	kontrol.Kite.HandleFunc("getToken", kontrol.HandleGetToken)
 	kontrol.Kite.HandleFunc("getKey", kontrol.HandleGetKey)
+	kontrol.Kite.HandleFunc("getKeys", kontrol.HandleGetKeys)
+	kontrol.Kite.HandleFunc("getRevocations", kontrol.HandleGetRevocations)
+	kontrol.Kite.HandleFunc("cancelWatcher", kontrol.HandleCancelWatcher)
+	kontrol.Kite.HandleFunc("subscribe", kontrol.HandleSubscribe)
+	kontrol.Kite.HandleFunc("unsubscribe", kontrol.HandleUnsubscribe)
+
+	admin := kontrol.Kite.Group("admin").RequireScope(kite.ScopeAdmin)
+	admin.HandleFunc("listKites", kontrol.HandleAdminListKites)
+	admin.HandleFunc("heartbeats", kontrol.HandleAdminHeartbeats)
+	admin.HandleFunc("deregister", kontrol.HandleAdminDeregister)
+	admin.HandleFunc("getKeys", kontrol.HandleAdminGetKeys)
 
 	kontrol.Kite.HandleHTTPFunc("/register", kontrol.HandleRegisterHTTP)
 	kontrol.Kite.HandleHTTPFunc("/heartbeat", kontrol.HandleHeartbeat)
+	kontrol.Kite.HandleHTTPFunc("/admin", kontrol.HandleAdmin)
+	kontrol.Kite.HandleHTTPFunc("/admin/methods/{name}", kontrol.HandleAdmin)
 
 	return kontrol
 }
@@ -160,19 +227,39 @@ func New(conf *config.Config, version string) *Kontrol {
 //
 //     kontrol := NewWithoutHandlers(conf, version)
 //     kontrol.Kite.HandleFunc("register", kontrol.HandleRegister)
+//     kontrol.Kite.HandleFunc("deregister", kontrol.HandleDeregister)
 //     kontrol.Kite.HandleFunc("registerMachine", kontrol.HandleMachine).DisableAuthentication()
 //     kontrol.Kite.HandleFunc("getKites", kontrol.HandleGetKites)
 //     kontrol.Kite.HandleFunc("getToken", kontrol.HandleGetToken)
 //     kontrol.Kite.HandleFunc("getKey", kontrol.HandleGetKey)
+//     kontrol.Kite.HandleFunc("getKeys", kontrol.HandleGetKeys)
+//     kontrol.Kite.HandleFunc("getRevocations", kontrol.HandleGetRevocations)
+//     kontrol.Kite.HandleFunc("cancelWatcher", kontrol.HandleCancelWatcher)
+//     kontrol.Kite.HandleFunc("subscribe", kontrol.HandleSubscribe)
+//     kontrol.Kite.HandleFunc("unsubscribe", kontrol.HandleUnsubscribe)
 //     kontrol.Kite.HandleHTTPFunc("/heartbeat", kontrol.HandleHeartbeat)
 //     kontrol.Kite.HandleHTTPFunc("/register", kontrol.HandleRegisterHTTP)
 //
+// The admin methods, which require the kite.ScopeAdmin scope, and the
+// admin web UI are registered with:
+//
+//     admin := kontrol.Kite.Group("admin").RequireScope(kite.ScopeAdmin)
+//     admin.HandleFunc("listKites", kontrol.HandleAdminListKites)
+//     admin.HandleFunc("heartbeats", kontrol.HandleAdminHeartbeats)
+//     admin.HandleFunc("deregister", kontrol.HandleAdminDeregister)
+//     admin.HandleFunc("getKeys", kontrol.HandleAdminGetKeys)
+//     kontrol.Kite.HandleHTTPFunc("/admin", kontrol.HandleAdmin)
+//     kontrol.Kite.HandleHTTPFunc("/admin/methods/{name}", kontrol.HandleAdmin)
+//
 func NewWithoutHandlers(conf *config.Config, version string) *Kontrol {
 	k := &Kontrol{
 		clientLocks: NewIdlock(),
 		heartbeats:  make(map[string]*heartbeat),
 		closed:      make(chan struct{}),
 		tokenCache:  make(map[string]cachedToken),
+		events:      make(chan *protocol.RegistrationEvent, EventQueueSize),
+
+		revocationsEpoch: uuid.NewV4().String(),
 	}
 
 	// Make a copy to not modify user-provided value.
@@ -192,6 +279,8 @@ func NewWithoutHandlers(conf *config.Config, version string) *Kontrol {
 	k.Kite = kite.NewWithConfig("kontrol", version, conf)
 	k.log = k.Kite.Log
 
+	k.Kite.OnSecrets(k.addSecretKeyPairs)
+
 	return k
 }
 
@@ -249,6 +338,9 @@ func (k *Kontrol) DeleteKeyPair(id, public string) error {
 		return err
 	}
 
+	k.keysMu.Lock()
+	defer k.keysMu.Unlock()
+
 	deleteIndex := -1
 	for i, p := range k.lastPublic {
 		if p == pair.Public {
@@ -297,9 +389,11 @@ func (k *Kontrol) AddKeyPair(id, public, private string) error {
 	}
 
 	// set last set key pair
+	k.keysMu.Lock()
 	k.lastIDs = append(k.lastIDs, id)
 	k.lastPublic = append(k.lastPublic, public)
 	k.lastPrivate = append(k.lastPrivate, private)
+	k.keysMu.Unlock()
 
 	if err := keyPair.Validate(); err != nil {
 		return err
@@ -320,8 +414,19 @@ func (k *Kontrol) Run() {
 		k.keyPair = NewMemKeyPairStorage()
 	}
 
+	// The key pairs from the secrets are needed for registering.
+	if err := k.Kite.LoadSecrets(); err != nil {
+		k.log.Fatal("%s", err)
+	}
+
+	// Pick up key pairs rotated before Kontrol restarted.
+	if err := k.restoreRotation(); err != nil {
+		k.log.Error("unable to restore rotated key pairs: %s", err)
+	}
+
 	// now go and register ourself
 	go k.registerSelf()
+	go k.publishEvents()
 
 	k.Kite.Run()
 }
@@ -341,16 +446,28 @@ func (k *Kontrol) SetKeyPairStorage(storage KeyPairStorage) {
 // Close stops kontrol and closes all connections
 func (k *Kontrol) Close() {
 	close(k.closed)
+
+	k.keysMu.Lock()
+	for _, t := range k.retiring {
+		t.Stop()
+	}
+	k.keysMu.Unlock()
+
+	k.closePeers()
 	k.Kite.Close()
 }
 
 // InitializeSelf registers his host by writing a key to ~/.kite/kite.key
 func (k *Kontrol) InitializeSelf() error {
+	k.keysMu.Lock()
 	if len(k.lastPublic) == 0 && len(k.lastPrivate) == 0 {
+		k.keysMu.Unlock()
 		return errors.New("Please initialize AddKeyPair() method")
 	}
+	public, private := k.lastPublic[0], k.lastPrivate[0]
+	k.keysMu.Unlock()
 
-	key, err := k.registerUser(k.Kite.Config.Username, k.lastPublic[0], k.lastPrivate[0])
+	key, err := k.registerUser(k.Kite.Config.Username, public, private)
 	if err != nil {
 		return err
 	}
@@ -369,14 +486,14 @@ func (k *Kontrol) registerUser(username, publicKey, privateKey string) (kiteKey
 		KontrolKey: strings.TrimSpace(publicKey),
 	}
 
-	rsaPrivate, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(privateKey))
+	kiteKey, err = kitekey.Sign(claims, privateKey)
 	if err != nil {
 		return "", err
 	}
 
 	k.Kite.Log.Info("Registered machine on user: %s", username)
 
-	return jwt.NewWithClaims(jwt.GetSigningMethod("RS256"), claims).SignedString(rsaPrivate)
+	return kiteKey, nil
 }
 
 // registerSelf adds Kontrol itself to the storage as a kite.
@@ -440,8 +557,12 @@ func (k *Kontrol) registerSelf() {
 
 // KeyPair looks up a key pair that was used to sign Kontrol's kite key.
 //
-// The value is cached on first call of the function.
+// The value is cached on first call of the function. After the key pairs
+// are rotated with RotateKeyPair, the new key pair is returned instead.
 func (k *Kontrol) KeyPair() (pair *KeyPair, err error) {
+	k.keysMu.Lock()
+	defer k.keysMu.Unlock()
+
 	if k.selfKeyPair != nil {
 		return k.selfKeyPair, nil
 	}
@@ -460,11 +581,16 @@ func (k *Kontrol) KeyPair() (pair *KeyPair, err error) {
 		ri := len(k.lastPublic) - i - 1
 
 		keyFn := func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
-				return nil, errors.New("invalid signing method")
+			key, err := kitekey.ParsePublicKey(k.lastPublic[ri])
+			if err != nil {
+				return nil, err
+			}
+
+			if err := kitekey.VerifyMethod(token, key); err != nil {
+				return nil, err
 			}
 
-			return jwt.ParseRSAPublicKeyFromPEM([]byte(k.lastPublic[ri]))
+			return key, nil
 		}
 
 		if _, err := jwt.ParseWithClaims(kiteKey, &kitekey.KiteClaims{}, keyFn); err != nil {
@@ -510,6 +636,8 @@ type token struct {
 	username string
 	issuer   string
 	keyPair  *KeyPair
+	proofKey string
+	kiteID   string
 	force    bool
 }
 
@@ -519,7 +647,7 @@ type cachedToken struct {
 }
 
 func (t *token) String() string {
-	return t.audience + t.username + t.issuer + t.keyPair.ID
+	return t.audience + t.username + t.issuer + t.keyPair.ID + t.proofKey + t.kiteID
 }
 
 // cacheToken cached the signed token under the given key.
@@ -557,11 +685,6 @@ func (k *Kontrol) generateToken(tok *token) (string, error) {
 		}
 	}
 
-	rsaPrivate, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(tok.keyPair.Private))
-	if err != nil {
-		return "", err
-	}
-
 	now := time.Now().UTC()
 
 	claims := &kitekey.KiteClaims{
@@ -573,13 +696,15 @@ func (k *Kontrol) generateToken(tok *token) (string, error) {
 			IssuedAt:  now.Add(-k.tokenLeeway()).UTC().Unix(),
 			Id:        uuid.NewV4().String(),
 		},
+		ProofKey: tok.proofKey,
+		KiteID:   tok.kiteID,
 	}
 
 	if !k.TokenNoNBF {
 		claims.NotBefore = now.Add(-k.tokenLeeway()).Unix()
 	}
 
-	signed, err := jwt.NewWithClaims(jwt.GetSigningMethod("RS256"), claims).SignedString(rsaPrivate)
+	signed, err := kitekey.Sign(claims, tok.keyPair.Private)
 	if err != nil {
 		return "", errors.New("Server error: Cannot generate a token")
 	}
@@ -12,6 +12,7 @@ import (
 	"github.com/koding/kite/config"
 	"github.com/koding/kite/kontrol"
 	"github.com/koding/multiconfig"
+	"github.com/redis/go-redis/v9"
 )
 
 type Kontrol struct {
@@ -39,6 +40,28 @@ type Kontrol struct {
 		DBName         string
 		ConnectTimeout int `default:"20"`
 	}
+
+	EtcdV3 struct {
+		Username string
+		Password string
+		CertFile string
+		KeyFile  string
+		CAFile   string
+	}
+
+	Consul struct {
+		Address    string `default:"127.0.0.1:8500"`
+		Scheme     string `default:"http"`
+		Datacenter string
+		Token      string
+	}
+
+	Redis struct {
+		Address  string `default:"127.0.0.1:6379"`
+		Password string
+		DB       int
+		Prefix   string
+	}
 }
 
 func main() {
@@ -83,6 +106,34 @@ func main() {
 	switch os.Getenv("KONTROL_STORAGE") {
 	case "etcd":
 		k.SetStorage(kontrol.NewEtcd(conf.Machines, k.Kite.Log))
+	case "etcdv3":
+		etcdConf := &kontrol.EtcdV3Config{
+			Endpoints: conf.Machines,
+			Username:  conf.EtcdV3.Username,
+			Password:  conf.EtcdV3.Password,
+			CertFile:  conf.EtcdV3.CertFile,
+			KeyFile:   conf.EtcdV3.KeyFile,
+			CAFile:    conf.EtcdV3.CAFile,
+		}
+
+		k.SetStorage(kontrol.NewEtcdV3Storage(etcdConf, k.Kite.Log))
+	case "consul":
+		consulConf := &kontrol.ConsulConfig{
+			Address:    conf.Consul.Address,
+			Scheme:     conf.Consul.Scheme,
+			Datacenter: conf.Consul.Datacenter,
+			Token:      conf.Consul.Token,
+		}
+
+		k.SetStorage(kontrol.NewConsul(consulConf, k.Kite.Log))
+	case "redis":
+		client := redis.NewClient(&redis.Options{
+			Addr:     conf.Redis.Address,
+			Password: conf.Redis.Password,
+			DB:       conf.Redis.DB,
+		})
+
+		k.SetStorage(kontrol.NewRedis(client, &kontrol.RedisConfig{Prefix: conf.Redis.Prefix}, k.Kite.Log))
 	case "postgres":
 		postgresConf := &kontrol.PostgresConfig{
 			Host:     conf.Postgres.Host,
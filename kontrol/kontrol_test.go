@@ -7,6 +7,7 @@ import (
 	"net"
 	"net/url"
 	"os"
+	"reflect"
 	"runtime"
 	"strconv"
 	"strings"
@@ -16,6 +17,7 @@ import (
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/koding/kite"
+	"github.com/koding/kite/config"
 	"github.com/koding/kite/kitekey"
 	"github.com/koding/kite/protocol"
 	"github.com/koding/kite/testkeys"
@@ -36,7 +38,7 @@ func init() {
 
 func TestUpdateKeys(t *testing.T) {
 	if storage := os.Getenv("KONTROL_STORAGE"); storage != "postgres" {
-		t.Skip("skipping TestUpdateKeys for storage %q: not implemented", storage)
+		t.Skipf("skipping TestUpdateKeys for storage %q: not implemented", storage)
 	}
 
 	kon, conf := startKontrol(testkeys.PrivateThird, testkeys.PublicThird, 5501)
@@ -661,7 +663,7 @@ func TestGetQueryKey(t *testing.T) {
 
 func TestKontrolMultiKey(t *testing.T) {
 	if storage := os.Getenv("KONTROL_STORAGE"); storage != "postgres" {
-		t.Skip("%q storage does not currently implement soft key pair deletes", storage)
+		t.Skipf("%q storage does not currently implement soft key pair deletes", storage)
 	}
 
 	i := uuid.NewV4()
@@ -772,3 +774,132 @@ func TestKontrolMultiKey(t *testing.T) {
 			testkeys.Public, publicKey)
 	}
 }
+
+func TestRotateKeyPair(t *testing.T) {
+	kon, conf := startKontrol(testkeys.PrivateThird, testkeys.PublicThird, 5502)
+	defer kon.Close()
+
+	hk, err := NewHelloKite("kite1", conf)
+	if err != nil {
+		t.Fatalf("error creating kite1: %s", err)
+	}
+	defer hk.Close()
+
+	if err := kon.RotateKeyPair("", testkeys.PublicSecond, testkeys.PrivateSecond, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := hk.Kite.GetKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{strings.TrimSpace(testkeys.PublicSecond), strings.TrimSpace(testkeys.PublicThird)}
+
+	if keys.Current != want[0] {
+		t.Fatalf("got %q current key, want %q", keys.Current, want[0])
+	}
+
+	if !reflect.DeepEqual(keys.Keys, want) {
+		t.Fatalf("got %v keys, want %v", keys.Keys, want)
+	}
+
+	// The kite key is re-issued with the current key pair.
+	if _, err := hk.Kite.Register(hk.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	reg, err := hk.WaitRegister(15 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reg.KiteKey == "" {
+		t.Fatal("expected kite key to be re-issued")
+	}
+
+	if key := hk.Kite.Config.KontrolKey; key != want[0] {
+		t.Fatalf("got %q kontrol key, want %q", key, want[0])
+	}
+}
+
+func TestRotateKeyPair_Restore(t *testing.T) {
+	storage := NewMemKeyPairStorage()
+
+	newKontrol := func() *Kontrol {
+		kon := New(config.New(), "1.0.0")
+		kon.SetKeyPairStorage(storage)
+		return kon
+	}
+
+	k := newKontrol()
+	defer k.Close()
+
+	if err := k.AddKeyPair("first", testkeys.PublicThird, testkeys.PrivateThird); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := k.RotateKeyPair("second", testkeys.PublicSecond, testkeys.PrivateSecond, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	// A restarted Kontrol picks up the rotation from the storage.
+	restarted := newKontrol()
+	defer restarted.Close()
+
+	if err := restarted.restoreRotation(); err != nil {
+		t.Fatal(err)
+	}
+
+	kp, err := restarted.KeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if kp.ID != "second" {
+		t.Fatalf("got %q current key pair, want %q", kp.ID, "second")
+	}
+
+	if !restarted.isRetiring("first") || restarted.isRetiring("second") {
+		t.Fatal("want only the first key pair to be retiring")
+	}
+
+	rotation, err := storage.GetKeyRotation()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if deadline := rotation.Retire["first"]; time.Until(deadline) <= 0 || time.Until(deadline) > time.Hour {
+		t.Fatalf("got %s deadline, want it within an hour", deadline)
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	hk, err := NewHelloKite("kite1", conf)
+	if err != nil {
+		t.Fatalf("error creating kite1: %s", err)
+	}
+	defer hk.Close()
+
+	if err := hk.Kite.WatchRevocations(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := kon.Revoke(&protocol.Revocation{KiteID: "compromised"}); err != nil {
+		t.Fatal(err)
+	}
+
+	timeout := time.After(10 * time.Second)
+
+	for !hk.Kite.IsRevoked("", "compromised") {
+		select {
+		case <-timeout:
+			t.Fatal("timed out waiting for revocation")
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	if err := kon.Revoke(&protocol.Revocation{}); err == nil {
+		t.Fatal("expected empty revocation to fail")
+	}
+}
@@ -5,9 +5,9 @@ import (
 	"fmt"
 	"strings"
 
-	etcd "github.com/coreos/etcd/client"
 	kontrolprotocol "github.com/koding/kite/kontrol/protocol"
 	"github.com/koding/kite/protocol"
+	etcd "go.etcd.io/etcd/client/v2"
 )
 
 // Node is a wrapper around an etcd node to provide additional
@@ -58,19 +58,26 @@ func (n *Node) Kite() (*protocol.KiteWithToken, error) {
 	}
 
 	return &protocol.KiteWithToken{
-		Kite:  *kite,
-		URL:   val.URL,
-		KeyID: val.KeyID,
+		Kite:   *kite,
+		URL:    val.URL,
+		URLs:   val.URLs,
+		KeyID:  val.KeyID,
+		Labels: val.Labels,
+		Weight: val.Weight,
 	}, nil
 }
 
 // KiteFromKey returns a *protocol.Kite from an etcd key. etcd key is like:
 // "/kites/devrim/env/mathworker/1/localhost/tardis.local/id"
 func (n *Node) KiteFromKey() (*protocol.Kite, error) {
+	return kiteFromKey(n.Node.Key)
+}
+
+func kiteFromKey(key string) (*protocol.Kite, error) {
 	// TODO replace "kites" with KitesPrefix constant
-	fields := strings.Split(strings.TrimPrefix(n.Node.Key, "/"), "/")
+	fields := strings.Split(strings.TrimPrefix(key, "/"), "/")
 	if len(fields) != 8 || (len(fields) > 0 && fields[0] != "kites") {
-		return nil, fmt.Errorf("kontrol: invalid kite %s", n.Node.Key)
+		return nil, fmt.Errorf("kontrol: invalid kite %s", key)
 	}
 
 	return &protocol.Kite{
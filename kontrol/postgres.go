@@ -1,15 +1,18 @@
 package kontrol
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 
+	sq "github.com/Masterminds/squirrel"
 	"github.com/hashicorp/go-version"
-	sq "github.com/lann/squirrel"
 	"github.com/lib/pq"
 
 	"github.com/koding/kite"
@@ -31,15 +34,58 @@ type PostgresConfig struct {
 	Password       string
 	DBName         string `required:"true" `
 	ConnectTimeout int    `default:"20"`
+
+	// MaxEvents is the number of the latest changes of kites
+	// kept for resuming watches.
+	MaxEvents int `default:"10000"`
 }
 
+const (
+	// postgresEventChannel is the channel notified about changes of kites.
+	postgresEventChannel = "kite_event"
+
+	// postgresEventLock is the key of the advisory lock held while
+	// recording a change of kites, so the changes are committed
+	// in the order of their revisions.
+	postgresEventLock = 0x6b697465
+
+	// postgresPartitionInterval is the range of updated_at
+	// covered by a single partition of kite.kite.
+	postgresPartitionInterval = 10 * time.Minute
+
+	// postgresPartitionsAhead is the number of partitions created
+	// ahead for the kites updated in the future.
+	postgresPartitionsAhead = 3
+)
+
+// Postgres implements the Storage, Watcher and KeyPairStorage
+// interfaces with PostgreSQL 11 or newer.
+//
+// The kite.kite table is partitioned by the time the kites were updated.
+// As every update moves the kite to the latest partition, the older ones
+// hold expired kites only and are dropped by RunCleaner, instead of deleting
+// the rows, which locked the table with many kites registered. Expired kites
+// which were not cleaned yet are never returned by Get.
+//
+// The changes of kites are recorded in the kite.event table and watchers are
+// notified about them with NOTIFY on the "kite_event" channel. The expired
+// kites are sent to the watchers once their partition is dropped.
 type Postgres struct {
 	DB  *sql.DB
 	Log kite.Logger
+
+	connString string
+	maxEvents  int
+	closed     chan struct{}
+	closeOnce  sync.Once
+
+	mu       sync.Mutex
+	listener *pq.Listener
+	watchers map[chan struct{}]struct{}
 }
 
 var (
-	_ Storage        = (*Postgres)(nil)
+	_ Watcher        = (*Postgres)(nil)
 	_ KeyPairStorage = (*Postgres)(nil)
 )
 
@@ -76,9 +122,22 @@ func NewPostgres(conf *PostgresConfig, log kite.Logger) *Postgres {
 		panic(err)
 	}
 
+	maxEvents := conf.MaxEvents
+	if maxEvents == 0 {
+		maxEvents = 10000
+	}
+
 	p := &Postgres{
-		DB:  db,
-		Log: log,
+		DB:         db,
+		Log:        log,
+		connString: connString,
+		maxEvents:  maxEvents,
+		closed:     make(chan struct{}),
+	}
+
+	// The partitions need to exist before any kite is stored.
+	if err := p.CreatePartitions(); err != nil {
+		p.Log.Error("postgres: creating partitions failed: %s", err)
 	}
 
 	cleanInterval := 120 * time.Second // clean every 120 second
@@ -87,27 +146,194 @@ func NewPostgres(conf *PostgresConfig, log kite.Logger) *Postgres {
 	return p
 }
 
-// RunCleaner deletes every "interval" duration rows which are older than
-// "expire" duration based on the "updated_at" field. For more info check
-// CleanExpireRows which is used to delete old rows.
+// Close stops watching and cleaning the kites and closes the database.
+func (p *Postgres) Close() error {
+	p.closeOnce.Do(func() { close(p.closed) })
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.listener != nil {
+		p.listener.Close()
+		p.listener = nil
+	}
+
+	return p.DB.Close()
+}
+
+// RunCleaner every "interval" duration creates the partitions of kite.kite
+// for the kites updated in the near future and drops the ones with the kites
+// not updated for at least "expire" duration. It also removes the changes
+// of kites exceeding PostgresConfig.MaxEvents.
 func (p *Postgres) RunCleaner(interval, expire time.Duration) {
 	cleanFunc := func() {
-		affectedRows, err := p.CleanExpiredRows(expire)
+		if err := p.CreatePartitions(); err != nil {
+			p.Log.Warning("postgres: creating partitions failed: %s", err)
+		}
+
+		n, err := p.DropExpiredPartitions(expire)
+		if err != nil {
+			p.Log.Warning("postgres: dropping expired partitions failed: %s", err)
+		} else if n != 0 {
+			p.Log.Debug("postgres: dropped %d expired partitions", n)
+		}
+
+		if err := p.trimEvents(); err != nil {
+			p.Log.Warning("postgres: removing old events failed: %s", err)
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			cleanFunc()
+		case <-p.closed:
+			return
+		}
+	}
+}
+
+// now gives the current time of the database, which is used for
+// the updated_at field of the kites.
+func (p *Postgres) now() (time.Time, error) {
+	var now time.Time
+	err := p.DB.QueryRow(`SELECT (now() at time zone 'utc')::timestamptz`).Scan(&now)
+	return now, err
+}
+
+// CreatePartitions creates the partitions of kite.kite for the kites
+// updated now and within the next partition intervals, unless they exist.
+func (p *Postgres) CreatePartitions() error {
+	now, err := p.now()
+	if err != nil {
+		return err
+	}
+
+	start := now.UTC().Truncate(postgresPartitionInterval)
+
+	for i := 0; i <= postgresPartitionsAhead; i++ {
+		from := start.Add(time.Duration(i) * postgresPartitionInterval)
+		to := from.Add(postgresPartitionInterval)
+
+		_, err := p.DB.Exec(fmt.Sprintf(
+			`CREATE UNLOGGED TABLE IF NOT EXISTS kite.kite_%d_%d PARTITION OF kite.kite FOR VALUES FROM ('%s') TO ('%s')`,
+			from.Unix(), to.Unix(), from.Format(time.RFC3339), to.Format(time.RFC3339),
+		))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DropExpiredPartitions drops the partitions of kite.kite with the kites
+// updated at least "expire" duration ago. The dropped kites are sent to
+// the watchers as deregistered. It returns the number of dropped partitions.
+func (p *Postgres) DropExpiredPartitions(expire time.Duration) (int, error) {
+	now, err := p.now()
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := p.DB.Query(`SELECT c.relname FROM pg_catalog.pg_inherits i
+	JOIN pg_catalog.pg_class c ON c.oid = i.inhrelid
+	WHERE i.inhparent = 'kite.kite'::regclass`)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var expired []string
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return 0, err
+		}
+
+		var from, to int64
+		if _, err := fmt.Sscanf(name, "kite_%d_%d", &from, &to); err != nil {
+			continue // not managed by Kontrol
+		}
+
+		if time.Unix(to, 0).Before(now.Add(-expire)) {
+			expired = append(expired, name)
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for i, name := range expired {
+		if err := p.dropPartition(name); err != nil {
+			return i, err
+		}
+	}
+
+	return len(expired), nil
+}
+
+// dropPartition detaches the partition, so no kite is moved to it, records
+// its kites as deregistered and drops it.
+func (p *Postgres) dropPartition(name string) (err error) {
+	tx, err := p.DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
 		if err != nil {
-			p.Log.Warning("postgres: cleaning old rows failed: %s", err)
-		} else if affectedRows != 0 {
-			p.Log.Debug("postgres: cleaned up %d rows", affectedRows)
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
 		}
+	}()
+
+	if _, err = tx.Exec(`ALTER TABLE kite.kite DETACH PARTITION kite.` + name); err != nil {
+		return err
+	}
+
+	if _, err = tx.Exec(`SELECT pg_advisory_xact_lock($1)`, postgresEventLock); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`INSERT INTO kite.event (action, path, value)
+	SELECT 'deregister',
+		'/kites/' || username || '/' || environment || '/' || kitename || '/' ||
+			version || '/' || region || '/' || hostname || '/' || id,
+		json_build_object('url', url, 'key_id', key_id, 'labels', labels::json, 'urls', urls::json, 'weight', weight)::text
+	FROM kite.` + name)
+	if err != nil {
+		return err
 	}
 
-	for range time.Tick(interval) {
-		cleanFunc()
+	if _, err = tx.Exec(`DROP TABLE kite.` + name); err != nil {
+		return err
 	}
+
+	_, err = tx.Exec(`SELECT pg_notify($1, '')`, postgresEventChannel)
+	return err
+}
+
+// trimEvents removes the changes of kites exceeding PostgresConfig.MaxEvents.
+func (p *Postgres) trimEvents() error {
+	if p.maxEvents == 0 {
+		return nil
+	}
+
+	_, err := p.DB.Exec(`DELETE FROM kite.event WHERE revision <= (SELECT max(revision) FROM kite.event) - $1`, p.maxEvents)
+	return err
 }
 
 // CleanExpiredRows deletes rows that are at least "expire" duration old. So if
 // say an expire duration of 10 second is given, it will delete all rows that
-// were updated 10 seconds ago
+// were updated 10 seconds ago. The deleted kites are not sent to the watchers,
+// see DropExpiredPartitions.
 func (p *Postgres) CleanExpiredRows(expire time.Duration) (int64, error) {
 	// See: http://stackoverflow.com/questions/14465727/how-to-insert-things-like-now-interval-2-minutes-into-php-pdo-query
 	// basically by passing an integer to INTERVAL is not possible, we need to
@@ -170,53 +396,15 @@ func (p *Postgres) Get(query *protocol.KontrolQuery) (Kites, error) {
 	}
 	defer rows.Close()
 
-	var (
-		username    string
-		environment string
-		kitename    string
-		version     string
-		region      string
-		hostname    string
-		id          string
-		url         string
-		updated_at  time.Time
-		created_at  time.Time
-		keyId       string
-	)
-
 	kites := make(Kites, 0)
 
 	for rows.Next() {
-		err := rows.Scan(
-			&username,
-			&environment,
-			&kitename,
-			&version,
-			&region,
-			&hostname,
-			&id,
-			&url,
-			&updated_at,
-			&created_at,
-			&keyId,
-		)
+		kite, err := scanKite(rows)
 		if err != nil {
 			return nil, err
 		}
 
-		kites = append(kites, &protocol.KiteWithToken{
-			Kite: protocol.Kite{
-				Username:    username,
-				Environment: environment,
-				Name:        kitename,
-				Version:     version,
-				Region:      region,
-				Hostname:    hostname,
-				ID:          id,
-			},
-			URL:   url,
-			KeyID: keyId,
-		})
+		kites = append(kites, kite)
 	}
 
 	if err := rows.Err(); err != nil {
@@ -251,6 +439,16 @@ func (p *Postgres) Upsert(kiteProt *protocol.Kite, value *kontrolprotocol.Regist
 		return errors.New("postgres: keyId is empty. Aborting upsert")
 	}
 
+	labels, err := encodeJSONColumn(value.Labels, len(value.Labels))
+	if err != nil {
+		return err
+	}
+
+	urls, err := encodeJSONColumn(value.URLs, len(value.URLs))
+	if err != nil {
+		return err
+	}
+
 	// we are going to try an UPDATE, if it's not successful we are going to
 	// INSERT the document, all ine one single transaction
 	tx, err := p.DB.Begin()
@@ -260,15 +458,36 @@ func (p *Postgres) Upsert(kiteProt *protocol.Kite, value *kontrolprotocol.Regist
 
 	defer func() {
 		if err != nil {
-			err = tx.Rollback()
+			tx.Rollback()
 		} else {
 			// it calls Rollback inside if it fails again :)
 			err = tx.Commit()
 		}
 	}()
 
-	res, err := tx.Exec(`UPDATE kite.kite SET url = $1, key_id = $3, updated_at = (now() at time zone 'utc') WHERE id = $2`,
-		value.URL, kiteProt.ID, value.KeyID)
+	// The watchers are notified only if the value of the kite has changed
+	// or the kite has expired, not on every heartbeat.
+	var (
+		oldURL, oldKeyID   string
+		oldLabels, oldURLs sql.NullString
+		oldWeight          int
+	)
+
+	err = tx.QueryRow(`SELECT url, key_id, labels, urls, weight FROM kite.kite
+	WHERE id = $1 AND updated_at >= (now() at time zone 'utc') - ((INTERVAL '1 second') * $2) FOR UPDATE`,
+		kiteProt.ID, int64(KeyTTL/time.Second)).Scan(&oldURL, &oldKeyID, &oldLabels, &oldURLs, &oldWeight)
+
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return err
+	case oldURL == value.URL && oldKeyID == value.KeyID && oldLabels == labels && oldURLs == urls && oldWeight == value.Weight:
+		_, err = tx.Exec(`UPDATE kite.kite SET updated_at = (now() at time zone 'utc') WHERE id = $1`, kiteProt.ID)
+		return err
+	}
+
+	res, err := tx.Exec(`UPDATE kite.kite SET url = $1, key_id = $3, labels = $4, urls = $5, weight = $6, updated_at = (now() at time zone 'utc') WHERE id = $2`,
+		value.URL, kiteProt.ID, value.KeyID, labels, urls, value.Weight)
 	if err != nil {
 		return err
 	}
@@ -278,56 +497,417 @@ func (p *Postgres) Upsert(kiteProt *protocol.Kite, value *kontrolprotocol.Regist
 		return err
 	}
 
-	// we got an update! so this was successful, just return without an error
-	if rowAffected != 0 {
-		return nil
+	if rowAffected == 0 {
+		insertSQL, args, err := insertKiteQuery(kiteProt, value)
+		if err != nil {
+			return err
+		}
+
+		if _, err = tx.Exec(insertSQL, args...); err != nil {
+			return err
+		}
 	}
 
-	insertSQL, args, err := insertKiteQuery(kiteProt, value.URL, value.KeyID)
+	return p.addEvent(tx, "register", kiteProt, value)
+}
+
+func (p *Postgres) Add(kiteProt *protocol.Kite, value *kontrolprotocol.RegisterValue) (err error) {
+	// check that the incoming URL is valid to prevent malformed input
+	_, err = url.Parse(value.URL)
 	if err != nil {
 		return err
 	}
 
-	_, err = tx.Exec(insertSQL, args...)
-	return err
+	sqlQuery, args, err := insertKiteQuery(kiteProt, value)
+	if err != nil {
+		return err
+	}
+
+	tx, err := p.DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	if _, err = tx.Exec(sqlQuery, args...); err != nil {
+		return err
+	}
+
+	return p.addEvent(tx, "register", kiteProt, value)
 }
 
-func (p *Postgres) Add(kiteProt *protocol.Kite, value *kontrolprotocol.RegisterValue) error {
-	// check that the incoming URL is valid to prevent malformed input
-	_, err := url.Parse(value.URL)
+// Update updates the value of the kite and renews its TTL, the kite
+// is inserted if it has been already removed, see Upsert.
+func (p *Postgres) Update(kiteProt *protocol.Kite, value *kontrolprotocol.RegisterValue) error {
+	return p.Upsert(kiteProt, value)
+}
+
+func (p *Postgres) Delete(kiteProt *protocol.Kite) (err error) {
+	tx, err := p.DB.Begin()
 	if err != nil {
 		return err
 	}
 
-	sqlQuery, args, err := insertKiteQuery(kiteProt, value.URL, value.KeyID)
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	rows, err := tx.Query(`DELETE FROM kite.kite WHERE id = $1 RETURNING *`, kiteProt.ID)
 	if err != nil {
 		return err
 	}
 
-	_, err = p.DB.Exec(sqlQuery, args...)
-	return err
+	var kites Kites
+
+	for rows.Next() {
+		kite, err := scanKite(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+
+		kites = append(kites, kite)
+	}
+
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, kite := range kites {
+		value := &kontrolprotocol.RegisterValue{
+			URL:    kite.URL,
+			KeyID:  kite.KeyID,
+			Labels: kite.Labels,
+			URLs:   kite.URLs,
+			Weight: kite.Weight,
+		}
+
+		if err = p.addEvent(tx, "deregister", &kite.Kite, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
-func (p *Postgres) Update(kiteProt *protocol.Kite, value *kontrolprotocol.RegisterValue) error {
-	// check that the incoming url is valid to prevent malformed input
-	_, err := url.Parse(value.URL)
+// addEvent records the change of the kite in the kite.event table,
+// the watchers are notified about it once tx is committed.
+func (p *Postgres) addEvent(tx *sql.Tx, action string, kiteProt *protocol.Kite, value *kontrolprotocol.RegisterValue) error {
+	v, err := json.Marshal(value)
 	if err != nil {
 		return err
 	}
 
-	// TODO: also consider just using WHERE id = kiteProt.ID, see how it's
-	// performs out
-	_, err = p.DB.Exec(`UPDATE kite.kite SET url = $1, updated_at = (now() at time zone 'utc') 
-	WHERE id = $2`,
-		value.URL, kiteProt.ID)
+	// The lock is held until tx is done, so the revisions
+	// are committed in the increasing order.
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1)`, postgresEventLock); err != nil {
+		return err
+	}
 
+	_, err = tx.Exec(`INSERT INTO kite.event (action, path, value) VALUES ($1, $2, $3)`,
+		action, KitesPrefix+kiteProt.String(), string(v))
+	if err != nil {
+		return err
+	}
+
+	// Notifications with the same payload are sent once per transaction.
+	_, err = tx.Exec(`SELECT pg_notify($1, '')`, postgresEventChannel)
 	return err
 }
 
-func (p *Postgres) Delete(kiteProt *protocol.Kite) error {
-	deleteKite := `DELETE FROM kite.kite WHERE id = $1`
-	_, err := p.DB.Exec(deleteKite, kiteProt.ID)
-	return err
+// Revision gives the revision of the latest change of kites.
+func (p *Postgres) Revision() (int64, error) {
+	var rev int64
+	err := p.DB.QueryRow(`SELECT coalesce(max(revision), 0) FROM kite.event`).Scan(&rev)
+	return rev, err
+}
+
+// Watch watches changes of kites that match the given query. The returned
+// channel is closed when ctx is done or the watch fails.
+//
+// Version constraints are not supported by Watch.
+func (p *Postgres) Watch(ctx context.Context, query *protocol.KontrolQuery) (<-chan *Event, error) {
+	return p.WatchFrom(ctx, query, 0)
+}
+
+// WatchFrom sends changes of kites that match the given query, made after
+// the given revision, read from the kite.event table whenever Postgres
+// notifies about new changes. If the changes were already removed, see
+// PostgresConfig.MaxEvents, the returned channel is closed and the kites
+// need to be listed again.
+//
+// Version constraints are not supported by WatchFrom.
+func (p *Postgres) WatchFrom(ctx context.Context, query *protocol.KontrolQuery, revision int64) (<-chan *Event, error) {
+	key, err := GetQueryKey(query)
+	if err != nil {
+		return nil, err
+	}
+
+	key = KitesPrefix + key
+
+	// Subscribe first, so no change made meanwhile is missed.
+	notify, err := p.subscribe()
+	if err != nil {
+		return nil, err
+	}
+
+	if revision == 0 {
+		if revision, err = p.Revision(); err != nil {
+			p.unsubscribe(notify)
+			return nil, err
+		}
+	}
+
+	var first sql.NullInt64
+	if err := p.DB.QueryRowContext(ctx, `SELECT min(revision) FROM kite.event`).Scan(&first); err != nil {
+		p.unsubscribe(notify)
+		return nil, err
+	}
+
+	events := make(chan *Event)
+
+	if first.Valid && first.Int64 > revision+1 {
+		p.unsubscribe(notify)
+		close(events)
+		return events, nil
+	}
+
+	go func() {
+		defer close(events)
+		defer p.unsubscribe(notify)
+
+		const batch = 100
+
+		for {
+			changes, err := p.events(ctx, revision, batch)
+			if ctx.Err() != nil {
+				return
+			}
+
+			if err != nil {
+				p.Log.Error("postgres watch of %q failed: %s", key, err)
+				return
+			}
+
+			for _, event := range changes {
+				revision = event.Revision
+
+				path := KitesPrefix + event.Kite.Kite.String()
+				if path != key && !strings.HasPrefix(path, key+"/") {
+					continue
+				}
+
+				if !query.MatchLabels(event.Kite.Labels) {
+					continue
+				}
+
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			if len(changes) == batch {
+				continue
+			}
+
+			select {
+			case <-notify:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return events, nil
+}
+
+// events gives at most n changes of kites made after the given revision.
+func (p *Postgres) events(ctx context.Context, revision int64, n int) ([]*Event, error) {
+	rows, err := p.DB.QueryContext(ctx, `SELECT revision, action, path, value FROM kite.event
+	WHERE revision > $1 ORDER BY revision LIMIT $2`, revision, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []*Event
+
+	for rows.Next() {
+		var (
+			event       Event
+			path, value string
+		)
+
+		if err := rows.Scan(&event.Revision, &event.Action, &path, &value); err != nil {
+			return nil, err
+		}
+
+		if event.Kite, err = kiteFromKV(path, []byte(value)); err != nil {
+			p.Log.Warning("invalid kite event %d: %s", event.Revision, err)
+			continue
+		}
+
+		events = append(events, &event)
+	}
+
+	return events, rows.Err()
+}
+
+// subscribe gives a channel, which is signalled whenever Postgres notifies
+// about changes of kites. All the watchers share a single connection, which
+// listens for the notifications.
+func (p *Postgres) subscribe() (chan struct{}, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.connString == "" {
+		return nil, errors.New("postgres: watching kites requires storage created with NewPostgres")
+	}
+
+	if p.listener == nil {
+		l := pq.NewListener(p.connString, time.Second, time.Minute, p.listenerEvent)
+
+		if err := l.Listen(postgresEventChannel); err != nil {
+			l.Close()
+			return nil, err
+		}
+
+		p.listener = l
+		go p.listen(l)
+	}
+
+	if p.watchers == nil {
+		p.watchers = make(map[chan struct{}]struct{})
+	}
+
+	c := make(chan struct{}, 1)
+	p.watchers[c] = struct{}{}
+
+	return c, nil
+}
+
+func (p *Postgres) unsubscribe(c chan struct{}) {
+	p.mu.Lock()
+	delete(p.watchers, c)
+	p.mu.Unlock()
+}
+
+// listen signals the watchers on every notification. As notifications
+// are lost while the connection is down, the watchers are signalled after
+// reconnecting and periodically as well.
+func (p *Postgres) listen(l *pq.Listener) {
+	ping := time.NewTicker(KeyTTL)
+	defer ping.Stop()
+
+	for {
+		select {
+		case _, ok := <-l.Notify:
+			if !ok {
+				return
+			}
+		case <-ping.C:
+			if err := l.Ping(); err != nil {
+				p.Log.Warning("postgres: listener ping failed: %s", err)
+			}
+		}
+
+		p.mu.Lock()
+		for c := range p.watchers {
+			select {
+			case c <- struct{}{}:
+			default:
+			}
+		}
+		p.mu.Unlock()
+	}
+}
+
+func (p *Postgres) listenerEvent(event pq.ListenerEventType, err error) {
+	if err != nil {
+		p.Log.Warning("postgres: listener event %d: %s", event, err)
+	}
+}
+
+// scanKite scans the kite from all the columns of kite.kite.
+func scanKite(rows *sql.Rows) (*protocol.KiteWithToken, error) {
+	var (
+		username    string
+		environment string
+		kitename    string
+		version     string
+		region      string
+		hostname    string
+		id          string
+		url         string
+		updated_at  time.Time
+		created_at  time.Time
+		keyId       string
+		labels      sql.NullString
+		urls        sql.NullString
+		weight      int
+	)
+
+	err := rows.Scan(
+		&username,
+		&environment,
+		&kitename,
+		&version,
+		&region,
+		&hostname,
+		&id,
+		&url,
+		&updated_at,
+		&created_at,
+		&keyId,
+		&labels,
+		&urls,
+		&weight,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	kite := &protocol.KiteWithToken{
+		Kite: protocol.Kite{
+			Username:    username,
+			Environment: environment,
+			Name:        kitename,
+			Version:     version,
+			Region:      region,
+			Hostname:    hostname,
+			ID:          id,
+		},
+		URL:    url,
+		KeyID:  keyId,
+		Weight: weight,
+	}
+
+	if labels.Valid && labels.String != "" {
+		if err := json.Unmarshal([]byte(labels.String), &kite.Labels); err != nil {
+			return nil, err
+		}
+	}
+
+	if urls.Valid && urls.String != "" {
+		if err := json.Unmarshal([]byte(urls.String), &kite.URLs); err != nil {
+			return nil, err
+		}
+	}
+
+	return kite, nil
 }
 
 // selectQuery returns a SQL query for the given query
@@ -357,13 +937,28 @@ func selectQuery(query *protocol.KontrolQuery) (string, []interface{}, error) {
 		return "", nil, ErrQueryFieldsEmpty
 	}
 
+	// expired kites are removed periodically, see RunCleaner
+	andQuery = append(andQuery, sq.Expr(`updated_at >= (now() at time zone 'utc') - ((INTERVAL '1 second') * ?)`,
+		int64(KeyTTL/time.Second)))
+
 	return kites.Where(andQuery).ToSql()
 }
 
-// inseryKiteQuery inserts the given kite, url and key to the kite.kite table
-func insertKiteQuery(kiteProt *protocol.Kite, url, keyId string) (string, []interface{}, error) {
+// inseryKiteQuery inserts the given kite, url, key, labels and alternative
+// urls to the kite.kite table
+func insertKiteQuery(kiteProt *protocol.Kite, value *kontrolprotocol.RegisterValue) (string, []interface{}, error) {
 	psql := sq.StatementBuilder.PlaceholderFormat(sq.Dollar)
 
+	labels, err := encodeJSONColumn(value.Labels, len(value.Labels))
+	if err != nil {
+		return "", nil, err
+	}
+
+	urls, err := encodeJSONColumn(value.URLs, len(value.URLs))
+	if err != nil {
+		return "", nil, err
+	}
+
 	kiteValues := kiteProt.Values()
 	values := make([]interface{}, len(kiteValues))
 
@@ -371,8 +966,11 @@ func insertKiteQuery(kiteProt *protocol.Kite, url, keyId string) (string, []inte
 		values[i] = kiteVal
 	}
 
-	values = append(values, url)
-	values = append(values, keyId)
+	values = append(values, value.URL)
+	values = append(values, value.KeyID)
+	values = append(values, labels)
+	values = append(values, urls)
+	values = append(values, value.Weight)
 
 	return psql.Insert("kite.kite").Columns(
 		"username",
@@ -384,9 +982,27 @@ func insertKiteQuery(kiteProt *protocol.Kite, url, keyId string) (string, []inte
 		"id",
 		"url",
 		"key_id",
+		"labels",
+		"urls",
+		"weight",
 	).Values(values...).ToSql()
 }
 
+// encodeJSONColumn gives the value of the JSON encoded column, e.g. labels,
+// which is NULL for kites without values, i.e. when n is 0.
+func encodeJSONColumn(v interface{}, n int) (sql.NullString, error) {
+	if n == 0 {
+		return sql.NullString{}, nil
+	}
+
+	p, err := json.Marshal(v)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+
+	return sql.NullString{String: string(p), Valid: true}, nil
+}
+
 /*
 
 --- Key Pair -----------------
@@ -470,3 +1086,70 @@ func (p *Postgres) GetKeyFromID(id string) (*KeyPair, error) {
 func (p *Postgres) GetKeyFromPublic(public string) (*KeyPair, error) {
 	return p.getKey(sq.Eq{"public": public})
 }
+
+func (p *Postgres) SetKeyRotation(rotation *KeyRotation) error {
+	tx, err := p.DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	err = func() error {
+		_, err := tx.Exec(`UPDATE kite.key SET current = (id::text = $1), retire_at = NULL WHERE deleted_at IS NULL`,
+			rotation.Current)
+		if err != nil {
+			return err
+		}
+
+		for id, t := range rotation.Retire {
+			_, err := tx.Exec(`UPDATE kite.key SET retire_at = $2 WHERE id = $1 AND deleted_at IS NULL`,
+				id, t.UTC())
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}()
+
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (p *Postgres) GetKeyRotation() (*KeyRotation, error) {
+	rows, err := p.DB.Query(`SELECT id, current, retire_at FROM kite.key
+		WHERE deleted_at IS NULL AND (current OR retire_at IS NOT NULL)`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rotation := &KeyRotation{
+		Retire: make(map[string]time.Time),
+	}
+
+	for rows.Next() {
+		var (
+			id      string
+			current bool
+			t       pq.NullTime
+		)
+
+		if err := rows.Scan(&id, &current, &t); err != nil {
+			return nil, err
+		}
+
+		if current {
+			rotation.Current = id
+		}
+
+		if t.Valid {
+			rotation.Retire[id] = t.Time
+		}
+	}
+
+	return rotation, rows.Err()
+}
@@ -9,4 +9,13 @@ type RegisterValue struct {
 	// This is currently only used by Kontrol itself internally, however it
 	// might be changed in the future.
 	KeyID string `json:"key_id"`
+
+	// Labels are arbitrary key/value pairs the kite registered with.
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// URLs are alternative URLs the kite is reachable at.
+	URLs []string `json:"urls,omitempty"`
+
+	// Weight is the capacity of the kite relative to other kites.
+	Weight int `json:"weight,omitempty"`
 }
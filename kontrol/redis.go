@@ -0,0 +1,569 @@
+package kontrol
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-version"
+	"github.com/koding/kite"
+	kontrolprotocol "github.com/koding/kite/kontrol/protocol"
+	"github.com/koding/kite/protocol"
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisConfig is used to configure the Redis storage.
+type RedisConfig struct {
+	// Prefix is prepended to all the keys, "{kontrol}" by default. The keys
+	// are modified with Lua scripts, so in a Redis Cluster they need to be
+	// stored in a single slot, which is ensured with the hash tag in braces.
+	Prefix string
+
+	// MaxEvents is the approximate number of the latest changes of kites
+	// kept for resuming watches, 10000 by default.
+	MaxEvents int64
+
+	// RequestTimeout is the timeout of a single request, 5s by default.
+	RequestTimeout time.Duration
+}
+
+// Redis implements the Storage and Watcher interfaces with Redis.
+//
+// Each kite is stored under a key built from all the kite fields, which
+// expires after KeyTTL unless the kite is updated, and a key built from
+// the kite ID, which points to the former. The kite keys are indexed with
+// a sorted set, which is queried by prefixes, and the changes of kites
+// are appended to a stream, which is read by watchers.
+//
+// Expired kites are removed from the index once Redis notifies about their
+// expiry. Keyspace notifications need to be enabled for expired events,
+// e.g. with "notify-keyspace-events Ex" in the Redis configuration. As
+// notifications are not delivered while Kontrol is disconnected, and in a
+// Redis Cluster they are not delivered from other nodes, the index is also
+// swept periodically and expired kites are never returned by Get.
+type Redis struct {
+	client    redis.UniversalClient
+	log       kite.Logger
+	prefix    string
+	maxEvents int64
+	timeout   time.Duration
+	closed    chan struct{}
+}
+
+var _ Watcher = (*Redis)(nil)
+
+// putScript stores the kite under KEYS[1] and its ID key KEYS[2] with TTL
+// of ARGV[3] milliseconds and adds the kite ARGV[1] to the index KEYS[3].
+// If its value ARGV[2] has changed, it is stored in the hash KEYS[4] and
+// the change is appended to the stream KEYS[6] with the next revision
+// from KEYS[5], trimmed to about ARGV[4] entries.
+var putScript = redis.NewScript(`
+redis.call("SET", KEYS[1], ARGV[2], "PX", ARGV[3])
+redis.call("SET", KEYS[2], ARGV[1], "PX", ARGV[3])
+redis.call("ZADD", KEYS[3], 0, ARGV[1])
+
+if redis.call("HGET", KEYS[4], ARGV[1]) == ARGV[2] then
+	return 0
+end
+
+redis.call("HSET", KEYS[4], ARGV[1], ARGV[2])
+
+local rev = redis.call("INCR", KEYS[5])
+redis.call("XADD", KEYS[6], "MAXLEN", "~", ARGV[4], rev .. "-0",
+	"action", "register", "kite", ARGV[1], "value", ARGV[2])
+
+return rev
+`)
+
+// deleteScript removes the kite ARGV[1] stored under the same keys as with
+// putScript and appends the change to the stream, trimmed to about ARGV[3]
+// entries. If ARGV[2] is "1", the kite is removed only if it has expired.
+var deleteScript = redis.NewScript(`
+if ARGV[2] == "1" and redis.call("EXISTS", KEYS[1]) == 1 then
+	return 0
+end
+
+redis.call("DEL", KEYS[1])
+if redis.call("GET", KEYS[2]) == ARGV[1] then
+	redis.call("DEL", KEYS[2])
+end
+redis.call("ZREM", KEYS[3], ARGV[1])
+
+local value = redis.call("HGET", KEYS[4], ARGV[1])
+if not value then
+	return 0
+end
+
+redis.call("HDEL", KEYS[4], ARGV[1])
+
+local rev = redis.call("INCR", KEYS[5])
+redis.call("XADD", KEYS[6], "MAXLEN", "~", ARGV[3], rev .. "-0",
+	"action", "deregister", "kite", ARGV[1], "value", value)
+
+return rev
+`)
+
+// NewRedis gives new Redis storage, which stores kites with the given client,
+// e.g. *redis.Client or *redis.ClusterClient.
+func NewRedis(client redis.UniversalClient, conf *RedisConfig, log kite.Logger) *Redis {
+	if conf == nil {
+		conf = &RedisConfig{}
+	}
+
+	r := &Redis{
+		client:    client,
+		log:       log,
+		prefix:    conf.Prefix,
+		maxEvents: conf.MaxEvents,
+		timeout:   conf.RequestTimeout,
+		closed:    make(chan struct{}),
+	}
+
+	if r.prefix == "" {
+		r.prefix = "{kontrol}"
+	}
+
+	if r.maxEvents == 0 {
+		r.maxEvents = 10000
+	}
+
+	if r.timeout == 0 {
+		r.timeout = 5 * time.Second
+	}
+
+	r.checkNotifications()
+
+	go r.expireKites()
+
+	return r
+}
+
+// Close stops removing expired kites. It does not close the client.
+func (r *Redis) Close() error {
+	close(r.closed)
+	return nil
+}
+
+func (r *Redis) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), r.timeout)
+}
+
+// keys gives the keys of the kite under the given path, as passed
+// to putScript and deleteScript.
+func (r *Redis) keys(path, id string) []string {
+	return []string{
+		r.prefix + path,
+		r.prefix + KitesPrefix + "/" + id,
+		r.prefix + "/index",
+		r.prefix + "/values",
+		r.prefix + "/revision",
+		r.prefix + "/events",
+	}
+}
+
+func (r *Redis) Add(k *protocol.Kite, value *kontrolprotocol.RegisterValue) error {
+	valueBytes, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := r.context()
+	defer cancel()
+
+	path := KitesPrefix + k.String()
+
+	return putScript.Run(ctx, r.client, r.keys(path, k.ID), path, string(valueBytes),
+		int64(KeyTTL/time.Millisecond), r.maxEvents).Err()
+}
+
+func (r *Redis) Update(k *protocol.Kite, value *kontrolprotocol.RegisterValue) error {
+	return r.Add(k, value)
+}
+
+func (r *Redis) Upsert(k *protocol.Kite, value *kontrolprotocol.RegisterValue) error {
+	return r.Add(k, value)
+}
+
+func (r *Redis) Delete(k *protocol.Kite) error {
+	return r.delete(KitesPrefix+k.String(), k.ID, false)
+}
+
+// delete removes the kite under the given path, only if it has expired
+// when expired is true.
+func (r *Redis) delete(path, id string, expired bool) error {
+	ctx, cancel := r.context()
+	defer cancel()
+
+	onlyExpired := "0"
+	if expired {
+		onlyExpired = "1"
+	}
+
+	return deleteScript.Run(ctx, r.client, r.keys(path, id), path, onlyExpired, r.maxEvents).Err()
+}
+
+// expire removes the expired kite under the given path.
+func (r *Redis) expire(path string) {
+	k, err := kiteFromKey(path)
+	if err != nil {
+		return
+	}
+
+	if err := r.delete(path, k.ID, true); err != nil {
+		r.log.Warning("unable to remove expired kite %s: %s", path, err)
+	}
+}
+
+func (r *Redis) Get(query *protocol.KontrolQuery) (Kites, error) {
+	ctx, cancel := r.context()
+	defer cancel()
+
+	key, err := r.redisKey(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	// If version field contains a constraint we need no make a new query up to
+	// "name" field and filter the results after getting all versions.
+	var hasVersionConstraint bool // does query contains a constraint on version?
+	var keyRest string            // query key after the version field
+	var versionConstraint version.Constraints
+	_, err = version.NewVersion(query.Version)
+	if err != nil && query.Version != "" {
+		versionConstraint, err = version.NewConstraint(query.Version)
+		if err != nil {
+			return nil, err
+		}
+
+		hasVersionConstraint = true
+		nameQuery := &protocol.KontrolQuery{
+			Username:    query.Username,
+			Environment: query.Environment,
+			Name:        query.Name,
+		}
+		key, _ = GetQueryKey(nameQuery)
+
+		keyRest = "/" + strings.TrimRight(
+			query.Region+"/"+query.Hostname+"/"+query.ID, "/")
+	}
+
+	key = KitesPrefix + key
+
+	// A query with all the fields gives a single kite, other queries
+	// match a subtree. Trailing slash ensures "/kites/user/env/math"
+	// does not match "/kites/user/env/mathworker" kites.
+	paths, err := r.client.ZRangeByLex(ctx, r.prefix+"/index", &redis.ZRangeBy{
+		Min: "[" + key,
+		Max: "[" + key,
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(paths) == 0 {
+		paths, err = r.client.ZRangeByLex(ctx, r.prefix+"/index", &redis.ZRangeBy{
+			Min: "[" + key + "/",
+			Max: "[" + key + "/\xff",
+		}).Result()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	kites, err := r.kites(ctx, paths)
+	if err != nil {
+		return nil, err
+	}
+
+	if hasVersionConstraint {
+		kites.Filter(versionConstraint, keyRest)
+	}
+
+	kites.Shuffle()
+
+	return kites, nil
+}
+
+// kites gives the kites stored under the given paths. The expired ones,
+// which were not removed from the index yet, are removed.
+func (r *Redis) kites(ctx context.Context, paths []string) (Kites, error) {
+	kites := make(Kites, 0, len(paths))
+
+	if len(paths) == 0 {
+		return kites, nil
+	}
+
+	keys := make([]string, len(paths))
+	for i, path := range paths {
+		keys[i] = r.prefix + path
+	}
+
+	values, err := r.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, v := range values {
+		value, ok := v.(string)
+		if !ok {
+			r.expire(paths[i])
+			continue
+		}
+
+		kite, err := kiteFromKV(paths[i], []byte(value))
+		if err != nil {
+			return nil, err
+		}
+
+		kites = append(kites, kite)
+	}
+
+	return kites, nil
+}
+
+func (r *Redis) redisKey(ctx context.Context, query *protocol.KontrolQuery) (string, error) {
+	if onlyIDQuery(query) {
+		path, err := r.client.Get(ctx, r.prefix+KitesPrefix+"/"+query.ID).Result()
+		if err == redis.Nil {
+			return "", errors.New("kite not found")
+		}
+		if err != nil {
+			return "", err
+		}
+
+		return strings.TrimPrefix(path, KitesPrefix), nil
+	}
+
+	return GetQueryKey(query)
+}
+
+// Revision gives the revision of the latest change of kites.
+func (r *Redis) Revision() (int64, error) {
+	ctx, cancel := r.context()
+	defer cancel()
+
+	rev, err := r.client.Get(ctx, r.prefix+"/revision").Result()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseInt(rev, 10, 64)
+}
+
+// Watch watches changes of kites that match the given query. The returned
+// channel is closed when ctx is done or the watch fails.
+//
+// Version constraints are not supported by Watch.
+func (r *Redis) Watch(ctx context.Context, query *protocol.KontrolQuery) (<-chan *Event, error) {
+	return r.WatchFrom(ctx, query, 0)
+}
+
+// WatchFrom sends changes of kites that match the given query, made after
+// the given revision, read from the stream of changes. If the changes were
+// already trimmed from the stream, see RedisConfig.MaxEvents, the returned
+// channel is closed and the kites need to be listed again.
+//
+// Version constraints are not supported by WatchFrom.
+func (r *Redis) WatchFrom(ctx context.Context, query *protocol.KontrolQuery, revision int64) (<-chan *Event, error) {
+	key, err := GetQueryKey(query)
+	if err != nil {
+		return nil, err
+	}
+
+	key = KitesPrefix + key
+
+	if revision == 0 {
+		if revision, err = r.Revision(); err != nil {
+			return nil, err
+		}
+	}
+
+	events := make(chan *Event)
+
+	first, err := r.client.XRangeN(ctx, r.prefix+"/events", "-", "+", 1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(first) != 0 && streamRevision(first[0].ID) > revision+1 {
+		close(events)
+		return events, nil
+	}
+
+	go func() {
+		defer close(events)
+
+		lastID := strconv.FormatInt(revision, 10) + "-0"
+
+		for {
+			streams, err := r.client.XRead(ctx, &redis.XReadArgs{
+				Streams: []string{r.prefix + "/events", lastID},
+				Count:   100,
+				Block:   5 * time.Second,
+			}).Result()
+
+			if ctx.Err() != nil {
+				return
+			}
+
+			if err == redis.Nil {
+				continue
+			}
+
+			if err != nil {
+				r.log.Error("redis watch of %q failed: %s", key, err)
+				return
+			}
+
+			for _, stream := range streams {
+				for _, msg := range stream.Messages {
+					lastID = msg.ID
+
+					event, err := r.event(msg)
+					if err != nil {
+						r.log.Warning("invalid kite event %s: %s", msg.ID, err)
+						continue
+					}
+
+					path := KitesPrefix + event.Kite.Kite.String()
+					if path != key && !strings.HasPrefix(path, key+"/") {
+						continue
+					}
+
+					if !query.MatchLabels(event.Kite.Labels) {
+						continue
+					}
+
+					select {
+					case events <- event:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+		}
+	}()
+
+	return events, nil
+}
+
+// event builds the event from the stream entry appended by
+// putScript or deleteScript.
+func (r *Redis) event(msg redis.XMessage) (*Event, error) {
+	action, _ := msg.Values["action"].(string)
+	path, _ := msg.Values["kite"].(string)
+	value, _ := msg.Values["value"].(string)
+
+	kite, err := kiteFromKV(path, []byte(value))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Event{
+		Action:   action,
+		Kite:     kite,
+		Revision: streamRevision(msg.ID),
+	}, nil
+}
+
+// streamRevision gives the revision from the ID of a stream entry.
+func streamRevision(id string) int64 {
+	if i := strings.IndexByte(id, '-'); i != -1 {
+		id = id[:i]
+	}
+
+	rev, _ := strconv.ParseInt(id, 10, 64)
+	return rev
+}
+
+// checkNotifications warns if Redis is not configured to notify about
+// expired keys.
+func (r *Redis) checkNotifications() {
+	ctx, cancel := r.context()
+	defer cancel()
+
+	conf, err := r.client.ConfigGet(ctx, "notify-keyspace-events").Result()
+	if err != nil {
+		// CONFIG is disabled by some of the hosted Redis services.
+		r.log.Debug("unable to read redis configuration: %s", err)
+		return
+	}
+
+	flags := conf["notify-keyspace-events"]
+
+	if !strings.Contains(flags, "E") || !strings.ContainsAny(flags, "xA") {
+		r.log.Warning(`redis keyspace notifications for expired keys are not enabled ` +
+			`("notify-keyspace-events Ex"), expired kites are going to be removed periodically`)
+	}
+}
+
+// expireKites removes expired kites once Redis notifies about their expiry
+// and sweeps the index of kites every KeyTTL.
+func (r *Redis) expireKites() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pubsub := r.client.PSubscribe(ctx, "__keyevent@*__:expired")
+	defer pubsub.Close()
+
+	expired := pubsub.Channel()
+
+	sweep := time.NewTicker(KeyTTL)
+	defer sweep.Stop()
+
+	for {
+		select {
+		case msg, ok := <-expired:
+			if !ok {
+				return
+			}
+
+			if path := strings.TrimPrefix(msg.Payload, r.prefix); path != msg.Payload {
+				r.expire(path)
+			}
+		case <-sweep.C:
+			if err := r.sweep(); err != nil {
+				r.log.Warning("unable to remove expired kites: %s", err)
+			}
+		case <-r.closed:
+			return
+		}
+	}
+}
+
+// sweep removes expired kites from the index.
+func (r *Redis) sweep() error {
+	ctx, cancel := r.context()
+	defer cancel()
+
+	paths, err := r.client.ZRangeByLex(ctx, r.prefix+"/index", &redis.ZRangeBy{
+		Min: "-",
+		Max: "+",
+	}).Result()
+	if err != nil {
+		return err
+	}
+
+	const batch = 1000
+
+	for len(paths) != 0 {
+		n := len(paths)
+		if n > batch {
+			n = batch
+		}
+
+		if _, err := r.kites(ctx, paths[:n]); err != nil {
+			return err
+		}
+
+		paths = paths[n:]
+	}
+
+	return nil
+}
@@ -0,0 +1,136 @@
+package kontrol
+
+import (
+	"errors"
+	"time"
+
+	"github.com/koding/kite"
+	"github.com/koding/kite/dnode"
+	"github.com/koding/kite/protocol"
+)
+
+// revocation is a revocation issued by Kontrol.
+type revocation struct {
+	*protocol.Revocation
+	version int64
+}
+
+// Revoke revokes the kite key or token with the given JWT ID or all
+// the credentials of the kite with the given ID. Kontrol denies requests
+// authenticated with revoked credentials, does not return revoked kites
+// from "getKites" and sends the revocation to kites that call
+// "getRevocations".
+//
+// Revocations are kept in memory, until they expire. A restarted Kontrol
+// starts a new epoch of revocation versions, so the kites fetch all the
+// revocations again, see protocol.GetRevocationsArgs.
+func (k *Kontrol) Revoke(rev *protocol.Revocation) error {
+	if rev.JTI == "" && rev.KiteID == "" {
+		return errors.New("revocation has neither JWT ID nor kite ID")
+	}
+
+	k.revocationsMu.Lock()
+	k.pruneRevocations()
+
+	k.revocationsVersion++
+
+	version := k.revocationsVersion
+	k.revocations = append(k.revocations, revocation{
+		Revocation: rev,
+		version:    version,
+	})
+
+	watchers := make([]dnode.Function, 0, len(k.revocationWatchers))
+	for _, fn := range k.revocationWatchers {
+		watchers = append(watchers, fn)
+	}
+	k.revocationsMu.Unlock()
+
+	k.Kite.Revoke(rev)
+
+	res := &protocol.GetRevocationsResult{
+		Revocations: []*protocol.Revocation{rev},
+		Version:     version,
+		Epoch:       k.revocationsEpoch,
+	}
+
+	for _, fn := range watchers {
+		if err := fn.Call(res); err != nil {
+			k.log.Warning("unable to send revocation: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// HandleGetRevocations gives revocations issued since the version
+// requested by the caller. If the caller passes a watch callback, it is
+// called with new revocations until the caller disconnects.
+func (k *Kontrol) HandleGetRevocations(r *kite.Request) (interface{}, error) {
+	var args protocol.GetRevocationsArgs
+
+	if err := r.Args.One().Unmarshal(&args); err != nil {
+		return nil, err
+	}
+
+	k.revocationsMu.Lock()
+	defer k.revocationsMu.Unlock()
+
+	k.pruneRevocations()
+
+	res := &protocol.GetRevocationsResult{
+		Revocations: make([]*protocol.Revocation, 0),
+		Version:     k.revocationsVersion,
+		Epoch:       k.revocationsEpoch,
+	}
+
+	// Versions of other epochs are meaningless, e.g. the caller
+	// got them before Kontrol restarted.
+	since := args.Since
+	if args.Epoch != k.revocationsEpoch {
+		since = 0
+	}
+
+	for _, rev := range k.revocations {
+		if rev.version > since {
+			res.Revocations = append(res.Revocations, rev.Revocation)
+		}
+	}
+
+	if args.WatchCallback.IsValid() {
+		if k.revocationWatchers == nil {
+			k.revocationWatchers = make(map[*kite.Client]dnode.Function)
+		}
+
+		if _, ok := k.revocationWatchers[r.Client]; !ok {
+			c := r.Client
+
+			c.OnDisconnect(func() {
+				k.revocationsMu.Lock()
+				delete(k.revocationWatchers, c)
+				k.revocationsMu.Unlock()
+			})
+		}
+
+		k.revocationWatchers[r.Client] = args.WatchCallback
+	}
+
+	return res, nil
+}
+
+// pruneRevocations removes revocations of credentials that are expired
+// anyway.
+//
+// The method must be called with revocationsMu held.
+func (k *Kontrol) pruneRevocations() {
+	now := time.Now().Unix()
+	revs := k.revocations[:0]
+
+	for _, rev := range k.revocations {
+		if rev.Expires == 0 || now < rev.Expires {
+			revs = append(revs, rev)
+		}
+	}
+
+	k.revocations = revs
+}
@@ -0,0 +1,211 @@
+package kontrol
+
+import (
+	"strings"
+	"time"
+
+	"github.com/koding/kite"
+	"github.com/koding/kite/protocol"
+	uuid "github.com/satori/go.uuid"
+)
+
+// DefaultRotationGrace is the default period during which key pairs replaced
+// with RotateKeyPair are still valid.
+const DefaultRotationGrace = 24 * time.Hour
+
+// RotateKeyPair adds the given key pair and makes it the current one, which
+// is used to sign new kite keys. If id is empty, a unique ID will be generated.
+//
+// Key pairs added before are still valid for the grace period, so the issued
+// kite keys and tokens keep working. Kites that register during the grace
+// period get their kite keys re-issued with the current key pair. Once the
+// grace period is over, the previous key pairs are deleted. If grace is 0,
+// DefaultRotationGrace is used.
+//
+// The current key pair and the deadlines of the previous ones are kept in
+// the key pair storage, so they survive restarts of Kontrol.
+func (k *Kontrol) RotateKeyPair(id, public, private string, grace time.Duration) error {
+	if grace == 0 {
+		grace = DefaultRotationGrace
+	}
+
+	if id == "" {
+		id = uuid.NewV4().String()
+	}
+
+	k.rotationMu.Lock()
+	defer k.rotationMu.Unlock()
+
+	k.keysMu.Lock()
+	previous := append([]string(nil), k.lastIDs...)
+	k.keysMu.Unlock()
+
+	if err := k.AddKeyPair(id, public, private); err != nil {
+		return err
+	}
+
+	rotation, err := k.keyPair.GetKeyRotation()
+	if err != nil {
+		return err
+	}
+
+	rotation = rotation.copy()
+	rotation.Current = id
+	delete(rotation.Retire, id)
+
+	deadline := time.Now().Add(grace)
+
+	for _, id := range previous {
+		// Keep the deadline of key pairs that are already retiring.
+		if _, ok := rotation.Retire[id]; !ok && id != rotation.Current {
+			rotation.Retire[id] = deadline
+		}
+	}
+
+	if err := k.keyPair.SetKeyRotation(rotation); err != nil {
+		return err
+	}
+
+	k.applyRotation(rotation, &KeyPair{
+		ID:      id,
+		Public:  strings.TrimSpace(public),
+		Private: strings.TrimSpace(private),
+	})
+
+	k.log.Info("Rotated key pairs, current key pair is %q, %d key pair(s) expire in %s", id, len(previous), grace)
+
+	return nil
+}
+
+// restoreRotation applies the rotation state kept in the key pair
+// storage, e.g. after Kontrol restarted.
+func (k *Kontrol) restoreRotation() error {
+	k.rotationMu.Lock()
+	defer k.rotationMu.Unlock()
+
+	rotation, err := k.keyPair.GetKeyRotation()
+	if err != nil {
+		return err
+	}
+
+	var current *KeyPair
+
+	if rotation.Current != "" {
+		if current, err = k.keyPair.GetKeyFromID(rotation.Current); err != nil {
+			return err
+		}
+	}
+
+	k.applyRotation(rotation, current)
+
+	return nil
+}
+
+// applyRotation makes current the key pair used to sign new kite keys,
+// unless it is nil, and schedules deleting the retiring key pairs.
+func (k *Kontrol) applyRotation(rotation *KeyRotation, current *KeyPair) {
+	k.keysMu.Lock()
+	defer k.keysMu.Unlock()
+
+	if current != nil {
+		k.selfKeyPair = current
+	}
+
+	if k.retiring == nil {
+		k.retiring = make(map[string]*time.Timer)
+	}
+
+	for id, deadline := range rotation.Retire {
+		if _, ok := k.retiring[id]; ok {
+			continue
+		}
+
+		id := id
+		k.retiring[id] = time.AfterFunc(time.Until(deadline), func() { k.retire(id) })
+	}
+}
+
+// retire deletes the key pair once its grace period is over.
+func (k *Kontrol) retire(id string) {
+	k.keysMu.Lock()
+	delete(k.retiring, id)
+	k.keysMu.Unlock()
+
+	if err := k.DeleteKeyPair(id, ""); err != nil && err != ErrKeyDeleted {
+		k.log.Error("unable to delete rotated key pair %q: %s", id, err)
+		return
+	}
+
+	k.rotationMu.Lock()
+	defer k.rotationMu.Unlock()
+
+	rotation, err := k.keyPair.GetKeyRotation()
+	if err != nil {
+		k.log.Error("unable to update rotated key pairs: %s", err)
+		return
+	}
+
+	if _, ok := rotation.Retire[id]; !ok {
+		return
+	}
+
+	rotation = rotation.copy()
+	delete(rotation.Retire, id)
+
+	if err := k.keyPair.SetKeyRotation(rotation); err != nil {
+		k.log.Error("unable to update rotated key pairs: %s", err)
+	}
+}
+
+// isRetiring returns true if the key pair was replaced with RotateKeyPair
+// and is going to be deleted.
+func (k *Kontrol) isRetiring(id string) bool {
+	k.keysMu.Lock()
+	defer k.keysMu.Unlock()
+
+	_, ok := k.retiring[id]
+	return ok
+}
+
+// trustedKeys gives public keys of all the key pairs that are valid,
+// starting with the current one.
+func (k *Kontrol) trustedKeys() []string {
+	var current string
+
+	if kp, err := k.KeyPair(); err == nil {
+		current = kp.Public
+	}
+
+	k.keysMu.Lock()
+	defer k.keysMu.Unlock()
+
+	keys := make([]string, 0, len(k.lastPublic)+1)
+
+	if current != "" {
+		keys = append(keys, current)
+	}
+
+	for i := len(k.lastPublic) - 1; i >= 0; i-- {
+		if k.lastPublic[i] != current {
+			keys = append(keys, k.lastPublic[i])
+		}
+	}
+
+	return keys
+}
+
+// HandleGetKeys gives the public keys Kontrol currently trusts, so kites
+// can verify tokens signed with any of them while key pairs are rotated.
+func (k *Kontrol) HandleGetKeys(r *kite.Request) (interface{}, error) {
+	keys := k.trustedKeys()
+
+	res := &protocol.GetKeysResult{
+		Keys: keys,
+	}
+
+	if len(keys) != 0 {
+		res.Current = keys[0]
+	}
+
+	return res, nil
+}
@@ -0,0 +1,35 @@
+package kontrol
+
+import (
+	"strings"
+
+	"github.com/koding/kite/config"
+)
+
+// addSecretKeyPairs adds the key pairs given by Config.SecretsProvider,
+// which were not added yet, e.g. when the secrets are refreshed. The
+// key pairs are removed with DeleteKeyPair or RotateKeyPair, as usual.
+func (k *Kontrol) addSecretKeyPairs(s *config.Secrets) {
+	for _, kp := range s.KontrolKeys {
+		if k.hasPublicKey(strings.TrimSpace(kp.Public)) {
+			continue
+		}
+
+		if err := k.AddKeyPair(kp.ID, kp.Public, kp.Private); err != nil {
+			k.log.Error("Unable to add key pair %q from secrets: %s", kp.ID, err)
+		}
+	}
+}
+
+func (k *Kontrol) hasPublicKey(public string) bool {
+	k.keysMu.Lock()
+	defer k.keysMu.Unlock()
+
+	for _, p := range k.lastPublic {
+		if p == public {
+			return true
+		}
+	}
+
+	return false
+}
@@ -1,25 +1,81 @@
 package kontrol
 
 import (
+	"context"
+
 	kontrolprotocol "github.com/koding/kite/kontrol/protocol"
 	"github.com/koding/kite/protocol"
 )
 
 // Storage is an interface to a kite storage. A storage should be safe to
 // concurrent access.
+//
+// Kites are stored with a time to live of KeyTTL. Kontrol calls Update for
+// every registered kite once per UpdateInterval, while the kite is sending
+// heartbeats, which renews the TTL. A kite that is not updated within KeyTTL
+// expires and must no longer be returned by Get. Storages which do not
+// support expiring keys need to clean up expired kites on their own.
+//
+// Custom storages are set with (*Kontrol).SetStorage. A storage which
+// implements Watcher as well enables watching kites with "getKites".
 type Storage interface {
 	// Get retrieves the Kites with the given query
 	Get(query *protocol.KontrolQuery) (Kites, error)
 
-	// Add inserts the given kite with the given value
+	// Add inserts the given kite with the given value, the kite
+	// expires after KeyTTL.
 	Add(kite *protocol.Kite, value *kontrolprotocol.RegisterValue) error
 
-	// Update updates the value for the given kite
+	// Update updates the value for the given kite and renews its TTL.
+	// The kite is added if it is not stored, e.g. when it has expired.
 	Update(kite *protocol.Kite, value *kontrolprotocol.RegisterValue) error
 
 	// Delete deletes the given kite from the storage
 	Delete(kite *protocol.Kite) error
 
 	// Upsert inserts or updates the value for the given kite
+	// and renews its TTL.
 	Upsert(kite *protocol.Kite, value *kontrolprotocol.RegisterValue) error
 }
+
+// Watcher is implemented by storages that are able to notify about
+// changes of kites, which are sent to the callers of "getKites" that
+// passed a watch callback.
+//
+// Every change is given a revision, which increases with each change.
+// Watchers resume watching after reconnecting with the revision of the
+// last event they received.
+type Watcher interface {
+	Storage
+
+	// Revision gives the revision of the latest change.
+	Revision() (int64, error)
+
+	// WatchFrom sends changes of kites, which match the given query
+	// including its labels, made after the given revision. The returned
+	// channel is closed when ctx is done or the watch fails. It is closed
+	// as well if the changes after the revision are no longer available,
+	// in which case the kites need to be listed again.
+	//
+	// Kites deregistered with Delete and the expired ones are sent
+	// with the "deregister" action.
+	WatchFrom(ctx context.Context, query *protocol.KontrolQuery, revision int64) (<-chan *Event, error)
+}
+
+// Event describes a change of a kite registration.
+type Event struct {
+	// Action is either "register" or "deregister". The kite is
+	// deregistered when it was deleted or has expired.
+	Action string
+
+	Kite *protocol.KiteWithToken
+
+	// Revision of the change, which can be passed
+	// to WatchFrom to resume the watch.
+	Revision int64
+}
+
+// EtcdV3Event describes a change of a kite registration.
+//
+// Deprecated: Use Event instead.
+type EtcdV3Event = Event
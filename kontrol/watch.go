@@ -0,0 +1,130 @@
+package kontrol
+
+import (
+	"context"
+	"errors"
+
+	"github.com/koding/kite"
+	"github.com/koding/kite/protocol"
+	uuid "github.com/satori/go.uuid"
+)
+
+// kiteWatch is a watch started with "getKites".
+type kiteWatch struct {
+	client *kite.Client
+	cancel context.CancelFunc
+}
+
+// watchKites sends changes of kites matching the query, made after the
+// given revision, to the watch callback of the caller. The watch is
+// canceled when the caller disconnects or calls "cancelWatcher" with
+// the returned ID.
+//
+// If the watch fails, the caller is sent a protocol.Reset event.
+func (k *Kontrol) watchKites(r *kite.Request, args *protocol.GetKitesArgs, w Watcher, revision int64) (string, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	events, err := w.WatchFrom(ctx, args.Query, revision)
+	if err != nil {
+		cancel()
+		return "", err
+	}
+
+	id := uuid.NewV4().String()
+
+	k.watchersMu.Lock()
+	if k.watchers == nil {
+		k.watchers = make(map[string]*kiteWatch)
+	}
+	k.watchers[id] = &kiteWatch{client: r.Client, cancel: cancel}
+	k.watchersMu.Unlock()
+
+	stop := func() {
+		cancel()
+
+		k.watchersMu.Lock()
+		delete(k.watchers, id)
+		k.watchersMu.Unlock()
+	}
+
+	r.Client.OnDisconnect(stop)
+
+	go func() {
+		defer stop()
+
+		for {
+			var ev *Event
+
+			select {
+			case ev = <-events:
+			case <-k.closed:
+				return
+			}
+
+			if ev == nil {
+				break
+			}
+
+			e := &protocol.KiteEvent{
+				Action:   protocol.Register,
+				Kite:     ev.Kite.Kite,
+				Labels:   ev.Kite.Labels,
+				Revision: ev.Revision,
+			}
+
+			if ev.Action == "deregister" {
+				e.Action = protocol.Deregister
+			} else {
+				if k.Kite.IsRevoked("", ev.Kite.Kite.ID) {
+					continue
+				}
+
+				token, err := k.kiteToken(r, args.Query, ev.Kite.KeyID, args.ProofKey)
+				if err != nil {
+					k.log.Error("unable to generate token for %s: %s", &ev.Kite.Kite, err)
+					continue
+				}
+
+				e.URL = ev.Kite.URL
+				e.URLs = ev.Kite.URLs
+				e.Weight = ev.Kite.Weight
+				e.Token = token
+			}
+
+			if err := args.WatchCallback.Call(e); err != nil {
+				k.log.Warning("unable to send kite event: %s", err)
+			}
+		}
+
+		// The watch failed, make the caller list kites again.
+		if ctx.Err() == nil {
+			if err := args.WatchCallback.Call(&protocol.KiteEvent{Action: protocol.Reset}); err != nil {
+				k.log.Warning("unable to send kite event: %s", err)
+			}
+		}
+	}()
+
+	return id, nil
+}
+
+// HandleCancelWatcher cancels the watch started by the caller with
+// "getKites". It expects the watcher ID as the argument.
+func (k *Kontrol) HandleCancelWatcher(r *kite.Request) (interface{}, error) {
+	id, err := r.Args.One().String()
+	if err != nil {
+		return nil, err
+	}
+
+	k.watchersMu.Lock()
+	defer k.watchersMu.Unlock()
+
+	w, ok := k.watchers[id]
+	if !ok || w.client != r.Client {
+		return nil, errors.New("watcher not found")
+	}
+
+	w.cancel()
+	delete(k.watchers, id)
+
+	return nil, nil
+}
@@ -8,6 +8,7 @@ import (
 	"net/url"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/koding/kite/dnode"
@@ -40,6 +41,16 @@ type kontrolClient struct {
 
 	// registerChan registers the url's it receives from the channel to Kontrol
 	registerChan chan *url.URL
+
+	// httpURL is the URL of Kontrol the kite registered to
+	// with RegisterHTTP
+	httpURL string
+
+	// registering is set once the kite tries to register to Kontrol,
+	// registered is set while it is registered; they are used by
+	// the readiness check, see Kite.Ready
+	registering int32
+	registered  int32
 }
 
 type registerResult struct {
@@ -55,6 +66,11 @@ func (k *Kite) SetupKontrolClient() error {
 		return nil // already prepared
 	}
 
+	// The kite key from the secrets gives the Kontrol URL.
+	if err := k.LoadSecrets(); err != nil {
+		return err
+	}
+
 	if k.Config.KontrolURL == "" {
 		return errors.New("no kontrol URL given in config")
 	}
@@ -66,6 +82,21 @@ func (k *Kite) SetupKontrolClient() error {
 		Key:  k.KiteKey(),
 	}
 
+	// Fail over to the next Kontrol if dialing the current one failed.
+	if urls := k.kontrolURLs(); len(urls) > 1 {
+		next := 0
+		client.OnReconnectAttempt(func(attempt int, err error) {
+			if err == nil {
+				return
+			}
+
+			next = (next + 1) % len(urls)
+			client.URL = urls[next]
+
+			k.Log.Info("Failing over to Kontrol: %s", client.URL)
+		})
+	}
+
 	k.kontrol.Lock()
 	k.kontrol.Client = client
 	k.kontrol.Unlock()
@@ -91,6 +122,7 @@ func (k *Kite) SetupKontrolClient() error {
 
 	k.kontrol.OnDisconnect(func() {
 		k.Log.Warning("Disconnected from Kontrol.")
+		atomic.StoreInt32(&k.kontrol.registered, 0)
 	})
 
 	// non blocking, is going to reconnect if the connection goes down.
@@ -101,6 +133,20 @@ func (k *Kite) SetupKontrolClient() error {
 	return nil
 }
 
+// kontrolURLs gives URLs of all the Kontrol instances the kite
+// can connect to, starting with the Config.KontrolURL.
+func (k *Kite) kontrolURLs() []string {
+	urls := []string{k.Config.KontrolURL}
+
+	for _, u := range k.Config.KontrolURLs {
+		if u != "" && u != k.Config.KontrolURL {
+			urls = append(urls, u)
+		}
+	}
+
+	return urls
+}
+
 // GetKites returns the list of Kites matching the query. The returned list
 // contains Ready to connect Client instances. The caller must connect
 // with Client.Dial() before using each Kite. An error is returned when no
@@ -122,11 +168,22 @@ func (k *Kite) SetupKontrolClient() error {
 //   return clients[0]
 //
 func (k *Kite) GetKites(query *protocol.KontrolQuery) ([]*Client, error) {
+	return k.getKitesFromKontrol(protocol.GetKitesArgs{Query: query})
+}
+
+// GetFederatedKites is like GetKites, but it also returns kites registered
+// to Kontrols of other regions, which the Kontrol is federated with.
+// Kites of the Kontrol's region come first.
+func (k *Kite) GetFederatedKites(query *protocol.KontrolQuery) ([]*Client, error) {
+	return k.getKitesFromKontrol(protocol.GetKitesArgs{Query: query, Federated: true})
+}
+
+func (k *Kite) getKitesFromKontrol(args protocol.GetKitesArgs) ([]*Client, error) {
 	if err := k.SetupKontrolClient(); err != nil {
 		return nil, err
 	}
 
-	clients, err := k.getKites(protocol.GetKitesArgs{Query: query})
+	clients, err := k.getKites(args)
 	if err != nil {
 		return nil, err
 	}
@@ -142,6 +199,8 @@ func (k *Kite) GetKites(query *protocol.KontrolQuery) ([]*Client, error) {
 func (k *Kite) getKites(args protocol.GetKitesArgs) ([]*Client, error) {
 	<-k.kontrol.readyConnected
 
+	args.ProofKey = k.ProofKey()
+
 	response, err := k.kontrol.TellWithTimeout("getKites", k.Config.Timeout, args)
 	if err != nil {
 		return nil, err
@@ -161,7 +220,10 @@ func (k *Kite) getKites(args protocol.GetKitesArgs) ([]*Client, error) {
 		}
 
 		clients[i] = k.NewClient(currentKite.URL)
+		clients[i].URLs = currentKite.URLs
 		clients[i].Kite = currentKite.Kite
+		clients[i].Labels = currentKite.Labels
+		clients[i].Weight = currentKite.Weight
 		clients[i].Auth = auth
 	}
 
@@ -191,7 +253,12 @@ func (k *Kite) GetToken(kite *protocol.Kite) (string, error) {
 
 	<-k.kontrol.readyConnected
 
-	result, err := k.kontrol.TellWithTimeout("getToken", k.Config.Timeout, kite)
+	args := &protocol.GetTokenArgs{
+		KontrolQuery: *kite.Query(),
+		ProofKey:     k.ProofKey(),
+	}
+
+	result, err := k.kontrol.TellWithTimeout("getToken", k.Config.Timeout, args)
 	if err != nil {
 		return "", err
 	}
@@ -219,6 +286,7 @@ func (k *Kite) GetTokenForce(kite *protocol.Kite) (string, error) {
 	args := &protocol.GetTokenArgs{
 		KontrolQuery: *kite.Query(),
 		Force:        true,
+		ProofKey:     k.ProofKey(),
 	}
 
 	result, err := k.kontrol.TellWithTimeout("getToken", k.Config.Timeout, args)
@@ -264,6 +332,121 @@ func (k *Kite) GetKey() (string, error) {
 	return key, nil
 }
 
+// GetKeys fetches public keys Kontrol currently trusts and trusts them
+// as well when verifying tokens, so tokens signed with any of them are
+// accepted while Kontrol's key pairs are rotated. The key kite key
+// is signed with stays the same.
+func (k *Kite) GetKeys() (*protocol.GetKeysResult, error) {
+	if err := k.SetupKontrolClient(); err != nil {
+		return nil, err
+	}
+
+	<-k.kontrol.readyConnected
+
+	result, err := k.kontrol.TellWithTimeout("getKeys", k.Config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys protocol.GetKeysResult
+	if err := result.Unmarshal(&keys); err != nil {
+		return nil, err
+	}
+
+	k.configMu.Lock()
+	defer k.configMu.Unlock()
+
+	k.Config.KontrolKeys = keys.Keys
+
+	if err := k.initKontrolKeys(); err != nil {
+		return nil, err
+	}
+
+	return &keys, nil
+}
+
+// GetRevocations fetches kite keys and tokens revoked by Kontrol since
+// the last call and denies requests authenticated with them.
+func (k *Kite) GetRevocations() error {
+	if err := k.SetupKontrolClient(); err != nil {
+		return err
+	}
+
+	<-k.kontrol.readyConnected
+
+	return k.getRevocations(dnode.Function{})
+}
+
+// PollRevocations fetches revocations every given interval,
+// see GetRevocations for details.
+func (k *Kite) PollRevocations(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		if err := k.GetRevocations(); err != nil {
+			k.Log.Warning("Fetching revocations failed: %s", err)
+		}
+	}
+}
+
+// WatchRevocations fetches revocations and makes Kontrol send new ones
+// as soon as they are issued, see GetRevocations for details.
+// The watch is renewed whenever the kite reconnects to Kontrol.
+func (k *Kite) WatchRevocations() error {
+	if err := k.SetupKontrolClient(); err != nil {
+		return err
+	}
+
+	<-k.kontrol.readyConnected
+
+	watch := dnode.Callback(func(arg *dnode.Partial) {
+		var res protocol.GetRevocationsResult
+
+		if err := arg.One().Unmarshal(&res); err != nil {
+			k.Log.Error("invalid revocations: %s", err)
+			return
+		}
+
+		k.revocations.update(&res)
+	})
+
+	if err := k.getRevocations(watch); err != nil {
+		return err
+	}
+
+	k.kontrol.OnConnect(func() {
+		go func() {
+			if err := k.getRevocations(watch); err != nil {
+				k.Log.Warning("Watching revocations failed: %s", err)
+			}
+		}()
+	})
+
+	return nil
+}
+
+func (k *Kite) getRevocations(watch dnode.Function) error {
+	since, epoch := k.revocations.getVersion()
+	args := &protocol.GetRevocationsArgs{
+		Since:         since,
+		Epoch:         epoch,
+		WatchCallback: watch,
+	}
+
+	result, err := k.kontrol.TellWithTimeout("getRevocations", k.Config.Timeout, args)
+	if err != nil {
+		return err
+	}
+
+	var res protocol.GetRevocationsResult
+	if err := result.Unmarshal(&res); err != nil {
+		return err
+	}
+
+	k.revocations.update(&res)
+
+	return nil
+}
+
 // NewKeyRenewer renews the internal key every given interval
 func (k *Kite) NewKeyRenewer(interval time.Duration) {
 	ticker := time.NewTicker(interval)
@@ -342,6 +525,8 @@ func (k *Kite) RegisterForever(kiteURL *url.URL) error {
 // handle the reconnection case. If you want to keep registered to kontrol, use
 // RegisterForever().
 func (k *Kite) Register(kiteURL *url.URL) (*registerResult, error) {
+	atomic.StoreInt32(&k.kontrol.registering, 1)
+
 	if err := k.SetupKontrolClient(); err != nil {
 		return nil, err
 	}
@@ -349,7 +534,10 @@ func (k *Kite) Register(kiteURL *url.URL) (*registerResult, error) {
 	<-k.kontrol.readyConnected
 
 	args := protocol.RegisterArgs{
-		URL: kiteURL.String(),
+		URL:    kiteURL.String(),
+		URLs:   k.advertisedURLs(),
+		Labels: k.Config.Labels,
+		Weight: k.Config.Weight,
 	}
 
 	k.Log.Info("Registering to kontrol with URL: %s", kiteURL.String())
@@ -378,6 +566,27 @@ func (k *Kite) Register(kiteURL *url.URL) (*registerResult, error) {
 	return &registerResult{parsed}, nil
 }
 
+// deregister removes the kite from Kontrol, so it is no longer returned
+// by getKites, if it is registered with the Kontrol client, see Shutdown.
+func (k *Kite) deregister() {
+	k.kontrol.Lock()
+	c := k.kontrol.Client
+	httpURL := k.kontrol.httpURL
+	k.kontrol.Unlock()
+
+	// Kites registered with RegisterHTTP expire on Kontrol.
+	if c == nil || httpURL != "" || atomic.LoadInt32(&k.kontrol.registered) == 0 {
+		return
+	}
+
+	if _, err := c.TellWithTimeout("deregister", k.Config.Timeout); err != nil {
+		k.Log.Warning("Unable to deregister from Kontrol: %s", err)
+		return
+	}
+
+	atomic.StoreInt32(&k.kontrol.registered, 0)
+}
+
 // RegisterToTunnel finds a tunnel proxy kite by asking kontrol then registers
 // itself on proxy. On error, retries forever. On every successful
 // registration, it sends the proxied URL to the registerChan channel. There is
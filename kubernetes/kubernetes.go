@@ -0,0 +1,338 @@
+// Package kubernetes resolves kites running in a Kubernetes cluster from
+// the EndpointSlices of their services, as an alternative to Kontrol:
+//
+//	d, err := kubernetes.NewInCluster(k)
+//	if err != nil {
+//		// not running in a cluster
+//	}
+//
+//	clients, err := d.GetKites(ctx, "app=math")
+//
+// The kites are selected with a label selector of their services. The
+// EndpointSlices inherit the labels of the services, the labels with
+// LabelPrefix, e.g. "kite.koding.com/name", identify the kites:
+//
+//	metadata:
+//	  labels:
+//	    app: math
+//	    kite.koding.com/username: koding
+//	    kite.koding.com/environment: production
+//	    kite.koding.com/name: math
+//
+// The service account of the pod must be allowed to list EndpointSlices.
+package kubernetes
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/koding/kite"
+	"github.com/koding/kite/protocol"
+)
+
+// LabelPrefix is the prefix of labels identifying the kites.
+const LabelPrefix = "kite.koding.com/"
+
+// Paths of the service account files mounted into pods.
+const (
+	TokenFile     = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	CAFile        = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+	NamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+)
+
+// ErrNotInCluster is returned by NewInCluster, when the process
+// is not running in a Kubernetes pod.
+var ErrNotInCluster = errors.New("kubernetes: not running in a cluster")
+
+// Discovery gives clients of kites selected by the labels of their services.
+type Discovery struct {
+	// Kite is the local kite the clients are created with.
+	Kite *kite.Kite
+
+	// APIServer is the URL of the Kubernetes API server.
+	APIServer string
+
+	// Namespace the kites are looked up in.
+	Namespace string
+
+	// Token authenticates requests to the API server. If empty,
+	// TokenFile is read for each request, as the token is rotated.
+	Token string
+
+	// Client makes requests to the API server.
+	Client *http.Client
+
+	// PortName is the name of the port of the service the kites listen on.
+	// If empty, the first port is used.
+	PortName string
+
+	// Scheme is the scheme of the kite URLs, "http" by default.
+	Scheme string
+
+	// Path is the path of the kite URLs, "/kite" by default.
+	Path string
+
+	// Auth gives authentication of the client of the remote kite.
+	// If nil, the clients authenticate with the kite key
+	// of the local kite.
+	Auth func(remote *protocol.Kite) (*kite.Auth, error)
+}
+
+// NewInCluster gives a discovery, which uses the API server and the service
+// account of the pod the process is running in. The kites are looked up
+// in the namespace of the pod.
+func NewInCluster(k *kite.Kite) (*Discovery, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, ErrNotInCluster
+	}
+
+	ca, err := ioutil.ReadFile(CAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("kubernetes: no certificates found in %s", CAFile)
+	}
+
+	namespace, err := ioutil.ReadFile(NamespaceFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Discovery{
+		Kite:      k,
+		APIServer: "https://" + net.JoinHostPort(host, port),
+		Namespace: strings.TrimSpace(string(namespace)),
+		Client: &http.Client{
+			Timeout: k.Config.Timeout,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: pool},
+			},
+		},
+	}, nil
+}
+
+// endpointSliceList is a list of discovery.k8s.io/v1 EndpointSlices.
+type endpointSliceList struct {
+	Items []endpointSlice `json:"items"`
+}
+
+type endpointSlice struct {
+	Metadata struct {
+		Labels map[string]string `json:"labels"`
+	} `json:"metadata"`
+
+	AddressType string `json:"addressType"`
+
+	Endpoints []struct {
+		Addresses  []string `json:"addresses"`
+		Hostname   string   `json:"hostname"`
+		Conditions struct {
+			Ready *bool `json:"ready"`
+		} `json:"conditions"`
+		TargetRef *struct {
+			Name string `json:"name"`
+			UID  string `json:"uid"`
+		} `json:"targetRef"`
+	} `json:"endpoints"`
+
+	Ports []struct {
+		Name string `json:"name"`
+		Port *int   `json:"port"`
+	} `json:"ports"`
+}
+
+// GetKites gives clients of the ready kites of the services selected
+// by the label selector, e.g. "app=math,tier!=canary". The clients
+// are not connected yet.
+//
+// If no kites are found, kite.ErrNoKitesAvailable is returned.
+func (d *Discovery) GetKites(ctx context.Context, selector string) ([]*kite.Client, error) {
+	slices, err := d.endpointSlices(ctx, selector)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		clients []*kite.Client
+		seen    = make(map[string]bool)
+	)
+
+	for _, slice := range slices {
+		if slice.AddressType == "FQDN" {
+			continue
+		}
+
+		port, ok := d.port(&slice)
+		if !ok {
+			continue
+		}
+
+		for _, e := range slice.Endpoints {
+			if e.Conditions.Ready != nil && !*e.Conditions.Ready {
+				continue
+			}
+
+			if len(e.Addresses) == 0 {
+				continue
+			}
+
+			u := &url.URL{
+				Scheme: d.scheme(),
+				Host:   net.JoinHostPort(e.Addresses[0], strconv.Itoa(port)),
+				Path:   d.path(),
+			}
+
+			if seen[u.String()] {
+				continue
+			}
+			seen[u.String()] = true
+
+			remote := kiteFromLabels(slice.Metadata.Labels)
+			remote.Hostname = e.Hostname
+			if e.TargetRef != nil {
+				remote.Hostname = e.TargetRef.Name
+			}
+
+			c := d.Kite.NewClient(u.String())
+			c.Kite = *remote
+			c.Labels = slice.Metadata.Labels
+
+			if c.Auth, err = d.auth(remote); err != nil {
+				return nil, err
+			}
+
+			clients = append(clients, c)
+		}
+	}
+
+	if len(clients) == 0 {
+		return nil, kite.ErrNoKitesAvailable
+	}
+
+	return clients, nil
+}
+
+func (d *Discovery) endpointSlices(ctx context.Context, selector string) ([]endpointSlice, error) {
+	u := fmt.Sprintf("%s/apis/discovery.k8s.io/v1/namespaces/%s/endpointslices?labelSelector=%s",
+		strings.TrimRight(d.APIServer, "/"), url.PathEscape(d.Namespace), url.QueryEscape(selector))
+
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := d.token()
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := d.client().Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		p, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("kubernetes: listing endpoint slices failed: %s: %s", resp.Status, p)
+	}
+
+	var list endpointSliceList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+
+	return list.Items, nil
+}
+
+// port gives the port of the slice the kites listen on.
+func (d *Discovery) port(slice *endpointSlice) (int, bool) {
+	for _, p := range slice.Ports {
+		if p.Port == nil {
+			continue
+		}
+
+		if d.PortName == "" || p.Name == d.PortName {
+			return *p.Port, true
+		}
+	}
+
+	return 0, false
+}
+
+// kiteFromLabels identifies the kite by the labels with LabelPrefix.
+func kiteFromLabels(labels map[string]string) *protocol.Kite {
+	return &protocol.Kite{
+		Username:    labels[LabelPrefix+"username"],
+		Environment: labels[LabelPrefix+"environment"],
+		Name:        labels[LabelPrefix+"name"],
+		Version:     labels[LabelPrefix+"version"],
+		Region:      labels[LabelPrefix+"region"],
+	}
+}
+
+func (d *Discovery) auth(remote *protocol.Kite) (*kite.Auth, error) {
+	if d.Auth != nil {
+		return d.Auth(remote)
+	}
+
+	return &kite.Auth{
+		Type: "kiteKey",
+		Key:  d.Kite.KiteKey(),
+	}, nil
+}
+
+func (d *Discovery) token() (string, error) {
+	if d.Token != "" {
+		return d.Token, nil
+	}
+
+	p, err := ioutil.ReadFile(TokenFile)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(p)), nil
+}
+
+func (d *Discovery) client() *http.Client {
+	if d.Client != nil {
+		return d.Client
+	}
+
+	return http.DefaultClient
+}
+
+func (d *Discovery) scheme() string {
+	if d.Scheme != "" {
+		return d.Scheme
+	}
+
+	return "http"
+}
+
+func (d *Discovery) path() string {
+	if d.Path != "" {
+		return d.Path
+	}
+
+	return "/kite"
+}
@@ -0,0 +1,115 @@
+package kubernetes
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/koding/kite"
+)
+
+const endpointSlices = `{
+  "items": [{
+    "metadata": {
+      "labels": {
+        "app": "math",
+        "kite.koding.com/username": "koding",
+        "kite.koding.com/environment": "production",
+        "kite.koding.com/name": "math"
+      }
+    },
+    "addressType": "IPv4",
+    "endpoints": [
+      {"addresses": ["10.0.0.1"], "conditions": {"ready": true}, "targetRef": {"name": "math-1"}},
+      {"addresses": ["10.0.0.2"], "conditions": {"ready": false}, "targetRef": {"name": "math-2"}},
+      {"addresses": ["10.0.0.3"], "conditions": {}, "targetRef": {"name": "math-3"}}
+    ],
+    "ports": [{"name": "metrics", "port": 9090}, {"name": "kite", "port": 3636}]
+  }, {
+    "metadata": {"labels": {"app": "math"}},
+    "addressType": "IPv6",
+    "endpoints": [
+      {"addresses": ["fd00::1"], "conditions": {"ready": true}}
+    ],
+    "ports": [{"name": "kite", "port": 3636}]
+  }]
+}`
+
+func TestDiscovery_GetKites(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/apis/discovery.k8s.io/v1/namespaces/kites/endpointslices" {
+			http.NotFound(w, r)
+			return
+		}
+
+		if auth := r.Header.Get("Authorization"); auth != "Bearer secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if selector := r.URL.Query().Get("labelSelector"); selector != "app=math" {
+			w.Write([]byte(`{"items": []}`))
+			return
+		}
+
+		w.Write([]byte(endpointSlices))
+	}))
+	defer s.Close()
+
+	k := kite.New("exp", "0.0.1")
+	k.Config.KiteKey = "kitekey"
+
+	d := &Discovery{
+		Kite:      k,
+		APIServer: s.URL,
+		Namespace: "kites",
+		Token:     "secret",
+		PortName:  "kite",
+	}
+
+	clients, err := d.GetKites(context.Background(), "app=math")
+	if err != nil {
+		t.Fatalf("GetKites()=%s", err)
+	}
+
+	var urls []string
+	for _, c := range clients {
+		urls = append(urls, c.URL)
+	}
+
+	want := []string{
+		"http://10.0.0.1:3636/kite",
+		"http://10.0.0.3:3636/kite",
+		"http://[fd00::1]:3636/kite",
+	}
+
+	if !reflect.DeepEqual(urls, want) {
+		t.Fatalf("got %v, want %v", urls, want)
+	}
+
+	c := clients[0]
+
+	if c.Kite.Username != "koding" || c.Kite.Environment != "production" || c.Kite.Name != "math" || c.Kite.Hostname != "math-1" {
+		t.Errorf("got %+v kite", c.Kite)
+	}
+
+	if c.Labels["app"] != "math" {
+		t.Errorf("got %v labels", c.Labels)
+	}
+
+	if c.Auth == nil || c.Auth.Type != "kiteKey" || c.Auth.Key != "kitekey" {
+		t.Errorf("got %+v auth, want kite key", c.Auth)
+	}
+
+	if _, err := d.GetKites(context.Background(), "app=other"); err != kite.ErrNoKitesAvailable {
+		t.Errorf("got %v, want %v", err, kite.ErrNoKitesAvailable)
+	}
+
+	d.Token = "invalid"
+
+	if _, err := d.GetKites(context.Background(), "app=math"); err == nil {
+		t.Error("expected unauthorized request to fail")
+	}
+}
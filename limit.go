@@ -0,0 +1,236 @@
+package kite
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// limitRequestSize limits the size of request bodies read by h, e.g. of
+// the frames sent over XHR, failing the requests exceeding the limit.
+// The size of messages read from WebSocket connections upgraded by h
+// is limited as well. If limit is 0, the size is not limited.
+func limitRequestSize(h http.Handler, limit int64) http.Handler {
+	if limit <= 0 {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.ContentLength > limit {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		if websocket.IsWebSocketUpgrade(req) {
+			if hj, ok := w.(http.Hijacker); ok {
+				w = &limitHijacker{ResponseWriter: w, hj: hj, limit: limit}
+			}
+		}
+
+		req.Body = http.MaxBytesReader(w, req.Body, limit)
+		h.ServeHTTP(w, req)
+	})
+}
+
+// limitHijacker limits the size of WebSocket messages read from the
+// hijacked connection.
+type limitHijacker struct {
+	http.ResponseWriter
+	hj    http.Hijacker
+	limit int64
+}
+
+func (h *limitHijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := h.hj.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	lc := &limitConn{
+		Conn:  conn,
+		r:     brw.Reader,
+		limit: h.limit,
+	}
+
+	return lc, bufio.NewReadWriter(bufio.NewReader(lc), brw.Writer), nil
+}
+
+var errMessageTooLarge = errors.New("websocket: message too large")
+
+// limitConn parses the headers of the WebSocket frames read from the
+// connection and fails the read, which would start a message larger
+// than limit, before its payload is read.
+//
+// Messages compressed with the permessage-deflate extension are
+// inflated once read in full, failing the read of their last bytes
+// if they would inflate to more than limit, before the WebSocket
+// connection inflates them.
+type limitConn struct {
+	net.Conn
+	r     io.Reader
+	limit int64
+
+	hdr       []byte // header of the current frame read so far
+	remaining int64  // payload bytes of the current frame not read yet
+	message   int64  // payload bytes of the current data message
+	err       error
+
+	data       bool    // the current frame is a data frame
+	fin        bool    // the current frame is the final one of the message
+	compressed bool    // the current message is compressed
+	mask       [4]byte // masking key of the current frame
+	masked     int     // payload bytes of the current frame unmasked so far
+	payload    []byte  // unmasked payload of the current compressed message
+}
+
+func (c *limitConn) Read(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	n, err := c.r.Read(p)
+
+	if e := c.scan(p[:n]); e != nil {
+		c.err = e
+		return 0, e
+	}
+
+	return n, err
+}
+
+func (c *limitConn) scan(p []byte) error {
+	for len(p) != 0 {
+		if c.remaining > 0 {
+			n := int64(len(p))
+			if n > c.remaining {
+				n = c.remaining
+			}
+
+			if c.data && c.compressed {
+				for _, b := range p[:n] {
+					c.payload = append(c.payload, b^c.mask[c.masked%4])
+					c.masked++
+				}
+			}
+
+			c.remaining -= n
+			p = p[n:]
+
+			if c.remaining == 0 {
+				if err := c.endFrame(); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		c.hdr = append(c.hdr, p[0])
+		p = p[1:]
+
+		if err := c.parseHeader(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// parseHeader updates the size of the current message once c.hdr holds
+// a complete frame header.
+func (c *limitConn) parseHeader() error {
+	if len(c.hdr) < 2 {
+		return nil
+	}
+
+	n := 2
+	switch c.hdr[1] & 0x7f {
+	case 126:
+		n += 2
+	case 127:
+		n += 8
+	}
+
+	if c.hdr[1]&0x80 != 0 {
+		n += 4 // masking key
+	}
+
+	if len(c.hdr) < n {
+		return nil
+	}
+
+	var size int64
+	switch size = int64(c.hdr[1] & 0x7f); size {
+	case 126:
+		size = int64(binary.BigEndian.Uint16(c.hdr[2:]))
+	case 127:
+		size = int64(binary.BigEndian.Uint64(c.hdr[2:]) & (1<<63 - 1))
+	}
+
+	// Control frames may be interleaved with the fragments of messages,
+	// their size is limited by the protocol.
+	opcode := c.hdr[0] & 0x0f
+	c.data = opcode < 8
+
+	if c.data {
+		if opcode != 0 {
+			c.message = 0
+			c.compressed = c.hdr[0]&0x40 != 0
+			c.payload = c.payload[:0]
+		}
+
+		if c.message += size; c.message > c.limit || c.message < 0 {
+			return errMessageTooLarge
+		}
+	}
+
+	c.fin = c.hdr[0]&0x80 != 0
+	c.mask = [4]byte{}
+	if c.hdr[1]&0x80 != 0 {
+		copy(c.mask[:], c.hdr[n-4:n])
+	}
+	c.masked = 0
+
+	c.hdr = c.hdr[:0]
+	c.remaining = size
+
+	if size == 0 {
+		return c.endFrame()
+	}
+
+	return nil
+}
+
+// endFrame checks the size of the compressed message, once its final
+// frame is read in full.
+func (c *limitConn) endFrame() error {
+	if !c.data || !c.fin || !c.compressed {
+		return nil
+	}
+
+	// The permessage-deflate extension strips the tail of the
+	// final deflate block of every message.
+	const tail = "\x00\x00\xff\xff\x01\x00\x00\xff\xff"
+
+	fr := flate.NewReader(io.MultiReader(bytes.NewReader(c.payload), strings.NewReader(tail)))
+	defer fr.Close()
+
+	n, _ := io.Copy(ioutil.Discard, io.LimitReader(fr, c.limit+1))
+
+	c.compressed = false
+	c.payload = c.payload[:0]
+
+	if n > c.limit {
+		return errMessageTooLarge
+	}
+
+	return nil
+}
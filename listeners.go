@@ -0,0 +1,131 @@
+package kite
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/koding/kite/config"
+)
+
+// listenExtra listens on the addresses of Config.Listeners. The returned
+// listeners are wrapped with TLS for the ones configured to serve TLS.
+func (k *Kite) listenExtra(tlsConfig *tls.Config) ([]net.Listener, error) {
+	var listeners []net.Listener
+
+	for i, cfg := range k.Config.Listeners {
+		if cfg.TLS && tlsConfig == nil {
+			k.closeExtra()
+			return nil, errors.New("kite: TLS listener " + cfg.Addr + " requires TLS to be configured")
+		}
+
+		l, err := k.listenAddr(i, cfg)
+		if err != nil {
+			k.closeExtra()
+			return nil, err
+		}
+
+		k.Log.Info("New listening: %s", l.Addr())
+
+		gl := newGracefulListener(l)
+
+		k.listenerMu.Lock()
+		k.extra = append(k.extra, gl)
+		k.listenerMu.Unlock()
+
+		sl := k.newIPFilterListener(gl)
+		if cfg.TLS {
+			sl = tls.NewListener(sl, tlsConfig)
+		}
+
+		listeners = append(listeners, sl)
+	}
+
+	return listeners, nil
+}
+
+// listenAddr listens on the address of the i-th additional listener,
+// or takes over the one inherited after Restart.
+func (k *Kite) listenAddr(i int, cfg config.Listener) (net.Listener, error) {
+	if k.restart != nil && i < len(k.restart.extra) && k.restart.extra[i] != nil {
+		l := k.restart.extra[i]
+		k.restart.extra[i] = nil
+		return l, nil
+	}
+
+	if path := strings.TrimPrefix(cfg.Addr, "unix://"); path != cfg.Addr {
+		return listenUnix(path, 0)
+	}
+
+	return net.Listen("tcp", cfg.Addr)
+}
+
+func (k *Kite) serveExtra(l net.Listener, h http.Handler) {
+	if err := k.serve(l, h); err != nil && !isClosing(err) {
+		k.Log.Error("Serving on %s failed: %s", l.Addr(), err)
+	}
+}
+
+func (k *Kite) closeExtra() {
+	k.listenerMu.Lock()
+	extra := k.extra
+	k.extra = nil
+	k.listenerMu.Unlock()
+
+	for _, l := range extra {
+		l.Close()
+	}
+}
+
+// listeners gives the main listener, if any, followed by the ones
+// of Config.Listeners.
+func (k *Kite) listeners() []*gracefulListener {
+	k.listenerMu.Lock()
+	defer k.listenerMu.Unlock()
+
+	var listeners []*gracefulListener
+
+	if k.listener != nil {
+		listeners = append(listeners, k.listener)
+	}
+
+	return append(listeners, k.extra...)
+}
+
+// mainListener gives the listener the kite server was started with,
+// nil if it is not started.
+func (k *Kite) mainListener() *gracefulListener {
+	k.listenerMu.Lock()
+	defer k.listenerMu.Unlock()
+
+	return k.listener
+}
+
+// Addrs gives the addresses the kite server listens on, the address
+// of the main listener goes first followed by the ones of Config.Listeners.
+// Addrs must be called after the listeners are initialized, see Port.
+func (k *Kite) Addrs() []net.Addr {
+	var addrs []net.Addr
+
+	for _, l := range k.listeners() {
+		addrs = append(addrs, l.Addr())
+	}
+
+	return addrs
+}
+
+// advertisedURLs gives the URLs of Config.Listeners, which are registered
+// to Kontrol as alternative URLs of the kite.
+func (k *Kite) advertisedURLs() []string {
+	var urls []string
+
+	for _, l := range k.Config.Listeners {
+		if l.URL != "" {
+			urls = append(urls, l.URL)
+		}
+	}
+
+	return urls
+}
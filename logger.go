@@ -1,6 +1,7 @@
 package kite
 
 import (
+	"fmt"
 	"os"
 	"strings"
 
@@ -40,22 +41,121 @@ type Logger interface {
 	Debug(format string, args ...interface{})
 }
 
-// getLogLevel returns the logging level defined via the KITE_LOG_LEVEL
-// environment. It returns Info by default if no environment variable
-// is set.
-func getLogLevel() Level {
-	switch strings.ToUpper(os.Getenv("KITE_LOG_LEVEL")) {
+// FieldLogger is a Logger, which attaches key/value fields to the logged
+// messages, so the messages can be correlated, e.g. by the kite ID
+// or the method name.
+//
+// The kiteslog and kitelogrus packages provide FieldLoggers backed by
+// log/slog and logrus.
+type FieldLogger interface {
+	Logger
+
+	// With gives a logger, which attaches the given fields to every
+	// message. The keyvals are alternating keys and values.
+	With(keyvals ...interface{}) Logger
+}
+
+// WithFields gives a logger, which attaches the given fields to every message
+// logged with l. The keyvals are alternating keys and values.
+//
+// If l is not a FieldLogger, the fields are appended to the messages
+// as key=value pairs.
+func WithFields(l Logger, keyvals ...interface{}) Logger {
+	if len(keyvals) == 0 {
+		return l
+	}
+
+	if fl, ok := l.(FieldLogger); ok {
+		return fl.With(keyvals...)
+	}
+
+	return &fieldLogger{
+		Logger: l,
+		fields: formatFields(keyvals),
+	}
+}
+
+// fieldLogger appends fields to messages of a Logger, which
+// does not support them.
+type fieldLogger struct {
+	Logger
+	fields string
+}
+
+var _ FieldLogger = (*fieldLogger)(nil)
+
+func (l *fieldLogger) Fatal(format string, args ...interface{}) {
+	l.Logger.Fatal("%s%s", fmt.Sprintf(format, args...), l.fields)
+}
+
+func (l *fieldLogger) Error(format string, args ...interface{}) {
+	l.Logger.Error("%s%s", fmt.Sprintf(format, args...), l.fields)
+}
+
+func (l *fieldLogger) Warning(format string, args ...interface{}) {
+	l.Logger.Warning("%s%s", fmt.Sprintf(format, args...), l.fields)
+}
+
+func (l *fieldLogger) Info(format string, args ...interface{}) {
+	l.Logger.Info("%s%s", fmt.Sprintf(format, args...), l.fields)
+}
+
+func (l *fieldLogger) Debug(format string, args ...interface{}) {
+	l.Logger.Debug("%s%s", fmt.Sprintf(format, args...), l.fields)
+}
+
+func (l *fieldLogger) With(keyvals ...interface{}) Logger {
+	return &fieldLogger{
+		Logger: l.Logger,
+		fields: l.fields + formatFields(keyvals),
+	}
+}
+
+// formatFields formats the fields as space-prefixed key=value pairs.
+// A key with no value is given the "!MISSING" value.
+func formatFields(keyvals []interface{}) string {
+	var buf strings.Builder
+
+	for i := 0; i < len(keyvals); i += 2 {
+		var value interface{} = "!MISSING"
+		if i+1 < len(keyvals) {
+			value = keyvals[i+1]
+		}
+
+		fmt.Fprintf(&buf, " %v=%v", keyvals[i], value)
+	}
+
+	return buf.String()
+}
+
+// ParseLevel gives the logging level of the given name, e.g. "DEBUG".
+func ParseLevel(name string) (Level, error) {
+	switch strings.ToUpper(name) {
 	case "DEBUG":
-		return DEBUG
+		return DEBUG, nil
+	case "INFO":
+		return INFO, nil
 	case "WARNING":
-		return WARNING
+		return WARNING, nil
 	case "ERROR":
-		return ERROR
+		return ERROR, nil
 	case "FATAL":
-		return FATAL
+		return FATAL, nil
 	default:
+		return INFO, fmt.Errorf("unknown logging level: %q", name)
+	}
+}
+
+// getLogLevel returns the logging level defined via the KITE_LOG_LEVEL
+// environment. It returns Info by default if no environment variable
+// is set.
+func getLogLevel() Level {
+	level, err := ParseLevel(os.Getenv("KITE_LOG_LEVEL"))
+	if err != nil {
 		return INFO
 	}
+
+	return level
 }
 
 // convertLevel converts a kite level into logging level
@@ -0,0 +1,70 @@
+package kite
+
+import (
+	"fmt"
+	"testing"
+)
+
+// recordLogger records the messages logged with it.
+type recordLogger struct {
+	msgs []string
+}
+
+func (l *recordLogger) Fatal(format string, args ...interface{})   { l.log("FATAL", format, args...) }
+func (l *recordLogger) Error(format string, args ...interface{})   { l.log("ERROR", format, args...) }
+func (l *recordLogger) Warning(format string, args ...interface{}) { l.log("WARNING", format, args...) }
+func (l *recordLogger) Info(format string, args ...interface{})    { l.log("INFO", format, args...) }
+func (l *recordLogger) Debug(format string, args ...interface{})   { l.log("DEBUG", format, args...) }
+
+func (l *recordLogger) log(level, format string, args ...interface{}) {
+	l.msgs = append(l.msgs, level+" "+fmt.Sprintf(format, args...))
+}
+
+func TestWithFields(t *testing.T) {
+	rec := &recordLogger{}
+
+	if l := WithFields(rec); l != Logger(rec) {
+		t.Fatalf("got %v, want the logger without fields", l)
+	}
+
+	l := WithFields(rec, "method", "square", "requestID", "abc")
+	l.Info("called with %d%%", 100)
+	l = WithFields(l, "duration", "1s", "missing")
+	l.Error("failed")
+
+	want := []string{
+		"INFO called with 100% method=square requestID=abc",
+		"ERROR failed method=square requestID=abc duration=1s missing=!MISSING",
+	}
+
+	if len(rec.msgs) != len(want) {
+		t.Fatalf("got %q, want %q", rec.msgs, want)
+	}
+
+	for i := range want {
+		if rec.msgs[i] != want[i] {
+			t.Errorf("got %q, want %q", rec.msgs[i], want[i])
+		}
+	}
+}
+
+func TestRequest_Logger(t *testing.T) {
+	rec := &recordLogger{}
+
+	r := &Request{
+		ID:        "abc",
+		Method:    "square",
+		Username:  "alice",
+		LocalKite: &Kite{Log: rec},
+		Client:    &Client{},
+	}
+	r.Client.Kite.ID = "kite-1"
+
+	r.Logger().Warning("slow")
+
+	want := "WARNING slow method=square requestID=abc kiteID=kite-1 username=alice"
+
+	if len(rec.msgs) != 1 || rec.msgs[0] != want {
+		t.Fatalf("got %q, want %q", rec.msgs, want)
+	}
+}
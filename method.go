@@ -1,16 +1,29 @@
 package kite
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"reflect"
+	"runtime/debug"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/juju/ratelimit"
+	"github.com/koding/kite/config"
+	"github.com/koding/kite/dnode"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // MethodHandling defines how to handle chaining of kite.Handler middlewares.
 // An error breaks the chain regardless of what handling is used. Note that all
 // Pre and Post handlers are executed regardless the handling logic, only the
-// return paramater is defined by the handling mode.
+// return paramater is defined by the handling mode. A handler may end the
+// chain early with a response instead of an error, see Respond.
 type MethodHandling int
 
 const (
@@ -22,6 +35,12 @@ const (
 
 	// ReturnLatest returns the latest response (waterfall behaviour)
 	ReturnLatest
+
+	// ReturnMerged returns the responses merged into a single map. The
+	// responses must be maps with string keys, or nil. The keys of the
+	// responses of later handlers replace the same keys of earlier ones,
+	// nested maps are not merged.
+	ReturnMerged
 )
 
 // Objects implementing the Handler interface can be registered to a method.
@@ -45,6 +64,37 @@ func (h HandlerFunc) ServeKite(r *Request) (interface{}, error) {
 // chained succeeded with non-nil error or not.
 type FinalFunc func(r *Request, resp interface{}, err error) (interface{}, error)
 
+// ErrorFunc is a function called when the handler chain of a method
+// fails, see Method.OnError and Kite.OnError.
+type ErrorFunc func(r *Request, err error)
+
+// Respond gives an error, which makes the handler returning it end the
+// handler chain early with the result, instead of failing the call.
+// The handlers following it are not executed, the final funcs are,
+// receiving the result with a nil error. It is meant for pre-handlers,
+// like caches or authorization shortcuts:
+//
+//	k.PreHandleFunc(func(r *kite.Request) (interface{}, error) {
+//		if v, ok := cache.Get(r.Method, r.Args.Raw); ok {
+//			return nil, kite.Respond(v)
+//		}
+//		return nil, nil
+//	})
+//
+// The result is returned regardless of the MethodHandling of the method.
+func Respond(result interface{}) error {
+	return &earlyResponse{result: result}
+}
+
+// earlyResponse is the error returned by Respond.
+type earlyResponse struct {
+	result interface{}
+}
+
+func (e *earlyResponse) Error() string {
+	return "kite: handler chain ended early with a response"
+}
+
 // Method defines a method and the Handler it is bind to. By default
 // "ReturnMethod" handling is used.
 type Method struct {
@@ -56,40 +106,238 @@ type Method struct {
 	preHandlers  []Handler   // a list of handlers that are executed before the main handler
 	postHandlers []Handler   // a list of handlers that are executed after the main handler
 	finalFuncs   []FinalFunc // a list of final funcs executed upon returning from ServeKite
+	errorFuncs   []ErrorFunc // a list of funcs called when the handler chain fails
 
 	// authenticate defines if a given authenticator function is enabled for
 	// the given auth type in the request.
 	authenticate bool
 
+	// scopes the caller must be granted, set with RequireScope
+	scopes []string
+
+	// control is set for the protocol methods, e.g. kite.cancel, which
+	// are not executed with the goroutines of Config.MaxHandlerGoroutines
+	control bool
+
 	// handling defines how to handle chaining of kite.Handler middlewares.
 	handling MethodHandling
 
-	// initialized is used to indicate whether all pre and post handlers are
-	// initialized.
-	initialized bool
+	// chain holds the handlers executed for calls of the method
+	// (*handlerChain), it is built on the first call
+	chain atomic.Value
+
+	// throttle holds the bucket the method is throttled with
+	// (*methodThrottle), nil if the method is not throttled
+	throttle atomic.Value
+
+	// keyedBucket is used for throttling the method per caller
+	keyedBucket *keyedBucket
+
+	// maxConcurrent and maxQueued configure the limiter, which bounds
+	// the number of calls executed at once
+	maxConcurrent int
+	maxQueued     int
+	limiter       *limiter
+
+	// timeout is the max duration of a single method call, zero means
+	// no limit
+	timeout time.Duration
+
+	// dedupTTL is the time the responses of calls with idempotency
+	// keys are kept for, zero means the calls are not deduplicated
+	dedupTTL time.Duration
+
+	// orderKey is the key of the sequence the responses to the calls
+	// are sent in, empty means the responses are not ordered
+	orderKey string
 
-	// bucket is used for throttling the method by certain rule
+	// argsSchema and resultSchema are the JSON schemas of the argument
+	// and the result of the method, set with Schema
+	argsSchema   map[string]interface{}
+	resultSchema map[string]interface{}
+
+	mu sync.Mutex // serializes changes of the method and its chain
+}
+
+// handlerChain is an immutable snapshot of the handlers and the settings
+// of a method, including the handlers registered for all the methods
+// of the kite, so calls of the method do not contend on locks.
+type handlerChain struct {
+	preHandlers  []Handler
+	postHandlers []Handler
+	finalFuncs   []FinalFunc
+	errorFuncs   []ErrorFunc
+	limiter      *limiter
+	keyedBucket  *keyedBucket
+	scopes       []string
+	handling     MethodHandling
+	timeout      time.Duration
+	dedupTTL     time.Duration
+	orderKey     string
+	gen          uint64 // Kite.chainGen the chain was built with
+}
+
+// methodThrottle is the bucket the method is throttled with.
+type methodThrottle struct {
 	bucket *ratelimit.Bucket
 
-	mu sync.Mutex // protects handler slices
+	// fillInterval and capacity of the bucket, used with the kite's
+	// RateLimiter
+	fillInterval time.Duration
+	capacity     int64
+}
+
+// methodTable is an immutable snapshot of the methods registered
+// with a kite, it is replaced when methods are registered or removed.
+type methodTable struct {
+	handlers map[string]*Method // methods registered with exact names
+	patterns []*Method          // methods registered with wildcard patterns
+	notFound *Method            // method called when no other matches
+}
+
+// clone gives a copy of the table, which can be modified.
+func (t *methodTable) clone() *methodTable {
+	c := &methodTable{
+		handlers: make(map[string]*Method, len(t.handlers)+1),
+		patterns: make([]*Method, len(t.patterns), len(t.patterns)+1),
+		notFound: t.notFound,
+	}
+
+	for name, m := range t.handlers {
+		c.handlers[name] = m
+	}
+
+	copy(c.patterns, t.patterns)
+
+	return c
+}
+
+// methodTable gives the methods registered with the kite.
+func (k *Kite) methodTable() *methodTable {
+	if t, ok := k.methods.Load().(*methodTable); ok {
+		return t
+	}
+
+	return &methodTable{}
+}
+
+// updateMethods replaces the table of registered methods with
+// a modified copy, so calls can look methods up without locking.
+func (k *Kite) updateMethods(update func(*methodTable)) {
+	k.methodsMu.Lock()
+	defer k.methodsMu.Unlock()
+
+	t := k.methodTable().clone()
+	update(t)
+	k.methods.Store(t)
 }
 
 // addHandle is an internal method to add a handler
 func (k *Kite) addHandle(method string, handler Handler) *Method {
+	m := k.newMethod(method, handler)
+
+	k.updateMethods(func(t *methodTable) {
+		if !isPattern(method) {
+			t.handlers[method] = m
+			return
+		}
+
+		for i, p := range t.patterns {
+			if p.name == method {
+				t.patterns[i] = m
+				return
+			}
+		}
+
+		t.patterns = append(t.patterns, m)
+	})
+
+	return m
+}
+
+// Unhandle removes the handler registered for the given method or pattern,
+// so the method can no longer be called. Calls that are already running
+// are not affected.
+//
+// Methods can be registered, replaced and removed while the kite is
+// serving requests.
+func (k *Kite) Unhandle(method string) {
+	k.updateMethods(func(t *methodTable) {
+		if !isPattern(method) {
+			delete(t.handlers, method)
+			return
+		}
+
+		for i, p := range t.patterns {
+			if p.name == method {
+				t.patterns = append(t.patterns[:i], t.patterns[i+1:]...)
+				return
+			}
+		}
+	})
+}
+
+// Methods gives the sorted names of the methods registered with the kite,
+// including the patterns, see MethodInfos for their details.
+func (k *Kite) Methods() []string {
+	t := k.methodTable()
+
+	names := make([]string, 0, len(t.handlers)+len(t.patterns))
+	for name := range t.handlers {
+		names = append(names, name)
+	}
+
+	for _, m := range t.patterns {
+		names = append(names, m.name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+func (k *Kite) newMethod(method string, handler Handler) *Method {
 	authenticate := true
 	if k.Config.DisableAuthentication {
 		authenticate = false
 	}
 
-	m := &Method{
+	return &Method{
 		name:         method,
 		handler:      handler,
 		authenticate: authenticate,
 		handling:     k.MethodHandling,
 	}
+}
 
-	k.handlers[method] = m
-	return m
+// method gives the method which handles calls of the given name. Methods
+// registered with the exact name take precedence over the ones registered
+// with patterns, out of which the longest matching pattern is used.
+// If none matches, the method registered with HandleNotFound is used.
+func (k *Kite) method(name string) (*Method, bool) {
+	t := k.methodTable()
+
+	if m, ok := t.handlers[name]; ok {
+		return m, true
+	}
+
+	var match *Method
+
+	for _, m := range t.patterns {
+		if ok, _ := path.Match(m.name, name); ok && (match == nil || len(m.name) > len(match.name)) {
+			match = m
+		}
+	}
+
+	if match != nil {
+		return match, true
+	}
+
+	return t.notFound, t.notFound != nil
+}
+
+func isPattern(method string) bool {
+	return strings.ContainsAny(method, "*?[")
 }
 
 // DisableAuthentication disables authentication check for this method.
@@ -108,23 +356,164 @@ func (m *Method) DisableAuthentication() *Method {
 // and clients need to be wait until the bucket is filled with time.  For
 // example to have throttle with 30 req/second, you need to have a fillinterval
 // of 33.33 milliseconds.
+//
+// The bucket is kept in memory, unless the kite's RateLimiter is set.
 func (m *Method) Throttle(fillInterval time.Duration, capacity int64) *Method {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	// don't do anything if the bucket is initialized already
-	if m.bucket != nil {
+	if m.getThrottle() != nil {
 		return m
 	}
 
-	m.bucket = ratelimit.NewBucket(
-		fillInterval, // interval
-		capacity,     // token per interval
-	)
+	m.throttle.Store(&methodThrottle{
+		bucket: ratelimit.NewBucket(
+			fillInterval, // interval
+			capacity,     // token per interval
+		),
+		fillInterval: fillInterval,
+		capacity:     capacity,
+	})
+
+	return m
+}
+
+// getThrottle gives the bucket the method is throttled with,
+// or nil if it is not throttled.
+func (m *Method) getThrottle() *methodThrottle {
+	t, _ := m.throttle.Load().(*methodThrottle)
+	return t
+}
+
+// setThrottle replaces the bucket of the method, see Throttle. The method
+// is no longer throttled if capacity is not positive.
+func (m *Method) setThrottle(fillInterval time.Duration, capacity int64) {
+	if capacity <= 0 {
+		m.throttle.Store((*methodThrottle)(nil))
+		return
+	}
+
+	m.throttle.Store(&methodThrottle{
+		bucket:       ratelimit.NewBucket(fillInterval, capacity),
+		fillInterval: fillInterval,
+		capacity:     capacity,
+	})
+}
+
+// ThrottleBy throttles the method per key returned by the key func, e.g.
+// per username of the caller. Each key has its own token bucket, see
+// Throttle for details on the fillInterval and capacity parameters.
+// Buckets of keys that are not used for a while are evicted. The buckets
+// are kept in memory, unless the kite's RateLimiter is set. At most 100000
+// buckets are kept in memory, requests with new keys are throttled once
+// there are that many in use.
+//
+// The ThrottleByUsername, ThrottleByKiteID and ThrottleByRemoteIP funcs
+// can be used as the key func.
+//
+// ThrottleBy can be used together with Throttle, in which case both
+// limits are applied.
+func (m *Method) ThrottleBy(key func(*Request) string, fillInterval time.Duration, capacity int64) *Method {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// don't do anything if the bucket is initialized already
+	if m.keyedBucket != nil {
+		return m
+	}
+
+	m.keyedBucket = newKeyedBucket(key, fillInterval, capacity)
+	m.resetChain()
+
+	return m
+}
+
+// MaxConcurrent limits the number of calls of the method, which are
+// executed at once. Calls exceeding the limit fail with ErrOverloaded,
+// unless queueing is enabled with MaxQueued.
+//
+// Zero or negative n means no limit, which is the default.
+//
+// The limit can be changed while the kite is serving. The calls being
+// executed or queued at the time are bound by the previous limit.
+func (m *Method) MaxConcurrent(n int) *Method {
+	m.mu.Lock()
+	m.maxConcurrent = n
+	m.resetLimiter()
+	m.mu.Unlock()
+
+	return m
+}
+
+// MaxQueued makes up to n calls, exceeding the limit set with
+// MaxConcurrent, wait until earlier calls finish instead of failing.
+// Queued calls fail when the caller disconnects or the call is canceled.
+//
+// Like MaxConcurrent, it can be changed while the kite is serving.
+func (m *Method) MaxQueued(n int) *Method {
+	m.mu.Lock()
+	m.maxQueued = n
+	m.resetLimiter()
+	m.mu.Unlock()
+
+	return m
+}
+
+// controlMethod marks the method as a protocol method, so its calls
+// do not wait for a free handler goroutine, see goMethod.
+func (m *Method) controlMethod() *Method {
+	m.control = true
+	return m
+}
+
+// resetLimiter makes the next call create the limiter with the current
+// limits, it is called with m.mu held.
+func (m *Method) resetLimiter() {
+	m.limiter = nil
+	m.resetChain()
+}
+
+// Handling sets how the response of the method is chosen out of the
+// responses of its handlers, overriding the kite's MethodHandling.
+func (m *Method) Handling(mode MethodHandling) *Method {
+	m.mu.Lock()
+	m.handling = mode
+	m.resetChain()
+	m.mu.Unlock()
+
+	return m
+}
+
+// Timeout limits the execution time of the method. When the handler
+// chain does not finish in the given duration, the context of the request
+// is canceled and the caller receives ErrTimeout error.
+//
+// The handlers are not stopped, they keep running until they return,
+// and the call counts towards MaxConcurrent until then. Handlers must
+// watch r.Ctx() and return once it is done.
+//
+// Zero or negative duration means no limit, which is the default.
+func (m *Method) Timeout(d time.Duration) *Method {
+	m.mu.Lock()
+	m.timeout = d
+	m.resetChain()
+	m.mu.Unlock()
 
 	return m
 }
 
 // PreHandler adds a new kite handler which is executed before the method.
+//
+// The handlers of the method are executed in the order they were added,
+// before the ones added with Kite.PreHandle. They may be added while
+// the kite is serving, the calls received afterwards execute them.
 func (m *Method) PreHandle(handler Handler) *Method {
+	m.mu.Lock()
 	m.preHandlers = append(m.preHandlers, handler)
+	m.resetChain()
+	m.mu.Unlock()
+
 	return m
 }
 
@@ -135,8 +524,16 @@ func (m *Method) PreHandleFunc(handler HandlerFunc) *Method {
 }
 
 // PostHandle adds a new kite handler which is executed after the method.
+//
+// The handlers of the method are executed in the order they were added,
+// before the ones added with Kite.PostHandle. They may be added while
+// the kite is serving, like pre-handlers.
 func (m *Method) PostHandle(handler Handler) *Method {
+	m.mu.Lock()
 	m.postHandlers = append(m.postHandlers, handler)
+	m.resetChain()
+	m.mu.Unlock()
+
 	return m
 }
 
@@ -150,21 +547,132 @@ func (m *Method) PostHandleFunc(handler HandlerFunc) *Method {
 // after pre-, handler and post- functions for the given method.
 //
 // It receives a result and an error from last handler that
-// got executed prior to calling final func.
+// got executed prior to calling final func. Final funcs of the method
+// are called before the ones registered with Kite.FinalFunc.
 func (m *Method) FinalFunc(f FinalFunc) *Method {
+	m.mu.Lock()
 	m.finalFuncs = append(m.finalFuncs, f)
+	m.resetChain()
+	m.mu.Unlock()
+
+	return m
+}
+
+// OnError registers a function, which is called whenever the handler chain
+// of the method fails, with the request and the error returned to the
+// caller, e.g. for reporting errors. The error is the one left by the
+// final funcs, panics and timeouts of the handlers are reported as well.
+// The functions are called before the ones registered with Kite.OnError.
+func (m *Method) OnError(f ErrorFunc) *Method {
+	m.mu.Lock()
+	m.errorFuncs = append(m.errorFuncs, f)
+	m.resetChain()
+	m.mu.Unlock()
+
 	return m
 }
 
+// handlerChain gives the handlers executed for calls of the method,
+// along with the ones registered with the kite k. They are gathered
+// on the first call, and again after the handlers of k changed.
+func (m *Method) handlerChain(k *Kite) *handlerChain {
+	var gen uint64
+	if k != nil {
+		gen = atomic.LoadUint64(&k.chainGen)
+	}
+
+	if c, _ := m.chain.Load().(*handlerChain); c != nil && c.gen == gen {
+		return c
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if c, _ := m.chain.Load().(*handlerChain); c != nil && c.gen == gen {
+		return c
+	}
+
+	if m.maxConcurrent > 0 && m.limiter == nil {
+		m.limiter = newLimiter(m.maxConcurrent, m.maxQueued)
+	}
+
+	c := &handlerChain{
+		preHandlers:  append([]Handler(nil), m.preHandlers...),
+		postHandlers: append([]Handler(nil), m.postHandlers...),
+		finalFuncs:   append([]FinalFunc(nil), m.finalFuncs...),
+		errorFuncs:   append([]ErrorFunc(nil), m.errorFuncs...),
+		limiter:      m.limiter,
+		keyedBucket:  m.keyedBucket,
+		scopes:       append([]string(nil), m.scopes...),
+		handling:     m.handling,
+		timeout:      m.timeout,
+		dedupTTL:     m.dedupTTL,
+		orderKey:     m.orderKey,
+	}
+
+	if k != nil {
+		k.chainMu.RLock()
+		c.preHandlers = append(c.preHandlers, k.preHandlers...)
+		c.postHandlers = append(c.postHandlers, k.postHandlers...)
+		c.finalFuncs = append(c.finalFuncs, k.finalFuncs...)
+		c.gen = atomic.LoadUint64(&k.chainGen)
+		k.chainMu.RUnlock()
+	}
+
+	m.chain.Store(c)
+
+	return c
+}
+
+// resetChain makes the next call gather the handlers again,
+// it is called with m.mu held.
+func (m *Method) resetChain() {
+	if c, _ := m.chain.Load().(*handlerChain); c != nil {
+		m.chain.Store((*handlerChain)(nil))
+	}
+}
+
 // Handle registers the handler for the given method. The handler is called
 // when a method call is received from a Kite.
+//
+// The method may be a pattern, e.g. "fs.*", in which case the handler
+// is called for every method matching the pattern, that has no handler
+// registered with its exact name. The pattern syntax is the one of
+// path.Match, where '*' matches dots as well. Request.Method holds
+// the name of the called method.
 func (k *Kite) Handle(method string, handler Handler) *Method {
 	return k.addHandle(method, handler)
 }
 
+// HandleNotFound registers the handler, which is called when no other
+// handler matches the called method. Request.Method holds the name
+// of the called method. A nil handler removes the registered one.
+func (k *Kite) HandleNotFound(handler Handler) *Method {
+	var m *Method
+	if handler != nil {
+		m = k.newMethod("", handler)
+	}
+
+	k.updateMethods(func(t *methodTable) {
+		t.notFound = m
+	})
+
+	return m
+}
+
+// HandleNotFoundFunc is the same as HandleNotFound. It accepts
+// a HandlerFunc.
+func (k *Kite) HandleNotFoundFunc(handler HandlerFunc) *Method {
+	if handler == nil {
+		return k.HandleNotFound(nil)
+	}
+
+	return k.HandleNotFound(handler)
+}
+
 // HandleFunc registers a handler to run when a method call is received from a
 // Kite. It returns a *Method option to further modify certain options on a
-// method call
+// method call. The method may be a pattern, see Handle.
 func (k *Kite) HandleFunc(method string, handler HandlerFunc) *Method {
 	return k.addHandle(method, handler)
 }
@@ -172,9 +680,16 @@ func (k *Kite) HandleFunc(method string, handler HandlerFunc) *Method {
 // PreHandle registers an handler which is executed before a kite.Handler
 // method is executed. Calling PreHandle multiple times registers multiple
 // handlers. A non-error return triggers the execution of the next handler. The
-// execution order is FIFO.
+// execution order is FIFO, the handlers registered with the method's
+// PreHandle are executed first.
+//
+// It is safe to call PreHandle while the kite is serving, e.g. by plugins
+// loaded at runtime. Calls received afterwards execute the handler, calls
+// in progress do not.
 func (k *Kite) PreHandle(handler Handler) {
-	k.preHandlers = append(k.preHandlers, handler)
+	k.updateHandlers(func() {
+		k.preHandlers = append(k.preHandlers, handler)
+	})
 }
 
 // PreHandleFunc is the same as PreHandle. It accepts a HandlerFunc.
@@ -185,9 +700,14 @@ func (k *Kite) PreHandleFunc(handler HandlerFunc) {
 // PostHandle registers an handler which is executed after a kite.Handler
 // method is executed. Calling PostHandler multiple times registers multiple
 // handlers. A non-error return triggers the execution of the next handler. The
-// execution order is FIFO.
+// execution order is FIFO, the handlers registered with the method's
+// PostHandle are executed first.
+//
+// It is safe to call PostHandle while the kite is serving, see PreHandle.
 func (k *Kite) PostHandle(handler Handler) {
-	k.postHandlers = append(k.postHandlers, handler)
+	k.updateHandlers(func() {
+		k.postHandlers = append(k.postHandlers, handler)
+	})
 }
 
 // PostHandleFunc is the same as PostHandle. It accepts a HandlerFunc.
@@ -200,84 +720,316 @@ func (k *Kite) PostHandleFunc(handler HandlerFunc) {
 //
 // It receives a result and an error from last handler that
 // got executed prior to calling final func.
+//
+// It is safe to call FinalFunc while the kite is serving, see PreHandle.
 func (k *Kite) FinalFunc(f FinalFunc) {
-	k.finalFuncs = append(k.finalFuncs, f)
+	k.updateHandlers(func() {
+		k.finalFuncs = append(k.finalFuncs, f)
+	})
 }
 
-func (m *Method) ServeKite(r *Request) (interface{}, error) {
-	var firstResp interface{}
-	var resp interface{}
-	var err error
+// updateHandlers applies fn, which changes the handlers executed for all
+// the methods, and makes the methods gather their handlers again.
+func (k *Kite) updateHandlers(fn func()) {
+	k.chainMu.Lock()
+	fn()
+	atomic.AddUint64(&k.chainGen, 1)
+	k.chainMu.Unlock()
+}
 
-	// first execute preHandlers. make a copy of the handler to avoid race
-	// conditions
-	m.mu.Lock()
-	preHandlers := make([]Handler, len(m.preHandlers))
-	for i, handler := range m.preHandlers {
-		preHandlers[i] = handler
+func (m *Method) ServeKite(r *Request) (resp interface{}, err error) {
+	ctx, span := r.LocalKite.startSpan(r.Ctx(), r.Method, trace.SpanKindServer)
+	defer func() { endSpan(span, err) }()
+
+	r.ctx = ctx
+
+	defer func() {
+		if v := recover(); v != nil {
+			resp, err = nil, recoverPanic(r, v)
+		}
+
+		if err != nil {
+			m.handlerChain(r.LocalKite).onError(r, err)
+		}
+	}()
 
+	if timeout := m.handlerChain(r.LocalKite).timeout; timeout > 0 {
+		return m.serveTimeout(r, timeout)
 	}
-	m.mu.Unlock()
 
-	for _, handler := range preHandlers {
+	return m.serveKite(r)
+}
+
+// serveTimeout runs the handler chain with the request's context
+// bounded by the method timeout.
+func (m *Method) serveTimeout(r *Request, timeout time.Duration) (interface{}, error) {
+	ctx, cancel := context.WithTimeout(r.Ctx(), timeout)
+	defer cancel()
+
+	r.ctx = ctx
+
+	done := make(chan callResult, 1)
+
+	// The handler counts as an in-flight call until it returns, so
+	// Shutdown waits for it after the call timed out. The call itself
+	// is counted meanwhile, see serveMethod. The same goes for its
+	// MaxConcurrent slot, only the reply is sent early.
+	r.LocalKite.calls.Add(1)
+	r.slot.hold()
+
+	go func() {
+		defer r.LocalKite.endCall()
+		defer r.slot.release()
+
+		// The handler runs in its own goroutine, recover here so
+		// it won't take the whole process down.
+		defer func() {
+			if v := recover(); v != nil {
+				done <- callResult{nil, recoverPanic(r, v)}
+			}
+		}()
+
+		resp, err := m.serveKite(r)
+		done <- callResult{resp, err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.resp, res.err
+	case <-ctx.Done():
+		r.detached = done
+
+		if ctx.Err() != context.DeadlineExceeded {
+			// Parent context got canceled, the caller is gone.
+			return nil, ctx.Err()
+		}
+
+		// The handler keeps running until it notices
+		// the canceled context, see Timeout.
+		err := *ErrTimeout
+		return nil, &err
+	}
+}
+
+// callResult is the response of the handler chain of a method.
+type callResult struct {
+	resp interface{}
+	err  error
+}
+
+// recoverPanic converts the value recovered from a panicking handler
+// into an error and passes it to the kite's PanicHandler and ErrorReporter.
+//
+// Argument errors caused by the Must* methods of dnode.Partial
+// are not considered panics and are returned as is.
+func recoverPanic(r *Request, v interface{}) *Error {
+	switch v.(type) {
+	case *Error, *dnode.ArgumentError:
+		return createError(r, v)
+	}
+
+	stack := debug.Stack()
+
+	r.Logger().Error("Method %q panicked: %v\n%s", r.Method, v, stack)
+
+	if h := r.LocalKite.PanicHandler; h != nil {
+		func() {
+			defer nopRecover()
+			h(r, v, stack)
+		}()
+	}
+
+	err := createError(r, &Error{
+		Type:    "panicError",
+		Message: fmt.Sprint(v),
+	})
+
+	r.report(err, v, stack)
+
+	return err
+}
+
+// report passes the error the handler chain failed with, or the panic
+// of the handler, to the kite's ErrorReporter.
+func (r *Request) report(err error, panicked interface{}, stack []byte) {
+	reporter := r.LocalKite.Config.ErrorReporter
+	if reporter == nil {
+		return
+	}
+
+	rep := &config.ErrorReport{
+		Err:       err,
+		Panic:     panicked,
+		Stack:     stack,
+		Method:    r.Method,
+		RequestID: r.ID,
+		Username:  r.Username,
+		Kite:      *r.LocalKite.Kite(),
+		Context:   r.Ctx(),
+		Time:      time.Now(),
+	}
+
+	if r.Client != nil {
+		rep.Caller = r.Client.Kite
+	}
+
+	defer nopRecover()
+	reporter.Report(rep)
+}
+
+func (m *Method) serveKite(r *Request) (interface{}, error) {
+	defer r.watchSlowCall()()
+
+	var resp interface{}
+	var err error
+
+	chain := m.handlerChain(r.LocalKite)
+	resps := responses{handling: chain.handling}
+
+	// first execute preHandlers
+	for _, handler := range chain.preHandlers {
 		resp, err = handler.ServeKite(r)
 		if err != nil {
-			return m.final(r, nil, err)
+			return chain.end(r, err)
 		}
 
-		if m.handling == ReturnFirst && resp != nil && firstResp == nil {
-			firstResp = resp
+		if err := resps.add(resp); err != nil {
+			return chain.final(r, nil, err)
 		}
 	}
 
-	preHandlers = nil // garbage collect it
+	// Do not run the handler if the caller is not waiting for
+	// the response anymore.
+	if r.Ctx().Err() == context.DeadlineExceeded {
+		e := *ErrDeadlineExceeded
+		return chain.final(r, nil, &e)
+	}
 
 	// now call our base handler
+	r.invoked = true
 	resp, err = m.handler.ServeKite(r)
 	if err != nil {
-		return m.final(r, nil, err)
+		return chain.end(r, err)
 	}
 
 	// also save it dependent on the handling mechanism
 	methodResp := resp
 
-	if m.handling == ReturnFirst && resp != nil && firstResp == nil {
-		firstResp = resp
+	if err := resps.add(resp); err != nil {
+		return chain.final(r, nil, err)
 	}
 
 	// and finally return our postHandlers
-	m.mu.Lock()
-	postHandlers := make([]Handler, len(m.postHandlers))
-	for i, handler := range m.postHandlers {
-		postHandlers[i] = handler
-	}
-	m.mu.Unlock()
-
-	for _, handler := range postHandlers {
+	for _, handler := range chain.postHandlers {
 		resp, err = handler.ServeKite(r)
 		if err != nil {
-			return m.final(r, nil, err)
+			return chain.end(r, err)
 		}
 
-		if m.handling == ReturnFirst && resp != nil && firstResp == nil {
-			firstResp = resp
+		if err := resps.add(resp); err != nil {
+			return chain.final(r, nil, err)
 		}
 	}
 
-	postHandlers = nil // garbage collect it
-
-	switch m.handling {
+	switch chain.handling {
 	case ReturnMethod:
 		resp = methodResp
 	case ReturnFirst:
-		resp = firstResp
+		resp = resps.first
+	case ReturnMerged:
+		resp = nil
+		if resps.merged != nil {
+			resp = resps.merged
+		}
+	}
+
+	return chain.final(r, resp, nil)
+}
+
+// responses collects the responses of the handlers of a chain,
+// which are needed by the handling.
+type responses struct {
+	handling MethodHandling
+	first    interface{}
+	merged   map[string]interface{}
+}
+
+func (rs *responses) add(resp interface{}) error {
+	switch rs.handling {
+	case ReturnFirst:
+		if resp != nil && rs.first == nil {
+			rs.first = resp
+		}
+	case ReturnMerged:
+		return rs.merge(resp)
+	}
+
+	return nil
+}
+
+// merge merges the map resp into the merged response.
+func (rs *responses) merge(resp interface{}) error {
+	if p, ok := resp.(*dnode.Partial); ok {
+		var v map[string]interface{}
+		if err := p.Unmarshal(&v); err != nil {
+			return fmt.Errorf("kite: unable to merge response: %s", err)
+		}
+
+		resp = v
+	}
+
+	v := reflect.ValueOf(resp)
+
+	if !v.IsValid() || (v.Kind() == reflect.Map && v.IsNil()) {
+		return nil
+	}
+
+	if v.Kind() != reflect.Map || v.Type().Key().Kind() != reflect.String {
+		return fmt.Errorf("kite: unable to merge response of %T type, it is not a map with string keys", resp)
+	}
+
+	if rs.merged == nil {
+		rs.merged = make(map[string]interface{}, v.Len())
+	}
+
+	for it := v.MapRange(); it.Next(); {
+		rs.merged[it.Key().String()] = it.Value().Interface()
+	}
+
+	return nil
+}
+
+// end ends the chain with the error a handler returned, or with
+// the result passed to Respond.
+func (c *handlerChain) end(r *Request, err error) (interface{}, error) {
+	var e *earlyResponse
+	if errors.As(err, &e) {
+		return c.final(r, e.result, nil)
+	}
+
+	return c.final(r, nil, err)
+}
+
+// onError calls the functions registered with OnError, of the method
+// and of the kite, and reports the error. Panics are reported
+// by recoverPanic.
+func (c *handlerChain) onError(r *Request, err error) {
+	if !errors.Is(err, ErrPanic) {
+		r.report(err, nil, nil)
+	}
+
+	for _, f := range c.errorFuncs {
+		func() {
+			defer nopRecover()
+			f(r, err)
+		}()
 	}
 
-	return m.final(r, resp, nil)
+	r.LocalKite.callOnErrorHandlers(r, err)
 }
 
-func (m *Method) final(r *Request, resp interface{}, err error) (interface{}, error) {
-	for _, f := range m.finalFuncs {
+func (c *handlerChain) final(r *Request, resp interface{}, err error) (interface{}, error) {
+	for _, f := range c.finalFuncs {
 		resp, err = f(r, resp, err)
 	}
 	return resp, err
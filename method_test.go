@@ -1,10 +1,25 @@
 package kite
 
 import (
+	"bytes"
+	"context"
 	"errors"
+	"fmt"
+	"io"
+	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/koding/kite/config"
+	"github.com/koding/kite/dnode"
+	"github.com/koding/kite/kitekey"
+	"github.com/koding/kite/protocol"
+	"github.com/koding/kite/testkeys"
+	"github.com/koding/kite/testutil"
 )
 
 func TestMethod_Throttling(t *testing.T) {
@@ -130,6 +145,77 @@ func TestMethod_First(t *testing.T) {
 
 }
 
+func TestMethod_Handling(t *testing.T) {
+	k := New("testkite", "0.0.1")
+	k.Config.DisableAuthentication = true
+
+	k.PreHandleFunc(func(r *Request) (interface{}, error) {
+		return map[string]interface{}{"user": "alice", "role": "guest"}, nil
+	})
+
+	k.HandleFunc("merged", func(r *Request) (interface{}, error) {
+		return map[string]string{"role": "admin", "handler": "merged"}, nil
+	}).Handling(ReturnMerged)
+
+	k.HandleFunc("first", func(r *Request) (interface{}, error) {
+		return "handler", nil
+	}).Handling(ReturnFirst)
+
+	k.HandleFunc("method", func(r *Request) (interface{}, error) {
+		return "handler", nil
+	})
+
+	k.HandleFunc("invalid", func(r *Request) (interface{}, error) {
+		return "not a map", nil
+	}).Handling(ReturnMerged)
+
+	go k.Run()
+	defer k.Close()
+	<-k.ServerReadyNotify()
+
+	c := New("exp", "0.0.1").NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", k.Port()))
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	result, err := c.TellWithTimeout("merged", 4*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got map[string]string
+	result.MustUnmarshal(&got)
+
+	want := map[string]string{"user": "alice", "role": "admin", "handler": "merged"}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("merged: got %v, want %v", got, want)
+	}
+
+	result, err = c.TellWithTimeout("first", 4*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := result.MustMap()["user"]; !ok {
+		t.Errorf("first: got %s, want the response of the pre-handler", result.Raw)
+	}
+
+	result, err = c.TellWithTimeout("method", 4*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s := result.MustString(); s != "handler" {
+		t.Errorf("method: got %q, want %q", s, "handler")
+	}
+
+	if _, err := c.TellWithTimeout("invalid", 4*time.Second); err == nil {
+		t.Error("invalid: expected the merge to fail")
+	}
+}
+
 func TestMethod_Error(t *testing.T) {
 	k := New("testkite", "0.0.1")
 	k.Config.DisableAuthentication = true
@@ -166,6 +252,194 @@ func TestMethod_Error(t *testing.T) {
 	}
 }
 
+func TestMethod_ErrorWrapping(t *testing.T) {
+	errNotFound := &Error{Type: "notFound", CodeVal: "user.notFound"}
+
+	k := New("testkite", "0.0.1")
+	k.Config.DisableAuthentication = true
+
+	k.HandleFunc("user", func(r *Request) (interface{}, error) {
+		err := errNotFound.WithDetails(map[string]string{"user": "alice"})
+		return nil, fmt.Errorf("loading user: %w", err)
+	})
+
+	go k.Run()
+	defer k.Close()
+	<-k.ServerReadyNotify()
+
+	c := New("exp", "0.0.1").NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", k.Port()))
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	_, err := c.TellWithTimeout("user", 4*time.Second)
+
+	if !errors.Is(err, errNotFound) {
+		t.Fatalf("got %#v, want it to wrap %#v", err, errNotFound)
+	}
+
+	if errors.Is(err, &Error{CodeVal: "group.notFound"}) {
+		t.Fatal("want error not to match other code")
+	}
+
+	if e := err.(*Error); e.Type != "genericError" || !strings.HasPrefix(e.Message, "loading user: ") {
+		t.Fatalf("got %+v", e)
+	}
+
+	var e *Error
+	if !errors.As(err.(*Error).Cause, &e) || e.CodeVal != "user.notFound" {
+		t.Fatalf("got %+v, want cause with user.notFound code", err.(*Error).Cause)
+	}
+
+	var details struct {
+		User string `json:"user"`
+	}
+
+	if err := e.UnmarshalDetails(&details); err != nil {
+		t.Fatal(err)
+	}
+
+	if details.User != "alice" {
+		t.Fatalf("got %q, want %q", details.User, "alice")
+	}
+}
+
+func TestMethod_Respond(t *testing.T) {
+	k := New("testkite", "0.0.1")
+	k.Config.DisableAuthentication = true
+
+	var handled, posted int32
+	var final interface{}
+
+	k.PreHandleFunc(func(r *Request) (interface{}, error) {
+		if r.Args.One().MustString() == "cached" {
+			return nil, Respond("from cache")
+		}
+		return nil, nil
+	})
+
+	k.HandleFunc("get", func(r *Request) (interface{}, error) {
+		atomic.AddInt32(&handled, 1)
+		return "from handler", nil
+	}).PostHandleFunc(func(r *Request) (interface{}, error) {
+		atomic.AddInt32(&posted, 1)
+		return nil, nil
+	}).FinalFunc(func(r *Request, resp interface{}, err error) (interface{}, error) {
+		if err != nil {
+			t.Errorf("final func got %s", err)
+		}
+		final = resp
+		return resp, err
+	})
+
+	go k.Run()
+	defer k.Close()
+	<-k.ServerReadyNotify()
+
+	c := New("exp", "0.0.1").NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", k.Port()))
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	cases := []struct {
+		arg     string
+		want    string
+		handled int32
+	}{
+		{"cached", "from cache", 0},
+		{"other", "from handler", 1},
+	}
+
+	for _, cas := range cases {
+		atomic.StoreInt32(&handled, 0)
+		atomic.StoreInt32(&posted, 0)
+
+		res, err := c.TellWithTimeout("get", 4*time.Second, cas.arg)
+		if err != nil {
+			t.Fatalf("%s: %s", cas.arg, err)
+		}
+
+		if s := res.MustString(); s != cas.want {
+			t.Errorf("%s: got %q, want %q", cas.arg, s, cas.want)
+		}
+
+		if final != cas.want {
+			t.Errorf("%s: final func got %v, want %q", cas.arg, final, cas.want)
+		}
+
+		if n := atomic.LoadInt32(&handled); n != cas.handled {
+			t.Errorf("%s: got %d handler calls, want %d", cas.arg, n, cas.handled)
+		}
+
+		if n := atomic.LoadInt32(&posted); n != cas.handled {
+			t.Errorf("%s: got %d post handler calls, want %d", cas.arg, n, cas.handled)
+		}
+	}
+}
+
+func TestKite_OnError(t *testing.T) {
+	k := New("testkite", "0.0.1")
+	k.Config.DisableAuthentication = true
+
+	var (
+		mu       sync.Mutex
+		reported []string
+	)
+
+	report := func(scope string) ErrorFunc {
+		return func(r *Request, err error) {
+			mu.Lock()
+			reported = append(reported, scope+" "+r.Method+": "+err.(*Error).Type)
+			mu.Unlock()
+		}
+	}
+
+	k.OnError(report("kite"))
+
+	k.HandleFunc("fail", func(r *Request) (interface{}, error) {
+		return nil, &Error{Type: "failed"}
+	}).OnError(report("method"))
+
+	k.HandleFunc("panic", func(r *Request) (interface{}, error) {
+		panic("boom")
+	})
+
+	k.HandleFunc("ok", func(r *Request) (interface{}, error) {
+		return "ok", nil
+	}).PreHandleFunc(func(r *Request) (interface{}, error) {
+		return nil, Respond("early")
+	})
+
+	go k.Run()
+	defer k.Close()
+	<-k.ServerReadyNotify()
+
+	c := New("exp", "0.0.1").NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", k.Port()))
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for _, method := range []string{"fail", "panic", "ok"} {
+		c.TellWithTimeout(method, 4*time.Second)
+	}
+
+	want := []string{
+		"method fail: failed",
+		"kite fail: failed",
+		"kite panic: panicError",
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if !reflect.DeepEqual(reported, want) {
+		t.Fatalf("got %v, want %v", reported, want)
+	}
+}
+
 func TestMethod_Base(t *testing.T) {
 	k := New("testkite", "0.0.1")
 	k.Config.DisableAuthentication = true
@@ -245,3 +519,1992 @@ func TestMethod_Base(t *testing.T) {
 	}
 
 }
+
+func TestMethod_Context(t *testing.T) {
+	k := New("testkite", "0.0.1")
+	k.Config.DisableAuthentication = true
+
+	canceled := make(chan error, 1)
+
+	k.HandleFunc("block", func(r *Request) (interface{}, error) {
+		select {
+		case <-r.Ctx().Done():
+			canceled <- r.Ctx().Err()
+		case <-time.After(10 * time.Second):
+			canceled <- errors.New("context was not canceled")
+		}
+		return nil, nil
+	})
+
+	go k.Run()
+	defer k.Close()
+	<-k.ServerReadyNotify()
+
+	c := New("exp", "0.0.1").NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", k.Port()))
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+
+	c.Go("block")
+
+	// give the request a chance to reach the handler
+	time.Sleep(500 * time.Millisecond)
+	c.Close()
+
+	select {
+	case err := <-canceled:
+		if err != context.Canceled {
+			t.Fatalf("got %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(15 * time.Second):
+		t.Fatal("timed out waiting for the handler")
+	}
+}
+
+func TestMethod_Timeout(t *testing.T) {
+	k := New("testkite", "0.0.1")
+	k.Config.DisableAuthentication = true
+
+	canceled := make(chan struct{})
+
+	k.HandleFunc("slow", func(r *Request) (interface{}, error) {
+		<-r.Ctx().Done()
+		close(canceled)
+		return "too late", nil
+	}).Timeout(500 * time.Millisecond)
+
+	go k.Run()
+	defer k.Close()
+	<-k.ServerReadyNotify()
+
+	c := New("exp", "0.0.1").NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", k.Port()))
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	_, err := c.TellWithTimeout("slow", 4*time.Second)
+	if err == nil {
+		t.Fatal("expected timeout error, got nil")
+	}
+
+	kErr, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("got %T, want *Error", err)
+	}
+
+	if kErr.Type != ErrTimeout.Type || kErr.Message != ErrTimeout.Message {
+		t.Fatalf("got %+v, want %+v", kErr, ErrTimeout)
+	}
+
+	if !errors.Is(err, ErrTimeout) || errors.Is(err, ErrDeadlineExceeded) {
+		t.Fatalf("got %+v, want it to match ErrTimeout only", kErr)
+	}
+
+	select {
+	case <-canceled:
+	case <-time.After(4 * time.Second):
+		t.Fatal("handler context was not canceled")
+	}
+}
+
+func TestMethod_TimeoutMaxConcurrent(t *testing.T) {
+	k := New("testkite", "0.0.1")
+	k.Config.DisableAuthentication = true
+
+	unblock := make(chan struct{})
+	returned := make(chan struct{})
+
+	k.HandleFunc("slow", func(r *Request) (interface{}, error) {
+		select {
+		case <-unblock:
+			return "ok", nil
+		default:
+		}
+
+		<-unblock
+		returned <- struct{}{}
+		return "too late", nil
+	}).Timeout(200 * time.Millisecond).MaxConcurrent(1)
+
+	go k.Run()
+	defer k.Close()
+	<-k.ServerReadyNotify()
+
+	c := New("exp", "0.0.1").NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", k.Port()))
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := c.TellWithTimeout("slow", 4*time.Second); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("got %v, want %v", err, ErrTimeout)
+	}
+
+	// The timed out handler still runs, so it keeps the only slot.
+	if _, err := c.TellWithTimeout("slow", 4*time.Second); !errors.Is(err, ErrOverloaded) {
+		t.Fatalf("got %v, want %v", err, ErrOverloaded)
+	}
+
+	close(unblock)
+
+	select {
+	case <-returned:
+	case <-time.After(4 * time.Second):
+		t.Fatal("timed out waiting for the handler")
+	}
+
+	// The slot is released once the handler returns.
+	deadline := time.Now().Add(4 * time.Second)
+	for {
+		_, err := c.TellWithTimeout("slow", 4*time.Second)
+		if err == nil {
+			break
+		}
+
+		if !errors.Is(err, ErrOverloaded) || time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMethod_Stream(t *testing.T) {
+	k := New("testkite", "0.0.1")
+	k.Config.DisableAuthentication = true
+
+	data := strings.Repeat("kite", 3*streamChunkSize*streamWindow)
+	k.Config.MaxResponseSize = int64(len(data))
+
+	k.HandleFunc("large", func(r *Request) (interface{}, error) {
+		return strings.NewReader(data + "kite"), nil
+	})
+
+	k.HandleFunc("stream", func(r *Request) (interface{}, error) {
+		s := NewStream()
+
+		go func() {
+			_, err := io.Copy(s, strings.NewReader(data))
+			s.CloseWithError(err)
+		}()
+
+		return s, nil
+	})
+
+	go k.Run()
+	defer k.Close()
+	<-k.ServerReadyNotify()
+
+	c := New("exp", "0.0.1").NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", k.Port()))
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var buf bytes.Buffer
+
+	result, err := c.TellStream("stream", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var res StreamResult
+	if err := result.Unmarshal(&res); err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Size != int64(len(data)) {
+		t.Errorf("got size %d, want %d", res.Size, len(data))
+	}
+
+	if buf.String() != data {
+		t.Errorf("got %d bytes of data, want %d", buf.Len(), len(data))
+	}
+
+	// Without a stream callback the whole response is sent at once.
+	result, err = c.TellWithTimeout("stream", 4*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var p []byte
+	if err := result.Unmarshal(&p); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(p) != data {
+		t.Errorf("got %d bytes of data, want %d", len(p), len(data))
+	}
+
+	// Responses sent at once are limited, streamed ones are not.
+	_, err = c.TellWithTimeout("large", 4*time.Second)
+	if err == nil || !strings.Contains(err.Error(), "exceeds the size limit") {
+		t.Fatalf("got %v, want size limit error", err)
+	}
+
+	buf.Reset()
+
+	if _, err := c.TellStream("large", &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.Len() != len(data)+4 {
+		t.Errorf("got %d bytes of data, want %d", buf.Len(), len(data)+4)
+	}
+}
+
+func TestMethod_Progress(t *testing.T) {
+	k := New("testkite", "0.0.1")
+	k.Config.DisableAuthentication = true
+
+	k.HandleFunc("provision", func(r *Request) (interface{}, error) {
+		for _, p := range []float64{0, 50, 100} {
+			if err := r.Progress(p, fmt.Sprintf("step %.0f", p)); err != nil {
+				return nil, err
+			}
+		}
+
+		return "done", nil
+	})
+
+	go k.Run()
+	defer k.Close()
+	<-k.ServerReadyNotify()
+
+	c := New("exp", "0.0.1").NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", k.Port()))
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var reports []Progress
+
+	result, err := c.TellWithProgress("provision", func(p *Progress) {
+		reports = append(reports, *p)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s := result.MustString(); s != "done" {
+		t.Fatalf("got %q, want %q", s, "done")
+	}
+
+	want := []Progress{{0, "step 0"}, {50, "step 50"}, {100, "step 100"}}
+
+	if !reflect.DeepEqual(reports, want) {
+		t.Fatalf("got %+v, want %+v", reports, want)
+	}
+
+	// Without a progress callback reporting progress is a nop.
+	result, err = c.TellWithTimeout("provision", 4*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s := result.MustString(); s != "done" {
+		t.Fatalf("got %q, want %q", s, "done")
+	}
+}
+
+func TestMethod_Typed(t *testing.T) {
+	type Args struct {
+		A, B int
+	}
+
+	type Result struct {
+		Sum int `json:"sum"`
+	}
+
+	k := New("testkite", "0.0.1")
+	k.Config.DisableAuthentication = true
+
+	k.HandleTyped("sum", func(ctx context.Context, args *Args) (*Result, error) {
+		if args.A < 0 || args.B < 0 {
+			return nil, errors.New("negative argument")
+		}
+		return &Result{Sum: args.A + args.B}, nil
+	})
+
+	go k.Run()
+	defer k.Close()
+	<-k.ServerReadyNotify()
+
+	c := New("exp", "0.0.1").NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", k.Port()))
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	result, err := c.TellWithTimeout("sum", 4*time.Second, &Args{A: 1, B: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var res Result
+	if err := result.Unmarshal(&res); err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Sum != 3 {
+		t.Errorf("got %d, want 3", res.Sum)
+	}
+
+	if _, err := c.TellWithTimeout("sum", 4*time.Second, &Args{A: -1}); err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	if _, err := c.TellWithTimeout("sum", 4*time.Second, "invalid"); err == nil {
+		t.Error("expected argument error, got nil")
+	}
+
+	// Missing and null arguments are passed as zero values.
+	for _, args := range [][]interface{}{nil, {nil}} {
+		result, err := c.TellWithTimeout("sum", 4*time.Second, args...)
+		if err != nil {
+			t.Fatalf("%v: %s", args, err)
+		}
+
+		var res Result
+		if err := result.Unmarshal(&res); err != nil || res.Sum != 0 {
+			t.Errorf("%v: got %+v, %v", args, res, err)
+		}
+	}
+}
+
+func TestMethod_TypedInvalid(t *testing.T) {
+	fns := []interface{}{
+		"foo",
+		func() (interface{}, error) { return nil, nil },
+		func(r *Request) (interface{}, error) { return nil, nil },
+		func(ctx context.Context, a, b int) (interface{}, error) { return nil, nil },
+		func(ctx context.Context) error { return nil },
+		func(ctx context.Context) (interface{}, bool) { return nil, false },
+		func(ctx context.Context, args struct {
+			Name string `validate:"required,foo"`
+		}) (interface{}, error) {
+			return nil, nil
+		},
+	}
+
+	for i, fn := range fns {
+		if _, err := newTypedHandler(fn); err == nil {
+			t.Errorf("%d: expected error for %T", i, fn)
+		}
+	}
+}
+
+func TestMethod_TypedValidation(t *testing.T) {
+	type Args struct {
+		Name string `json:"name" validate:"required"`
+		Age  int    `json:"age,omitempty" validate:"omitempty,min=1"`
+	}
+
+	k := New("testkite", "0.0.1")
+	k.Config.DisableAuthentication = true
+
+	var called int32
+
+	k.HandleTyped("hello", func(ctx context.Context, args *Args) (string, error) {
+		atomic.AddInt32(&called, 1)
+		return "hello " + args.Name, nil
+	})
+
+	go k.Run()
+	defer k.Close()
+	<-k.ServerReadyNotify()
+
+	c := New("exp", "0.0.1").NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", k.Port()))
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := c.TellWithTimeout("hello", 4*time.Second, &Args{Name: "kite", Age: 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string][]interface{}{
+		"invalid args": {&Args{Age: -1}},
+		"no args":      nil,
+	}
+
+	for name, args := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, err := c.TellWithTimeout("hello", 4*time.Second, args...)
+
+			e, ok := err.(*Error)
+			if !ok {
+				t.Fatalf("got %#v, want *Error", err)
+			}
+
+			if e.Type != "validationError" {
+				t.Fatalf("got %q, want validationError", e.Type)
+			}
+
+			want := []FieldError{{Field: "name", Rule: "required", Message: "is required"}}
+			if len(args) != 0 {
+				want = append(want, FieldError{Field: "age", Rule: "min", Message: "must be at least 1"})
+			}
+
+			if !reflect.DeepEqual(e.Fields, want) {
+				t.Fatalf("got %+v, want %+v", e.Fields, want)
+			}
+		})
+	}
+
+	if n := atomic.LoadInt32(&called); n != 1 {
+		t.Fatalf("handler called %d times, want 1", n)
+	}
+}
+
+func TestMethod_Panic(t *testing.T) {
+	k := New("testkite", "0.0.1")
+	k.Config.DisableAuthentication = true
+
+	recovered := make(chan interface{}, 1)
+
+	k.PanicHandler = func(r *Request, v interface{}, stack []byte) {
+		if len(stack) == 0 {
+			t.Error("empty stack trace")
+		}
+		recovered <- v
+	}
+
+	k.HandleFunc("panic", func(r *Request) (interface{}, error) {
+		panic("handler failure")
+	})
+
+	k.HandleFunc("args", func(r *Request) (interface{}, error) {
+		return r.Args.One().MustString(), nil
+	})
+
+	go k.Run()
+	defer k.Close()
+	<-k.ServerReadyNotify()
+
+	c := New("exp", "0.0.1").NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", k.Port()))
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	_, err := c.TellWithTimeout("panic", 4*time.Second)
+	if err == nil {
+		t.Fatal("expected error, got nil")
+	}
+
+	if kErr, ok := err.(*Error); !ok || kErr.Type != "panicError" {
+		t.Fatalf("got %#v, want panicError", err)
+	}
+
+	select {
+	case v := <-recovered:
+		if v != "handler failure" {
+			t.Errorf("got %v, want %q", v, "handler failure")
+		}
+	case <-time.After(4 * time.Second):
+		t.Fatal("PanicHandler was not called")
+	}
+
+	// Argument errors are not reported as panics.
+	_, err = c.TellWithTimeout("args", 4*time.Second, 1)
+	if kErr, ok := err.(*Error); !ok || kErr.Type != "argumentError" {
+		t.Fatalf("got %#v, want argumentError", err)
+	}
+
+	select {
+	case v := <-recovered:
+		t.Errorf("unexpected call to PanicHandler: %v", v)
+	default:
+	}
+}
+
+func TestMethod_ThrottleBy(t *testing.T) {
+	k := New("testkite", "0.0.1")
+	k.Config.DisableAuthentication = true
+
+	k.HandleFunc("foo", func(r *Request) (interface{}, error) {
+		return "handle", nil
+	}).ThrottleBy(ThrottleByUsername, time.Hour, 2)
+
+	go k.Run()
+	defer k.Close()
+	<-k.ServerReadyNotify()
+
+	dial := func(username string) *Client {
+		e := New("exp", "0.0.1")
+		e.Config.Username = username
+
+		c := e.NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", k.Port()))
+		if err := c.Dial(); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	alice, bob := dial("alice"), dial("bob")
+	defer alice.Close()
+	defer bob.Close()
+
+	for i := 0; i < 2; i++ {
+		if _, err := alice.TellWithTimeout("foo", 4*time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err := alice.TellWithTimeout("foo", 4*time.Second)
+	if kErr, ok := err.(*Error); !ok || kErr.Type != "requestLimitError" {
+		t.Fatalf("got %v, want requestLimitError", err)
+	}
+
+	// bob has a separate bucket
+	if _, err := bob.TellWithTimeout("foo", 4*time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// memoryRateLimiter is a RateLimiter shared by kites in tests.
+type memoryRateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]int64
+	err     error
+}
+
+func (rl *memoryRateLimiter) Take(_ context.Context, key string, _ time.Duration, capacity int64) (bool, error) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if rl.err != nil {
+		return false, rl.err
+	}
+
+	if rl.buckets[key] >= capacity {
+		return false, nil
+	}
+
+	rl.buckets[key]++
+
+	return true, nil
+}
+
+func TestMethod_RateLimiter(t *testing.T) {
+	rl := &memoryRateLimiter{buckets: make(map[string]int64)}
+
+	// Replicas of the same kite share the limits kept by the RateLimiter.
+	var (
+		clients []*Client
+		prefix  string
+	)
+
+	for i := 0; i < 2; i++ {
+		k := New("testkite", "0.0.1")
+		k.Config.DisableAuthentication = true
+		k.RateLimiter = rl
+		prefix = "kite:/" + k.Kite().Username + "/" + k.Kite().Environment + "/testkite:"
+
+		k.HandleFunc("foo", func(r *Request) (interface{}, error) {
+			return "handle", nil
+		}).Throttle(time.Hour, 3).ThrottleBy(ThrottleByUsername, time.Hour, 2)
+
+		go k.Run()
+		defer k.Close()
+		<-k.ServerReadyNotify()
+
+		e := New("exp", "0.0.1")
+		e.Config.Username = "alice"
+
+		c := e.NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", k.Port()))
+		if err := c.Dial(); err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		clients = append(clients, c)
+	}
+
+	for _, c := range clients {
+		if _, err := c.TellWithTimeout("foo", 4*time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// alice's bucket is empty, the method's one has a token left.
+	for _, c := range clients {
+		_, err := c.TellWithTimeout("foo", 4*time.Second)
+		if kErr, ok := err.(*Error); !ok || kErr.Type != "requestLimitError" {
+			t.Fatalf("got %v, want requestLimitError", err)
+		}
+	}
+
+	rl.mu.Lock()
+	method, user := rl.buckets[prefix+"foo"], rl.buckets[prefix+"foo:alice"]
+	rl.err = errors.New("unavailable")
+	rl.mu.Unlock()
+
+	if method != 3 || user != 2 {
+		t.Fatalf("got %d and %d tokens taken, want 3 and 2", method, user)
+	}
+
+	// Calls are allowed when the RateLimiter fails.
+	if _, err := clients[0].TellWithTimeout("foo", 4*time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKeyedBucket_Evict(t *testing.T) {
+	kb := newKeyedBucket(ThrottleByUsername, time.Millisecond, 2)
+
+	for _, username := range []string{"alice", "bob"} {
+		if !kb.take(&Request{Username: username}) {
+			t.Fatalf("%s: expected a token", username)
+		}
+	}
+
+	if n := len(kb.buckets); n != 2 {
+		t.Fatalf("got %d buckets, want 2", n)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	if !kb.take(&Request{Username: "alice"}) {
+		t.Fatal("alice: expected a token")
+	}
+
+	if _, ok := kb.buckets["bob"]; ok {
+		t.Fatal("unused bucket was not evicted")
+	}
+}
+
+func TestKeyedBucket_MaxBuckets(t *testing.T) {
+	kb := newKeyedBucket(ThrottleByKiteID, time.Hour, 2)
+	kb.maxBuckets = 2
+
+	for _, id := range []string{"a", "b"} {
+		if !kb.take(&Request{KiteID: id}) {
+			t.Fatalf("%s: expected a token", id)
+		}
+	}
+
+	// New keys are throttled while the buckets in use are kept.
+	if kb.take(&Request{KiteID: "c"}) {
+		t.Fatal("c: expected the request to be throttled")
+	}
+
+	if n := len(kb.buckets); n != 2 {
+		t.Fatalf("got %d buckets, want 2", n)
+	}
+
+	if !kb.take(&Request{KiteID: "a"}) {
+		t.Fatal("a: expected a token")
+	}
+}
+
+func TestThrottleByKiteID(t *testing.T) {
+	// The kite ID reported by the caller is not trusted.
+	r := &Request{
+		Client:   &Client{Kite: protocol.Kite{ID: "reported"}},
+		Username: "alice",
+	}
+
+	if key := ThrottleByKiteID(r); key != "alice" {
+		t.Errorf("got %q, want %q", key, "alice")
+	}
+
+	r.KiteID = "authenticated"
+
+	if key := ThrottleByKiteID(r); key != "authenticated" {
+		t.Errorf("got %q, want %q", key, "authenticated")
+	}
+}
+
+func TestMethod_TellWithContext(t *testing.T) {
+	k := New("testkite", "0.0.1")
+	k.Config.DisableAuthentication = true
+
+	started := make(chan struct{}, 1)
+	canceled := make(chan struct{}, 1)
+
+	k.HandleFunc("slow", func(r *Request) (interface{}, error) {
+		started <- struct{}{}
+
+		select {
+		case <-r.Ctx().Done():
+			canceled <- struct{}{}
+		case <-time.After(4 * time.Second):
+		}
+
+		return "too late", nil
+	})
+
+	go k.Run()
+	defer k.Close()
+	<-k.ServerReadyNotify()
+
+	c := New("exp", "0.0.1").NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", k.Port()))
+	c.CancelRemote = true
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		<-started
+		cancel()
+	}()
+
+	if _, err := c.TellWithContext(ctx, "slow"); err != context.Canceled {
+		t.Fatalf("got %v, want %v", err, context.Canceled)
+	}
+
+	select {
+	case <-canceled:
+	case <-time.After(4 * time.Second):
+		t.Fatal("handler context was not canceled")
+	}
+
+	// The call is not canceled remotely without CancelRemote.
+	c.CancelRemote = false
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		<-started
+		cancel()
+	}()
+
+	if _, err := c.TellWithContext(ctx, "slow"); err != context.Canceled {
+		t.Fatalf("got %v, want %v", err, context.Canceled)
+	}
+
+	select {
+	case <-canceled:
+		t.Fatal("handler context was canceled")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// Calls with a live context work as usual.
+	result, err := c.TellWithContext(context.Background(), "kite.ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s := result.MustString(); s != "pong" {
+		t.Fatalf("got %q, want %q", s, "pong")
+	}
+}
+
+func TestMethod_Deadline(t *testing.T) {
+	k := New("testkite", "0.0.1")
+	k.Config.DisableAuthentication = true
+
+	deadlines := make(chan time.Time, 1)
+	release := make(chan struct{})
+
+	k.HandleFunc("slow", func(r *Request) (interface{}, error) {
+		deadline, _ := r.Ctx().Deadline()
+		deadlines <- deadline
+
+		select {
+		case <-r.Ctx().Done():
+		case <-release:
+		}
+
+		return nil, r.Ctx().Err()
+	})
+
+	calls := make(chan struct{}, 1)
+
+	k.HandleFunc("count", func(r *Request) (interface{}, error) {
+		calls <- struct{}{}
+		return nil, nil
+	})
+
+	k.PreHandleFunc(func(r *Request) (interface{}, error) {
+		if r.Method == "count" {
+			// Make the call expire before its handler is run.
+			time.Sleep(200 * time.Millisecond)
+		}
+		return nil, nil
+	})
+
+	go k.Run()
+	defer k.Close()
+	<-k.ServerReadyNotify()
+
+	c := New("exp", "0.0.1").NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", k.Port()))
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// The handler context gets the deadline of the caller.
+	start := time.Now()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	if _, err := c.TellWithContext(ctx, "slow"); err != context.DeadlineExceeded {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	select {
+	case deadline := <-deadlines:
+		if deadline.IsZero() || deadline.Sub(start) > time.Second {
+			t.Fatalf("got deadline %s after the call, want ~500ms", deadline.Sub(start))
+		}
+	case <-time.After(4 * time.Second):
+		t.Fatal("handler was not called")
+	}
+
+	// Calls without a deadline do not get one.
+	go c.Tell("slow")
+
+	select {
+	case deadline := <-deadlines:
+		if !deadline.IsZero() {
+			t.Fatalf("got deadline %s, want none", deadline)
+		}
+	case <-time.After(4 * time.Second):
+		t.Fatal("handler was not called")
+	}
+	close(release)
+
+	// Calls that expired before reaching the handler are not executed.
+	_, err := c.TellWithTimeout("count", 100*time.Millisecond)
+	if err == nil {
+		t.Fatal("expected the call to time out")
+	}
+
+	select {
+	case <-calls:
+		t.Fatal("expired call was executed")
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func TestMethod_RequireScope(t *testing.T) {
+	k := New("testkite", "0.0.1")
+	k.Authenticators["scopes"] = func(r *Request) error {
+		r.Username = "alice"
+		r.Scopes = strings.Fields(r.Auth.Key)
+		return nil
+	}
+
+	k.HandleFunc("read", func(r *Request) (interface{}, error) {
+		return "read", nil
+	}).RequireScope("read")
+
+	k.HandleFunc("write", func(r *Request) (interface{}, error) {
+		t.Error("handler of forbidden call was run")
+		return "write", nil
+	}).RequireScope("read", "write")
+
+	go k.Run()
+	defer k.Close()
+	<-k.ServerReadyNotify()
+
+	c := New("exp", "0.0.1").NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", k.Port()))
+	c.Auth = &Auth{Type: "scopes", Key: "read"}
+
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := c.TellWithTimeout("read", 4*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := c.TellWithTimeout("write", 4*time.Second)
+	if kErr, ok := err.(*Error); !ok || kErr.Type != "forbidden" {
+		t.Fatalf("got %v, want forbidden", err)
+	}
+}
+
+func TestScopesFromToken(t *testing.T) {
+	key := []byte("secret")
+
+	cases := map[string]struct {
+		claims jwt.MapClaims
+		fn     func(jwt.MapClaims) []string
+		want   []string
+	}{
+		"list": {
+			claims: jwt.MapClaims{"scopes": []string{"read", "write"}},
+			want:   []string{"read", "write"},
+		},
+		"none": {
+			claims: jwt.MapClaims{"sub": "alice"},
+		},
+		"custom claim": {
+			claims: jwt.MapClaims{"roles": "admin"},
+			fn: func(claims jwt.MapClaims) []string {
+				if claims["roles"] == "admin" {
+					return []string{"read", "write"}
+				}
+				return nil
+			},
+			want: []string{"read", "write"},
+		},
+	}
+
+	for name, cas := range cases {
+		t.Run(name, func(t *testing.T) {
+			s, err := jwt.NewWithClaims(jwt.SigningMethodHS256, cas.claims).SignedString(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			token, err := jwt.ParseWithClaims(s, &kitekey.KiteClaims{}, func(*jwt.Token) (interface{}, error) {
+				return key, nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			k := &Kite{ScopesFromClaims: cas.fn}
+
+			scopes, err := k.scopesFromToken(token)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(scopes, cas.want) && (len(scopes) != 0 || len(cas.want) != 0) {
+				t.Fatalf("got %v, want %v", scopes, cas.want)
+			}
+		})
+	}
+}
+
+func TestRequest_SetArgs(t *testing.T) {
+	k := New("testkite", "0.0.1")
+	k.Config.DisableAuthentication = true
+
+	type options struct {
+		Name     string         `json:"name"`
+		Secret   string         `json:"secret,omitempty"`
+		Callback dnode.Function `json:"callback"`
+	}
+
+	k.PreHandleFunc(func(r *Request) (interface{}, error) {
+		var opts options
+		if err := r.Args.One().Unmarshal(&opts); err != nil {
+			return nil, err
+		}
+
+		if opts.Name == "" {
+			opts.Name = "default"
+		}
+		opts.Secret = ""
+
+		return nil, r.SetArgs(opts)
+	})
+
+	k.HandleFunc("echo", func(r *Request) (interface{}, error) {
+		var opts options
+		if err := r.Args.One().Unmarshal(&opts); err != nil {
+			return nil, err
+		}
+
+		if opts.Secret != "" {
+			return nil, errors.New("secret was not stripped")
+		}
+
+		if err := opts.Callback.Call(opts.Name); err != nil {
+			return nil, err
+		}
+
+		return opts.Name, nil
+	})
+
+	go k.Run()
+	defer k.Close()
+	<-k.ServerReadyNotify()
+
+	c := New("exp", "0.0.1").NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", k.Port()))
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	called := make(chan string, 1)
+
+	result, err := c.TellWithTimeout("echo", 4*time.Second, &options{
+		Secret: "password",
+		Callback: dnode.Callback(func(arg *dnode.Partial) {
+			called <- arg.One().MustString()
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s := result.MustString(); s != "default" {
+		t.Fatalf("got %q, want %q", s, "default")
+	}
+
+	select {
+	case s := <-called:
+		if s != "default" {
+			t.Fatalf("got %q, want %q", s, "default")
+		}
+	case <-time.After(4 * time.Second):
+		t.Fatal("callback was not called")
+	}
+}
+
+func TestGroup(t *testing.T) {
+	k := New("testkite", "0.0.1")
+	k.Config.DisableAuthentication = true
+
+	fs := k.Group("fs")
+	fs.PreHandleFunc(func(r *Request) (interface{}, error) {
+		r.Context.Set("group", "fs")
+		return nil, nil
+	})
+
+	fs.HandleFunc("list", func(r *Request) (interface{}, error) {
+		return r.Context.Get("group")
+	}).PreHandleFunc(func(r *Request) (interface{}, error) {
+		if _, err := r.Context.Get("group"); err != nil {
+			return nil, errors.New("group pre-handler was not called first")
+		}
+		return nil, nil
+	})
+
+	fs.Group("admin").RequireScope("admin").HandleFunc("wipe", func(r *Request) (interface{}, error) {
+		return r.Context.Get("group")
+	})
+
+	go k.Run()
+	defer k.Close()
+	<-k.ServerReadyNotify()
+
+	c := New("exp", "0.0.1").NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", k.Port()))
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	result, err := c.TellWithTimeout("fs.list", 4*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s := result.MustString(); s != "fs" {
+		t.Fatalf("got %q, want %q", s, "fs")
+	}
+
+	_, err = c.TellWithTimeout("fs.admin.wipe", 4*time.Second)
+	if e, ok := err.(*Error); !ok || e.Type != "forbidden" {
+		t.Fatalf("got %v, want forbidden error", err)
+	}
+
+	if _, err := c.TellWithTimeout("list", 4*time.Second); err == nil {
+		t.Fatal("expected method to be registered with the group prefix")
+	}
+}
+
+func TestMethod_Pattern(t *testing.T) {
+	k := New("testkite", "0.0.1")
+	k.Config.DisableAuthentication = true
+
+	handler := func(prefix string) HandlerFunc {
+		return func(r *Request) (interface{}, error) {
+			return prefix + r.Method, nil
+		}
+	}
+
+	k.HandleFunc("fs.list", handler("exact:"))
+	k.HandleFunc("fs.*", handler("fs:"))
+	k.HandleFunc("fs.dir.*", handler("dir:"))
+	k.HandleNotFoundFunc(handler("notfound:"))
+
+	go k.Run()
+	defer k.Close()
+	<-k.ServerReadyNotify()
+
+	c := New("exp", "0.0.1").NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", k.Port()))
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	cases := map[string]string{
+		"fs.list":    "exact:fs.list",
+		"fs.remove":  "fs:fs.remove",
+		"fs.dir.mk":  "dir:fs.dir.mk",
+		"proxy.call": "notfound:proxy.call",
+		"kite.ping":  "pong",
+	}
+
+	for method, want := range cases {
+		result, err := c.TellWithTimeout(method, 4*time.Second)
+		if err != nil {
+			t.Fatalf("%s: %s", method, err)
+		}
+
+		if got := result.MustString(); got != want {
+			t.Fatalf("%s: got %q, want %q", method, got, want)
+		}
+	}
+}
+
+func TestKite_Unhandle(t *testing.T) {
+	k := New("testkite", "0.0.1")
+	k.Config.DisableAuthentication = true
+
+	go k.Run()
+	defer k.Close()
+	<-k.ServerReadyNotify()
+
+	c := New("exp", "0.0.1").NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", k.Port()))
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	tell := func(method string) (string, error) {
+		result, err := c.TellWithTimeout(method, 4*time.Second)
+		if err != nil {
+			return "", err
+		}
+
+		return result.MustString(), nil
+	}
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+
+	// Calls are served while methods are being replaced.
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					tell("plugin.version")
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 50; i++ {
+		version := fmt.Sprint(i)
+
+		k.HandleFunc("plugin.version", func(r *Request) (interface{}, error) {
+			return version, nil
+		})
+		k.HandleFunc("plugin.*", func(r *Request) (interface{}, error) {
+			return version, nil
+		})
+	}
+
+	close(stop)
+	wg.Wait()
+
+	for _, method := range []string{"plugin.version", "plugin.other"} {
+		if s, err := tell(method); err != nil || s != "49" {
+			t.Fatalf("%s: got %q, %v, want %q", method, s, err, "49")
+		}
+	}
+
+	k.Unhandle("plugin.version")
+
+	if s, err := tell("plugin.version"); err != nil || s != "49" {
+		t.Fatalf("got %q, %v, want the pattern handler to be called", s, err)
+	}
+
+	k.Unhandle("plugin.*")
+
+	if _, err := tell("plugin.version"); err == nil {
+		t.Fatal("expected call of unhandled method to fail")
+	}
+}
+
+func TestKite_Methods(t *testing.T) {
+	k := New("testkite", "0.0.1")
+	k.Config.KontrolUser = "testuser"
+	k.Config.KontrolKey = testkeys.Public
+	k.HandleFunc("square", func(r *Request) (interface{}, error) { return nil, nil }).
+		Throttle(time.Second, 10).
+		RequireScope(ScopeAdmin).
+		Timeout(time.Minute).
+		Schema(float64(0), map[string]interface{}{"type": "number", "minimum": 0.0})
+	k.HandleFunc("plugin.*", func(r *Request) (interface{}, error) { return nil, nil }).
+		DisableAuthentication()
+	k.HandleTyped("divide", func(ctx context.Context, args struct {
+		Dividend float64  `json:"dividend"`
+		Divisor  float64  `json:"divisor,omitempty"`
+		Tags     []string `json:"tags,omitempty"`
+		Ignored  string   `json:"-"`
+	}) (float64, error) {
+		return 0, nil
+	})
+
+	go k.Run()
+	defer k.Close()
+	<-k.ServerReadyNotify()
+
+	c := New("exp", "0.0.1").NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", k.Port()))
+	c.Auth = &Auth{Type: "kiteKey", Key: testutil.NewKiteKey().Raw}
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	result, err := c.TellWithTimeout("kite.methods", 4*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var infos []MethodInfo
+	if err := result.Unmarshal(&infos); err != nil {
+		t.Fatal(err)
+	}
+
+	methods := make(map[string]MethodInfo)
+	var names []string
+
+	for _, info := range infos {
+		methods[info.Name] = info
+		names = append(names, info.Name)
+	}
+
+	if !reflect.DeepEqual(names, k.Methods()) {
+		t.Fatalf("got %v, want %v", names, k.Methods())
+	}
+
+	want := map[string]MethodInfo{
+		"square": {
+			Name:          "square",
+			Authenticated: true,
+			Scopes:        []string{ScopeAdmin},
+			Throttle:      &ThrottleInfo{FillInterval: time.Second, Capacity: 10},
+			Timeout:       time.Minute,
+			Args:          map[string]interface{}{"type": "number"},
+			Result:        map[string]interface{}{"type": "number", "minimum": 0.0},
+		},
+		"plugin.*": {
+			Name: "plugin.*",
+		},
+		"divide": {
+			Name:          "divide",
+			Authenticated: true,
+			Args: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"dividend": map[string]interface{}{"type": "number"},
+					"divisor":  map[string]interface{}{"type": "number"},
+					"tags": map[string]interface{}{
+						"type":  "array",
+						"items": map[string]interface{}{"type": "string"},
+					},
+				},
+				"required": []interface{}{"dividend"},
+			},
+			Result: map[string]interface{}{"type": "number"},
+		},
+	}
+
+	for name, info := range want {
+		if got := methods[name]; !reflect.DeepEqual(got, info) {
+			t.Errorf("%s: got %+v, want %+v", name, got, info)
+		}
+	}
+
+	if _, ok := methods["kite.methods"]; !ok {
+		t.Errorf("kite.methods not found in %v", names)
+	}
+}
+
+func TestMethod_PreHandleWhileServing(t *testing.T) {
+	k := New("testkite", "0.0.1")
+	k.Config.DisableAuthentication = true
+
+	var calls int64
+
+	m := k.HandleFunc("count", func(r *Request) (interface{}, error) {
+		return nil, nil
+	})
+
+	go k.Run()
+	defer k.Close()
+	<-k.ServerReadyNotify()
+
+	c := New("exp", "0.0.1").NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", k.Port()))
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+
+	// Calls are served while handlers are being added.
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					c.TellWithTimeout("count", 4*time.Second)
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 10; i++ {
+		m.PreHandleFunc(func(r *Request) (interface{}, error) {
+			atomic.AddInt64(&calls, 1)
+			return nil, nil
+		})
+	}
+
+	close(stop)
+	wg.Wait()
+
+	atomic.StoreInt64(&calls, 0)
+
+	if _, err := c.TellWithTimeout("count", 4*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := atomic.LoadInt64(&calls); n != 10 {
+		t.Fatalf("got %d, want 10 pre handlers to be called", n)
+	}
+}
+
+func TestKite_PreHandleWhileServing(t *testing.T) {
+	k := New("testkite", "0.0.1")
+	k.Config.DisableAuthentication = true
+
+	var (
+		mu    sync.Mutex
+		order []string
+	)
+
+	record := func(name string) HandlerFunc {
+		return func(r *Request) (interface{}, error) {
+			mu.Lock()
+			order = append(order, name)
+			mu.Unlock()
+			return nil, nil
+		}
+	}
+
+	k.HandleFunc("count", record("handler")).PreHandleFunc(record("method pre")).PostHandleFunc(record("method post"))
+
+	go k.Run()
+	defer k.Close()
+	<-k.ServerReadyNotify()
+
+	c := New("exp", "0.0.1").NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", k.Port()))
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// The method is called before the kite handlers are added,
+	// so its handler chain is built without them.
+	if _, err := c.TellWithTimeout("count", 4*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+
+	// Calls are served while handlers are being added.
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					c.TellWithTimeout("count", 4*time.Second)
+				}
+			}
+		}()
+	}
+
+	k.PreHandleFunc(record("kite pre"))
+	k.PostHandleFunc(record("kite post"))
+	k.FinalFunc(func(r *Request, resp interface{}, err error) (interface{}, error) {
+		record("kite final")(r)
+		return resp, err
+	})
+
+	close(stop)
+	wg.Wait()
+
+	mu.Lock()
+	order = nil
+	mu.Unlock()
+
+	if _, err := c.TellWithTimeout("count", 4*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"method pre", "kite pre", "handler", "method post", "kite post", "kite final"}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if !reflect.DeepEqual(order, want) {
+		t.Fatalf("got %v, want %v", order, want)
+	}
+}
+
+func TestMethod_SettingsWhileServing(t *testing.T) {
+	k := New("testkite", "0.0.1")
+	k.Config.DisableAuthentication = true
+
+	m := k.HandleFunc("count", func(r *Request) (interface{}, error) {
+		return nil, nil
+	})
+
+	go k.Run()
+	defer k.Close()
+	<-k.ServerReadyNotify()
+
+	c := New("exp", "0.0.1").NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", k.Port()))
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+
+	// Calls are served while the method is being configured.
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			ctx := ContextWithIdempotencyKey(context.Background(), "key")
+
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					c.TellWithContext(ctx, "count")
+				}
+			}
+		}()
+	}
+
+	for i, start := 0, time.Now(); time.Since(start) < 200*time.Millisecond; i++ {
+		m.Timeout(time.Duration(i+1) * time.Second)
+		m.Handling(ReturnFirst)
+		m.Deduplicate(time.Millisecond)
+		m.Ordered("count")
+		m.ThrottleBy(ThrottleByUsername, time.Millisecond, 1000)
+	}
+
+	m.RequireScope("count")
+
+	close(stop)
+	wg.Wait()
+
+	_, err := c.TellWithTimeout("count", 4*time.Second)
+	if e, ok := err.(*Error); !ok || e.Type != "forbidden" {
+		t.Fatalf("got %v, want forbidden error", err)
+	}
+}
+
+func TestMethod_MaxConcurrent(t *testing.T) {
+	k := New("testkite", "0.0.1")
+	k.Config.DisableAuthentication = true
+
+	started := make(chan struct{}, 4)
+	unblock := make(chan struct{})
+
+	blocking := func(r *Request) (interface{}, error) {
+		started <- struct{}{}
+		<-unblock
+		return "done", nil
+	}
+
+	reject := k.HandleFunc("reject", blocking).MaxConcurrent(1)
+	queue := k.HandleFunc("queue", blocking).MaxConcurrent(1).MaxQueued(1)
+
+	go k.Run()
+	defer k.Close()
+	<-k.ServerReadyNotify()
+
+	// Calls are made with separate clients, as a client waits
+	// for responses of its calls one at a time.
+	tell := func(method string) error {
+		c := New("exp", "0.0.1").NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", k.Port()))
+		if err := c.Dial(); err != nil {
+			return err
+		}
+		defer c.Close()
+
+		_, err := c.TellWithTimeout(method, 4*time.Second)
+		return err
+	}
+
+	errs := make(chan error, 3)
+	for _, method := range []string{"reject", "queue"} {
+		go func(method string) { errs <- tell(method) }(method)
+		<-started
+	}
+
+	// The next call of "queue" waits, the following ones are rejected.
+	go func() { errs <- tell("queue") }()
+
+	for deadline := time.Now().Add(4 * time.Second); ; {
+		queue.mu.Lock()
+		queued := atomic.LoadInt32(&queue.limiter.queued)
+		queue.mu.Unlock()
+
+		if queued == 1 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the call to be queued")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, method := range []string{"reject", "queue"} {
+		if e, ok := tell(method).(*Error); !ok || e.Type != "overloaded" {
+			t.Fatalf("%s: got %v, want overloaded error", method, e)
+		}
+	}
+
+	close(unblock)
+
+	for i := 0; i < 3; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("got %v, want the call to succeed", err)
+		}
+	}
+
+	// Changed limits apply to the following calls.
+	reject.MaxConcurrent(2).MaxQueued(1)
+
+	if l := reject.handlerChain(k).limiter; l == nil || cap(l.slots) != 2 || l.maxQueued != 1 {
+		t.Fatalf("got %+v, want limiter of 2 calls and 1 queued", l)
+	}
+
+	reject.MaxConcurrent(0)
+
+	if l := reject.handlerChain(k).limiter; l != nil {
+		t.Fatalf("got %+v, want no limiter", l)
+	}
+}
+
+func TestKite_MaxHandlerGoroutines(t *testing.T) {
+	for _, overflow := range []config.Overflow{config.OverflowReject, config.OverflowQueue} {
+		k := New("testkite", "0.0.1")
+		k.Config.DisableAuthentication = true
+		k.Config.MaxHandlerGoroutines = 1
+		k.Config.HandlerOverflow = overflow
+
+		started := make(chan struct{}, 2)
+		unblock := make(chan struct{})
+
+		k.HandleFunc("block", func(r *Request) (interface{}, error) {
+			started <- struct{}{}
+			<-unblock
+			return "done", nil
+		})
+
+		go k.Run()
+		<-k.ServerReadyNotify()
+
+		tell := func() error {
+			c := New("exp", "0.0.1").NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", k.Port()))
+			if err := c.Dial(); err != nil {
+				return err
+			}
+			defer c.Close()
+
+			_, err := c.TellWithTimeout("block", 4*time.Second)
+			return err
+		}
+
+		errs := make(chan error, 2)
+		go func() { errs <- tell() }()
+		<-started
+
+		calls := 1
+
+		if overflow == config.OverflowReject {
+			if e, ok := tell().(*Error); !ok || e.Type != "overloaded" {
+				t.Fatalf("got %v, want overloaded error", e)
+			}
+
+			if stats := k.HandlerStats(); stats.Running != 1 || stats.Rejected != 1 {
+				t.Fatalf("got %+v, want 1 running and 1 rejected", stats)
+			}
+		} else {
+			go func() { errs <- tell() }()
+			calls++
+
+			for deadline := time.Now().Add(4 * time.Second); k.HandlerStats().Queued != 1; {
+				if time.Now().After(deadline) {
+					t.Fatal("timed out waiting for the call to be queued")
+				}
+
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+
+		close(unblock)
+
+		for i := 0; i < calls; i++ {
+			if err := <-errs; err != nil {
+				t.Fatalf("got %v, want the call to succeed", err)
+			}
+		}
+
+		if stats := k.HandlerStats(); stats.Queued != 0 {
+			t.Fatalf("got %d queued calls, want 0", stats.Queued)
+		}
+
+		k.Close()
+	}
+}
+
+func TestKite_MaxHandlerGoroutinesStream(t *testing.T) {
+	k := New("testkite", "0.0.1")
+	k.Config.DisableAuthentication = true
+	k.Config.MaxHandlerGoroutines = 1
+	k.Config.HandlerOverflow = config.OverflowQueue
+
+	data := strings.Repeat("kite", 3*streamChunkSize*streamWindow)
+
+	// The stream waits for kite.streamAck calls while holding
+	// the only handler goroutine.
+	k.HandleFunc("stream", func(r *Request) (interface{}, error) {
+		return strings.NewReader(data), nil
+	})
+
+	go k.Run()
+	defer k.Close()
+	<-k.ServerReadyNotify()
+
+	c := New("exp", "0.0.1").NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", k.Port()))
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	done := make(chan error, 1)
+	var buf bytes.Buffer
+
+	go func() {
+		_, err := c.TellStream("stream", &buf)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(4 * time.Second):
+		t.Fatal("timed out waiting for the stream")
+	}
+
+	if buf.String() != data {
+		t.Errorf("got %d bytes of data, want %d", buf.Len(), len(data))
+	}
+}
+
+func TestClient_TellBatch(t *testing.T) {
+	k := New("testkite", "0.0.1")
+	k.Config.DisableAuthentication = true
+
+	k.HandleFunc("square", func(r *Request) (interface{}, error) {
+		n := r.Args.One().MustFloat64()
+		return n * n, nil
+	})
+
+	k.HandleFunc("fail", func(r *Request) (interface{}, error) {
+		return nil, errors.New("failed")
+	})
+
+	go k.Run()
+	defer k.Close()
+	<-k.ServerReadyNotify()
+
+	c := New("exp", "0.0.1").NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", k.Port()))
+	if err := c.Dial(); err != nil {
+		t.Fatalf("Dial()=%s", err)
+	}
+	defer c.Close()
+
+	calls := []BatchCall{
+		{Method: "square", Args: []interface{}{3}},
+		{Method: "kite.ping"},
+		{Method: "fail"},
+		{Method: "unknown"},
+		{Method: "square", Args: []interface{}{4}},
+	}
+
+	for name, tell := range map[string]func([]BatchCall) ([]BatchResult, error){
+		"sequential": c.TellBatch,
+		"concurrent": c.TellBatchConcurrent,
+	} {
+		t.Run(name, func(t *testing.T) {
+			results, err := tell(calls)
+			if err != nil {
+				t.Fatalf("TellBatch()=%s", err)
+			}
+
+			if len(results) != len(calls) {
+				t.Fatalf("got %d results, want %d", len(results), len(calls))
+			}
+
+			if n := results[0].Result.MustFloat64(); n != 9 {
+				t.Errorf("got %v, want 9", n)
+			}
+
+			if s := results[1].Result.MustString(); s != "pong" {
+				t.Errorf("got %q, want %q", s, "pong")
+			}
+
+			if e := results[2].Error; e == nil || e.Message != "failed" {
+				t.Errorf("got %v, want the call to fail", e)
+			}
+
+			if e := results[3].Error; e == nil || e.Type != "methodNotFound" {
+				t.Errorf("got %v, want methodNotFound error", e)
+			}
+
+			if n := results[4].Result.MustFloat64(); n != 16 {
+				t.Errorf("got %v, want 16", n)
+			}
+		})
+	}
+}
+
+func TestClient_TellBatchConcurrentLimits(t *testing.T) {
+	for _, overflow := range []config.Overflow{config.OverflowReject, config.OverflowQueue} {
+		k := New("testkite", "0.0.1")
+		k.Config.DisableAuthentication = true
+		k.Config.MaxHandlerGoroutines = 1
+		k.Config.HandlerOverflow = overflow
+
+		k.HandleFunc("square", func(r *Request) (interface{}, error) {
+			n := r.Args.One().MustFloat64()
+			return n * n, nil
+		})
+
+		go k.Run()
+		<-k.ServerReadyNotify()
+
+		c := New("exp", "0.0.1").NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", k.Port()))
+		if err := c.Dial(); err != nil {
+			t.Fatalf("Dial()=%s", err)
+		}
+
+		calls := make([]BatchCall, 3)
+		for i := range calls {
+			calls[i] = BatchCall{Method: "square", Args: []interface{}{i}}
+		}
+
+		// The only goroutine is held by the batch itself.
+		results, err := c.TellBatchConcurrent(calls)
+		if err != nil {
+			t.Fatalf("TellBatchConcurrent()=%s", err)
+		}
+
+		for i, res := range results {
+			if overflow == config.OverflowReject {
+				if res.Error == nil || res.Error.Type != "overloaded" {
+					t.Errorf("%d: got %v, want overloaded error", i, res.Error)
+				}
+				continue
+			}
+
+			if res.Error != nil {
+				t.Errorf("%d: got %v, want the call to succeed", i, res.Error)
+			} else if n := res.Result.MustFloat64(); n != float64(i*i) {
+				t.Errorf("%d: got %v, want %d", i, n, i*i)
+			}
+		}
+
+		if _, err := c.TellBatchConcurrent(make([]BatchCall, maxBatchCalls+1)); err == nil {
+			t.Errorf("expected batch of %d calls to be rejected", maxBatchCalls+1)
+		}
+
+		c.Close()
+		k.Close()
+	}
+}
+
+func TestClient_TellBatchNested(t *testing.T) {
+	k := New("testkite", "0.0.1")
+	k.Config.DisableAuthentication = true
+
+	var running, maxRunning int32
+
+	k.HandleFunc("sleep", func(r *Request) (interface{}, error) {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+				break
+			}
+		}
+
+		time.Sleep(20 * time.Millisecond)
+		return nil, nil
+	})
+
+	go k.Run()
+	defer k.Close()
+	<-k.ServerReadyNotify()
+
+	c := New("exp", "0.0.1").NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", k.Port()))
+	if err := c.Dial(); err != nil {
+		t.Fatalf("Dial()=%s", err)
+	}
+	defer c.Close()
+
+	nested := BatchCall{
+		Method: "kite.batch",
+		Args:   []interface{}{&batchArgs{Calls: []BatchCall{{Method: "sleep", Args: []interface{}{}}}}},
+	}
+
+	results, err := c.TellBatch([]BatchCall{nested})
+	if err != nil {
+		t.Fatalf("TellBatch()=%s", err)
+	}
+
+	if e := results[0].Error; e == nil {
+		t.Fatal("expected the nested batch to be rejected")
+	}
+
+	calls := make([]BatchCall, 3*maxBatchGoroutines)
+	for i := range calls {
+		calls[i] = BatchCall{Method: "sleep"}
+	}
+
+	if _, err := c.TellBatchConcurrent(calls); err != nil {
+		t.Fatalf("TellBatchConcurrent()=%s", err)
+	}
+
+	if n := atomic.LoadInt32(&maxRunning); n > maxBatchGoroutines {
+		t.Errorf("got %d calls running at once, want at most %d", n, maxBatchGoroutines)
+	}
+}
+
+func TestRequest_ID(t *testing.T) {
+	backend := New("backend", "0.0.1")
+	backend.Config.DisableAuthentication = true
+	backend.HandleFunc("id", func(r *Request) (interface{}, error) {
+		return r.ID, nil
+	})
+	backend.HandleFunc("fail", func(r *Request) (interface{}, error) {
+		return nil, errors.New("failed")
+	})
+
+	go backend.Run()
+	defer backend.Close()
+	<-backend.ServerReadyNotify()
+
+	frontend := New("frontend", "0.0.1")
+	frontend.Config.DisableAuthentication = true
+
+	b := frontend.NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", backend.Port()))
+	if err := b.Dial(); err != nil {
+		t.Fatalf("Dial()=%s", err)
+	}
+	defer b.Close()
+
+	frontend.HandleFunc("ids", func(r *Request) (interface{}, error) {
+		res, err := b.TellWithContext(r.Ctx(), "id")
+		if err != nil {
+			return nil, err
+		}
+
+		return []string{r.ID, res.MustString()}, nil
+	})
+	frontend.HandleFunc("fail", func(r *Request) (interface{}, error) {
+		_, err := b.TellWithContext(r.Ctx(), "fail")
+		if e, ok := err.(*Error); !ok || e.RequestID != r.ID {
+			return nil, fmt.Errorf("got %v, want error with %q request ID", err, r.ID)
+		}
+
+		return nil, nil
+	})
+
+	go frontend.Run()
+	defer frontend.Close()
+	<-frontend.ServerReadyNotify()
+
+	c := New("exp", "0.0.1").NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", frontend.Port()))
+	if err := c.Dial(); err != nil {
+		t.Fatalf("Dial()=%s", err)
+	}
+	defer c.Close()
+
+	seen := make(map[string]bool)
+
+	for i := 0; i < 2; i++ {
+		res, err := c.TellWithTimeout("ids", 4*time.Second)
+		if err != nil {
+			t.Fatalf("TellWithTimeout()=%s", err)
+		}
+
+		var ids []string
+		res.MustUnmarshal(&ids)
+
+		if len(ids) != 2 || ids[0] == "" || ids[0] != ids[1] {
+			t.Fatalf("got %q, want the same ID on both kites", ids)
+		}
+
+		if seen[ids[0]] {
+			t.Fatalf("got %q again, want a new ID for each call", ids[0])
+		}
+
+		seen[ids[0]] = true
+	}
+
+	ctx := ContextWithRequestID(context.Background(), "my-request")
+
+	res, err := c.TellWithContext(ctx, "ids")
+	if err != nil {
+		t.Fatalf("TellWithContext()=%s", err)
+	}
+
+	var ids []string
+	res.MustUnmarshal(&ids)
+
+	if len(ids) != 2 || ids[0] != "my-request" || ids[1] != "my-request" {
+		t.Fatalf("got %q, want the ID of the caller", ids)
+	}
+
+	if _, err := c.TellWithTimeout("fail", 4*time.Second); err != nil {
+		t.Fatalf("TellWithTimeout()=%s", err)
+	}
+}
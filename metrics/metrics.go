@@ -0,0 +1,188 @@
+// Package metrics provides Prometheus instrumentation for kites.
+//
+// Calling New instruments the kite and exposes the collected metrics
+// on the /metrics endpoint of the kite's HTTP server:
+//
+//	k := kite.New("math", "1.0.0")
+//	metrics.New(k)
+//
+//	k.Run()
+//
+// The metrics of method calls are labeled with the names or the patterns
+// the methods are registered with, e.g. "fs.*", and the ones of the calls
+// handled by the method registered with HandleNotFound with "notFound".
+package metrics
+
+import (
+	"time"
+
+	"github.com/koding/kite"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Path is the HTTP path the metrics are exposed on.
+const Path = "/metrics"
+
+// Metrics holds the collectors of a single kite.
+type Metrics struct {
+	// Registry the collectors are registered with. It can be used
+	// to register application specific collectors as well.
+	Registry *prometheus.Registry
+
+	// Requests counts method calls, partitioned by method name.
+	Requests *prometheus.CounterVec
+
+	// Errors counts failed method calls, partitioned by method name
+	// and the error type.
+	Errors *prometheus.CounterVec
+
+	// Throttled counts method calls rejected due to throttling,
+	// partitioned by method name.
+	Throttled *prometheus.CounterVec
+
+	// Latency observes the duration of method calls, partitioned
+	// by method name.
+	Latency *prometheus.HistogramVec
+
+	// SlowCalls counts method calls that took longer than
+	// config.Config.SlowCallThreshold, partitioned by method name.
+	SlowCalls *prometheus.CounterVec
+
+	// Connections is the number of currently connected clients.
+	Connections prometheus.Gauge
+
+	// HandlerGoroutines is the number of goroutines executing method
+	// calls, HandlerQueue the number of calls waiting for a free one
+	// and HandlerRejected counts the rejected calls. They are reported
+	// when the number of goroutines is limited, see
+	// config.Config.MaxHandlerGoroutines.
+	HandlerGoroutines prometheus.GaugeFunc
+	HandlerQueue      prometheus.GaugeFunc
+	HandlerRejected   prometheus.CounterFunc
+
+	slowCallThreshold time.Duration
+}
+
+// New instruments k and registers the /metrics endpoint on its
+// HTTP muxer. It must be called before k is run.
+func New(k *kite.Kite) *Metrics {
+	labels := prometheus.Labels{
+		"kite": k.Kite().Name,
+	}
+
+	m := &Metrics{
+		slowCallThreshold: k.Config.SlowCallThreshold,
+		Registry:          prometheus.NewRegistry(),
+		Requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   "kite",
+			Name:        "requests_total",
+			Help:        "Total number of method calls.",
+			ConstLabels: labels,
+		}, []string{"method"}),
+		Errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   "kite",
+			Name:        "request_errors_total",
+			Help:        "Total number of method calls that returned an error.",
+			ConstLabels: labels,
+		}, []string{"method", "type"}),
+		Throttled: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   "kite",
+			Name:        "throttled_requests_total",
+			Help:        "Total number of method calls rejected due to throttling.",
+			ConstLabels: labels,
+		}, []string{"method"}),
+		Latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:   "kite",
+			Name:        "request_duration_seconds",
+			Help:        "Duration of method calls.",
+			ConstLabels: labels,
+			Buckets:     prometheus.DefBuckets,
+		}, []string{"method"}),
+		SlowCalls: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   "kite",
+			Name:        "slow_requests_total",
+			Help:        "Total number of method calls that took longer than the slow call threshold.",
+			ConstLabels: labels,
+		}, []string{"method"}),
+		Connections: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   "kite",
+			Name:        "connections",
+			Help:        "Number of connected clients.",
+			ConstLabels: labels,
+		}),
+		HandlerGoroutines: prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   "kite",
+			Name:        "handler_goroutines",
+			Help:        "Number of goroutines executing method calls.",
+			ConstLabels: labels,
+		}, func() float64 { return float64(k.HandlerStats().Running) }),
+		HandlerQueue: prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   "kite",
+			Name:        "handler_queued_calls",
+			Help:        "Number of method calls waiting for a free goroutine.",
+			ConstLabels: labels,
+		}, func() float64 { return float64(k.HandlerStats().Queued) }),
+		HandlerRejected: prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace:   "kite",
+			Name:        "handler_rejected_calls_total",
+			Help:        "Total number of method calls rejected due to busy goroutines.",
+			ConstLabels: labels,
+		}, func() float64 { return float64(k.HandlerStats().Rejected) }),
+	}
+
+	m.Registry.MustRegister(
+		m.Requests,
+		m.Errors,
+		m.Throttled,
+		m.Latency,
+		m.SlowCalls,
+		m.Connections,
+		m.HandlerGoroutines,
+		m.HandlerQueue,
+		m.HandlerRejected,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	k.OnConnect(func(*kite.Client) { m.Connections.Inc() })
+	k.OnDisconnect(func(*kite.Client) { m.Connections.Dec() })
+	k.OnResponse(m.observe)
+
+	k.HandleHTTP(Path, promhttp.HandlerFor(m.Registry, promhttp.HandlerOpts{}))
+
+	return m
+}
+
+func (m *Metrics) observe(r *kite.Request, elapsed time.Duration, err *kite.Error) {
+	method := methodLabel(r)
+
+	m.Requests.WithLabelValues(method).Inc()
+	m.Latency.WithLabelValues(method).Observe(elapsed.Seconds())
+
+	if m.slowCallThreshold > 0 && elapsed > m.slowCallThreshold {
+		m.SlowCalls.WithLabelValues(method).Inc()
+	}
+
+	if err == nil {
+		return
+	}
+
+	if err.Type == "requestLimitError" {
+		m.Throttled.WithLabelValues(method).Inc()
+	}
+
+	m.Errors.WithLabelValues(method, err.Type).Inc()
+}
+
+// methodLabel gives the method label of the request, which is the name
+// or the pattern the method is registered with, so the number of label
+// values does not grow with the names the callers make up.
+func methodLabel(r *kite.Request) string {
+	if p := r.Pattern(); p != "" {
+		return p
+	}
+
+	return "notFound"
+}
@@ -0,0 +1,93 @@
+package metrics_test
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/koding/kite"
+	"github.com/koding/kite/metrics"
+)
+
+func TestMetrics(t *testing.T) {
+	k := kite.New("metrics", "0.0.1")
+	k.Config.DisableAuthentication = true
+	k.Config.MaxHandlerGoroutines = 10
+	k.Config.SlowCallThreshold = 20 * time.Millisecond
+
+	k.HandleFunc("ok", func(r *kite.Request) (interface{}, error) {
+		return "ok", nil
+	})
+
+	k.HandleFunc("fail", func(r *kite.Request) (interface{}, error) {
+		return nil, errors.New("fail")
+	})
+
+	k.HandleFunc("slow", func(r *kite.Request) (interface{}, error) {
+		time.Sleep(50 * time.Millisecond)
+		return "ok", nil
+	})
+
+	k.HandleFunc("throttled", func(r *kite.Request) (interface{}, error) {
+		return "ok", nil
+	}).Throttle(time.Hour, 1)
+
+	k.HandleFunc("fs.*", func(r *kite.Request) (interface{}, error) {
+		return "ok", nil
+	})
+
+	k.HandleNotFoundFunc(func(r *kite.Request) (interface{}, error) {
+		return nil, kite.ErrMethodNotFound
+	})
+
+	metrics.New(k)
+
+	go k.Run()
+	defer k.Close()
+	<-k.ServerReadyNotify()
+
+	c := kite.New("exp", "0.0.1").NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", k.Port()))
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for _, method := range []string{"ok", "ok", "fail", "slow", "throttled", "throttled", "fs.read", "fs.write", "foo", "bar"} {
+		c.TellWithTimeout(method, 4*time.Second)
+	}
+
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d%s", k.Port(), metrics.Path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	p, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		`kite_requests_total{kite="metrics",method="ok"} 2`,
+		`kite_requests_total{kite="metrics",method="throttled"} 2`,
+		`kite_requests_total{kite="metrics",method="fs.*"} 2`,
+		`kite_requests_total{kite="metrics",method="notFound"} 2`,
+		`kite_request_errors_total{kite="metrics",method="fail",type="genericError"} 1`,
+		`kite_throttled_requests_total{kite="metrics",method="throttled"} 1`,
+		`kite_request_duration_seconds_count{kite="metrics",method="ok"} 2`,
+		`kite_slow_requests_total{kite="metrics",method="slow"} 1`,
+		`kite_connections{kite="metrics"} 1`,
+		`kite_handler_queued_calls{kite="metrics"} 0`,
+		`kite_handler_rejected_calls_total{kite="metrics"} 0`,
+	}
+
+	for _, w := range want {
+		if !strings.Contains(string(p), w) {
+			t.Errorf("metrics do not contain %q", w)
+		}
+	}
+}
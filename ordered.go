@@ -0,0 +1,132 @@
+package kite
+
+import "sync"
+
+// Ordered makes the responses to the calls of the method be sent to the
+// remote kite in the order the calls were received, even though the calls
+// are executed concurrently and may complete out of order. Responses
+// completed early are held until the responses to the earlier calls
+// are sent.
+//
+// The order is kept per remote kite, among the calls of all the methods
+// ordered with the same key. Use the name of the method as the key to
+// order its calls only, or a key shared by a few methods, e.g. "files"
+// for "files.write" and "files.read", to order their calls together.
+// Responses to calls of other methods are sent as soon as they
+// complete, which is the default.
+//
+// An empty key disables ordering.
+func (m *Method) Ordered(key string) *Method {
+	m.mu.Lock()
+	m.orderKey = key
+	m.resetChain()
+	m.mu.Unlock()
+
+	return m
+}
+
+// sequence orders the responses to the calls of the methods ordered
+// with the same key, received from a single remote kite.
+type sequence struct {
+	mu       sync.Mutex
+	next     uint64            // number of the next received call
+	sent     uint64            // number of the call to be responded to next
+	pending  map[uint64]func() // responses completed out of order
+	flushing bool              // true if a goroutine sends the responses
+}
+
+// ticket is the place of a call in a sequence. A nil ticket
+// responds right away.
+type ticket struct {
+	seq  *sequence
+	n    uint64
+	done bool
+}
+
+// ticket gives the ticket for the call of the method, just received
+// over the session, or nil if the method is not ordered.
+func (c *Client) ticket(m *Method) *ticket {
+	key := m.handlerChain(c.LocalKite).orderKey
+	if key == "" {
+		return nil
+	}
+
+	c.sequencesMu.Lock()
+	seq, ok := c.sequences[key]
+	if !ok {
+		if c.sequences == nil {
+			c.sequences = make(map[string]*sequence)
+		}
+
+		seq = &sequence{pending: make(map[uint64]func())}
+		c.sequences[key] = seq
+	}
+	c.sequencesMu.Unlock()
+
+	seq.mu.Lock()
+	defer seq.mu.Unlock()
+
+	t := &ticket{seq: seq, n: seq.next}
+	seq.next++
+
+	return t
+}
+
+// wrap gives the reply function, which sends the response
+// in the order of the ticket.
+func (t *ticket) wrap(reply func(interface{}, *Error)) func(interface{}, *Error) {
+	if t == nil {
+		return reply
+	}
+
+	return func(result interface{}, err *Error) {
+		t.respond(func() { reply(result, err) })
+	}
+}
+
+// release gives up the place of the call in the sequence,
+// if the call has not been responded to.
+func (t *ticket) release() {
+	if t != nil {
+		t.respond(func() {})
+	}
+}
+
+// respond calls fn once the earlier calls in the sequence are responded
+// to, along with the calls that completed in the meantime.
+func (t *ticket) respond(fn func()) {
+	s := t.seq
+
+	s.mu.Lock()
+
+	if t.done {
+		s.mu.Unlock()
+		return
+	}
+
+	t.done = true
+	s.pending[t.n] = fn
+
+	if s.flushing {
+		s.mu.Unlock()
+		return
+	}
+
+	s.flushing = true
+
+	for {
+		fn, ok := s.pending[s.sent]
+		if !ok {
+			s.flushing = false
+			s.mu.Unlock()
+			return
+		}
+
+		delete(s.pending, s.sent)
+		s.sent++
+
+		s.mu.Unlock()
+		fn()
+		s.mu.Lock()
+	}
+}
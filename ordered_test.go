@@ -0,0 +1,110 @@
+package kite
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestMethod_Ordered(t *testing.T) {
+	k := New("testkite", "0.0.1")
+	k.Config.DisableAuthentication = true
+
+	sleep := func(r *Request) (interface{}, error) {
+		d := time.Duration(r.Args.One().MustFloat64()) * time.Millisecond
+		time.Sleep(d)
+		return r.Method, nil
+	}
+
+	k.HandleFunc("files.write", sleep).Ordered("files")
+	k.HandleFunc("files.read", sleep).Ordered("files")
+	k.HandleFunc("ping", sleep)
+
+	go k.Run()
+	defer k.Close()
+	<-k.ServerReadyNotify()
+
+	c := New("exp", "0.0.1").NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", k.Port()))
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	start := time.Now()
+
+	write := c.Go("files.write", 300)
+	read := c.Go("files.read", 0)
+	ping := c.Go("ping", 0)
+
+	// The response to ping is not held, as ping is not ordered.
+	if resp := <-ping; resp.Err != nil {
+		t.Fatal(resp.Err)
+	}
+
+	if d := time.Since(start); d > 200*time.Millisecond {
+		t.Errorf("ping took %s", d)
+	}
+
+	// The response to files.read is held until files.write completes.
+	select {
+	case resp := <-read:
+		if resp.Err != nil {
+			t.Fatal(resp.Err)
+		}
+
+		select {
+		case <-write:
+		default:
+			t.Error("files.read completed before files.write")
+		}
+	case resp := <-write:
+		if resp.Err != nil {
+			t.Fatal(resp.Err)
+		}
+
+		if resp := <-read; resp.Err != nil {
+			t.Fatal(resp.Err)
+		}
+	}
+
+	if d := time.Since(start); d < 300*time.Millisecond {
+		t.Errorf("ordered calls took %s, want at least 300ms", d)
+	}
+}
+
+func TestTicket(t *testing.T) {
+	c := &Client{}
+	m := &Method{orderKey: "key"}
+
+	var got []int
+	reply := func(i int) func(interface{}, *Error) {
+		return func(interface{}, *Error) { got = append(got, i) }
+	}
+
+	t1, t2, t3, t4 := c.ticket(m), c.ticket(m), c.ticket(m), c.ticket(m)
+
+	t3.wrap(reply(3))(nil, nil)
+	t2.wrap(reply(2))(nil, nil)
+
+	if len(got) != 0 {
+		t.Fatalf("got %v responses before the first one", got)
+	}
+
+	// A call which failed without a response does not hold the later ones.
+	t1.release()
+	t1.wrap(reply(1))(nil, nil)
+
+	t4.wrap(reply(4))(nil, nil)
+	t4.release()
+
+	if want := []int{2, 3, 4}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	// Unordered methods respond right away.
+	c.ticket(&Method{}).wrap(reply(5))(nil, nil)
+
+	if len(got) != 4 {
+		t.Fatalf("got %v, want 5 responded", got)
+	}
+}
@@ -0,0 +1,499 @@
+package kite
+
+import (
+	"context"
+	"math/rand"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/koding/kite/dnode"
+	"github.com/koding/kite/protocol"
+)
+
+// DefaultPoolRefresh is the default interval of refreshing
+// the set of pooled kites.
+const DefaultPoolRefresh = 30 * time.Second
+
+// PoolKite is a kite client managed by a Pool.
+type PoolKite struct {
+	*Client
+
+	pending int64 // number of calls in flight, accessed atomically
+	weight  int64 // weight the kite registered with, accessed atomically
+}
+
+// Pending gives number of calls to the kite that are still in flight.
+func (pk *PoolKite) Pending() int64 {
+	return atomic.LoadInt64(&pk.pending)
+}
+
+// Weight gives the weight the kite registered to Kontrol with,
+// see config.Config.Weight. It is at least 1.
+func (pk *PoolKite) Weight() int64 {
+	if w := atomic.LoadInt64(&pk.weight); w > 0 {
+		return w
+	}
+
+	return 1
+}
+
+// PoolStrategy picks a kite out of the pooled ones, which is going
+// to handle the next call. The kites slice is never empty.
+type PoolStrategy interface {
+	Pick(kites []*PoolKite) *PoolKite
+}
+
+// PoolStrategyFunc is a type adapter to allow the use of ordinary
+// functions as PoolStrategy.
+type PoolStrategyFunc func(kites []*PoolKite) *PoolKite
+
+// Pick calls f(kites).
+func (f PoolStrategyFunc) Pick(kites []*PoolKite) *PoolKite {
+	return f(kites)
+}
+
+// RoundRobin gives a strategy, which picks the kites in turns.
+func RoundRobin() PoolStrategy {
+	var n uint64
+
+	return PoolStrategyFunc(func(kites []*PoolKite) *PoolKite {
+		i := atomic.AddUint64(&n, 1) - 1
+		return kites[i%uint64(len(kites))]
+	})
+}
+
+// WeightedRoundRobin gives a strategy, which picks the kites in turns
+// proportionally to their weights, e.g. a kite of weight 3 is picked three
+// times as often as a kite of weight 1. The picks of a kite are spread
+// evenly between the picks of other kites.
+func WeightedRoundRobin() PoolStrategy {
+	var mu sync.Mutex
+	current := make(map[*PoolKite]int64)
+
+	return PoolStrategyFunc(func(kites []*PoolKite) *PoolKite {
+		mu.Lock()
+		defer mu.Unlock()
+
+		// Forget the kites which are no longer pooled.
+		if len(current) > len(kites) {
+			next := make(map[*PoolKite]int64, len(kites))
+			for _, pk := range kites {
+				next[pk] = current[pk]
+			}
+			current = next
+		}
+
+		var (
+			best  *PoolKite
+			total int64
+		)
+
+		for _, pk := range kites {
+			w := pk.Weight()
+			total += w
+			current[pk] += w
+
+			if best == nil || current[pk] > current[best] {
+				best = pk
+			}
+		}
+
+		current[best] -= total
+
+		return best
+	})
+}
+
+// LeastPending gives a strategy, which picks the kite with the smallest
+// number of calls in flight relative to its weight.
+func LeastPending() PoolStrategy {
+	return PoolStrategyFunc(func(kites []*PoolKite) *PoolKite {
+		least := kites[0]
+
+		for _, pk := range kites[1:] {
+			if pk.Pending()*least.Weight() < least.Pending()*pk.Weight() {
+				least = pk
+			}
+		}
+
+		return least
+	})
+}
+
+// Random gives a strategy, which picks a kite at random with
+// the probability proportional to its weight.
+func Random() PoolStrategy {
+	return PoolStrategyFunc(func(kites []*PoolKite) *PoolKite {
+		var total int64
+		for _, pk := range kites {
+			total += pk.Weight()
+		}
+
+		n := rand.Int63n(total)
+
+		for _, pk := range kites {
+			if n -= pk.Weight(); n < 0 {
+				return pk
+			}
+		}
+
+		return kites[len(kites)-1]
+	})
+}
+
+// Pool balances calls across all the kites that match a Kontrol query.
+//
+// The set of kites is fetched from Kontrol on the first call and refreshed
+// periodically afterwards - new kites are dialed and kites that are no
+// longer registered are closed.
+//
+// Calls of latency sensitive methods may be hedged, see HedgeDelay.
+//
+// The Strategy, Refresh, HedgeDelay and Hedged fields may be changed
+// only before the first call.
+type Pool struct {
+	// Strategy picks the kite for each call, WeightedRoundRobin by default.
+	Strategy PoolStrategy
+
+	// Refresh is the interval of refreshing the set of kites,
+	// DefaultPoolRefresh by default.
+	Refresh time.Duration
+
+	// HedgeDelay, if positive, enables hedging of the calls of the methods
+	// listed in Hedged. If the kite a hedged call was sent to does not
+	// respond within HedgeDelay, the call is sent to another pooled kite
+	// as well. The first successful response is returned and the other
+	// call is canceled, also on the remote kite, see Client.CancelRemote.
+	//
+	// A slow kite does not slow down the hedged calls this way, at the
+	// cost of the extra calls. HedgeDelay is typically set to a high
+	// percentile of the latency of the method, e.g. p95.
+	HedgeDelay time.Duration
+
+	// Hedged lists the methods, which calls are hedged. As the calls
+	// may be executed twice, only methods safe to be called more than
+	// once should be listed. The names may be patterns, like the ones
+	// the methods are handled with, e.g. "users.get*".
+	Hedged []string
+
+	k     *Kite
+	query *protocol.KontrolQuery
+
+	// getKites fetches the current set of kites, k.GetKites by default.
+	getKites func(*protocol.KontrolQuery) ([]*Client, error)
+
+	mu    sync.RWMutex
+	kites []*PoolKite
+
+	once   sync.Once
+	closed chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewPool gives a new pool of kites that match the given query.
+func (k *Kite) NewPool(query *protocol.KontrolQuery) *Pool {
+	return &Pool{
+		k:        k,
+		query:    query,
+		getKites: k.GetKites,
+		closed:   make(chan struct{}),
+	}
+}
+
+// Tell makes a blocking method call to one of the pooled kites,
+// see (*Client).Tell for details.
+func (p *Pool) Tell(method string, args ...interface{}) (result *dnode.Partial, err error) {
+	return p.TellWithTimeout(method, 0, args...)
+}
+
+// TellWithTimeout does the same thing with Tell() method except it takes an
+// extra argument that is the timeout for waiting reply from the remote Kite.
+// If timeout is given 0, the behavior is same as Tell().
+func (p *Pool) TellWithTimeout(method string, timeout time.Duration, args ...interface{}) (result *dnode.Partial, err error) {
+	if p.hedges(method) {
+		ctx := context.Background()
+
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+
+		return p.tellHedged(ctx, method, args)
+	}
+
+	pk, err := p.pick(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	atomic.AddInt64(&pk.pending, 1)
+	defer atomic.AddInt64(&pk.pending, -1)
+
+	return pk.TellWithTimeout(method, timeout, args...)
+}
+
+// TellWithContext makes a blocking method call to one of the pooled
+// kites, see (*Client).TellWithContext for details.
+func (p *Pool) TellWithContext(ctx context.Context, method string, args ...interface{}) (result *dnode.Partial, err error) {
+	if p.hedges(method) {
+		return p.tellHedged(ctx, method, args)
+	}
+
+	pk, err := p.pick(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	atomic.AddInt64(&pk.pending, 1)
+	defer atomic.AddInt64(&pk.pending, -1)
+
+	return pk.TellWithContext(ctx, method, args...)
+}
+
+// hedges tells whether calls of the method are hedged.
+func (p *Pool) hedges(method string) bool {
+	if p.HedgeDelay <= 0 {
+		return false
+	}
+
+	for _, pattern := range p.Hedged {
+		if ok, _ := path.Match(pattern, method); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// tellHedged makes the call to one of the pooled kites and, if it does not
+// respond within HedgeDelay, to another one. It gives the first successful
+// response, or the error of the last call that failed.
+func (p *Pool) tellHedged(ctx context.Context, method string, args []interface{}) (*dnode.Partial, error) {
+	first, err := p.pick(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Canceling the context cancels the call that lost.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		res *dnode.Partial
+		err error
+	}
+
+	results := make(chan result, 2)
+
+	tell := func(pk *PoolKite) {
+		atomic.AddInt64(&pk.pending, 1)
+
+		go func() {
+			defer atomic.AddInt64(&pk.pending, -1)
+
+			res, err := pk.TellWithContext(ctx, method, args...)
+			results <- result{res, err}
+		}()
+	}
+
+	tell(first)
+
+	t := time.NewTimer(p.HedgeDelay)
+	defer t.Stop()
+
+	select {
+	case r := <-results:
+		return r.res, r.err
+	case <-t.C:
+	}
+
+	pending := 1
+
+	if second, err := p.pick(first); err == nil && second != first {
+		p.k.Log.Debug("Hedging %q call to %s, %s did not respond within %s",
+			method, second.Kite, first.Kite, p.HedgeDelay)
+
+		tell(second)
+		pending++
+	}
+
+	var r result
+
+	for ; pending > 0; pending-- {
+		if r = <-results; r.err == nil {
+			break
+		}
+	}
+
+	return r.res, r.err
+}
+
+// Kites gives the currently pooled kites.
+func (p *Pool) Kites() []*PoolKite {
+	p.start()
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	kites := make([]*PoolKite, len(p.kites))
+	copy(kites, p.kites)
+
+	return kites
+}
+
+// Close stops refreshing the pool and closes all the pooled kites.
+func (p *Pool) Close() {
+	p.mu.Lock()
+	select {
+	case <-p.closed:
+		p.mu.Unlock()
+		return
+	default:
+		close(p.closed)
+	}
+	p.mu.Unlock()
+
+	p.wg.Wait()
+
+	p.mu.Lock()
+	kites := p.kites
+	p.kites = nil
+	p.mu.Unlock()
+
+	for _, pk := range kites {
+		pk.Close()
+	}
+}
+
+// pick picks the kite for the next call with the Strategy. The except
+// kite, if non-nil, is not picked unless it is the only pooled kite.
+func (p *Pool) pick(except *PoolKite) (*PoolKite, error) {
+	p.start()
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if len(p.kites) == 0 {
+		return nil, ErrNoKitesAvailable
+	}
+
+	// Prefer kites which are not shutting down.
+	kites := p.kites
+	for i, pk := range p.kites {
+		if pk == except || pk.GoingAway() {
+			kites = make([]*PoolKite, 0, len(p.kites))
+			kites = append(kites, p.kites[:i]...)
+			for _, pk := range p.kites[i+1:] {
+				if pk != except && !pk.GoingAway() {
+					kites = append(kites, pk)
+				}
+			}
+			break
+		}
+	}
+
+	if len(kites) == 0 {
+		kites = p.kites
+	}
+
+	return p.Strategy.Pick(kites), nil
+}
+
+func (p *Pool) start() {
+	p.once.Do(func() {
+		if p.Strategy == nil {
+			p.Strategy = WeightedRoundRobin()
+		}
+
+		if p.Refresh <= 0 {
+			p.Refresh = DefaultPoolRefresh
+		}
+
+		p.refresh()
+
+		p.wg.Add(1)
+		go p.refreshLoop()
+	})
+}
+
+func (p *Pool) refreshLoop() {
+	defer p.wg.Done()
+
+	t := time.NewTicker(p.Refresh)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-p.closed:
+			return
+		case <-t.C:
+			p.refresh()
+		}
+	}
+}
+
+// refresh synchronizes the pooled kites with the ones returned
+// by Kontrol.
+func (p *Pool) refresh() {
+	clients, err := p.getKites(p.query)
+	if err != nil && err != ErrNoKitesAvailable {
+		// Keep the current kites, they may be still reachable.
+		p.k.Log.Warning("Unable to refresh pool of %q kites: %s", p.query.Name, err)
+		return
+	}
+
+	p.mu.RLock()
+	current := make(map[string]*PoolKite, len(p.kites))
+	for _, pk := range p.kites {
+		current[pk.Kite.ID] = pk
+	}
+	p.mu.RUnlock()
+
+	kites := make([]*PoolKite, 0, len(clients))
+
+	for _, c := range clients {
+		if pk, ok := current[c.Kite.ID]; ok {
+			delete(current, c.Kite.ID)
+			atomic.StoreInt64(&pk.weight, int64(c.Weight))
+			kites = append(kites, pk)
+			c.Close()
+			continue
+		}
+
+		// The calls that lost are canceled on the remote kites as well.
+		if p.HedgeDelay > 0 {
+			c.CancelRemote = true
+		}
+
+		if err := c.DialTimeout(p.k.Config.Timeout); err != nil {
+			p.k.Log.Warning("Unable to dial %s: %s", c.Kite, err)
+			c.Close()
+			continue
+		}
+
+		kites = append(kites, &PoolKite{Client: c, weight: int64(c.Weight)})
+	}
+
+	p.mu.Lock()
+	select {
+	case <-p.closed:
+		// Pool was closed in the meantime.
+		p.mu.Unlock()
+
+		for _, pk := range kites {
+			pk.Close()
+		}
+		return
+	default:
+		p.kites = kites
+	}
+	p.mu.Unlock()
+
+	// Close kites that are gone.
+	for _, pk := range current {
+		pk.Close()
+	}
+}
@@ -0,0 +1,255 @@
+package kite
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/koding/kite/protocol"
+)
+
+func TestPool(t *testing.T) {
+	var kites []*Kite
+
+	for i := 0; i < 3; i++ {
+		k := New("pooled", "0.0.1")
+		k.Config.DisableAuthentication = true
+		k.HandleFunc("id", func(r *Request) (interface{}, error) {
+			return r.LocalKite.Id, nil
+		})
+
+		go k.Run()
+		<-k.ServerReadyNotify()
+		defer k.Close()
+
+		kites = append(kites, k)
+	}
+
+	c := New("client", "0.0.1")
+	c.Config.DisableAuthentication = true
+
+	var mu sync.Mutex
+	registered := kites
+
+	p := c.NewPool(&protocol.KontrolQuery{Name: "pooled"})
+	p.getKites = func(*protocol.KontrolQuery) ([]*Client, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if len(registered) == 0 {
+			return nil, ErrNoKitesAvailable
+		}
+
+		clients := make([]*Client, len(registered))
+		for i, k := range registered {
+			clients[i] = c.NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", k.Port()))
+			clients[i].Kite = *k.Kite()
+		}
+
+		return clients, nil
+	}
+	defer p.Close()
+
+	// Each kite is called once in a round.
+	seen := make(map[string]int)
+
+	for i := 0; i < 2*len(kites); i++ {
+		result, err := p.TellWithTimeout("id", 4*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		seen[result.MustString()]++
+	}
+
+	for _, k := range kites {
+		if n := seen[k.Id]; n != 2 {
+			t.Errorf("%s: got %d calls, want 2", k.Id, n)
+		}
+	}
+
+	// Deregistered kites are removed from the pool.
+	mu.Lock()
+	registered = kites[:1]
+	mu.Unlock()
+
+	p.refresh()
+
+	if n := len(p.Kites()); n != 1 {
+		t.Fatalf("got %d kites, want 1", n)
+	}
+
+	for i := 0; i < 3; i++ {
+		result, err := p.TellWithTimeout("id", 4*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if id := result.MustString(); id != kites[0].Id {
+			t.Fatalf("got %q, want %q", id, kites[0].Id)
+		}
+	}
+
+	mu.Lock()
+	registered = nil
+	mu.Unlock()
+
+	p.refresh()
+
+	if _, err := p.Tell("id"); err != ErrNoKitesAvailable {
+		t.Fatalf("got %v, want %v", err, ErrNoKitesAvailable)
+	}
+}
+
+func TestPoolStrategy(t *testing.T) {
+	kites := []*PoolKite{
+		{Client: &Client{}, pending: 3},
+		{Client: &Client{}, pending: 1},
+		{Client: &Client{}, pending: 2},
+	}
+
+	if pk := LeastPending().Pick(kites); pk != kites[1] {
+		t.Errorf("LeastPending: got %d pending, want 1", pk.Pending())
+	}
+
+	rr := RoundRobin()
+
+	for i := 0; i < 2*len(kites); i++ {
+		if pk := rr.Pick(kites); pk != kites[i%len(kites)] {
+			t.Errorf("RoundRobin: got %p at %d, want %p", pk, i, kites[i%len(kites)])
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		pk := Random().Pick(kites)
+		if pk != kites[0] && pk != kites[1] && pk != kites[2] {
+			t.Fatalf("Random: got unknown kite %p", pk)
+		}
+	}
+}
+
+func TestPoolStrategyWeighted(t *testing.T) {
+	kites := []*PoolKite{
+		{Client: &Client{}, pending: 4, weight: 4},
+		{Client: &Client{}, pending: 2},
+		{Client: &Client{}, pending: 3, weight: 2},
+	}
+
+	if pk := LeastPending().Pick(kites); pk != kites[0] {
+		t.Errorf("LeastPending: got %d pending of weight %d, want 4 of weight 4", pk.Pending(), pk.Weight())
+	}
+
+	wrr := WeightedRoundRobin()
+	picks := make(map[*PoolKite]int)
+
+	for i := 0; i < 70; i++ {
+		picks[wrr.Pick(kites)]++
+	}
+
+	for _, pk := range kites {
+		if want := 10 * int(pk.Weight()); picks[pk] != want {
+			t.Errorf("WeightedRoundRobin: got %d picks of weight %d, want %d", picks[pk], pk.Weight(), want)
+		}
+	}
+
+	// The picks of the heaviest kite are interleaved with other ones.
+	if pk := wrr.Pick(kites); pk != kites[0] {
+		t.Errorf("WeightedRoundRobin: got weight %d, want 4", pk.Weight())
+	}
+
+	if pk := wrr.Pick(kites); pk == kites[0] {
+		t.Errorf("WeightedRoundRobin: got weight 4 picked twice in a row")
+	}
+
+	// A removed kite is no longer picked.
+	for i := 0; i < 10; i++ {
+		if pk := wrr.Pick(kites[1:]); pk == kites[0] {
+			t.Fatalf("WeightedRoundRobin: got removed kite")
+		}
+	}
+}
+
+func TestPoolHedging(t *testing.T) {
+	var kites []*Kite
+	canceled := make(chan struct{}, 1)
+
+	for i := 0; i < 2; i++ {
+		slow := i == 0
+
+		k := New("pooled", "0.0.1")
+		k.Config.DisableAuthentication = true
+		k.HandleFunc("id", func(r *Request) (interface{}, error) {
+			if slow {
+				select {
+				case <-r.Ctx().Done():
+					canceled <- struct{}{}
+				case <-time.After(2 * time.Second):
+				}
+			}
+			return r.LocalKite.Id, nil
+		})
+
+		go k.Run()
+		<-k.ServerReadyNotify()
+		defer k.Close()
+
+		kites = append(kites, k)
+	}
+
+	c := New("client", "0.0.1")
+	c.Config.DisableAuthentication = true
+
+	p := c.NewPool(&protocol.KontrolQuery{Name: "pooled"})
+	p.getKites = func(*protocol.KontrolQuery) ([]*Client, error) {
+		clients := make([]*Client, len(kites))
+		for i, k := range kites {
+			clients[i] = c.NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", k.Port()))
+			clients[i].Kite = *k.Kite()
+		}
+
+		return clients, nil
+	}
+	defer p.Close()
+
+	// Calls go to the slow kite first.
+	p.Strategy = PoolStrategyFunc(func(kites []*PoolKite) *PoolKite {
+		return kites[0]
+	})
+	p.HedgeDelay = 50 * time.Millisecond
+	p.Hedged = []string{"i*"}
+
+	start := time.Now()
+
+	result, err := p.TellWithTimeout("id", 4*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if id := result.MustString(); id != kites[1].Id {
+		t.Fatalf("got %q, want %q", id, kites[1].Id)
+	}
+
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("hedged call took %s", d)
+	}
+
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("the call to the slow kite was not canceled")
+	}
+
+	// Calls of other methods are not hedged.
+	p.Hedged = []string{"other"}
+
+	result, err = p.TellWithContext(context.Background(), "id")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if id := result.MustString(); id != kites[0].Id {
+		t.Fatalf("got %q, want %q", id, kites[0].Id)
+	}
+}
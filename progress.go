@@ -0,0 +1,81 @@
+package kite
+
+import (
+	"context"
+	"sync"
+
+	"github.com/koding/kite/dnode"
+)
+
+// Progress is a progress report of a long-running method call.
+type Progress struct {
+	// Percent tells how much of the work is done, from 0 to 100.
+	Percent float64 `json:"percent"`
+
+	// Message describes the current stage of the work.
+	Message string `json:"message,omitempty"`
+}
+
+// Progress reports the progress of the method call to the caller, e.g.:
+//
+//	k.HandleFunc("provision", func(r *kite.Request) (interface{}, error) {
+//		r.Progress(0, "creating machine")
+//		...
+//		r.Progress(50, "installing packages")
+//		...
+//		return machine, nil
+//	})
+//
+// It is a nop if the caller did not ask for progress reports,
+// see (*Client).TellWithProgress. The returned error is non-nil
+// if sending the report failed.
+func (r *Request) Progress(percent float64, msg string) error {
+	if !r.progress.IsValid() {
+		return nil
+	}
+
+	return r.progress.Call(&Progress{
+		Percent: percent,
+		Message: msg,
+	})
+}
+
+// TellWithProgress makes a blocking method call to the server, like Tell
+// does, calling the progress function with each progress report sent
+// by the method handler with (*Request).Progress.
+//
+// The progress function is not called after TellWithProgress returns.
+func (c *Client) TellWithProgress(method string, progress func(*Progress), args ...interface{}) (result *dnode.Partial, err error) {
+	var (
+		mu   sync.Mutex
+		done bool
+	)
+
+	progressCallback := dnode.Callback(func(arg *dnode.Partial) {
+		var p Progress
+
+		if err := arg.One().Unmarshal(&p); err != nil {
+			c.LocalKite.Log.Error("invalid progress report: %s", err)
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		if !done {
+			progress(&p)
+		}
+	})
+
+	responseChan := make(chan *response, 1)
+
+	c.sendMethod(context.Background(), method, args, 0, callOptions{ProgressCallback: progressCallback}, responseChan)
+
+	resp := <-responseChan
+
+	mu.Lock()
+	done = true
+	mu.Unlock()
+
+	return resp.Result, resp.Err
+}
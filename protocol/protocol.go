@@ -7,6 +7,7 @@ import (
 	"encoding/json"
 	"errors"
 	"strings"
+	"time"
 
 	"github.com/koding/kite/dnode"
 )
@@ -117,6 +118,21 @@ type RegisterArgs struct {
 	URL  string `json:"url"`
 	Kite *Kite  `json:"kite,omitempty"`
 	Auth *Auth  `json:"auth,omitempty"`
+
+	// Labels are arbitrary key/value pairs describing the kite, e.g.
+	// zone, shard or capacity, which can be matched with
+	// KontrolQuery.Labels.
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// URLs are alternative URLs the kite is reachable at, e.g. over
+	// other network interfaces, in order of preference. Clients dial
+	// them when the kite is not reachable at URL.
+	URLs []string `json:"urls,omitempty"`
+
+	// Weight is the capacity of the kite relative to other kites,
+	// which is used for balancing calls across them. Zero means
+	// the default weight of 1.
+	Weight int `json:"weight,omitempty"`
 }
 
 type Auth struct {
@@ -141,12 +157,142 @@ type RegisterResult struct {
 	// In such case Kontrol is going to create new kite key by signing
 	// it with new keys.
 	KiteKey string `json:"kiteKey,omitempty"`
+
+	// Keys are public keys Kontrol currently trusts. Kites trust them
+	// as well when verifying tokens, so tokens signed with any of
+	// them are accepted while Kontrol's key pairs are rotated.
+	Keys []string `json:"keys,omitempty"`
+}
+
+// GetKeysResult is the result of Kontrol's "getKeys" method.
+type GetKeysResult struct {
+	// Current is the public key new kite keys are signed with.
+	Current string `json:"current"`
+
+	// Keys are all the public keys Kontrol currently trusts,
+	// including the current one.
+	Keys []string `json:"keys"`
+}
+
+// AdminListKitesArgs is the argument of Kontrol's "admin.listKites" method.
+type AdminListKitesArgs struct {
+	// Query selects the kites to list, its Username must be set.
+	Query *KontrolQuery `json:"query"`
+}
+
+// AdminKite is a kite registered to Kontrol, as listed by Kontrol's
+// "admin.listKites" method.
+type AdminKite struct {
+	Kite   Kite              `json:"kite"`
+	URL    string            `json:"url"`
+	URLs   []string          `json:"urls,omitempty"`
+	KeyID  string            `json:"keyId,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Weight int               `json:"weight,omitempty"`
+
+	// Heartbeat is nil, if the kite does not send heartbeats to the Kontrol,
+	// e.g. it registered to another Kontrol sharing the same storage.
+	Heartbeat *HeartbeatStatus `json:"heartbeat,omitempty"`
+}
+
+// AdminListKitesResult is the result of Kontrol's "admin.listKites" method.
+type AdminListKitesResult struct {
+	Kites []*AdminKite `json:"kites"`
+}
+
+// HeartbeatStatus describes heartbeats of a kite registered to Kontrol.
+type HeartbeatStatus struct {
+	Kite Kite `json:"kite"`
+
+	// Transport is "kite" for kites registered over a kite connection
+	// and "http" for the ones registered with HTTP requests.
+	Transport string `json:"transport"`
+
+	Registered    time.Time `json:"registered"`
+	LastHeartbeat time.Time `json:"lastHeartbeat"`
+
+	// Alive is false, if the kite missed its heartbeats.
+	Alive bool `json:"alive"`
+}
+
+// AdminDeregisterArgs is the argument of Kontrol's "admin.deregister" method.
+type AdminDeregisterArgs struct {
+	KontrolQuery // kite to deregister, must match exactly one kite
+
+	// Revoke revokes the kite key of the kite as well, so it can't
+	// register again.
+	Revoke bool `json:"revoke,omitempty"`
+}
+
+// AdminKey is a key pair of Kontrol, as listed by Kontrol's "admin.getKeys"
+// method. Private keys are never listed.
+type AdminKey struct {
+	ID     string `json:"id"`
+	Public string `json:"public"`
+
+	// Current is true for the key pair new kite keys are signed with.
+	Current bool `json:"current"`
+
+	// Retiring is true for key pairs replaced by a rotation, which are
+	// going to be deleted once the grace period is over.
+	Retiring bool `json:"retiring"`
+}
+
+// Revocation identifies revoked kite keys and tokens, either by their
+// JWT ID (jti claim) or by the ID of the kite using them. The JWT ID
+// of a kite key is the same as the ID of the kite.
+type Revocation struct {
+	JTI    string `json:"jti,omitempty"`
+	KiteID string `json:"kiteID,omitempty"`
+
+	// Expires is a Unix time after which the revocation can be forgotten,
+	// e.g. the expiration time of the revoked token. Zero means never.
+	Expires int64 `json:"expires,omitempty"`
+}
+
+// GetRevocationsArgs is the argument of Kontrol's "getRevocations" method.
+type GetRevocationsArgs struct {
+	// Since is the Version of the last GetRevocationsResult the caller
+	// received, only revocations added afterwards are returned.
+	Since int64 `json:"since"`
+
+	// Epoch is the Epoch of the last GetRevocationsResult the caller
+	// received. Since is ignored if it does not match the current one.
+	Epoch string `json:"epoch,omitempty"`
+
+	// WatchCallback, if set, is called with *GetRevocationsResult
+	// argument whenever new revocations are added.
+	WatchCallback dnode.Function `json:"watchCallback"`
+}
+
+// GetRevocationsResult is the result of Kontrol's "getRevocations" method.
+type GetRevocationsResult struct {
+	Revocations []*Revocation `json:"revocations"`
+	Version     int64         `json:"version"`
+
+	// Epoch identifies the sequence of versions, it changes
+	// when Kontrol restarts and its versions start over.
+	Epoch string `json:"epoch,omitempty"`
 }
 
 type GetKitesArgs struct {
 	Query         *KontrolQuery   `json:"query"`
 	WatchCallback dnode.Function  `json:"watchCallback"`
 	Who           json.RawMessage `json:"who"`
+
+	// Since is the revision of the last KiteEvent the caller received.
+	// If set along with WatchCallback, the watch is resumed with changes
+	// made after the revision, without listing the kites again.
+	Since int64 `json:"since,omitempty"`
+
+	// Federated makes Kontrol return kites registered to Kontrols of other
+	// regions, it is federated with, after the ones registered to it.
+	// Watching kites of other regions is not supported.
+	Federated bool `json:"federated,omitempty"`
+
+	// ProofKey is the base64 encoded Ed25519 public key of the caller,
+	// the returned tokens are bound to, see kitekey.KiteClaims.
+	ProofKey string `json:"proofKey,omitempty"`
 }
 
 // GetTokenArgs is a request value for the "getToken" kontrol method.
@@ -154,6 +300,10 @@ type GetTokenArgs struct {
 	KontrolQuery // kite to generate a token for
 
 	Force bool `json:"force"` // force creation of a new token
+
+	// ProofKey is the base64 encoded Ed25519 public key of the caller,
+	// the token is bound to, see kitekey.KiteClaims.
+	ProofKey string `json:"proofKey,omitempty"`
 }
 
 type WhoResult struct {
@@ -162,13 +312,22 @@ type WhoResult struct {
 
 type GetKitesResult struct {
 	Kites []*KiteWithToken `json:"kites"`
+
+	// Revision and WatcherID are set if the caller passed WatchCallback.
+	// Revision is the one the watch starts from, WatcherID is used for
+	// canceling the watch with Kontrol's "cancelWatcher" method.
+	Revision  int64  `json:"revision,omitempty"`
+	WatcherID string `json:"watcherID,omitempty"`
 }
 
 type KiteWithToken struct {
-	Kite  Kite   `json:"kite"`
-	URL   string `json:"url"`
-	KeyID string `json:"keyId,omitempty"`
-	Token string `json:"token"`
+	Kite   Kite              `json:"kite"`
+	URL    string            `json:"url"`
+	URLs   []string          `json:"urls,omitempty"` // alternative URLs, see RegisterArgs
+	KeyID  string            `json:"keyId,omitempty"`
+	Token  string            `json:"token"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Weight int               `json:"weight,omitempty"` // see RegisterArgs
 }
 
 // KiteEvent is the struct that is sent as an argument in watchCallback of
@@ -178,8 +337,15 @@ type KiteEvent struct {
 	Kite   Kite       `json:"kite"`
 
 	// Required to connect when Action == Register
-	URL   string `json:"url,omitempty"`
-	Token string `json:"token,omitempty"`
+	URL    string            `json:"url,omitempty"`
+	URLs   []string          `json:"urls,omitempty"`
+	Token  string            `json:"token,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Weight int               `json:"weight,omitempty"`
+
+	// Revision of the change, used for resuming the watch
+	// with GetKitesArgs.Since.
+	Revision int64 `json:"revision,omitempty"`
 }
 
 type KiteAction string
@@ -187,8 +353,41 @@ type KiteAction string
 const (
 	Register   KiteAction = "REGISTER"
 	Deregister KiteAction = "DEREGISTER"
+
+	// Reset is sent when the watch cannot be continued, e.g. the revision
+	// it was resumed from is no longer available. The kites need to be
+	// listed again.
+	Reset KiteAction = "RESET"
+
+	// Expire is sent to subscribers of Kontrol's registration events,
+	// when a kite stopped sending heartbeats, so its registration
+	// is going to expire.
+	Expire KiteAction = "EXPIRE"
 )
 
+// RegistrationEvent is sent to subscribers of Kontrol's registration events,
+// when a kite registers, is deregistered or expires.
+type RegistrationEvent struct {
+	Action KiteAction        `json:"action"`
+	Kite   Kite              `json:"kite"`
+	URL    string            `json:"url,omitempty"`
+	URLs   []string          `json:"urls,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Weight int               `json:"weight,omitempty"`
+	Time   time.Time         `json:"time"`
+}
+
+// SubscribeArgs is the argument of Kontrol's "subscribe" method.
+type SubscribeArgs struct {
+	// Query selects the kites events are sent for, events of all
+	// kites are sent if nil.
+	Query *KontrolQuery `json:"query,omitempty"`
+
+	// Callback is called with *RegistrationEvent argument
+	// for each event.
+	Callback dnode.Function `json:"callback"`
+}
+
 // KontrolQuery is a structure of message sent to Kontrol. It is used for
 // querying kites based on the incoming field parameters. Missing fields are
 // not counted during the query (for example if the "version" field is empty,
@@ -202,6 +401,24 @@ type KontrolQuery struct {
 	Region      string `json:"region"`
 	Hostname    string `json:"hostname"`
 	ID          string `json:"id"`
+
+	// Labels select kites registered with all the given labels.
+	// A label with an empty value selects kites having the label
+	// set to any value.
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// MatchLabels tells whether the given labels of a kite match
+// the label selector of the query.
+func (k *KontrolQuery) MatchLabels(labels map[string]string) bool {
+	for key, value := range k.Labels {
+		v, ok := labels[key]
+		if !ok || (value != "" && v != value) {
+			return false
+		}
+	}
+
+	return true
 }
 
 func (k KontrolQuery) Fields() map[string]string {
@@ -61,3 +61,30 @@ func TestKiteQuery(t *testing.T) {
 	expect(q.Version, "version")
 	expect(q.Hostname, "hostname")
 }
+
+func TestKontrolQueryMatchLabels(t *testing.T) {
+	labels := map[string]string{
+		"zone":  "eu-1a",
+		"shard": "2",
+	}
+
+	cases := []struct {
+		selector map[string]string
+		ok       bool
+	}{
+		{nil, true},
+		{map[string]string{"zone": "eu-1a"}, true},
+		{map[string]string{"zone": "eu-1a", "shard": "2"}, true},
+		{map[string]string{"shard": ""}, true},
+		{map[string]string{"zone": "us-1a"}, false},
+		{map[string]string{"zone": "eu-1a", "capacity": ""}, false},
+	}
+
+	for i, cas := range cases {
+		q := &KontrolQuery{Labels: cas.selector}
+
+		if ok := q.MatchLabels(labels); ok != cas.ok {
+			t.Errorf("%d: got %t, want %t", i, ok, cas.ok)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package kite
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/koding/kite/config"
+)
+
+// Proxy makes the client dial the remote kite through the proxy
+// at the given URL, overriding Config.ProxyURL. See Config.ProxyURL
+// for the supported proxies.
+//
+// Proxy must be called before Dial, it is not applied to
+// an already established connection.
+func (c *Client) Proxy(proxyURL string) error {
+	u, err := parseProxyURL(proxyURL)
+	if err != nil {
+		return err
+	}
+
+	c.m.Lock()
+	c.proxy = u
+	c.m.Unlock()
+
+	return nil
+}
+
+// proxyURL gives the proxy the remote kite is dialed through,
+// or nil if the proxy is given by the environment.
+func (c *Client) proxyURL() (*url.URL, error) {
+	c.m.RLock()
+	proxy := c.proxy
+	c.m.RUnlock()
+
+	if proxy != nil {
+		return proxy, nil
+	}
+
+	if s := c.config().ProxyURL; s != "" {
+		return parseProxyURL(s)
+	}
+
+	return nil, nil
+}
+
+// httpClient gives the HTTP client used for registering
+// to Kontrol, which dials through Config.ProxyURL if set.
+func (k *Kite) httpClient() (*http.Client, error) {
+	if k.Config.ProxyURL == "" {
+		return k.Config.Client, nil
+	}
+
+	proxy, err := parseProxyURL(k.Config.ProxyURL)
+	if err != nil {
+		return nil, err
+	}
+
+	return proxyConfig(k.Config, proxy).Client, nil
+}
+
+func parseProxyURL(proxyURL string) (*url.URL, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "http", "socks5":
+	default:
+		return nil, fmt.Errorf("kite: unsupported proxy scheme %q", u.Scheme)
+	}
+
+	if u.Host == "" {
+		return nil, errors.New("kite: missing proxy host in " + proxyURL)
+	}
+
+	return u, nil
+}
+
+// proxyConfig gives a copy of cfg, which dials through the given proxy.
+// HTTP proxies are sent CONNECT requests for websocket connections,
+// with the Proxy-Authorization header if the proxy URL has user info.
+//
+// If proxy is nil, websocket connections are dialed through the proxy
+// given by the environment, unless cfg has a custom one. XHR and
+// HTTP clients use the environment by default.
+func proxyConfig(cfg *config.Config, proxy *url.URL) *config.Config {
+	if proxy == nil {
+		if cfg.Websocket == nil || cfg.Websocket.Proxy != nil {
+			return cfg
+		}
+
+		cfg = cfg.Copy()
+		cfg.Websocket.Proxy = http.ProxyFromEnvironment
+
+		return cfg
+	}
+
+	proxyFunc := http.ProxyURL(proxy)
+
+	withProxy := func(c *http.Client) {
+		transport := c.Transport
+		if transport == nil {
+			transport = http.DefaultTransport
+		}
+
+		if t, ok := transport.(*http.Transport); ok {
+			t = t.Clone()
+			t.Proxy = proxyFunc
+			c.Transport = t
+		}
+	}
+
+	cfg = cfg.Copy()
+
+	if cfg.Websocket != nil {
+		cfg.Websocket.Proxy = proxyFunc
+	}
+
+	if cfg.XHR != nil {
+		withProxy(cfg.XHR)
+	}
+
+	if cfg.Client != nil {
+		withProxy(cfg.Client)
+	}
+
+	return cfg
+}
@@ -0,0 +1,169 @@
+package kite
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/igm/sockjs-go/sockjs"
+	"github.com/koding/kite/protocol"
+)
+
+// Recording is a session recorded by a kite with Config.RecordDir set.
+//
+// A recording file starts with a line with the JSON encoded recording
+// header, the fields of Recording other than Frames, followed by a line
+// with a JSON encoded Frame per each frame sent or received.
+type Recording struct {
+	// Kite is the kite, which recorded the session.
+	Kite protocol.Kite `json:"kite"`
+
+	// SessionID is the ID of the recorded session.
+	SessionID string `json:"sessionID"`
+
+	// Initiated is true if the session was dialed by a client of the kite,
+	// false if it was served by the kite.
+	Initiated bool `json:"initiated"`
+
+	// Binary is true if the frames were passed as they are by
+	// the transport, e.g. gRPC, instead of as UTF-8 text.
+	Binary bool `json:"binary,omitempty"`
+
+	// Frames are the frames of the session in the order
+	// they were sent and received.
+	Frames []Frame `json:"-"`
+}
+
+// Frame is a frame sent or received over a recorded session.
+type Frame struct {
+	Time     time.Time `json:"time"`
+	Received bool      `json:"received"` // false if the frame was sent
+	Data     string    `json:"data"`
+}
+
+// ReadRecording reads the recording from the file.
+func ReadRecording(file string) (*Recording, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return DecodeRecording(f)
+}
+
+// DecodeRecording decodes the recording, see Recording for its format.
+func DecodeRecording(r io.Reader) (*Recording, error) {
+	var rec Recording
+
+	dec := json.NewDecoder(bufio.NewReader(r))
+
+	if err := dec.Decode(&rec); err != nil {
+		if err == io.EOF {
+			return nil, errors.New("kite: empty recording")
+		}
+
+		return nil, err
+	}
+
+	for {
+		var f Frame
+
+		switch err := dec.Decode(&f); err {
+		case nil:
+			rec.Frames = append(rec.Frames, f)
+		case io.EOF:
+			return &rec, nil
+		default:
+			return nil, err
+		}
+	}
+}
+
+// recorder writes the frames of a session to the recording file.
+type recorder struct {
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+// newRecorder gives a recorder of the session, or nil if sessions
+// are not recorded. Sessions, which recording file cannot be created,
+// are logged and not recorded.
+func (c *Client) newRecorder(session sockjs.Session) *recorder {
+	dir := c.config().RecordDir
+	if dir == "" {
+		return nil
+	}
+
+	local := c.LocalKite.Kite()
+
+	f, err := os.CreateTemp(dir, local.Name+"-*.kiterec")
+	if err != nil {
+		c.LocalKite.Log.Error("Recording session %s failed: %s", session.ID(), err)
+		return nil
+	}
+
+	r := &recorder{
+		f:   f,
+		enc: json.NewEncoder(f),
+	}
+
+	header := &Recording{
+		Kite:      *local,
+		SessionID: session.ID(),
+		Initiated: sessionInitiated(session),
+	}
+
+	if s, ok := session.(interface {
+		Binary() bool
+	}); ok {
+		header.Binary = s.Binary()
+	}
+
+	if err := r.enc.Encode(header); err != nil {
+		c.LocalKite.Log.Error("Recording session %s failed: %s", session.ID(), err)
+		f.Close()
+		return nil
+	}
+
+	c.LocalKite.Log.Debug("Recording session %s to %s", session.ID(), f.Name())
+
+	return r
+}
+
+// Record writes the frame to the recording. It is a nop if r is nil
+// or the recording is closed.
+func (r *recorder) Record(received bool, data string) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.f == nil {
+		return
+	}
+
+	r.enc.Encode(&Frame{
+		Time:     time.Now(),
+		Received: received,
+		Data:     data,
+	})
+}
+
+// Close closes the recording file.
+func (r *recorder) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.f != nil {
+		r.f.Close()
+		r.f = nil
+	}
+}
@@ -0,0 +1,93 @@
+// Package redislimit provides a kite.RateLimiter, which keeps the token
+// buckets in Redis, so the limits of throttled methods are shared by all
+// replicas of a kite:
+//
+//	k := kite.New("math", "1.0.0")
+//	k.RateLimiter = redislimit.New(redis.NewClient(&redis.Options{
+//		Addr: "localhost:6379",
+//	}))
+//
+//	k.HandleFunc("square", square).Throttle(time.Second, 100)
+//
+// Each bucket is a Redis hash, which expires once the bucket is full
+// again. The buckets are refilled using the time of the Redis server,
+// so the clocks of the replicas do not need to be in sync.
+package redislimit
+
+import (
+	"context"
+	"time"
+
+	"github.com/koding/kite"
+	"github.com/redis/go-redis/v9"
+)
+
+// takeScript takes a token from the bucket stored under KEYS[1], which
+// is refilled with a token every ARGV[1] microseconds, up to ARGV[2]
+// tokens. It returns 1 if a token was taken, 0 otherwise.
+var takeScript = redis.NewScript(`
+local interval = tonumber(ARGV[1])
+local capacity = tonumber(ARGV[2])
+
+local time = redis.call("TIME")
+local now = tonumber(time[1]) * 1000000 + tonumber(time[2])
+
+local bucket = redis.call("HMGET", KEYS[1], "tokens", "updated")
+local tokens = tonumber(bucket[1])
+local updated = tonumber(bucket[2])
+
+if tokens == nil then
+	tokens = capacity
+	updated = now
+end
+
+local filled = math.floor((now - updated) / interval)
+if filled > 0 then
+	tokens = math.min(capacity, tokens + filled)
+	updated = updated + filled * interval
+end
+
+local taken = 0
+if tokens > 0 then
+	tokens = tokens - 1
+	taken = 1
+end
+
+redis.call("HSET", KEYS[1], "tokens", tokens, "updated", updated)
+redis.call("PEXPIRE", KEYS[1], math.ceil((capacity - tokens) * interval / 1000) + 1000)
+
+return taken
+`)
+
+// RateLimiter is a kite.RateLimiter backed by Redis.
+type RateLimiter struct {
+	client redis.Scripter
+
+	// Prefix is prepended to the keys of the buckets.
+	Prefix string
+}
+
+var _ kite.RateLimiter = (*RateLimiter)(nil)
+
+// New gives a rate limiter, which keeps the buckets with the given
+// Redis client, e.g. *redis.Client or *redis.ClusterClient.
+func New(client redis.Scripter) *RateLimiter {
+	return &RateLimiter{
+		client: client,
+	}
+}
+
+// Take takes a single token from the bucket of the key.
+func (rl *RateLimiter) Take(ctx context.Context, key string, fillInterval time.Duration, capacity int64) (bool, error) {
+	interval := fillInterval.Microseconds()
+	if interval <= 0 {
+		interval = 1
+	}
+
+	taken, err := takeScript.Run(ctx, rl.client, []string{rl.Prefix + key}, interval, capacity).Int64()
+	if err != nil {
+		return false, err
+	}
+
+	return taken == 1, nil
+}
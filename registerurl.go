@@ -19,7 +19,26 @@ const publicEcho = "http://echoip.com"
 // methods Register(), RegisterToProxy(), etc.) It needs to be called after all
 // configurations are done (like TLS, Port,etc.). If local is true a local IP
 // is used, otherwise a public IP is being used.
+//
+// For kites listening on a Unix domain socket the URL of the socket
+// is returned. For kites with Config.AutoTLS the URL of the first
+// domain is returned, as the certificate is not valid for the IPs.
 func (k *Kite) RegisterURL(local bool) *url.URL {
+	if us := k.Config.UnixSocket; us != nil && us.Path != "" {
+		return &url.URL{
+			Scheme: "unix",
+			Path:   us.Path,
+		}
+	}
+
+	if at := k.Config.AutoTLS; at != nil && len(at.Domains) != 0 {
+		return &url.URL{
+			Scheme: "https",
+			Host:   net.JoinHostPort(at.Domains[0], strconv.Itoa(k.Config.Port)),
+			Path:   "/" + k.name + "-" + k.version + "/kite",
+		}
+	}
+
 	var ip net.IP
 	var err error
 
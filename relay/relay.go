@@ -0,0 +1,95 @@
+// Package relay implements a kite, which relays kites that cannot accept
+// inbound connections, e.g. behind NAT.
+//
+// Kites connect to the relay in reverse with (*kite.Kite).RegisterToRelay,
+// which registers the URL of the relay to Kontrol. Kites that find them
+// with GetKites dial the relay, which transparently forwards their dnode
+// traffic over a tunnel opened by the relayed kite, so the calls are
+// authenticated by the relayed kite itself.
+package relay
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/koding/kite"
+	"github.com/koding/kite/config"
+)
+
+const (
+	Version = "0.0.1"
+	Name    = "relay"
+)
+
+// Relay is a kite relaying kites connected to it in reverse.
+type Relay struct {
+	Kite *kite.Kite
+
+	// Authorize authorizes the kites connecting in reverse, which
+	// are authenticated already. If nil, every kite is accepted.
+	Authorize func(*kite.Request) error
+}
+
+// New gives a new relay kite for the given configuration.
+func New(conf *config.Config) *Relay {
+	k := kite.NewWithConfig(Name, Version, conf)
+
+	r := &Relay{
+		Kite: k,
+	}
+
+	k.PreHandleFunc(r.authorize)
+	k.HandleFunc("relay.stats", r.handleStats).RequireScope(kite.ScopeAdmin)
+
+	return r
+}
+
+// AllowUsers gives an Authorize func, which accepts
+// kites of the given users only.
+func AllowUsers(usernames ...string) func(*kite.Request) error {
+	allowed := make(map[string]struct{}, len(usernames))
+	for _, username := range usernames {
+		allowed[username] = struct{}{}
+	}
+
+	return func(r *kite.Request) error {
+		if _, ok := allowed[r.Username]; !ok {
+			return fmt.Errorf("user %q is not allowed to be relayed", r.Username)
+		}
+
+		return nil
+	}
+}
+
+// Run runs the relay kite, it blocks until the kite is closed.
+func (r *Relay) Run() {
+	r.Kite.Run()
+}
+
+// Close closes the relay kite.
+func (r *Relay) Close() {
+	r.Kite.Close()
+}
+
+// Stats gives the traffic relayed to the kites, keyed by kite ID.
+func (r *Relay) Stats() map[string]kite.RelayStats {
+	return r.Kite.RelayStats()
+}
+
+// authorize authorizes the reverse connections, other calls are passed.
+func (r *Relay) authorize(req *kite.Request) (interface{}, error) {
+	if req.Method != "kite.reverse" || r.Authorize == nil {
+		return nil, nil
+	}
+
+	if err := r.Authorize(req); err != nil {
+		r.Kite.Log.Warning("Rejected reverse connection of %s: %s", req.Client.Kite, err)
+		return nil, errors.New("relay: " + err.Error())
+	}
+
+	return nil, nil
+}
+
+func (r *Relay) handleStats(req *kite.Request) (interface{}, error) {
+	return r.Stats(), nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/koding/kite/config"
+	"github.com/koding/kite/relay"
+)
+
+var (
+	flagIP          = flag.String("ip", "0.0.0.0", "Listening IP")
+	flagPort        = flag.Int("port", 3999, "Server port to bind")
+	flagPublicURL   = flag.String("public-url", "", "Public URL of the relay registered to Kontrol")
+	flagAllowUsers  = flag.String("allow-users", "", "Comma separated users whose kites are relayed, all if empty")
+	flagRegion      = flag.String("region", "", "Change region")
+	flagEnvironment = flag.String("env", "development", "Change environment")
+	flagVersion     = flag.Bool("version", false, "Show version and exit")
+)
+
+func main() {
+	flag.Parse()
+
+	if *flagVersion {
+		fmt.Println(relay.Version)
+		os.Exit(0)
+	}
+
+	conf := config.MustGet()
+	conf.IP = *flagIP
+	conf.Port = *flagPort
+	conf.Environment = *flagEnvironment
+
+	if *flagRegion != "" {
+		conf.Region = *flagRegion
+	}
+
+	r := relay.New(conf)
+
+	if *flagAllowUsers != "" {
+		r.Authorize = relay.AllowUsers(strings.Split(*flagAllowUsers, ",")...)
+	}
+
+	if *flagPublicURL != "" {
+		u, err := url.Parse(*flagPublicURL)
+		if err != nil {
+			log.Fatalf("Invalid -public-url: %s", err)
+		}
+
+		go func() {
+			if err := r.Kite.RegisterForever(u); err != nil {
+				r.Kite.Log.Fatal("Registering to Kontrol: %s", err)
+			}
+		}()
+	}
+
+	r.Run()
+}
@@ -0,0 +1,95 @@
+package relay
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/koding/kite"
+	"github.com/koding/kite/config"
+	"github.com/koding/kite/kitekey"
+	"github.com/koding/kite/testkeys"
+	"github.com/koding/kite/testutil"
+)
+
+func newConfig(username string) *config.Config {
+	key := testutil.NewKiteKeyUsername(username)
+
+	conf := config.New()
+	conf.KiteKey = key.Raw
+	conf.Id = key.Claims.(*kitekey.KiteClaims).Id
+	conf.KontrolUser = "testuser"
+	conf.KontrolKey = testkeys.Public
+	return conf
+}
+
+// newKite gives a kite identified by the ID its kite key was issued to.
+func newKite(name, username string) *kite.Kite {
+	conf := newConfig(username)
+
+	k := kite.NewWithConfig(name, "0.0.1", conf)
+	k.Id = conf.Id
+	return k
+}
+
+func TestRelay(t *testing.T) {
+	r := New(newConfig("relay"))
+	r.Authorize = AllowUsers("alice")
+	go r.Run()
+	<-r.Kite.ServerReadyNotify()
+	defer r.Close()
+
+	relayURL := fmt.Sprintf("http://127.0.0.1:%d/kite", r.Kite.Port())
+
+	// Kites of other users are not relayed.
+	mallory := newKite("mathworker", "mallory")
+	defer mallory.Close()
+
+	if _, err := mallory.DialReverse(relayURL); err == nil {
+		t.Fatal("expected reverse connection of unauthorized kite to be rejected")
+	}
+
+	alice := newKite("mathworker", "alice")
+	alice.HandleFunc("echo", func(r *kite.Request) (interface{}, error) {
+		return r.Args.One().MustString(), nil
+	})
+	defer alice.Close()
+
+	c, err := alice.DialReverse(relayURL)
+	if err != nil {
+		t.Fatalf("DialReverse()=%s", err)
+	}
+	defer c.Close()
+
+	bob := newKite("exp2", "bob")
+	defer bob.Close()
+
+	relayed := bob.NewClient(relayURL + "?reverse=" + alice.Id)
+	relayed.Auth = &kite.Auth{Type: "kiteKey", Key: bob.KiteKey()}
+	if err := relayed.DialTimeout(4 * time.Second); err != nil {
+		t.Fatalf("Dial()=%s", err)
+	}
+	defer relayed.Close()
+
+	result, err := relayed.TellWithTimeout("echo", 4*time.Second, "hello")
+	if err != nil {
+		t.Fatalf("Tell()=%s", err)
+	}
+
+	if s := result.MustString(); s != "hello" {
+		t.Fatalf("got %q, want %q", s, "hello")
+	}
+
+	stats, ok := r.Stats()[alice.Id]
+	if !ok {
+		t.Fatalf("no stats of %s", alice.Id)
+	}
+
+	if stats.Sessions != 1 || stats.Sent == 0 || stats.Received == 0 {
+		t.Fatalf("got %+v stats, want traffic of 1 session", stats)
+	}
+
+	if _, ok := r.Stats()[mallory.Id]; ok {
+		t.Fatal("unexpected stats of unauthorized kite")
+	}
+}
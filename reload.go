@@ -0,0 +1,235 @@
+package kite
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+
+	"github.com/koding/kite/config"
+)
+
+// ScopeAdmin is the scope required for calling the admin methods
+// of the kite, like "kite.reloadConfig".
+const ScopeAdmin = "kite.admin"
+
+// ReloadConfig applies the following fields of the configuration
+// to the running kite, without dropping the connected clients:
+//
+//   - LogLevel changes the level of the logger with SetLogLevel
+//   - TLSCertFile and TLSKeyFile replace the certificate of the server,
+//     for connections made after the reload
+//   - AllowedIPs and DeniedIPs replace the IP ranges the server accepts
+//     connections from, and MaxConnsPerIP changes the per-IP connection
+//     limit, for connections made after the reload
+//   - Throttles change the rates of the methods throttled with Throttle
+//
+// The fields, which are not set, are left unchanged, e.g. the IP ranges
+// set in code are kept when the reloaded configuration has none.
+//
+// The fields are copied to the kite's Config. The configuration is
+// validated first, nothing is changed if any of the fields is invalid.
+func (k *Kite) ReloadConfig(cfg *config.Config) error {
+	k.reloadMu.Lock()
+	defer k.reloadMu.Unlock()
+
+	var level Level
+	if cfg.LogLevel != "" {
+		l, err := ParseLevel(cfg.LogLevel)
+		if err != nil {
+			return err
+		}
+
+		level = l
+	}
+
+	allowed, err := parseIPNets(cfg.AllowedIPs)
+	if err != nil {
+		return err
+	}
+
+	denied, err := parseIPNets(cfg.DeniedIPs)
+	if err != nil {
+		return err
+	}
+
+	var tlsConfig *tls.Config
+	if cfg.TLSCertFile != "" {
+		if k.TLSConfig == nil {
+			return errors.New("kite: TLS is not enabled")
+		}
+
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return err
+		}
+
+		tlsConfig = k.TLSConfig.Clone()
+		tlsConfig.Certificates = []tls.Certificate{cert}
+		tlsConfig.GetConfigForClient = nil
+	}
+
+	methods := make(map[*Method]config.Throttle, len(cfg.Throttles))
+
+	for name, t := range cfg.Throttles {
+		m, ok := k.registeredMethod(name)
+		if !ok {
+			return fmt.Errorf("kite: cannot throttle %q: method is not found", name)
+		}
+
+		if t.Capacity > 0 && t.FillInterval <= 0 {
+			return fmt.Errorf("kite: cannot throttle %q: invalid fill interval: %s", name, t.FillInterval)
+		}
+
+		methods[m] = t
+	}
+
+	if cfg.LogLevel != "" && k.SetLogLevel != nil {
+		k.SetLogLevel(level)
+	}
+
+	if tlsConfig != nil {
+		k.tlsReloaded.Store(tlsConfig)
+	}
+
+	if len(cfg.AllowedIPs) != 0 {
+		k.allowedIPs.Store(allowed)
+	}
+
+	if len(cfg.DeniedIPs) != 0 {
+		k.deniedIPs.Store(denied)
+	}
+
+	if cfg.MaxConnsPerIP != 0 {
+		atomic.StoreInt32(&k.maxConnsPerIP, int32(cfg.MaxConnsPerIP))
+	}
+
+	for m, t := range methods {
+		m.setThrottle(t.FillInterval, t.Capacity)
+	}
+
+	k.configMu.Lock()
+	if cfg.LogLevel != "" {
+		k.Config.LogLevel = cfg.LogLevel
+	}
+	if cfg.TLSCertFile != "" {
+		k.Config.TLSCertFile = cfg.TLSCertFile
+		k.Config.TLSKeyFile = cfg.TLSKeyFile
+	}
+	if len(cfg.AllowedIPs) != 0 {
+		k.Config.AllowedIPs = append([]string(nil), cfg.AllowedIPs...)
+	}
+	if len(cfg.DeniedIPs) != 0 {
+		k.Config.DeniedIPs = append([]string(nil), cfg.DeniedIPs...)
+	}
+	if cfg.MaxConnsPerIP != 0 {
+		k.Config.MaxConnsPerIP = cfg.MaxConnsPerIP
+	}
+	if len(cfg.Throttles) != 0 && k.Config.Throttles == nil {
+		k.Config.Throttles = make(map[string]config.Throttle, len(cfg.Throttles))
+	}
+	for name, t := range cfg.Throttles {
+		k.Config.Throttles[name] = t
+	}
+	k.configMu.Unlock()
+
+	k.Log.Info("Configuration is reloaded")
+
+	return nil
+}
+
+// reload reads the configuration with ReadConfig and applies it.
+func (k *Kite) reload() error {
+	read := k.ReadConfig
+	if read == nil {
+		read = config.Get
+	}
+
+	cfg, err := read()
+	if err != nil {
+		return err
+	}
+
+	return k.ReloadConfig(cfg)
+}
+
+// registeredMethod gives the method registered under the name,
+// which may be a pattern.
+func (k *Kite) registeredMethod(name string) (*Method, bool) {
+	t := k.methodTable()
+
+	if m, ok := t.handlers[name]; ok {
+		return m, true
+	}
+
+	for _, m := range t.patterns {
+		if m.name == name {
+			return m, true
+		}
+	}
+
+	return nil, false
+}
+
+// tlsConfigForClient gives the TLS configuration with the reloaded
+// certificate, if any.
+func (k *Kite) tlsConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	cfg, _ := k.tlsReloaded.Load().(*tls.Config)
+	return cfg, nil
+}
+
+// isAllowedIP tells whether the server accepts requests from the address.
+// Requests from addresses that are not IP ones, e.g. made over Unix
+// domain sockets, are accepted.
+func (k *Kite) isAllowedIP(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return true
+	}
+
+	return k.allowsIP(ip)
+}
+
+// allowsIP tells whether the IP address is not in any of the denied
+// IP ranges and is in one of the allowed ones, if any.
+func (k *Kite) allowsIP(ip net.IP) bool {
+	denied, _ := k.deniedIPs.Load().([]*net.IPNet)
+	if containsIP(denied, ip) {
+		return false
+	}
+
+	allowed, _ := k.allowedIPs.Load().([]*net.IPNet)
+
+	return len(allowed) == 0 || containsIP(allowed, ip)
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func parseIPNets(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+
+		nets = append(nets, n)
+	}
+
+	return nets, nil
+}
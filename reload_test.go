@@ -0,0 +1,175 @@
+package kite
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/koding/kite/config"
+)
+
+func TestKite_ReloadConfig(t *testing.T) {
+	k := New("testkite", "0.0.1")
+	k.Config.DisableAuthentication = false
+
+	k.Authenticators["test"] = func(r *Request) error {
+		r.Username = r.Auth.Key
+		if r.Username == "admin" {
+			r.Scopes = []string{ScopeAdmin}
+		}
+		return nil
+	}
+
+	var levels []Level
+	k.SetLogLevel = func(l Level) { levels = append(levels, l) }
+
+	reloaded := config.New()
+	reloaded.LogLevel = "debug"
+	reloaded.Throttles = map[string]config.Throttle{
+		"foo": {FillInterval: time.Hour, Capacity: 3},
+	}
+	k.ReadConfig = func() (*config.Config, error) {
+		return reloaded, nil
+	}
+
+	k.HandleFunc("foo", func(r *Request) (interface{}, error) {
+		return "handle", nil
+	}).Throttle(time.Hour, 1)
+
+	go k.Run()
+	defer k.Close()
+	<-k.ServerReadyNotify()
+
+	dial := func(username string) (*Client, error) {
+		c := New("exp", "0.0.1").NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", k.Port()))
+		c.Auth = &Auth{Type: "test", Key: username}
+
+		if err := c.DialTimeout(4 * time.Second); err != nil {
+			return nil, err
+		}
+
+		return c, nil
+	}
+
+	alice, err := dial("alice")
+	if err != nil {
+		t.Fatalf("Dial()=%s", err)
+	}
+	defer alice.Close()
+
+	tell := func(c *Client, method string) error {
+		_, err := c.TellWithTimeout(method, 4*time.Second)
+		return err
+	}
+
+	if err := tell(alice, "foo"); err != nil {
+		t.Fatalf("Tell()=%s", err)
+	}
+
+	if e, ok := tell(alice, "foo").(*Error); !ok || e.Type != "requestLimitError" {
+		t.Fatalf("got %v, want requestLimitError", e)
+	}
+
+	if e, ok := tell(alice, "kite.reloadConfig").(*Error); !ok || e.Type != "forbidden" {
+		t.Fatalf("got %v, want forbidden error", e)
+	}
+
+	admin, err := dial("admin")
+	if err != nil {
+		t.Fatalf("Dial()=%s", err)
+	}
+	defer admin.Close()
+
+	if err := tell(admin, "kite.reloadConfig"); err != nil {
+		t.Fatalf("Tell()=%s", err)
+	}
+
+	if len(levels) != 1 || levels[0] != DEBUG {
+		t.Fatalf("got %v levels, want DEBUG", levels)
+	}
+
+	// The bucket of the method is replaced with a full one.
+	for i := 0; i < 3; i++ {
+		if err := tell(alice, "foo"); err != nil {
+			t.Fatalf("Tell()=%s", err)
+		}
+	}
+
+	if e, ok := tell(alice, "foo").(*Error); !ok || e.Type != "requestLimitError" {
+		t.Fatalf("got %v, want requestLimitError", e)
+	}
+
+	// Invalid configuration is not applied.
+	invalid := config.New()
+	invalid.AllowedIPs = []string{"10.0.0.0/8"}
+	invalid.Throttles = map[string]config.Throttle{"bar": {FillInterval: time.Second, Capacity: 1}}
+
+	if err := k.ReloadConfig(invalid); err == nil {
+		t.Fatal("expected reloading throttle of unknown method to fail")
+	}
+
+	if c, err := dial("bob"); err != nil {
+		t.Fatalf("Dial()=%s", err)
+	} else {
+		c.Close()
+	}
+
+	// New connections from addresses that are not allowed are rejected,
+	// the existing ones are kept.
+	if err := k.ReloadConfig(&config.Config{AllowedIPs: []string{"10.0.0.0/8"}}); err != nil {
+		t.Fatalf("ReloadConfig()=%s", err)
+	}
+
+	if c, err := dial("bob"); err == nil {
+		c.Close()
+		t.Fatal("expected connecting from 127.0.0.1 to fail")
+	}
+
+	if err := tell(admin, "kite.ping"); err != nil {
+		t.Fatalf("Tell()=%s", err)
+	}
+
+	if err := k.ReloadConfig(&config.Config{AllowedIPs: []string{"127.0.0.0/8"}}); err != nil {
+		t.Fatalf("ReloadConfig()=%s", err)
+	}
+
+	if c, err := dial("bob"); err != nil {
+		t.Fatalf("Dial()=%s", err)
+	} else {
+		c.Close()
+	}
+}
+
+func TestKite_ReloadConfigKeepsIPFilter(t *testing.T) {
+	k := New("testkite", "0.0.1")
+	k.Config.DisableAuthentication = true
+	k.Config.AllowedIPs = []string{"10.0.0.0/8"}
+	k.Config.MaxConnsPerIP = 1
+
+	// The reloaded configuration sets none of the fields.
+	k.ReadConfig = func() (*config.Config, error) {
+		return &config.Config{}, nil
+	}
+
+	go k.Run()
+	defer k.Close()
+	<-k.ServerReadyNotify()
+
+	if err := k.reload(); err != nil {
+		t.Fatalf("reload()=%s", err)
+	}
+
+	c := New("exp", "0.0.1").NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", k.Port()))
+	if err := c.DialTimeout(4 * time.Second); err == nil {
+		c.Close()
+		t.Fatal("expected connecting from 127.0.0.1 to fail")
+	}
+
+	if got := k.Config.AllowedIPs; len(got) != 1 || got[0] != "10.0.0.0/8" {
+		t.Errorf("got %v allowed IPs, want [10.0.0.0/8]", got)
+	}
+
+	if n := k.Config.MaxConnsPerIP; n != 1 {
+		t.Errorf("got %d max connections per IP, want 1", n)
+	}
+}
@@ -0,0 +1,27 @@
+//go:build !windows
+// +build !windows
+
+package kite
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// SetupReloadHandler listens to SIGHUP signals and reloads the
+// configuration read with ReadConfig, see ReloadConfig.
+func (k *Kite) SetupReloadHandler() {
+	c := make(chan os.Signal, 1)
+
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		for range c {
+			k.Log.Info("Got signal: %s, reloading configuration", syscall.SIGHUP)
+
+			if err := k.reload(); err != nil {
+				k.Log.Error("Reloading configuration failed: %s", err)
+			}
+		}
+	}()
+}
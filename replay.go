@@ -0,0 +1,236 @@
+package kite
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/koding/kite/kitekey"
+	"github.com/koding/kite/utils"
+)
+
+// ErrReplayed is returned by AuthenticateFromToken when the request
+// carries a nonce already used with the token, see Config.ReplayWindow.
+var ErrReplayed = errors.New("request is replayed")
+
+// NonceStore keeps the nonces of the requests authenticated with tokens,
+// see Kite.NonceStore.
+type NonceStore interface {
+	// Use stores the nonce for ttl, unless it is already stored.
+	// It returns false if the nonce was already stored.
+	Use(ctx context.Context, nonce string, ttl time.Duration) (bool, error)
+}
+
+// nonceStore gives the kite's NonceStore, or the one keeping
+// the nonces in memory if it is not set.
+func (k *Kite) nonceStore() NonceStore {
+	if k.NonceStore != nil {
+		return k.NonceStore
+	}
+
+	k.noncesOnce.Do(func() {
+		k.nonces = newMemoryNonceStore()
+	})
+
+	return k.nonces
+}
+
+// replayCheck is the result of checkReplay shared by the requests made
+// with a single message, e.g. the calls of a batch, so the nonce of the
+// message is checked once.
+type replayCheck struct {
+	once sync.Once
+	err  error
+}
+
+// checkReplay rejects the request authenticated with the token, if its
+// timestamp is outside of Config.ReplayWindow, its nonce is not signed
+// with the proof key of the token or it was already used with the token.
+func (k *Kite) checkReplay(r *Request, claims *kitekey.KiteClaims) error {
+	window := k.Config.ReplayWindow
+	if window <= 0 {
+		return nil
+	}
+
+	if r.replay == nil {
+		return k.checkNonce(r, claims, window)
+	}
+
+	r.replay.once.Do(func() {
+		r.replay.err = k.checkNonce(r, claims, window)
+	})
+
+	return r.replay.err
+}
+
+func (k *Kite) checkNonce(r *Request, claims *kitekey.KiteClaims, window time.Duration) error {
+	// Nonces are kept per token, so the ones of tokens without
+	// IDs would collide.
+	if claims.Id == "" {
+		return errors.New("token has no ID")
+	}
+
+	if claims.ProofKey == "" {
+		return errors.New("token has no proof key")
+	}
+
+	if r.Auth.Nonce == "" || r.Auth.Timestamp == 0 {
+		return errors.New("request has no nonce or timestamp")
+	}
+
+	if err := verifyNonce(claims.ProofKey, r.Auth); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	ts := time.UnixMilli(r.Auth.Timestamp)
+
+	if d := now.Sub(ts); d > window || d < -window {
+		return fmt.Errorf("request timestamp is off by more than %s", window)
+	}
+
+	// Requests are rejected once their timestamp is out of the window
+	// or the token expires, so their nonces are not kept any longer.
+	ttl := ts.Add(window).Sub(now)
+
+	if claims.ExpiresAt != 0 {
+		if d := time.Unix(claims.ExpiresAt, 0).Sub(now); d < ttl {
+			ttl = d
+		}
+	}
+
+	ok, err := k.nonceStore().Use(r.Ctx(), claims.Id+":"+r.Auth.Nonce, ttl)
+	if err != nil {
+		return fmt.Errorf("unable to check nonce: %s", err)
+	}
+
+	if !ok {
+		return ErrReplayed
+	}
+
+	return nil
+}
+
+// ProofKey gives the base64 encoded public key the kite signs the nonces
+// of the requests authenticated with tokens with. Kontrol binds the tokens
+// it issues to the kite to the key, see Config.ReplayWindow.
+func (k *Kite) ProofKey() string {
+	pub := k.proofPrivateKey().Public().(ed25519.PublicKey)
+	return base64.StdEncoding.EncodeToString(pub)
+}
+
+func (k *Kite) proofPrivateKey() ed25519.PrivateKey {
+	k.proofKeyOnce.Do(func() {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			panic("kite: unable to generate proof key: " + err.Error())
+		}
+
+		k.proofKey = priv
+	})
+
+	return k.proofKey
+}
+
+// SetAuthHeader sets the Authorization header of the HTTP request made
+// to a kite, e.g. to its gateway, to the auth. Tokens are sent along
+// with a fresh nonce and timestamp signed with the kite's proof key,
+// so the request passes the replay checks, see Config.ReplayWindow
+// and AuthFromRequest.
+func (k *Kite) SetAuthHeader(req *http.Request, auth *Auth) {
+	req.Header.Set("Authorization", auth.Type+" "+auth.Key)
+
+	if auth.Type != "token" {
+		return
+	}
+
+	a := *auth
+	k.newNonce(&a)
+
+	req.Header.Set("Kite-Nonce", a.Nonce)
+	req.Header.Set("Kite-Timestamp", strconv.FormatInt(a.Timestamp, 10))
+	req.Header.Set("Kite-Signature", a.Signature)
+}
+
+// newNonce sets a fresh nonce and timestamp of the auth and signs them.
+func (k *Kite) newNonce(auth *Auth) {
+	auth.Nonce = utils.RandomString(16)
+	auth.Timestamp = time.Now().UnixMilli()
+	k.signNonce(auth)
+}
+
+// signNonce signs the nonce and the timestamp of the auth
+// along with its token.
+func (k *Kite) signNonce(auth *Auth) {
+	sig := ed25519.Sign(k.proofPrivateKey(), nonceMessage(auth))
+	auth.Signature = base64.StdEncoding.EncodeToString(sig)
+}
+
+func verifyNonce(proofKey string, auth *Auth) error {
+	pub, err := base64.StdEncoding.DecodeString(proofKey)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return errors.New("token has invalid proof key")
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(auth.Signature)
+	if err != nil || !ed25519.Verify(ed25519.PublicKey(pub), nonceMessage(auth), sig) {
+		return errors.New("request has invalid nonce signature")
+	}
+
+	return nil
+}
+
+// nonceMessage gives the message signed with the proof key, the token is
+// included, so the signature is not valid with other tokens of the kite.
+func nonceMessage(auth *Auth) []byte {
+	return []byte(auth.Key + "\n" + auth.Nonce + "\n" + strconv.FormatInt(auth.Timestamp, 10))
+}
+
+// memoryNonceStore is a NonceStore keeping the nonces in memory.
+// Expired nonces are swept at most once per minute.
+type memoryNonceStore struct {
+	mu        sync.Mutex
+	nonces    map[string]time.Time
+	lastSweep time.Time
+}
+
+var _ NonceStore = (*memoryNonceStore)(nil)
+
+func newMemoryNonceStore() *memoryNonceStore {
+	return &memoryNonceStore{
+		nonces:    make(map[string]time.Time),
+		lastSweep: time.Now(),
+	}
+}
+
+func (s *memoryNonceStore) Use(_ context.Context, nonce string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	if now.Sub(s.lastSweep) > time.Minute {
+		for n, expires := range s.nonces {
+			if now.After(expires) {
+				delete(s.nonces, n)
+			}
+		}
+
+		s.lastSweep = now
+	}
+
+	if expires, ok := s.nonces[nonce]; ok && now.Before(expires) {
+		return false, nil
+	}
+
+	s.nonces[nonce] = now.Add(ttl)
+
+	return true, nil
+}
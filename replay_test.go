@@ -0,0 +1,183 @@
+package kite
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/koding/kite/kitekey"
+	"github.com/koding/kite/protocol"
+	"github.com/koding/kite/testkeys"
+)
+
+func TestKite_ReplayWindow(t *testing.T) {
+	k := New("testkite", "0.0.1")
+	k.Config.KontrolUser = "kontrol"
+	k.Config.KontrolKey = testkeys.Public
+	k.Config.ReplayWindow = time.Minute
+	k.Config.VerifyAudienceFunc = func(*protocol.Kite, string) error { return nil }
+	k.HandleFunc("foo", func(r *Request) (interface{}, error) {
+		return "foo", nil
+	})
+
+	go k.Run()
+	defer k.Close()
+	<-k.ServerReadyNotify()
+
+	exp := New("exp", "0.0.1")
+
+	token, err := kitekey.Sign(&kitekey.KiteClaims{
+		StandardClaims: jwt.StandardClaims{
+			Id:        "token",
+			Issuer:    "kontrol",
+			Subject:   "alice",
+			Audience:  "/",
+			ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		},
+		KontrolKey: testkeys.Public,
+		ProofKey:   exp.ProofKey(),
+	}, testkeys.Private)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := exp.NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", k.Port()))
+	c.Auth = &Auth{Type: "token", Key: token}
+
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Each call carries its own nonce.
+	for i := 0; i < 3; i++ {
+		if _, err := c.Tell("foo"); err != nil {
+			t.Fatalf("%d: Tell()=%s", i, err)
+		}
+	}
+
+	// The calls of a batch share its nonce.
+	results, err := c.TellBatch([]BatchCall{{Method: "foo"}, {Method: "foo"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, res := range results {
+		if res.Error != nil {
+			t.Fatalf("%d: got %s, want the call to succeed", i, res.Error)
+		}
+	}
+
+	// Calls made without a session carry the nonces in headers.
+	if _, err := k.ServeCall(context.Background(), &Call{
+		Method: "foo",
+		Auth:   AuthFromHeader("Bearer " + token),
+	}); err == nil || !strings.Contains(err.Error(), "request has no nonce") {
+		t.Fatalf("got %v, want the call without a nonce to fail", err)
+	}
+
+	req := httptest.NewRequest("POST", "/methods/foo", nil)
+	exp.SetAuthHeader(req, &Auth{Type: "token", Key: token})
+
+	for i, want := range []string{"", ErrReplayed.Error()} {
+		_, err := k.ServeCall(context.Background(), &Call{
+			Method:  "foo",
+			Auth:    AuthFromRequest(req),
+			Request: req,
+		})
+
+		switch {
+		case want == "" && err != nil:
+			t.Fatalf("%d: ServeCall()=%s", i, err)
+		case want != "" && (err == nil || !strings.Contains(err.Error(), want)):
+			t.Fatalf("%d: got %v, want %q", i, err, want)
+		}
+	}
+
+	noID, err := kitekey.Sign(&kitekey.KiteClaims{
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    "kontrol",
+			Subject:   "alice",
+			Audience:  "/",
+			ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		},
+		KontrolKey: testkeys.Public,
+	}, testkeys.Private)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	noProofKey, err := kitekey.Sign(&kitekey.KiteClaims{
+		StandardClaims: jwt.StandardClaims{
+			Id:        "noProofKey",
+			Issuer:    "kontrol",
+			Subject:   "alice",
+			Audience:  "/",
+			ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		},
+		KontrolKey: testkeys.Public,
+	}, testkeys.Private)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().UnixMilli()
+
+	cases := []struct {
+		auth   *Auth
+		signer *Kite
+		err    string
+	}{{
+		&Auth{Type: "token", Key: token, Nonce: "replayed", Timestamp: now},
+		exp,
+		"",
+	}, {
+		&Auth{Type: "token", Key: token, Nonce: "replayed", Timestamp: now},
+		exp,
+		ErrReplayed.Error(),
+	}, {
+		&Auth{Type: "token", Key: token, Nonce: "stale", Timestamp: now - 2*time.Minute.Milliseconds()},
+		exp,
+		"request timestamp is off",
+	}, {
+		&Auth{Type: "token", Key: token},
+		exp,
+		"request has no nonce or timestamp",
+	}, {
+		&Auth{Type: "token", Key: token, Nonce: "unsigned", Timestamp: now},
+		nil,
+		"invalid nonce signature",
+	}, {
+		// A party holding the token can not sign fresh nonces.
+		&Auth{Type: "token", Key: token, Nonce: "stolen", Timestamp: now},
+		New("thief", "0.0.1"),
+		"invalid nonce signature",
+	}, {
+		&Auth{Type: "token", Key: noProofKey, Nonce: "noproofkey", Timestamp: now},
+		exp,
+		"token has no proof key",
+	}, {
+		&Auth{Type: "token", Key: noID, Nonce: "noid", Timestamp: now},
+		exp,
+		"token has no ID",
+	}}
+
+	for i, cas := range cases {
+		if cas.signer != nil {
+			cas.signer.signNonce(cas.auth)
+		}
+
+		err := k.AuthenticateFromToken(&Request{LocalKite: k, Auth: cas.auth})
+
+		switch {
+		case cas.err == "" && err != nil:
+			t.Errorf("%d: AuthenticateFromToken()=%s", i, err)
+		case cas.err != "" && (err == nil || !strings.Contains(err.Error(), cas.err)):
+			t.Errorf("%d: got %v, want %q", i, err, cas.err)
+		}
+	}
+}
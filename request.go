@@ -1,8 +1,11 @@
 package kite
 
 import (
+	"context"
+	"crypto"
 	"errors"
 	"fmt"
+	"io"
 	"runtime/debug"
 	"time"
 
@@ -11,22 +14,39 @@ import (
 	"github.com/koding/kite/dnode"
 	"github.com/koding/kite/kitekey"
 	"github.com/koding/kite/protocol"
-	"github.com/koding/kite/sockjsclient"
 	"github.com/koding/kite/utils"
 )
 
 // Request contains information about the incoming request.
 type Request struct {
 	// ID is an unique string, which may be used for tracing the request.
+	//
+	// It is generated for every incoming call, unless the caller sent
+	// the ID of the request it is made within, see ContextWithRequestID.
+	// It is included in the error responses and the messages logged
+	// with the request's Logger.
 	ID string
 
 	// Method defines the method name which is invoked by the incoming request.
 	Method string
 
+	// IdempotencyKey is the key the caller identified the call and its
+	// retries with, if any, see ContextWithIdempotencyKey.
+	IdempotencyKey string
+
 	// Username defines the username which the incoming request is bound to.
 	// This is authenticated and validated if authentication is enabled.
 	Username string
 
+	// Scopes granted to the caller by the authenticator, which are
+	// checked against the ones required with (*Method).RequireScope.
+	Scopes []string
+
+	// KiteID is the ID of the kite the credentials of the caller were
+	// issued to, set by the authenticator, e.g. the JWT ID of a kite key.
+	// Requests of revoked kites are denied, see Revoke.
+	KiteID string
+
 	// Args defines the incoming arguments for the given method.
 	Args *dnode.Partial
 
@@ -45,6 +65,139 @@ type Request struct {
 	// chain. This is useful with PreHandle and PostHandle handlers to pass
 	// data between handlers.
 	Context cache.Cache
+
+	// ctx is canceled when the remote kite disconnects or when
+	// the method call has finished.
+	ctx context.Context
+
+	// method is the method handling the request, see Pattern.
+	method *Method
+
+	// replay is shared by the requests of a single message, e.g. the
+	// calls of a batch, so its nonce is checked once, see checkReplay.
+	replay *replayCheck
+
+	// slot is the limiter slot taken by the call, see MaxConcurrent.
+	slot *slot
+
+	// invoked is set once the handler of the method is invoked,
+	// after the PreHandle handlers accepted the call.
+	invoked bool
+
+	// detached, if set, receives the response of the handler chain,
+	// which was still running when the call returned, see Timeout.
+	detached <-chan callResult
+
+	// stream is a callback used for streaming the response
+	// to the caller, see Stream for details.
+	stream dnode.Function
+
+	// progress is a callback used for reporting progress
+	// to the caller, see Progress for details.
+	progress dnode.Function
+
+	// result is the result of the method call, it is kept
+	// for the access log, see AccessLog.
+	result interface{}
+}
+
+// Ctx returns the context of the request. The context is canceled
+// when the remote kite disconnects or when the method call has
+// finished, whichever happens first.
+//
+// Long-running handlers should watch the Done channel of the context
+// in order to stop processing once the caller went away.
+//
+// The method is not named Context because the name is already taken
+// by the Context field.
+func (r *Request) Ctx() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+
+	return r.ctx
+}
+
+// Pattern gives the name or the pattern the method handling the request
+// is registered with, e.g. "fs.*" for a call of "fs.read", and an empty
+// string for the method registered with HandleNotFound. Unlike Method,
+// it only takes the values registered with the kite, so it is suitable
+// for labeling metrics.
+func (r *Request) Pattern() string {
+	if r.method == nil {
+		return ""
+	}
+
+	return r.method.name
+}
+
+// requestIDKey is the context key of the request ID.
+type requestIDKey struct{}
+
+// ContextWithRequestID gives a copy of ctx carrying the request ID.
+//
+// Calls made with a context carrying a request ID, e.g. with the
+// Ctx of the request passed to the handler, send the ID to the remote
+// kite, which uses it as ID of its request. This way the ID is shared
+// by all the calls made in order to serve the request, even across
+// multiple kites.
+func ContextWithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestIDFromContext gives the request ID carried by ctx, if any.
+func RequestIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(requestIDKey{}).(string)
+	return id, ok && id != ""
+}
+
+// withRequestID makes sure ctx carries a request ID, generating a new one
+// if the given id is empty and ctx does not carry any.
+func withRequestID(ctx context.Context, id string) (context.Context, string) {
+	if id == "" {
+		if ctxID, ok := RequestIDFromContext(ctx); ok {
+			return ctx, ctxID
+		}
+
+		id = utils.RandomString(16)
+	}
+
+	return ContextWithRequestID(ctx, id), id
+}
+
+// SetArgs replaces the arguments of the request with the given ones.
+// It is meant for pre-handlers, which rewrite the arguments before they
+// reach the method handler, e.g. to inject defaults, strip secrets or
+// translate legacy argument shapes:
+//
+//	k.PreHandleFunc(func(r *kite.Request) (interface{}, error) {
+//		var opts Options
+//		if err := r.Args.One().Unmarshal(&opts); err != nil {
+//			return nil, err
+//		}
+//
+//		if opts.Region == "" {
+//			opts.Region = "us-east-1"
+//		}
+//
+//		return nil, r.SetArgs(opts)
+//	})
+//
+// Callbacks sent by the caller, that are part of the new arguments,
+// can be called by the handler as usual.
+func (r *Request) SetArgs(args ...interface{}) error {
+	if args == nil {
+		args = []interface{}{}
+	}
+
+	p, err := dnode.NewPartial(args)
+	if err != nil {
+		return err
+	}
+
+	r.Args = p
+
+	return nil
 }
 
 // Response is the type of the object that is returned from request handlers
@@ -55,12 +208,17 @@ type Response struct {
 }
 
 // runMethod is called when a method is received from remote Kite.
-func (c *Client) runMethod(method *Method, args *dnode.Partial) {
+// The response is sent in the order of the ticket, if non-nil.
+func (c *Client) runMethod(method *Method, name string, args *dnode.Partial, t *ticket) {
 	var (
 		callFunc func(interface{}, *Error)
 		request  *Request
 	)
 
+	// Do not hold the responses to later calls, if the call
+	// failed without a response.
+	defer t.release()
+
 	// Recover dnode argument errors and send them back. The caller can use
 	// functions like MustString(), MustSlice()... without the fear of panic.
 	defer func() {
@@ -73,10 +231,59 @@ func (c *Client) runMethod(method *Method, args *dnode.Partial) {
 	}()
 
 	// The request that will be constructed from incoming dnode message.
-	request, callFunc = c.newRequest(method.name, args)
+	request, callFunc = c.newRequest(name, args)
+	request.method = method
+	callFunc = t.wrap(callFunc)
+
+	c.serveMethod(method, request, func(result interface{}, err *Error) {
+		// Stream the response if the handler returned a reader and
+		// the caller receives streams, otherwise send it as a whole.
+		if rd, ok := result.(io.Reader); ok && err == nil {
+			var readErr error
+			if request.stream.IsValid() {
+				result, readErr = c.sendStream(request, rd)
+			} else {
+				result, readErr = c.readResponse(rd)
+			}
+			err = createError(request, readErr)
+		}
+
+		callFunc(result, err)
+	})
+}
+
+// rejectMethod replies to the method call with ErrOverloaded
+// without executing the method.
+func (c *Client) rejectMethod(method *Method, name string, args *dnode.Partial, t *ticket) {
+	defer t.release()
+	defer func() {
+		if r := recover(); r != nil {
+			c.LocalKite.Log.Warning("Unable to reject %q call: %v", name, r)
+		}
+	}()
+
+	request, callFunc := c.newRequest(name, args)
+	request.method = method
+	callFunc = t.wrap(callFunc)
+
+	err := *ErrOverloaded
+	callFunc(nil, createError(request, &err))
+}
+
+// serveMethod authenticates the request, runs the method handlers and
+// passes their result to reply.
+func (c *Client) serveMethod(method *Method, request *Request, reply func(interface{}, *Error)) {
+	// Keep track of in-flight calls, so Shutdown can wait for them.
+	if !c.LocalKite.beginCall() {
+		err := *ErrShuttingDown
+		reply(nil, createError(request, &err))
+		return
+	}
+	defer c.LocalKite.endCall()
+
 	if method.authenticate {
 		if err := request.authenticate(); err != nil {
-			callFunc(nil, createError(request, err))
+			reply(nil, createError(request, err))
 			return
 		}
 	} else {
@@ -85,33 +292,48 @@ func (c *Client) runMethod(method *Method, args *dnode.Partial) {
 		request.Username = request.Client.Kite.Username
 	}
 
-	method.mu.Lock()
-	if !method.initialized {
-		method.preHandlers = append(method.preHandlers, c.LocalKite.preHandlers...)
-		method.postHandlers = append(method.postHandlers, c.LocalKite.postHandlers...)
-		method.finalFuncs = append(method.finalFuncs, c.LocalKite.finalFuncs...)
-		method.initialized = true
+	if err := method.checkScopes(request); err != nil {
+		reply(nil, err)
+		return
 	}
-	method.mu.Unlock()
+
+	limiter := method.handlerChain(c.LocalKite).limiter
 
 	// check if any throttling is enabled and then check token's available.
 	// Tokens are filled per frequency of the initial bucket, so every request
 	// is going to take one token from the bucket. If many requests come in (in
 	// span time larger than the bucket's frequency), there will be no token's
 	// available more so it will return a zero.
-	if method.bucket != nil && method.bucket.TakeAvailable(1) == 0 {
-		callFunc(nil, &Error{
+	if !method.take(request) {
+		reply(nil, &Error{
 			Type:      "requestLimitError",
 			Message:   "The maximum request rate is exceeded.",
 			RequestID: request.ID,
+			Retryable: true,
 		})
 		return
 	}
 
-	// Call the handler functions.
-	result, err := method.ServeKite(request)
+	// Wait for a free slot, if the number of concurrent calls is limited.
+	if limiter != nil {
+		s, err := limiter.acquire(request.Ctx())
+		if err != nil {
+			reply(nil, createError(request, err))
+			return
+		}
+
+		request.slot = s
+	}
+
+	// Call the handler functions, unless the call is a duplicate.
+	result, err := method.serveOnce(request)
+	request.result = result
+
+	// The slot is kept by handlers still running after the call
+	// timed out, see serveTimeout.
+	request.slot.release()
 
-	callFunc(result, createError(request, err))
+	reply(result, createError(request, err))
 }
 
 // runCallback is called when a callback method call is received from remote Kite.
@@ -134,7 +356,7 @@ func (c *Client) newRequest(method string, args *dnode.Partial) (*Request, func(
 	args.One().MustUnmarshal(&options)
 
 	// Notify the handlers registered with Kite.OnFirstRequest().
-	if _, ok := c.session.(*sockjsclient.WebsocketSession); !ok {
+	if !c.initiated() {
 		c.firstRequestHandlersNotified.Do(func() {
 			c.m.Lock()
 			c.Kite = options.Kite
@@ -143,18 +365,47 @@ func (c *Client) newRequest(method string, args *dnode.Partial) (*Request, func(
 		})
 	}
 
+	ctx, id := withRequestID(c.LocalKite.extractTrace(c.sessionContext(), options.Trace), options.RequestID)
+
+	var cancel context.CancelFunc
+	if options.Timeout != 0 {
+		// The caller stops waiting for the response after the timeout.
+		ctx, cancel = context.WithTimeout(ctx, options.Timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	start := time.Now()
+
 	request := &Request{
-		ID:        utils.RandomString(16),
-		Method:    method,
-		Args:      options.WithArgs,
-		LocalKite: c.LocalKite,
-		Client:    c,
-		Auth:      options.Auth,
-		Context:   cache.NewMemory(),
+		ID:             id,
+		Method:         method,
+		IdempotencyKey: options.IdempotencyKey,
+		Args:           options.WithArgs,
+		LocalKite:      c.LocalKite,
+		Client:         c,
+		Auth:           options.Auth,
+		Context:        cache.NewMemory(),
+		ctx:            ctx,
+		stream:         options.StreamCallback,
+		progress:       options.ProgressCallback,
+	}
+
+	if options.CancelID != "" {
+		c.addCancel(options.CancelID, cancel)
 	}
 
 	// Call response callback function, send back our response
 	callFunc := func(result interface{}, err *Error) {
+		// The method call is finished, release the request context.
+		defer cancel()
+
+		if options.CancelID != "" {
+			defer c.removeCancel(options.CancelID)
+		}
+		defer func() {
+			c.LocalKite.callOnResponseHandlers(request, time.Since(start), err)
+		}()
+
 		if options.ResponseCallback.Caller == nil {
 			return
 		}
@@ -176,14 +427,16 @@ func (c *Client) newRequest(method string, args *dnode.Partial) (*Request, func(
 // authenticate tries to authenticate the user by selecting appropriate
 // authenticator function.
 func (r *Request) authenticate() *Error {
-	// Trust the Kite if we have initiated the connection.  Following casts
-	// means, session is opened by the client.
-	if _, ok := r.Client.session.(*sockjsclient.WebsocketSession); ok {
+	// Trust the Kite if we have initiated the connection, except for
+	// reverse tunnels, see tunnelSession.
+	if sessionInitiated(r.Client.session) {
 		return nil
 	}
 
-	if _, ok := r.Client.session.(*sockjsclient.XHRSession); ok {
-		return nil
+	// Connections with a verified client certificate are
+	// authenticated with it, unless the client says otherwise.
+	if r.Auth == nil && peerCert(r) != nil {
+		r.Auth = &Auth{Type: "tls"}
 	}
 
 	if r.Auth == nil {
@@ -204,10 +457,16 @@ func (r *Request) authenticate() *Error {
 
 	// Call authenticator function. It sets the Request.Username field.
 	err := f(r)
+	if err == nil && r.LocalKite.IsRevoked("", r.KiteID) {
+		err = ErrRevoked
+	}
+
 	if err != nil {
 		return &Error{
 			Type:    "authenticationError",
 			Message: fmt.Sprintf("%s: %s", r.Auth.Type, err),
+			Cause:   toError(err),
+			err:     err,
 		}
 	}
 
@@ -217,6 +476,23 @@ func (r *Request) authenticate() *Error {
 	return nil
 }
 
+// Logger gives the logger of the local kite, which attaches the method name,
+// the request ID, the ID of the calling kite and the username of the caller
+// to every message.
+func (r *Request) Logger() Logger {
+	var kiteID string
+	if r.Client != nil {
+		kiteID = r.Client.Kite.ID
+	}
+
+	return WithFields(r.LocalKite.Log,
+		"method", r.Method,
+		"requestID", r.ID,
+		"kiteID", kiteID,
+		"username", r.Username,
+	)
+}
+
 // AuthenticateFromToken is the default Authenticator for Kite.
 func (k *Kite) AuthenticateFromToken(r *Request) error {
 	k.verifyOnce.Do(k.verifyInit)
@@ -253,16 +529,29 @@ func (k *Kite) AuthenticateFromToken(r *Request) error {
 		return errors.New("token has no username")
 	}
 
+	if k.IsRevoked(claims.Id, "") {
+		return ErrRevoked
+	}
+
 	// check if we have an audience and it matches our own signature
 	if err := k.verifyAudienceFunc(k.Kite(), claims.Audience); err != nil {
 		return err
 	}
 
+	if err := k.checkReplay(r, claims); err != nil {
+		return err
+	}
+
 	// We don't check for exp and nbf claims here because jwt-go package
 	// already checks them.
 
 	// replace the requester username so we reflect the validated
 	r.Username = claims.Subject
+	r.KiteID = claims.KiteID
+
+	if r.Scopes, err = k.scopesFromToken(token); err != nil {
+		return err
+	}
 
 	return nil
 }
@@ -284,7 +573,16 @@ func (k *Kite) AuthenticateFromKiteKey(r *Request) error {
 		return errors.New("token has no username")
 	}
 
+	if k.IsRevoked(claims.Id, "") {
+		return ErrRevoked
+	}
+
 	r.Username = claims.Subject
+	r.KiteID = claims.Id
+
+	if r.Scopes, err = k.scopesFromToken(token); err != nil {
+		return err
+	}
 
 	return nil
 }
@@ -308,6 +606,10 @@ func (k *Kite) AuthenticateSimpleKiteKey(key string) (string, error) {
 		return "", errors.New("token has no username")
 	}
 
+	if k.IsRevoked(claims.Id, "") {
+		return "", ErrRevoked
+	}
+
 	return claims.Subject, nil
 }
 
@@ -341,26 +643,59 @@ func (k *Kite) verifyInit() {
 		k.verifyCache.StartGC(ttl / 2)
 	}
 
-	key, err := jwt.ParseRSAPublicKeyFromPEM([]byte(k.Config.KontrolKey))
-	if err != nil {
+	if err := k.initKontrolKeys(); err != nil {
 		k.Log.Error("unable to init kontrol key: %s", err)
+	}
+}
 
-		return
+// initKontrolKeys parses trusted public keys of Kontrol.
+//
+// The method must be called with configMu held.
+func (k *Kite) initKontrolKeys() error {
+	key, err := kitekey.ParsePublicKey(k.Config.KontrolKey)
+	if err != nil {
+		return err
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(k.Config.KontrolKeys)+1)
+
+	for _, pem := range append([]string{k.Config.KontrolKey}, k.Config.KontrolKeys...) {
+		pub, err := kitekey.ParsePublicKey(pem)
+		if err != nil {
+			return err
+		}
+
+		kid, err := kitekey.KeyID(pub)
+		if err != nil {
+			return err
+		}
+
+		keys[kid] = pub
 	}
 
 	k.kontrolKey = key
+	k.kontrolKeys = keys
+
+	return nil
 }
 
 func (k *Kite) selfVerify(pub string) error {
 	k.configMu.RLock()
 	ourKey := k.Config.KontrolKey
+	ourKeys := k.Config.KontrolKeys
 	k.configMu.RUnlock()
 
-	if pub != ourKey {
-		return ErrKeyNotTrusted
+	if pub == ourKey {
+		return nil
+	}
+
+	for _, key := range ourKeys {
+		if pub == key {
+			return nil
+		}
 	}
 
-	return nil
+	return ErrKeyNotTrusted
 }
 
 func (k *Kite) verify(token *jwt.Token) (interface{}, error) {
@@ -371,11 +706,15 @@ func (k *Kite) verify(token *jwt.Token) (interface{}, error) {
 		return nil, errors.New("no kontrol key found")
 	}
 
-	rsaKey, err := jwt.ParseRSAPublicKeyFromPEM([]byte(key))
+	pubKey, err := kitekey.ParsePublicKey(key)
 	if err != nil {
 		return nil, err
 	}
 
+	if err := kitekey.VerifyMethod(token, pubKey); err != nil {
+		return nil, err
+	}
+
 	switch {
 	case k.verifyCache != nil:
 		v, err := k.verifyCache.Get(key)
@@ -387,7 +726,7 @@ func (k *Kite) verify(token *jwt.Token) (interface{}, error) {
 			return nil, errors.New("invalid kontrol key found")
 		}
 
-		return rsaKey, nil
+		return pubKey, nil
 	}
 
 	if err := k.verifyFunc(key); err != nil {
@@ -402,7 +741,7 @@ func (k *Kite) verify(token *jwt.Token) (interface{}, error) {
 
 	k.verifyCache.Set(key, true)
 
-	return rsaKey, nil
+	return pubKey, nil
 }
 
 func (k *Kite) verifyAudience(kite *protocol.Kite, audience string) error {
@@ -0,0 +1,240 @@
+package kite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Environment variables, which pass the state of the kite to the process
+// started by Restart. The files are inherited as file descriptors
+// following stdin, stdout and stderr.
+const (
+	envListenerFD = "KITE_RESTART_LISTENER_FD"
+	envReadyFD    = "KITE_RESTART_READY_FD"
+	envExtraFDs   = "KITE_RESTART_EXTRA_FDS" // comma separated
+	envKiteID     = "KITE_RESTART_ID"
+)
+
+// restartState is the state inherited from the process
+// the kite was restarted from.
+type restartState struct {
+	listener net.Listener
+	extra    []net.Listener // listeners of Config.Listeners
+	ready    *os.File       // written to once the kite is serving
+}
+
+// Restart starts a new process of the kite executable, which takes over
+// serving on the listeners of the kite, e.g. after the binary was upgraded.
+// The new process is started with the same arguments and environment and
+// the listening sockets are passed to it, so connections are not refused
+// while the kites are being switched.
+//
+// The new process takes over the listeners and the ID of the first kite
+// it creates. Reusing the ID makes its registration to Kontrol replace
+// the registration of the old process, so the kite is registered
+// continuously.
+//
+// Restart returns once the new process is serving, or fails if it exits
+// before or ctx is done, in which case the process is killed. The caller
+// is expected to stop the old kite with Shutdown then, which drains
+// in-flight method calls.
+func (k *Kite) Restart(ctx context.Context) (*os.Process, error) {
+	return k.restartProcess(ctx, os.Args, os.Environ())
+}
+
+// restartProcess is like Restart, but the new process is started
+// with the given arguments and environment.
+func (k *Kite) restartProcess(ctx context.Context, args, environ []string) (*os.Process, error) {
+	if k.mainListener() == nil {
+		return nil, errors.New("kite: server is not running")
+	}
+
+	listeners := k.listeners()
+
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	for _, l := range listeners {
+		fl, ok := l.Listener.(interface {
+			File() (*os.File, error)
+		})
+		if !ok {
+			return nil, fmt.Errorf("kite: unable to pass %T listener to a new process", l.Listener)
+		}
+
+		f, err := fl.File()
+		if err != nil {
+			return nil, err
+		}
+
+		files = append(files, f)
+	}
+
+	path, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	// Extra listeners follow the main one and the ready pipe.
+	extraFDs := make([]string, len(files)-1)
+	for i := range extraFDs {
+		extraFDs[i] = strconv.Itoa(5 + i)
+	}
+
+	env := []string{
+		envListenerFD + "=3",
+		envReadyFD + "=4",
+		envExtraFDs + "=" + strings.Join(extraFDs, ","),
+		envKiteID + "=" + k.Id,
+	}
+
+	for _, kv := range environ {
+		if !strings.HasPrefix(kv, "KITE_RESTART_") {
+			env = append(env, kv)
+		}
+	}
+
+	p, err := os.StartProcess(path, args, &os.ProcAttr{
+		Env:   env,
+		Files: append([]*os.File{os.Stdin, os.Stdout, os.Stderr, files[0], w}, files[1:]...),
+	})
+
+	// The write end is held by the new process only, so reading
+	// fails if the process exits before it is ready.
+	w.Close()
+
+	if err != nil {
+		return nil, err
+	}
+
+	ready := make(chan error, 1)
+
+	go func() {
+		_, err := r.Read(make([]byte, 1))
+		ready <- err
+	}()
+
+	select {
+	case err = <-ready:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	if err != nil {
+		p.Kill()
+		p.Wait()
+		return nil, fmt.Errorf("kite: new process failed to start serving: %s", err)
+	}
+
+	// The socket files are used by the new process now.
+	for _, l := range listeners {
+		if ul, ok := l.Listener.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+
+	k.Log.Info("Restarted kite with process %d", p.Pid)
+
+	return p, nil
+}
+
+// inheritRestartState takes over the state passed by the process the kite
+// was restarted from, if any. Only the first kite created takes it over.
+func inheritRestartState() (id string, state *restartState, err error) {
+	id = os.Getenv(envKiteID)
+	if id == "" {
+		return "", nil, nil
+	}
+
+	lfd, err := strconv.Atoi(os.Getenv(envListenerFD))
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid %s: %s", envListenerFD, err)
+	}
+
+	rfd, err := strconv.Atoi(os.Getenv(envReadyFD))
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid %s: %s", envReadyFD, err)
+	}
+
+	var extraFDs []int
+	if s := os.Getenv(envExtraFDs); s != "" {
+		for _, fd := range strings.Split(s, ",") {
+			n, err := strconv.Atoi(fd)
+			if err != nil {
+				return "", nil, fmt.Errorf("invalid %s: %s", envExtraFDs, err)
+			}
+
+			extraFDs = append(extraFDs, n)
+		}
+	}
+
+	for _, env := range []string{envKiteID, envListenerFD, envReadyFD, envExtraFDs} {
+		os.Unsetenv(env)
+	}
+
+	state = &restartState{
+		ready: os.NewFile(uintptr(rfd), "kite-ready"),
+	}
+
+	if state.listener, err = fileListener(lfd); err != nil {
+		return "", nil, err
+	}
+
+	for _, fd := range extraFDs {
+		l, err := fileListener(fd)
+		if err != nil {
+			return "", nil, err
+		}
+
+		state.extra = append(state.extra, l)
+	}
+
+	return id, state, nil
+}
+
+// fileListener gives the listener of the inherited file descriptor.
+func fileListener(fd int) (net.Listener, error) {
+	f := os.NewFile(uintptr(fd), "kite-listener")
+	defer f.Close()
+
+	return net.FileListener(f)
+}
+
+// notifyRestarted tells the process the kite was restarted from
+// the kite is serving.
+func (k *Kite) notifyRestarted() {
+	if k.restart == nil || k.restart.ready == nil {
+		return
+	}
+
+	if _, err := k.restart.ready.Write([]byte{1}); err != nil {
+		k.Log.Warning("Unable to notify the restarting process: %s", err)
+	}
+
+	k.restart.ready.Close()
+	k.restart.ready = nil
+
+	// Close the inherited listeners, which are no longer configured.
+	for _, l := range k.restart.extra {
+		if l != nil {
+			l.Close()
+		}
+	}
+
+	k.restart.extra = nil
+}
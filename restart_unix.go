@@ -0,0 +1,47 @@
+//go:build !windows
+// +build !windows
+
+package kite
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// SetupRestartHandler listens to SIGUSR1 signals and restarts the kite with
+// Restart, e.g. after its binary was upgraded. Once the new process serves,
+// the kite is shut down with Shutdown. The timeout bounds both waiting for
+// the new process and for in-flight method calls to complete. Run returns
+// after the kite is shut down, so the old process can exit.
+func (k *Kite) SetupRestartHandler(timeout time.Duration) {
+	c := make(chan os.Signal, 1)
+
+	signal.Notify(c, syscall.SIGUSR1)
+	go func() {
+		for range c {
+			k.Log.Info("Got signal: %s, restarting", syscall.SIGUSR1)
+
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+
+			p, err := k.Restart(ctx)
+			if err != nil {
+				cancel()
+				k.Log.Error("Restarting failed: %s", err)
+				continue
+			}
+
+			p.Release()
+
+			if err := k.Shutdown(ctx); err != nil {
+				k.Log.Warning("Shutting down the old process: %s", err)
+			}
+
+			cancel()
+			signal.Stop(c)
+			return
+		}
+	}()
+}
@@ -0,0 +1,227 @@
+package kite
+
+import (
+	"context"
+	"errors"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"github.com/koding/kite/dnode"
+)
+
+// RetryPolicy configures retries of the calls made by a client,
+// see (*Client).WithRetry. The delay between attempts grows
+// exponentially, starting at InitialInterval until it reaches
+// MaxInterval.
+type RetryPolicy struct {
+	// MaxAttempts limits the number of attempts of a call, including
+	// the first one. If zero, DefaultRetryPolicy.MaxAttempts is used.
+	MaxAttempts int
+
+	// InitialInterval is the delay before the first retry.
+	InitialInterval time.Duration
+
+	// MaxInterval caps the delay between retries.
+	MaxInterval time.Duration
+
+	// Multiplier is the factor the delay grows by after each retry.
+	Multiplier float64
+
+	// Jitter randomizes each delay by the given factor, e.g. 0.5
+	// gives a delay in [0.5*d, 1.5*d] range. Zero disables jitter.
+	Jitter float64
+
+	// AttemptTimeout limits the time each attempt waits for the response
+	// for. If zero, an attempt waits until the timeout of the call.
+	AttemptTimeout time.Duration
+
+	// Idempotent lists the methods, which are safe to be called more
+	// than once; calls of other methods are retried only if they carry
+	// an idempotency key, see ContextWithIdempotencyKey. The names
+	// may be patterns, like the ones the methods are handled with,
+	// e.g. "users.get*" or "*" for all the methods.
+	Idempotent []string
+
+	// IsRetryable tells whether a call, which failed with the error,
+	// is retried. If nil, IsRetryableCall is used.
+	IsRetryable func(error) bool
+}
+
+// DefaultRetryPolicy holds the default values for zero MaxAttempts,
+// InitialInterval, MaxInterval and Multiplier fields of a RetryPolicy.
+var DefaultRetryPolicy = &RetryPolicy{
+	MaxAttempts:     3,
+	InitialInterval: 100 * time.Millisecond,
+	MaxInterval:     5 * time.Second,
+	Multiplier:      2,
+	Jitter:          0.2,
+}
+
+// IsRetryableCall tells whether a call, which failed with the error, can be
+// made again, which is when the error is retryable, see IsRetryable, or the
+// call timed out, was not sent or the remote kite disconnected before
+// responding. Calls rejected because of an expired token are retryable too,
+// as the client renews its token then. Errors of canceled contexts are
+// not retryable.
+func IsRetryableCall(err error) bool {
+	if IsRetryable(err) || isTokenExpired(err) {
+		return true
+	}
+
+	var e *Error
+	if !errors.As(err, &e) {
+		return false
+	}
+
+	switch e.Type {
+	case "timeout", "sendError", "disconnect":
+		return true
+	default:
+		return false
+	}
+}
+
+// WithRetry makes the calls done with Tell, TellWithTimeout and
+// TellWithContext be retried according to the policy. Only the calls
+// of the methods listed in policy.Idempotent, and the calls carrying
+// an idempotency key, are retried.
+//
+// The timeout of TellWithTimeout and the deadline of the context of
+// TellWithContext limit the time of all the attempts of a call.
+//
+// A nil policy disables retries. WithRetry returns c, so it can be
+// used when creating the client:
+//
+//	c := k.NewClient(url).WithRetry(&kite.RetryPolicy{
+//		Idempotent: []string{"users.get", "users.list"},
+//	})
+func (c *Client) WithRetry(policy *RetryPolicy) *Client {
+	c.retryMu.Lock()
+	c.retry = policy
+	c.retryMu.Unlock()
+
+	return c
+}
+
+func (c *Client) retryPolicy() *RetryPolicy {
+	c.retryMu.Lock()
+	defer c.retryMu.Unlock()
+
+	return c.retry
+}
+
+// retries tells whether calls of the method are retried.
+func (p *RetryPolicy) retries(method string) bool {
+	if p == nil {
+		return false
+	}
+
+	for _, pattern := range p.Idempotent {
+		if ok, _ := path.Match(pattern, method); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *RetryPolicy) maxAttempts() int {
+	if p.MaxAttempts > 0 {
+		return p.MaxAttempts
+	}
+
+	return DefaultRetryPolicy.MaxAttempts
+}
+
+func (p *RetryPolicy) isRetryable(err error) bool {
+	if p.IsRetryable != nil {
+		return p.IsRetryable(err)
+	}
+
+	return IsRetryableCall(err)
+}
+
+func (p *RetryPolicy) backOff() backoff.BackOff {
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = p.InitialInterval
+	b.MaxInterval = p.MaxInterval
+	b.Multiplier = p.Multiplier
+	b.RandomizationFactor = p.Jitter
+	b.MaxElapsedTime = 0 // the attempts are limited by MaxAttempts
+
+	if b.InitialInterval <= 0 {
+		b.InitialInterval = DefaultRetryPolicy.InitialInterval
+	}
+
+	if b.MaxInterval <= 0 {
+		b.MaxInterval = DefaultRetryPolicy.MaxInterval
+	}
+
+	if b.Multiplier <= 0 {
+		b.Multiplier = DefaultRetryPolicy.Multiplier
+	}
+
+	b.Reset()
+
+	return b
+}
+
+// tellWithRetry makes the call, retrying it according to the policy until
+// it succeeds, fails with an error that is not retryable, the attempts are
+// exhausted or the timeout passes. The error of the last attempt is returned.
+func (c *Client) tellWithRetry(ctx context.Context, p *RetryPolicy, method string, timeout time.Duration, args []interface{}) (*dnode.Partial, error) {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+
+	b := p.backOff()
+
+	for attempt := 1; ; attempt++ {
+		attemptTimeout := p.AttemptTimeout
+		if !deadline.IsZero() {
+			if left := time.Until(deadline); attemptTimeout <= 0 || left < attemptTimeout {
+				attemptTimeout = left
+			}
+		}
+
+		responseChan := make(chan *response, 1)
+		c.sendMethod(ctx, method, args, attemptTimeout, callOptions{}, responseChan)
+		resp := <-responseChan
+
+		if resp.Err == nil || attempt >= p.maxAttempts() || ctx.Err() != nil || !p.isRetryable(resp.Err) {
+			return resp.Result, resp.Err
+		}
+
+		delay := b.NextBackOff()
+
+		if d, ok := ctx.Deadline(); ok && time.Now().Add(delay).After(d) {
+			return resp.Result, resp.Err
+		}
+
+		if !deadline.IsZero() && time.Now().Add(delay).After(deadline) {
+			return resp.Result, resp.Err
+		}
+
+		c.LocalKite.Log.Debug("Retrying %q call to %q kite in %s, attempt %d failed: %s",
+			method, c.Kite.Name, delay, attempt, resp.Err)
+
+		t := time.NewTimer(delay)
+
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return resp.Result, resp.Err
+		}
+	}
+}
+
+// isTokenExpired tells whether the call failed, because the remote kite
+// rejected the expired token of the client.
+func isTokenExpired(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Type == "authenticationError" && strings.Contains(e.Message, "token is expired")
+}
@@ -0,0 +1,150 @@
+package kite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClient_WithRetry(t *testing.T) {
+	k := New("testkite", "0.0.1")
+	k.Config.DisableAuthentication = true
+
+	var calls = map[string]*int32{
+		"get":    new(int32),
+		"update": new(int32),
+		"fail":   new(int32),
+		"slow":   new(int32),
+		"busy":   new(int32),
+	}
+
+	// Each of the methods fails the first two calls.
+	overloaded := func(method string) HandlerFunc {
+		return func(r *Request) (interface{}, error) {
+			if atomic.AddInt32(calls[method], 1) <= 2 {
+				err := *ErrOverloaded
+				return nil, &err
+			}
+			return method, nil
+		}
+	}
+
+	k.HandleFunc("get", overloaded("get"))
+	k.HandleFunc("update", overloaded("update"))
+	k.HandleFunc("fail", func(r *Request) (interface{}, error) {
+		atomic.AddInt32(calls["fail"], 1)
+		return nil, errors.New("not retryable")
+	})
+	k.HandleFunc("slow", func(r *Request) (interface{}, error) {
+		if atomic.AddInt32(calls["slow"], 1) == 1 {
+			time.Sleep(time.Second)
+		}
+		return "slow", nil
+	})
+	k.HandleFunc("busy", func(r *Request) (interface{}, error) {
+		atomic.AddInt32(calls["busy"], 1)
+		err := *ErrOverloaded
+		return nil, &err
+	})
+
+	go k.Run()
+	defer k.Close()
+	<-k.ServerReadyNotify()
+
+	c := New("exp", "0.0.1").NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", k.Port())).WithRetry(&RetryPolicy{
+		MaxAttempts:     4,
+		InitialInterval: 10 * time.Millisecond,
+		AttemptTimeout:  200 * time.Millisecond,
+		Idempotent:      []string{"get", "fail", "slow", "bu*"},
+	})
+
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	cases := []struct {
+		method string
+		calls  int32
+		err    bool
+	}{
+		{"get", 3, false},   // succeeds with the third attempt
+		{"update", 1, true}, // not idempotent
+		{"fail", 1, true},   // error is not retryable
+		{"slow", 2, false},  // first attempt times out
+		{"busy", 4, true},   // attempts are exhausted
+	}
+
+	for _, cas := range cases {
+		t.Run(cas.method, func(t *testing.T) {
+			result, err := c.TellWithTimeout(cas.method, 4*time.Second)
+
+			if cas.err {
+				if err == nil {
+					t.Fatal("expected error, got nil")
+				}
+			} else if err != nil {
+				t.Fatalf("TellWithTimeout()=%s", err)
+			} else if s := result.MustString(); s != cas.method {
+				t.Fatalf("got %q, want %q", s, cas.method)
+			}
+
+			// Wait for the attempts, which the client stopped waiting for.
+			time.Sleep(100 * time.Millisecond)
+
+			if n := atomic.LoadInt32(calls[cas.method]); n != cas.calls {
+				t.Fatalf("got %d calls, want %d", n, cas.calls)
+			}
+		})
+	}
+}
+
+func TestClient_WithRetryContext(t *testing.T) {
+	k := New("testkite", "0.0.1")
+	k.Config.DisableAuthentication = true
+
+	var calls int32
+
+	k.HandleFunc("busy", func(r *Request) (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		err := *ErrOverloaded
+		return nil, &err
+	})
+
+	go k.Run()
+	defer k.Close()
+	<-k.ServerReadyNotify()
+
+	c := New("exp", "0.0.1").NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", k.Port())).WithRetry(&RetryPolicy{
+		MaxAttempts:     100,
+		InitialInterval: 50 * time.Millisecond,
+		Multiplier:      1,
+		Idempotent:      []string{"*"},
+	})
+
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+
+	_, err := c.TellWithContext(ctx, "busy")
+	if !errors.Is(err, ErrOverloaded) {
+		t.Fatalf("got %v, want %v", err, ErrOverloaded)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("retries took %s after the context was done", elapsed)
+	}
+
+	if n := atomic.LoadInt32(&calls); n < 2 || n > 10 {
+		t.Fatalf("got %d calls, want between 2 and 10", n)
+	}
+}
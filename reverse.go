@@ -0,0 +1,402 @@
+package kite
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/koding/kite/utils"
+
+	"github.com/igm/sockjs-go/sockjs"
+)
+
+// Query parameters of the URLs of sessions relayed by kites, which accept
+// reverse connections. Consumers dial the relay kite with the reverse
+// parameter set to the ID of the kite to relay to, the relayed kite dials
+// back with the tunnel parameter set to the token the relay gave it.
+const (
+	reverseParam = "reverse"
+	tunnelParam  = "tunnel"
+)
+
+// RelayStats is the traffic relayed to a reverse connected kite.
+type RelayStats struct {
+	Sessions int64 `json:"sessions"` // number of relayed sessions
+	Sent     int64 `json:"sent"`     // bytes sent to the kite
+	Received int64 `json:"received"` // bytes received from the kite
+}
+
+// reverseTunnel is a tunnel to a reverse connected kite,
+// waiting to be joined with the session of a consumer.
+type reverseTunnel struct {
+	session chan sockjs.Session
+	done    chan struct{} // closed once the sessions are joined
+}
+
+// tunnelSession is the session of a reverse tunnel. It is dialed by the
+// kite, but the calls made over it come from the consumers the relay joins
+// with it, so they are authenticated like the ones of accepted sessions.
+type tunnelSession struct {
+	sockjs.Session
+}
+
+func (s tunnelSession) Initiated() bool {
+	return false
+}
+
+func (s tunnelSession) Compressed() bool {
+	c, ok := s.Session.(interface {
+		Compressed() bool
+	})
+
+	return ok && c.Compressed()
+}
+
+// DialReverse connects to the kite at remoteURL and serves the methods of k
+// over the connection, so kites that cannot accept inbound connections,
+// e.g. behind NAT, are reachable by the remote kite. The remote kite is
+// either the consumer of the methods, which calls them with the client
+// given by ReverseClient, or a relay, see RegisterToRelay.
+//
+// The remote kite accepts the reverse connection only if the ID of k is
+// the one its kite key was issued to, e.g. k.Id = k.Config.Id.
+//
+// The returned client reconnects when the connection is lost.
+func (k *Kite) DialReverse(remoteURL string) (*Client, error) {
+	c := k.NewClient(remoteURL)
+	c.Reconnect = true
+
+	if key := k.KiteKey(); key != "" {
+		c.Auth = &Auth{
+			Type: "kiteKey",
+			Key:  key,
+		}
+	}
+
+	announced := make(chan error, 1)
+
+	// Announce the reverse connection after every connect,
+	// reconnected sessions are not known to the remote kite.
+	c.OnConnect(func() {
+		_, err := c.TellWithTimeout("kite.reverse", k.Config.Timeout)
+		if err != nil {
+			k.Log.Warning("Cannot announce reverse connection to %s: %s", remoteURL, err)
+		}
+
+		select {
+		case announced <- err:
+		default:
+		}
+	})
+
+	if err := c.Dial(); err != nil {
+		return nil, err
+	}
+
+	if err := <-announced; err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// RegisterToRelay makes the kite reachable through the relay kite
+// at relayURL. It serves the methods of the kite over a reverse
+// connection to the relay, see DialReverse, and registers the URL
+// of the relay to Kontrol, so kites which find the kite with GetKites
+// connect to the relay, which relays them over the reverse connection.
+func (k *Kite) RegisterToRelay(relayURL string) error {
+	u, err := url.Parse(relayURL)
+	if err != nil {
+		return err
+	}
+
+	if _, err := k.DialReverse(relayURL); err != nil {
+		return err
+	}
+
+	q := u.Query()
+	q.Set(reverseParam, k.Id)
+	u.RawQuery = q.Encode()
+
+	return k.RegisterForever(u)
+}
+
+// ReverseClient gives the client of the kite with the given ID, which is
+// connected to k with DialReverse, or nil if there is none. Calls made
+// with the client are served by the reverse connected kite.
+func (k *Kite) ReverseClient(id string) *Client {
+	k.reverseMu.Lock()
+	defer k.reverseMu.Unlock()
+
+	return k.reverse[id]
+}
+
+// ReverseClients gives the clients of the kites connected
+// to k with DialReverse.
+func (k *Kite) ReverseClients() []*Client {
+	k.reverseMu.Lock()
+	defer k.reverseMu.Unlock()
+
+	clients := make([]*Client, 0, len(k.reverse))
+	for _, c := range k.reverse {
+		clients = append(clients, c)
+	}
+
+	return clients
+}
+
+// RelayStats gives the traffic relayed to reverse connected kites,
+// keyed by kite ID. The stats of a kite are kept after it disconnects,
+// so they add up over reconnects.
+func (k *Kite) RelayStats() map[string]RelayStats {
+	k.reverseMu.Lock()
+	defer k.reverseMu.Unlock()
+
+	stats := make(map[string]RelayStats, len(k.relayStats))
+	for id, s := range k.relayStats {
+		stats[id] = RelayStats{
+			Sessions: atomic.LoadInt64(&s.Sessions),
+			Sent:     atomic.LoadInt64(&s.Sent),
+			Received: atomic.LoadInt64(&s.Received),
+		}
+	}
+
+	return stats
+}
+
+// relayStatsOf gives the stats of the kite with the given ID.
+func (k *Kite) relayStatsOf(id string) *RelayStats {
+	k.reverseMu.Lock()
+	defer k.reverseMu.Unlock()
+
+	if k.relayStats == nil {
+		k.relayStats = make(map[string]*RelayStats)
+	}
+
+	s, ok := k.relayStats[id]
+	if !ok {
+		s = &RelayStats{}
+		k.relayStats[id] = s
+	}
+
+	return s
+}
+
+// handleReverse handles the announcement of a reverse connection.
+// Calls made over the connection are authenticated with
+// the kite key of the local kite.
+//
+// The connection is kept under the ID of the kite the credentials of
+// the caller were issued to, so a kite cannot take over the reverse
+// connection of another one by announcing itself with its ID.
+func handleReverse(r *Request) (interface{}, error) {
+	k, c := r.LocalKite, r.Client
+	id := r.KiteID
+
+	if id == "" {
+		return nil, errors.New("reverse connections are accepted only from kites authenticated with their own credentials")
+	}
+
+	if c.Kite.ID != id {
+		return nil, fmt.Errorf("kite ID %q does not match the ID %q the credentials were issued to", c.Kite.ID, id)
+	}
+
+	if key := k.KiteKey(); key != "" {
+		c.authMu.Lock()
+		c.Auth = &Auth{
+			Type: "kiteKey",
+			Key:  key,
+		}
+		c.authMu.Unlock()
+	}
+
+	k.reverseMu.Lock()
+	if k.reverse == nil {
+		k.reverse = make(map[string]*Client)
+	}
+	k.reverse[id] = c
+	k.reverseMu.Unlock()
+
+	c.OnDisconnect(func() {
+		k.reverseMu.Lock()
+		if k.reverse[id] == c {
+			delete(k.reverse, id)
+		}
+		k.reverseMu.Unlock()
+	})
+
+	k.Log.Info("Kite %s connected in reverse", c.Kite)
+
+	return nil, nil
+}
+
+// handleReverseTunnel handles the request of a relay to open a tunnel,
+// which the relay joins with the session of a consumer. The kite serves
+// its methods over the tunnel. It is accepted only from dialed kites,
+// which authenticate with their kite key, see handleReverse.
+func handleReverseTunnel(r *Request) (interface{}, error) {
+	if !r.Client.initiated() {
+		return nil, errors.New("reverse tunnels are opened only to dialed kites")
+	}
+
+	// Calls over dialed sessions are trusted without authentication,
+	// the relay is authenticated explicitly.
+	if r.Auth == nil || r.Auth.Type != "kiteKey" {
+		return nil, errors.New("reverse tunnels are opened only to kites authenticated with a kite key")
+	}
+
+	if err := r.LocalKite.AuthenticateFromKiteKey(r); err != nil {
+		return nil, err
+	}
+
+	var args struct {
+		Token string `json:"token"`
+	}
+
+	if err := r.Args.One().Unmarshal(&args); err != nil {
+		return nil, err
+	}
+
+	u, err := url.Parse(r.Client.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	q := u.Query()
+	q.Set(tunnelParam, args.Token)
+	u.RawQuery = q.Encode()
+
+	session, err := r.Client.dialURL(u.String(), r.LocalKite.Config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	go r.LocalKite.sockjsHandler(tunnelSession{session})
+
+	return nil, nil
+}
+
+// acceptSession serves the sessions accepted by the kite server.
+// The sessions of consumers relayed to reverse connected kites
+// and of the tunnels they are relayed over are joined, the other
+// ones are served by the kite.
+func (k *Kite) acceptSession(session sockjs.Session) {
+	var q url.Values
+	if req := session.Request(); req != nil {
+		q = req.URL.Query()
+	}
+
+	switch {
+	case q.Get(reverseParam) != "":
+		defer session.Close(3000, "Go away!")
+		k.relayTo(session, q.Get(reverseParam))
+	case q.Get(tunnelParam) != "":
+		defer session.Close(3000, "Go away!")
+		k.acceptTunnel(session, q.Get(tunnelParam))
+	default:
+		k.sockjsHandler(session)
+	}
+}
+
+// relayTo relays the session of a consumer to the reverse connected
+// kite with the given ID. The kite is requested to open a tunnel,
+// which is joined with the session.
+func (k *Kite) relayTo(session sockjs.Session, id string) {
+	c := k.ReverseClient(id)
+	if c == nil {
+		k.Log.Warning("Cannot relay to kite %s: no reverse connection", id)
+		return
+	}
+
+	token := utils.RandomString(32)
+	t := &reverseTunnel{
+		session: make(chan sockjs.Session, 1),
+		done:    make(chan struct{}),
+	}
+
+	k.reverseMu.Lock()
+	if k.tunnels == nil {
+		k.tunnels = make(map[string]*reverseTunnel)
+	}
+	k.tunnels[token] = t
+	k.reverseMu.Unlock()
+
+	defer func() {
+		k.reverseMu.Lock()
+		delete(k.tunnels, token)
+		k.reverseMu.Unlock()
+
+		close(t.done)
+	}()
+
+	_, err := c.TellWithTimeout("kite.reverseTunnel", k.Config.Timeout, map[string]string{"token": token})
+	if err != nil {
+		k.Log.Warning("Cannot open tunnel to kite %s: %s", id, err)
+		return
+	}
+
+	select {
+	case tunnel := <-t.session:
+		stats := k.relayStatsOf(id)
+		atomic.AddInt64(&stats.Sessions, 1)
+
+		joinSessions(session, tunnel, &stats.Sent, &stats.Received)
+	case <-time.After(k.Config.Timeout):
+		k.Log.Warning("Timed out waiting for tunnel to kite %s", id)
+	}
+}
+
+// acceptTunnel hands over the tunnel with the given token
+// to the relayed session waiting for it.
+func (k *Kite) acceptTunnel(session sockjs.Session, token string) {
+	k.reverseMu.Lock()
+	t, ok := k.tunnels[token]
+	delete(k.tunnels, token)
+	k.reverseMu.Unlock()
+
+	if !ok {
+		k.Log.Warning("Unknown tunnel token: %q", token)
+		return
+	}
+
+	t.session <- session
+	<-t.done
+}
+
+// joinSessions copies messages between the sessions until any of
+// them is closed. The bytes copied to b and to a are added to sent
+// and received respectively.
+func joinSessions(a, b sockjs.Session, sent, received *int64) {
+	done := make(chan struct{}, 2)
+
+	copy := func(dst, src sockjs.Session, n *int64) {
+		defer func() { done <- struct{}{} }()
+
+		for {
+			msg, err := src.Recv()
+			if err != nil {
+				return
+			}
+
+			if err := dst.Send(msg); err != nil {
+				return
+			}
+
+			atomic.AddInt64(n, int64(len(msg)))
+		}
+	}
+
+	go copy(b, a, sent)
+	go copy(a, b, received)
+
+	<-done
+
+	a.Close(3000, "Go away!")
+	b.Close(3000, "Go away!")
+
+	<-done
+}
@@ -0,0 +1,271 @@
+package reverseproxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// errServerName stops the handshake once the server name is read.
+var errServerName = errors.New("server name read")
+
+// AddRoute routes the TLS connections with the given server name (SNI)
+// to the backend at addr, when the proxy is run with
+// ListenAndServePassthrough. The connections are passed through
+// as they are, so the backend terminates TLS with a certificate
+// valid for the server name.
+func (p *Proxy) AddRoute(serverName, addr string) {
+	p.routesMu.Lock()
+	defer p.routesMu.Unlock()
+
+	if p.routes == nil {
+		p.routes = make(map[string]string)
+	}
+
+	p.routes[serverName] = addr
+}
+
+// RemoveRoute removes the route of the given server name.
+func (p *Proxy) RemoveRoute(serverName string) {
+	p.routesMu.Lock()
+	defer p.routesMu.Unlock()
+
+	delete(p.routes, serverName)
+}
+
+func (p *Proxy) route(serverName string) (string, bool) {
+	p.routesMu.Lock()
+	defer p.routesMu.Unlock()
+
+	addr, ok := p.routes[serverName]
+	return addr, ok
+}
+
+// serverName gives the server name of the kite with the given ID,
+// which it is reached with in the passthrough mode.
+func (p *Proxy) serverName(kiteID string) string {
+	return kiteID + "." + p.PublicHost
+}
+
+// registerPassthrough routes the server name of the kite to the address
+// of its URL and gives the URL the kite is reached with through the proxy.
+func (p *Proxy) registerPassthrough(kiteID string, kiteURL *url.URL) string {
+	addr := kiteURL.Host
+	if kiteURL.Port() == "" {
+		addr = net.JoinHostPort(kiteURL.Hostname(), "443")
+	}
+
+	serverName := p.serverName(kiteID)
+	p.AddRoute(serverName, addr)
+
+	proxyURL := url.URL{
+		Scheme: "https",
+		Host:   serverName + ":" + strconv.Itoa(p.PublicPort),
+		Path:   kiteURL.Path,
+	}
+
+	s := proxyURL.String()
+	p.Kite.Log.Info("Passing connections to '%s' through to '%s'. Can be reached now with: '%s'", serverName, addr, s)
+
+	return s
+}
+
+// ListenAndServePassthrough listens on the TCP network address of the
+// kite and routes TLS connections by their server name (SNI) without
+// terminating them, see AddRoute. Connections with other server names
+// are terminated with the given certificate and served by the proxy,
+// like with ListenAndServeTLS.
+//
+// Kites registered to the proxy are given a URL with a server name
+// of <kite ID>.<PublicHost>, e.g. a wildcard certificate of PublicHost
+// is required for their TLS server, see Passthrough.
+func (p *Proxy) ListenAndServePassthrough(certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+
+	p.listener, err = net.Listen("tcp",
+		net.JoinHostPort(p.Kite.Config.IP, strconv.Itoa(p.Kite.Config.Port)))
+	if err != nil {
+		return err
+	}
+	p.Kite.Log.Info("Listening on: %s", p.listener.Addr().String())
+
+	// now we are ready
+	close(p.readyC)
+
+	defer close(p.closeC)
+	return p.servePassthrough(p.listener, tlsConfig)
+}
+
+func (p *Proxy) servePassthrough(l net.Listener, tlsConfig *tls.Config) error {
+	terminated := &connListener{
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+		addr:   l.Addr(),
+	}
+	defer terminated.Close()
+
+	server := &http.Server{
+		Handler:   p.mux,
+		TLSConfig: tlsConfig,
+	}
+
+	go server.Serve(tls.NewListener(terminated, tlsConfig))
+	defer server.Close()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go p.passthrough(conn, terminated)
+	}
+}
+
+// passthrough pipes the connection to the backend routed by its
+// server name, or hands it over to be terminated if there is none.
+func (p *Proxy) passthrough(conn net.Conn, terminated *connListener) {
+	conn.SetReadDeadline(time.Now().Add(p.Kite.Config.Timeout))
+
+	serverName, conn, err := readServerName(conn)
+	if err != nil {
+		p.Kite.Log.Warning("Reading TLS server name from %s failed: %s", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	conn.SetReadDeadline(time.Time{})
+
+	addr, ok := p.route(serverName)
+	if !ok {
+		terminated.put(conn)
+		return
+	}
+
+	backend, err := net.DialTimeout("tcp", addr, p.Kite.Config.Timeout)
+	if err != nil {
+		p.Kite.Log.Error("[%s] Dialing backend %s failed: %s", serverName, addr, err)
+		conn.Close()
+		return
+	}
+
+	p.Kite.Log.Debug("[%s] Passing connection of %s through to %s", serverName, conn.RemoteAddr(), addr)
+
+	pipe(conn, backend)
+}
+
+// readServerName reads the TLS ClientHello of the connection and gives
+// its server name. The returned connection replays the bytes read.
+func readServerName(conn net.Conn) (string, net.Conn, error) {
+	var buf bytes.Buffer
+	var serverName string
+
+	err := tls.Server(readOnlyConn{Conn: conn, r: io.TeeReader(conn, &buf)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errServerName
+		},
+	}).Handshake()
+
+	conn = &replayConn{Conn: conn, r: io.MultiReader(&buf, conn)}
+
+	if err != errServerName {
+		return "", conn, err
+	}
+
+	return serverName, conn, nil
+}
+
+// pipe copies data between the connections until any of them is closed.
+func pipe(a, b net.Conn) {
+	var once sync.Once
+	closeBoth := func() {
+		a.Close()
+		b.Close()
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	copy := func(dst, src net.Conn) {
+		defer wg.Done()
+		io.Copy(dst, src)
+		once.Do(closeBoth)
+	}
+
+	go copy(a, b)
+	go copy(b, a)
+
+	wg.Wait()
+}
+
+// readOnlyConn is a connection of a handshake, which only reads
+// the ClientHello, writing the response fails.
+type readOnlyConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error) { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                { return nil }
+
+func (c readOnlyConn) SetDeadline(time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(time.Time) error { return nil }
+
+// replayConn is a connection, which reads the data of r first.
+type replayConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *replayConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+// connListener is a listener of connections handed over with put.
+type connListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+	addr   net.Addr
+}
+
+func (l *connListener) put(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.closed:
+		conn.Close()
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
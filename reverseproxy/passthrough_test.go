@@ -0,0 +1,83 @@
+package reverseproxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestPassthrough(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "backend")
+	}))
+	defer backend.Close()
+
+	p := New(newPoolConfig())
+	defer p.Kite.Close()
+
+	// The certificate of httptest is valid for example.com.
+	p.AddRoute("example.com", backend.Listener.Addr().String())
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go p.servePassthrough(l, backend.TLS)
+
+	get := func(serverName, path string) (int, string) {
+		transport := backend.Client().Transport.(*http.Transport).Clone()
+		transport.TLSClientConfig.ServerName = serverName
+
+		resp, err := (&http.Client{Transport: transport}).Get("https://" + l.Addr().String() + path)
+		if err != nil {
+			t.Fatalf("GET %s with server name %q: %s", path, serverName, err)
+		}
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return resp.StatusCode, string(body)
+	}
+
+	if code, body := get("example.com", "/"); code != http.StatusOK || body != "backend" {
+		t.Fatalf("got %d %q, want the response of the backend", code, body)
+	}
+
+	// Connections of other server names are served by the proxy.
+	if code, body := get("proxy.example.com", "/pool/unknown/"); code != http.StatusNotFound {
+		t.Fatalf("got %d %q, want %d", code, body, http.StatusNotFound)
+	}
+
+	p.RemoveRoute("example.com")
+
+	if code, _ := get("example.com", "/"); code != http.StatusNotFound {
+		t.Fatalf("got %d after removing route, want %d", code, http.StatusNotFound)
+	}
+}
+
+func TestRegisterPassthrough(t *testing.T) {
+	p := New(newPoolConfig())
+	defer p.Kite.Close()
+
+	p.PublicHost = "proxy.example.com"
+	p.PublicPort = 443
+
+	kiteURL, _ := url.Parse("https://10.0.0.5:3636/kite")
+
+	if got, want := p.registerPassthrough("1234", kiteURL), "https://1234.proxy.example.com:443/kite"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	if addr, ok := p.route("1234.proxy.example.com"); !ok || addr != "10.0.0.5:3636" {
+		t.Fatalf("got route %q, %t", addr, ok)
+	}
+}
@@ -0,0 +1,448 @@
+package reverseproxy
+
+import (
+	"hash/fnv"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/koding/kite"
+	"github.com/koding/kite/protocol"
+	"github.com/koding/websocketproxy"
+)
+
+const (
+	// DefaultHealthCheckInterval is the default interval of checking
+	// the health of pooled backends and refreshing them from Kontrol.
+	DefaultHealthCheckInterval = 10 * time.Second
+
+	// DefaultHealthCheckTimeout is the default time a backend
+	// is given to respond to a health check.
+	DefaultHealthCheckTimeout = 5 * time.Second
+
+	// DefaultMaxFailures is the default number of consecutive
+	// failures after which a backend is ejected from its pool.
+	DefaultMaxFailures = 3
+)
+
+// Backend is a kite of a Pool, which requests are proxied to.
+type Backend struct {
+	ID  string  // kite ID
+	URL url.URL // URL the kite is registered with
+
+	failures int32 // consecutive failures, accessed atomically
+	ejected  int32 // 1 if ejected, accessed atomically
+}
+
+// Ejected tells whether the backend is ejected from the pool after failing,
+// requests are not proxied to it until it passes a health check.
+func (b *Backend) Ejected() bool {
+	return atomic.LoadInt32(&b.ejected) == 1
+}
+
+// Pool is a health-checked pool of backend kites, which match a Kontrol
+// query. The proxy serves the pool under /pool/<name>/ and forwards
+// requests to one of the backends which are not ejected.
+//
+// Requests with the kiteID query parameter set to the ID of the client
+// kite are sticky - they are forwarded to the same backend as long as it
+// is not ejected. Requests of a SockJS session are sticky to the session
+// otherwise.
+//
+// The fields may be changed only before the pool is added to the proxy.
+type Pool struct {
+	Name  string
+	Query *protocol.KontrolQuery
+
+	// HealthCheckInterval is the interval of checking the health of
+	// the backends with their /readyz endpoint and refreshing them
+	// from Kontrol, DefaultHealthCheckInterval by default.
+	HealthCheckInterval time.Duration
+
+	// HealthCheckTimeout is the time a backend is given to respond
+	// to a health check, DefaultHealthCheckTimeout by default.
+	HealthCheckTimeout time.Duration
+
+	// MaxFailures is the number of consecutive failed health checks or
+	// proxied requests, after which a backend is ejected from the pool,
+	// DefaultMaxFailures by default.
+	MaxFailures int
+
+	p *Proxy
+
+	// getKites fetches the backend kites, p.Kite.GetKites by default.
+	getKites func(*protocol.KontrolQuery) ([]*kite.Client, error)
+
+	client         *http.Client
+	websocketProxy http.Handler
+	httpProxy      http.Handler
+
+	mu       sync.RWMutex
+	backends []*Backend
+	next     uint64 // round-robin counter, accessed atomically
+
+	once   sync.Once
+	closed chan struct{}
+	wg     sync.WaitGroup
+}
+
+// AddPool adds a pool of the backend kites, which match the query. The pool
+// is served under /pool/<name>/, e.g. kites dial it with a URL like:
+//
+//	http://proxy.example.com/pool/math?kiteID=<client kite ID>
+//
+// The backends are fetched from Kontrol and checked periodically until
+// the pool is closed.
+func (p *Proxy) AddPool(name string, query *protocol.KontrolQuery) *Pool {
+	pl := &Pool{
+		Name:     name,
+		Query:    query,
+		p:        p,
+		getKites: p.Kite.GetKites,
+		closed:   make(chan struct{}),
+	}
+
+	p.poolsMu.Lock()
+	if p.pools == nil {
+		p.pools = make(map[string]*Pool)
+	}
+	p.pools[name] = pl
+	p.poolsMu.Unlock()
+
+	return pl
+}
+
+// Backends gives the pooled backends.
+func (pl *Pool) Backends() []*Backend {
+	pl.start()
+
+	pl.mu.RLock()
+	defer pl.mu.RUnlock()
+
+	return append([]*Backend(nil), pl.backends...)
+}
+
+// Close stops checking the backends and removes the pool from the proxy.
+func (pl *Pool) Close() {
+	pl.p.poolsMu.Lock()
+	if pl.p.pools[pl.Name] == pl {
+		delete(pl.p.pools, pl.Name)
+	}
+	pl.p.poolsMu.Unlock()
+
+	pl.mu.Lock()
+	select {
+	case <-pl.closed:
+		pl.mu.Unlock()
+		return
+	default:
+		close(pl.closed)
+	}
+	pl.mu.Unlock()
+
+	pl.wg.Wait()
+}
+
+// servePool serves the requests proxied to the pools.
+func (p *Proxy) servePool(rw http.ResponseWriter, req *http.Request) {
+	name := strings.SplitN(strings.TrimPrefix(req.URL.Path, "/pool/"), "/", 2)[0]
+
+	p.poolsMu.Lock()
+	pl, ok := p.pools[name]
+	p.poolsMu.Unlock()
+
+	if !ok {
+		http.Error(rw, "pool not found", http.StatusNotFound)
+		return
+	}
+
+	pl.ServeHTTP(rw, req)
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (pl *Pool) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	pl.start()
+
+	if !pl.available() {
+		pl.p.Kite.Log.Error("[%s] No healthy backends for %s", pl.Name, req.URL)
+		http.Error(rw, "no healthy backends", http.StatusServiceUnavailable)
+		return
+	}
+
+	if isWebsocket(req) {
+		// we don't use https explicitly, ssl termination is done here
+		req.URL.Scheme = "ws"
+		pl.websocketProxy.ServeHTTP(rw, req)
+		return
+	}
+
+	pl.httpProxy.ServeHTTP(rw, req)
+}
+
+// available tells whether any of the backends is not ejected.
+func (pl *Pool) available() bool {
+	pl.mu.RLock()
+	defer pl.mu.RUnlock()
+
+	for _, b := range pl.backends {
+		if !b.Ejected() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// backend gives the URL of the backend the request is proxied to,
+// or nil if none of the backends is healthy.
+func (pl *Pool) backend(req *http.Request) *url.URL {
+	// rest contains SockJS related endpoints,
+	// like /info or /123/kjasd213/websocket
+	rest := strings.TrimPrefix(req.URL.Path, "/pool/"+pl.Name)
+
+	key := req.URL.Query().Get("kiteID")
+	if segments := strings.Split(strings.Trim(rest, "/"), "/"); key == "" && len(segments) == 3 {
+		key = segments[1] // SockJS session ID
+	}
+
+	b := pl.pick(key)
+	if b == nil {
+		pl.p.Kite.Log.Error("[%s] No healthy backends for %s", pl.Name, req.URL)
+		return nil
+	}
+
+	u := b.URL
+	u.Scheme = req.URL.Scheme
+	u.Path = path.Join(u.Path, rest)
+
+	return &u
+}
+
+func (pl *Pool) director(req *http.Request) {
+	u := pl.backend(req)
+	if u == nil {
+		return
+	}
+
+	// we don't use https explicitly, ssl termination is done here
+	req.URL.Scheme = "http"
+	req.URL.Host = u.Host
+	req.URL.Path = u.Path
+}
+
+// errorHandler counts the failed request as a failure of the backend.
+func (pl *Pool) errorHandler(rw http.ResponseWriter, req *http.Request, err error) {
+	pl.p.Kite.Log.Warning("[%s] Proxying to %s failed: %s", pl.Name, req.URL.Host, err)
+
+	pl.mu.RLock()
+	for _, b := range pl.backends {
+		if b.URL.Host == req.URL.Host {
+			pl.fail(b)
+		}
+	}
+	pl.mu.RUnlock()
+
+	rw.WriteHeader(http.StatusBadGateway)
+}
+
+// pick picks the backend for the key, backends are picked in turns
+// if the key is empty. Ejected backends are never picked.
+func (pl *Pool) pick(key string) *Backend {
+	pl.mu.RLock()
+	defer pl.mu.RUnlock()
+
+	healthy := make([]*Backend, 0, len(pl.backends))
+	for _, b := range pl.backends {
+		if !b.Ejected() {
+			healthy = append(healthy, b)
+		}
+	}
+
+	if len(healthy) == 0 {
+		return nil
+	}
+
+	if key == "" {
+		return healthy[(atomic.AddUint64(&pl.next, 1)-1)%uint64(len(healthy))]
+	}
+
+	// Rendezvous hashing keeps the keys on their backends
+	// while other backends are added or ejected.
+	var best *Backend
+	var max uint64
+
+	for _, b := range healthy {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte(b.ID))
+
+		if sum := h.Sum64(); best == nil || sum > max {
+			best, max = b, sum
+		}
+	}
+
+	return best
+}
+
+// fail counts a failure of the backend, ejecting it
+// after MaxFailures consecutive ones.
+func (pl *Pool) fail(b *Backend) {
+	if atomic.AddInt32(&b.failures, 1) >= int32(pl.MaxFailures) && atomic.CompareAndSwapInt32(&b.ejected, 0, 1) {
+		pl.p.Kite.Log.Warning("[%s] Ejecting backend %s: %s", pl.Name, b.ID, b.URL.String())
+	}
+}
+
+// succeed resets the failures of the backend, readmitting it if ejected.
+func (pl *Pool) succeed(b *Backend) {
+	atomic.StoreInt32(&b.failures, 0)
+
+	if atomic.CompareAndSwapInt32(&b.ejected, 1, 0) {
+		pl.p.Kite.Log.Info("[%s] Readmitting backend %s: %s", pl.Name, b.ID, b.URL.String())
+	}
+}
+
+func (pl *Pool) start() {
+	pl.once.Do(func() {
+		if pl.HealthCheckInterval <= 0 {
+			pl.HealthCheckInterval = DefaultHealthCheckInterval
+		}
+
+		if pl.HealthCheckTimeout <= 0 {
+			pl.HealthCheckTimeout = DefaultHealthCheckTimeout
+		}
+
+		if pl.MaxFailures <= 0 {
+			pl.MaxFailures = DefaultMaxFailures
+		}
+
+		pl.client = &http.Client{Timeout: pl.HealthCheckTimeout}
+
+		pl.websocketProxy = &websocketproxy.WebsocketProxy{
+			Backend: pl.backend,
+			Upgrader: &websocket.Upgrader{
+				ReadBufferSize:  4096,
+				WriteBufferSize: 4096,
+				CheckOrigin: func(r *http.Request) bool {
+					return true
+				},
+			},
+		}
+
+		pl.httpProxy = &httputil.ReverseProxy{
+			Director:     pl.director,
+			ErrorHandler: pl.errorHandler,
+		}
+
+		pl.refresh()
+
+		pl.wg.Add(1)
+		go pl.checkLoop()
+	})
+}
+
+func (pl *Pool) checkLoop() {
+	defer pl.wg.Done()
+
+	t := time.NewTicker(pl.HealthCheckInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-pl.closed:
+			return
+		case <-t.C:
+			pl.refresh()
+		}
+	}
+}
+
+// refresh synchronizes the backends with the kites registered
+// to Kontrol and checks their health.
+func (pl *Pool) refresh() {
+	pl.mu.RLock()
+	backends := append([]*Backend(nil), pl.backends...)
+	pl.mu.RUnlock()
+
+	clients, err := pl.getKites(pl.Query)
+	if err != nil && err != kite.ErrNoKitesAvailable {
+		// Keep the current backends, they are still checked.
+		pl.p.Kite.Log.Warning("[%s] Unable to refresh backends: %s", pl.Name, err)
+	} else {
+		current := make(map[string]*Backend, len(backends))
+		for _, b := range backends {
+			current[b.ID] = b
+		}
+
+		backends = make([]*Backend, 0, len(clients))
+
+		for _, c := range clients {
+			c.Close()
+
+			u, err := url.Parse(c.URL)
+			if err != nil {
+				pl.p.Kite.Log.Warning("[%s] Invalid URL of %s: %s", pl.Name, c.Kite, err)
+				continue
+			}
+
+			// A kite registered again with another URL starts afresh.
+			b, ok := current[c.Kite.ID]
+			if !ok || b.URL != *u {
+				b = &Backend{ID: c.Kite.ID, URL: *u}
+			}
+
+			backends = append(backends, b)
+		}
+	}
+
+	var wg sync.WaitGroup
+
+	for _, b := range backends {
+		wg.Add(1)
+		go func(b *Backend) {
+			defer wg.Done()
+			pl.check(b)
+		}(b)
+	}
+
+	wg.Wait()
+
+	pl.mu.Lock()
+	pl.backends = backends
+	pl.mu.Unlock()
+}
+
+// check checks the health of the backend with its /readyz endpoint.
+func (pl *Pool) check(b *Backend) {
+	u := b.URL
+	u.Path = "/readyz"
+	u.RawQuery = ""
+
+	switch u.Scheme {
+	case "ws":
+		u.Scheme = "http"
+	case "wss":
+		u.Scheme = "https"
+	}
+
+	resp, err := pl.client.Get(u.String())
+	if err != nil {
+		pl.p.Kite.Log.Debug("[%s] Health check of %s failed: %s", pl.Name, b.ID, err)
+		pl.fail(b)
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		pl.p.Kite.Log.Debug("[%s] Health check of %s failed: %s", pl.Name, b.ID, resp.Status)
+		pl.fail(b)
+		return
+	}
+
+	pl.succeed(b)
+}
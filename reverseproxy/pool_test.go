@@ -0,0 +1,128 @@
+package reverseproxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/koding/kite"
+	"github.com/koding/kite/config"
+	"github.com/koding/kite/protocol"
+	"github.com/koding/kite/testkeys"
+	"github.com/koding/kite/testutil"
+)
+
+func newPoolConfig() *config.Config {
+	conf := config.New()
+	conf.KiteKey = testutil.NewKiteKey().Raw
+	conf.KontrolUser = "testuser"
+	conf.KontrolKey = testkeys.Public
+	return conf
+}
+
+func TestPool(t *testing.T) {
+	var backends []*kite.Kite
+
+	for i := 0; i < 2; i++ {
+		k := kite.NewWithConfig("math", "0.0.1", newPoolConfig())
+		go k.Run()
+		<-k.ServerReadyNotify()
+		defer k.Close()
+
+		backends = append(backends, k)
+	}
+
+	p := New(newPoolConfig())
+	defer p.Kite.Close()
+
+	pool := p.AddPool("math", &protocol.KontrolQuery{Name: "math"})
+	pool.HealthCheckInterval = time.Hour // refreshed explicitly
+	pool.MaxFailures = 1
+	pool.getKites = func(*protocol.KontrolQuery) ([]*kite.Client, error) {
+		var clients []*kite.Client
+
+		for _, k := range backends {
+			c := p.Kite.NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", k.Port()))
+			c.Kite.ID = k.Id
+			clients = append(clients, c)
+		}
+
+		return clients, nil
+	}
+	defer pool.Close()
+
+	if n := len(pool.Backends()); n != 2 {
+		t.Fatalf("got %d backends, want 2", n)
+	}
+
+	for _, b := range pool.Backends() {
+		if b.Ejected() {
+			t.Fatalf("backend %s is ejected", b.ID)
+		}
+	}
+
+	sticky := pool.pick("client-kite-id")
+	for i := 0; i < 10; i++ {
+		if b := pool.pick("client-kite-id"); b != sticky {
+			t.Fatalf("got backend %s, want %s", b.ID, sticky.ID)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/pool/math/info?kiteID=client-kite-id", nil)
+	p.mux.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d for /info, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/pool/unknown/info", nil)
+	p.mux.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("got %d for unknown pool, want %d", rec.Code, http.StatusNotFound)
+	}
+
+	// The crashed backend is ejected although it is still returned
+	// by the query, the sticky requests fail over to the other one.
+	var crashed, alive *kite.Kite
+	if sticky.ID == backends[0].Id {
+		crashed, alive = backends[0], backends[1]
+	} else {
+		crashed, alive = backends[1], backends[0]
+	}
+
+	crashed.Close()
+	pool.refresh()
+
+	for _, b := range pool.Backends() {
+		if b.Ejected() != (b.ID == crashed.Id) {
+			t.Fatalf("backend %s: got ejected %t", b.ID, b.Ejected())
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		if b := pool.pick("client-kite-id"); b == nil || b.ID != alive.Id {
+			t.Fatalf("got backend %v, want %s", b, alive.Id)
+		}
+
+		if b := pool.pick(""); b == nil || b.ID != alive.Id {
+			t.Fatalf("got backend %v, want %s", b, alive.Id)
+		}
+	}
+
+	// With no healthy backends the pool is unavailable.
+	alive.Close()
+	pool.refresh()
+
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/pool/math/info", nil)
+	p.mux.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("got %d with no healthy backends, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+}
@@ -35,6 +35,15 @@ type Proxy struct {
 	kites   map[string]url.URL
 	kitesMu sync.Mutex
 
+	// Holds pools of backend kites. Keys are pool names.
+	pools   map[string]*Pool
+	poolsMu sync.Mutex
+
+	// Holds routes of TLS connections passed through to backends.
+	// Keys are server names, values are backend addresses.
+	routes   map[string]string
+	routesMu sync.Mutex
+
 	// muxer for proxy
 	mux            *http.ServeMux
 	websocketProxy http.Handler
@@ -44,6 +53,12 @@ type Proxy struct {
 	Scheme     string
 	PublicHost string // If given it must match the domain in certificate.
 	PublicPort int    // Uses for registering and defining the public port.
+
+	// Passthrough makes registered kites reachable by TLS connections,
+	// which the proxy passes through without terminating them, when it
+	// is run with ListenAndServePassthrough. Kites are given URLs with
+	// a server name of <kite ID>.<PublicHost>, which resolves to the proxy.
+	Passthrough bool
 }
 
 func New(conf *config.Config) *Proxy {
@@ -82,11 +97,13 @@ func New(conf *config.Config) *Proxy {
 
 	p.mux.Handle("/", k)
 	p.mux.Handle("/proxy/", p)
+	p.mux.HandleFunc("/pool/", p.servePool)
 
 	// OnDisconnect is called whenever a kite is disconnected from us.
 	k.OnDisconnect(func(r *kite.Client) {
 		k.Log.Info("Removing kite Id '%s' from proxy. It's disconnected", r.Kite.ID)
 		delete(p.kites, r.Kite.ID)
+		p.RemoveRoute(p.serverName(r.Kite.ID))
 	})
 
 	return p
@@ -130,6 +147,10 @@ func (p *Proxy) handleRegister(r *kite.Request) (interface{}, error) {
 
 	p.kites[r.Client.ID] = *kiteUrl
 
+	if p.Passthrough {
+		return p.registerPassthrough(r.Client.ID, kiteUrl), nil
+	}
+
 	proxyURL := url.URL{
 		Scheme: p.Scheme,
 		Host:   p.PublicHost + ":" + strconv.Itoa(p.PublicPort),
@@ -22,6 +22,7 @@ var (
 	flagRegion      = flag.String("region", "", "Change region")
 	flagEnvironment = flag.String("env", "development", "Change development")
 	flagVersion     = flag.Bool("version", false, "Show version and exit")
+	flagPassthrough = flag.Bool("passthrough", false, "Route TLS connections to kites by SNI without terminating them")
 )
 
 func main() {
@@ -50,6 +51,7 @@ func main() {
 	r := reverseproxy.New(conf)
 	r.PublicHost = *flagPublicHost
 	r.Scheme = scheme
+	r.Passthrough = *flagPassthrough
 
 	// Use server port if the public port is not defined
 	if *flagPublicPort == 0 {
@@ -68,12 +70,21 @@ func main() {
 		r.Kite.Log.Fatal("Registering to Kontrol: %s", err)
 	}
 
+	if *flagPassthrough && (*flagCertFile == "" || *flagKeyFile == "") {
+		log.Fatal("Please specify cert/key files via -cert and -key for -passthrough. Aborting.")
+	}
+
 	if *flagCertFile == "" || *flagKeyFile == "" {
 		log.Println("No cert/key files are defined. Running proxy unsecure.")
 		err := r.ListenAndServe()
 		if err != nil {
 			log.Fatal("ListenAndServe: ", err)
 		}
+	} else if *flagPassthrough {
+		err := r.ListenAndServePassthrough(*flagCertFile, *flagKeyFile)
+		if err != nil {
+			log.Fatal("ListenAndServePassthrough: ", err)
+		}
 	} else {
 		err := r.ListenAndServeTLS(*flagCertFile, *flagKeyFile)
 		if err != nil {
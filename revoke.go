@@ -0,0 +1,108 @@
+package kite
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/koding/kite/protocol"
+)
+
+// ErrRevoked is returned by authenticators when the kite key or token
+// of the request was revoked.
+var ErrRevoked = errors.New("credentials are revoked")
+
+// revocations holds revoked JWT IDs and kite IDs along with the time
+// they can be forgotten.
+type revocations struct {
+	mu      sync.RWMutex
+	jti     map[string]int64
+	kiteID  map[string]int64
+	version int64  // version of the last revocations fetched from kontrol
+	epoch   string // epoch of the version
+}
+
+// Revoke makes the kite deny requests authenticated with the revoked
+// kite keys or tokens.
+//
+// Revocations issued by Kontrol are added with GetRevocations,
+// PollRevocations or WatchRevocations.
+func (k *Kite) Revoke(revs ...*protocol.Revocation) {
+	k.revocations.add(revs...)
+}
+
+// IsRevoked returns true if credentials with the given JWT ID or
+// the ones used by the kite with the given ID were revoked.
+// Empty IDs are ignored.
+func (k *Kite) IsRevoked(jti, kiteID string) bool {
+	return k.revocations.revoked(jti, kiteID)
+}
+
+func (r *revocations) add(revs ...*protocol.Revocation) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.jti == nil {
+		r.jti = make(map[string]int64)
+		r.kiteID = make(map[string]int64)
+	}
+
+	now := time.Now().Unix()
+
+	// Forget revocations of credentials that have expired anyway.
+	for _, m := range []map[string]int64{r.jti, r.kiteID} {
+		for id, exp := range m {
+			if exp != 0 && exp <= now {
+				delete(m, id)
+			}
+		}
+	}
+
+	for _, rev := range revs {
+		if rev.JTI != "" {
+			r.jti[rev.JTI] = rev.Expires
+		}
+
+		// Kite keys are issued with the kite ID as their JWT ID.
+		if rev.KiteID != "" {
+			r.kiteID[rev.KiteID] = rev.Expires
+			r.jti[rev.KiteID] = rev.Expires
+		}
+	}
+}
+
+func (r *revocations) revoked(jti, kiteID string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	now := time.Now().Unix()
+
+	if exp, ok := r.jti[jti]; ok && jti != "" && (exp == 0 || now < exp) {
+		return true
+	}
+
+	if exp, ok := r.kiteID[kiteID]; ok && kiteID != "" && (exp == 0 || now < exp) {
+		return true
+	}
+
+	return false
+}
+
+func (r *revocations) getVersion() (int64, string) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.version, r.epoch
+}
+
+func (r *revocations) update(res *protocol.GetRevocationsResult) {
+	r.add(res.Revocations...)
+
+	r.mu.Lock()
+	// Versions start over with a new epoch, e.g. after Kontrol restarted.
+	if res.Epoch != r.epoch || res.Version > r.version {
+		r.version = res.Version
+		r.epoch = res.Epoch
+	}
+	r.mu.Unlock()
+}
@@ -0,0 +1,99 @@
+package kite
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// RequireScope allows calling the method only by callers, which were
+// granted all of the given scopes. Calls lacking any of the scopes fail
+// with a "forbidden" error before any of the handlers is run.
+//
+// Scopes are read from the claims of the token or kite key the request
+// was authenticated with, see Kite.ScopesFromClaims. Custom authenticators
+// grant scopes by setting Request.Scopes.
+func (m *Method) RequireScope(scopes ...string) *Method {
+	m.mu.Lock()
+	m.scopes = append(m.scopes, scopes...)
+	m.resetChain()
+	m.mu.Unlock()
+
+	return m
+}
+
+// HasScope returns true if the caller was granted the given scope.
+func (r *Request) HasScope(scope string) bool {
+	for _, s := range r.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkScopes gives a "forbidden" error if the caller was not granted
+// any of the scopes required by the method.
+func (m *Method) checkScopes(r *Request) *Error {
+	for _, scope := range m.handlerChain(r.LocalKite).scopes {
+		if !r.HasScope(scope) {
+			return &Error{
+				Type:      "forbidden",
+				Message:   fmt.Sprintf("%q scope is required to call %q", scope, r.Method),
+				RequestID: r.ID,
+			}
+		}
+	}
+
+	return nil
+}
+
+// ScopesClaim is the default ScopesFromClaims func. It reads the "scopes"
+// claim, see kitekey.KiteClaims.
+func ScopesClaim(claims jwt.MapClaims) []string {
+	v, ok := claims["scopes"].([]interface{})
+	if !ok {
+		return nil
+	}
+
+	scopes := make([]string, 0, len(v))
+
+	for _, s := range v {
+		if s, ok := s.(string); ok {
+			scopes = append(scopes, s)
+		}
+	}
+
+	return scopes
+}
+
+// scopesFromToken gives the scopes granted by the claims of the already
+// verified token.
+func (k *Kite) scopesFromToken(token *jwt.Token) ([]string, error) {
+	// The claims were decoded into kitekey.KiteClaims, decode them again
+	// so custom claims can be read as well.
+	parts := strings.Split(token.Raw, ".")
+	if len(parts) != 3 {
+		return nil, jwt.NewValidationError("token contains an invalid number of segments", jwt.ValidationErrorMalformed)
+	}
+
+	p, err := jwt.DecodeSegment(parts[1])
+	if err != nil {
+		return nil, err
+	}
+
+	var claims jwt.MapClaims
+
+	if err := json.Unmarshal(p, &claims); err != nil {
+		return nil, err
+	}
+
+	if k.ScopesFromClaims != nil {
+		return k.ScopesFromClaims(claims), nil
+	}
+
+	return ScopesClaim(claims), nil
+}
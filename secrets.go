@@ -0,0 +1,191 @@
+package kite
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"time"
+
+	"github.com/koding/kite/config"
+	"github.com/koding/kite/kitekey"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// minSecretsRetry is the shortest interval between attempts
+// to get secrets, which failed to be got.
+const minSecretsRetry = time.Second
+
+// LoadSecrets gets the secrets of the kite from Config.SecretsProvider and
+// applies them: the kite key replaces Config.KiteKey, along with the other
+// fields read from it as with Config.ReadToken, and the TLS certificate
+// is served by the kite server. The secrets are got again in the
+// background before they expire, until the kite is closed.
+//
+// LoadSecrets is called when the kite starts serving or sets up its
+// Kontrol client, it needs to be called explicitly only to get the
+// secrets earlier. Subsequent calls do nothing.
+func (k *Kite) LoadSecrets() error {
+	p := k.Config.SecretsProvider
+	if p == nil {
+		return nil
+	}
+
+	k.secretsMu.Lock()
+	defer k.secretsMu.Unlock()
+
+	if k.secretsCancel != nil {
+		return nil // already loaded
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), k.Config.Timeout)
+	s, err := p.Secrets(ctx)
+	cancel()
+
+	if err != nil {
+		return fmt.Errorf("kite: unable to get secrets: %s", err)
+	}
+
+	if err := k.applySecrets(s, true); err != nil {
+		return err
+	}
+
+	ctx, k.secretsCancel = context.WithCancel(context.Background())
+
+	go k.refreshSecrets(ctx, p, s.TTL)
+
+	return nil
+}
+
+// OnSecrets registers a callback which is called when the kite gets its
+// secrets from Config.SecretsProvider, after they are applied.
+func (k *Kite) OnSecrets(handler func(*config.Secrets)) {
+	k.handlersMu.Lock()
+	k.onSecretsHandlers = append(k.onSecretsHandlers, handler)
+	k.handlersMu.Unlock()
+}
+
+func (k *Kite) callOnSecretsHandlers(s *config.Secrets) {
+	k.handlersMu.RLock()
+	defer k.handlersMu.RUnlock()
+
+	for _, handler := range k.onSecretsHandlers {
+		func() {
+			defer nopRecover()
+			handler(s)
+		}()
+	}
+}
+
+// refreshSecrets gets the secrets after two thirds of their TTL. Failed
+// attempts are retried after two thirds of the remaining time, so the
+// secrets are retried a few times before they expire.
+func (k *Kite) refreshSecrets(ctx context.Context, p config.SecretsProvider, ttl time.Duration) {
+	for ttl > 0 {
+		wait := ttl * 2 / 3
+		if wait < minSecretsRetry {
+			wait = minSecretsRetry
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return
+		}
+
+		reqCtx, cancel := context.WithTimeout(ctx, k.Config.Timeout)
+		s, err := p.Secrets(reqCtx)
+		cancel()
+
+		if err == nil {
+			err = k.applySecrets(s, false)
+		}
+
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
+			k.Log.Error("Unable to refresh secrets: %s", err)
+
+			ttl -= wait
+			continue
+		}
+
+		k.Log.Info("Secrets are refreshed")
+
+		ttl = s.TTL
+	}
+}
+
+// applySecrets applies the secrets. The initial secrets are applied
+// before the kite server starts, so the TLS certificate is set on
+// TLSConfig. Refreshed certificates are served for connections made
+// after the refresh, as with ReloadConfig.
+func (k *Kite) applySecrets(s *config.Secrets, initial bool) error {
+	var cert *tls.Certificate
+
+	if s.TLSCertificate != "" {
+		c, err := tls.X509KeyPair([]byte(s.TLSCertificate), []byte(s.TLSKey))
+		if err != nil {
+			return fmt.Errorf("kite: invalid TLS certificate: %s", err)
+		}
+
+		cert = &c
+	}
+
+	var key *jwt.Token
+
+	if s.KiteKey != "" {
+		var err error
+		if key, err = jwt.ParseWithClaims(s.KiteKey, &kitekey.KiteClaims{}, kitekey.GetKontrolKey); err != nil {
+			return fmt.Errorf("kite: invalid kite key: %s", err)
+		}
+	}
+
+	if key != nil {
+		k.configMu.Lock()
+		err := k.Config.ReadToken(key)
+		if err == nil {
+			err = k.initKontrolKeys()
+		}
+		k.configMu.Unlock()
+
+		if err != nil {
+			return fmt.Errorf("kite: invalid kite key: %s", err)
+		}
+	}
+
+	if cert != nil {
+		k.reloadMu.Lock()
+		switch {
+		case initial:
+			if k.TLSConfig == nil {
+				k.TLSConfig = &tls.Config{}
+			}
+
+			k.TLSConfig.Certificates = []tls.Certificate{*cert}
+		case k.TLSConfig != nil:
+			tlsConfig := k.TLSConfig.Clone()
+			tlsConfig.Certificates = []tls.Certificate{*cert}
+			tlsConfig.GetConfigForClient = nil
+
+			k.tlsReloaded.Store(tlsConfig)
+		}
+		k.reloadMu.Unlock()
+	}
+
+	k.callOnSecretsHandlers(s)
+
+	return nil
+}
+
+// stopSecrets stops refreshing the secrets.
+func (k *Kite) stopSecrets() {
+	k.secretsMu.Lock()
+	defer k.secretsMu.Unlock()
+
+	if k.secretsCancel != nil {
+		k.secretsCancel()
+	}
+}
@@ -0,0 +1,143 @@
+package kite
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/koding/kite/config"
+	"github.com/koding/kite/testutil"
+)
+
+type fakeSecrets struct {
+	mu      sync.Mutex
+	secrets []*config.Secrets
+}
+
+func (f *fakeSecrets) Secrets(context.Context) (*config.Secrets, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s := f.secrets[0]
+	if len(f.secrets) > 1 {
+		f.secrets = f.secrets[1:]
+	}
+
+	return s, nil
+}
+
+func TestKite_SecretsProvider(t *testing.T) {
+	newCert := func(name string) (certPEM, keyPEM string) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			Subject:      pkix.Name{CommonName: name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+		}
+
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+			string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+	}
+
+	cert1, key1 := newCert("first")
+	cert2, key2 := newCert("second")
+
+	p := &fakeSecrets{secrets: []*config.Secrets{{
+		KiteKey:        testutil.NewKiteKeyUsername("alice").Raw,
+		TLSCertificate: cert1,
+		TLSKey:         key1,
+		TTL:            300 * time.Millisecond,
+	}, {
+		KiteKey:        testutil.NewKiteKeyUsername("bob").Raw,
+		TLSCertificate: cert2,
+		TLSKey:         key2,
+	}}}
+
+	k := New("testkite", "0.0.1")
+	k.Config.DisableAuthentication = true
+	k.Config.SecretsProvider = p
+
+	var got []*config.Secrets
+	var mu sync.Mutex
+	k.OnSecrets(func(s *config.Secrets) {
+		mu.Lock()
+		got = append(got, s)
+		mu.Unlock()
+	})
+
+	go k.Run()
+	defer k.Close()
+	<-k.ServerReadyNotify()
+
+	served := func() string {
+		conn, err := tls.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", k.Port()), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatalf("Dial()=%s", err)
+		}
+		defer conn.Close()
+
+		return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+
+	if name := served(); name != "first" {
+		t.Fatalf("got %q certificate, want first", name)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := len(got)
+		mu.Unlock()
+
+		if n == 2 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d secrets, want 2", n)
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if name := served(); name != "second" {
+		t.Fatalf("got %q certificate, want second", name)
+	}
+
+	if key := k.KiteKey(); key != got[1].KiteKey {
+		t.Fatal("expected kite key to be refreshed")
+	}
+
+	k.configMu.RLock()
+	username := k.Config.Username
+	k.configMu.RUnlock()
+
+	if username != "bob" {
+		t.Fatalf("got %q username, want bob", username)
+	}
+}
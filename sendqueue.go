@@ -0,0 +1,130 @@
+package kite
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/koding/kite/config"
+)
+
+// ErrSendQueueFull is returned when a message cannot be sent to the remote
+// kite, because the queue of the messages waiting to be sent over the session
+// is full and Config.SendQueueOverflow is config.OverflowReject.
+var ErrSendQueueFull = &Error{
+	Type:      "sendQueueFull",
+	Message:   "The queue of messages sent to the remote kite is full",
+	Retryable: true,
+}
+
+// sendQueue is the queue of messages waiting to be sent over the session
+// by the send hub. Its size is bounded by the high and low watermarks,
+// see Config.SendQueueHigh.
+type sendQueue struct {
+	high, low int64
+	reject    bool
+
+	mu      sync.Mutex
+	msgs    []*message
+	size    int64         // bytes of the queued messages and the one being sent
+	full    bool          // size reached high, and did not drop below low yet
+	drained chan struct{} // closed once the queue is no longer full
+	ready   chan struct{} // signaled when a message is pushed
+}
+
+func newSendQueue(cfg *config.Config) *sendQueue {
+	q := &sendQueue{
+		high:   cfg.SendQueueHigh,
+		low:    cfg.SendQueueLow,
+		reject: cfg.SendQueueHigh > 0 && cfg.SendQueueOverflow == config.OverflowReject,
+		ready:  make(chan struct{}, 1),
+	}
+
+	if q.high < 0 {
+		q.high = 0
+	}
+
+	if q.low <= 0 || q.low > q.high {
+		q.low = q.high / 2
+	}
+
+	return q
+}
+
+// push queues the message. If the queue is full, it waits until the queue
+// drains below the low watermark or closed is closed, or it fails with
+// ErrSendQueueFull, depending on the overflow policy.
+//
+// A message is queued as long as the queue is not full, even if it
+// exceeds the high watermark, so messages bigger than the high
+// watermark can be sent as well.
+func (q *sendQueue) push(msg *message, closed <-chan struct{}) error {
+	for {
+		q.mu.Lock()
+
+		if !q.full {
+			q.msgs = append(q.msgs, msg)
+			q.size += msg.size()
+
+			if q.size > q.high {
+				q.full = true
+				q.drained = make(chan struct{})
+			}
+
+			q.mu.Unlock()
+
+			select {
+			case q.ready <- struct{}{}:
+			default:
+			}
+
+			return nil
+		}
+
+		if q.reject {
+			q.mu.Unlock()
+
+			err := *ErrSendQueueFull
+			return &err
+		}
+
+		drained := q.drained
+		q.mu.Unlock()
+
+		select {
+		case <-drained:
+		case <-closed:
+			return errors.New("can't send, client is closed")
+		}
+	}
+}
+
+// pop gives the oldest queued message, or nil if the queue is empty.
+// The message is accounted in the size of the queue until it is
+// released with done.
+func (q *sendQueue) pop() *message {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.msgs) == 0 {
+		return nil
+	}
+
+	msg := q.msgs[0]
+	q.msgs[0] = nil
+	q.msgs = q.msgs[1:]
+
+	return msg
+}
+
+// done releases the message, which was sent or failed to be sent.
+func (q *sendQueue) done(msg *message) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.size -= msg.size()
+
+	if q.full && q.size <= q.low {
+		q.full = false
+		close(q.drained)
+	}
+}
@@ -0,0 +1,132 @@
+package kite
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/igm/sockjs-go/sockjs"
+	"github.com/koding/kite/config"
+)
+
+func TestSendQueue(t *testing.T) {
+	cfg := config.New()
+	cfg.SendQueueHigh = 10
+	cfg.SendQueueLow = 5
+	cfg.SendQueueOverflow = config.OverflowReject
+
+	q := newSendQueue(cfg)
+	closed := make(chan struct{})
+
+	msg := func() *message {
+		return &message{p: []byte("abcd"), frames: [][]byte{[]byte("ef")}}
+	}
+
+	// The second message exceeds the high watermark.
+	for i := 0; i < 2; i++ {
+		if err := q.push(msg(), closed); err != nil {
+			t.Fatalf("%d: push()=%s", i, err)
+		}
+	}
+
+	if err := q.push(msg(), closed); !errors.Is(err, ErrSendQueueFull) {
+		t.Fatalf("got %v, want %v", err, ErrSendQueueFull)
+	}
+
+	// The queue is full until it drains to the low watermark.
+	q.done(q.pop())
+
+	if err := q.push(msg(), closed); !errors.Is(err, ErrSendQueueFull) {
+		t.Fatalf("got %v, want %v", err, ErrSendQueueFull)
+	}
+
+	q.done(q.pop())
+
+	if err := q.push(msg(), closed); err != nil {
+		t.Fatalf("push()=%s", err)
+	}
+
+	if m := q.pop(); m == nil || q.pop() != nil {
+		t.Fatal("expected exactly one queued message")
+	}
+
+	// Senders wait while the queue is full.
+	cfg.SendQueueOverflow = config.OverflowQueue
+	q = newSendQueue(cfg)
+
+	m1, m2 := msg(), msg()
+	q.push(m1, closed)
+	q.push(m2, closed)
+
+	done := make(chan error, 1)
+	go func() { done <- q.push(msg(), closed) }()
+
+	select {
+	case err := <-done:
+		t.Fatalf("push() returned %v while the queue is full", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	q.done(q.pop())
+	q.done(q.pop())
+
+	if err := <-done; err != nil {
+		t.Fatalf("push()=%s", err)
+	}
+
+	go func() { done <- q.push(msg(), closed) }()
+	go func() { done <- q.push(msg(), closed) }()
+
+	// One of the senders waits until the client is closed.
+	if err := <-done; err != nil {
+		t.Fatalf("push()=%s", err)
+	}
+
+	close(closed)
+
+	if err := <-done; err == nil {
+		t.Fatal("expected push() to fail once closed")
+	}
+}
+
+func TestClient_SendQueue(t *testing.T) {
+	k := New("sender", "0.0.1")
+	k.Config.SendQueueHigh = 1024
+	k.Config.SendQueueOverflow = config.OverflowReject
+
+	session := &stalledSession{unblock: make(chan struct{})}
+
+	c := k.NewClient("")
+	c.setSession(session)
+	c.wg.Add(1)
+	go c.sendHub()
+	defer c.Close()
+	defer close(session.unblock)
+
+	payload := make([]byte, 256)
+
+	var err error
+	for i := 0; i < 100 && err == nil; i++ {
+		_, _, err = c.marshalAndSend("method", []interface{}{payload})
+	}
+
+	if !errors.Is(err, ErrSendQueueFull) {
+		t.Fatalf("got %v, want %v", err, ErrSendQueueFull)
+	}
+}
+
+// stalledSession is a session of a remote kite, which does not read
+// the messages sent to it.
+type stalledSession struct {
+	unblock chan struct{}
+}
+
+var _ sockjs.Session = (*stalledSession)(nil)
+
+func (s *stalledSession) ID() string                           { return "stalled" }
+func (s *stalledSession) Request() *http.Request               { return nil }
+func (s *stalledSession) Recv() (string, error)                { <-s.unblock; return "", errors.New("closed") }
+func (s *stalledSession) Send(string) error                    { <-s.unblock; return nil }
+func (s *stalledSession) Close(uint32, string) error           { return nil }
+func (s *stalledSession) GetSessionState() sockjs.SessionState { return sockjs.SessionActive }
@@ -2,6 +2,7 @@
 package kite
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"io/ioutil"
@@ -11,24 +12,22 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 // Run is a blocking method. It runs the kite server and then accepts requests
-// asynchronously. It supports graceful restart via SIGUSR2.
+// asynchronously. It supports graceful restart, see SetupRestartHandler.
 func (k *Kite) Run() {
 	if os.Getenv("KITE_VERSION") != "" {
 		fmt.Println(k.Kite().Version)
 		os.Exit(0)
 	}
 
-	// An error string equivalent to net.errClosing for using with http.Serve()
-	// during a graceful exit. Needed to declare here again because it is not
-	// exported by "net" package.
-	const errClosing = "use of closed network connection"
-
 	err := k.listenAndServe()
 	if err != nil {
-		if strings.Contains(err.Error(), errClosing) {
+		if isClosing(err) {
 			// The server is closed by Close() method
 			k.Log.Info("Kite server is closed.")
 			return
@@ -37,8 +36,77 @@ func (k *Kite) Run() {
 	}
 }
 
+// ServeListener is like Run, but it serves on the given listener instead
+// of listening on the configured address, e.g. on a socket passed with
+// systemd socket activation or one bound to an ephemeral port. The listener
+// is wrapped with TLS if it is configured with UseTLS or Config.AutoTLS.
+//
+// ServeListener blocks until the kite is closed, when it returns nil.
+// The listener is closed when ServeListener returns.
+func (k *Kite) ServeListener(l net.Listener) error {
+	err := k.serveListener(l)
+	if err != nil && isClosing(err) {
+		k.Log.Info("Kite server is closed.")
+		return nil
+	}
+
+	return err
+}
+
+// ServeListenerTLS is like ServeListener, but it serves TLS connections
+// with the certificate and key read from the given PEM encoded files.
+func (k *Kite) ServeListenerTLS(l net.Listener, certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		l.Close()
+		return err
+	}
+
+	if k.TLSConfig == nil {
+		k.TLSConfig = &tls.Config{}
+	}
+
+	k.TLSConfig.Certificates = append(k.TLSConfig.Certificates, cert)
+
+	return k.ServeListener(l)
+}
+
+// isClosing tells whether the error was returned by http.Serve
+// after the listener was closed by Close.
+func isClosing(err error) bool {
+	// An error string equivalent to net.errClosing for using with http.Serve()
+	// during a graceful exit. Needed to declare here again because it is not
+	// exported by "net" package.
+	const errClosing = "use of closed network connection"
+
+	return strings.Contains(err.Error(), errClosing)
+}
+
 // Close stops the server and the kontrol client instance.
+//
+// If Config.ShutdownGracePeriod is set, Close shuts down the kite
+// gracefully with Shutdown, waiting for in-flight method calls
+// at most for the grace period.
 func (k *Kite) Close() {
+	k.callsMu.Lock()
+	draining := k.draining
+	k.callsMu.Unlock()
+
+	if d := k.Config.ShutdownGracePeriod; d > 0 && !draining {
+		ctx, cancel := context.WithTimeout(context.Background(), d)
+		defer cancel()
+
+		if err := k.Shutdown(ctx); err != nil {
+			k.Log.Warning("Method calls not done within %s grace period", d)
+		}
+
+		return
+	}
+
+	k.close()
+}
+
+func (k *Kite) close() {
 	k.Log.Info("Closing kite...")
 
 	k.kontrol.Lock()
@@ -47,11 +115,18 @@ func (k *Kite) Close() {
 	}
 	k.kontrol.Unlock()
 
-	if k.listener != nil {
-		k.listener.Close()
-		k.listener = nil
+	k.listenerMu.Lock()
+	l := k.listener
+	k.listener = nil
+	k.listenerMu.Unlock()
+
+	if l != nil {
+		l.Close()
 	}
 
+	k.closeExtra()
+	k.stopSecrets()
+
 	k.mu.Lock()
 	cache := k.verifyCache
 	k.mu.Unlock()
@@ -61,37 +136,268 @@ func (k *Kite) Close() {
 	}
 }
 
+// Shutdown gracefully shuts down the kite. It stops accepting new
+// connections, waits for in-flight method calls to complete, deregisters
+// from Kontrol and closes all sessions. Method calls which timed out,
+// see (*Method).Timeout, are waited for until their handlers return.
+//
+// The connected kites are notified the kite is going away, so they
+// can reconnect, e.g. to another instance behind a load balancer,
+// once their calls are done, see (*Client).GoingAway.
+//
+// Method calls received during shutdown are rejected with
+// ErrShuttingDown error.
+//
+// If ctx expires before all method calls have completed, the kite
+// is closed anyway and the context's error is returned.
+func (k *Kite) Shutdown(ctx context.Context) error {
+	k.Log.Info("Shutting down kite...")
+
+	listeners := k.listeners()
+
+	for _, l := range listeners {
+		l.stopAccept()
+	}
+
+	k.callsMu.Lock()
+	k.draining = true
+	k.callsMu.Unlock()
+
+	k.notifyGoingAway()
+
+	done := make(chan struct{})
+
+	go func() {
+		k.calls.Wait()
+		close(done)
+	}()
+
+	var err error
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	// Heartbeats are stopped once the server is done serving,
+	// close disconnects from Kontrol.
+	k.deregister()
+	k.close()
+
+	// Close the sessions first, so the responses that are
+	// still being sent are flushed.
+	for _, c := range k.connectedClients() {
+		c.Close()
+	}
+
+	for _, l := range listeners {
+		l.connsMu.Lock()
+		l.closeConns()
+		l.connsMu.Unlock()
+	}
+
+	return err
+}
+
+// beginCall marks start of a method call. It returns false
+// if the kite is being shut down.
+func (k *Kite) beginCall() bool {
+	k.callsMu.Lock()
+	defer k.callsMu.Unlock()
+
+	if k.draining {
+		return false
+	}
+
+	k.calls.Add(1)
+
+	return true
+}
+
+// endCall marks end of a method call.
+func (k *Kite) endCall() {
+	k.calls.Done()
+}
+
+func (k *Kite) addClient(c *Client) {
+	k.clientsMu.Lock()
+	if k.clients == nil {
+		k.clients = make(map[*Client]struct{})
+	}
+	k.clients[c] = struct{}{}
+	k.clientsMu.Unlock()
+}
+
+func (k *Kite) removeClient(c *Client) {
+	k.clientsMu.Lock()
+	delete(k.clients, c)
+	k.clientsMu.Unlock()
+}
+
+func (k *Kite) connectedClients() []*Client {
+	k.clientsMu.Lock()
+	defer k.clientsMu.Unlock()
+
+	clients := make([]*Client, 0, len(k.clients))
+	for c := range k.clients {
+		clients = append(clients, c)
+	}
+
+	return clients
+}
+
 func (k *Kite) Addr() string {
 	return net.JoinHostPort(k.Config.IP, strconv.Itoa(k.Config.Port))
 }
 
+// listen listens on the TCP network address k.Addr() or on the Unix
+// domain socket if one is configured. The kite restarted with Restart
+// serves on the inherited listener instead.
+func (k *Kite) listen() (net.Listener, error) {
+	if k.restart != nil && k.restart.listener != nil {
+		l := k.restart.listener
+		k.restart.listener = nil
+		return l, nil
+	}
+
+	us := k.Config.UnixSocket
+	if us == nil || us.Path == "" {
+		return net.Listen("tcp4", k.Addr())
+	}
+
+	return listenUnix(us.Path, us.Mode)
+}
+
+// listenUnix listens on the Unix domain socket with the given path
+// and permissions, unless mode is 0.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	// Remove a stale socket left by a kite that was not closed.
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+		} else {
+			os.Remove(path)
+		}
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if mode != 0 {
+		if err := os.Chmod(path, mode); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+
+	return l, nil
+}
+
 // listenAndServe listens on the TCP network address k.URL.Host and then
 // calls Serve to handle requests on incoming connectionk.
 func (k *Kite) listenAndServe() error {
 	// create a new one if there doesn't exist
-	l, err := net.Listen("tcp4", k.Addr())
+	l, err := k.listen()
+	if err != nil {
+		return err
+	}
+
+	return k.serveListener(l)
+}
+
+// serveListener handles requests on incoming connections of l.
+func (k *Kite) serveListener(l net.Listener) error {
+	if err := k.LoadSecrets(); err != nil {
+		l.Close()
+		return err
+	}
+
+	allowed, err := parseIPNets(k.Config.AllowedIPs)
+	if err != nil {
+		l.Close()
+		return err
+	}
+
+	denied, err := parseIPNets(k.Config.DeniedIPs)
 	if err != nil {
+		l.Close()
 		return err
 	}
 
+	k.setIPFilter(allowed, denied, k.Config.MaxConnsPerIP)
+
+	if at := k.Config.AutoTLS; at != nil {
+		tlsConfig, err := k.autoTLSConfig(at)
+		if err != nil {
+			l.Close()
+			return err
+		}
+
+		k.reloadMu.Lock()
+		k.TLSConfig = tlsConfig
+		k.reloadMu.Unlock()
+	}
+
 	k.Log.Info("New listening: %s", l.Addr())
 
+	gl := newGracefulListener(l)
+
+	k.listenerMu.Lock()
+	k.listener = gl
+	k.listenerMu.Unlock()
+
+	// The TLS listener wraps the graceful one, so the server gets
+	// *tls.Conn connections and fills in http.Request.TLS, which
+	// is needed to authenticate with client certificates. Connections
+	// are filtered by IP addresses before the TLS handshake.
+	sl := k.newIPFilterListener(gl)
+
+	var tlsConfig *tls.Config
+
+	// Refreshed secrets clone TLSConfig under reloadMu.
+	k.reloadMu.Lock()
 	if k.TLSConfig != nil {
 		if k.TLSConfig.NextProtos == nil {
 			k.TLSConfig.NextProtos = []string{"http/1.1"}
 		}
-		l = tls.NewListener(l, k.TLSConfig)
+
+		// Serve the certificate reloaded with ReloadConfig, if any.
+		tlsConfig = k.TLSConfig
+		if tlsConfig.GetConfigForClient == nil {
+			tlsConfig = tlsConfig.Clone()
+			tlsConfig.GetConfigForClient = k.tlsConfigForClient
+		}
 	}
+	k.reloadMu.Unlock()
 
-	k.listener = newGracefulListener(l)
+	if tlsConfig != nil {
+		sl = tls.NewListener(sl, tlsConfig)
+	}
+
+	extra, err := k.listenExtra(tlsConfig)
+	if err != nil {
+		gl.Close()
+		return err
+	}
+
+	// Accept unencrypted HTTP/2 connections, used by gRPC transport.
+	h := h2c.NewHandler(k, &http2.Server{})
+
+	for _, l := range extra {
+		go k.serveExtra(l, h)
+	}
 
 	// listener is ready, notify waiters.
 	close(k.readyC)
+	k.notifyRestarted()
 
 	defer close(k.closeC) // serving is finished, notify waiters.
 	k.Log.Info("Serving...")
 
-	return k.serve(k.listener, k)
+	return k.serve(sl, h)
 }
 
 func (k *Kite) serve(l net.Listener, h http.Handler) error {
@@ -101,7 +407,8 @@ func (k *Kite) serve(l net.Listener, h http.Handler) error {
 	return http.Serve(l, h)
 }
 
-// Port returns the TCP port number that the kite listens.
+// Port returns the TCP port number that the kite listens, or 0 for kites
+// listening on a Unix domain socket.
 // Port must be called after the listener is initialized.
 // You can use ServerReadyNotify function to get notified when listener is ready.
 //
@@ -116,11 +423,17 @@ func (k *Kite) serve(l net.Listener, h http.Handler) error {
 //   port := k.Port()
 //
 func (k *Kite) Port() int {
-	if k.listener == nil {
+	l := k.mainListener()
+	if l == nil {
 		return 0
 	}
 
-	return k.listener.Addr().(*net.TCPAddr).Port
+	addr, ok := l.Addr().(*net.TCPAddr)
+	if !ok {
+		return 0
+	}
+
+	return addr.Port
 }
 
 func (k *Kite) UseTLS(certPEM, keyPEM string) {
@@ -163,8 +476,9 @@ func (k *Kite) ServerReadyNotify() chan bool {
 type gracefulListener struct {
 	net.Listener
 
-	conns   map[net.Conn]struct{}
-	connsMu sync.Mutex
+	conns    map[net.Conn]struct{}
+	draining bool // do not close conns on Close, see stopAccept
+	connsMu  sync.Mutex
 }
 
 func newGracefulListener(l net.Listener) *gracefulListener {
@@ -194,19 +508,37 @@ func (l *gracefulListener) Accept() (net.Conn, error) {
 	}, nil
 }
 
+// stopAccept closes the underlying listener, accepted connections
+// are left open till closeConns is called.
+func (l *gracefulListener) stopAccept() error {
+	l.connsMu.Lock()
+	l.draining = true
+	l.connsMu.Unlock()
+
+	return l.Listener.Close()
+}
+
 func (l *gracefulListener) Close() error {
 	err := l.Listener.Close()
 
 	l.connsMu.Lock()
-	for conn := range l.conns {
-		conn.Close()
+	if !l.draining {
+		l.closeConns()
 	}
-	l.conns = nil
 	l.connsMu.Unlock()
 
 	return err
 }
 
+// closeConns closes all accepted connections. The caller must
+// hold connsMu.
+func (l *gracefulListener) closeConns() {
+	for conn := range l.conns {
+		conn.Close()
+	}
+	l.conns = nil
+}
+
 type gracefulConn struct {
 	net.Conn
 
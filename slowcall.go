@@ -0,0 +1,103 @@
+package kite
+
+import (
+	"bytes"
+	"runtime"
+	"time"
+)
+
+const (
+	// maxSlowCallArgs is the number of bytes of the arguments
+	// logged for a slow call.
+	maxSlowCallArgs = 256
+
+	// maxStacksSize limits the size of the buffer the stacks
+	// of all goroutines are dumped to.
+	maxStacksSize = 16 << 20
+)
+
+// watchSlowCall samples the stack of the calling goroutine, which executes
+// the handlers of the request, once the call takes longer than
+// Config.SlowCallThreshold. The returned func must be called when
+// the handlers return, it logs the call if it was slow.
+func (r *Request) watchSlowCall() func() {
+	threshold := r.LocalKite.Config.SlowCallThreshold
+	if threshold <= 0 {
+		return func() {}
+	}
+
+	start := time.Now()
+	id := goroutineID()
+	sampled := make(chan []byte, 1)
+
+	t := time.AfterFunc(threshold, func() {
+		sampled <- goroutineStack(id)
+	})
+
+	return func() {
+		if t.Stop() {
+			return
+		}
+
+		WithFields(r.Logger(), "duration", time.Since(start), "args", r.argsSummary()).
+			Warning("Slow method call, handler stack:\n%s", <-sampled)
+	}
+}
+
+// argsSummary gives the arguments of the request encoded with JSON,
+// truncated to maxSlowCallArgs bytes.
+func (r *Request) argsSummary() string {
+	if r.Args == nil {
+		return ""
+	}
+
+	p, err := r.Args.MarshalJSON()
+	if err != nil {
+		return "<" + err.Error() + ">"
+	}
+
+	if len(p) > maxSlowCallArgs {
+		return string(p[:maxSlowCallArgs]) + "..."
+	}
+
+	return string(p)
+}
+
+// goroutineID gives the ID of the calling goroutine,
+// parsed from its stack trace header.
+func goroutineID() string {
+	var buf [64]byte
+	p := buf[:runtime.Stack(buf[:], false)]
+
+	p = bytes.TrimPrefix(p, []byte("goroutine "))
+	if i := bytes.IndexByte(p, ' '); i != -1 {
+		p = p[:i]
+	}
+
+	return string(p)
+}
+
+// goroutineStack gives the stack trace of the goroutine with the given ID,
+// or an empty one if the goroutine is not found.
+func goroutineStack(id string) []byte {
+	buf := make([]byte, 64*1024)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) || len(buf) >= maxStacksSize {
+			buf = buf[:n]
+			break
+		}
+
+		buf = make([]byte, 2*len(buf))
+	}
+
+	header := []byte("goroutine " + id + " [")
+
+	for _, stack := range bytes.Split(buf, []byte("\n\n")) {
+		if bytes.HasPrefix(stack, header) {
+			return stack
+		}
+	}
+
+	return nil
+}
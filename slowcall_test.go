@@ -0,0 +1,46 @@
+package kite
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/koding/kite/config"
+	"github.com/koding/kite/dnode"
+)
+
+func TestRequest_watchSlowCall(t *testing.T) {
+	rec := &recordLogger{}
+
+	r := &Request{
+		Method:    "square",
+		Args:      &dnode.Partial{Raw: []byte(`[2]`)},
+		LocalKite: &Kite{Log: rec, Config: &config.Config{SlowCallThreshold: 20 * time.Millisecond}},
+		Client:    &Client{},
+	}
+
+	r.watchSlowCall()()
+
+	if len(rec.msgs) != 0 {
+		t.Fatalf("got %q, want fast call not to be logged", rec.msgs)
+	}
+
+	done := r.watchSlowCall()
+	time.Sleep(50 * time.Millisecond)
+	done()
+
+	if len(rec.msgs) != 1 {
+		t.Fatalf("got %q, want slow call to be logged", rec.msgs)
+	}
+
+	for _, want := range []string{
+		"WARNING Slow method call",
+		"TestRequest_watchSlowCall", // the stack of the handler
+		"method=square",
+		"args=[2]",
+	} {
+		if !strings.Contains(rec.msgs[0], want) {
+			t.Errorf("got %q, want it to contain %q", rec.msgs[0], want)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package sockjsclient
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+var frameSeeds = []string{
+	"o",
+	"h",
+	`c[3000,"Go away!"]`,
+	`a["{\"method\":\"square\"}","msgpack:gqZtZXRob2Sm"]`,
+	`a[]`,
+	`m"message"`,
+	`m""`,
+	`a["\ud800"]`,
+	"x",
+	"",
+}
+
+func FuzzWebsocketFrame(f *testing.F) {
+	for _, seed := range frameSeeds {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		frameType, messages, err := parseFrame(buf)
+		if err != nil {
+			return
+		}
+
+		switch frameType {
+		case 'a', 'm':
+		case 'o', 'c', 'h':
+			if len(messages) != 0 {
+				t.Fatalf("got %d messages of %q frame", len(messages), frameType)
+			}
+		default:
+			t.Fatalf("unexpected frame type %q", frameType)
+		}
+	})
+}
+
+func FuzzXHRFrame(f *testing.F) {
+	for _, seed := range frameSeeds {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		x := &XHRSession{
+			timeout: time.Second,
+			maxSize: 1 << 16,
+			abort:   make(chan struct{}),
+		}
+
+		resp := &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(bytes.NewReader(data)),
+		}
+
+		msg, again, err := x.handleResp(resp)
+		if err != nil {
+			return
+		}
+
+		if again && msg != "" {
+			t.Fatalf("got message %q of a frame, which is polled again", msg)
+		}
+	})
+}
@@ -3,6 +3,7 @@ package sockjsclient
 // http://sockjs.github.io/sockjs-protocol/sockjs-protocol-0.3.3.html
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,6 +12,7 @@ import (
 	"net/url"
 	"path"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -80,6 +82,10 @@ type WebsocketSession struct {
 	mu    sync.Mutex
 	conn  *websocket.Conn
 	state sockjs.SessionState
+
+	// compressed is true if the connection uses
+	// the permessage-deflate extension.
+	compressed bool
 }
 
 var _ sockjs.Session = (*WebsocketSession)(nil)
@@ -148,13 +154,33 @@ func DialWebsocket(uri string, cfg *config.Config) (*WebsocketSession, error) {
 
 	u = makeWebsocketURL(u, serverID, sessionID)
 
-	conn, _, err := cfg.Websocket.Dial(u.String(), h)
+	dialer := cfg.Websocket
+	if cfg.Compression.Algorithm != "" {
+		d := *dialer
+		d.EnableCompression = true
+		dialer = &d
+	}
+
+	conn, resp, err := dialer.Dial(u.String(), h)
 	if err != nil {
 		return nil, err
 	}
 
+	if cfg.MaxResponseSize > 0 {
+		conn.SetReadLimit(cfg.MaxResponseSize)
+	}
+
 	session := NewWebsocketSession(conn)
 	session.id = sessionID
+	session.compressed = strings.Contains(resp.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate")
+
+	// The level of other algorithms does not apply to deflate.
+	if session.compressed && cfg.Compression.Algorithm == "deflate" && cfg.Compression.Level != 0 {
+		if err := conn.SetCompressionLevel(cfg.Compression.Level); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
 	session.req = &http.Request{
 		URL:    u,
 		Header: h,
@@ -194,6 +220,12 @@ func (w *WebsocketSession) ID() string {
 	return w.id
 }
 
+// Compressed tells whether messages are compressed by
+// the permessage-deflate extension of the connection.
+func (w *WebsocketSession) Compressed() bool {
+	return w.compressed
+}
+
 // Recv reads one text frame from session.
 func (w *WebsocketSession) Recv() (string, error) {
 	// Return previously received messages if there is any.
@@ -214,41 +246,25 @@ read_frame:
 		return "", err
 	}
 
-	if len(buf) == 0 {
-		return "", errors.New("unexpected empty message")
+	frameType, messages, err := parseFrame(buf)
+	if err != nil {
+		return "", err
 	}
 
-	frameType := buf[0]
-	data := buf[1:]
-
 	switch frameType {
 	case 'o':
 		w.setState(sockjs.SessionActive)
 		goto read_frame
-	case 'a':
-		var messages []string
-		err = json.Unmarshal(data, &messages)
-		if err != nil {
-			return "", err
-		}
-		w.messages = append(w.messages, messages...)
-	case 'm':
-		var message string
-		err = json.Unmarshal(data, &message)
-		if err != nil {
-			return "", err
-		}
-		w.messages = append(w.messages, message)
 	case 'c':
 		w.setState(sockjs.SessionClosed)
 		return "", ErrSessionClosed
 	case 'h':
 		// TODO handle heartbeat
 		goto read_frame
-	default:
-		return "", errors.New("invalid frame type")
 	}
 
+	w.messages = append(w.messages, messages...)
+
 	// Return first message in slice.
 	if len(w.messages) == 0 {
 		return "", errors.New("no message")
@@ -258,17 +274,73 @@ read_frame:
 	return msg, nil
 }
 
+// parseFrame parses a SockJS frame, giving its type and the messages
+// of the 'a' and 'm' frames.
+func parseFrame(buf []byte) (frameType byte, messages []string, err error) {
+	if len(buf) == 0 {
+		return 0, nil, errors.New("unexpected empty message")
+	}
+
+	frameType, data := buf[0], buf[1:]
+
+	switch frameType {
+	case 'o', 'c', 'h':
+		return frameType, nil, nil
+	case 'a':
+		if err := json.Unmarshal(data, &messages); err != nil {
+			return 0, nil, err
+		}
+	case 'm':
+		var message string
+		if err := json.Unmarshal(data, &message); err != nil {
+			return 0, nil, err
+		}
+		messages = []string{message}
+	default:
+		return 0, nil, errors.New("invalid frame type")
+	}
+
+	return frameType, messages, nil
+}
+
 // Send sends one text frame to session
 func (w *WebsocketSession) Send(str string) error {
 	if atomic.LoadInt32(&w.closed) == 1 {
 		return ErrSessionClosed
 	}
 
+	buf := getBuffer()
+	defer putBuffer(buf)
+
+	buf.WriteByte('[')
+	json.NewEncoder(buf).Encode(str)
+
+	// Replace the newline Encode terminates the string with.
+	buf.Truncate(buf.Len() - 1)
+	buf.WriteByte(']')
+
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	b, _ := json.Marshal([]string{str})
-	return w.conn.WriteMessage(websocket.TextMessage, b)
+	return w.conn.WriteMessage(websocket.TextMessage, buf.Bytes())
+}
+
+// bufferPool reuses the buffers frames are encoded in. Buffers bigger
+// than 64KiB are not reused, so the pool does not hold on to lots of
+// memory after occasional big messages.
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+func getBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() <= 64*1024 {
+		buf.Reset()
+		bufferPool.Put(buf)
+	}
 }
 
 // Close closes the session with provided code and reason.
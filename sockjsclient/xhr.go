@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
@@ -25,6 +26,10 @@ import (
 // After the session is opened, the error makes the poller retry polling.
 var ErrPollTimeout = errors.New("polling on XHR response has timed out")
 
+// ErrFrameTooLarge is returned when a frame received from the server
+// exceeds the limit set with config.Config.MaxResponseSize.
+var ErrFrameTooLarge = errors.New("frame exceeds the size limit")
+
 var errAborted = errors.New("session aborted by server")
 
 // XHRSession implements sockjs.Session with XHR transport.
@@ -33,7 +38,9 @@ type XHRSession struct {
 
 	client     *http.Client
 	timeout    time.Duration
+	maxSize    int64
 	sessionURL string
+	query      string // query of the dialed URL, sent with every request
 	sessionID  string
 	messages   []string
 	abort      chan struct{}
@@ -50,10 +57,17 @@ func DialXHR(uri string, cfg *config.Config) (*XHRSession, error) {
 	// following /server_id/session_id should always be the same for every session
 	serverID := threeDigits()
 	sessionID := utils.RandomString(20)
+
+	// The query of the URL, if any, is sent with every request.
+	var query string
+	if i := strings.IndexByte(uri, '?'); i != -1 {
+		uri, query = uri[:i], uri[i:]
+	}
+
 	sessionURL := uri + "/" + serverID + "/" + sessionID
 
 	// start the initial session handshake
-	sessionResp, err := cfg.XHR.Post(sessionURL+"/xhr", "text/plain", nil)
+	sessionResp, err := cfg.XHR.Post(sessionURL+"/xhr"+query, "text/plain", nil)
 	if err != nil {
 		return nil, err
 	}
@@ -76,8 +90,10 @@ func DialXHR(uri string, cfg *config.Config) (*XHRSession, error) {
 	return &XHRSession{
 		client:     cfg.XHR,
 		timeout:    cfg.Timeout,
+		maxSize:    cfg.MaxResponseSize,
 		sessionID:  sessionID,
 		sessionURL: sessionURL,
+		query:      query,
 		state:      sockjs.SessionActive,
 		abort:      make(chan struct{}, 1),
 	}, nil
@@ -117,7 +133,7 @@ func (x *XHRSession) Recv() (string, error) {
 
 	// start to poll from the server until we receive something
 	for {
-		req, err := http.NewRequest("POST", x.sessionURL+"/xhr", nil)
+		req, err := http.NewRequest("POST", x.sessionURL+"/xhr"+x.query, nil)
 		if err != nil {
 			return "", errors.New("invalid session url: " + err.Error())
 		}
@@ -190,7 +206,12 @@ func (x *XHRSession) handleResp(resp *http.Response) (msg string, again bool, er
 		return "", false, fmt.Errorf("Receiving data failed. Want: 200 Got: %d", resp.StatusCode)
 	}
 
-	fr := newFrameReader(resp.Body, x.timeout)
+	body := io.Reader(resp.Body)
+	if x.maxSize > 0 {
+		body = &limitReader{r: body, n: x.maxSize}
+	}
+
+	fr := newFrameReader(body, x.timeout)
 
 	frame, err := fr.ReadByte()
 	if err == ErrPollTimeout {
@@ -270,7 +291,7 @@ func (x *XHRSession) Send(frame string) error {
 		return err
 	}
 
-	resp, err := x.client.Post(x.sessionURL+"/xhr_send", "text/plain", bytes.NewReader(body))
+	resp, err := x.client.Post(x.sessionURL+"/xhr_send"+x.query, "text/plain", bytes.NewReader(body))
 	if err != nil {
 		return err
 	}
@@ -393,3 +414,30 @@ func (fr *frameReader) readFrame() {
 		fr.err = ErrPollTimeout
 	}
 }
+
+// limitReader reads from r up to n bytes, failing with ErrFrameTooLarge
+// when there are more.
+type limitReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		return 0, ErrFrameTooLarge
+	}
+
+	// Read one byte past the limit to tell whether there are more.
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+
+	if l.n < 0 {
+		return n, ErrFrameTooLarge
+	}
+
+	return n, err
+}
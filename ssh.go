@@ -0,0 +1,285 @@
+package kite
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/koding/kite/config"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sshScheme is the scheme of URLs of kites reached through
+// an SSH jump host, e.g. kite+ssh://user@bastion/10.0.0.5:3636/kite.
+const sshScheme = "kite+ssh"
+
+// sshConfig gives the URL and a copy of the config, which are used for
+// connecting to a kite through the SSH jump host given by the kite+ssh
+// URL. The first element of the URL path is the address of the kite
+// as seen from the jump host, the rest is the path of the kite, which
+// is /kite if empty.
+//
+// The kite is reached with regular HTTP requests, which are tunneled
+// over an SSH connection to the jump host. The SSH connection is shared
+// by the connections made with the config and closed once they all are.
+func sshConfig(u *url.URL, cfg *config.Config) (string, *config.Config, error) {
+	kiteURL, err := sshKiteURL(u)
+	if err != nil {
+		return "", nil, err
+	}
+
+	clientConfig, err := sshClientConfig(u, cfg)
+	if err != nil {
+		return "", nil, err
+	}
+
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "22")
+	}
+
+	d := &sshDialer{
+		addr:   addr,
+		config: clientConfig,
+	}
+
+	cfg = cfg.Copy()
+
+	if cfg.Websocket != nil {
+		cfg.Websocket.NetDial = nil
+		cfg.Websocket.NetDialContext = d.DialContext
+		cfg.Websocket.Proxy = nil
+	}
+
+	if cfg.XHR != nil {
+		cfg.XHR.Transport = &http.Transport{DialContext: d.DialContext}
+	}
+
+	return kiteURL.String(), cfg, nil
+}
+
+// sshKiteURL gives the URL of the kite behind the jump host.
+func sshKiteURL(u *url.URL) (*url.URL, error) {
+	if u.Host == "" {
+		return nil, errors.New("kite: missing SSH jump host in " + u.Redacted())
+	}
+
+	target := strings.SplitN(strings.TrimPrefix(u.Path, "/"), "/", 2)
+
+	if _, _, err := net.SplitHostPort(target[0]); err != nil {
+		return nil, errors.New("kite: invalid kite address in " + u.Redacted() + ": " + err.Error())
+	}
+
+	kiteURL := &url.URL{
+		Scheme:   "http",
+		Host:     target[0],
+		Path:     "/kite",
+		RawQuery: u.RawQuery,
+	}
+
+	if len(target) == 2 && target[1] != "" {
+		kiteURL.Path = "/" + target[1]
+	}
+
+	return kiteURL, nil
+}
+
+// sshClientConfig gives the configuration of the SSH client, which is
+// Config.SSH with the user and password of the URL, if any. Host keys are
+// verified against ~/.ssh/known_hosts if Config.SSH does not verify them.
+func sshClientConfig(u *url.URL, cfg *config.Config) (*ssh.ClientConfig, error) {
+	var c ssh.ClientConfig
+
+	if cfg.SSH != nil {
+		c = *cfg.SSH
+	}
+
+	if u.User != nil {
+		c.User = u.User.Username()
+
+		if password, ok := u.User.Password(); ok {
+			c.Auth = append([]ssh.AuthMethod{ssh.Password(password)}, c.Auth...)
+		}
+	}
+
+	if c.User == "" {
+		return nil, errors.New("kite: missing SSH user in " + u.Redacted())
+	}
+
+	if c.HostKeyCallback == nil {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+
+		if c.HostKeyCallback, err = knownhosts.New(filepath.Join(home, ".ssh", "known_hosts")); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.Timeout == 0 {
+		c.Timeout = cfg.Timeout
+	}
+
+	return &c, nil
+}
+
+// sshDialer dials addresses through the SSH jump host, the SSH
+// connection is made on the first dial and closed once all
+// the dialed connections are closed.
+type sshDialer struct {
+	addr   string
+	config *ssh.ClientConfig
+
+	mu     sync.Mutex
+	client *ssh.Client
+	conns  int
+}
+
+func (d *sshDialer) DialContext(ctx context.Context, _, addr string) (net.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.client == nil {
+		client, err := d.dial(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		d.client = client
+	}
+
+	conn, err := d.client.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		if d.conns == 0 {
+			d.client.Close()
+			d.client = nil
+		}
+
+		return nil, err
+	}
+
+	d.conns++
+
+	return &sshConn{Conn: conn, d: d}, nil
+}
+
+// dial connects to the jump host. If no authentication methods are
+// configured, the keys of the SSH agent are used.
+func (d *sshDialer) dial(ctx context.Context) (*ssh.Client, error) {
+	cfg := *d.config
+
+	if len(cfg.Auth) == 0 {
+		sock := os.Getenv("SSH_AUTH_SOCK")
+		if sock == "" {
+			return nil, errors.New("kite: no SSH authentication methods configured and SSH_AUTH_SOCK is not set")
+		}
+
+		conn, err := net.Dial("unix", sock)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+
+		cfg.Auth = []ssh.AuthMethod{ssh.PublicKeysCallback(agent.NewClient(conn).Signers)}
+	}
+
+	var nd net.Dialer
+
+	conn, err := nd.DialContext(ctx, "tcp", d.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok && cfg.Timeout > 0 {
+		deadline = time.Now().Add(cfg.Timeout)
+	}
+
+	conn.SetDeadline(deadline)
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, d.addr, &cfg)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+func (d *sshDialer) release() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.conns--; d.conns == 0 && d.client != nil {
+		d.client.Close()
+		d.client = nil
+	}
+}
+
+// sshConn is a connection tunneled over the SSH connection of d.
+//
+// SSH channels do not support deadlines, the connection
+// is closed once any of its deadlines passes instead.
+type sshConn struct {
+	net.Conn
+	d    *sshDialer
+	once sync.Once
+
+	mu         sync.Mutex
+	readTimer  *time.Timer
+	writeTimer *time.Timer
+}
+
+func (c *sshConn) Close() error {
+	err := c.Conn.Close()
+
+	c.once.Do(func() {
+		c.SetDeadline(time.Time{})
+		c.d.release()
+	})
+
+	return err
+}
+
+func (c *sshConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	c.SetWriteDeadline(t)
+	return nil
+}
+
+func (c *sshConn) SetReadDeadline(t time.Time) error {
+	c.setTimer(&c.readTimer, t)
+	return nil
+}
+
+func (c *sshConn) SetWriteDeadline(t time.Time) error {
+	c.setTimer(&c.writeTimer, t)
+	return nil
+}
+
+func (c *sshConn) setTimer(timer **time.Timer, t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if *timer != nil {
+		(*timer).Stop()
+		*timer = nil
+	}
+
+	if !t.IsZero() {
+		*timer = time.AfterFunc(time.Until(t), func() { c.Close() })
+	}
+}
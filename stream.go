@@ -0,0 +1,411 @@
+package kite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"sync"
+
+	"github.com/koding/kite/dnode"
+	"github.com/koding/kite/utils"
+)
+
+const (
+	// streamChunkSize is the max size of a single chunk sent
+	// over a stream callback.
+	streamChunkSize = 32 * 1024
+
+	// streamWindow is the number of chunks that can be sent
+	// without being acknowledged by the receiving side.
+	streamWindow = 8
+)
+
+// errStreamCanceled is returned by the stream sender when the
+// receiving side has canceled the stream.
+var errStreamCanceled = errors.New("stream canceled by the receiver")
+
+// errStreamOverflow is returned by TellStream when the sender sent more
+// chunks than it may send ahead of the acknowledgements.
+var errStreamOverflow = errors.New("too many out of order stream chunks")
+
+// Stream is a pipe that can be returned by a handler in order to
+// send the response in chunks, as it is being produced.
+//
+// The handler is expected to write to the stream in a separate
+// goroutine and close it once done, e.g.:
+//
+//	k.HandleFunc("tail", func(r *kite.Request) (interface{}, error) {
+//	    s := kite.NewStream()
+//
+//	    go func() {
+//	        _, err := io.Copy(s, logFile)
+//	        s.CloseWithError(err)
+//	    }()
+//
+//	    return s, nil
+//	})
+//
+// A handler may return any io.Reader as well, the reader is going
+// to be streamed till EOF and closed afterwards if it implements
+// io.Closer.
+//
+// A caller receives the data with (*Client).TellStream. If the caller
+// does not support streaming, the whole reader is read into memory
+// and sent as a single []byte result, which fails if it exceeds
+// Config.MaxResponseSize.
+type Stream struct {
+	r *io.PipeReader
+	w *io.PipeWriter
+
+	// done is closed once the stream is closed, either by the handler
+	// or after it was sent, e.g. when the caller went away.
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+var (
+	_ io.Reader      = (*Stream)(nil)
+	_ io.WriteCloser = (*Stream)(nil)
+)
+
+// NewStream gives new stream value.
+func NewStream() *Stream {
+	r, w := io.Pipe()
+
+	return &Stream{
+		r:    r,
+		w:    w,
+		done: make(chan struct{}),
+	}
+}
+
+// Read implements the io.Reader interface.
+func (s *Stream) Read(p []byte) (int, error) {
+	return s.r.Read(p)
+}
+
+// Write implements the io.Writer interface. It blocks until
+// the data is consumed by the stream sender. If the stream
+// is canceled by the caller, Write returns non-nil error.
+func (s *Stream) Write(p []byte) (int, error) {
+	return s.w.Write(p)
+}
+
+// Close ends the stream.
+func (s *Stream) Close() error {
+	s.closeDone()
+	return s.w.Close()
+}
+
+// CloseWithError ends the stream with the given error. The error
+// is sent back to the caller. If err is nil, it behaves like Close.
+func (s *Stream) CloseWithError(err error) error {
+	s.closeDone()
+	return s.w.CloseWithError(err)
+}
+
+func (s *Stream) closeDone() {
+	s.doneOnce.Do(func() { close(s.done) })
+}
+
+// StreamResult is the result of a method call which response
+// was streamed.
+type StreamResult struct {
+	// Size is the total number of bytes sent.
+	Size int64 `json:"size"`
+}
+
+// streamChunk is the argument of a stream callback.
+type streamChunk struct {
+	ID   string `json:"id"`
+	Seq  int    `json:"seq"`
+	Data []byte `json:"data"`
+}
+
+// streamAck is the argument of the kite.streamAck method.
+type streamAck struct {
+	ID     string `json:"id"`
+	Cancel bool   `json:"cancel,omitempty"`
+}
+
+// stream is a sender-side state of a single stream.
+type stream struct {
+	acks   chan struct{}
+	cancel chan struct{}
+	once   sync.Once
+}
+
+func (s *stream) ack() {
+	select {
+	case s.acks <- struct{}{}:
+	default:
+	}
+}
+
+func (s *stream) close() {
+	s.once.Do(func() { close(s.cancel) })
+}
+
+// wait blocks until a chunk can be sent.
+func (s *stream) wait(r *Request) error {
+	select {
+	case <-s.acks:
+		return nil
+	case <-s.cancel:
+		return errStreamCanceled
+	case <-r.Ctx().Done():
+		return r.Ctx().Err()
+	}
+}
+
+// sendStream reads from rd and calls the stream callback of the request
+// with consecutive chunks till EOF. It does not read more than
+// streamWindow chunks ahead of the acknowledgements received from the
+// caller, which must have sent a stream callback.
+func (c *Client) sendStream(r *Request, rd io.Reader) (interface{}, error) {
+	defer closeReader(rd)
+
+	s := &stream{
+		acks:   make(chan struct{}, streamWindow),
+		cancel: make(chan struct{}),
+	}
+
+	for i := 0; i < streamWindow; i++ {
+		s.acks <- struct{}{}
+	}
+
+	id := utils.RandomString(16)
+
+	c.addStream(id, s)
+	defer c.removeStream(id)
+
+	var (
+		res StreamResult
+		seq int
+		p   = make([]byte, streamChunkSize)
+	)
+
+	for {
+		if err := s.wait(r); err != nil {
+			return nil, err
+		}
+
+		n, err := rd.Read(p)
+		if n > 0 {
+			chunk := &streamChunk{
+				ID:   id,
+				Seq:  seq,
+				Data: p[:n],
+			}
+
+			if e := r.stream.Call(chunk); e != nil {
+				return nil, e
+			}
+
+			res.Size += int64(n)
+			seq++
+		} else {
+			// Nothing was sent, give the credit back.
+			s.ack()
+		}
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Wait for all the chunks to be acknowledged, so the caller
+	// receives the response after all the data was written.
+	for i := 0; i < streamWindow; i++ {
+		if err := s.wait(r); err != nil {
+			return nil, err
+		}
+	}
+
+	return &res, nil
+}
+
+// readResponse reads the whole rd for the callers, which did not send
+// a stream callback, and returns it as []byte. The response fails if it
+// exceeds Config.MaxResponseSize, the largest one the caller accepts.
+func (c *Client) readResponse(rd io.Reader) (interface{}, error) {
+	defer closeReader(rd)
+
+	limit := c.config().MaxResponseSize
+	if limit <= 0 {
+		return ioutil.ReadAll(rd)
+	}
+
+	p, err := ioutil.ReadAll(io.LimitReader(rd, limit+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(p)) > limit {
+		return nil, &MessageTooLargeError{Limit: limit}
+	}
+
+	return p, nil
+}
+
+// closeReader closes the reader returned by a handler, once it was sent.
+func closeReader(rd io.Reader) {
+	switch v := rd.(type) {
+	case *Stream:
+		// Unblock writers of the stream.
+		v.r.Close()
+		v.closeDone()
+	case io.Closer:
+		v.Close()
+	}
+}
+
+func (c *Client) addStream(id string, s *stream) {
+	c.streamsMu.Lock()
+	if c.streams == nil {
+		c.streams = make(map[string]*stream)
+	}
+	c.streams[id] = s
+	c.streamsMu.Unlock()
+}
+
+func (c *Client) removeStream(id string) {
+	c.streamsMu.Lock()
+	delete(c.streams, id)
+	c.streamsMu.Unlock()
+}
+
+func (c *Client) getStream(id string) *stream {
+	c.streamsMu.Lock()
+	defer c.streamsMu.Unlock()
+
+	return c.streams[id]
+}
+
+// handleStreamAck acknowledges or cancels a stream that is being sent
+// over the current session.
+func handleStreamAck(r *Request) (interface{}, error) {
+	var ack streamAck
+
+	if err := r.Args.One().Unmarshal(&ack); err != nil {
+		return nil, err
+	}
+
+	s := r.Client.getStream(ack.ID)
+	if s == nil {
+		return nil, fmt.Errorf("stream %q not found", ack.ID)
+	}
+
+	if ack.Cancel {
+		s.close()
+	} else {
+		s.ack()
+	}
+
+	return nil, nil
+}
+
+// TellStream makes a blocking method call to the server, which response
+// is streamed. The received data is written to w in order. The returned
+// result is the final response, which for streamed responses
+// is a StreamResult value.
+//
+// If writing to w fails, the stream is canceled and the write error
+// is returned. The stream fails as well if more chunks than the sender
+// may send ahead of acknowledgements arrive out of order.
+func (c *Client) TellStream(method string, w io.Writer, args ...interface{}) (result *dnode.Partial, err error) {
+	var (
+		mu       sync.Mutex
+		next     int
+		pending  = make(map[int][]byte)
+		writeErr error
+	)
+
+	streamCallback := dnode.Callback(func(arg *dnode.Partial) {
+		var chunk streamChunk
+
+		if err := arg.One().Unmarshal(&chunk); err != nil {
+			c.LocalKite.Log.Error("invalid stream chunk: %s", err)
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		if writeErr != nil {
+			return
+		}
+
+		// Callbacks may get executed concurrently, ensure
+		// chunks are written in order. The sender does not send
+		// more than streamWindow chunks ahead of the acks, so
+		// there are never more of them pending.
+		if chunk.Seq < next {
+			return
+		}
+
+		pending[chunk.Seq] = chunk.Data
+
+		if len(pending) > streamWindow {
+			writeErr = errStreamOverflow
+			c.Go("kite.streamAck", &streamAck{ID: chunk.ID, Cancel: true})
+			return
+		}
+
+		for {
+			p, ok := pending[next]
+			if !ok {
+				break
+			}
+
+			delete(pending, next)
+			next++
+
+			if _, err := w.Write(p); err != nil {
+				writeErr = err
+				c.Go("kite.streamAck", &streamAck{ID: chunk.ID, Cancel: true})
+				return
+			}
+
+			c.Go("kite.streamAck", &streamAck{ID: chunk.ID})
+		}
+	})
+
+	responseChan := make(chan *response, 1)
+
+	c.sendMethod(context.Background(), method, args, 0, callOptions{StreamCallback: streamCallback}, responseChan)
+
+	resp := <-responseChan
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if writeErr != nil {
+		return nil, writeErr
+	}
+
+	return resp.Result, resp.Err
+}
+
+// callbackID looks up an ID of the named callback, that was sent
+// as a field of call options.
+func callbackID(callbacks map[string]dnode.Path, name string) (uint64, bool) {
+	for id, path := range callbacks {
+		if len(path) != 2 || fmt.Sprint(path[0]) != "0" || fmt.Sprint(path[1]) != name {
+			continue
+		}
+
+		if n, err := strconv.ParseUint(id, 10, 64); err == nil {
+			return n, true
+		}
+	}
+
+	return 0, false
+}
@@ -2,6 +2,7 @@
 package testutil
 
 import (
+	"flag"
 	"os"
 	"testing"
 	"time"
@@ -61,28 +62,20 @@ func NewToken(username, private, public string) *jwt.Token {
 		KontrolURL: "http://localhost:4000/kite",
 	}
 
-	token := jwt.NewWithClaims(jwt.GetSigningMethod("RS256"), claims)
-
-	rsaPrivate, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(private))
-	if err != nil {
-		panic(err)
-	}
-
-	token.Raw, err = token.SignedString(rsaPrivate)
+	signed, err := kitekey.Sign(claims, private)
 	if err != nil {
 		panic(err)
 	}
 
 	// verify the token
-	_, err = jwt.ParseWithClaims(token.Raw, claims, func(*jwt.Token) (interface{}, error) {
-		return jwt.ParseRSAPublicKeyFromPEM([]byte(public))
+	token, err := jwt.ParseWithClaims(signed, claims, func(*jwt.Token) (interface{}, error) {
+		return kitekey.ParsePublicKey(public)
 	})
 
 	if err != nil {
 		panic(err)
 	}
 
-	token.Valid = true
 	return token
 
 }
@@ -111,7 +104,7 @@ type quietHandler struct {
 }
 
 func (h *quietHandler) Handle(rec *logging.Record) {
-	if testing.Verbose() {
+	if flag.Parsed() && testing.Verbose() {
 		h.Handler.Handle(rec)
 	}
 }
@@ -0,0 +1,250 @@
+package kite
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/juju/ratelimit"
+)
+
+// RateLimiter keeps token buckets used for throttling methods,
+// see Kite.RateLimiter.
+type RateLimiter interface {
+	// Take takes a single token from the bucket of the key. The bucket
+	// starts full, with capacity tokens, and is refilled with a token
+	// every fillInterval. Take returns false if the bucket is empty.
+	Take(ctx context.Context, key string, fillInterval time.Duration, capacity int64) (bool, error)
+}
+
+// take takes a token from each bucket of the method. It returns false
+// if any of them is empty.
+func (m *Method) take(r *Request) bool {
+	// The bucket may be replaced with ReloadConfig.
+	t := m.getThrottle()
+	kb := m.handlerChain(r.LocalKite).keyedBucket
+
+	rl := r.LocalKite.RateLimiter
+	if rl == nil {
+		return (t == nil || t.bucket.TakeAvailable(1) != 0) &&
+			(kb == nil || kb.take(r))
+	}
+
+	if t != nil && !takeToken(rl, r, m.rateLimitKey(r.LocalKite), t.fillInterval, t.capacity) {
+		return false
+	}
+
+	if kb != nil {
+		key := m.rateLimitKey(r.LocalKite) + ":" + kb.key(r)
+
+		if !takeToken(rl, r, key, kb.fillInterval, kb.capacity) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// rateLimitKey gives the key of the method's bucket kept by the RateLimiter,
+// which is the same for all replicas of the kite.
+func (m *Method) rateLimitKey(k *Kite) string {
+	kite := k.Kite()
+	return "kite:/" + kite.Username + "/" + kite.Environment + "/" + kite.Name + ":" + m.name
+}
+
+// takeToken takes a token with the RateLimiter, allowing the call
+// if the RateLimiter fails.
+func takeToken(rl RateLimiter, r *Request, key string, fillInterval time.Duration, capacity int64) bool {
+	ok, err := rl.Take(r.Ctx(), key, fillInterval, capacity)
+	if err != nil {
+		r.Logger().Warning("rate limiter: %s", err)
+		return true
+	}
+
+	return ok
+}
+
+// maxKeyedBuckets is the maximum number of buckets kept by a keyedBucket.
+const maxKeyedBuckets = 100000
+
+// keyedBucket maintains a token bucket per key. Buckets that have not
+// been used for longer than it takes to fill them up are evicted, as
+// such buckets are no different from newly created ones.
+//
+// At most maxBuckets buckets are kept, so callers choosing the keys
+// can not grow them without limit. Once there are that many buckets
+// in use, requests with other keys are throttled.
+type keyedBucket struct {
+	key          func(*Request) string
+	fillInterval time.Duration
+	capacity     int64
+	ttl          time.Duration
+	maxBuckets   int
+
+	mu        sync.Mutex
+	buckets   map[string]*keyedBucketEntry
+	lastSweep time.Time
+}
+
+type keyedBucketEntry struct {
+	bucket   *ratelimit.Bucket
+	lastUsed time.Time
+}
+
+func newKeyedBucket(key func(*Request) string, fillInterval time.Duration, capacity int64) *keyedBucket {
+	return &keyedBucket{
+		key:          key,
+		fillInterval: fillInterval,
+		capacity:     capacity,
+		ttl:          fillInterval * time.Duration(capacity),
+		maxBuckets:   maxKeyedBuckets,
+		buckets:      make(map[string]*keyedBucketEntry),
+		lastSweep:    time.Now(),
+	}
+}
+
+// take takes a single token from the bucket of the request's key.
+// It returns false if the bucket is empty.
+func (kb *keyedBucket) take(r *Request) bool {
+	key := kb.key(r)
+	now := time.Now()
+
+	kb.mu.Lock()
+	defer kb.mu.Unlock()
+
+	if now.Sub(kb.lastSweep) > kb.ttl {
+		kb.sweep(now)
+	}
+
+	e, ok := kb.buckets[key]
+	if !ok {
+		if len(kb.buckets) >= kb.maxBuckets {
+			kb.sweep(now)
+		}
+
+		if len(kb.buckets) >= kb.maxBuckets {
+			return false
+		}
+
+		e = &keyedBucketEntry{
+			bucket: ratelimit.NewBucket(kb.fillInterval, kb.capacity),
+		}
+		kb.buckets[key] = e
+	}
+
+	e.lastUsed = now
+
+	return e.bucket.TakeAvailable(1) != 0
+}
+
+// sweep evicts unused buckets. The caller must hold kb.mu.
+func (kb *keyedBucket) sweep(now time.Time) {
+	for key, e := range kb.buckets {
+		if now.Sub(e.lastUsed) > kb.ttl {
+			delete(kb.buckets, key)
+		}
+	}
+
+	kb.lastSweep = now
+}
+
+// limiter bounds the number of calls executed at once.
+type limiter struct {
+	slots     chan struct{}
+	maxQueued int32
+	queued    int32 // accessed atomically
+}
+
+func newLimiter(maxConcurrent, maxQueued int) *limiter {
+	return &limiter{
+		slots:     make(chan struct{}, maxConcurrent),
+		maxQueued: int32(maxQueued),
+	}
+}
+
+// acquire takes a slot for a call, waiting for one if the call
+// can be queued.
+func (l *limiter) acquire(ctx context.Context) (*slot, error) {
+	select {
+	case l.slots <- struct{}{}:
+		return &slot{l: l, refs: 1}, nil
+	default:
+	}
+
+	if atomic.AddInt32(&l.queued, 1) > l.maxQueued {
+		atomic.AddInt32(&l.queued, -1)
+
+		err := *ErrOverloaded
+		return nil, &err
+	}
+	defer atomic.AddInt32(&l.queued, -1)
+
+	select {
+	case l.slots <- struct{}{}:
+		return &slot{l: l, refs: 1}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (l *limiter) release() {
+	<-l.slots
+}
+
+// slot is a limiter slot taken by a call. It is given back to the
+// limiter once the call and the handlers it runs have all released it.
+type slot struct {
+	l    *limiter
+	refs int32 // accessed atomically
+}
+
+// hold keeps the slot taken until the matching release.
+func (s *slot) hold() {
+	if s != nil {
+		atomic.AddInt32(&s.refs, 1)
+	}
+}
+
+func (s *slot) release() {
+	if s != nil && atomic.AddInt32(&s.refs, -1) == 0 {
+		s.l.release()
+	}
+}
+
+// ThrottleByUsername is a key func for ThrottleBy that throttles
+// requests per username of the caller.
+func ThrottleByUsername(r *Request) string {
+	return r.Username
+}
+
+// ThrottleByKiteID is a key func for ThrottleBy that throttles
+// requests per ID of the calling kite, as authenticated by its
+// credentials, see Request.KiteID. Requests authenticated without
+// a kite ID are throttled per username of the caller.
+func ThrottleByKiteID(r *Request) string {
+	if r.KiteID != "" {
+		return r.KiteID
+	}
+
+	return r.Username
+}
+
+// ThrottleByRemoteIP is a key func for ThrottleBy that throttles
+// requests per IP address of the caller.
+func ThrottleByRemoteIP(r *Request) string {
+	addr := r.Client.RemoteAddr()
+
+	if addr == "" {
+		if session := r.Client.getSession(); session != nil && session.Request() != nil {
+			addr = session.Request().RemoteAddr
+		}
+	}
+
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+
+	return addr
+}
@@ -0,0 +1,204 @@
+package kite
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/koding/kite/config"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// RequireClientCert makes the kite accept only TLS connections from
+// clients presenting a certificate signed by one of the given PEM encoded
+// CA certificates. The server certificate must be set with UseTLS.
+//
+// Requests that carry no authentication information are authenticated
+// with the client certificate, see AuthenticateFromCert.
+func (k *Kite) RequireClientCert(caPEM string) {
+	if k.TLSConfig == nil {
+		k.TLSConfig = &tls.Config{}
+	}
+
+	if k.TLSConfig.ClientCAs == nil {
+		k.TLSConfig.ClientCAs = x509.NewCertPool()
+	}
+
+	if !k.TLSConfig.ClientCAs.AppendCertsFromPEM([]byte(caPEM)) {
+		panic("kite: no CA certificates found in PEM data")
+	}
+
+	k.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+}
+
+// RequireClientCertFile is like RequireClientCert, but reads
+// the CA certificates from the given file.
+func (k *Kite) RequireClientCertFile(caFile string) {
+	caData, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		k.Log.Fatal("Cannot read CA certificate file: %s", err.Error())
+	}
+
+	k.RequireClientCert(string(caData))
+}
+
+// autoTLSConfig gives the TLS configuration of the kite server, which
+// obtains and renews certificates of the AutoTLS domains with ACME.
+// Other settings, e.g. required client certificates, are retained.
+func (k *Kite) autoTLSConfig(at *config.AutoTLS) (*tls.Config, error) {
+	if len(at.Domains) == 0 {
+		return nil, errors.New("kite: no AutoTLS domains configured")
+	}
+
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(at.Domains...),
+		Email:      at.Email,
+	}
+
+	if at.CacheDir != "" {
+		m.Cache = autocert.DirCache(at.CacheDir)
+	}
+
+	if at.DirectoryURL != "" {
+		m.Client = &acme.Client{DirectoryURL: at.DirectoryURL}
+	}
+
+	tlsConfig := &tls.Config{}
+	if k.TLSConfig != nil {
+		tlsConfig = k.TLSConfig.Clone()
+	}
+
+	tlsConfig.GetCertificate = m.GetCertificate
+
+	// Accept TLS-ALPN-01 challenges of the certificate authority.
+	if tlsConfig.NextProtos == nil {
+		tlsConfig.NextProtos = []string{"http/1.1"}
+	}
+	tlsConfig.NextProtos = append(tlsConfig.NextProtos, acme.ALPNProto)
+
+	return tlsConfig, nil
+}
+
+// AuthenticateFromCert authenticates the user from the verified TLS client
+// certificate of the connection. The username is given by
+// k.UsernameFromCert, or CertUsername if it is nil.
+//
+// It is the authenticator for the "tls" authentication type, which is
+// also used for requests without authentication information sent over
+// a connection with a verified client certificate.
+func (k *Kite) AuthenticateFromCert(r *Request) error {
+	cert := peerCert(r)
+	if cert == nil {
+		return errors.New("no verified client certificate")
+	}
+
+	fn := k.UsernameFromCert
+	if fn == nil {
+		fn = CertUsername
+	}
+
+	username, err := fn(cert)
+	if err != nil {
+		return err
+	}
+
+	r.Username = username
+
+	return nil
+}
+
+// CertUsername gives the username identified by the certificate, which is,
+// in order of precedence:
+//
+//   - the first URI SAN, e.g. a SPIFFE ID like
+//     spiffe://example.org/ns/prod/sa/alice, as a whole, so identities
+//     of different trust domains or namespaces do not collide
+//   - the first DNS SAN
+//   - the first email address SAN
+//   - the subject common name
+//
+// Kite.UsernameFromCert can map URI SANs to shorter usernames, e.g.
+// the last path element of the SPIFFE IDs of a single trust domain.
+func CertUsername(cert *x509.Certificate) (string, error) {
+	var username string
+
+	switch {
+	case len(cert.URIs) != 0:
+		username = cert.URIs[0].String()
+	case len(cert.DNSNames) != 0:
+		username = cert.DNSNames[0]
+	case len(cert.EmailAddresses) != 0:
+		username = cert.EmailAddresses[0]
+	default:
+		username = cert.Subject.CommonName
+	}
+
+	if username == "" {
+		return "", errors.New("no username found in client certificate")
+	}
+
+	return username, nil
+}
+
+// peerCert gives the verified client certificate of the connection
+// the request came from, or nil if there's none.
+func peerCert(r *Request) *x509.Certificate {
+	session := r.Client.getSession()
+	if session == nil || session.Request() == nil {
+		return nil
+	}
+
+	state := session.Request().TLS
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+
+	return state.VerifiedChains[0][0]
+}
+
+// clientCertConfig gives a copy of the config, which presents
+// cfg.ClientCertificates when connecting over TLS.
+func clientCertConfig(cfg *config.Config) *config.Config {
+	if len(cfg.ClientCertificates) == 0 {
+		return cfg
+	}
+
+	certs := cfg.ClientCertificates
+
+	withCerts := func(c *tls.Config) *tls.Config {
+		if c == nil {
+			c = &tls.Config{}
+		} else {
+			c = c.Clone()
+		}
+
+		c.Certificates = certs
+		return c
+	}
+
+	cfg = cfg.Copy()
+
+	if cfg.Websocket != nil {
+		cfg.Websocket.TLSClientConfig = withCerts(cfg.Websocket.TLSClientConfig)
+	}
+
+	if cfg.XHR != nil {
+		transport := cfg.XHR.Transport
+		if transport == nil {
+			transport = http.DefaultTransport
+		}
+
+		if t, ok := transport.(*http.Transport); ok {
+			t = t.Clone()
+			t.TLSClientConfig = withCerts(t.TLSClientConfig)
+			cfg.XHR.Transport = t
+		}
+	}
+
+	return cfg
+}
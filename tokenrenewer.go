@@ -1,22 +1,44 @@
 package kite
 
 import (
+	"errors"
 	"fmt"
+	"math/rand"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/cenkalti/backoff"
 	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/koding/kite/kitekey"
 	"github.com/koding/kite/protocol"
 )
 
 const (
-	renewBefore   = 30 * time.Second
-	retryInterval = 10 * time.Second
+	// renewBefore is how long before the expiry the token is renewed,
+	// at most a third of the validity left for short-lived tokens.
+	renewBefore = 30 * time.Second
+
+	// renewJitter renews the token earlier by a random fraction
+	// of the wait, so clients given their tokens at the same time
+	// do not renew them all at once.
+	renewJitter = 0.1
+
+	// Failed renewals are retried with exponential backoff, starting
+	// at minRetryInterval until it reaches retryInterval.
+	minRetryInterval = time.Second
+	retryInterval    = 10 * time.Second
 )
 
 // TokenRenewer renews the token of a Client just before it expires.
+//
+// Failed renewals are retried until they succeed or the client
+// disconnects, the client keeps using its current token meanwhile.
+// Renewals failing because the kite is no longer registered with
+// Kontrol are not retried, until the token is reported expired.
+// Calls failing with an expired token are retryable, see
+// IsRetryableCall, so clients with a RetryPolicy retry them
+// with the renewed token.
 type TokenRenewer struct {
 	client           *Client
 	localKite        *Kite
@@ -25,6 +47,10 @@ type TokenRenewer struct {
 	disconnect       chan struct{}
 	once             sync.Once // for c.installHandlers
 	renewLoopWG      sync.WaitGroup
+
+	// getToken gets a new token, it is localKite.GetToken
+	// unless replaced by tests.
+	getToken func(*protocol.Kite) (string, error)
 }
 
 func NewTokenRenewer(r *Client, k *Kite) (*TokenRenewer, error) {
@@ -33,6 +59,7 @@ func NewTokenRenewer(r *Client, k *Kite) (*TokenRenewer, error) {
 		localKite:        k,
 		signalRenewToken: make(chan struct{}),
 		disconnect:       make(chan struct{}),
+		getToken:         k.GetToken,
 	}
 	return t, t.parse(r.Auth.Key)
 }
@@ -71,45 +98,100 @@ func (t *TokenRenewer) installHandlers() {
 	t.client.OnDisconnect(t.sendDisconnectSignal)
 }
 
+// renewLoop renews the token before it expires, or when the remote kite
+// tells it expired, until the remote kite disconnects.
 func (t *TokenRenewer) renewLoop() {
 	t.renewLoopWG.Add(1)
 	defer t.renewLoopWG.Done()
 
-	// renews token before it expires (sends the first signal to the goroutine below)
-	go time.AfterFunc(t.renewDuration(), t.sendRenewTokenSignal)
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = minRetryInterval
+	b.MaxInterval = retryInterval
+	b.MaxElapsedTime = 0 // retry until disconnected
+	b.Reset()
+
+	timer := time.NewTimer(t.renewDuration())
+	defer timer.Stop()
+
+	attempt := 0
 
-	// renew token on signal util remote kite disconnects.
 	for {
 		select {
+		case <-timer.C:
 		case <-t.signalRenewToken:
-			switch err := t.renewToken(); {
-			case err == nil:
-				go time.AfterFunc(t.renewDuration(), t.sendRenewTokenSignal)
-			case err == ErrNoKitesAvailable || strings.Contains(err.Error(), "no kites found"):
+			// A failed renewal is retried after the backoff, even if
+			// the remote kite rejects further calls with the expired
+			// token meanwhile, so the kontrol is not flooded when
+			// it is unavailable.
+			if attempt != 0 {
+				continue
+			}
+
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+		case <-t.disconnect:
+			return
+		}
+
+		if err := t.renewToken(); err != nil {
+			if errors.Is(err, ErrNoKitesAvailable) || strings.Contains(err.Error(), "no kites found") {
 				// If kite went down we're not going to renew the token,
-				// as we need to dial either way.
+				// as we need to dial either way. The renewal is attempted
+				// again only when an expired token is detected.
 				//
 				// This case handles a situation, when kite missed
 				// disconnect signal (observed to happen with XHR transport).
-			default:
-				t.localKite.Log.Error("token renewer: %s Cannot renew token for Kite: %s I will retry in %d seconds...",
-					err, t.client.ID, retryInterval/time.Second)
-				// Need to sleep here litle bit because a signal is sent
-				// when an expired token is detected on incoming request.
-				// This sleep prevents the signal from coming too fast.
-				time.Sleep(1 * time.Second)
-				go time.AfterFunc(retryInterval, t.sendRenewTokenSignal)
+				t.localKite.Log.Warning("token renewer: Kite %s is not available, not renewing its token: %s",
+					t.client.ID, err)
+
+				attempt = 0
+				b.Reset()
+				continue
 			}
-		case <-t.disconnect:
-			return
+
+			attempt++
+			delay := b.NextBackOff()
+
+			t.localKite.Log.Warning("token renewer: Cannot renew token for Kite %s (attempt %d): %s, retrying in %s",
+				t.client.ID, attempt, err, delay)
+
+			t.client.callOnTokenRenewFailureHandlers(attempt, err)
+
+			timer.Reset(delay)
+			continue
 		}
+
+		attempt = 0
+		b.Reset()
+
+		timer.Reset(t.renewDuration())
 	}
 }
 
 // The duration from now to the time token needs to be renewed.
 // Needs to be calculated after renewing the token.
 func (t *TokenRenewer) renewDuration() time.Duration {
-	return t.validUntil.Add(-renewBefore).Sub(time.Now().UTC())
+	left := time.Until(t.validUntil)
+	if left <= 0 {
+		return 0
+	}
+
+	before := renewBefore
+	if before > left/3 {
+		before = left / 3
+	}
+
+	d := left - before
+
+	if jitter := int64(float64(d) * renewJitter); jitter > 0 {
+		d -= time.Duration(rand.Int63n(jitter))
+	}
+
+	return d
 }
 
 func (t *TokenRenewer) startRenewLoop() {
@@ -146,7 +228,7 @@ func (t *TokenRenewer) renewToken() error {
 		ID: t.client.Kite.ID,
 	}
 
-	token, err := t.localKite.GetToken(renew)
+	token, err := t.getToken(renew)
 	if err != nil {
 		return err
 	}
@@ -160,6 +242,7 @@ func (t *TokenRenewer) renewToken() error {
 	t.client.authMu.Unlock()
 
 	t.client.callOnTokenRenewHandlers(token)
+	t.client.callOnTokenRenewedHandlers(token, t.validUntil)
 
 	return nil
 }
@@ -0,0 +1,184 @@
+package kite
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/koding/kite/kitekey"
+	"github.com/koding/kite/protocol"
+	"github.com/koding/kite/testkeys"
+)
+
+func newTestToken(t *testing.T, validFor time.Duration) string {
+	claims := &kitekey.KiteClaims{
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    "testuser",
+			Subject:   "testuser",
+			IssuedAt:  time.Now().UTC().Unix(),
+			ExpiresAt: time.Now().Add(validFor).UTC().Unix(),
+		},
+	}
+
+	token, err := kitekey.Sign(claims, testkeys.Private)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return token
+}
+
+func TestTokenRenewer_RenewDuration(t *testing.T) {
+	k := New("testkite", "0.0.1")
+	k.Config.KontrolKey = testkeys.Public
+	k.Config.KontrolUser = "testuser"
+
+	cases := map[time.Duration][2]time.Duration{
+		time.Hour:        {(time.Hour - renewBefore) * 9 / 10, time.Hour - renewBefore},
+		30 * time.Second: {18 * time.Second, 20 * time.Second},
+	}
+
+	for validFor, want := range cases {
+		r, err := NewTokenRenewer(&Client{Auth: &Auth{Type: "token", Key: newTestToken(t, validFor)}}, k)
+		if err != nil {
+			t.Fatalf("NewTokenRenewer()=%s", err)
+		}
+
+		// The expiry is stored with a second precision.
+		if d := r.renewDuration(); d < want[0]-time.Second || d > want[1] {
+			t.Errorf("%s: got %s, want in [%s, %s] range", validFor, d, want[0], want[1])
+		}
+	}
+}
+
+func TestTokenRenewer_Retry(t *testing.T) {
+	k := New("testkite", "0.0.1")
+	k.Config.KontrolKey = testkeys.Public
+	k.Config.KontrolUser = "testuser"
+	c := k.NewClient("http://127.0.0.1:1/kite")
+	c.Kite = protocol.Kite{ID: "remote"}
+	c.Auth = &Auth{Type: "token", Key: newTestToken(t, time.Second)}
+
+	r, err := NewTokenRenewer(c, k)
+	if err != nil {
+		t.Fatalf("NewTokenRenewer()=%s", err)
+	}
+
+	renewed := newTestToken(t, time.Hour)
+	errKontrol := errors.New("kontrol is unavailable")
+
+	var mu sync.Mutex
+	var calls int
+
+	r.getToken = func(kite *protocol.Kite) (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if kite.ID != "remote" {
+			t.Errorf("got %q kite, want remote", kite.ID)
+		}
+
+		if calls++; calls == 1 {
+			return "", errKontrol
+		}
+
+		return renewed, nil
+	}
+
+	failures := make(chan int, 1)
+	c.OnTokenRenewFailure(func(attempt int, err error) {
+		if err != errKontrol {
+			t.Errorf("got %v, want %v", err, errKontrol)
+		}
+		failures <- attempt
+	})
+
+	done := make(chan time.Time, 1)
+	c.OnTokenRenewed(func(token string, expiresAt time.Time) {
+		if token != renewed {
+			t.Error("got unexpected renewed token")
+		}
+		done <- expiresAt
+	})
+
+	r.startRenewLoop()
+	defer r.sendDisconnectSignal()
+
+	select {
+	case attempt := <-failures:
+		if attempt != 1 {
+			t.Fatalf("got %d attempt, want 1", attempt)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the renewal to fail")
+	}
+
+	select {
+	case expiresAt := <-done:
+		if d := time.Until(expiresAt); d < 59*time.Minute {
+			t.Fatalf("got token expiring in %s, want 1h", d)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the renewal to be retried")
+	}
+
+	if key := c.authCopy().Key; key != renewed {
+		t.Fatal("expected the client to use the renewed token")
+	}
+
+	expired := &Error{Type: "authenticationError", Message: "token is expired"}
+	if !IsRetryableCall(expired) {
+		t.Fatal("expected calls with expired token to be retryable")
+	}
+}
+
+func TestTokenRenewer_NoKites(t *testing.T) {
+	k := New("testkite", "0.0.1")
+	k.Config.KontrolKey = testkeys.Public
+	k.Config.KontrolUser = "testuser"
+	c := k.NewClient("http://127.0.0.1:1/kite")
+	c.Kite = protocol.Kite{ID: "remote"}
+	c.Auth = &Auth{Type: "token", Key: newTestToken(t, time.Second)}
+
+	r, err := NewTokenRenewer(c, k)
+	if err != nil {
+		t.Fatalf("NewTokenRenewer()=%s", err)
+	}
+
+	calls := make(chan struct{}, 10)
+	r.getToken = func(*protocol.Kite) (string, error) {
+		calls <- struct{}{}
+		return "", ErrNoKitesAvailable
+	}
+
+	c.OnTokenRenewFailure(func(attempt int, err error) {
+		t.Errorf("got failure of attempt %d: %s", attempt, err)
+	})
+
+	r.startRenewLoop()
+	defer r.sendDisconnectSignal()
+
+	select {
+	case <-calls:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the renewal")
+	}
+
+	// The renewal is not retried while the remote kite is gone.
+	select {
+	case <-calls:
+		t.Fatal("expected the renewal not to be retried")
+	case <-time.After(2 * minRetryInterval):
+	}
+
+	// It is attempted again once an expired token is detected.
+	r.sendRenewTokenSignal()
+
+	select {
+	case <-calls:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the renewal")
+	}
+}
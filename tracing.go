@@ -0,0 +1,86 @@
+package kite
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation name of the kite tracer.
+const tracerName = "github.com/koding/kite"
+
+// defaultPropagator is used when Config.Propagator is nil.
+var defaultPropagator = propagation.NewCompositeTextMapPropagator(
+	propagation.TraceContext{},
+	propagation.Baggage{},
+)
+
+func (k *Kite) tracer() trace.Tracer {
+	tp := k.Config.TracerProvider
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+
+	return tp.Tracer(tracerName)
+}
+
+func (k *Kite) propagator() propagation.TextMapPropagator {
+	if k.Config.Propagator != nil {
+		return k.Config.Propagator
+	}
+
+	return defaultPropagator
+}
+
+// startSpan starts a span for the given method call.
+func (k *Kite) startSpan(ctx context.Context, method string, kind trace.SpanKind) (context.Context, trace.Span) {
+	return k.tracer().Start(ctx, method,
+		trace.WithSpanKind(kind),
+		trace.WithAttributes(
+			attribute.String("rpc.system", "kite"),
+			attribute.String("rpc.service", k.name),
+			attribute.String("rpc.method", method),
+		),
+	)
+}
+
+// injectTrace encodes the trace context of ctx, so it can be sent
+// to the remote kite. It returns nil if ctx does not carry any.
+func (k *Kite) injectTrace(ctx context.Context) map[string]string {
+	carrier := make(propagation.MapCarrier)
+
+	k.propagator().Inject(ctx, carrier)
+
+	if len(carrier) == 0 {
+		return nil
+	}
+
+	return carrier
+}
+
+// extractTrace decodes the trace context sent by the remote kite.
+func (k *Kite) extractTrace(ctx context.Context, carrier map[string]string) context.Context {
+	if len(carrier) == 0 {
+		return ctx
+	}
+
+	return k.propagator().Extract(ctx, propagation.MapCarrier(carrier))
+}
+
+// endSpan records the err, if any, and ends the span.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		if kiteErr, ok := err.(*Error); ok {
+			span.SetAttributes(attribute.String("kite.error.type", kiteErr.Type))
+		}
+
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
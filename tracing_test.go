@@ -0,0 +1,78 @@
+package kite
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracing(t *testing.T) {
+	serverSpans := tracetest.NewSpanRecorder()
+	clientSpans := tracetest.NewSpanRecorder()
+
+	k := New("testkite", "0.0.1")
+	k.Config.DisableAuthentication = true
+	k.Config.TracerProvider = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(serverSpans))
+
+	k.HandleFunc("foo", func(r *Request) (interface{}, error) {
+		if !trace.SpanContextFromContext(r.Ctx()).IsValid() {
+			t.Error("request context has no span")
+		}
+		return "bar", nil
+	})
+
+	go k.Run()
+	defer k.Close()
+	<-k.ServerReadyNotify()
+
+	e := New("exp", "0.0.1")
+	e.Config.TracerProvider = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(clientSpans))
+
+	c := e.NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", k.Port()))
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := c.TellWithTimeout("foo", 4*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	client := findSpan(clientSpans.Ended(), "foo", trace.SpanKindClient)
+	if client == nil {
+		t.Fatal("client span not found")
+	}
+
+	// The server span is ended after the response is sent.
+	var server sdktrace.ReadOnlySpan
+	for i := 0; i < 20 && server == nil; i++ {
+		if server = findSpan(serverSpans.Ended(), "foo", trace.SpanKindServer); server == nil {
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+
+	if server == nil {
+		t.Fatal("server span not found")
+	}
+
+	if got, want := server.Parent().SpanID(), client.SpanContext().SpanID(); got != want {
+		t.Errorf("got parent span %s, want %s", got, want)
+	}
+
+	if got, want := server.SpanContext().TraceID(), client.SpanContext().TraceID(); got != want {
+		t.Errorf("got trace %s, want %s", got, want)
+	}
+}
+
+func findSpan(spans []sdktrace.ReadOnlySpan, name string, kind trace.SpanKind) sdktrace.ReadOnlySpan {
+	for _, span := range spans {
+		if span.Name() == name && span.SpanKind() == kind {
+			return span
+		}
+	}
+	return nil
+}
@@ -1,9 +1,11 @@
 // Package tunnelproxy implements a reverse-proxy for kites behind firewall or NAT.
+//
+// Deprecated: Use the relay package instead, which does not require
+// the relayed kites to run a server.
 package tunnelproxy
 
 import (
 	"crypto/tls"
-	"errors"
 	"net"
 	"net/http"
 	"net/url"
@@ -14,6 +16,7 @@ import (
 
 	"github.com/koding/kite"
 	"github.com/koding/kite/config"
+	"github.com/koding/kite/kitekey"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/igm/sockjs-go/sockjs"
@@ -181,13 +184,6 @@ func (p *Proxy) handleProxy(session sockjs.Session, req *http.Request) {
 		return
 	}
 
-	// TODO(rjeczalik): keep *rsa.PrivateKey in Proxy struct
-	rsaPrivate, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(p.privKey))
-	if err != nil {
-		p.Kite.Log.Error("key pair encrypt error: %s", err)
-		return
-	}
-
 	tunnel := client.newTunnel(session)
 	defer tunnel.Close()
 
@@ -199,7 +195,8 @@ func (p *Proxy) handleProxy(session sockjs.Session, req *http.Request) {
 		"nbf": time.Now().UTC().Add(-leeway).Unix(),         // Not Before
 	}
 
-	signed, err := jwt.NewWithClaims(jwt.GetSigningMethod("RS256"), claims).SignedString(rsaPrivate)
+	// TODO(rjeczalik): keep parsed private key in Proxy struct
+	signed, err := kitekey.Sign(claims, p.privKey)
 	if err != nil {
 		p.Kite.Log.Error("Cannot sign token: %s", err.Error())
 		return
@@ -229,11 +226,16 @@ func (p *Proxy) handleTunnel(session sockjs.Session, req *http.Request) {
 	tokenString := req.URL.Query().Get("token")
 
 	getPublicKey := func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
-			return nil, errors.New("invalid signing method")
+		key, err := kitekey.ParsePublicKey(p.pubKey)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := kitekey.VerifyMethod(token, key); err != nil {
+			return nil, err
 		}
 
-		return jwt.ParseRSAPublicKeyFromPEM([]byte(p.pubKey))
+		return key, nil
 	}
 
 	token, err := jwt.Parse(tokenString, getPublicKey)
@@ -0,0 +1,136 @@
+package kite
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+)
+
+var (
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// typedHandler is a Handler that calls a function with
+// a typed argument, see HandleTyped for details.
+type typedHandler struct {
+	fn         reflect.Value
+	argType    reflect.Type // nil if fn takes no argument
+	resultType reflect.Type // nil if fn returns an interface
+}
+
+var _ Handler = (*typedHandler)(nil)
+
+// HandleTyped registers fn as a handler for the given method. The fn must be
+// a function of one of the following signatures:
+//
+//	func(context.Context) (Result, error)
+//	func(context.Context, Args) (Result, error)
+//
+// where Args is a type the first argument of the method call is unmarshaled
+// into and Result is the type of the response. The context is the one
+// returned by (*Request).Ctx. If the caller sends no arguments, fn
+// is called with a zero value of Args.
+//
+// Args is validated with Validate before fn is called, the caller gets
+// a "validationError" listing the invalid fields if it is not valid.
+//
+// HandleTyped panics if fn has a signature other than the above.
+func (k *Kite) HandleTyped(method string, fn interface{}) *Method {
+	h, err := newTypedHandler(fn)
+	if err != nil {
+		panic("kite: " + err.Error())
+	}
+
+	return k.addHandle(method, h)
+}
+
+func newTypedHandler(fn interface{}) (*typedHandler, error) {
+	v := reflect.ValueOf(fn)
+	t := v.Type()
+
+	if t.Kind() != reflect.Func {
+		return nil, fmt.Errorf("handler must be a function, got %s", t)
+	}
+
+	if t.NumIn() < 1 || t.NumIn() > 2 || t.In(0) != contextType {
+		return nil, fmt.Errorf("handler must accept context.Context and an optional argument, got %s", t)
+	}
+
+	if t.NumOut() != 2 || t.Out(1) != errorType {
+		return nil, fmt.Errorf("handler must return a result and an error, got %s", t)
+	}
+
+	h := &typedHandler{
+		fn: v,
+	}
+
+	if out := t.Out(0); out.Kind() != reflect.Interface {
+		h.resultType = out
+	}
+
+	if t.NumIn() == 2 {
+		h.argType = t.In(1)
+
+		if err := checkRules(h.argType, make(map[reflect.Type]bool)); err != nil {
+			return nil, err
+		}
+	}
+
+	return h, nil
+}
+
+// ServeKite implements the Handler interface.
+func (h *typedHandler) ServeKite(r *Request) (interface{}, error) {
+	in := []reflect.Value{reflect.ValueOf(r.Ctx())}
+
+	if h.argType != nil {
+		arg, err := h.unmarshalArg(r)
+		if err != nil {
+			return nil, err
+		}
+
+		in = append(in, arg)
+	}
+
+	out := h.fn.Call(in)
+
+	if err, ok := out[1].Interface().(error); ok && err != nil {
+		return nil, err
+	}
+
+	return out[0].Interface(), nil
+}
+
+func (h *typedHandler) unmarshalArg(r *Request) (reflect.Value, error) {
+	arg := reflect.New(h.argType)
+
+	if r.Args != nil {
+		args, err := r.Args.Slice()
+		if err != nil {
+			return reflect.Value{}, &Error{Type: "argumentError", Message: err.Error()}
+		}
+
+		// A null argument leaves the zero value, like it does
+		// with encoding/json.
+		if len(args) != 0 && args[0] != nil {
+			if err := args[0].Unmarshal(arg.Interface()); err != nil {
+				return reflect.Value{}, &Error{Type: "argumentError", Message: err.Error()}
+			}
+		}
+	}
+
+	// A nil pointer, when no argument or null is sent, is replaced with
+	// a pointer to the zero value, so that the required fields are
+	// reported and the handler does not get a nil pointer.
+	v := arg.Elem()
+	if v.Kind() == reflect.Ptr && v.IsNil() {
+		v = reflect.New(v.Type().Elem())
+	}
+
+	if err := Validate(v.Interface()); err != nil {
+		return reflect.Value{}, err
+	}
+
+	return v, nil
+}
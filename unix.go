@@ -0,0 +1,41 @@
+package kite
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/koding/kite/config"
+)
+
+// unixConfig gives the URL and a copy of the config, which are used for
+// connecting to a kite listening on the Unix domain socket given by
+// the unix:///path/to/socket URL.
+//
+// The kite is reached with regular HTTP requests, which
+// are sent over the socket instead of TCP.
+func unixConfig(u *url.URL, cfg *config.Config) (string, *config.Config) {
+	path := u.Path
+
+	dial := func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", path)
+	}
+
+	cfg = cfg.Copy()
+
+	if cfg.Websocket != nil {
+		cfg.Websocket.NetDial = nil
+		cfg.Websocket.NetDialContext = dial
+		cfg.Websocket.Proxy = nil
+	}
+
+	if cfg.XHR != nil {
+		cfg.XHR.Transport = &http.Transport{DialContext: dial}
+	}
+
+	// The host is not used for dialing, it's only sent
+	// in the Host header.
+	return "http://unix/kite", cfg
+}
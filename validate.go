@@ -0,0 +1,430 @@
+package kite
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// FieldError describes a field of a method argument, which failed
+// validation, see Validate.
+type FieldError struct {
+	// Field is the path of the field, made of the JSON names
+	// of the fields, e.g. "user.emails[0]".
+	Field string `json:"field"`
+
+	// Rule is the violated rule, e.g. "required" or "min".
+	Rule string `json:"rule"`
+
+	// Message describes the problem, e.g. "must be at least 1".
+	Message string `json:"message"`
+}
+
+func (e *FieldError) Error() string {
+	return e.Field + " " + e.Message
+}
+
+// Validate validates v, a struct or a pointer to it, with the rules set
+// by the validate tags of its fields, like:
+//
+//	type Args struct {
+//		Name string   `json:"name" validate:"required,max=64"`
+//		Age  int      `json:"age" validate:"min=1"`
+//		Role string   `json:"role,omitempty" validate:"omitempty,oneof=admin user"`
+//		Tags []string `json:"tags,omitempty" validate:"max=8"`
+//	}
+//
+// The rules are separated with commas:
+//
+//	required   the field must not be zero, nil or empty
+//	omitempty  the other rules are skipped if the field is zero, nil or empty
+//	min=N      numbers must be at least N, strings, slices and maps
+//	           must have at least N characters or elements
+//	max=N      numbers must be at most N, strings, slices and maps
+//	           must have at most N characters or elements
+//	len=N      strings, slices and maps must have exactly N characters
+//	           or elements, numbers must equal N
+//	oneof=A B  the field must be one of the space separated values
+//
+// Rules of pointer fields apply to the values they point to, except
+// for required and omitempty. The fields of nested structs, also those
+// in slices and maps, are validated as well.
+//
+// Validate returns a *Error of "validationError" type, which Fields
+// list the invalid fields, or nil if v is valid. Handlers registered
+// with HandleTyped have their arguments validated before being called.
+func Validate(v interface{}) error {
+	var val validator
+
+	if err := val.value("", reflect.ValueOf(v)); err != nil {
+		return err
+	}
+
+	if len(val.fields) == 0 {
+		return nil
+	}
+
+	msgs := make([]string, len(val.fields))
+	for i := range val.fields {
+		msgs[i] = val.fields[i].Error()
+	}
+
+	return &Error{
+		Type:    "validationError",
+		Message: "invalid arguments: " + strings.Join(msgs, "; "),
+		Fields:  val.fields,
+	}
+}
+
+// rule is a parsed rule of a validate tag.
+type rule struct {
+	name   string
+	param  string
+	n      float64  // parameter of min, max and len
+	values []string // parameter of oneof
+}
+
+// parseRules parses the validate tag of a field of type t.
+func parseRules(tag string, t reflect.Type) ([]rule, error) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	var rules []rule
+
+	for _, s := range strings.Split(tag, ",") {
+		name, param, _ := strings.Cut(strings.TrimSpace(s), "=")
+		r := rule{name: name, param: param}
+
+		switch name {
+		case "required", "omitempty":
+			if param != "" {
+				return nil, fmt.Errorf("rule %q takes no parameter", name)
+			}
+		case "min", "max", "len":
+			n, err := strconv.ParseFloat(param, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid parameter of rule %q: %q", name, param)
+			}
+
+			if _, ok := sizeOf(reflect.Zero(t)); !ok {
+				return nil, fmt.Errorf("rule %q cannot be applied to %s", name, t)
+			}
+
+			r.n = n
+		case "oneof":
+			if r.values = strings.Fields(param); len(r.values) == 0 {
+				return nil, fmt.Errorf("missing values of rule %q", name)
+			}
+
+			if !isScalar(t) {
+				return nil, fmt.Errorf("rule %q cannot be applied to %s", name, t)
+			}
+		case "":
+			continue
+		default:
+			return nil, fmt.Errorf("unknown rule %q", name)
+		}
+
+		rules = append(rules, r)
+	}
+
+	return rules, nil
+}
+
+// hasRule tells whether the validate tag has the rule.
+func hasRule(tag, name string) bool {
+	for _, s := range strings.Split(tag, ",") {
+		if rule, _, _ := strings.Cut(strings.TrimSpace(s), "="); rule == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkRules checks the validate tags of the fields of t, and of the
+// types it is made of, so the invalid ones are found when a handler
+// is registered rather than when it is called.
+func checkRules(t reflect.Type, seen map[reflect.Type]bool) error {
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Array, reflect.Map:
+		return checkRules(t.Elem(), seen)
+	case reflect.Struct:
+		if seen[t] {
+			return nil
+		}
+		seen[t] = true
+
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+
+			if !f.IsExported() && !f.Anonymous {
+				continue
+			}
+
+			if tag := f.Tag.Get("validate"); tag != "" && tag != "-" {
+				if _, err := parseRules(tag, f.Type); err != nil {
+					return fmt.Errorf("invalid validate tag of %s.%s: %s", t, f.Name, err)
+				}
+			}
+
+			if err := checkRules(f.Type, seen); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// validator collects the invalid fields of a value.
+type validator struct {
+	fields []FieldError
+}
+
+func (val *validator) add(path, rule, msg string) {
+	val.fields = append(val.fields, FieldError{
+		Field:   path,
+		Rule:    rule,
+		Message: msg,
+	})
+}
+
+// value validates the structs v is made of.
+func (val *validator) value(path string, v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+
+		return val.value(path, v.Elem())
+	case reflect.Struct:
+		return val.structFields(path, v)
+	case reflect.Slice, reflect.Array:
+		if isScalar(v.Type().Elem()) {
+			return nil
+		}
+
+		for i := 0; i < v.Len(); i++ {
+			if err := val.value(fmt.Sprintf("%s[%d]", path, i), v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if isScalar(v.Type().Elem()) {
+			return nil
+		}
+
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j])
+		})
+
+		for _, key := range keys {
+			if err := val.value(fmt.Sprintf("%s[%v]", path, key), v.MapIndex(key)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// structFields validates the fields of the struct v, the fields are
+// named like encoding/json names them.
+func (val *validator) structFields(path string, v reflect.Value) error {
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+
+		name, _, _ := strings.Cut(tag, ",")
+
+		if f.Anonymous && name == "" {
+			fv := v.Field(i)
+			if fv.Kind() == reflect.Ptr {
+				if fv.IsNil() {
+					continue
+				}
+				fv = fv.Elem()
+			}
+
+			if fv.Kind() == reflect.Struct {
+				if err := val.structFields(path, fv); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+
+		if !f.IsExported() {
+			continue
+		}
+
+		if name == "" {
+			name = f.Name
+		}
+
+		if path != "" {
+			name = path + "." + name
+		}
+
+		if tag := f.Tag.Get("validate"); tag != "" && tag != "-" {
+			if err := val.field(name, v.Field(i), tag); err != nil {
+				return fmt.Errorf("invalid validate tag of %s.%s: %s", t, f.Name, err)
+			}
+		}
+
+		if err := val.value(name, v.Field(i)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// field validates the field v with the rules of the tag.
+func (val *validator) field(path string, v reflect.Value, tag string) error {
+	rules, err := parseRules(tag, v.Type())
+	if err != nil {
+		return err
+	}
+
+	empty := isEmpty(v)
+
+	for _, r := range rules {
+		switch r.name {
+		case "omitempty":
+			if empty {
+				return nil
+			}
+		case "required":
+			if empty {
+				val.add(path, r.name, "is required")
+				return nil
+			}
+		}
+	}
+
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+
+	for _, r := range rules {
+		switch r.name {
+		case "min", "max", "len":
+			size, _ := sizeOf(v)
+
+			switch {
+			case r.name == "min" && size < r.n:
+				val.add(path, r.name, sizeMessage(v, "at least", r.param))
+			case r.name == "max" && size > r.n:
+				val.add(path, r.name, sizeMessage(v, "at most", r.param))
+			case r.name == "len" && size != r.n:
+				val.add(path, r.name, sizeMessage(v, "exactly", r.param))
+			}
+		case "oneof":
+			s := scalarString(v)
+			found := false
+
+			for _, value := range r.values {
+				if s == value {
+					found = true
+					break
+				}
+			}
+
+			if !found {
+				val.add(path, r.name, "must be one of: "+strings.Join(r.values, ", "))
+			}
+		}
+	}
+
+	return nil
+}
+
+// sizeOf gives the value of the number, or the length of the string,
+// slice or map, which the min, max and len rules compare.
+func sizeOf(v reflect.Value) (float64, bool) {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(v.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	case reflect.String:
+		return float64(utf8.RuneCountInString(v.String())), true
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return float64(v.Len()), true
+	default:
+		return 0, false
+	}
+}
+
+// sizeMessage describes the size v must have, e.g. "must be at least 1"
+// or "must have at most 8 elements".
+func sizeMessage(v reflect.Value, bound, n string) string {
+	switch v.Kind() {
+	case reflect.String:
+		return "must be " + bound + " " + n + " characters long"
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return "must have " + bound + " " + n + " elements"
+	default:
+		return "must be " + bound + " " + n
+	}
+}
+
+// scalarString gives the string, number or bool v as the oneof
+// rule compares it.
+func scalarString(v reflect.Value) string {
+	switch v.Kind() {
+	case reflect.String:
+		return v.String()
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(v.Uint(), 10)
+	default:
+		return strconv.FormatFloat(v.Float(), 'g', -1, 64)
+	}
+}
+
+// isEmpty tells whether v is zero, nil or empty.
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	default:
+		return v.IsZero()
+	}
+}
+
+// isScalar tells whether the values of t are strings, numbers or bools,
+// which contain no fields to validate.
+func isScalar(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Bool, reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,152 @@
+package kite
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	type Address struct {
+		City string `json:"city" validate:"required"`
+	}
+
+	type Embedded struct {
+		ID int `json:"id" validate:"min=1"`
+	}
+
+	type Args struct {
+		Embedded
+
+		Name      string             `json:"name" validate:"required,min=2,max=4"`
+		Role      string             `json:"role,omitempty" validate:"omitempty,oneof=admin user"`
+		Level     int                `validate:"oneof=1 2 3"`
+		Tags      []string           `json:"tags" validate:"max=2"`
+		Code      string             `json:"code,omitempty" validate:"omitempty,len=3"`
+		Limit     *float64           `json:"limit" validate:"max=1.5"`
+		Address   *Address           `json:"address" validate:"required"`
+		Addresses []Address          `json:"addresses"`
+		Named     map[string]Address `json:"named"`
+		Ignored   string             `json:"-" validate:"required"`
+		hidden    string             `validate:"required"`
+	}
+
+	limit := 2.0
+
+	cases := []struct {
+		name string
+		args interface{}
+		want []FieldError
+	}{{
+		name: "valid",
+		args: &Args{
+			Embedded: Embedded{ID: 1},
+			Name:     "kite",
+			Role:     "admin",
+			Level:    2,
+			Tags:     []string{"a", "b"},
+			Address:  &Address{City: "Warsaw"},
+		},
+	}, {
+		name: "zero",
+		args: Args{},
+		want: []FieldError{
+			{Field: "id", Rule: "min", Message: "must be at least 1"},
+			{Field: "name", Rule: "required", Message: "is required"},
+			{Field: "Level", Rule: "oneof", Message: "must be one of: 1, 2, 3"},
+			{Field: "address", Rule: "required", Message: "is required"},
+		},
+	}, {
+		name: "invalid",
+		args: &Args{
+			Embedded:  Embedded{ID: 1},
+			Name:      "kitekite",
+			Role:      "root",
+			Level:     1,
+			Tags:      []string{"a", "b", "c"},
+			Code:      "ab",
+			Limit:     &limit,
+			Address:   &Address{City: "Warsaw"},
+			Addresses: []Address{{City: "Berlin"}, {}},
+			Named:     map[string]Address{"home": {}},
+		},
+		want: []FieldError{
+			{Field: "name", Rule: "max", Message: "must be at most 4 characters long"},
+			{Field: "role", Rule: "oneof", Message: "must be one of: admin, user"},
+			{Field: "tags", Rule: "max", Message: "must have at most 2 elements"},
+			{Field: "code", Rule: "len", Message: "must be exactly 3 characters long"},
+			{Field: "limit", Rule: "max", Message: "must be at most 1.5"},
+			{Field: "addresses[1].city", Rule: "required", Message: "is required"},
+			{Field: "named[home].city", Rule: "required", Message: "is required"},
+		},
+	}, {
+		name: "not a struct",
+		args: 10,
+	}, {
+		name: "nil",
+		args: (*Args)(nil),
+	}}
+
+	for _, cas := range cases {
+		t.Run(cas.name, func(t *testing.T) {
+			err := Validate(cas.args)
+
+			if cas.want == nil {
+				if err != nil {
+					t.Fatalf("Validate()=%s", err)
+				}
+				return
+			}
+
+			e, ok := err.(*Error)
+			if !ok {
+				t.Fatalf("got %#v, want *Error", err)
+			}
+
+			if e.Type != "validationError" {
+				t.Errorf("got %q, want validationError", e.Type)
+			}
+
+			if !reflect.DeepEqual(e.Fields, cas.want) {
+				t.Errorf("got %+v, want %+v", e.Fields, cas.want)
+			}
+		})
+	}
+}
+
+func TestValidate_InvalidTags(t *testing.T) {
+	types := []interface{}{
+		struct {
+			A string `validate:"foo"`
+		}{},
+		struct {
+			A string `validate:"min=a"`
+		}{},
+		struct {
+			A bool `validate:"max=1"`
+		}{},
+		struct {
+			A []string `validate:"oneof=a b"`
+		}{},
+		struct {
+			A string `validate:"oneof="`
+		}{},
+		struct {
+			A string `validate:"required=1"`
+		}{},
+		struct {
+			A []struct {
+				B string `validate:"foo"`
+			}
+		}{},
+	}
+
+	for i, v := range types {
+		if err := checkRules(reflect.TypeOf(v), make(map[reflect.Type]bool)); err == nil {
+			t.Errorf("%d: expected error for %T", i, v)
+		}
+
+		if _, ok := Validate(v).(*Error); ok {
+			t.Errorf("%d: expected tag error for %T", i, v)
+		}
+	}
+}
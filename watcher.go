@@ -0,0 +1,245 @@
+package kite
+
+import (
+	"sync"
+
+	"github.com/koding/kite/dnode"
+	"github.com/koding/kite/protocol"
+)
+
+// Event is a change of a kite registration received by a Watcher.
+type Event struct {
+	protocol.KiteEvent
+
+	localKite *Kite
+}
+
+// Client gives a client for the kite that registered, ready to connect
+// with Client.Dial(). It must not be called for events other than
+// protocol.Register.
+func (e *Event) Client() *Client {
+	c := e.localKite.NewClient(e.URL)
+	c.URLs = e.URLs
+	c.Kite = e.Kite
+	c.Labels = e.Labels
+	c.Weight = e.Weight
+	c.Auth = &Auth{
+		Type: "token",
+		Key:  e.Token,
+	}
+
+	return c
+}
+
+// Watcher notifies about kites that register to or deregister
+// from Kontrol, see WatchKites.
+type Watcher struct {
+	k        *Kite
+	query    *protocol.KontrolQuery
+	onEvent  func(*Event, *Error)
+	callback dnode.Function
+
+	mu      sync.Mutex
+	id      string // ID of the watch on Kontrol's side
+	since   int64  // revision of the last received event
+	stopped bool
+
+	// Events received while the watch is being started are queued,
+	// so they are passed to onEvent after the listed kites.
+	pending bool
+	queue   []*protocol.KiteEvent
+}
+
+// WatchKites calls onEvent with protocol.Register events for kites matching
+// the query, that are registered to Kontrol, and then with an event
+// whenever a kite matching the query registers or deregisters.
+// Labels of the query are matched as well.
+//
+// When the kite reconnects to Kontrol, the watch is resumed and onEvent
+// is called only with the changes made in the meantime. If the watch
+// cannot be resumed, onEvent is called with protocol.Reset event
+// followed by events for all the kites matching the query. If watching
+// fails, onEvent is called with a nil event and the error.
+//
+// Watching kites requires Kontrol with a storage that supports it,
+// like EtcdV3.
+func (k *Kite) WatchKites(query protocol.KontrolQuery, onEvent func(*Event, *Error)) (*Watcher, error) {
+	if err := k.SetupKontrolClient(); err != nil {
+		return nil, err
+	}
+
+	<-k.kontrol.readyConnected
+
+	w := &Watcher{
+		k:       k,
+		query:   &query,
+		onEvent: onEvent,
+	}
+
+	w.callback = dnode.Callback(w.handleEvent)
+
+	if err := w.watch(); err != nil {
+		return nil, err
+	}
+
+	k.kontrol.OnConnect(func() {
+		go w.rewatch()
+	})
+
+	return w, nil
+}
+
+// Stop stops the watch, onEvent is not called afterwards.
+func (w *Watcher) Stop() error {
+	w.mu.Lock()
+	id := w.id
+	w.stopped = true
+	w.mu.Unlock()
+
+	_, err := w.k.kontrol.TellWithTimeout("cancelWatcher", w.k.Config.Timeout, id)
+	return err
+}
+
+// watch starts the watch on Kontrol, resuming the previous one
+// if any event was received.
+func (w *Watcher) watch() error {
+	w.mu.Lock()
+	since, stopped := w.since, w.stopped
+	w.pending = !stopped
+	w.mu.Unlock()
+
+	if stopped {
+		return nil
+	}
+
+	if err := w.start(since); err != nil {
+		w.mu.Lock()
+		w.pending = false
+		w.queue = nil
+		w.mu.Unlock()
+
+		return err
+	}
+
+	// Pass the queued events until there are no more.
+	for {
+		w.mu.Lock()
+		queue := w.queue
+		w.queue = nil
+		w.pending = len(queue) != 0
+		w.mu.Unlock()
+
+		if len(queue) == 0 {
+			return nil
+		}
+
+		for _, e := range queue {
+			w.emit(e)
+		}
+	}
+}
+
+// start starts the watch on Kontrol and passes the listed kites
+// to onEvent.
+func (w *Watcher) start(since int64) error {
+	args := protocol.GetKitesArgs{
+		Query:         w.query,
+		WatchCallback: w.callback,
+		Since:         since,
+		ProofKey:      w.k.ProofKey(),
+	}
+
+	result, err := w.k.kontrol.TellWithTimeout("getKites", w.k.Config.Timeout, args)
+	if err != nil {
+		return err
+	}
+
+	var res protocol.GetKitesResult
+	if err := result.Unmarshal(&res); err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	w.id = res.WatcherID
+	if res.Revision > w.since {
+		w.since = res.Revision
+	}
+	w.mu.Unlock()
+
+	for _, kite := range res.Kites {
+		w.onEvent(&Event{
+			KiteEvent: protocol.KiteEvent{
+				Action:   protocol.Register,
+				Kite:     kite.Kite,
+				URL:      kite.URL,
+				URLs:     kite.URLs,
+				Token:    kite.Token,
+				Labels:   kite.Labels,
+				Weight:   kite.Weight,
+				Revision: res.Revision,
+			},
+			localKite: w.k,
+		}, nil)
+	}
+
+	return nil
+}
+
+// rewatch starts the watch again, reporting failures to onEvent.
+func (w *Watcher) rewatch() {
+	if err := w.watch(); err != nil {
+		w.k.Log.Warning("Watching kites failed: %s", err)
+
+		e, ok := err.(*Error)
+		if !ok {
+			e = &Error{
+				Type:    "watchError",
+				Message: err.Error(),
+			}
+		}
+
+		w.onEvent(nil, e)
+	}
+}
+
+func (w *Watcher) handleEvent(arg *dnode.Partial) {
+	var e protocol.KiteEvent
+
+	if err := arg.One().Unmarshal(&e); err != nil {
+		w.k.Log.Error("invalid kite event: %s", err)
+		return
+	}
+
+	w.mu.Lock()
+	switch {
+	case e.Action == protocol.Reset:
+		w.since = 0
+	case e.Revision > w.since:
+		w.since = e.Revision
+	}
+
+	if w.pending {
+		w.queue = append(w.queue, &e)
+		w.mu.Unlock()
+		return
+	}
+	w.mu.Unlock()
+
+	w.emit(&e)
+}
+
+func (w *Watcher) emit(e *protocol.KiteEvent) {
+	w.mu.Lock()
+	stopped := w.stopped
+	w.mu.Unlock()
+
+	if stopped {
+		return
+	}
+
+	w.onEvent(&Event{KiteEvent: *e, localKite: w.k}, nil)
+
+	if e.Action == protocol.Reset {
+		go w.rewatch()
+	}
+}
@@ -0,0 +1,192 @@
+package kite
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/koding/kite/config"
+	"github.com/koding/kite/dnode"
+)
+
+// workerIdleTimeout is the time after which an idle handler
+// goroutine exits.
+const workerIdleTimeout = 30 * time.Second
+
+// maxQueuedCalls is the max number of calls waiting for a free handler
+// goroutine with OverflowQueue, the calls above it are rejected with
+// ErrOverloaded.
+const maxQueuedCalls = 1024
+
+// HandlerStats describes the goroutines executing method calls,
+// when their number is limited with Config.MaxHandlerGoroutines.
+type HandlerStats struct {
+	Running  int   // number of running goroutines, busy or idle
+	Queued   int   // number of calls waiting for a free goroutine
+	Rejected int64 // total number of calls rejected with ErrOverloaded
+}
+
+// workerPool executes method calls with a bounded number of goroutines.
+type workerPool struct {
+	slots  chan struct{}
+	work   chan func()
+	queue  chan func() // calls waiting for a free goroutine
+	reject bool
+
+	queued      int32 // accessed atomically
+	rejected    int64 // accessed atomically
+	dispatching int32 // accessed atomically, 1 if dispatch is running
+}
+
+func newWorkerPool(max int, overflow config.Overflow) *workerPool {
+	return &workerPool{
+		slots:  make(chan struct{}, max),
+		work:   make(chan func()),
+		queue:  make(chan func(), maxQueuedCalls),
+		reject: overflow == config.OverflowReject,
+	}
+}
+
+// run executes fn with an idle goroutine or starts a new one, if the
+// limit allows. Otherwise it queues fn or returns false, depending on
+// the overflow policy. It never blocks, so the caller can keep reading
+// messages, e.g. the ones that let the busy goroutines finish.
+func (p *workerPool) run(fn func()) bool {
+	if p.tryRun(fn) {
+		return true
+	}
+
+	if p.reject {
+		atomic.AddInt64(&p.rejected, 1)
+		return false
+	}
+
+	select {
+	case p.queue <- fn:
+		atomic.AddInt32(&p.queued, 1)
+	default:
+		atomic.AddInt64(&p.rejected, 1)
+		return false
+	}
+
+	if atomic.CompareAndSwapInt32(&p.dispatching, 0, 1) {
+		go p.dispatch()
+	}
+
+	return true
+}
+
+// tryRun executes fn with an idle goroutine or starts a new one, if the
+// limit allows and no calls are waiting. Otherwise it returns false,
+// without queueing fn.
+func (p *workerPool) tryRun(fn func()) bool {
+	// Calls already waiting go first.
+	if atomic.LoadInt32(&p.queued) != 0 {
+		return false
+	}
+
+	select {
+	case p.work <- fn:
+		return true
+	case p.slots <- struct{}{}:
+		go p.worker(fn)
+		return true
+	default:
+		return false
+	}
+}
+
+// dispatch hands the queued calls over to the goroutines, in the
+// order they were queued. It returns once the queue is empty.
+func (p *workerPool) dispatch() {
+	for {
+		select {
+		case fn := <-p.queue:
+			// Idle goroutines may exit meanwhile, so the freed
+			// slot is taken for a new one.
+			select {
+			case p.work <- fn:
+			case p.slots <- struct{}{}:
+				go p.worker(fn)
+			}
+
+			atomic.AddInt32(&p.queued, -1)
+		default:
+			atomic.StoreInt32(&p.dispatching, 0)
+
+			// A call may have been queued after the queue was
+			// found empty, but before the flag was cleared.
+			if len(p.queue) == 0 || !atomic.CompareAndSwapInt32(&p.dispatching, 0, 1) {
+				return
+			}
+		}
+	}
+}
+
+func (p *workerPool) worker(fn func()) {
+	defer func() { <-p.slots }()
+
+	t := time.NewTimer(workerIdleTimeout)
+	defer t.Stop()
+
+	for {
+		fn()
+
+		if !t.Stop() {
+			<-t.C
+		}
+		t.Reset(workerIdleTimeout)
+
+		select {
+		case fn = <-p.work:
+		case <-t.C:
+			return
+		}
+	}
+}
+
+func (p *workerPool) stats() HandlerStats {
+	return HandlerStats{
+		Running:  len(p.slots),
+		Queued:   int(atomic.LoadInt32(&p.queued)),
+		Rejected: atomic.LoadInt64(&p.rejected),
+	}
+}
+
+// workerPool gives the pool of goroutines executing method calls,
+// or nil if their number is not limited.
+func (k *Kite) workerPool() *workerPool {
+	k.workersOnce.Do(func() {
+		if n := k.Config.MaxHandlerGoroutines; n > 0 {
+			k.workers = newWorkerPool(n, k.Config.HandlerOverflow)
+		}
+	})
+
+	return k.workers
+}
+
+// HandlerStats gives statistics of the goroutines executing method
+// calls, e.g. for monitoring the number of queued calls. It gives
+// zero value if their number is not limited.
+func (k *Kite) HandlerStats() HandlerStats {
+	if p := k.workerPool(); p != nil {
+		return p.stats()
+	}
+
+	return HandlerStats{}
+}
+
+// goMethod executes the method call in a separate goroutine, bounded
+// by Config.MaxHandlerGoroutines. The protocol methods are not bounded,
+// since the calls holding the goroutines may wait for them, e.g. a
+// stream waiting for kite.streamAck.
+func (c *Client) goMethod(method *Method, name string, args *dnode.Partial, t *ticket) {
+	p := c.LocalKite.workerPool()
+	if p == nil || method.control {
+		go c.runMethod(method, name, args, t)
+		return
+	}
+
+	if !p.run(func() { c.runMethod(method, name, args, t) }) {
+		c.rejectMethod(method, name, args, t)
+	}
+}